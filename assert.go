@@ -0,0 +1,60 @@
+package lua
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// The compiler and the VM check their invariants with assert. A failed check
+// raises the error "assertion failure". Building with the tag lua_noassert
+// compiles the checks out; building with lua_debug adds the position in the
+// source being compiled, the running instruction and the Go stack to the
+// message:
+//
+//	go build -tags lua_noassert
+//	go test -tags lua_debug
+
+func (l *State) assert(cond bool) {
+	if checkAssertions && !cond {
+		l.assertionFailed("")
+	}
+}
+
+func (s *scanner) assert(cond bool) {
+	if checkAssertions && !cond {
+		s.l.assertionFailed(fmt.Sprintf("%s:%d", chunkID(s.source), s.lineNumber))
+	}
+}
+
+func (f *function) assert(cond bool) {
+	if checkAssertions && !cond {
+		f.p.scanner.assert(false)
+	}
+}
+
+// assertionFailed raises the error of a failed assertion. where is the
+// position of the compiler in the source, if it is compiling.
+func (l *State) assertionFailed(where string) {
+	msg := "assertion failure"
+	if assertDiagnostics {
+		msg += l.assertionDiagnostics(where)
+	}
+	l.runtimeError(msg)
+}
+
+func (l *State) assertionDiagnostics(where string) string {
+	var b strings.Builder
+	if where != "" {
+		fmt.Fprintf(&b, "\n\tcompiling %s", where)
+	}
+	if ci := l.callInfo; ci.isLua() {
+		p := l.prototype(ci)
+		if pc := int(ci.savedPC - 1); pc >= 0 && pc < len(p.code) {
+			fmt.Fprintf(&b, "\n\tinstruction %d of function <%s:%d>: %s", pc+1, chunkID(p.source), p.lineDefined, p.code[pc])
+		}
+	}
+	b.WriteString("\n\tgo stack:\n")
+	b.Write(debug.Stack())
+	return b.String()
+}
@@ -0,0 +1,9 @@
+//go:build lua_debug && !lua_noassert
+// +build lua_debug,!lua_noassert
+
+package lua
+
+const (
+	checkAssertions   = true
+	assertDiagnostics = true
+)
@@ -0,0 +1,9 @@
+//go:build lua_noassert
+// +build lua_noassert
+
+package lua
+
+const (
+	checkAssertions   = false
+	assertDiagnostics = false
+)
@@ -0,0 +1,9 @@
+//go:build !lua_noassert && !lua_debug
+// +build !lua_noassert,!lua_debug
+
+package lua
+
+const (
+	checkAssertions   = true
+	assertDiagnostics = false
+)
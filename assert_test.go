@@ -0,0 +1,28 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssert(t *testing.T) {
+	if !checkAssertions {
+		t.Skip("assertions are compiled out")
+	}
+	l := NewState()
+	l.PushGoFunction(func(l *State) int {
+		l.assert(true)
+		l.assert(false)
+		return 0
+	})
+	if err := l.ProtectedCall(0, 0, 0); err == nil {
+		t.Fatal("expected an assertion failure")
+	}
+	msg, _ := l.ToString(-1)
+	if !strings.Contains(msg, "assertion failure") {
+		t.Errorf("got %q", msg)
+	}
+	if diagnostics := strings.Contains(msg, "go stack:"); diagnostics != assertDiagnostics {
+		t.Errorf("go stack in message is %v, want %v: %q", diagnostics, assertDiagnostics, msg)
+	}
+}
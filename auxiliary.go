@@ -2,9 +2,9 @@ package lua
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 )
 
@@ -109,16 +109,15 @@ func Traceback(l, l1 *State, message string, level int) {
 // object at index. If the object does not have a metatable, or if the
 // metatable does not have this field, returns false and pushes nothing.
 func MetaField(l *State, index int, event string) bool {
-	if !l.MetaTable(index) {
+	mt := l.metaTableOf(l.indexToValue(index))
+	if mt == nil {
 		return false
 	}
-	l.PushString(event)
-	l.RawGet(-2)
-	if l.IsNil(-1) {
-		l.Pop(2) // remove metatable and metafield
+	v := mt.atString(event)
+	if v == nil {
 		return false
 	}
-	l.Remove(-2) // remove only metatable
+	l.apiPush(v)
 	return true
 }
 
@@ -419,6 +418,28 @@ func OptInteger(l *State, index, def int) int {
 	return CheckInteger(l, index)
 }
 
+// CheckInteger64 checks whether the function argument at index is a number
+// with an exact integer representation and returns it as an int64.
+func CheckInteger64(l *State, index int) int64 {
+	i, ok := l.ToInteger64(index)
+	if !ok {
+		if l.IsNumber(index) {
+			ArgumentError(l, index, "number has no integer representation")
+		}
+		tagError(l, index, TypeNumber)
+	}
+	return i
+}
+
+// OptInteger64 returns the integer at index as an int64. If the argument is
+// absent or nil, returns def. Otherwise, raises an error.
+func OptInteger64(l *State, index int, def int64) int64 {
+	if l.IsNoneOrNil(index) {
+		return def
+	}
+	return CheckInteger64(l, index)
+}
+
 func CheckUnsigned(l *State, index int) uint {
 	i, ok := l.ToUnsigned(index)
 	if !ok {
@@ -510,6 +531,62 @@ func Require(l *State, name string, f Function, global bool) {
 	}
 }
 
+// Unload undoes require or Require: it removes module name from
+// package.loaded, so the next require loads it again, and removes the
+// entries of the registry and the globals that refer to the module, if it
+// is a table or a function. Integer keys of the registry, which hosts use
+// to keep references, are left alone. It reports whether the module was
+// loaded.
+//
+// Once scripts drop their own references, the module and the prototypes of
+// its functions can be garbage collected. Unload also drops the closures
+// the functions of the module keep cached for reuse, so their upvalues are
+// released even while a stray reference keeps a prototype alive.
+func Unload(l *State, name string) bool {
+	SubTable(l, RegistryIndex, "_LOADED")
+	l.Field(-1, name)
+	if l.IsNil(-1) {
+		l.Pop(2)
+		return false
+	}
+	module := l.AbsIndex(-1)
+	l.PushNil()
+	l.SetField(-3, name)
+	l.PushGlobalTable()
+	// Other values, such as the true of a module that returns nothing, are
+	// not the module's own and may be stored for other reasons.
+	shared := !l.IsTable(module) && !l.IsFunction(module)
+	for _, t := range []int{RegistryIndex, l.Top()} {
+		var keys []value
+		for l.PushNil(); !shared && l.Next(t); l.Pop(1) {
+			if l.RawEqual(-1, module) && (t != RegistryIndex || !l.IsInteger(-2)) {
+				keys = append(keys, l.ToValue(-2))
+			}
+		}
+		for _, k := range keys {
+			l.apiPush(k)
+			l.PushNil()
+			l.RawSet(t)
+		}
+	}
+	releaseClosureCaches(l.ToValue(module))
+	if l.IsTable(module) {
+		for l.PushNil(); l.Next(module); l.Pop(1) {
+			releaseClosureCaches(l.ToValue(-1))
+		}
+	}
+	l.Pop(3)
+	return true
+}
+
+// releaseClosureCaches drops the cached closures of the prototypes of f, if
+// it is a Lua function.
+func releaseClosureCaches(f value) {
+	if c, ok := f.(*luaClosure); ok {
+		c.prototype.releaseCaches()
+	}
+}
+
 func NewLibraryTable(l *State, functions []RegistryFunction) { l.CreateTable(0, len(functions)) }
 
 func NewLibrary(l *State, functions []RegistryFunction) {
@@ -540,7 +617,7 @@ func skipComment(r *bufio.Reader) (bool, error) {
 }
 
 func LoadFile(l *State, fileName, mode string) error {
-	var f *os.File
+	var f File
 	fileNameIndex := l.Top() + 1
 	fileError := func(what string) error {
 		fileName, _ := l.ToString(fileNameIndex)
@@ -550,11 +627,11 @@ func LoadFile(l *State, fileName, mode string) error {
 	}
 	if fileName == "" {
 		l.PushString("=stdin")
-		f = os.Stdin
+		f = standardFile{l.global, 0}
 	} else {
 		l.PushString("@" + fileName)
 		var err error
-		if f, err = os.Open(fileName); err != nil {
+		if f, err = openFile(l, fileName, readOnly); err != nil {
 			return fileError("open")
 		}
 	}
@@ -574,12 +651,10 @@ func LoadFile(l *State, fileName, mode string) error {
 	}
 	s, _ := l.ToString(-1)
 	err := l.Load(r, s, mode)
-	if f != os.Stdin {
+	if fileName != "" {
 		_ = f.Close()
 	}
-	switch err {
-	case nil, SyntaxError, MemoryError: // do nothing
-	default:
+	if err != nil && !errors.Is(err, SyntaxError) && !errors.Is(err, MemoryError) {
 		l.SetTop(fileNameIndex)
 		return fileError("read")
 	}
@@ -603,7 +678,7 @@ func NewStateEx() *State {
 	if l != nil {
 		_ = AtPanic(l, func(l *State) int {
 			s, _ := l.ToString(-1)
-			fmt.Fprintf(os.Stderr, "PANIC: unprotected error in call to Lua API (%s)\n", s)
+			fmt.Fprintf(l.global.stderrWriter(), "PANIC: unprotected error in call to Lua API (%s)\n", s)
 			return 0
 		})
 	}
@@ -611,6 +686,14 @@ func NewStateEx() *State {
 }
 
 func LengthEx(l *State, index int) int {
+	switch v := l.indexToValue(index).(type) { // without __len, skip boxing the length
+	case *table:
+		if l.fastTagMethod(v.metaTable, tmLen) == nil {
+			return v.length()
+		}
+	case string:
+		return len(v)
+	}
 	l.Length(index)
 	if length, ok := l.ToInteger(-1); ok {
 		l.Pop(1)
@@ -628,7 +711,9 @@ func FileResult(l *State, err error, filename string) int {
 		return 1
 	}
 	l.PushNil()
-	if filename != "" {
+	if isTimeout(err) {
+		l.PushString("timeout")
+	} else if filename != "" {
 		l.PushString(filename + ": " + err.Error())
 	} else {
 		l.PushString(err.Error())
@@ -652,3 +737,62 @@ func DoString(l *State, s string) error {
 	}
 	return l.ProtectedCall(0, MultipleReturns, 0)
 }
+
+// The functions with the suffix E are variants of auxiliary functions that
+// return the error the original raises, as an *Error, instead of raising
+// it, for host code that must not panic. They leave the stack as they found
+// it. Go functions called from Lua should keep using the originals, so that
+// an error reaches the script.
+
+// catch calls f in protected mode and returns the error it raises as an
+// *Error, restoring the stack.
+func (l *State) catch(f func()) error {
+	top := l.top
+	err := l.protectedCall(f, top, 0)
+	if err != nil {
+		err = l.newError(err)
+		l.top = top
+	}
+	return err
+}
+
+// ToStringE converts the value at index to a string like ToStringMeta,
+// without pushing it, and returns the error of a failing __tostring
+// metamethod.
+func ToStringE(l *State, index int) (s string, err error) {
+	index = l.AbsIndex(index)
+	err = l.catch(func() {
+		s, _ = ToStringMeta(l, index)
+		l.Pop(1)
+	})
+	return
+}
+
+// CheckStringE is like CheckString, but returns its error.
+func CheckStringE(l *State, index int) (s string, err error) {
+	err = l.catch(func() { s = CheckString(l, index) })
+	return
+}
+
+// CheckNumberE is like CheckNumber, but returns its error.
+func CheckNumberE(l *State, index int) (n float64, err error) {
+	err = l.catch(func() { n = CheckNumber(l, index) })
+	return
+}
+
+// CheckIntegerE is like CheckInteger, but returns its error.
+func CheckIntegerE(l *State, index int) (i int, err error) {
+	err = l.catch(func() { i = CheckInteger(l, index) })
+	return
+}
+
+// CallE calls a function like ProtectedCall, but removes the error value
+// from the stack when it fails, so that the stack holds the results or
+// nothing. The *Error returned keeps the value.
+func CallE(l *State, argCount, resultCount int) error {
+	err := l.ProtectedCall(argCount, resultCount, 0)
+	if err != nil {
+		l.Pop(1)
+	}
+	return err
+}
@@ -1,11 +1,16 @@
 package lua
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestLoadFileSyntaxError(t *testing.T) {
+	skipWithoutOS(t)
 	l := NewState()
 	err := LoadFile(l, "fixtures/syntax_error.lua", "")
-	if err != SyntaxError {
+	if !errors.Is(err, SyntaxError) {
 		t.Error("didn't return SyntaxError on file with syntax error")
 	}
 	if l.Top() != 1 {
@@ -23,7 +28,7 @@ func TestLoadFileSyntaxError(t *testing.T) {
 func TestLoadStringSyntaxError(t *testing.T) {
 	l := NewState()
 	err := LoadString(l, "this_is_a_syntax_error")
-	if err != SyntaxError {
+	if !errors.Is(err, SyntaxError) {
 		t.Error("didn't return SyntaxError on string with syntax error")
 	}
 	if l.Top() != 1 {
@@ -37,3 +42,165 @@ func TestLoadStringSyntaxError(t *testing.T) {
 		t.Error("didn't push the correct error string")
 	}
 }
+
+func TestUnload(t *testing.T) {
+	testString(t, `
+		local loads = 0
+		package.preload.counter = function()
+			loads = loads + 1
+			local n = 0
+			return {next = function() n = n + 1 return n end}
+		end
+		local counter = require("counter")
+		assert(counter.next() == 1 and counter.next() == 2)
+		assert(package.unload("counter") == true)
+		assert(package.loaded.counter == nil)
+		assert(package.unload("counter") == false)
+		counter = require("counter")
+		assert(loads == 2 and counter.next() == 1)
+
+		DEBUG = true
+		package.preload.nothing = function() end
+		assert(require("nothing") == true and package.unload("nothing"))
+		assert(DEBUG == true, "unrelated true global removed")
+	`)
+
+	l := NewState()
+	OpenLibraries(l)
+	Require(l, "mod", func(l *State) int {
+		if err := LoadString(l, "return {f = function() return function() end end}"); err != nil {
+			t.Fatal(err)
+		}
+		l.Call(0, 1)
+		return 1
+	}, true)
+	l.PushValue(-1)
+	l.RawSetInt(RegistryIndex, 1000)
+	l.SetField(RegistryIndex, "mod.instance")
+	if err := DoString(l, "mod.f()"); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("mod")
+	l.Field(-1, "f")
+	f := l.ToValue(-1).(*luaClosure)
+	l.Pop(2)
+	if f.prototype.prototypes[0].cache == nil {
+		t.Fatal("no closure cached")
+	}
+	if !Unload(l, "mod") {
+		t.Fatal("module not loaded")
+	}
+	for _, get := range []func(){
+		func() { l.Global("mod") },
+		func() { l.Field(RegistryIndex, "mod.instance") },
+		func() { SubTable(l, RegistryIndex, "_LOADED"); l.Field(-1, "mod"); l.Remove(-2) },
+	} {
+		if get(); !l.IsNil(-1) {
+			t.Errorf("module still referenced: %v", l.ToValue(-1))
+		}
+		l.Pop(1)
+	}
+	if l.RawGetInt(RegistryIndex, 1000); !l.IsTable(-1) {
+		t.Error("integer registry key removed")
+	}
+	l.Pop(1)
+	if f.prototype.prototypes[0].cache != nil {
+		t.Error("cached closure not released")
+	}
+	if l.Top() != 0 {
+		t.Errorf("stack not balanced: %d", l.Top())
+	}
+}
+
+func TestLengthExAndMetaField(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		plain = {1, 2, 3}
+		sized = setmetatable({}, {__len = function() return 7 end, __name = "Sized"})
+		bad = setmetatable({}, {__len = function() return "x" end})
+		assert(table.unpack(sized, 1, 2) == nil and select("#", table.unpack(plain)) == 3)
+		local proxy = setmetatable({}, {__index = plain, __len = function() return #plain end})
+		local a, b, c = table.unpack(proxy)
+		assert(a == 1 and b == 2 and c == 3)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		global string
+		length int
+	}{{"plain", 3}, {"sized", 7}} {
+		l.Global(c.global)
+		if n := LengthEx(l, -1); n != c.length {
+			t.Errorf("LengthEx(%s) = %d", c.global, n)
+		}
+		l.Pop(1)
+	}
+	l.PushString("four")
+	if n := LengthEx(l, -1); n != 4 {
+		t.Errorf("LengthEx of a string = %d", n)
+	}
+	top := l.Top()
+	l.Global("plain")
+	if MetaField(l, -1, "__len") || l.Top() != top+1 {
+		t.Error("MetaField of a table without metatable")
+	}
+	l.Global("sized")
+	if !MetaField(l, -1, "__name") || l.Top() != top+3 {
+		t.Error("MetaField __name")
+	} else if s, _ := l.ToString(-1); s != "Sized" {
+		t.Errorf("__name is %q", s)
+	}
+	if MetaField(l, -2, "__index") || l.Top() != top+3 {
+		t.Error("MetaField of a missing field")
+	}
+	if err := DoString(l, `table.insert(bad, 1)`); err == nil || !strings.Contains(err.Error(), "object length is not an integer") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestErrorReturningVariants(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.PushString("s")
+	l.PushInteger(3)
+	l.PushNumber(2.5)
+	if err := DoString(l, `return setmetatable({}, {__tostring = function() error("no name") end})`); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := CheckStringE(l, 1); s != "s" || err != nil {
+		t.Errorf("CheckStringE: %q, %v", s, err)
+	}
+	if i, err := CheckIntegerE(l, 2); i != 3 || err != nil {
+		t.Errorf("CheckIntegerE: %d, %v", i, err)
+	}
+	if n, err := CheckNumberE(l, 3); n != 2.5 || err != nil {
+		t.Errorf("CheckNumberE: %v, %v", n, err)
+	}
+	if s, err := ToStringE(l, 2); s != "3" || err != nil {
+		t.Errorf("ToStringE: %q, %v", s, err)
+	}
+
+	var e *Error
+	if _, err := CheckIntegerE(l, 3); !errors.As(err, &e) || e.Message != "bad argument #3 (number has no integer representation)" {
+		t.Errorf("CheckIntegerE: %v", err)
+	}
+	if _, err := CheckStringE(l, 4); err == nil || !strings.Contains(err.Error(), "string expected, got table") {
+		t.Errorf("CheckStringE: %v", err)
+	}
+	if _, err := ToStringE(l, -1); err == nil || !strings.Contains(err.Error(), "no name") {
+		t.Errorf("ToStringE: %v", err)
+	}
+	if l.Top() != 4 {
+		t.Errorf("stack holds %d values, want 4", l.Top())
+	}
+
+	LoadString(l, "error('failed')")
+	if err := CallE(l, 0, 1); !errors.As(err, &e) || e.Value != `[string "error('failed')"]:1: failed` || l.Top() != 4 {
+		t.Errorf("CallE: %v, top %d", err, l.Top())
+	}
+	LoadString(l, "return 1")
+	if err := CallE(l, 0, 1); err != nil || l.Top() != 5 {
+		t.Errorf("CallE: %v, top %d", err, l.Top())
+	}
+}
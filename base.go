@@ -2,7 +2,6 @@ package lua
 
 import (
 	"io"
-	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -154,7 +153,7 @@ func baseWarn(l *State) int {
 		return 0
 	}
 	if l.warnEnabled {
-		os.Stderr.WriteString("Lua warning: " + text + "\n")
+		io.WriteString(l.global.stderrWriter(), "Lua warning: "+text+"\n")
 	}
 	return 0
 }
@@ -251,6 +250,7 @@ var baseLibrary = []RegistryFunction{
 		}
 		var err error
 		if s, ok := l.ToString(1); ok {
+			checkTags(l, "load", s)
 			err = LoadBuffer(l, s, OptString(l, 2, s), m)
 		} else {
 			chunkName := OptString(l, 2, "=(load)")
@@ -269,6 +269,7 @@ var baseLibrary = []RegistryFunction{
 	}},
 	{"print", func(l *State) int {
 		n := l.Top()
+		w := l.global.stdoutWriter()
 		l.Global("tostring")
 		for i := 1; i <= n; i++ {
 			l.PushValue(-1) // function to be called
@@ -280,13 +281,13 @@ var baseLibrary = []RegistryFunction{
 				panic("unreachable")
 			}
 			if i > 1 {
-				os.Stdout.WriteString("\t")
+				io.WriteString(w, "\t")
 			}
-			os.Stdout.WriteString(s)
+			io.WriteString(w, s)
 			l.Pop(1) // pop result
 		}
-		os.Stdout.WriteString("\n")
-		os.Stdout.Sync()
+		io.WriteString(w, "\n")
+		flushFile(w)
 		return 0
 	}},
 	{"rawequal", func(l *State) int {
@@ -0,0 +1,8 @@
+#!/bin/sh
+# escape.sh FILE... reads the output of go build -gcflags=-m and counts the
+# values of the given files that escape to the heap, by file and message,
+# leaving out the positions. See the Makefile in the parent directory.
+pattern=$(printf '%s\n' "$@" | sed 's/\./\\./g; s/^/^\\.\\\//; s/$/:/' | paste -sd '|' -)
+grep -E "$pattern" | grep -E 'escapes to heap|moved to heap' |
+	sed -E 's/^\.\/([^:]+):[0-9]+:[0-9]+: /\1: /' |
+	sort | uniq -c | sort -k2,2 -k1,1nr
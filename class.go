@@ -0,0 +1,300 @@
+package lua
+
+import "strings"
+
+// A class made by the class library is a table whose metatable, the class
+// metatable, holds:
+//
+//	__methods     the metatable of the instances, which holds the methods
+//	__declared    the fields assigned to the class itself
+//	__subclasses  a set of the classes that extend it
+//
+// The class table only holds its name and super, so that every assignment
+// to it goes through __newindex. Methods are inherited through the
+// metatable of __methods, whose __index is the __methods table of the super
+// class; metamethods, which Lua looks up without __index, are copied into
+// the subclasses that do not declare their own.
+
+// classReserved are the fields of the instance metatable that a class
+// cannot declare.
+var classReserved = map[string]bool{"__index": true, "__name": true, "__class": true}
+
+func isClass(l *State, index int) bool {
+	if !l.MetaTable(index) {
+		return false
+	}
+	l.PushString("__methods")
+	l.RawGet(-2)
+	ok := l.IsTable(-1)
+	l.Pop(2)
+	return ok
+}
+
+func checkClass(l *State, index int) {
+	if !isClass(l, index) {
+		typeError(l, index, "class")
+	}
+}
+
+// pushClassField pushes a field of the class metatable of the class at index.
+func pushClassField(l *State, index int, name string) {
+	l.MetaTable(index)
+	l.PushString(name)
+	l.RawGet(-2)
+	l.Remove(-2)
+}
+
+// pushSuper pushes the super class of the class at index, or nil.
+func pushSuper(l *State, index int) {
+	index = l.AbsIndex(index)
+	l.PushString("super")
+	l.RawGet(index)
+}
+
+func isMetamethod(l *State, key int) bool {
+	if l.TypeOf(key) != TypeString {
+		return false
+	}
+	s, _ := l.ToString(key)
+	return strings.HasPrefix(s, "__")
+}
+
+// newClass pushes a new class named name that extends the class at super,
+// or no class if super is 0.
+func newClass(l *State, name string, super int) {
+	l.CreateTable(0, 2)
+	c := l.Top()
+	l.PushString(name)
+	l.SetField(c, "name")
+	if super != 0 {
+		l.PushValue(super)
+		l.SetField(c, "super")
+	}
+	l.CreateTable(0, 8)
+	meta := l.Top()
+	l.NewTable()
+	methods := l.Top()
+	if super != 0 {
+		pushClassField(l, super, "__methods")
+		for l.PushNil(); l.Next(-2); l.Pop(1) {
+			if isMetamethod(l, -2) {
+				l.PushValue(-2)
+				l.PushValue(-2)
+				l.RawSet(methods)
+			}
+		}
+		l.CreateTable(0, 1)
+		l.Insert(-2)
+		l.SetField(-2, "__index")
+		l.SetMetaTable(methods)
+		pushClassField(l, super, "__subclasses")
+		l.PushValue(c)
+		l.PushBoolean(true)
+		l.RawSet(-3)
+		l.Pop(1)
+	}
+	l.PushValue(methods)
+	l.SetField(methods, "__index")
+	l.PushString(name)
+	l.SetField(methods, "__name")
+	l.PushValue(c)
+	l.SetField(methods, "__class")
+	l.PushValue(c)
+	l.SetField(methods, "class")
+	l.SetField(meta, "__methods")
+	l.NewTable()
+	l.SetField(meta, "__declared")
+	l.NewTable()
+	l.SetField(meta, "__subclasses")
+	SetFunctions(l, []RegistryFunction{
+		{"__index", classIndex},
+		{"__newindex", classNewIndex},
+		{"__call", classNew},
+		{"__tostring", classToString},
+	}, 0)
+	l.SetMetaTable(c)
+}
+
+func classToString(l *State) int {
+	l.PushString("name")
+	l.RawGet(1)
+	name, _ := l.ToString(-1)
+	l.PushString("class " + name)
+	return 1
+}
+
+func classIndex(l *State) int {
+	pushClassField(l, 1, "__methods")
+	l.PushValue(2)
+	l.Table(-2)
+	if !l.IsNil(-1) || l.TypeOf(2) != TypeString {
+		return 1
+	}
+	// new and extend are functions of the class, not methods of its
+	// instances, unless the class declares methods of the same name.
+	switch name, _ := l.ToString(2); name {
+	case "new":
+		l.PushGoFunction(classNew)
+	case "extend":
+		l.PushGoFunction(classExtend)
+	}
+	return 1
+}
+
+func classNewIndex(l *State) int {
+	if l.TypeOf(2) == TypeString {
+		if name, _ := l.ToString(2); classReserved[name] {
+			Errorf(l, "class: cannot declare '%s'", name)
+		}
+	}
+	pushClassField(l, 1, "__declared")
+	l.PushValue(2)
+	l.PushValue(3)
+	l.RawSet(-3)
+	if l.IsNil(3) && isMetamethod(l, 2) {
+		pushSuper(l, 1)
+		if !l.IsNil(-1) {
+			pushClassField(l, -1, "__methods")
+			l.PushValue(2)
+			l.RawGet(-2)
+			l.Replace(3) // the inherited metamethod replaces the removed one
+		}
+	}
+	inheritMethod(l, 1, 2, 3)
+	return 0
+}
+
+// inheritMethod sets the method key of the class at c to the value at v
+// and, for a metamethod, passes it on to the subclasses that do not
+// declare their own.
+func inheritMethod(l *State, c, key, v int) {
+	CheckStackWithMessage(l, 8, "too many subclasses")
+	top := l.Top()
+	pushClassField(l, c, "__methods")
+	l.PushValue(key)
+	l.PushValue(v)
+	l.RawSet(-3)
+	if isMetamethod(l, key) {
+		pushClassField(l, c, "__subclasses")
+		for l.PushNil(); l.Next(-2); l.Pop(1) {
+			sub := l.Top() - 1
+			pushClassField(l, sub, "__declared")
+			l.PushValue(key)
+			l.RawGet(-2)
+			declared := !l.IsNil(-1)
+			l.Pop(2)
+			if !declared {
+				inheritMethod(l, sub, key, v)
+			}
+		}
+	}
+	l.SetTop(top)
+}
+
+// classNew creates an instance of the class at index 1 and calls its init
+// method with the other arguments.
+func classNew(l *State) int {
+	checkClass(l, 1)
+	n := l.Top()
+	l.NewTable()
+	pushClassField(l, 1, "__methods")
+	l.SetMetaTable(-2)
+	instance := l.Top()
+	l.Field(instance, "init")
+	if l.IsNil(-1) {
+		l.Pop(1)
+		return 1
+	}
+	l.PushValue(instance)
+	for i := 2; i <= n; i++ {
+		l.PushValue(i)
+	}
+	l.Call(n, 0)
+	return 1
+}
+
+func classExtend(l *State) int {
+	checkClass(l, 1)
+	newClass(l, CheckString(l, 2), 1)
+	return 1
+}
+
+// isSubclass reports whether the class at a is the class at b or extends it.
+func isSubclass(l *State, a, b int) bool {
+	top := l.Top()
+	defer l.SetTop(top)
+	for l.PushValue(a); isClass(l, -1); l.Replace(-2) {
+		if l.RawEqual(-1, b) {
+			return true
+		}
+		pushSuper(l, -1)
+	}
+	return false
+}
+
+var classLibrary = []RegistryFunction{
+	{"isclass", func(l *State) int {
+		l.PushBoolean(isClass(l, 1))
+		return 1
+	}},
+	{"isinstance", func(l *State) int {
+		checkClass(l, 2)
+		ok := false
+		if l.MetaTable(1) {
+			l.PushString("__class")
+			l.RawGet(-2)
+			ok = isSubclass(l, -1, 2)
+		}
+		l.PushBoolean(ok)
+		return 1
+	}},
+	{"issubclass", func(l *State) int {
+		checkClass(l, 1)
+		checkClass(l, 2)
+		l.PushBoolean(isSubclass(l, 1, 2))
+		return 1
+	}},
+	{"metatable", func(l *State) int {
+		checkClass(l, 1)
+		pushClassField(l, 1, "__methods")
+		return 1
+	}},
+}
+
+// ClassOpen opens the class library, which provides classes with single
+// inheritance. It is not opened by OpenLibraries; pass it as a preloaded
+// library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "class", Function: lua.ClassOpen})
+//
+// The module is callable: class(name [, super]) returns a new class, as
+// does super:extend(name). Methods and metamethods are declared by
+// assigning them to the class; an instance is made with C(...) or
+// C:new(...), which calls the method init, if any, with the arguments. A
+// subclass inherits the methods and metamethods of its super class, also
+// those declared later, and calls overridden ones as C.super.method(self,
+// ...). Instances have the field class, and their metatable the field
+// __name, so that tostring and error messages show the class name unless
+// the class declares __tostring.
+//
+// The functions isclass(v), isinstance(v, C), issubclass(A, B) and
+// metatable(C) complete the module. metatable(C) returns the metatable of
+// the instances of C; a Go host can set it on a userdata to make the
+// userdata an instance of C.
+func ClassOpen(l *State) int {
+	NewLibrary(l, classLibrary)
+	l.CreateTable(0, 1)
+	l.PushGoFunction(func(l *State) int {
+		name := CheckString(l, 2)
+		super := 0
+		if !l.IsNoneOrNil(3) {
+			checkClass(l, 3)
+			super = 3
+		}
+		newClass(l, name, super)
+		return 1
+	})
+	l.SetField(-2, "__call")
+	l.SetMetaTable(-2)
+	return 1
+}
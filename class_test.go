@@ -0,0 +1,106 @@
+package lua
+
+import "testing"
+
+func TestClass(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"class", ClassOpen})
+	if err := DoString(l, `
+		local class = require("class")
+		local Animal = class("Animal")
+		function Animal:init(name) self.name = name end
+		function Animal:speak() return "..." end
+		function Animal:describe() return self.name .. " says " .. self:speak() end
+		Animal.__eq = function(a, b) return a.name == b.name end
+
+		local Dog = Animal:extend("Dog")
+		function Dog:init(name, breed)
+			Dog.super.init(self, name)
+			self.breed = breed
+		end
+		function Dog:speak() return "woof" end
+
+		local Puppy = class("Puppy", Dog)
+		local p = Puppy("rex", "pug")
+		assert(p.name == "rex" and p.breed == "pug")
+		assert(p:describe() == "rex says woof")
+		assert(Animal:new("x"):describe() == "x says ...")
+		assert(p.class == Puppy and Puppy.super == Dog and Puppy.name == "Puppy")
+
+		-- metamethods are inherited, also when declared later
+		assert(p == Puppy("rex"))
+		Animal.__len = function() return 42 end
+		assert(#p == 42)
+		Dog.__len = function() return 7 end
+		assert(#p == 7 and #Animal("a") == 42)
+		Dog.__len = nil
+		assert(#p == 42)
+
+		-- __name makes tostring show the class, __tostring overrides it
+		assert(tostring(p):match("^Puppy: "))
+		assert(tostring(Dog) == "class Dog")
+		Animal.__tostring = function(a) return "animal " .. a.name end
+		assert(tostring(p) == "animal rex")
+
+		assert(class.isclass(Dog) and not class.isclass({}) and not class.isclass(p))
+		assert(class.isinstance(p, Animal) and class.isinstance(p, Puppy))
+		assert(not class.isinstance(Animal("a"), Dog) and not class.isinstance({}, Animal))
+		assert(class.issubclass(Puppy, Animal) and class.issubclass(Dog, Dog))
+		assert(not class.issubclass(Animal, Dog))
+		assert(getmetatable(p) == class.metatable(Puppy))
+
+		-- methods do not leak to the class functions and back
+		assert(p.new == nil and p.extend == nil)
+		local ok, err = pcall(function() Dog.__index = {} end)
+		assert(not ok and err:match("cannot declare '__index'"))
+		ok, err = pcall(class.isinstance, p, {})
+		assert(not ok and err:match("class expected"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClassUserData checks that a Go host can make a userdata an instance
+// of a class.
+func TestClassUserData(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"class", ClassOpen})
+	if err := DoString(l, `
+		Point = require("class")("Point")
+		function Point:get(k) return field(self, k) end`); err != nil {
+		t.Fatal(err)
+	}
+	type point struct{ x, y int }
+	l.PushGoFunction(func(l *State) int {
+		l.PushUserData(&point{3, 4})
+		l.Global("require")
+		l.PushString("class")
+		l.Call(1, 1)
+		l.Field(-1, "metatable")
+		l.Global("Point")
+		l.Call(1, 1)
+		l.SetMetaTable(-3)
+		l.Pop(1)
+		return 1
+	})
+	l.SetGlobal("newpoint")
+	l.PushGoFunction(func(l *State) int {
+		p := l.ToUserData(1).(*point)
+		switch k, _ := l.ToString(2); k {
+		case "x":
+			l.PushInteger(p.x)
+		case "y":
+			l.PushInteger(p.y)
+		}
+		return 1
+	})
+	l.SetGlobal("field")
+	if err := DoString(l, `
+		local p = newpoint()
+		assert(require("class").isinstance(p, Point))
+		assert(tostring(p):match("^Point: "))
+		assert(p:get("x") == 3 and p:get("y") == 4)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,147 @@
+// Command glua-c compiles Lua source files into binary chunks, like luac.
+//
+// Usage:
+//
+//	glua-c [options] [filenames]
+//
+// The options are those of luac:
+//
+//	-l       list the instructions (-l -l also lists constants, locals and upvalues)
+//	-o name  write the chunk to name (default "luac.out"; "-" is stdout)
+//	-p       parse only, write no chunk
+//	-s       strip debug information
+//	-v       show the version
+//	--       stop handling options
+//	-        read the source from stdin
+//
+// As with luac, -l without -p also writes the chunk. The input may also be
+// a binary chunk, which can be listed or stripped. Unlike luac, glua-c
+// writes a chunk for one input file only; it does not combine several files
+// into one main function.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	lua "github.com/speedata/go-lua"
+)
+
+const usage = `usage: glua-c [options] [filenames]
+Available options are:
+  -l       list (use -l -l for full listing)
+  -o name  output to file 'name' (default is "luac.out")
+  -p       parse only
+  -s       strip debug information
+  -v       show version information
+  --       stop handling options
+  -        stop handling options and process stdin
+`
+
+type options struct {
+	list      int
+	output    string
+	parseOnly bool
+	strip     bool
+	version   bool
+	files     []string
+}
+
+func parseArgs(args []string) (*options, error) {
+	o := &options{output: "luac.out"}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		} else if arg == "-" || len(arg) == 0 || arg[0] != '-' {
+			break
+		}
+		switch arg {
+		case "-l":
+			o.list++
+		case "-o":
+			if i++; i >= len(args) || args[i] == "" || (args[i][0] == '-' && args[i] != "-") {
+				return nil, fmt.Errorf("'-o' needs argument")
+			}
+			o.output = args[i]
+		case "-p":
+			o.parseOnly = true
+		case "-s":
+			o.strip = true
+		case "-v":
+			o.version = true
+		default:
+			return nil, fmt.Errorf("unrecognized option '%s'", arg)
+		}
+	}
+	o.files = args[i:]
+	if len(o.files) == 0 && !o.version {
+		return nil, fmt.Errorf("no input files given")
+	}
+	if len(o.files) > 1 && !o.parseOnly {
+		return nil, fmt.Errorf("only one input file can be compiled into a chunk (use -p to check or list several)")
+	}
+	return o, nil
+}
+
+func run(o *options) error {
+	if o.version {
+		fmt.Printf("glua-c %s (go-lua)\n", lua.VersionString)
+		if len(o.files) == 0 {
+			return nil
+		}
+	}
+	l := lua.NewState()
+	for _, name := range o.files {
+		fileName := name
+		if name == "-" {
+			fileName = ""
+		}
+		if err := lua.LoadFile(l, fileName, ""); err != nil {
+			msg, _ := l.ToString(-1)
+			return fmt.Errorf("%s", msg)
+		}
+		if o.list > 0 {
+			if err := lua.ListChunk(l, os.Stdout, o.list > 1); err != nil {
+				return err
+			}
+		}
+		if !o.parseOnly {
+			var buf bytes.Buffer
+			if err := l.Dump(&buf, o.strip); err != nil {
+				return err
+			}
+			if err := writeOutput(o.output, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		l.Pop(1)
+	}
+	return nil
+}
+
+func writeOutput(name string, data []byte) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(name, data, 0666); err != nil {
+		return fmt.Errorf("cannot write %s: %v", name, err)
+	}
+	return nil
+}
+
+func main() {
+	o, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "glua-c: %v\n%s", err, usage)
+		os.Exit(1)
+	}
+	if err := run(o); err != nil {
+		fmt.Fprintf(os.Stderr, "glua-c: %v\n", err)
+		os.Exit(1)
+	}
+}
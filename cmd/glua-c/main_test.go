@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestParseArgs(t *testing.T) {
+	o, err := parseArgs([]string{"-l", "-l", "-s", "-o", "out.luac", "a.lua"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.list != 2 || !o.strip || o.output != "out.luac" || len(o.files) != 1 || o.files[0] != "a.lua" {
+		t.Errorf("unexpected options %+v", o)
+	}
+	if o, err := parseArgs([]string{"-p", "--", "-a.lua", "b.lua"}); err != nil || len(o.files) != 2 || o.files[0] != "-a.lua" {
+		t.Errorf("got %+v, %v", o, err)
+	}
+	if o, err := parseArgs([]string{"-"}); err != nil || o.files[0] != "-" {
+		t.Errorf("got %+v, %v", o, err)
+	}
+	for _, args := range [][]string{{}, {"-o"}, {"-x", "a.lua"}, {"a.lua", "b.lua"}} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded", args)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	if !lua.Features().Has("io") {
+		t.Skip("no files with lua_noos")
+	}
+	dir := t.TempDir()
+	source, output := filepath.Join(dir, "a.lua"), filepath.Join(dir, "a.luac")
+	if err := os.WriteFile(source, []byte("return 6 * 7"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(&options{output: output, strip: true, files: []string{source}}); err != nil {
+		t.Fatal(err)
+	}
+	l := lua.NewState()
+	if err := lua.LoadFile(l, output, "b"); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 1)
+	if n, _ := l.ToInteger(-1); n != 42 {
+		t.Errorf("chunk returned %d, want 42", n)
+	}
+
+	if err := os.WriteFile(source, []byte("return 6 *"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(&options{parseOnly: true, files: []string{source}}); err == nil {
+		t.Error("syntax error not reported")
+	}
+}
@@ -0,0 +1,92 @@
+// Command glua-fmt formats Lua source files, like gofmt.
+//
+// Usage:
+//
+//	glua-fmt [flags] [files]
+//
+// Without files, it formats stdin and writes the result to stdout. The
+// flags are:
+//
+//	-l         list the files whose formatting differs instead of printing them
+//	-w         write the result to the files instead of stdout
+//	-indent s  indent with s instead of a tab
+//
+// See package format for the layout it produces.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/speedata/go-lua/format"
+)
+
+var (
+	list   = flag.Bool("l", false, "list files whose formatting differs")
+	write  = flag.Bool("w", false, "write result to the source files")
+	indent = flag.String("indent", "\t", "indentation of one level")
+)
+
+func formatFile(name string, in io.Reader, out io.Writer) error {
+	src, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	res, err := (&format.Config{Indent: *indent}).Source(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if bytes.Equal(src, res) && (*list || *write) {
+		return nil
+	}
+	if *list {
+		fmt.Fprintln(out, name)
+	}
+	if *write {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(name, res, info.Mode().Perm())
+	}
+	if !*list {
+		_, err = out.Write(res)
+	}
+	return err
+}
+
+func run(files []string, stdin io.Reader, stdout io.Writer) error {
+	if len(files) == 0 {
+		if *write {
+			return fmt.Errorf("cannot use -w with standard input")
+		}
+		return formatFile("<standard input>", stdin, stdout)
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = formatFile(name, f, stdout)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: glua-fmt [flags] [files]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := run(flag.Args(), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "glua-fmt: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	messy, tidy := filepath.Join(dir, "messy.lua"), filepath.Join(dir, "tidy.lua")
+	for name, src := range map[string]string{messy: "x=1\n", tidy: "x = 1\n"} {
+		if err := os.WriteFile(name, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	if err := run(nil, strings.NewReader("do x=1 end"), &out); err != nil || out.String() != "do x = 1 end\n" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+
+	*list = true
+	out.Reset()
+	if err := run([]string{messy, tidy}, nil, &out); err != nil || out.String() != messy+"\n" {
+		t.Errorf("-l: got %q, %v", out.String(), err)
+	}
+	*list, *write = false, true
+	defer func() { *write = false }()
+	if err := run([]string{messy}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(messy); string(b) != "x = 1\n" {
+		t.Errorf("-w wrote %q", b)
+	}
+	if err := run(nil, strings.NewReader(""), &out); err == nil {
+		t.Error("-w with stdin succeeded")
+	}
+	if err := run([]string{filepath.Join(dir, "missing.lua")}, nil, &out); err == nil {
+		t.Error("missing file succeeded")
+	}
+}
@@ -0,0 +1,266 @@
+// Command glua is a stand-alone Lua interpreter, like lua.
+//
+// Usage:
+//
+//	glua [options] [script [args]]
+//
+// The options are those of lua:
+//
+//	-e stat  execute the string stat
+//	-i       enter interactive mode after running the script
+//	-l mod   require mod into the global mod; -l g=mod uses the global g
+//	-v       show the version
+//	-E       ignore the environment variables LUA_INIT_5_4 and LUA_INIT
+//	--       stop handling options
+//	-        run stdin as the script and stop handling options
+//
+// Without a script or -e, glua enters interactive mode if stdin is a
+// terminal and runs stdin otherwise. In interactive mode it reads
+// statements with line editing, prints the values of expressions and
+// accepts =expr as a shorthand for return expr; see package repl. The
+// optional libraries of go-lua, such as lpeg and regex, can be loaded with
+// require.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/go-lua/repl"
+)
+
+const usage = `usage: glua [options] [script [args]]
+Available options are:
+  -e stat   execute string 'stat'
+  -i        enter interactive mode after executing 'script'
+  -l mod    require library 'mod' into global 'mod'
+  -l g=mod  require library 'mod' into global 'g'
+  -v        show version information
+  -E        ignore environment variables
+  --        stop handling options
+  -         stop handling options and execute stdin
+`
+
+// An action is a -e or -l option, which run in the order given.
+type action struct {
+	execute bool   // -e, else -l
+	arg     string // the statement or module
+}
+
+type options struct {
+	interactive bool
+	version     bool
+	noEnv       bool
+	actions     []action
+	script      int // index of the script in args, or -1
+	args        []string
+}
+
+func parseArgs(args []string) (*options, error) {
+	o := &options{script: -1, args: args}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		} else if arg == "-" || len(arg) == 0 || arg[0] != '-' {
+			break
+		}
+		switch arg[:2] {
+		case "-i":
+			o.interactive, o.version = true, true
+		case "-v":
+			o.version = true
+		case "-E":
+			o.noEnv = true
+		case "-e", "-l":
+			value := arg[2:]
+			if value == "" {
+				if i++; i >= len(args) || args[i] == "" || args[i][0] == '-' {
+					return nil, fmt.Errorf("'%s' needs argument", arg)
+				}
+				value = args[i]
+			}
+			o.actions = append(o.actions, action{execute: arg[1] == 'e', arg: value})
+			continue
+		default:
+			return nil, fmt.Errorf("unrecognized option '%s'", arg)
+		}
+		if len(arg) > 2 {
+			return nil, fmt.Errorf("unrecognized option '%s'", arg)
+		}
+	}
+	if i < len(args) {
+		o.script = i
+	}
+	return o, nil
+}
+
+// interpreter runs the options in a Lua state.
+type interpreter struct {
+	l           *lua.State
+	stdin       *os.File
+	out, errOut io.Writer
+}
+
+func (it *interpreter) run(o *options) error {
+	l := it.l
+	lua.OpenLibraries(l, lua.OptionalLibraries...)
+	it.createArgTable(o)
+	if o.version {
+		fmt.Fprintf(it.out, "%s (%s)\n", lua.VersionString, lua.Implementation)
+	}
+	if !o.noEnv {
+		if err := it.runInit(); err != nil {
+			return err
+		}
+	}
+	for _, a := range o.actions {
+		if err := it.runAction(a); err != nil {
+			return err
+		}
+	}
+	if o.script >= 0 {
+		if err := it.runScript(o); err != nil {
+			return err
+		}
+	}
+	switch {
+	case o.interactive:
+		return it.repl()
+	case o.script < 0 && len(o.actions) == 0 && !o.version:
+		if isTerminal(it.stdin) {
+			fmt.Fprintf(it.out, "%s (%s)\n", lua.VersionString, lua.Implementation)
+			return it.repl()
+		}
+		return it.runChunk(lua.LoadFile(l, "", "bt"), 0)
+	}
+	return nil
+}
+
+// createArgTable sets the global arg: the script at index 0, its arguments
+// at positive and the interpreter's options at negative indices.
+func (it *interpreter) createArgTable(o *options) {
+	l := it.l
+	script := o.script
+	if script < 0 {
+		script = len(o.args)
+	}
+	l.CreateTable(len(o.args)-script, script+1)
+	l.PushString(os.Args[0])
+	l.RawSetInt(-2, -script-1)
+	for i, arg := range o.args {
+		l.PushString(arg)
+		l.RawSetInt(-2, i-script)
+	}
+	l.SetGlobal("arg")
+}
+
+func (it *interpreter) runInit() error {
+	name := "LUA_INIT_5_4"
+	init, ok := os.LookupEnv(name)
+	if !ok {
+		name = "LUA_INIT"
+		if init, ok = os.LookupEnv(name); !ok {
+			return nil
+		}
+	}
+	if strings.HasPrefix(init, "@") {
+		return it.runChunk(lua.LoadFile(it.l, init[1:], "bt"), 0)
+	}
+	return it.runChunk(lua.LoadBuffer(it.l, init, "="+name, "bt"), 0)
+}
+
+func (it *interpreter) runAction(a action) error {
+	l := it.l
+	if a.execute {
+		return it.runChunk(lua.LoadBuffer(l, a.arg, "=(command line)", "bt"), 0)
+	}
+	global, module := a.arg, a.arg
+	if i := strings.IndexByte(a.arg, '='); i >= 0 {
+		global, module = a.arg[:i], a.arg[i+1:]
+	}
+	l.Global("require")
+	l.PushString(module)
+	if err := it.call(1, 1); err != nil {
+		return err
+	}
+	l.SetGlobal(global)
+	return nil
+}
+
+func (it *interpreter) runScript(o *options) error {
+	l := it.l
+	name := o.args[o.script]
+	if name == "-" && (o.script == 0 || o.args[o.script-1] != "--") {
+		name = ""
+	}
+	if err := lua.LoadFile(l, name, "bt"); err != nil {
+		return it.runChunk(err, 0)
+	}
+	scriptArgs := o.args[o.script+1:]
+	for _, arg := range scriptArgs {
+		l.PushString(arg)
+	}
+	return it.call(len(scriptArgs), 0)
+}
+
+// runChunk runs the chunk that a load left on the stack, or reports the
+// load error err.
+func (it *interpreter) runChunk(err error, argCount int) error {
+	if err != nil {
+		return it.report()
+	}
+	return it.call(argCount, 0)
+}
+
+// call calls the function below argCount arguments with a traceback for
+// errors.
+func (it *interpreter) call(argCount, resultCount int) error {
+	l := it.l
+	base := l.Top() - argCount
+	l.PushGoFunction(repl.MessageHandler)
+	l.Insert(base)
+	err := l.ProtectedCall(argCount, resultCount, base)
+	l.Remove(base)
+	if err != nil {
+		return it.report()
+	}
+	return nil
+}
+
+// report takes the error message from the stack and returns it as an error.
+func (it *interpreter) report() error {
+	msg, ok := it.l.ToString(-1)
+	if !ok {
+		msg = fmt.Sprintf("(error object is a %s value)", lua.TypeNameOf(it.l, -1))
+	}
+	it.l.Pop(1)
+	return fmt.Errorf("%s", msg)
+}
+
+func (it *interpreter) repl() error {
+	return repl.Run(it.l, repl.NewTerminal(it.stdin, it.out), it.out)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func main() {
+	o, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "glua: %v\n%s", err, usage)
+		os.Exit(1)
+	}
+	it := &interpreter{l: lua.NewState(), stdin: os.Stdin, out: os.Stdout, errOut: os.Stderr}
+	if err := it.run(o); err != nil {
+		fmt.Fprintf(it.errOut, "glua: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestParseArgs(t *testing.T) {
+	o, err := parseArgs([]string{"-e", "x = 1", "-lm", "-i", "script.lua", "-e", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.interactive || !o.version || o.script != 4 || len(o.actions) != 2 || o.actions[1] != (action{arg: "m"}) {
+		t.Errorf("unexpected options %+v", o)
+	}
+	if o, err := parseArgs([]string{"-v", "--", "-s.lua"}); err != nil || o.script != 2 {
+		t.Errorf("got %+v, %v", o, err)
+	}
+	if o, err := parseArgs(nil); err != nil || o.script != -1 {
+		t.Errorf("got %+v, %v", o, err)
+	}
+	for _, args := range [][]string{{"-e"}, {"-l", "-i"}, {"-x"}, {"-iv"}} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q) succeeded", args)
+		}
+	}
+}
+
+func interpret(t *testing.T, args ...string) (string, error) {
+	t.Setenv("LUA_INIT_5_4", "init = 'set'")
+	o, err := parseArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	l := lua.NewState()
+	lua.SetStdout(l, &out)
+	it := &interpreter{l: l, stdin: os.Stdin, out: &out, errOut: &out}
+	err = it.run(o)
+	return out.String(), err
+}
+
+func TestRun(t *testing.T) {
+	if !lua.Features().Has("io") {
+		t.Skip("no files with lua_noos")
+	}
+	script := filepath.Join(t.TempDir(), "script.lua")
+	if err := os.WriteFile(script, []byte("print(init, arg[0] == ..., select('#', ...), ..., arg[-1], arg[2])"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := interpret(t, "-e", "x = 6", "-l", "s=string", "-e", "print(s.rep('a', x))", script, script, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aaaaaa\nset\ttrue\t2\t" + script + "\tprint(s.rep('a', x))\tb\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+
+	if _, err := interpret(t, "-E", "-e", "assert(init == nil)"); err != nil {
+		t.Error(err)
+	}
+	if out, _ := interpret(t, "-v"); !strings.HasPrefix(out, "Lua 5.4 (go-lua)\n") {
+		t.Errorf("unexpected version %q", out)
+	}
+	if _, err := interpret(t, "-e", "error('boom')"); err == nil || !strings.Contains(err.Error(), "boom\nstack traceback:") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := interpret(t, "-e", "x ="); err == nil || !strings.Contains(err.Error(), "(command line):1:") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := interpret(t, "-l", "nosuchmodule"); err == nil || !strings.Contains(err.Error(), "module 'nosuchmodule' not found") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := interpret(t, "-e", "require('lpeg')"); err != nil {
+		t.Errorf("optional library: %v", err)
+	}
+}
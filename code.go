@@ -469,7 +469,6 @@ func (f *function) breakLabel() bool {
 	return needClose
 }
 func (f *function) unreachable()                        { f.assert(false) }
-func (f *function) assert(cond bool)                    { f.p.l.assert(cond) }
 func (f *function) Instruction(e exprDesc) *instruction { return &f.f.code[e.info] }
 func (e exprDesc) hasJumps() bool                       { return e.t != e.f }
 func (e exprDesc) isNumeral() bool {
@@ -638,7 +637,6 @@ func (f *function) conditionalJump(op opCode, a, b, c, k int) int {
 }
 
 func (f *function) fixJump(pc, dest int) {
-	f.assert(f.isJumpListWalkable(pc))
 	f.assert(dest != noJump)
 	offset := dest - (pc + 1)
 	if abs(offset) > offsetSJ {
@@ -653,8 +651,10 @@ func (f *function) Label() int {
 	return f.lastTarget
 }
 
+// jump returns the next entry of the jump list that pc is on. It does not
+// check that the rest of the list is walkable, as it is called for every
+// entry of a list and long lists would take quadratic time.
 func (f *function) jump(pc int) int {
-	f.assert(f.isJumpListWalkable(pc))
 	if offset := f.f.code[pc].sJ(); offset != noJump {
 		return pc + 1 + offset
 	}
@@ -662,7 +662,7 @@ func (f *function) jump(pc int) int {
 }
 
 func (f *function) isJumpListWalkable(list int) bool {
-	if list == noJump {
+	if !checkAssertions || list == noJump {
 		return true
 	}
 	if list < 0 || list >= len(f.f.code) {
@@ -770,6 +770,7 @@ func (f *function) addConstant(k, v value) int {
 		return index
 	}
 	index := len(f.f.constants)
+	f.p.checkLimit(index+1, maxArgAx, "constants")
 	f.constantLookup[k] = index
 	f.f.constants = append(f.f.constants, v)
 	return index
@@ -790,8 +791,8 @@ func (f *function) IntegerConstant(n int64) int {
 }
 
 func (f *function) CheckStack(n int) {
-	if n += f.freeRegisterCount; n >= maxStack {
-		f.p.syntaxError("function or expression too complex")
+	if n += f.freeRegisterCount; n >= maxRegisters {
+		f.p.syntaxError("function or expression needs too many registers")
 	} else if n > f.f.maxStackSize {
 		f.f.maxStackSize = n
 	}
@@ -1043,14 +1044,16 @@ func (f *function) exp2K(e exprDesc) (int, bool) {
 }
 
 // codeABRK emits an instruction with the value in C as either a register (k=0)
-// or constant index (k=1).
-func (f *function) codeABRK(op opCode, a, b int, ec exprDesc) {
+// or constant index (k=1). It returns ec as emitted, so that callers free the
+// register of a constant that didn't fit in C.
+func (f *function) codeABRK(op opCode, a, b int, ec exprDesc) exprDesc {
 	if info, ok := f.exp2K(ec); ok {
 		f.EncodeABCk(op, a, b, info, 1)
-	} else {
-		ec = f.ExpressionToAnyRegister(ec)
-		f.EncodeABCk(op, a, b, ec.info, 0)
+		return ec
 	}
+	ec = f.ExpressionToAnyRegister(ec)
+	f.EncodeABCk(op, a, b, ec.info, 0)
+	return ec
 }
 
 func (f *function) StoreVariable(v, e exprDesc) {
@@ -1063,13 +1066,13 @@ func (f *function) StoreVariable(v, e exprDesc) {
 		e = f.ExpressionToAnyRegister(e)
 		f.EncodeABC(opSetUpValue, e.info, v.info, 0)
 	case kindIndexUp:
-		f.codeABRK(opSetTableUp, v.table, v.index, e)
+		e = f.codeABRK(opSetTableUp, v.table, v.index, e)
 	case kindIndexInt:
-		f.codeABRK(opSetI, v.table, v.index, e)
+		e = f.codeABRK(opSetI, v.table, v.index, e)
 	case kindIndexStr:
-		f.codeABRK(opSetField, v.table, v.index, e)
+		e = f.codeABRK(opSetField, v.table, v.index, e)
 	case kindIndexed:
-		f.codeABRK(opSetTable, v.table, v.index, e)
+		e = f.codeABRK(opSetTable, v.table, v.index, e)
 	default:
 		f.unreachable()
 	}
@@ -1082,7 +1085,7 @@ func (f *function) Self(e, key exprDesc) exprDesc {
 	f.freeExpression(e)
 	result := exprDesc{info: f.freeRegisterCount, kind: kindNonRelocatable, t: noJump, f: noJump}
 	f.ReserveRegisters(2) // function and 'self' produced by opSelf
-	f.codeABRK(opSelf, result.info, r, key)
+	key = f.codeABRK(opSelf, result.info, r, key)
 	f.freeExpression(key)
 	return result
 }
@@ -1650,8 +1653,9 @@ func (f *function) SingleVariable(name string) (e exprDesc) {
 	var found bool
 	if e, found = singleVariableHelper(f, name, true); !found {
 		e, found = singleVariableHelper(f, "_ENV", true)
-		f.assert(found && (e.kind == kindLocal || e.kind == kindUpValue))
-		e = f.Indexed(e, f.EncodeString(name))
+		f.assert(found)
+		// _ENV may be a compile-time constant, such as in local _ENV <const> = t
+		e = f.Indexed(f.ExpressionToAnyRegisterOrUpValue(e), f.EncodeString(name))
 	}
 	return
 }
@@ -1789,7 +1793,8 @@ func (f *function) CloseMainFunction() *function {
 }
 
 // finish does a final pass over the code, converting RETURN0/RETURN1
-// to RETURN when needed (vararg functions need parameter count in C).
+// to RETURN when needed (vararg functions need parameter count in C), and
+// then optimizes the jumps; see collapseJumps and removeDeadCode.
 func (f *function) finish() {
 	for i := range f.f.code {
 		pc := &f.f.code[i]
@@ -1805,4 +1810,134 @@ func (f *function) finish() {
 			}
 		}
 	}
+	f.collapseJumps()
+	f.removeDeadCode()
+}
+
+// finalTarget follows the chain of jumps starting at the jump at pc and
+// returns where it ends. Like C Lua, it gives up after 100 jumps, which
+// also stops it in a loop of jumps.
+func (f *function) finalTarget(pc int) int {
+	code := f.f.code
+	for count := 0; count < 100 && code[pc].opCode() == opJump; count++ {
+		pc += code[pc].sJ() + 1
+	}
+	return pc
+}
+
+// collapseJumps makes every jump that leads to another jump go to the end
+// of the chain directly, as jump lists of nested conditions and loops tend
+// to produce such chains.
+func (f *function) collapseJumps() {
+	for pc, i := range f.f.code {
+		if i.opCode() == opJump {
+			f.f.code[pc].setSJ(f.finalTarget(pc) - (pc + 1))
+		}
+	}
+}
+
+// successors calls visit with the instructions that may run after the one
+// at pc. An instruction that may skip the next one, like a test before its
+// jump or an arithmetic instruction before its metamethod fallback, has
+// both as successors, so that they stay next to each other.
+func (f *function) successors(pc int, visit func(int)) {
+	code := f.f.code
+	i := code[pc]
+	switch i.opCode() {
+	case opJump:
+		visit(pc + 1 + i.sJ())
+		return
+	case opReturn, opReturn0, opReturn1:
+		return
+	case opTForPrep:
+		visit(pc + 1 + i.bx())
+		return
+	case opForPrep:
+		// The loop is skipped by an offset from its FORLOOP, which must
+		// stay even if the body never gets to it.
+		visit(pc + 1 + i.bx())
+		visit(pc + 2 + i.bx())
+	case opForLoop, opTForLoop:
+		visit(pc + 1 - i.bx())
+	}
+	visit(pc + 1)
+	if op := i.opCode(); testTMode(op) || op == opLoadFalseSkip {
+		visit(pc + 2)
+	} else if pc+1 < len(code) {
+		switch code[pc+1].opCode() {
+		case opMMBin, opMMBinI, opMMBinK:
+			visit(pc + 2)
+		}
+	}
+}
+
+// removeDeadCode removes the instructions that cannot be reached from the
+// start of the function, such as jumps after a return or code after a break,
+// and relocates jumps, line information and the ranges of local variables.
+func (f *function) removeDeadCode() {
+	code := f.f.code
+	reachable := make([]bool, len(code))
+	// The final return stays, as in C Lua it gives the line of the 'end'
+	// of the function to debug.getinfo's activelines.
+	reachable[len(code)-1] = true
+	stack := []int{0}
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if pc < len(code) && !reachable[pc] {
+			reachable[pc] = true
+			f.successors(pc, func(next int) { stack = append(stack, next) })
+		}
+	}
+	newPC := make([]int, len(code)+1) // instructions that are removed map to the next one
+	n := 0
+	for pc := range code {
+		newPC[pc] = n
+		if reachable[pc] {
+			n++
+		}
+	}
+	newPC[len(code)] = n
+	if n == len(code) {
+		return
+	}
+
+	lines := f.instructionLines()
+	f.f.code, f.f.lineInfo, f.f.absLineInfos = make([]instruction, 0, n), make([]int8, 0, n), nil
+	f.previousLine, f.iwthabs = f.f.lineDefined, 0
+	for pc, i := range code {
+		if !reachable[pc] {
+			continue
+		}
+		switch i.opCode() {
+		case opJump:
+			i.setSJ(newPC[pc+1+i.sJ()] - (newPC[pc] + 1))
+		case opForPrep, opTForPrep:
+			i.setBx(newPC[pc+1+i.bx()] - (newPC[pc] + 1))
+		case opForLoop, opTForLoop:
+			i.setBx(newPC[pc] + 1 - newPC[pc+1-i.bx()])
+		}
+		f.f.code = append(f.f.code, i)
+		f.saveLineInfo(lines[pc])
+	}
+	for i := range f.f.localVariables {
+		v := &f.f.localVariables[i]
+		v.startPC, v.endPC = pc(newPC[v.startPC]), pc(newPC[v.endPC])
+	}
+}
+
+// instructionLines decodes the line information of the code.
+func (f *function) instructionLines() []int {
+	lines := make([]int, len(f.f.code))
+	line, abs := f.f.lineDefined, 0
+	for pc, d := range f.f.lineInfo {
+		if d == lineInfoAbs {
+			line = f.f.absLineInfos[abs].line
+			abs++
+		} else {
+			line += int(d)
+		}
+		lines[pc] = line
+	}
+	return lines
 }
@@ -0,0 +1,170 @@
+//go:build !lua_noos
+// +build !lua_noos
+
+package lua
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// The exported API of Shopify/go-lua, with the signatures it has there. Code
+// written against it compiles with this package once the import path is
+// changed (see MIGRATING.md); these declarations stop compiling if one of
+// the signatures changes incompatibly.
+var (
+	_ func() *State                                    = NewState
+	_ func() *State                                    = NewStateEx
+	_ func(*State, ...RegistryFunction)                = OpenLibraries
+	_ func(*State, Function) Function                  = AtPanic
+	_ func(int) int                                    = UpValueIndex
+	_ func(*State, int, int) (string, bool)            = UpValue
+	_ func(*State, int, int) (string, bool)            = SetUpValue
+	_ func(*State, int, int) interface{}               = UpValueId
+	_ func(*State, int, int, int, int)                 = UpValueJoin
+	_ func(*State) *float64                            = Version
+	_ func(*State, *State, string, int)                = Traceback
+	_ func(*State, int, string) bool                   = MetaField
+	_ func(*State, int, string) bool                   = CallMeta
+	_ func(*State, int, string)                        = ArgumentError
+	_ func(*State, int)                                = Where
+	_ func(*State, string, ...interface{})             = Errorf
+	_ func(*State, int) (string, bool)                 = ToStringMeta
+	_ func(*State, string) bool                        = NewMetaTable
+	_ func(*State, string)                             = MetaTableNamed
+	_ func(*State, string)                             = SetMetaTableNamed
+	_ func(*State, int, string) interface{}            = TestUserData
+	_ func(*State, int, string) interface{}            = CheckUserData
+	_ func(*State, int, Type)                          = CheckType
+	_ func(*State, int)                                = CheckAny
+	_ func(*State, bool, int, string)                  = ArgumentCheck
+	_ func(*State, int) string                         = CheckString
+	_ func(*State, int, string) string                 = OptString
+	_ func(*State, int) float64                        = CheckNumber
+	_ func(*State, int, float64) float64               = OptNumber
+	_ func(*State, int) int                            = CheckInteger
+	_ func(*State, int, int) int                       = OptInteger
+	_ func(*State, int) uint                           = CheckUnsigned
+	_ func(*State, int, uint) uint                     = OptUnsigned
+	_ func(*State, int) string                         = TypeNameOf
+	_ func(*State, []RegistryFunction, uint8)          = SetFunctions
+	_ func(*State, int, string)                        = CheckStackWithMessage
+	_ func(*State, int, string, []string) int          = CheckOption
+	_ func(*State, int, string) bool                   = SubTable
+	_ func(*State, string, Function, bool)             = Require
+	_ func(*State, []RegistryFunction)                 = NewLibraryTable
+	_ func(*State, []RegistryFunction)                 = NewLibrary
+	_ func(*State, string, string) error               = LoadFile
+	_ func(*State, string) error                       = LoadString
+	_ func(*State, string, string, string) error       = LoadBuffer
+	_ func(*State, int) int                            = LengthEx
+	_ func(*State, error, string) int                  = FileResult
+	_ func(*State, string) error                       = DoFile
+	_ func(*State, string) error                       = DoString
+	_ func(*State, Hook, byte, int)                    = SetDebugHook
+	_ func(*State) Hook                                = DebugHook
+	_ func(*State) byte                                = DebugHookMask
+	_ func(*State) int                                 = DebugHookCount
+	_ func(*State, int) (Frame, bool)                  = Stack
+	_ func(*State, string, Frame) (Debug, bool)        = Info
+	_ []Function                                       = []Function{BaseOpen, Bit32Open, CoroutineOpen, DebugOpen, IOOpen, MathOpen, OSOpen, PackageOpen, StringOpen, TableOpen}
+	_ func(*State) (int, bool, error)                  = (*State).Context
+	_ func(*State, int, int, int, Function)            = (*State).CallWithContinuation
+	_ func(*State, int, int, int) error                = (*State).ProtectedCall
+	_ func(*State, int, int, int, int, Function) error = (*State).ProtectedCallWithContinuation
+	_ func(*State, io.Reader, string, string) error    = (*State).Load
+	_ func(*State, int, int)                           = (*State).Call
+	_ func(*State, int, string)                        = (*State).SetField
+	_ func(*State, int) int                            = (*State).AbsIndex
+	_ func(*State) int                                 = (*State).Top
+	_ []func(*State, int)                              = []func(*State, int){(*State).SetTop, (*State).Remove, (*State).Insert, (*State).Replace, (*State).PushValue, (*State).Pop, (*State).RawGet, (*State).UserValue, (*State).SetTable, (*State).RawSet, (*State).SetUserValue, (*State).SetMetaTable, (*State).Concat, (*State).Length, (*State).Table, (*State).PushInteger}
+	_ func(*State, int, int)                           = (*State).Copy
+	_ func(*State, int) bool                           = (*State).CheckStack
+	_ func(*State, int) Type                           = (*State).TypeOf
+	_ []func(*State, int) bool                         = []func(*State, int) bool{(*State).IsGoFunction, (*State).IsNumber, (*State).IsString, (*State).IsUserData, (*State).IsFunction, (*State).IsTable, (*State).IsLightUserData, (*State).IsNil, (*State).IsBoolean, (*State).IsThread, (*State).IsNone, (*State).IsNoneOrNil, (*State).ToBoolean, (*State).MetaTable, (*State).Next}
+	_ func(*State, Operator)                           = (*State).Arith
+	_ func(*State, int, int) bool                      = (*State).RawEqual
+	_ func(*State, int, int, ComparisonOperator) bool  = (*State).Compare
+	_ func(*State, int) (int, bool)                    = (*State).ToInteger
+	_ func(*State, int) (uint, bool)                   = (*State).ToUnsigned
+	_ func(*State, int) (float64, bool)                = (*State).ToNumber
+	_ func(*State, int) (string, bool)                 = (*State).ToString
+	_ func(*State, int) int                            = (*State).RawLength
+	_ func(*State, int) Function                       = (*State).ToGoFunction
+	_ func(*State, int) interface{}                    = (*State).ToUserData
+	_ func(*State, int) *State                         = (*State).ToThread
+	_ func(*State, int) interface{}                    = (*State).ToValue
+	_ func(*State)                                     = (*State).PushNil
+	_ func(*State, float64)                            = (*State).PushNumber
+	_ func(*State, uint)                               = (*State).PushUnsigned
+	_ func(*State, bool)                               = (*State).PushBoolean
+	_ func(*State, string) string                      = (*State).PushString
+	_ func(*State, string, ...interface{}) string      = (*State).PushFString
+	_ func(*State, Function, uint8)                    = (*State).PushGoClosure
+	_ func(*State, Function)                           = (*State).PushGoFunction
+	_ func(*State, interface{})                        = (*State).PushLightUserData
+	_ func(*State, interface{})                        = (*State).PushUserData
+	_ func(*State) bool                                = (*State).PushThread
+	_ func(*State, string)                             = (*State).Global
+	_ func(*State, string)                             = (*State).SetGlobal
+	_ func(*State, int, string)                        = (*State).Field
+	_ func(*State, int, int)                           = (*State).RawGetInt
+	_ func(*State, int, int)                           = (*State).RawSetInt
+	_ func(*State, int, interface{})                   = (*State).RawGetValue
+	_ func(*State, int, int)                           = (*State).CreateTable
+	_ func(*State)                                     = (*State).NewTable
+	_ func(*State)                                     = (*State).PushGlobalTable
+	_ func(*State)                                     = (*State).Error
+	_ func(*State, string, Function)                   = (*State).Register
+	_                                                  = []error{SyntaxError, MemoryError, ErrorError, FileError, RuntimeError("")}
+	_                                                  = []interface{}{TypeNil, TypeBoolean, TypeLightUserData, TypeNumber, TypeString, TypeTable, TypeFunction, TypeUserData, TypeThread, TypeCount, TypeNone}
+	_                                                  = []interface{}{OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow, OpUnaryMinus, OpEq, OpLT, OpLE}
+	_                                                  = []int{HookCall, HookReturn, HookLine, HookCount, HookTailCall, MaskCall, MaskReturn, MaskLine, MaskCount, MaskTailCall}
+	_                                                  = []int{MultipleReturns, RegistryIndex, RegistryIndexMainThread, RegistryIndexGlobals, MinStack, VersionMajor, VersionMinor, VersionNumber}
+	_                                                  = []string{Signature, VersionString}
+	_                                                  = Debug{Event: 0, Name: "", NameKind: "", What: "", Source: "", ShortSource: "", CurrentLine: 0, LineDefined: 0, LastLineDefined: 0, UpValueCount: 0, ParameterCount: 0, IsVarArg: false, IsTailCall: false}
+	_                                                  = RegistryFunction{Name: "", Function: nil}
+)
+
+// Dump has an optional strip argument here; calls in the form of
+// Shopify/go-lua still compile.
+func dumpLikeShopify(l *State, w io.Writer) error { return l.Dump(w) }
+
+// TestShopifyCompatibility runs code in the style of the Shopify/go-lua
+// README and examples.
+func TestShopifyCompatibility(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Register("add", func(l *State) int {
+		a, b := CheckNumber(l, 1), CheckNumber(l, 2)
+		l.PushNumber(a + b)
+		return 1
+	})
+	NewLibrary(l, []RegistryFunction{
+		{"greet", func(l *State) int {
+			l.PushString("hello, " + OptString(l, 1, "world"))
+			return 1
+		}},
+	})
+	l.SetGlobal("lib")
+	if err := DoString(l, `result = lib.greet(tostring(add(1, 2)))`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("result")
+	if s, _ := l.ToString(-1); s != "hello, 3" {
+		t.Errorf("got %q", s)
+	}
+	l.Pop(1)
+	if err := LoadString(l, "return 6 * 7"); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := dumpLikeShopify(l, &b); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 1)
+	if n, ok := l.ToInteger(-1); !ok || n != 42 {
+		t.Errorf("got %d", n)
+	}
+}
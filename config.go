@@ -5,10 +5,14 @@ import "math"
 const (
 	maxStack          = 1000000
 	maxCallCount      = 200
+	maxRegisters      = 255 // registers of a function, so that they fit in the A operand
 	errorStackSize    = maxStack + 200
 	extraStack        = 5
 	basicStackSize    = 2 * MinStack
 	maxTagLoop        = 100
+	maxTableDepth     = 1000 // default of SetTableDepthLimit
+	noCallDepthLimit  = math.MaxInt
+	extraCallDepth    = 20 // calls for the message handler beyond the limit of SetCallDepthLimit
 	firstPseudoIndex  = -maxStack - 1000
 	maxUpValue        = math.MaxUint8
 	idSize            = 60
@@ -0,0 +1,120 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// crashDumpChunks is the number of chunk names a crash dump remembers.
+const crashDumpChunks = 32
+
+// A crashDump is the configuration set with SetCrashDump.
+type crashDump struct {
+	w      io.Writer
+	chunks []string // names of the most recently loaded chunks, oldest first
+}
+
+// write writes the crash dump for the unprotected error err, whose error
+// object is on top of the stack.
+func (c *crashDump) write(l *State, err error) {
+	reason := err.Error()
+	if s, ok := l.stack[l.top-1].(string); ok {
+		reason = s
+	}
+	_ = WriteCrashDump(l, c.w, reason)
+}
+
+func (c *crashDump) loaded(chunkName string) {
+	if len(c.chunks) == crashDumpChunks {
+		c.chunks = append(c.chunks[:0], c.chunks[1:]...)
+	}
+	c.chunks = append(c.chunks, chunkName)
+}
+
+// SetCrashDump makes an unprotected error in any thread of l write a crash
+// dump to w, as described for WriteCrashDump, before the panic function set
+// with AtPanic is called. From then on, the state also remembers the names
+// of the last chunks it loaded for the dump. A nil w turns crash dumps off.
+func SetCrashDump(l *State, w io.Writer) {
+	if w == nil {
+		l.global.crashDump = nil
+	} else if l.global.crashDump == nil {
+		l.global.crashDump = &crashDump{w: w}
+	} else {
+		l.global.crashDump.w = w
+	}
+}
+
+// WriteCrashDump writes a diagnostic report about the thread l for
+// post-mortem analysis: the reason given by the caller, a traceback with
+// the current instruction and the local variables of every frame, the
+// counters of the thread, and the names of the most recently loaded chunks
+// if SetCrashDump is active. Hosts can call it when they recover a Go panic
+// raised while running Lua code. Values are printed without calling
+// metamethods, so writing a dump does not run Lua code.
+func WriteCrashDump(l *State, w io.Writer, reason string) error {
+	b := bufio.NewWriter(w)
+	top := l.top
+	defer func() { l.top = top }()
+	fmt.Fprintf(b, "=== Lua crash dump ===\nreason: %s\n", reason)
+	fmt.Fprintf(b, "\n--- traceback ---\n")
+	level := 0
+	for f, ok := Stack(l, level); ok; f, ok = Stack(l, level) {
+		ci := (*callInfo)(f)
+		d, _ := Info(l, "Slnt", f)
+		fmt.Fprintf(b, "#%d %s:", level, d.ShortSource)
+		if d.CurrentLine > 0 {
+			fmt.Fprintf(b, "%d:", d.CurrentLine)
+		}
+		fmt.Fprintf(b, " in %s", tracebackFuncName(l, d))
+		if ci.isLua() {
+			fmt.Fprintf(b, " (pc %d of %d)", ci.savedPC, len(l.prototype(ci).code))
+		}
+		if d.IsTailCall {
+			fmt.Fprintf(b, "\n\t(...tail calls...)")
+		}
+		b.WriteByte('\n')
+		for n := 1; ; n++ {
+			name, v := l.getLocal(ci, n)
+			if name == "" {
+				break
+			} else if !strings.HasPrefix(name, "(") { // skip temporaries
+				fmt.Fprintf(b, "\t%s = %s\n", name, crashDumpValue(v))
+			}
+		}
+		for n := -1; ; n-- {
+			name, v := l.getLocal(ci, n)
+			if name == "" {
+				break
+			}
+			fmt.Fprintf(b, "\t%s %d = %s\n", name, -n, crashDumpValue(v))
+		}
+		level++
+	}
+	fmt.Fprintf(b, "\n--- counters ---\n")
+	fmt.Fprintf(b, "frames: %d\nnested Go calls: %d\nnon-yieldable calls: %d\n", level, l.nestedGoCallCount, l.nonYieldableCallCount)
+	fmt.Fprintf(b, "stack slots: %d in use, %d allocated\n", l.top, len(l.stack))
+	fmt.Fprintf(b, "hook: mask %q, count %d, %d left\n", maskToString(l.hookMask), l.baseHookCount, l.hookCount)
+	if c := l.global.crashDump; c != nil {
+		fmt.Fprintf(b, "\n--- loaded chunks (most recent last) ---\n")
+		for _, name := range c.chunks {
+			fmt.Fprintf(b, "%s\n", chunkID(name))
+		}
+	}
+	return b.Flush()
+}
+
+// crashDumpValue describes v on a single line of limited length.
+func crashDumpValue(v value) string {
+	const maxLength = 200
+	if c, ok := v.(*luaClosure); ok {
+		return fmt.Sprintf("function <%s:%d>", chunkID(c.prototype.source), c.prototype.lineDefined)
+	}
+	s := strings.ReplaceAll(debugValue(v), "\n", `\n`)
+	if len(s) > maxLength {
+		s = s[:maxLength] + "..."
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCrashDump(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	var dump bytes.Buffer
+	SetCrashDump(l, &dump)
+	if err := LoadString(l, `
+		local limit = 3
+		local function check(n, ...)
+			local label = "item " .. n
+			if n > limit then error("too many items") end
+			return label
+		end
+		for i = 1, 5 do check(i, "extra") end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("unprotected error did not panic")
+			}
+		}()
+		l.Call(0, 0)
+	}()
+	out := dump.String()
+	for _, want := range []string{
+		"reason: [string \"...\"]:5: too many items",
+		"in global 'error'",
+		"\tcheck = function <[string \"...\"]:3>\n",
+		"in local 'check' (pc ",
+		"\tn = 4\n",
+		"\tlabel = 'item 4'\n",
+		"\t(vararg) 1 = 'extra'\n",
+		"\tlimit = 3\n",
+		"nested Go calls: ",
+		"--- loaded chunks (most recent last) ---\n[string \"...\"]\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("crash dump lacks %q:\n%s", want, out)
+		}
+	}
+
+	SetCrashDump(l, nil)
+	dump.Reset()
+	if err := DoString(l, `error("protected")`); err == nil || dump.Len() != 0 {
+		t.Errorf("got %v and %d bytes of dump, want an error and no dump", err, dump.Len())
+	}
+}
+
+type testImage struct{ width, height int }
+
+func TestCrashDumpDebugString(t *testing.T) {
+	RegisterDebugString(&testImage{}, func(d interface{}) string {
+		img := d.(*testImage)
+		return fmt.Sprintf("Image(%dx%d)", img.width, img.height)
+	})
+	defer RegisterDebugString(&testImage{}, nil)
+	l := NewState()
+	l.PushUserData(&testImage{1200, 800})
+	l.SetGlobal("img")
+	l.PushLightUserData(&testImage{16, 16})
+	l.SetGlobal("icon")
+	var dump bytes.Buffer
+	l.Register("dump", func(l *State) int {
+		if err := WriteCrashDump(l, &dump, "test"); err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	})
+	if err := DoString(l, `local img, icon = img, icon; dump()`); err != nil {
+		t.Fatal(err)
+	}
+	out := dump.String()
+	for _, want := range []string{"\timg = userdata Image(1200x800)\n", "\ticon = light userdata Image(16x16)\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("crash dump lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package lua
+
+import "strings"
+
+// A DateLocale holds the names and formats that os.date uses for the
+// conversions that depend on the locale.
+type DateLocale struct {
+	Name        string     // the name os.setlocale accepts and returns, e.g. "de_DE"
+	Days        [7]string  // %A, starting with Sunday
+	ShortDays   [7]string  // %a
+	Months      [12]string // %B, starting with January
+	ShortMonths [12]string // %b and %h
+	AM, PM      string     // %p
+	DateTime    string     // the format of %c
+	Date        string     // the format of %x
+	Time        string     // the format of %X
+}
+
+// CDateLocale is the "C" locale, which os.date uses unless SetDateLocale or
+// os.setlocale selected another one.
+var CDateLocale = &DateLocale{
+	Name:        "C",
+	Days:        [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	ShortDays:   [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"},
+	Months:      [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	ShortMonths: [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"},
+	AM:          "AM",
+	PM:          "PM",
+	DateTime:    "%a %b %e %H:%M:%S %Y",
+	Date:        "%m/%d/%y",
+	Time:        "%H:%M:%S",
+}
+
+// dateLocales are the locales that os.setlocale knows besides the one set
+// with SetDateLocale. Their formats follow the GNU C library.
+var dateLocales = []*DateLocale{
+	CDateLocale,
+	{
+		Name:        "en_US",
+		Days:        CDateLocale.Days,
+		ShortDays:   CDateLocale.ShortDays,
+		Months:      CDateLocale.Months,
+		ShortMonths: CDateLocale.ShortMonths,
+		AM:          "AM",
+		PM:          "PM",
+		DateTime:    "%a %d %b %Y %I:%M:%S %p",
+		Date:        "%m/%d/%Y",
+		Time:        "%I:%M:%S %p",
+	},
+	{
+		Name:        "de_DE",
+		Days:        [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		ShortDays:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		Months:      [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		ShortMonths: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		DateTime:    "%a %d %b %Y %H:%M:%S",
+		Date:        "%d.%m.%Y",
+		Time:        "%H:%M:%S",
+	},
+	{
+		Name:        "fr_FR",
+		Days:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		ShortDays:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		Months:      [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		ShortMonths: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		DateTime:    "%a %d %b %Y %H:%M:%S",
+		Date:        "%d/%m/%Y",
+		Time:        "%H:%M:%S",
+	},
+}
+
+// SetDateLocale sets the locale of os.date and returns the previous one. A
+// nil locale restores CDateLocale. Scripts can switch back to the locale
+// with os.setlocale(loc.Name, "time"). The locale is shared by all threads
+// of l.
+func SetDateLocale(l *State, loc *DateLocale) *DateLocale {
+	old := l.global.dateLocale
+	if old == nil {
+		old = CDateLocale
+	}
+	l.global.dateLocale, l.global.customDateLocale = loc, loc
+	return old
+}
+
+func (g *globalState) timeLocale() *DateLocale {
+	if g.dateLocale != nil {
+		return g.dateLocale
+	}
+	return CDateLocale
+}
+
+// findDateLocale returns the locale called name, ignoring an encoding suffix
+// such as ".UTF-8", or nil.
+func (g *globalState) findDateLocale(name string) *DateLocale {
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	if name == "POSIX" {
+		name = "C"
+	}
+	if loc := g.customDateLocale; loc != nil && loc.Name == name {
+		return loc
+	}
+	for _, loc := range dateLocales {
+		if loc.Name == name {
+			return loc
+		}
+	}
+	return nil
+}
@@ -86,10 +86,8 @@ func (l *State) varInfo(v value, stackIdx int) (kind, name string) {
 	// comparison can match the wrong upvalue when multiple have the same value.
 	if stackIdx >= 0 {
 		for i, uv := range c.upValues {
-			if home, ok := uv.home.(stackLocation); ok {
-				if home.index == stackIdx {
-					return "upvalue", c.prototype.upValueName(i)
-				}
+			if uv.isInStackAt(stackIdx) {
+				return "upvalue", c.prototype.upValueName(i)
 			}
 		}
 	}
@@ -102,6 +100,10 @@ func (l *State) varInfo(v value, stackIdx int) (kind, name string) {
 		if fi >= 0 && fi < len(ci.frame) {
 			frameIndex = fi
 		}
+	} else if r, ok := indexedRegister(c.prototype, currentPC); ok && r < len(ci.frame) && ci.frame[r] == v {
+		// Values such as nil compare equal in many registers; the
+		// instruction that failed names the right one.
+		frameIndex = r
 	} else {
 		for i, e := range ci.frame {
 			if e == v {
@@ -132,6 +134,21 @@ func (l *State) varInfo(v value, stackIdx int) (kind, name string) {
 	return
 }
 
+// indexedRegister returns the register of the table that the instruction at
+// pc indexes, if it is an indexing instruction.
+func indexedRegister(p *prototype, pc pc) (int, bool) {
+	if pc < 0 || int(pc) >= len(p.code) {
+		return 0, false
+	}
+	switch i := p.code[pc]; i.opCode() {
+	case opGetTable, opGetI, opGetField, opSelf:
+		return i.b(), true
+	case opSetTable, opSetI, opSetField:
+		return i.a(), true
+	}
+	return 0, false
+}
+
 // objectTypeName returns the type name for a value, checking __name metafield first.
 func (l *State) objectTypeName(v value) string {
 	var mt *table
@@ -267,12 +284,6 @@ func (l *State) concatError(v1, v2 value) {
 	l.typeError(v1, "concatenate")
 }
 
-func (l *State) assert(cond bool) {
-	if !cond {
-		l.runtimeError("assertion failure")
-	}
-}
-
 func (l *State) errorMessage() {
 	if l.errorFunction != 0 { // is there an error handling function?
 		errorFunction := l.stack[l.errorFunction]
@@ -681,6 +692,185 @@ func Info(l *State, what string, where Frame) (d Debug, ok bool) {
 	return d, ok
 }
 
+// A frameScope resolves names in the scope of the Lua function running in a
+// frame, for Watch and Eval. Locals are looked up by slot when they are used,
+// so the values are current even if the stack has been reallocated.
+type frameScope struct {
+	ci       *callInfo
+	c        *luaClosure
+	locals   map[string]int // name -> slot, inner locals shadow outer ones
+	upValues map[string]int // name -> upvalue index
+}
+
+func newFrameScope(l *State, f Frame, what string) (*frameScope, error) {
+	ci := (*callInfo)(f)
+	if !ci.isLua() {
+		return nil, fmt.Errorf("%s: frame is not running a Lua function", what)
+	}
+	s := &frameScope{ci: ci, c: l.stack[ci.function].(*luaClosure), locals: make(map[string]int), upValues: make(map[string]int)}
+	for i, uv := range s.c.prototype.upValues {
+		s.upValues[uv.name] = i
+	}
+	currentPC := ci.savedPC - 1
+	if currentPC < 0 {
+		currentPC = 0
+	}
+	for n := 1; ; n++ {
+		name, ok := s.c.prototype.localName(n, currentPC)
+		if !ok {
+			break
+		} else if !strings.HasPrefix(name, "(") {
+			s.locals[name] = n - 1
+		}
+	}
+	return s, nil
+}
+
+func (s *frameScope) lookup(name string) (value, bool) {
+	if n, ok := s.locals[name]; ok {
+		return s.ci.frame[n], true
+	} else if i, ok := s.upValues[name]; ok {
+		return s.c.upValue(i), true
+	}
+	return nil, false
+}
+
+func (s *frameScope) assign(name string, v value) bool {
+	if n, ok := s.locals[name]; ok {
+		s.ci.frame[n] = v
+	} else if i, ok := s.upValues[name]; ok {
+		s.c.setUpValue(i, v)
+	} else {
+		return false
+	}
+	return true
+}
+
+// pushEnv pushes the environment table for a chunk run in the scope. Reads
+// resolve to locals, upvalues and then the frame's _ENV. If writable is true,
+// assignments to locals and upvalues change them in the frame and all other
+// assignments go to _ENV.
+func (s *frameScope) pushEnv(l *State, writable bool) {
+	pushFrameEnv := func(l *State) {
+		if env, ok := s.lookup("_ENV"); ok {
+			l.apiPush(env)
+		} else {
+			l.PushGlobalTable()
+		}
+	}
+	l.NewTable()
+	l.NewTable()
+	l.PushGoFunction(func(l *State) int {
+		if name, ok := l.ToValue(2).(string); ok {
+			if v, ok := s.lookup(name); ok {
+				l.apiPush(v)
+				return 1
+			}
+		}
+		pushFrameEnv(l)
+		l.PushValue(2)
+		l.Table(-2)
+		return 1
+	})
+	l.SetField(-2, "__index")
+	if writable {
+		l.PushGoFunction(func(l *State) int {
+			if name, ok := l.ToValue(2).(string); ok && s.assign(name, l.indexToValue(3)) {
+				return 0
+			}
+			pushFrameEnv(l)
+			l.PushValue(2)
+			l.PushValue(3)
+			l.SetTable(-3)
+			return 0
+		})
+		l.SetField(-2, "__newindex")
+	}
+	l.SetMetaTable(-2)
+}
+
+// limitedCall calls the function on top of the stack in protected mode with
+// an instruction limit of steps (none if steps <= 0), restoring the debug
+// hook afterwards. Once the limit is reached, the error is raised again on
+// every instruction, so that pcall inside the function cannot catch it and
+// carry on. It returns the number of results, which are left on the
+// stack on success; on error, nothing is left on the stack.
+func limitedCall(l *State, steps, results int, what string) (int, error) {
+	top := l.Top() - 1
+	hook, mask, count := l.hooker, l.hookMask, l.baseHookCount
+	allowHook, internal := l.allowHook, l.internalHook
+	if steps > 0 {
+		SetDebugHook(l, func(l *State, _ Debug) {
+			if l.baseHookCount != 1 {
+				SetDebugHook(l, l.hooker, MaskCount, 1)
+			}
+			Errorf(l, "%s exceeded %d steps", what, steps)
+		}, MaskCount, steps)
+		l.allowHook = true
+	}
+	err := l.ProtectedCall(0, results, 0)
+	if steps > 0 {
+		SetDebugHook(l, hook, mask, count)
+		l.allowHook, l.internalHook = allowHook, internal
+	}
+	if err != nil {
+		l.SetTop(top)
+		return 0, err
+	}
+	return l.Top() - top, nil
+}
+
+// Watch evaluates the Lua expression expr in the scope of the Lua function
+// running in frame f, the way a debugger shows watch expressions. Names refer
+// to the locals active at the current position of the function, then to its
+// upvalues, then to the fields of its _ENV. The expression sees the values
+// of the locals and upvalues but cannot assign to them.
+//
+// At most steps instructions are executed, so a watch expression cannot hang
+// the program being debugged; steps <= 0 means no limit. Watch may be called
+// from a hook. On success, the value of the expression is pushed onto the
+// stack. Otherwise nothing is pushed and the error is returned.
+func Watch(l *State, f Frame, expr string, steps int) error {
+	s, err := newFrameScope(l, f, "watch")
+	if err != nil {
+		return err
+	}
+	if err := LoadBuffer(l, "return "+expr, "=watch", "t"); err != nil {
+		l.Pop(1)
+		return err
+	}
+	s.pushEnv(l, false)
+	SetUpValue(l, -2, 1)
+	_, err = limitedCall(l, steps, 1, "watch expression")
+	return err
+}
+
+// Eval runs the Lua statements in code in the scope of the Lua function
+// running in frame f, for the read-eval-print loop of a debugger stopped at
+// a breakpoint. Names resolve like in Watch, but assignments to the locals
+// and upvalues of the function change them in the frame, and assignments to
+// other names set fields of its _ENV. As in the standalone interpreter, code
+// that is a valid expression is evaluated and its values are returned.
+//
+// The limit on steps and the handling of errors are those of Watch. On
+// success, Eval pushes all values returned by code and returns their number.
+func Eval(l *State, f Frame, code string, steps int) (int, error) {
+	s, err := newFrameScope(l, f, "eval")
+	if err != nil {
+		return 0, err
+	}
+	if LoadBuffer(l, "return "+code, "=eval", "t") != nil {
+		l.Pop(1)
+		if err := LoadBuffer(l, code, "=eval", "t"); err != nil {
+			l.Pop(1)
+			return 0, err
+		}
+	}
+	s.pushEnv(l, true)
+	SetUpValue(l, -2, 1)
+	return limitedCall(l, steps, MultipleReturns, "eval")
+}
+
 func upValueHelper(f func(*State, int, int) (string, bool), returnValueCount int) Function {
 	return func(l *State) int {
 		CheckType(l, 1, TypeFunction)
@@ -1113,6 +1303,43 @@ var debugLibrary = []RegistryFunction{
 		return 1
 	}},
 	{"setupvalue", upValueHelper(SetUpValue, 1)},
+	{"listing", func(l *State) int {
+		// go-lua extension: debug.listing(f [, full]) returns the "luac -l"
+		// listing of f and the functions nested in it.
+		_, ok := l.ToValue(1).(*luaClosure)
+		ArgumentCheck(l, ok, 1, "Lua function expected")
+		var b strings.Builder
+		full := l.ToBoolean(2)
+		l.SetTop(1)
+		_ = ListChunk(l, &b, full)
+		l.PushString(b.String())
+		return 1
+	}},
+	{"tablestats", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		s := TableStatistics(l, 1)
+		l.CreateTable(0, 9)
+		for _, f := range []struct {
+			name  string
+			value int
+		}{
+			{"arraysize", s.ArrayLength},
+			{"arrayused", s.ArrayUsed},
+			{"arraycapacity", s.ArrayCapacity},
+			{"hashsize", s.HashSize},
+			{"hashcount", s.HashCount},
+			{"hashused", s.HashUsed},
+			{"memory", s.Memory},
+		} {
+			l.PushInteger(f.value)
+			l.SetField(-2, f.name)
+		}
+		l.PushNumber(s.ArrayLoad())
+		l.SetField(-2, "arrayload")
+		l.PushNumber(s.HashLoad())
+		l.SetField(-2, "hashload")
+		return 1
+	}},
 	{"traceback", func(l *State) int {
 		i, l1 := threadArg(l)
 		if s, ok := l.ToString(i + 1); !ok && !l.IsNoneOrNil(i+1) {
@@ -0,0 +1,142 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	watches := map[string]string{}
+	l.Register("stop", func(l *State) int {
+		f, _ := Stack(l, 1)
+		for _, expr := range []string{"x + y", "up .. name", "x", "#t", "math.max(x, 10)", "undefined"} {
+			if err := Watch(l, f, expr, 1000); err != nil {
+				t.Fatalf("%s: %v", expr, err)
+			}
+			watches[expr], _ = ToStringMeta(l, -1)
+			l.Pop(2)
+		}
+		top := l.Top()
+		if err := Watch(l, f, "(function() while true do end end)()", 1000); err == nil || !strings.Contains(err.Error(), "exceeded 1000 steps") {
+			t.Errorf("endless watch: got %v", err)
+		}
+		if err := Watch(l, f, "(function() while true do pcall(function() for i = 1, 1e12 do end end) end end)()", 1000); err == nil || !strings.Contains(err.Error(), "exceeded 1000 steps") {
+			t.Errorf("endless watch in pcall: got %v", err)
+		}
+		if err := Watch(l, f, "x +", 0); err == nil {
+			t.Error("syntax error expected")
+		}
+		if l.Top() != top {
+			t.Errorf("failed watches left %d values on the stack", l.Top()-top)
+		}
+		return 0
+	})
+	if err := DoString(l, `
+		local up = "up:"
+		local function f(x)
+			local y = 2
+			local name = "f"
+			local t = {1, 2, 3}
+			do
+				local x = 40
+				stop()
+			end
+			return up
+		end
+		f(1)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"x + y": "42", "up .. name": "up:f", "x": "40", "#t": "3", "math.max(x, 10)": "40", "undefined": "nil"}
+	for expr, v := range want {
+		if watches[expr] != v {
+			t.Errorf("%s = %s, want %s", expr, watches[expr], v)
+		}
+	}
+}
+
+func TestWatchFromHook(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	var errs []error
+	SetDebugHook(l, func(l *State, d Debug) {
+		f, _ := Stack(l, 0)
+		err := Watch(l, f, "(function() repeat until false end)()", 500)
+		errs = append(errs, err)
+		SetDebugHook(l, nil, 0, 0)
+	}, MaskLine, 0)
+	if err := DoString(l, "local a = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0] == nil || !strings.Contains(errs[0].Error(), "exceeded 500 steps") {
+		t.Errorf("got %v", errs)
+	}
+}
+
+func TestEval(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	var results []string
+	l.Register("breakpoint", func(l *State) int {
+		f, _ := Stack(l, 1)
+		for _, code := range []string{"x = x * 2", "count = count + 1", "seen = true", "local t = {} for i = 1, 3 do t[i] = i end return #t", "x, count", "big = string.rep('x', 100000)"} {
+			n, err := Eval(l, f, code, 0)
+			if err != nil {
+				t.Fatalf("%s: %v", code, err)
+			}
+			for i := -n; i < 0; i++ {
+				s, _ := ToStringMeta(l, i)
+				results = append(results, s)
+				l.Pop(1)
+			}
+			l.Pop(n)
+		}
+		if _, err := Eval(l, f, "while true do end", 500); err == nil || !strings.Contains(err.Error(), "exceeded 500 steps") {
+			t.Errorf("endless eval: got %v", err)
+		}
+		if _, err := Eval(l, f, "while true do pcall(function() for i = 1, 1e12 do end end) end", 500); err == nil || !strings.Contains(err.Error(), "exceeded 500 steps") {
+			t.Errorf("endless eval in pcall: got %v", err)
+		}
+		return 0
+	})
+	if err := DoString(l, `
+		local count = 0
+		local function f(x)
+			breakpoint()
+			return x, count
+		end
+		local x, c = f(21)
+		assert(x == 42 and c == 1, x)
+		assert(seen and #big == 100000)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(results, ","); got != "3,42,1" {
+		t.Errorf("results = %s, want 3,42,1", got)
+	}
+}
+
+func TestTableStats(t *testing.T) {
+	testString(t, `
+		local t = {}
+		t[1] = true
+		t[2] = true
+		t[16] = true -- not sequential, goes to the hash part
+		t[3] = true
+		local s = debug.tablestats(t)
+		assert(s.arrayused == 3 and s.arraysize >= 3 and s.hashcount == 1, "split")
+		assert(s.hashsize == 4 and s.hashused == 1 and s.hashload == 0.25)
+		assert(s.arrayload == s.arrayused / s.arraysize and s.memory > 0)
+
+		t[16] = nil -- the slot stays taken until the next rehash
+		s = debug.tablestats(t)
+		assert(s.hashcount == 0 and s.hashused == 1)
+		table.compact(t)
+		s = debug.tablestats(t)
+		assert(s.hashsize == 0 and s.hashused == 0 and s.hashload == 0)
+		assert(s.arraysize == 4 and s.arraycapacity == 4 and s.arrayload == 0.75)
+		assert(not pcall(debug.tablestats, 1))
+	`)
+}
@@ -0,0 +1,134 @@
+package lua
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTypedErrors(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	for _, c := range []struct {
+		chunk, name string
+		syntax      bool
+		chunkName   string
+		line        int
+		message     string
+		value       interface{}
+		text        string
+	}{
+		{"x = = 1", "=test", true, "test", 1, "unexpected symbol near '='",
+			"test:1: unexpected symbol near '='", "syntax error: test:1: unexpected symbol near '='"},
+		{"local x\nx()", "chunk", false, `[string "chunk"]`, 2, "attempt to call a nil value (local 'x')",
+			`[string "chunk"]:2: attempt to call a nil value (local 'x')`,
+			`runtime error: [string "chunk"]:2: attempt to call a nil value (local 'x')`},
+		{"\n\nerror('at: 3')", "@dir/f.lua", false, "dir/f.lua", 3, "at: 3",
+			"dir/f.lua:3: at: 3", "runtime error: dir/f.lua:3: at: 3"},
+		{"error('no position', 0)", "@f.lua", false, "", 0, "no position", "no position", "runtime error: no position"},
+		{"error('[string \"x\"]: 1', 0)", "=t", false, "", 0, `[string "x"]: 1`, `[string "x"]: 1`, `runtime error: [string "x"]: 1`},
+		{"error(42)", "=t", false, "", 0, "", int64(42), "runtime error: 42"},
+		{"error()", "=t", false, "", 0, "", nil, "runtime error: (error object is a nil value)"},
+		{"error(true)", "=t", false, "", 0, "", true, "runtime error: (error object is a boolean value)"},
+	} {
+		err := LoadBuffer(l, c.chunk, c.name, "")
+		if err == nil {
+			err = l.ProtectedCall(0, 0, 0)
+		}
+		l.Pop(1)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%s: %T is not an *Error", c.chunk, err)
+			continue
+		}
+		var r RuntimeError
+		if c.syntax && !errors.Is(err, SyntaxError) || !c.syntax && !errors.As(err, &r) {
+			t.Errorf("%s: wrong kind of error %v", c.chunk, e.Err)
+		}
+		if e.ChunkName != c.chunkName || e.Line != c.line || e.Message != c.message {
+			t.Errorf("%s: got %q, %d, %q, want %q, %d, %q", c.chunk, e.ChunkName, e.Line, e.Message, c.chunkName, c.line, c.message)
+		}
+		if e.Value != c.value {
+			t.Errorf("%s: value %#v, want %#v", c.chunk, e.Value, c.value)
+		}
+		if e.Error() != c.text {
+			t.Errorf("%s: Error() = %q, want %q", c.chunk, e.Error(), c.text)
+		}
+	}
+
+	// Errors that are not errors of Lua are not wrapped.
+	l.PushGoFunction(func(l *State) int { panic(errors.New("not Lua")) })
+	if err := l.ProtectedCall(0, 0, 0); err == nil || err.Error() != "not Lua" {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestErrorValue(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	err := DoString(l, `
+		local E = {__name = "MyError"}
+		error(setmetatable({code = 42}, E))
+	`)
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("%T is not an *Error", err)
+	}
+	if want := "runtime error: (error object is a MyError value)"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	l.SetTop(0)
+	e.Push(l)
+	l.Field(-1, "code")
+	if code, _ := l.ToInteger(-1); code != 42 || e.Message != "" {
+		t.Errorf("code %d, message %q", code, e.Message)
+	}
+
+	// The value can be raised again, also from a thread of the state.
+	co := l.NewThread()
+	co.PushGoFunction(func(co *State) int {
+		e.Push(co)
+		co.Error()
+		return 0
+	})
+	var again *Error
+	if err := co.ProtectedCall(0, 0, 0); !errors.As(err, &again) || again.Value != e.Value {
+		t.Errorf("raised again: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Push to another state did not panic")
+			}
+		}()
+		e.Push(NewState())
+	}()
+}
+
+func TestVariableNamesInErrors(t *testing.T) {
+	for _, c := range []struct{ chunk, message string }{
+		{"return foo.x", "attempt to index a nil value (global 'foo')"},
+		{"local t = {} t.a.b = 1", "attempt to index a nil value (field 'a')"},
+		{"local x; return x.y", "attempt to index a nil value (local 'x')"},
+		{"local up; (function() return up.x end)()", "attempt to index a nil value (upvalue 'up')"},
+		{"local t = {} return t[1].x", "attempt to index a nil value (field '?')"},
+		{"return foo()", "attempt to call a nil value (global 'foo')"},
+		{"local t = {} t:m()", "attempt to call a nil value (method 'm')"},
+		{"return math.foo()", "attempt to call a nil value (field 'foo')"},
+		{"for k in nil do end", "attempt to call a nil value (for iterator 'for iterator')"},
+		{"return 1 + foo", "attempt to perform arithmetic on a nil value (global 'foo')"},
+		{"local t = {} return t.x // 1", "attempt to perform arithmetic on a nil value (field 'x')"},
+		{`return ("x") + {}`, "attempt to perform arithmetic on a string value (constant 'x')"},
+		{"local s = 'a' return s & 1", "attempt to perform bitwise operation on a string value (local 's')"},
+		{"local t = {} return t.x .. 's'", "attempt to concatenate a nil value (field 'x')"},
+		{"return #foo", "attempt to get length of a nil value (global 'foo')"},
+		{"return {} < 1", "attempt to compare table with number"},
+	} {
+		l := NewState()
+		OpenLibraries(l)
+		var e *Error
+		if err := DoString(l, c.chunk); !errors.As(err, &e) || e.Message != c.message {
+			t.Errorf("%s: got %v, want %q", c.chunk, err, c.message)
+		}
+	}
+}
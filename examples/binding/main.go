@@ -0,0 +1,224 @@
+// Command binding makes Go structs usable from Lua with reflection.
+//
+// Push wraps a pointer to a struct in a userdata whose metatable, shared by
+// all values of the type, maps field accesses and method calls to the Go
+// value: account.Owner reads a field, account.Balance = 10 sets it, and
+// account:Deposit(5) calls a method. Numbers, strings, booleans and other
+// bound structs are converted in both directions; a Go method that returns
+// an error raises it as a Lua error.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// An Account is the Go type bound in the example.
+type Account struct {
+	Owner   string
+	Balance int
+	Frozen  bool
+	History []string // not convertible, so not visible from Lua
+}
+
+// Deposit adds amount to the balance.
+func (a *Account) Deposit(amount int) {
+	a.Balance += amount
+	a.History = append(a.History, fmt.Sprintf("deposit %d", amount))
+}
+
+// Transfer moves amount to another account.
+func (a *Account) Transfer(to *Account, amount int) error {
+	switch {
+	case a.Frozen:
+		return errors.New("account is frozen")
+	case amount > a.Balance:
+		return fmt.Errorf("insufficient funds: %d < %d", a.Balance, amount)
+	}
+	a.Balance -= amount
+	to.Balance += amount
+	return nil
+}
+
+// String is used by tostring.
+func (a *Account) String() string { return fmt.Sprintf("Account(%s, %d)", a.Owner, a.Balance) }
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Push pushes p, which must be a pointer to a struct, as a userdata.
+func Push(l *lua.State, p interface{}) {
+	t := reflect.TypeOf(p)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("binding: %v is not a pointer to a struct", t))
+	}
+	l.PushUserData(p)
+	if lua.NewMetaTable(l, "binding."+t.String()) {
+		lua.SetFunctions(l, []lua.RegistryFunction{
+			{Name: "__index", Function: index},
+			{Name: "__newindex", Function: newIndex},
+			{Name: "__tostring", Function: toString},
+		}, 0)
+	}
+	l.SetMetaTable(-2)
+}
+
+// check returns the struct that argument 1 points to.
+func check(l *lua.State) reflect.Value {
+	if p := l.ToUserData(1); p != nil {
+		if v := reflect.ValueOf(p); v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+			return v
+		}
+	}
+	lua.ArgumentError(l, 1, "bound struct expected")
+	panic("unreachable")
+}
+
+func index(l *lua.State) int {
+	p, name := check(l), lua.CheckString(l, 2)
+	if m := p.MethodByName(name); m.IsValid() {
+		receiver := p.Interface()
+		l.PushGoFunction(func(l *lua.State) int {
+			if l.ToUserData(1) != receiver {
+				lua.ArgumentError(l, 1, "receiver expected, call the method with ':'")
+			}
+			return call(l, name, m)
+		})
+		return 1
+	}
+	if f := p.Elem().FieldByName(name); f.IsValid() && f.CanInterface() && push(l, f) {
+		return 1
+	}
+	l.PushNil()
+	return 1
+}
+
+func newIndex(l *lua.State) int {
+	p, name := check(l), lua.CheckString(l, 2)
+	f := p.Elem().FieldByName(name)
+	if !f.IsValid() || !f.CanSet() {
+		lua.Errorf(l, "%s has no field '%s'", p.Type().String(), name)
+	}
+	f.Set(to(l, 3, f.Type()))
+	return 0
+}
+
+func toString(l *lua.State) int {
+	p := check(l)
+	if s, ok := p.Interface().(fmt.Stringer); ok {
+		l.PushString(s.String())
+	} else {
+		l.PushString(p.Type().String())
+	}
+	return 1
+}
+
+// call calls the method m with the arguments from index 2 on, since index 1
+// is the receiver of a call with ':'.
+func call(l *lua.State, name string, m reflect.Value) int {
+	t := m.Type()
+	if l.Top()-1 != t.NumIn() {
+		lua.Errorf(l, "%s expects %d arguments, got %d", name, t.NumIn(), l.Top()-1)
+	}
+	args := make([]reflect.Value, t.NumIn())
+	for i := range args {
+		args[i] = to(l, i+2, t.In(i))
+	}
+	n := 0
+	for _, r := range m.Call(args) {
+		if r.Type() == errorType {
+			if !r.IsNil() {
+				lua.Errorf(l, "%s", r.Interface().(error).Error())
+			}
+		} else if push(l, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// push pushes v and reports whether its type could be converted.
+func push(l *lua.State, v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.PushInteger64(v.Int())
+	case reflect.Float32, reflect.Float64:
+		l.PushNumber(v.Float())
+	case reflect.String:
+		l.PushString(v.String())
+	case reflect.Bool:
+		l.PushBoolean(v.Bool())
+	case reflect.Ptr:
+		if v.Elem().Kind() != reflect.Struct {
+			return false
+		}
+		Push(l, v.Interface())
+	default:
+		return false
+	}
+	return true
+}
+
+// to converts the argument at index to the type t, or raises an error.
+func to(l *lua.State, index int, t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(lua.CheckInteger64(l, index))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(lua.CheckNumber(l, index))
+	case reflect.String:
+		v.SetString(lua.CheckString(l, index))
+	case reflect.Bool:
+		lua.CheckType(l, index, lua.TypeBoolean)
+		v.SetBool(l.ToBoolean(index))
+	case reflect.Ptr:
+		p := reflect.ValueOf(l.ToUserData(index))
+		if !p.IsValid() || p.Type() != t {
+			lua.ArgumentError(l, index, t.String()+" expected")
+		}
+		return p
+	default:
+		lua.ArgumentError(l, index, "unsupported type "+t.String())
+	}
+	return v
+}
+
+const script = `
+alice.Balance = 100
+alice:Deposit(50)
+print(alice, bob)
+alice:Transfer(bob, 120)
+print(alice, bob)
+print(pcall(alice.Transfer, alice, bob, 1000))
+bob.Frozen = true
+print(pcall(bob.Transfer, bob, alice, 1))
+print(alice.History, pcall(function() alice.Missing = 1 end))
+`
+
+func run(w io.Writer) error {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.SetStdout(l, w)
+	alice, bob := &Account{Owner: "alice"}, &Account{Owner: "bob"}
+	Push(l, alice)
+	l.SetGlobal("alice")
+	Push(l, bob)
+	l.SetGlobal("bob")
+	if err := lua.DoString(l, script); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "history of alice: %q\n", alice.History)
+	return nil
+}
+
+func main() {
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "binding:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	if err := run(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `Account(alice, 150)	Account(bob, 0)
+Account(alice, 30)	Account(bob, 120)
+false	insufficient funds: 30 < 1000
+false	account is frozen
+nil	false	[string "..."]:10: *main.Account has no field 'Missing'
+history of alice: ["deposit 50"]
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	tests := []struct{ code, err string }{
+		{`a.Balance = "lots"`, "number expected, got string"},
+		{`a.Frozen = 1`, "boolean expected, got number"},
+		{`a:Deposit()`, "Deposit expects 1 arguments, got 0"},
+		{`a:Transfer(42, 1)`, "*main.Account expected"},
+		{`a.Deposit(1, 2)`, "receiver expected"},
+		{`local m = getmetatable(a).__index; m(1, "x")`, "bound struct expected"},
+	}
+	for _, tt := range tests {
+		l := lua.NewState()
+		lua.OpenLibraries(l)
+		Push(l, &Account{})
+		l.SetGlobal("a")
+		err := lua.DoString(l, tt.code)
+		if err == nil {
+			t.Errorf("%s: no error", tt.code)
+			continue
+		}
+		if msg, _ := l.ToString(-1); !strings.Contains(msg, tt.err) {
+			t.Errorf("%s: got %q, want %q", tt.code, msg, tt.err)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+-- The configuration of a web service. It is plain Lua, so it can compute
+-- values, but it runs in a sandbox without io, os, require or load.
+name = "shop"
+port = tonumber(getenv("PORT", "8080"))
+debug = getenv("DEBUG", "") == "1"
+
+hosts = {}
+for i = 1, 3 do
+  hosts[#hosts + 1] = string.format("backend-%d.internal", i)
+end
+
+limits = {
+  requests = 100 * 60,
+  body = 1 << 20,
+}
@@ -0,0 +1,167 @@
+// Command config evaluates a configuration file written in Lua in a sandbox
+// and reads the result into a Go struct.
+//
+// The chunk runs with an environment of its own that offers only the safe
+// parts of the standard library, a getenv function that reads from a map
+// the host controls, and nothing that touches files, processes or other
+// code. CallWithTimeout stops configurations that loop forever, and mode
+// "t" rejects precompiled chunks, which could crash the interpreter.
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	lua "github.com/speedata/go-lua"
+)
+
+//go:embed config.lua
+var configSource string
+
+// Config is the configuration of the service.
+type Config struct {
+	Name   string
+	Port   int
+	Debug  bool
+	Hosts  []string
+	Limits map[string]int
+}
+
+// safeGlobals are the globals of the sandbox, copied from a state with the
+// standard libraries open.
+var safeGlobals = []string{
+	"assert", "error", "ipairs", "next", "pairs", "pcall", "select", "tonumber",
+	"tostring", "type", "math", "string", "table", "utf8",
+}
+
+// Load runs the configuration chunk src, named name in error messages, and
+// returns the globals it set. getenv is the environment the chunk can read;
+// timeout limits its running time.
+func Load(name, src string, getenv map[string]string, timeout time.Duration) (*Config, error) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	pushSandbox(l, getenv)
+	if err := lua.LoadBuffer(l, src, "@"+name, "t"); err != nil {
+		return nil, fmt.Errorf("%s", errorMessage(l))
+	}
+	l.PushValue(-2)
+	lua.SetUpValue(l, -2, 1) // the _ENV of the chunk
+	if err := lua.CallWithTimeout(l, timeout, 0, 0); err == lua.TimeoutError {
+		return nil, fmt.Errorf("%s: timed out after %v", name, timeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s", errorMessage(l))
+	}
+	return readConfig(l, name)
+}
+
+// pushSandbox pushes the environment of the chunk.
+func pushSandbox(l *lua.State, getenv map[string]string) {
+	l.NewTable()
+	for _, name := range safeGlobals {
+		l.Global(name)
+		l.SetField(-2, name)
+	}
+	l.PushGoFunction(func(l *lua.State) int {
+		if v, ok := getenv[lua.CheckString(l, 1)]; ok {
+			l.PushString(v)
+		} else {
+			l.PushString(lua.OptString(l, 2, ""))
+		}
+		return 1
+	})
+	l.SetField(-2, "getenv")
+}
+
+// readConfig reads the configuration from the environment on the top of the
+// stack.
+func readConfig(l *lua.State, name string) (*Config, error) {
+	c := &Config{Limits: map[string]int{}}
+	var err error
+	field := func(key string, t lua.Type) bool {
+		if err != nil {
+			return false
+		}
+		l.Field(-1, key)
+		if l.TypeOf(-1) != t {
+			err = fmt.Errorf("%s: %s must be a %s, not a %s", name, key, t, lua.TypeNameOf(l, -1))
+			l.Pop(1)
+			return false
+		}
+		return true
+	}
+	if field("name", lua.TypeString) {
+		c.Name, _ = l.ToString(-1)
+		l.Pop(1)
+	}
+	if field("port", lua.TypeNumber) {
+		c.Port, _ = l.ToInteger(-1)
+		l.Pop(1)
+	}
+	if field("debug", lua.TypeBoolean) {
+		c.Debug = l.ToBoolean(-1)
+		l.Pop(1)
+	}
+	if field("hosts", lua.TypeTable) {
+		for i := 1; ; i++ {
+			l.RawGetInt(-1, i)
+			host, ok := l.ToString(-1)
+			l.Pop(1)
+			if !ok {
+				break
+			}
+			c.Hosts = append(c.Hosts, host)
+		}
+		l.Pop(1)
+	}
+	if field("limits", lua.TypeTable) {
+		for l.PushNil(); l.Next(-2); l.Pop(1) {
+			key, _ := l.ToString(-2)
+			n, ok := l.ToInteger(-1)
+			if !ok || l.TypeOf(-2) != lua.TypeString {
+				err = fmt.Errorf("%s: limits.%v must be an integer", name, key)
+				l.Pop(2)
+				break
+			}
+			c.Limits[key] = n
+		}
+		l.Pop(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func errorMessage(l *lua.State) string {
+	msg, _ := l.ToString(-1)
+	l.Pop(1)
+	return msg
+}
+
+func run(w io.Writer) error {
+	c, err := Load("config.lua", configSource, map[string]string{"PORT": "9000"}, time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "name: %s\nport: %d\ndebug: %v\nhosts: %v\n", c.Name, c.Port, c.Debug, c.Hosts)
+	keys := make([]string, 0, len(c.Limits))
+	for k := range c.Limits {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "limits.%s: %d\n", k, c.Limits[k])
+	}
+	return nil
+}
+
+func main() {
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
+	}
+}
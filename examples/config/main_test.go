@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	if err := run(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `name: shop
+port: 9000
+debug: false
+hosts: [backend-1.internal backend-2.internal backend-3.internal]
+limits.body: 1048576
+limits.requests: 6000
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	tests := []struct{ name, src, err string }{
+		{"no os", `os.execute("rm -rf /")`, "attempt to index a nil value (global 'os')"},
+		{"no io", `io.open("/etc/passwd")`, "attempt to index a nil value (global 'io')"},
+		{"no load", `load("x = 1")()`, "attempt to call a nil value (global 'load')"},
+		{"no require", `require("os")`, "attempt to call a nil value (global 'require')"},
+		{"no binary chunks", "\x1bLua", "attempt to load a binary chunk"},
+		{"endless loop", `while true do end`, "timed out"},
+		{"wrong type", `name = "x" port = "80"`, "port must be a number, not a string"},
+		{"runtime error", `name = 1 .. nil`, "attempt to concatenate a nil value"},
+	}
+	for _, tt := range tests {
+		_, err := Load("test.lua", tt.src, nil, 50*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	c, err := Load("config.lua", configSource, map[string]string{"DEBUG": "1"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 8080 || !c.Debug {
+		t.Errorf("got port %d and debug %v", c.Port, c.Debug)
+	}
+}
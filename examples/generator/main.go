@@ -0,0 +1,165 @@
+// Command generator uses Lua coroutines as generators that Go code pulls
+// values from.
+//
+// The generators are ordinary recursive Lua functions. They hand out values
+// with emit, a Go function that yields the running coroutine, so they can
+// produce values from any depth of recursion without building a list.
+// Generate runs a generator in a coroutine created by coroutine.wrap and
+// resumes it for each value Go asks for, which also makes infinite
+// generators usable: Go stops asking, and the suspended coroutine is
+// garbage collected.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+)
+
+const generators = `
+-- permutations emits all orders of the elements of a.
+function permutations(a, n)
+  n = n or #a
+  if n <= 1 then
+    emit(table.concat(a, " "))
+    return
+  end
+  for i = 1, n do
+    a[n], a[i] = a[i], a[n]
+    permutations(a, n - 1)
+    a[n], a[i] = a[i], a[n]
+  end
+end
+
+-- fibonacci emits the Fibonacci numbers, without end.
+function fibonacci()
+  local a, b = 0, 1
+  while true do
+    emit(a)
+    a, b = b, a + b
+  end
+end
+
+-- words emits the words of s that pass the filter f.
+function words(s, f)
+  for w in s:gmatch("%a+") do
+    if f(w) then emit(w) end
+  end
+end
+`
+
+// emit yields its argument to the Go code that resumed the coroutine.
+func emit(l *lua.State) int {
+	lua.CheckAny(l, 1)
+	l.SetTop(1)
+	return l.Yield(1)
+}
+
+// Generate runs the global function name with args in a coroutine and
+// returns the first limit values it emits, or all of them if it returns
+// before. The arguments are pushed with push.
+func Generate(l *lua.State, limit int, name string, args ...interface{}) ([]string, error) {
+	l.Global("coroutine")
+	l.Field(-1, "wrap")
+	l.Remove(-2)
+	l.Global(name)
+	if err := l.ProtectedCall(1, 1, 0); err != nil {
+		return nil, popError(l)
+	}
+	defer l.Pop(1)
+	var values []string
+	for len(values) < limit {
+		l.PushValue(-1)
+		n := 0
+		if len(values) == 0 { // the first resume passes the arguments
+			for _, arg := range args {
+				push(l, arg)
+			}
+			n = len(args)
+		}
+		if err := l.ProtectedCall(n, 1, 0); err != nil {
+			return values, popError(l)
+		}
+		if l.IsNil(-1) { // the generator has returned
+			l.Pop(1)
+			break
+		}
+		s, _ := lua.ToStringMeta(l, -1)
+		l.Pop(2)
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func push(l *lua.State, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		l.PushInteger(v)
+	case string:
+		l.PushString(v)
+	case []string:
+		l.CreateTable(len(v), 0)
+		for i, s := range v {
+			l.PushString(s)
+			l.RawSetInt(-2, i+1)
+		}
+	case func(string) bool:
+		l.PushGoFunction(func(l *lua.State) int {
+			l.PushBoolean(v(lua.CheckString(l, 1)))
+			return 1
+		})
+	default:
+		panic(fmt.Sprintf("generator: cannot push %T", v))
+	}
+}
+
+func popError(l *lua.State) error {
+	msg, _ := l.ToString(-1)
+	l.Pop(1)
+	return fmt.Errorf("%s", msg)
+}
+
+// NewState returns a state with the generators defined.
+func NewState() (*lua.State, error) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	l.Register("emit", emit)
+	if err := lua.DoString(l, generators); err != nil {
+		return nil, popError(l)
+	}
+	return l, nil
+}
+
+func run(w io.Writer) error {
+	l, err := NewState()
+	if err != nil {
+		return err
+	}
+	perms, err := Generate(l, 100, "permutations", []string{"a", "b", "c"})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "permutations:", strings.Join(perms, ", "))
+	fib, err := Generate(l, 12, "fibonacci")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "fibonacci:", strings.Join(fib, " "))
+	long := func(w string) bool { return len(w) > 4 }
+	words, err := Generate(l, 100, "words", "Generators keep their state between resumes of the coroutine", long)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "long words:", strings.Join(words, " "))
+	return nil
+}
+
+func main() {
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "generator:", err)
+		os.Exit(1)
+	}
+}
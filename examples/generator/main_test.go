@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	if err := run(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `permutations: b c a, c b a, c a b, a c b, b a c, a b c
+fibonacci: 0 1 1 2 3 5 8 13 21 34 55 89
+long words: Generators their state between resumes coroutine
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	l, err := NewState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, `function failing() emit(1) emit(2) error("out of values") end`); err != nil {
+		t.Fatal(err)
+	}
+	values, err := Generate(l, 10, "failing")
+	if strings.Join(values, " ") != "1 2" || err == nil || !strings.Contains(err.Error(), "out of values") {
+		t.Errorf("got %q and %v", values, err)
+	}
+	if _, err := Generate(l, 10, "missing"); err == nil {
+		t.Error("no error for a missing generator")
+	}
+	if _, err := Generate(l, 10, "words", "some words", "not a function"); err == nil {
+		t.Error("no error for a wrong argument")
+	}
+	if l.Top() != 0 {
+		t.Errorf("%d values left on the stack", l.Top())
+	}
+}
@@ -0,0 +1,157 @@
+// Command pool serves HTTP requests with a Lua handler, using a pool of Lua
+// states so that requests run in parallel.
+//
+// A State is not safe for concurrent use, and creating one and opening its
+// libraries for every request is expensive. The server keeps the states it
+// has created in a sync.Pool instead: each has the handler compiled and
+// ready, and a request borrows one for its duration. The request is passed
+// to the Lua functions through a host slot, which is cleared before the
+// state goes back into the pool, and Reset undoes what the handler changed
+// in the globals, so that one request cannot affect the next. Settings
+// shared by all states live in a frozen table that Go code reads without
+// locking.
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// handlerSource is the script of the server. It returns the handler, which
+// returns the status and the body of the response.
+const handlerSource = `
+local greeting = setting("greeting")
+return function()
+  local name = query("name")
+  if not name then
+    return 400, "missing name"
+  end
+  return 200, string.format("%s, %s! (%s %s)", greeting, name, method(), path())
+end
+`
+
+// settingsSource is run once; the table it returns is frozen and shared.
+const settingsSource = `return table.freeze { greeting = "Hello", timeout = 0.5 }`
+
+// The host slot that holds the request a state is serving.
+const requestSlot = 0
+
+// A Server runs handlerSource for every request.
+type Server struct {
+	settings lua.FrozenTable
+	timeout  time.Duration
+	states   sync.Pool
+}
+
+// NewServer loads the shared settings and returns a server.
+func NewServer() (*Server, error) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	if err := lua.DoString(l, settingsSource); err != nil {
+		return nil, err
+	}
+	settings, ok := lua.ToFrozenTable(l, -1)
+	if !ok {
+		return nil, fmt.Errorf("the settings are not a frozen table")
+	}
+	s := &Server{settings: settings}
+	timeout, _ := settings.Field("timeout").(float64)
+	s.timeout = time.Duration(timeout * float64(time.Second))
+	s.states.New = func() interface{} { return s.newState() }
+	return s, nil
+}
+
+// newState creates a state with the functions of the handler and the
+// handler in the global handler, and takes the snapshot for Reset.
+func (s *Server) newState() *lua.State {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	l.Register("setting", func(l *lua.State) int {
+		l.PushString(fmt.Sprint(s.settings.Field(lua.CheckString(l, 1))))
+		return 1
+	})
+	l.Register("query", func(l *lua.State) int {
+		v := request(l).URL.Query().Get(lua.CheckString(l, 1))
+		if v == "" {
+			l.PushNil()
+		} else {
+			l.PushString(v)
+		}
+		return 1
+	})
+	l.Register("method", func(l *lua.State) int {
+		l.PushString(request(l).Method)
+		return 1
+	})
+	l.Register("path", func(l *lua.State) int {
+		l.PushString(request(l).URL.Path)
+		return 1
+	})
+	if err := lua.DoString(l, handlerSource); err != nil {
+		panic(err) // the script is part of the program
+	}
+	l.SetGlobal("handler")
+	l.Snapshot()
+	return l
+}
+
+// request returns the request that l is serving.
+func request(l *lua.State) *http.Request {
+	return lua.HostSlot(l, requestSlot).(*http.Request)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := s.states.Get().(*lua.State)
+	defer s.states.Put(l)
+	lua.SetHostSlot(l, requestSlot, r)
+	defer lua.SetHostSlot(l, requestSlot, nil)
+	defer l.Reset()
+
+	l.Global("handler")
+	err := lua.CallWithTimeout(l, s.timeout, 0, 2)
+	if err != nil {
+		msg, _ := l.ToString(-1)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	status, _ := l.ToInteger(-2)
+	body, _ := l.ToString(-1)
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+func run(w io.Writer) error {
+	s, err := NewServer()
+	if err != nil {
+		return err
+	}
+	for _, target := range []string{"/hello?name=Ada", "/hello", "/greet?name=Grace"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		fmt.Fprintf(w, "%s: %d %s\n", target, rec.Code, rec.Body.String())
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		s, err := NewServer()
+		if err == nil {
+			fmt.Println("listening on", os.Args[1])
+			err = http.ListenAndServe(os.Args[1], s)
+		}
+		fmt.Fprintln(os.Stderr, "pool:", err)
+		os.Exit(1)
+	}
+	if err := run(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "pool:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+	if err := run(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `/hello?name=Ada: 200 Hello, Ada! (GET /hello)
+/hello: 400 missing name
+/greet?name=Grace: 200 Hello, Grace! (GET /greet)
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// TestConcurrentRequests runs requests in parallel; with -race it checks
+// that no state is used by two requests at once.
+func TestConcurrentRequests(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("POST", fmt.Sprintf("/n?name=%d", i), nil))
+			if want := fmt.Sprintf("Hello, %d! (POST /n)", i); rec.Body.String() != want {
+				t.Errorf("got %q, want %q", rec.Body.String(), want)
+			}
+		}()
+	}
+	wg.Wait()
+}
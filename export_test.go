@@ -0,0 +1,39 @@
+package lua
+
+import "strings"
+
+// A ScannedToken is a token as go-lua's compiler reads it: its text, the
+// line where it ends and, for numerals and strings, its value.
+type ScannedToken struct {
+	Text  string
+	Line  int
+	Value interface{}
+}
+
+// Scan returns the tokens that the compiler reads from src, so that tests
+// outside the package can compare them with package syntax.
+func Scan(src string) (scanned []ScannedToken, err error) {
+	l := NewState()
+	s := &scanner{r: strings.NewReader(src), lineNumber: 1, lastLine: 1, lookAheadToken: token{t: tkEOS}, l: l, source: "=scan"}
+	err = l.protectedCall(func() {
+		for s.next(); s.t != tkEOS; s.next() {
+			t := ScannedToken{Line: s.lineNumber}
+			switch s.t {
+			case tkName:
+				t.Text = s.s
+			case tkNumber:
+				t.Text, t.Value = "<number>", s.n
+			case tkInteger:
+				t.Text, t.Value = "<number>", s.i
+			case tkString:
+				t.Text, t.Value = "<string>", s.s
+			default:
+				if t.Text = string(s.t); s.t >= firstReserved {
+					t.Text = tokens[s.t-firstReserved]
+				}
+			}
+			scanned = append(scanned, t)
+		}
+	}, l.top, l.errorFunction)
+	return
+}
@@ -0,0 +1,145 @@
+package lua
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// fileHandle is the name of the metatable of the files of the io library.
+const fileHandle = "FILE*"
+
+// File is the interface implemented by the handles of the io library. An
+// *os.File satisfies it, and hosts may supply other implementations through
+// a FileOpener or PushFile. Files that also implement io.Seeker support
+// file:seek; files with SetReadDeadline and SetWriteDeadline methods, such as
+// pipes and network connections, support file:setdeadline.
+type File interface {
+	io.ReadWriteCloser
+}
+
+var errNotSeekable = errors.New("file is not seekable")
+
+// A FileOpener opens the named file with the given flags, which are the ones
+// accepted by os.OpenFile. It is used by io.open, io.lines, io.input,
+// io.output, loadfile, dofile and require, so it can map paths, restrict
+// access or serve files from memory.
+type FileOpener func(name string, flag int) (File, error)
+
+// SetFileOpener sets the function used to open files by name and returns the
+// previous one. A nil opener restores the default, which uses os.OpenFile,
+// or fails in builds with the lua_noos tag, where the opener is the only
+// way for loadfile, dofile and require to read files. The opener is shared
+// by all threads of l.
+func SetFileOpener(l *State, opener FileOpener) FileOpener {
+	old := l.global.fileOpener
+	if old == nil {
+		old = defaultFileOpener
+	}
+	l.global.fileOpener = opener
+	return old
+}
+
+func openFile(l *State, name string, flag int) (File, error) {
+	if l.global.fileOpener != nil {
+		return l.global.fileOpener(name, flag)
+	}
+	return defaultFileOpener(name, flag)
+}
+
+// SetStdin sets the reader behind io.stdin, which is also used by io.read,
+// io.lines and loadfile when no file name is given. A nil reader restores
+// os.Stdin, or an empty reader in builds with the lua_noos tag.
+func SetStdin(l *State, r io.Reader) { l.global.stdin = r }
+
+// SetStdout sets the writer behind io.stdout, which is also the target of
+// print, io.write and the output of commands run by os.execute. A nil writer
+// restores os.Stdout, or discards the output in builds with the lua_noos
+// tag.
+func SetStdout(l *State, w io.Writer) { l.global.stdout = w }
+
+// SetStderr sets the writer behind io.stderr, which also receives warnings. A
+// nil writer restores os.Stderr, or discards the output in builds with the
+// lua_noos tag.
+func SetStderr(l *State, w io.Writer) { l.global.stderr = w }
+
+func (g *globalState) stdinReader() io.Reader {
+	if g.stdin != nil {
+		return g.stdin
+	}
+	return defaultStdin()
+}
+
+func (g *globalState) stdoutWriter() io.Writer {
+	if g.stdout != nil {
+		return g.stdout
+	}
+	return defaultStdout()
+}
+
+func (g *globalState) stderrWriter() io.Writer {
+	if g.stderr != nil {
+		return g.stderr
+	}
+	return defaultStderr()
+}
+
+// standardFile is the File behind io.stdin, io.stdout and io.stderr. It
+// looks up the current stream on every call, so redirecting a stream also
+// affects handles that were created before.
+type standardFile struct {
+	g  *globalState
+	fd int // 0, 1 or 2 as in C
+}
+
+func (f standardFile) stream() interface{} {
+	switch f.fd {
+	case 0:
+		return f.g.stdinReader()
+	case 1:
+		return f.g.stdoutWriter()
+	}
+	return f.g.stderrWriter()
+}
+
+func (f standardFile) Read(p []byte) (int, error) {
+	if r, ok := f.stream().(io.Reader); ok {
+		return r.Read(p)
+	}
+	return 0, fs.ErrInvalid
+}
+
+func (f standardFile) Write(p []byte) (int, error) {
+	if w, ok := f.stream().(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, fs.ErrInvalid
+}
+
+func (f standardFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.stream().(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errNotSeekable
+}
+
+func (f standardFile) Sync() error { return flushFile(f.stream()) }
+func (standardFile) Close() error  { return nil } // standard files are never closed
+
+// flushFile commits buffered data of f, if it supports it.
+func flushFile(f interface{}) error {
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// A NumberFormat sets how io.write and file:write write numbers. Each
+// field is a format of string.format with a single conversion for the
+// number, such as "%.3f" or "%08d", and may contain other text. An empty
+// field keeps the default: floats are written like tostring writes them and
+// integers as they are.
+type NumberFormat struct {
+	Float   string // for floats: a conversion among e, E, f, g, G, a and A
+	Integer string // for integers: also d, i, u, o, x and X
+}
@@ -0,0 +1,199 @@
+// Package format reprints Lua source code in a canonical layout.
+//
+// The formatter keeps the line structure and the comments of the source. It
+// indents each line by the nesting of the blocks, tables and parentheses
+// around it, puts single spaces around binary operators, after commas and
+// between words, and none inside brackets or after unary operators. It
+// removes trailing spaces and collapses runs of blank lines into one.
+// Strings, numbers and comments are written as they are.
+//
+// The source must be valid Lua: it is compiled with go-lua's parser first,
+// and syntax errors are returned as errors.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+	"github.com/speedata/go-lua/syntax"
+)
+
+// A Config controls the output of Source.
+type Config struct {
+	Indent string // the string that indents a line by one level
+}
+
+// Source formats src with tabs for indentation.
+func Source(src []byte) ([]byte, error) {
+	return (&Config{Indent: "\t"}).Source(src)
+}
+
+// Source formats src, which must be a valid Lua chunk.
+func (c *Config) Source(src []byte) ([]byte, error) {
+	chunk := string(src)
+	if strings.HasPrefix(chunk, "#") { // skip the first line like lua.LoadFile
+		if i := strings.IndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[i:]
+		} else {
+			chunk = ""
+		}
+	}
+	l := lua.NewState()
+	if err := lua.LoadBuffer(l, chunk, "=input", "t"); err != nil {
+		msg, _ := l.ToString(-1)
+		return nil, fmt.Errorf("%s", msg)
+	}
+	tokens, err := lex(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("input:%v", err)
+	}
+	p := &printer{indent: c.Indent}
+	for i := range tokens {
+		p.print(tokens, i)
+	}
+	out := p.b.Bytes()
+	if len(out) > 0 {
+		out = append(out, '\n')
+	}
+	if err := sameTokens(tokens, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// sameTokens checks that out has the same tokens as the source, so that
+// formatting never changes the meaning of the code.
+func sameTokens(tokens []token, out []byte) error {
+	formatted, err := lex(string(out))
+	if err == nil && len(formatted) != len(tokens) {
+		err = fmt.Errorf("%d tokens instead of %d", len(formatted), len(tokens))
+	}
+	for i := 0; err == nil && i < len(tokens); i++ {
+		if formatted[i].text != tokens[i].text {
+			err = fmt.Errorf("token %q at line %d became %q", tokens[i].text, tokens[i].line, formatted[i].text)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("format: internal error: %v", err)
+	}
+	return nil
+}
+
+// A printer writes the tokens. Each line that leaves brackets or blocks open
+// indents the following lines by one level, however many it opens, so that
+// f(function() indents the function body once. levels holds the number of
+// openers still open for each level.
+type printer struct {
+	b       bytes.Buffer
+	indent  string
+	levels  []int
+	opened  bool   // the current line has pushed a level
+	prev    *token // the last token printed
+	endLine int    // the source line on which prev ends
+	inLabel bool   // between the colons of ::label::
+}
+
+// openers and closers change the nesting. else and elseif close the previous
+// part of an if statement; then and else open the next.
+var (
+	openers = map[string]bool{"do": true, "then": true, "repeat": true, "function": true, "else": true, "(": true, "{": true, "[": true}
+	closers = map[string]bool{"end": true, "until": true, "else": true, "elseif": true, ")": true, "}": true, "]": true}
+)
+
+func (t *token) opens() bool {
+	return t.kind != syntax.String && t.kind != syntax.Comment && openers[t.text]
+}
+func (t *token) closes() bool {
+	return t.kind != syntax.String && t.kind != syntax.Comment && closers[t.text]
+}
+
+// closeLevels returns levels after n closers.
+func closeLevels(levels []int, n int, copied bool) []int {
+	for ; n > 0 && len(levels) > 0; n-- {
+		top := len(levels) - 1
+		if !copied {
+			levels, copied = append([]int(nil), levels...), true
+		}
+		if levels[top]--; levels[top] == 0 {
+			levels = levels[:top]
+		}
+	}
+	return levels
+}
+
+func (p *printer) print(tokens []token, i int) {
+	t := &tokens[i]
+	if p.prev == nil || t.line > p.endLine {
+		if p.prev != nil {
+			p.b.WriteByte('\n')
+			if t.line > p.endLine+1 {
+				p.b.WriteByte('\n')
+			}
+		}
+		// A line that starts with closers is indented like the line that
+		// opened them.
+		n := 0
+		for j := i; j < len(tokens) && tokens[j].line == t.line && tokens[j].closes(); j++ {
+			n++
+		}
+		p.b.WriteString(strings.Repeat(p.indent, len(closeLevels(p.levels, n, false))))
+		p.opened = false
+	} else if p.space(t) {
+		p.b.WriteByte(' ')
+	}
+	p.b.WriteString(t.text)
+	if t.closes() {
+		before := len(p.levels)
+		p.levels = closeLevels(p.levels, 1, true)
+		if len(p.levels) < before {
+			p.opened = false
+		}
+	}
+	if t.opens() {
+		if p.opened {
+			p.levels[len(p.levels)-1]++
+		} else {
+			p.levels, p.opened = append(p.levels, 1), true
+		}
+	}
+	if t.kind == syntax.Symbol && t.text == "::" {
+		p.inLabel = !p.inLabel
+	}
+	p.prev, p.endLine = t, t.endLine
+}
+
+// space reports whether a space separates t from the previous token on the
+// same line.
+func (p *printer) space(t *token) bool {
+	prev := p.prev
+	switch {
+	case t.kind == syntax.Comment || prev.kind == syntax.Comment:
+		return true
+	case t.attribute && t.text == ">" || prev.attribute && prev.text == "<":
+		return false
+	case prev.text == "[" && (strings.HasPrefix(t.text, "[") || strings.HasPrefix(t.text, "=")),
+		t.text == "]" && prev.kind == syntax.String && strings.HasPrefix(prev.text, "["):
+		return true // [ [[s]] ] must not become [[[s]]]
+	case prev.unary && strings.HasPrefix(t.text, "-"):
+		return true // - -x must not become a comment
+	case prev.kind == syntax.Symbol && (prev.text == "(" || prev.text == "[" || prev.text == "{" || prev.text == "." || prev.text == ":" || prev.text == "#" || prev.unary):
+		return false
+	case prev.text == "::" && p.inLabel:
+		return false
+	}
+	if t.kind != syntax.Symbol {
+		return true
+	}
+	switch t.text {
+	case ",", ";", ")", "]", "}", ".", ":":
+		return false
+	case "::":
+		return !p.inLabel
+	case "(", "[":
+		callable := prev.kind == syntax.Name || prev.kind == syntax.String || prev.text == ")" || prev.text == "]" || prev.text == "}"
+		return !callable && !(t.text == "(" && prev.text == "function")
+	}
+	return true
+}
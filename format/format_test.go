@@ -0,0 +1,80 @@
+package format
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"", ""},
+		{"local   x  =1", "local x = 1\n"},
+		{"x=a+b*-c..d//e^-f", "x = a + b * -c .. d // e ^ -f\n"},
+		{"x = - -y; z = ~ ~y, a ~ b, #t", "x = - -y; z = ~~y, a ~ b, #t\n"},
+		{"local t={1,2;3, a={b=2},[ 'k' ]=4, [ [[s]] ]=5}", "local t = {1, 2; 3, a = {b = 2}, ['k'] = 4, [ [[s]] ] = 5}\n"},
+		{"f( a , b )( c ) [ d ] : m ( ) . n = f{ 1 } .. f'x'", "f(a, b)(c)[d]:m().n = f {1} .. f 'x'\n"},
+		{"local function f( a,... ) return function  (...) end end", "local function f(a, ...) return function(...) end end\n"},
+		{"local a<const>,b < close > =1,nil", "local a <const>, b <close> = 1, nil\n"},
+		{"goto  l ; :: l ::", "goto l; ::l::\n"},
+		{"if a then\nb()\nelseif c then\nd()\nelse\ne()\nend", "if a then\n\tb()\nelseif c then\n\td()\nelse\n\te()\nend\n"},
+		{"for i=1,2 do\nwhile x do\nrepeat\nx()\nuntil y\nend\nend", "for i = 1, 2 do\n\twhile x do\n\t\trepeat\n\t\t\tx()\n\t\tuntil y\n\tend\nend\n"},
+		{"f(function()\nreturn {\n1,\n}\nend)", "f(function()\n\treturn {\n\t\t1,\n\t}\nend)\n"},
+		{"\n\n-- c  \nx = 1   --[[ long ]]  -- short\n\n\n\ny = 2\n\n", "-- c\nx = 1 --[[ long ]] -- short\n\ny = 2\n"},
+		{"local s = [[\n  keep   \n]]  .. 'a\\z\n     b'", "local s = [[\n  keep   \n]] .. 'a\\z\n     b'\n"},
+		{"#!/usr/bin/env lua\nprint(  1 )", "#!/usr/bin/env lua\nprint(1)\n"},
+		{"x = 1e-3+0x1p+4-.5", "x = 1e-3 + 0x1p+4 - .5\n"},
+		{"do\r\n  x = 1\r\nend\r\n", "do\n\tx = 1\nend\n"},
+	}
+	for _, test := range tests {
+		out, err := Source([]byte(test.in))
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if string(out) != test.out {
+			t.Errorf("%q:\ngot  %q\nwant %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	out, err := (&Config{Indent: "  "}).Source([]byte("do\ndo\nx = 1\nend\nend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "do\n  do\n    x = 1\n  end\nend\n"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	if _, err := Source([]byte("x = = 1")); err == nil || !strings.Contains(err.Error(), "input:1: unexpected symbol near '='") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// TestLuaTests formats the files of the Lua test suite, checking that the
+// result is stable when formatted again.
+func TestLuaTests(t *testing.T) {
+	files, err := filepath.Glob("../lua-tests/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+	for _, name := range files {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		once, err := Source(src)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		twice, err := Source(once)
+		if err != nil {
+			t.Errorf("%s: formatted: %v", name, err)
+		} else if string(once) != string(twice) {
+			t.Errorf("%s: formatting is not stable", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/speedata/go-lua/syntax"
+)
+
+// A token is a piece of the source as it was written, with the lines on
+// which it starts and ends. Long strings and comments may span lines.
+type token struct {
+	kind          syntax.Kind
+	text          string
+	line, endLine int
+	unary         bool // a '-' or '~' that is a unary operator
+	attribute     bool // the '<' or '>' of a <const> or <close> attribute
+}
+
+// lex splits src into tokens with syntax.Scanner, keeping the comments. A
+// first line that starts with '#' is returned as a comment.
+func lex(src string) ([]token, error) {
+	var tokens []token
+	s := syntax.NewScanner([]byte(src))
+	for t := s.Next(); t.Kind != syntax.EOF; t = s.Next() {
+		if t.Kind == syntax.Invalid {
+			return nil, fmt.Errorf("%d: %s", t.Pos.Line, t.Err)
+		}
+		text := t.Text
+		if t.Kind == syntax.Comment && !strings.HasPrefix(text, "--[") {
+			text = strings.TrimRight(text, " \t\f\v")
+		}
+		tokens = append(tokens, token{kind: t.Kind, text: text, line: t.Pos.Line, endLine: t.End.Line})
+	}
+	markOperators(tokens)
+	return tokens, nil
+}
+
+// endsOperand reports whether t can end an operand, so that a '-' or '~'
+// after it is a binary operator.
+func (t token) endsOperand() bool {
+	switch t.kind {
+	case syntax.Name, syntax.Number, syntax.String:
+		return true
+	case syntax.Keyword:
+		return t.text == "end" || t.text == "nil" || t.text == "true" || t.text == "false"
+	case syntax.Symbol:
+		return t.text == ")" || t.text == "]" || t.text == "}" || t.text == "..."
+	}
+	return false
+}
+
+// markOperators marks the unary operators and the brackets of attributes.
+func markOperators(tokens []token) {
+	var prev *token
+	inLocal := false // in the names of a local declaration
+	for i := range tokens {
+		t := &tokens[i]
+		if t.kind == syntax.Comment || t.attribute {
+			continue
+		}
+		switch {
+		case t.text == "local":
+			inLocal = true
+		case inLocal && t.text == "<" && prev.kind == syntax.Name && i+2 < len(tokens) && tokens[i+2].text == ">":
+			t.attribute = true
+			tokens[i+2].attribute = true
+		case t.kind != syntax.Name && t.text != ",":
+			inLocal = false
+			if t.text == "-" || t.text == "~" {
+				t.unary = prev == nil || !prev.endsOperand()
+			}
+		}
+		prev = t
+	}
+}
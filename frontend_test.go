@@ -0,0 +1,95 @@
+package lua_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/speedata/go-lua"
+	"github.com/speedata/go-lua/syntax"
+)
+
+// TestSyntaxFrontend runs the compiler's scanner and package syntax over the
+// Lua test suite and checks that they read the same tokens on the same
+// lines, and that the literals of the syntax tree have the values that the
+// compiler reads.
+func TestSyntaxFrontend(t *testing.T) {
+	files, err := filepath.Glob("lua-tests/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+	for _, name := range files {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := src
+		if len(chunk) > 0 && chunk[0] == '#' {
+			chunk = chunk[bytes.IndexAny(chunk, "\r\n"):]
+		}
+		want, err := lua.Scan(string(chunk))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var got []lua.ScannedToken
+		for s := syntax.NewScanner(src); ; {
+			tok := s.Next()
+			if tok.Kind == syntax.EOF {
+				break
+			}
+			switch tok.Kind {
+			case syntax.Comment:
+				continue
+			case syntax.Number:
+				tok.Text = "<number>"
+			case syntax.String:
+				tok.Text = "<string>"
+			}
+			got = append(got, lua.ScannedToken{Text: tok.Text, Line: tok.End.Line})
+		}
+		var values []interface{}
+		for i, tok := range want {
+			if i < len(got) && got[i] != (lua.ScannedToken{Text: tok.Text, Line: tok.Line}) {
+				t.Fatalf("%s: token %d is %q on line %d, want %q on line %d", name, i, got[i].Text, got[i].Line, tok.Text, tok.Line)
+			}
+			if tok.Value != nil {
+				values = append(values, tok.Value)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s: %d tokens, want %d", name, len(got), len(want))
+		}
+		c, err := syntax.Parse(src, "@"+name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		type literal struct {
+			offset int
+			value  interface{}
+		}
+		var literals []literal
+		syntax.Inspect(c.Block, func(n syntax.Node) bool {
+			switch n := n.(type) {
+			case *syntax.NumberExpr:
+				literals = append(literals, literal{n.Pos().Offset, n.Value})
+			case *syntax.StringExpr:
+				literals = append(literals, literal{n.Pos().Offset, n.Value})
+			}
+			return n != nil
+		})
+		sort.Slice(literals, func(i, j int) bool { return literals[i].offset < literals[j].offset })
+		for i, l := range literals {
+			if i < len(values) && !reflect.DeepEqual(l.value, values[i]) {
+				t.Fatalf("%s: literal %d is %#v, want %#v", name, i, l.value, values[i])
+			}
+		}
+		if len(literals) != len(values) {
+			t.Fatalf("%s: %d literals, want %d", name, len(literals), len(values))
+		}
+	}
+}
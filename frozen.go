@@ -0,0 +1,88 @@
+package lua
+
+// A FrozenTable gives Go code read access to a table that was frozen with
+// table.freeze. A frozen table cannot be modified any more: assignments,
+// rawset and setmetatable raise "attempt to modify a frozen table". As its
+// contents never change, any number of goroutines may read it through a
+// FrozenTable at the same time, without locking and without the State that
+// owns it, which is not safe for concurrent use. This way, configuration
+// loaded once can be shared by the states of a pool.
+//
+// Freezing is shallow. Values are returned like ToValue returns them, except
+// that nested tables are returned as FrozenTable if they are frozen as well,
+// and as nil otherwise, since reading them would not be safe.
+type FrozenTable struct {
+	t *table
+}
+
+// ToFrozenTable returns a handle for the table at index, which must be
+// frozen. The second result is false if the value is not a frozen table.
+func ToFrozenTable(l *State, index int) (FrozenTable, bool) {
+	if t, ok := l.indexToValue(index).(*table); ok && t.frozen {
+		return FrozenTable{t}, true
+	}
+	return FrozenTable{}, false
+}
+
+// FreezeTable freezes the table at index, like table.freeze.
+func FreezeTable(l *State, index int) {
+	l.indexToValue(index).(*table).frozen = true
+}
+
+func (l *State) checkWritable(t *table) {
+	if t.frozen {
+		l.runtimeError("attempt to modify a frozen table")
+	}
+}
+
+func frozenValue(v value) interface{} {
+	switch v := v.(type) {
+	case *table:
+		if v.frozen {
+			return FrozenTable{v}
+		}
+		return nil
+	case *userData:
+		return v.data
+	}
+	return v
+}
+
+// Field returns the value of t[name].
+func (t FrozenTable) Field(name string) interface{} { return frozenValue(t.t.hash.getString(name)) }
+
+// Index returns the value of t[i].
+func (t FrozenTable) Index(i int) interface{} { return frozenValue(t.t.atInt(i)) }
+
+// Get returns the value of t[key]. Go integers are looked up as Lua
+// integers.
+func (t FrozenTable) Get(key interface{}) interface{} {
+	switch k := key.(type) {
+	case nil:
+		return nil
+	case int:
+		return t.Index(k)
+	case FrozenTable:
+		key = k.t
+	}
+	return frozenValue(t.t.at(key))
+}
+
+// Len returns the length of t as the # operator without metamethods does.
+func (t FrozenTable) Len() int { return t.t.length() }
+
+// Range calls f for every entry of t, in an unspecified order, until f
+// returns false.
+func (t FrozenTable) Range(f func(key, value interface{}) bool) {
+	for i, v := range t.t.array {
+		if v != nil && !f(int64(i+1), frozenValue(v)) {
+			return
+		}
+	}
+	for i := t.t.hash.nextLive(0); i >= 0; i = t.t.hash.nextLive(i + 1) {
+		n := &t.t.hash.nodes[i]
+		if !f(frozenValue(n.key), frozenValue(n.value)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package lua
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFrozenTable(t *testing.T) {
+	testString(t, `
+		local t = table.freeze({1, 2, 3, x = "x", sub = {}})
+		assert(table.isfrozen(t) and not table.isfrozen(t.sub))
+		local function fails(f, ...)
+			local ok, err = pcall(f, ...)
+			assert(not ok and err:find("attempt to modify a frozen table"), err)
+		end
+		fails(function() t.x = "y" end)
+		fails(function() t.new = 1 end)
+		fails(function() t[1] = nil end)
+		fails(rawset, t, "x", 1)
+		fails(setmetatable, t, {})
+		fails(table.insert, t, 4)
+		fails(table.remove, t)
+		fails(table.sort, t, function(a, b) return a > b end)
+		fails(table.move, {9}, 1, 1, 1, t)
+		table.compact(t)
+		assert(t.x == "x" and #t == 3 and table.concat(t, ",") == "1,2,3")
+		t.sub.y = 1 -- freezing is shallow
+		local copy = table.move(t, 1, 3, 1, {})
+		assert(#copy == 3)
+	`)
+}
+
+func TestFrozenTableConcurrentReads(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		config = {name = "app", limits = table.freeze({cpu = 2, mem = 512}), extra = {}}
+		for i = 1, 100 do config[i] = i * i; config["k" .. i] = i end
+		table.freeze(config)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("config")
+	config, ok := ToFrozenTable(l, -1)
+	if !ok {
+		t.Fatal("config is not frozen")
+	}
+	l.PushGlobalTable()
+	if _, ok := ToFrozenTable(l, -1); ok {
+		t.Error("globals are not frozen")
+	}
+	l.Pop(1)
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 200; round++ {
+				if config.Field("name") != "app" || config.Len() != 100 || config.Index(10) != int64(100) || config.Get("k7") != int64(7) {
+					errs <- "wrong value"
+					return
+				}
+				limits, ok := config.Field("limits").(FrozenTable)
+				if !ok || limits.Get("mem") != int64(512) || config.Field("extra") != nil {
+					errs <- "wrong nested table"
+					return
+				}
+				n := 0
+				config.Range(func(k, v interface{}) bool { n++; return true })
+				if n != 203 {
+					errs <- "wrong entry count"
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for len(errs) > 0 {
+		t.Error(<-errs)
+	}
+	if err := DoString(l, `config.name = "other"`); err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("got %v", err)
+	}
+}
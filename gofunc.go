@@ -0,0 +1,22 @@
+//go:build !tinygo
+// +build !tinygo
+
+package lua
+
+import (
+	"reflect"
+	"runtime"
+)
+
+// goFunctionPC returns the entry point of the Go function f.
+func goFunctionPC(f interface{}) uintptr { return reflect.ValueOf(f).Pointer() }
+
+// goFunctionInfo returns the name and position of the Go function at pc, and
+// an empty name if it is unknown.
+func goFunctionInfo(pc uintptr) (name, file string, line int) {
+	if f := runtime.FuncForPC(pc); f != nil {
+		file, line = f.FileLine(pc)
+		return f.Name(), file, line
+	}
+	return "", "", 0
+}
@@ -0,0 +1,11 @@
+//go:build tinygo
+// +build tinygo
+
+package lua
+
+// goFunctionPC returns 0: TinyGo's reflect cannot take the address of a
+// function, so all Go functions share one entry point.
+func goFunctionPC(f interface{}) uintptr { return 0 }
+
+// goFunctionInfo returns an empty name: TinyGo keeps no function table.
+func goFunctionInfo(pc uintptr) (name, file string, line int) { return "", "", 0 }
@@ -0,0 +1,87 @@
+package lua
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+const hashHandle = "HASH*"
+
+var hashAlgorithms = []string{"md5", "sha1", "sha256", "sha512", "crc32"}
+
+var hashConstructors = []func() hash.Hash{md5.New, sha1.New, sha256.New, sha512.New, func() hash.Hash { return crc32.NewIEEE() }}
+
+// A digest is an incremental hash. Data is added with update, which accepts
+// strings as well as open files and mappings, so large inputs are hashed
+// without being read into a single Lua string.
+type digest struct {
+	name string
+	h    hash.Hash
+}
+
+func toDigest(l *State) *digest { return CheckUserData(l, 1, hashHandle).(*digest) }
+
+var digestMethods = []RegistryFunction{
+	{"final", func(l *State) int {
+		// d:final([raw]) returns the digest in hex, or as a binary string if
+		// raw is true. The digest can be updated further afterwards.
+		sum := toDigest(l).h.Sum(nil)
+		if l.ToBoolean(2) {
+			l.PushString(string(sum))
+		} else {
+			l.PushString(hex.EncodeToString(sum))
+		}
+		return 1
+	}},
+	{"reset", func(l *State) int {
+		toDigest(l).h.Reset()
+		l.SetTop(1)
+		return 1
+	}},
+	{"update", func(l *State) int {
+		// d:update(data) adds a string, a mapping, or the rest of an open
+		// file, which is read in chunks until end of file. It returns d.
+		d := toDigest(l)
+		if err := hashData(l, d.h, 2); err != nil {
+			return FileResult(l, err, "")
+		}
+		l.SetTop(1)
+		return 1
+	}},
+	{"__tostring", func(l *State) int {
+		d := toDigest(l)
+		l.PushString(fmt.Sprintf("%s digest (%p)", d.name, d))
+		return 1
+	}},
+}
+
+var hashLibrary = []RegistryFunction{
+	{"new", func(l *State) int {
+		// hash.new(algorithm) returns a digest for md5, sha1, sha256, sha512
+		// or crc32.
+		i := CheckOption(l, 1, "", hashAlgorithms)
+		l.PushUserData(&digest{name: hashAlgorithms[i], h: hashConstructors[i]()})
+		SetMetaTableNamed(l, hashHandle)
+		return 1
+	}},
+}
+
+// HashOpen opens the hash library. It is not opened by OpenLibraries; pass
+// it as a preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "hash", Function: lua.HashOpen})
+func HashOpen(l *State) int {
+	NewMetaTable(l, hashHandle)
+	l.PushValue(-1)
+	l.SetField(-2, "__index")
+	SetFunctions(l, digestMethods, 0)
+	l.Pop(1)
+	NewLibrary(l, hashLibrary)
+	return 1
+}
@@ -0,0 +1,49 @@
+package lua
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	skipWithoutOS(t)
+	name := filepath.Join(t.TempDir(), "big.txt")
+	if err := os.WriteFile(name, []byte(strings.Repeat("abc", 100000)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"hash", HashOpen})
+	l.PushString(name)
+	l.SetGlobal("name")
+	if err := DoString(l, `
+		local hash = require("hash")
+		assert(hash.new("sha256"):final() == "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+		assert(hash.new("md5"):update("a"):update("bc"):final() == "900150983cd24fb0d6963f7d28e17f72")
+		assert(#hash.new("sha1"):update("abc"):final(true) == 20)
+		assert(hash.new("crc32"):update("abc"):final() == "352441c2")
+
+		local whole = hash.new("sha512"):update(string.rep("abc", 100000)):final()
+		local f = assert(io.open(name))
+		assert(hash.new("sha512"):update(f):final() == whole)
+		f:seek("set", 3)
+		assert(hash.new("sha512"):update("abc"):update(f):final() == whole)
+		f:close()
+		assert(not pcall(hash.new("md5").update, hash.new("md5"), f))
+		assert(not pcall(hash.new, "crc64"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// A number read from a pipe puts back the byte after it.
+	SetStdin(l, struct{ io.Reader }{strings.NewReader("12xyz")})
+	if err := DoString(l, `
+		local hash = require("hash")
+		assert(io.read("n") == 12)
+		assert(hash.new("md5"):update(io.stdin):final() == hash.new("md5"):update("xyz"):final())
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
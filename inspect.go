@@ -0,0 +1,287 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// An inspector renders Lua values as human-readable strings for debugging.
+// Tables are expanded recursively with their keys sorted, so the output is
+// stable between runs. A table that is already being rendered further up is
+// printed as <cycle>, and tables nested deeper than depth are abbreviated as
+// {...}.
+type inspector struct {
+	b       strings.Builder
+	depth   int
+	indent  string
+	newline string
+	active  map[*table]bool
+}
+
+func newInspector(depth int, indent, newline string) *inspector {
+	return &inspector{depth: depth, indent: indent, newline: newline, active: make(map[*table]bool)}
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || isReserved(s) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && (i == 0 || !isDigit(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func inspectQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < ' ' || c == 127 {
+				fmt.Fprintf(&b, "\\%d", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// keyClass orders keys of different types: numbers first, then strings,
+// booleans and finally everything else.
+func keyClass(k value) int {
+	switch k.(type) {
+	case int64, float64:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	}
+	return 3
+}
+
+func keyLess(a, b value) bool {
+	if ca, cb := keyClass(a), keyClass(b); ca != cb {
+		return ca < cb
+	}
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return a < b
+		}
+		f, _ := toFloat(b)
+		return float64(a) < f
+	case float64:
+		f, _ := toFloat(b)
+		return a < f
+	case string:
+		return a < b.(string)
+	case bool:
+		return !a && b.(bool)
+	}
+	return fmt.Sprintf("%p", a) < fmt.Sprintf("%p", b)
+}
+
+func (in *inspector) scalar(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case int64:
+		return integerToString(v)
+	case float64:
+		if math.IsInf(v, 1) {
+			return "math.huge"
+		} else if math.IsInf(v, -1) {
+			return "-math.huge"
+		}
+		s := numberToString(v)
+		if !strings.ContainsAny(s, ".eEn") { // keep floats recognizable as floats
+			s += ".0"
+		}
+		return s
+	case string:
+		return inspectQuote(v)
+	case *table:
+		return fmt.Sprintf("table: %p", v)
+	case *userData:
+		return fmt.Sprintf("userdata: %p", v)
+	case *State:
+		return fmt.Sprintf("thread: %p", v)
+	case *luaClosure, *goClosure, *goFunction:
+		return fmt.Sprintf("function: %p", v)
+	}
+	return fmt.Sprintf("userdata: %p", v)
+}
+
+func (in *inspector) tabify(level int) {
+	in.b.WriteString(in.newline)
+	in.b.WriteString(strings.Repeat(in.indent, level))
+}
+
+func (in *inspector) key(k value, level int) {
+	if s, ok := k.(string); ok && isIdentifier(s) {
+		in.b.WriteString(s)
+	} else {
+		in.b.WriteByte('[')
+		in.value(k, level)
+		in.b.WriteByte(']')
+	}
+}
+
+func (in *inspector) value(v value, level int) {
+	t, ok := v.(*table)
+	if !ok {
+		in.b.WriteString(in.scalar(v))
+		return
+	}
+	if in.active[t] {
+		in.b.WriteString("<cycle>")
+		return
+	}
+	if level >= in.depth {
+		in.b.WriteString("{...}")
+		return
+	}
+	in.active[t] = true
+	defer delete(in.active, t)
+
+	n := 0 // length of the sequence part, printed without keys
+	for t.atInt(n+1) != nil {
+		n++
+	}
+	var keys []value
+	for i, x := range t.array {
+		if x != nil && i+1 > n {
+			keys = append(keys, int64(i+1))
+		}
+	}
+	t.hash.each(func(k, _ value) {
+		if i := arrayIndex(k); i < 1 || n < i {
+			keys = append(keys, k)
+		}
+	})
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+
+	if n == 0 && len(keys) == 0 && t.metaTable == nil {
+		in.b.WriteString("{}")
+		return
+	}
+	in.b.WriteByte('{')
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			in.b.WriteByte(',')
+		}
+		in.b.WriteByte(' ')
+		in.value(t.atInt(i), level+1)
+	}
+	count := n
+	for _, k := range keys {
+		if count > 0 {
+			in.b.WriteByte(',')
+		}
+		count++
+		in.tabify(level + 1)
+		in.key(k, level+1)
+		in.b.WriteString(" = ")
+		in.value(t.at(k), level+1)
+	}
+	if t.metaTable != nil {
+		if count > 0 {
+			in.b.WriteByte(',')
+		}
+		count++
+		in.tabify(level + 1)
+		in.b.WriteString("<metatable> = ")
+		in.value(t.metaTable, level+1)
+	}
+	if count > n {
+		in.tabify(level)
+	} else {
+		in.b.WriteByte(' ')
+	}
+	in.b.WriteByte('}')
+}
+
+// Inspect returns a human-readable representation of the value at index.
+// Tables are rendered recursively with sorted keys, without invoking any
+// metamethods. Tables nested more than depth levels deep are shown as {...}
+// and tables that contain themselves are marked with <cycle>. A negative
+// depth means the limit set with SetTableDepthLimit, which also caps larger
+// depths.
+func Inspect(l *State, index, depth int) string {
+	in := newInspector(inspectDepth(l, depth), "  ", "\n")
+	in.value(l.indexToValue(index), 0)
+	return in.b.String()
+}
+
+// inspectDepth returns the nesting level at which Inspect and inspect stop.
+func inspectDepth(l *State, depth int) int {
+	if depth < 0 || depth > l.tableDepthLimit() {
+		return l.tableDepthLimit()
+	}
+	return depth
+}
+
+func inspect(l *State) int {
+	CheckAny(l, 1)
+	depth, indent, newline := l.tableDepthLimit(), "  ", "\n"
+	if !l.IsNoneOrNil(2) {
+		CheckType(l, 2, TypeTable)
+		l.Field(2, "depth")
+		if !l.IsNil(-1) {
+			depth = CheckInteger(l, -1)
+		}
+		l.Field(2, "indent")
+		indent = OptString(l, -1, indent)
+		l.Field(2, "newline")
+		newline = OptString(l, -1, newline)
+		l.Pop(3)
+	}
+	in := newInspector(inspectDepth(l, depth), indent, newline)
+	in.value(l.indexToValue(1), 0)
+	l.PushString(in.b.String())
+	return 1
+}
+
+// InspectOpen opens the inspect library. It is not opened by OpenLibraries;
+// pass it as a preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "inspect", Function: lua.InspectOpen})
+//
+// The module is callable, so inspect(v) and inspect.inspect(v) are
+// equivalent. The optional second argument is a table with the fields depth
+// (maximum nesting level; negative means the limit, as for Inspect), indent
+// (string used for each level) and newline.
+func InspectOpen(l *State) int {
+	NewLibrary(l, []RegistryFunction{{"inspect", inspect}})
+	l.CreateTable(0, 1)
+	l.PushGoFunction(func(l *State) int {
+		l.Remove(1) // drop the module table
+		return inspect(l)
+	})
+	l.SetField(-2, "__call")
+	l.SetMetaTable(-2)
+	return 1
+}
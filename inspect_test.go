@@ -0,0 +1,69 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"inspect", InspectOpen})
+	if err := DoString(l, `
+		local inspect = require("inspect")
+		assert(inspect(1) == "1")
+		assert(inspect(1.5) == "1.5")
+		assert(inspect(2.0) == "2.0")
+		assert(inspect("a\nb") == '"a\\nb"')
+		assert(inspect({}) == "{}")
+		assert(inspect({1, 2, 3}) == "{ 1, 2, 3 }")
+		assert(inspect({b = 1, a = 2, [10] = 3, ["not id"] = 4}) ==
+			'{\n  [10] = 3,\n  a = 2,\n  b = 1,\n  ["not id"] = 4\n}')
+		assert(inspect({1, x = {y = 2}}) == "{ 1,\n  x = {\n    y = 2\n  }\n}")
+		assert(inspect({1, {2, {3}}}, {depth = 2}) == "{ 1, { 2, {...} } }")
+		assert(inspect({x = {1}}, {newline = "", indent = ""}) == "{x = { 1 }}")
+		local t = {}
+		t.self = t
+		assert(inspect(t) == "{\n  self = <cycle>\n}")
+		local shared = {1}
+		assert(inspect({shared, shared}) == "{ { 1 }, { 1 } }")
+		assert(inspect(setmetatable({}, {__index = {}})) ==
+			"{\n  <metatable> = {\n    __index = {}\n  }\n}")
+		assert(inspect.inspect({true}) == "{ true }")
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	l.NewTable()
+	l.PushInteger(7)
+	l.RawSetInt(-2, 1)
+	if got := Inspect(l, -1, -1); got != "{ 7 }" {
+		t.Errorf("Inspect = %q, want %q", got, "{ 7 }")
+	}
+	if got := Inspect(l, -1, 0); got != "{...}" {
+		t.Errorf("Inspect with depth 0 = %q, want %q", got, "{...}")
+	}
+}
+
+func TestInspectDeepTable(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"inspect", InspectOpen})
+	if prev := SetTableDepthLimit(l, 3); prev != 1000 {
+		t.Fatalf("default limit is %d, want 1000", prev)
+	}
+	if err := DoString(l, `
+		local inspect = require("inspect")
+		assert(inspect({{{{}}}}) == "{ { { {...} } } }")
+		assert(inspect({{{{}}}}, {depth = 100}) == "{ { { {...} } } }")
+		assert(inspect({{{{}}}}, {depth = -1}) == "{ { { {...} } } }")
+		local t = {}
+		for i = 1, 1000000 do t = {t} end
+		deep = t
+	`); err != nil {
+		t.Fatal(err)
+	}
+	SetTableDepthLimit(l, 0)
+	l.Global("deep")
+	if got := Inspect(l, -1, -1); strings.Count(got, "{") != 1001 || !strings.Contains(got, "{...}") {
+		t.Errorf("unexpected rendering of a deep table: %.50q", got)
+	}
+}
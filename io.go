@@ -1,28 +1,108 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
 package lua
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const (
-	fileHandle = "FILE*"
-	input      = "_IO_input"
-	output     = "_IO_output"
+	input  = "_IO_input"
+	output = "_IO_output"
 )
 
+func seekFile(f File, offset int64, whence int) (int64, error) {
+	if s, ok := f.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, errNotSeekable
+}
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+func defaultFileOpener(name string, flag int) (File, error) {
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readOnly is the flag for opening a file to read it.
+const readOnly = os.O_RDONLY
+
+// The standard streams, when the host sets none.
+func defaultStdin() io.Reader  { return os.Stdin }
+func defaultStdout() io.Writer { return os.Stdout }
+func defaultStderr() io.Writer { return os.Stderr }
+
+// isTimeout reports whether err is the error of an expired deadline.
+func isTimeout(err error) bool { return errors.Is(err, os.ErrDeadlineExceeded) }
+
+// hashData adds the data at index to h for digest:update: the rest of an
+// open file, a mapping or a string.
+func hashData(l *State, h io.Writer, index int) error {
+	switch v := l.ToUserData(index).(type) {
+	case *stream:
+		if v.close == nil {
+			Errorf(l, "attempt to use a closed file")
+		}
+		_, err := io.Copy(h, v) // v returns the bytes that read put back first
+		return err
+	case *mapping:
+		if v.closed {
+			Errorf(l, "attempt to use a closed mapping")
+		}
+		_, err := h.Write(v.data)
+		return err
+	}
+	_, err := io.WriteString(h, CheckString(l, index))
+	return err
+}
+
 type stream struct {
-	f     *os.File
-	close Function
+	f            File
+	close        Function
+	numberFormat *NumberFormat // nil means the format set with SetNumberFormat
+	pending      []byte        // bytes put back by read that f cannot seek back over
+}
+
+// Read reads from the file, after the bytes put back with unread.
+func (s *stream) Read(p []byte) (int, error) {
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	return s.f.Read(p)
+}
+
+// unread puts back the byte b that was just read, by seeking back over it
+// or, for files that cannot seek such as pipes, by keeping it for the next
+// read.
+func (s *stream) unread(b byte) {
+	if len(s.pending) == 0 {
+		if _, err := seekFile(s.f, -1, io.SeekCurrent); err == nil {
+			return
+		}
+	}
+	s.pending = append([]byte{b}, s.pending...)
 }
 
 func toStream(l *State) *stream { return CheckUserData(l, 1, fileHandle).(*stream) }
 
-func toFile(l *State) *os.File {
+func toFile(l *State) File {
 	s := toStream(l)
 	if s.close == nil {
 		Errorf(l, "attempt to use a closed file")
@@ -31,7 +111,7 @@ func toFile(l *State) *os.File {
 	return s.f
 }
 
-func newStream(l *State, f *os.File, close Function) *stream {
+func newStream(l *State, f File, close Function) *stream {
 	s := &stream{f: f, close: close}
 	l.PushUserData(s)
 	SetMetaTableNamed(l, fileHandle)
@@ -42,20 +122,28 @@ func newFile(l *State) *stream {
 	return newStream(l, nil, func(l *State) int { return FileResult(l, toStream(l).f.Close(), "") })
 }
 
-func ioFile(l *State, name string) *os.File {
+// PushFile pushes a new io library file handle for f onto the stack. Closing
+// the handle closes f. The io library must have been opened in l.
+func PushFile(l *State, f File) {
+	newFile(l).f = f
+}
+
+func ioFile(l *State, name string) File { return ioStream(l, name).f }
+
+func ioStream(l *State, name string) *stream {
 	l.Field(RegistryIndex, name)
 	s := l.ToUserData(-1).(*stream)
 	if s.close == nil {
 		Errorf(l, fmt.Sprintf("standard %s file is closed", name[len("_IO_"):]))
 	}
-	return s.f
+	return s
 }
 
 func forceOpen(l *State, name, mode string) {
 	s := newFile(l)
 	flags, err := flags(mode)
 	if err == nil {
-		s.f, err = os.OpenFile(name, flags, 0666)
+		s.f, err = openFile(l, name, flags)
 	}
 	if err != nil {
 		Errorf(l, fmt.Sprintf("cannot open file '%s' (%s)", name, err.Error()))
@@ -93,17 +181,135 @@ func close(l *State) int {
 	return closeHelper(l)
 }
 
-func write(l *State, f *os.File, argIndex, argCount int) int {
+// checkNumberFormat returns an error if format is not a format for one
+// number with one of the conversions.
+func checkNumberFormat(format, conversions string) error {
+	count := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		} else if i+1 < len(format) && format[i+1] == '%' {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ #0123456789.", format[j]) >= 0 {
+			j++
+		}
+		if j == len(format) || strings.IndexByte(conversions, format[j]) < 0 {
+			return fmt.Errorf("invalid number format '%s'", format)
+		}
+		count, i = count+1, j
+	}
+	if count != 1 {
+		return fmt.Errorf("invalid number format '%s' (one conversion expected)", format)
+	}
+	return nil
+}
+
+const (
+	floatConversions   = "eEfgGaA"
+	integerConversions = "eEfgGaAdiuoxX"
+)
+
+// SetNumberFormat sets the formats of the numbers that io.write and
+// file:write write in all threads of l, for the files that have no format of
+// their own set with file:numberformat, and returns the previous formats.
+// Scripts can set them with io.numberformat([float [, integer]]). It panics
+// if a format is not valid.
+func SetNumberFormat(l *State, f NumberFormat) NumberFormat {
+	if err := validNumberFormat(f); err != nil {
+		panic("lua: " + err.Error())
+	}
+	old := l.global.numberFormat
+	l.global.numberFormat = f
+	return old
+}
+
+func validNumberFormat(f NumberFormat) error {
+	if f.Float != "" {
+		if err := checkNumberFormat(f.Float, floatConversions); err != nil {
+			return err
+		}
+	}
+	if f.Integer != "" {
+		return checkNumberFormat(f.Integer, integerConversions)
+	}
+	return nil
+}
+
+// checkNumberFormatArgs returns the formats given as the arguments at index
+// and index+1, nil or strings.
+func checkNumberFormatArgs(l *State, index int) NumberFormat {
+	f := NumberFormat{Float: OptString(l, index, ""), Integer: OptString(l, index+1, "")}
+	if f.Float != "" {
+		if err := checkNumberFormat(f.Float, floatConversions); err != nil {
+			ArgumentError(l, index, err.Error())
+		}
+	}
+	if f.Integer != "" {
+		if err := checkNumberFormat(f.Integer, integerConversions); err != nil {
+			ArgumentError(l, index+1, err.Error())
+		}
+	}
+	return f
+}
+
+// pushNumberFormat pushes the formats of f, nil for the defaults.
+func pushNumberFormat(l *State, f NumberFormat) int {
+	for _, s := range []string{f.Float, f.Integer} {
+		if s == "" {
+			l.PushNil()
+		} else {
+			l.PushString(s)
+		}
+	}
+	return 2
+}
+
+// formatNumberFunction is string.format for one argument. formatNumber
+// pushes this single value, so io.write does not allocate a function for
+// every number it formats.
+var formatNumberFunction = &goFunction{func(l *State) int {
+	l.PushString(formatHelper(l, CheckString(l, 1), 2))
+	return 1
+}}
+
+// formatNumber formats the number at index with format like string.format.
+func formatNumber(l *State, format string, index int) string {
+	l.apiPush(formatNumberFunction)
+	l.PushString(format)
+	l.PushValue(index)
+	l.Call(2, 1)
+	s, _ := l.ToString(-1)
+	l.Pop(1)
+	return s
+}
+
+func write(l *State, s *stream, argIndex, argCount int) int {
 	var err error
+	nf := l.global.numberFormat
+	if s.numberFormat != nil {
+		nf = *s.numberFormat
+	}
+	f := s.f
 	for ; argIndex <= argCount && err == nil; argIndex++ {
 		if l.IsInteger(argIndex) {
+			if nf.Integer != "" {
+				_, err = io.WriteString(f, formatNumber(l, nf.Integer, argIndex))
+				continue
+			}
 			i, _ := l.ToInteger(argIndex)
-			_, err = f.WriteString(integerToString(int64(i)))
+			_, err = io.WriteString(f, integerToString(int64(i)))
 		} else if l.TypeOf(argIndex) == TypeNumber {
+			if nf.Float != "" {
+				_, err = io.WriteString(f, formatNumber(l, nf.Float, argIndex))
+				continue
+			}
 			n, _ := l.ToNumber(argIndex)
-			_, err = f.WriteString(numberToString(n))
+			_, err = io.WriteString(f, numberToString(n))
 		} else {
-			_, err = f.WriteString(CheckString(l, argIndex))
+			_, err = io.WriteString(f, CheckString(l, argIndex))
 		}
 	}
 	if err == nil {
@@ -113,7 +319,7 @@ func write(l *State, f *os.File, argIndex, argCount int) int {
 }
 
 // readNumber reads a number from file, supporting integers, floats, and hex formats.
-func readNumber(l *State, f *os.File) bool {
+func readNumber(l *State, f *stream) bool {
 	// Skip whitespace
 	buf := make([]byte, 1)
 	for {
@@ -124,7 +330,7 @@ func readNumber(l *State, f *os.File) bool {
 		}
 		b := buf[0]
 		if b != ' ' && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\v' {
-			f.Seek(-1, io.SeekCurrent)
+			f.unread(b)
 			break
 		}
 	}
@@ -184,7 +390,7 @@ func readNumber(l *State, f *os.File) bool {
 			}
 		} else {
 			// Put the character back and stop
-			f.Seek(-1, io.SeekCurrent)
+			f.unread(b)
 			break
 		}
 	}
@@ -212,7 +418,7 @@ func readNumber(l *State, f *os.File) bool {
 }
 
 // readLineFromFile reads a line from file. If keepEOL is true, keeps the end-of-line character.
-func readLineFromFile(l *State, f *os.File, keepEOL bool) (bool, error) {
+func readLineFromFile(l *State, f *stream, keepEOL bool) (bool, error) {
 	var sb strings.Builder
 	buf := make([]byte, 1)
 	hasContent := false
@@ -246,54 +452,54 @@ func readLineFromFile(l *State, f *os.File, keepEOL bool) (bool, error) {
 }
 
 // readAll reads the entire file from current position.
-func readAll(l *State, f *os.File) bool {
+func readAll(l *State, f *stream) (bool, error) {
 	data, err := io.ReadAll(f)
-	if err != nil && err != io.EOF {
-		l.PushNil()
-		return false
+	if err != nil && len(data) == 0 {
+		return false, err
 	}
 	l.PushString(string(data))
-	return true
+	return true, nil
 }
 
 // readBytes reads up to n bytes from file.
-func readBytes(l *State, f *os.File, n int) bool {
+func readBytes(l *State, f *stream, n int) (bool, error) {
 	if n == 0 {
 		// Special case: read(0) tests for EOF
 		buf := make([]byte, 1)
 		count, err := f.Read(buf)
 		if count > 0 {
-			f.Seek(-1, io.SeekCurrent) // Put the byte back
+			f.unread(buf[0])
 			l.PushString("")
-			return true
+			return true, nil
 		}
 		if err == io.EOF {
 			l.PushNil()
-			return false
+			return false, nil
+		} else if err != nil {
+			return false, err
 		}
 		l.PushString("")
-		return true
+		return true, nil
 	}
 
 	buf := make([]byte, n)
 	count, err := f.Read(buf)
 	if count > 0 {
 		l.PushString(string(buf[:count]))
-		return true
+		return true, nil
 	}
-	if err == io.EOF {
-		l.PushNil()
-		return false
+	if err != nil && err != io.EOF {
+		return false, err
 	}
 	l.PushNil()
-	return false
+	return false, nil
 }
 
 // readOne reads one item based on the format specifier.
 // Returns (true, nil) if successful, (false, nil) on EOF, (false, err) on OS error.
-func readOne(l *State, f *os.File, argIndex int) (bool, error) {
+func readOne(l *State, f *stream, argIndex int) (bool, error) {
 	if n, ok := l.ToInteger(argIndex); ok {
-		return readBytes(l, f, int(n)), nil
+		return readBytes(l, f, int(n))
 	}
 
 	format := OptString(l, argIndex, "l")
@@ -310,14 +516,14 @@ func readOne(l *State, f *os.File, argIndex int) (bool, error) {
 	case "L":
 		return readLineFromFile(l, f, true)
 	case "a":
-		return readAll(l, f), nil
+		return readAll(l, f)
 	default:
 		Errorf(l, "invalid format")
 		return false, nil
 	}
 }
 
-func read(l *State, f *os.File, argIndex int) int {
+func read(l *State, f *stream, argIndex int) int {
 	argCount := l.Top()
 	if argCount < argIndex {
 		// No arguments: default is "l" (read line)
@@ -352,7 +558,7 @@ func readLine(l *State) int {
 	for i := 1; i <= argCount; i++ {
 		l.PushValue(UpValueIndex(3 + i))
 	}
-	resultCount := read(l, s.f, 2)
+	resultCount := read(l, s, 2)
 	l.assert(resultCount > 0)
 	if !l.IsNil(-resultCount) {
 		return resultCount
@@ -369,7 +575,13 @@ func readLine(l *State) int {
 	return 0
 }
 
-func lines(l *State, shouldClose bool) {
+// The line iterators are recorded like io.read and file:read, see Record.
+var (
+	ioLinesIterator   = Recorded("io.lines", readLine)
+	fileLinesIterator = Recorded("file:lines", readLine)
+)
+
+func lines(l *State, shouldClose bool, iterator Function) {
 	argCount := l.Top() - 1
 	const maxArgLine = 250
 	ArgumentCheck(l, argCount <= maxArgLine, maxArgLine, "too many arguments")
@@ -379,7 +591,7 @@ func lines(l *State, shouldClose bool) {
 	for i := 1; i <= argCount; i++ {
 		l.PushValue(i + 1)
 	}
-	l.PushGoClosure(readLine, uint8(3+argCount))
+	l.PushGoClosure(iterator, uint8(3+argCount))
 }
 
 func flags(m string) (f int, err error) {
@@ -407,7 +619,7 @@ func flags(m string) (f int, err error) {
 
 var ioLibrary = []RegistryFunction{
 	{"close", close},
-	{"flush", func(l *State) int { return FileResult(l, ioFile(l, output).Sync(), "") }},
+	{"flush", func(l *State) int { return FileResult(l, flushFile(ioFile(l, output)), "") }},
 	{"input", ioFileHelper(input, "r")},
 	{"lines", func(l *State) int {
 		if l.IsNone(1) {
@@ -417,14 +629,15 @@ var ioLibrary = []RegistryFunction{
 			l.Field(RegistryIndex, input)
 			l.Replace(1)
 			toFile(l)
-			lines(l, false)
+			lines(l, false, ioLinesIterator)
 			return 1
 		}
 		// Lua 5.4: io.lines(filename) returns 4 values for generic for-in:
 		// iterator, file_stream, nil, file_stream (TBC)
 		forceOpen(l, CheckString(l, 1), "r")
 		l.Replace(1)
-		lines(l, true) // pushes iterator closure
+		// Push the iterator closure.
+		lines(l, true, ioLinesIterator)
 		l.PushValue(1) // push file stream as 2nd result
 		l.PushNil()    // push nil as 3rd result
 		l.PushValue(1) // push file stream as 4th result (to-be-closed)
@@ -432,10 +645,11 @@ var ioLibrary = []RegistryFunction{
 	}},
 	{"open", func(l *State) int {
 		name := CheckString(l, 1)
+		checkTags(l, "io.open", name)
 		flags, err := flags(OptString(l, 2, "r"))
 		s := newFile(l)
 		ArgumentCheck(l, err == nil, 2, "invalid mode")
-		s.f, err = os.OpenFile(name, flags, 0666)
+		s.f, err = openFile(l, name, flags)
 		if err == nil {
 			return 1
 		}
@@ -444,6 +658,7 @@ var ioLibrary = []RegistryFunction{
 	{"output", ioFileHelper(output, "w")},
 	{"popen", func(l *State) int {
 		command := CheckString(l, 1)
+		checkTags(l, "io.popen", command)
 		mode := OptString(l, 2, "r")
 
 		// Validate mode
@@ -467,7 +682,7 @@ var ioLibrary = []RegistryFunction{
 			cmd.Env = env
 		}
 
-		var f *os.File
+		var f File
 		var err error
 
 		if mode == "r" {
@@ -477,7 +692,7 @@ var ioLibrary = []RegistryFunction{
 				return FileResult(l, pipeErr, command)
 			}
 			cmd.Stdout = pw
-			cmd.Stderr = os.Stderr
+			cmd.Stderr = l.global.stderrWriter()
 			err = cmd.Start()
 			pw.Close() // Close write end in parent
 			if err != nil {
@@ -492,8 +707,8 @@ var ioLibrary = []RegistryFunction{
 				return FileResult(l, pipeErr, command)
 			}
 			cmd.Stdin = pr
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
+			cmd.Stdout = l.global.stdoutWriter()
+			cmd.Stderr = l.global.stderrWriter()
 			err = cmd.Start()
 			pr.Close() // Close read end in parent
 			if err != nil {
@@ -530,9 +745,9 @@ var ioLibrary = []RegistryFunction{
 		return 1
 	}},
 	{"read", func(l *State) int {
-		f := ioFile(l, input)
-		l.Remove(-1) // remove stream userdata pushed by ioFile
-		return read(l, f, 1)
+		s := ioStream(l, input)
+		l.Remove(-1) // remove stream userdata pushed by ioStream
+		return read(l, s, 1)
 	}},
 	{"tmpfile", func(l *State) int {
 		s := newFile(l)
@@ -556,8 +771,16 @@ var ioLibrary = []RegistryFunction{
 	}},
 	{"write", func(l *State) int {
 		top := l.Top()
-		f := ioFile(l, output)
-		return write(l, f, 1, top)
+		return write(l, ioStream(l, output), 1, top)
+	}},
+	{"numberformat", func(l *State) int {
+		// io.numberformat([float [, integer]]) sets the number formats of
+		// io.write and file:write, see SetNumberFormat, and returns the
+		// previous ones. nil restores a default.
+		f := checkNumberFormatArgs(l, 1)
+		old := l.global.numberFormat
+		l.global.numberFormat = f
+		return pushNumberFormat(l, old)
 	}},
 }
 
@@ -567,23 +790,48 @@ var fileHandleMethods = []RegistryFunction{
 		toFile(l)
 		return closeHelper(l)
 	}},
-	{"flush", func(l *State) int { return FileResult(l, toFile(l).Sync(), "") }},
-	{"lines", func(l *State) int { toFile(l); lines(l, false); return 1 }},
-	{"read", func(l *State) int { return read(l, toFile(l), 2) }},
+	{"flush", func(l *State) int { return FileResult(l, flushFile(toFile(l)), "") }},
+	{"lines", func(l *State) int { toFile(l); lines(l, false, fileLinesIterator); return 1 }},
+	{"read", func(l *State) int {
+		toFile(l)
+		return read(l, toStream(l), 2)
+	}},
 	{"seek", func(l *State) int {
-		whence := []int{os.SEEK_SET, os.SEEK_CUR, os.SEEK_END}
+		whence := []int{io.SeekStart, io.SeekCurrent, io.SeekEnd}
 		f := toFile(l)
 		op := CheckOption(l, 2, "cur", []string{"set", "cur", "end"})
-		p3 := OptNumber(l, 3, 0)
-		offset := int64(p3)
-		ArgumentCheck(l, float64(offset) == p3, 3, "not an integer in proper range")
-		ret, err := f.Seek(offset, whence[op])
+		offset := OptInteger64(l, 3, 0)
+		ret, err := seekFile(f, offset, whence[op])
 		if err != nil {
 			return FileResult(l, err, "")
 		}
-		l.PushNumber(float64(ret))
+		toStream(l).pending = nil
+		l.PushInteger64(ret)
 		return 1
 	}},
+	{"setdeadline", func(l *State) int {
+		// file:setdeadline(seconds [, mode]) makes reads ("r"), writes ("w")
+		// or both ("rw", the default) fail with "timeout" once the given
+		// number of seconds has passed. A nil timeout removes the deadline.
+		f := toFile(l)
+		var deadline time.Time
+		if !l.IsNoneOrNil(2) {
+			deadline = time.Now().Add(time.Duration(CheckNumber(l, 2) * float64(time.Second)))
+		}
+		op := CheckOption(l, 3, "rw", []string{"r", "w", "rw"})
+		d, ok := f.(deadliner)
+		if !ok {
+			return FileResult(l, errors.New("deadlines not supported"), "")
+		}
+		var err error
+		if op != 1 {
+			err = d.SetReadDeadline(deadline)
+		}
+		if op != 0 && err == nil {
+			err = d.SetWriteDeadline(deadline)
+		}
+		return FileResult(l, err, "")
+	}},
 	{"setvbuf", func(l *State) int { // Files are unbuffered in Go. Fake support for now.
 		//		f := toFile(l)
 		//		op := CheckOption(l, 2, "", []string{"no", "full", "line"})
@@ -592,17 +840,34 @@ var fileHandleMethods = []RegistryFunction{
 		return FileResult(l, nil, "")
 	}},
 	{"write", func(l *State) int {
-		f := toFile(l)
+		toFile(l)
 		n := l.Top()
 		l.PushValue(1)
-		return write(l, f, 2, n)
+		return write(l, toStream(l), 2, n)
+	}},
+	{"numberformat", func(l *State) int {
+		// file:numberformat([float [, integer]]) sets the number formats of
+		// the writes to this file like io.numberformat and returns the
+		// previous ones; without arguments, the file uses those of io again.
+		s := toStream(l)
+		var old NumberFormat
+		if s.numberFormat != nil {
+			old = *s.numberFormat
+		}
+		if l.IsNone(2) {
+			s.numberFormat = nil
+		} else {
+			f := checkNumberFormatArgs(l, 2)
+			s.numberFormat = &f
+		}
+		return pushNumberFormat(l, old)
 	}},
 	//	{"__gc", },
 	{"__tostring", func(l *State) int {
 		if s := toStream(l); s.close == nil {
 			l.PushString("file (closed)")
 		} else {
-			l.PushString(fmt.Sprintf("file (%p)", s.f))
+			l.PushString(fmt.Sprintf("file (%p)", s))
 		}
 		return 1
 	}},
@@ -615,7 +880,7 @@ func dontClose(l *State) int {
 	return 2
 }
 
-func registerStdFile(l *State, f *os.File, reg, name string) {
+func registerStdFile(l *State, f File, reg, name string) {
 	newStream(l, f, dontClose)
 	if reg != "" {
 		l.PushValue(-1)
@@ -644,9 +909,9 @@ func IOOpen(l *State) int {
 	l.SetField(-2, "__close")
 	l.Pop(1)
 
-	registerStdFile(l, os.Stdin, input, "stdin")
-	registerStdFile(l, os.Stdout, output, "stdout")
-	registerStdFile(l, os.Stderr, "", "stderr")
+	registerStdFile(l, standardFile{l.global, 0}, input, "stdin")
+	registerStdFile(l, standardFile{l.global, 1}, output, "stdout")
+	registerStdFile(l, standardFile{l.global, 2}, "", "stderr")
 
 	return 1
 }
@@ -0,0 +1,43 @@
+//go:build !lua_noos
+// +build !lua_noos
+
+package lua
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFileDeadline(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer w.Close()
+	l := NewState()
+	OpenLibraries(l)
+	PushFile(l, r)
+	l.SetGlobal("pipe")
+	if _, err := w.WriteString("ready\n12xyz\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(l, `
+		assert(pipe:setdeadline(0.05, "r"))
+		assert(pipe:read("l") == "ready")
+		local n, empty, rest = pipe:read("n", 0, "l") -- pipes cannot seek back
+		assert(n == 12 and empty == "" and rest == "xyz")
+		local v, msg = pipe:read("l") -- nothing more was written
+		assert(v == nil and msg == "timeout", tostring(msg))
+		v, msg = pipe:read(10)
+		assert(v == nil and msg == "timeout", tostring(msg))
+		assert(pipe:setdeadline(nil))
+		assert(io.type(pipe) == "file")
+		assert(pipe:close())
+
+		local f = io.tmpfile()
+		assert(f:setdeadline(1) == nil) -- regular files have no deadlines
+		f:close()
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
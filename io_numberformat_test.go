@@ -0,0 +1,69 @@
+//go:build !lua_noos
+// +build !lua_noos
+
+package lua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNumberFormat(t *testing.T) {
+	var stdout bytes.Buffer
+	l := NewState()
+	OpenLibraries(l)
+	SetStdout(l, &stdout)
+	if old := SetNumberFormat(l, NumberFormat{Float: "%.3f"}); old != (NumberFormat{}) {
+		t.Errorf("SetNumberFormat returned %+v, want the defaults", old)
+	}
+	if err := DoString(l, `
+		io.write(1/3, " ", 2, " ", 1e3, "\n")
+		local f, i = io.numberformat("%.2e", "%05d")
+		assert(f == "%.3f" and i == nil)
+		io.write(1234.5, " ", 42, " ", -7, "\n")
+		io.stdout:numberformat(nil, "[%x]")
+		io.stdout:write(255, " ", 0.5, "\n")
+		f, i = io.stdout:numberformat()
+		assert(f == nil and i == "[%x]")
+		io.write(255, "\n")
+		io.numberformat()
+		io.write(0.1, " ", 3, " ", 2^63, "\n")
+
+		local tmp = os.tmpname()
+		local h = io.open(tmp, "w")
+		h:numberformat("%g", "%.1f")
+		h:write(1, " ", 1e-5)
+		h:close()
+		h = io.open(tmp)
+		assert(h:read("a") == "1.0 1e-05")
+		h:close()
+		os.remove(tmp)
+
+		for _, bad in ipairs{"%d", "%s", "%q", "x", "%f %f", "%5.2z"} do
+			assert(not pcall(io.numberformat, bad))
+		end
+		assert(not pcall(io.numberformat, nil, "%c"))
+		assert(pcall(io.numberformat, "%%%.1f%%", "%+i"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	want := "0.333 2 1000.000\n" +
+		"1.23e+03 00042 -0007\n" +
+		"[ff] 0.5\n" +
+		"00255\n" +
+		"0.1 3 9.2233720368548e+18\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	if old := SetNumberFormat(l, NumberFormat{}); old != (NumberFormat{Float: "%%%.1f%%", Integer: "%+i"}) {
+		t.Errorf("SetNumberFormat returned %+v", old)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("SetNumberFormat accepted an invalid format")
+			}
+		}()
+		SetNumberFormat(l, NumberFormat{Integer: "%s"})
+	}()
+}
@@ -0,0 +1,71 @@
+package lua
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+type memFile struct{ *strings.Reader }
+
+func (memFile) Write([]byte) (int, error) { return 0, os.ErrPermission }
+func (memFile) Close() error              { return nil }
+
+// pipeFile hides the Seek method of a File, like a pipe.
+type pipeFile struct{ File }
+
+func TestSetFileOpener(t *testing.T) {
+	skipWithoutOS(t)
+	files := map[string]string{
+		"data.txt":   "first\nsecond\n",
+		"chunk.lua":  "return 1 + 2",
+		"./mod.lua":  "return {name = 'mod'}",
+		"number.txt": "42",
+		"pipe.txt":   "12xyz",
+	}
+	l := NewState()
+	OpenLibraries(l)
+	SetFileOpener(l, func(name string, flag int) (File, error) {
+		if flag != os.O_RDONLY {
+			return nil, os.ErrPermission
+		}
+		s, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		if name == "pipe.txt" {
+			return pipeFile{memFile{strings.NewReader(s)}}, nil
+		}
+		return memFile{strings.NewReader(s)}, nil
+	})
+	if err := DoString(l, `
+		package.path = "./?.lua"
+		local f = assert(io.open("data.txt"))
+		assert(f:read("l") == "first")
+		assert(f:read("a") == "second\n")
+		f:close()
+		local t = {}
+		for line in io.lines("data.txt") do t[#t + 1] = line end
+		assert(#t == 2 and t[2] == "second")
+		assert(io.open("number.txt"):read("n") == 42)
+		f = assert(io.open("pipe.txt"))
+		local n, empty, rest = f:read("n", 0, "a")
+		assert(n == 12 and empty == "" and rest == "xyz")
+		assert(f:seek() == nil)
+		assert(loadfile("chunk.lua")() == 3)
+		assert(dofile("chunk.lua") == 3)
+		assert(require("mod").name == "mod")
+		assert(io.open("missing.txt") == nil)
+		local ok, msg = io.open("data.txt", "w")
+		assert(ok == nil and msg:find("data.txt"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if old := SetFileOpener(l, nil); old == nil {
+		t.Error("SetFileOpener returned nil for the installed opener")
+	}
+	if err := DoString(l, `assert(io.open("data.txt") == nil)`); err != nil {
+		t.Error(err)
+	}
+}
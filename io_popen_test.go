@@ -3,6 +3,7 @@ package lua
 import "testing"
 
 func TestPopen(t *testing.T) {
+	skipWithoutCommands(t)
 	testString(t, `
 		-- Test popen read mode
 		local f = io.popen("echo hello")
@@ -3,6 +3,7 @@ package lua
 import "testing"
 
 func TestIORead(t *testing.T) {
+	skipWithoutOS(t)
 	testString(t, `
 		-- Test file read functionality
 		local tmp = os.tmpname()
@@ -0,0 +1,22 @@
+package lua
+
+import "testing"
+
+func TestIOSeekInteger(t *testing.T) {
+	skipWithoutOS(t)
+	testString(t, `
+		local tmp = os.tmpname()
+		local f = assert(io.open(tmp, "w+"))
+		f:write("0123456789")
+		local pos = f:seek("cur")
+		assert(pos == 10 and math.type(pos) == "integer")
+		pos = f:seek("set", 3)
+		assert(pos == 3 and math.type(pos) == "integer")
+		assert(f:read(2) == "34")
+		assert(f:seek("end", -1) == 9)
+		assert(f:seek("set", 2.0) == 2) -- floats with an integer value are accepted
+		assert(not pcall(f.seek, f, "set", 1.5))
+		f:close()
+		os.remove(tmp)
+	`)
+}
@@ -0,0 +1,40 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedirectStandardStreams(t *testing.T) {
+	skipWithoutOS(t)
+	var stdout, stderr bytes.Buffer
+	l := NewState()
+	OpenLibraries(l) // the io library picks up streams set later
+	SetStdout(l, &stdout)
+	SetStderr(l, &stderr)
+	SetStdin(l, strings.NewReader("line one\n42\n"))
+	if err := DoString(l, `
+		print("hello", 1, nil)
+		io.write("a", 2, "\n")
+		io.stdout:write("b\n")
+		io.stderr:write("oops\n")
+		warn("@on")
+		warn("careful")
+		assert(io.read("l") == "line one")
+		assert(io.stdin:read("n") == 42)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello\t1\tnil\na2\nb\n"; stdout.String() != want {
+		t.Errorf("stdout = %q, want %q", stdout.String(), want)
+	}
+	if want := "oops\nLua warning: careful\n"; stderr.String() != want {
+		t.Errorf("stderr = %q, want %q", stderr.String(), want)
+	}
+
+	SetStdin(l, strings.NewReader("return 'from stdin'"))
+	if err := DoString(l, `assert(loadfile()() == "from stdin")`); err != nil {
+		t.Error(err)
+	}
+}
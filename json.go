@@ -0,0 +1,657 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// nullSentinel is the value of json.null and msgpack.null, which stand for
+// null in the data they decode and encode.
+var nullSentinel = &struct{ name string }{"null"}
+
+// A jsonConfig holds the settings of an instance of the json library.
+type jsonConfig struct {
+	sparseConvert      bool
+	sparseRatio        int
+	sparseSafe         int
+	encodeMaxDepth     int
+	decodeMaxDepth     int
+	precision          int
+	encodeInvalid      int // 0 raises an error, 1 writes nan and inf, -1 writes null
+	decodeInvalid      bool
+	emptyTableAsObject bool
+	keepBuffer         bool
+}
+
+func newJSONConfig() *jsonConfig {
+	return &jsonConfig{
+		sparseRatio: 2, sparseSafe: 10,
+		encodeMaxDepth: 1000, decodeMaxDepth: 1000,
+		precision: 14, decodeInvalid: true, emptyTableAsObject: true, keepBuffer: true,
+	}
+}
+
+func toJSONConfig(l *State) *jsonConfig { return l.ToUserData(UpValueIndex(1)).(*jsonConfig) }
+
+// jsonEncoder writes a value as JSON, like lua-cjson.
+type jsonEncoder struct {
+	l      *State
+	config *jsonConfig
+	b      strings.Builder
+}
+
+func (e *jsonEncoder) value(v value, depth int) {
+	switch v := v.(type) {
+	case nil:
+		e.b.WriteString("null")
+	case bool:
+		e.b.WriteString(strconv.FormatBool(v))
+	case int64:
+		e.b.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		e.number(v)
+	case string:
+		e.string(v)
+	case *table:
+		e.table(v, depth+1)
+	default:
+		if v == nullSentinel {
+			e.b.WriteString("null")
+			return
+		}
+		Errorf(e.l, "Cannot serialise %s: type not supported", e.l.valueToType(v).String())
+	}
+}
+
+func (e *jsonEncoder) number(f float64) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		switch e.config.encodeInvalid {
+		case 0:
+			Errorf(e.l, "Cannot serialise number: must not be NaN or Infinity")
+		case -1:
+			e.b.WriteString("null")
+			return
+		}
+		switch {
+		case math.IsNaN(f):
+			e.b.WriteString("nan")
+		case f > 0:
+			e.b.WriteString("inf")
+		default:
+			e.b.WriteString("-inf")
+		}
+		return
+	}
+	e.b.WriteString(strconv.FormatFloat(f, 'g', e.config.precision, 64))
+}
+
+// string writes s quoted, escaping the characters that lua-cjson escapes:
+// the quote, the backslash, the slash and the control characters. Other
+// bytes are copied as they are.
+func (e *jsonEncoder) string(s string) {
+	e.b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '/':
+			e.b.WriteByte('\\')
+			e.b.WriteByte(c)
+		case '\b':
+			e.b.WriteString(`\b`)
+		case '\f':
+			e.b.WriteString(`\f`)
+		case '\n':
+			e.b.WriteString(`\n`)
+		case '\r':
+			e.b.WriteString(`\r`)
+		case '\t':
+			e.b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&e.b, `\u%04x`, c)
+			} else {
+				e.b.WriteByte(c)
+			}
+		}
+	}
+	e.b.WriteByte('"')
+}
+
+// arrayLength returns the length of t if it is to be written as an array,
+// or -1 for an object: when it has keys other than positive integers, or
+// when it is excessively sparse and sparseConvert is set.
+func (e *jsonEncoder) arrayLength(t *table) int {
+	largest, items := 0, 0
+	isArray := true
+	each := func(k, _ value) {
+		if i, ok := k.(int64); ok && i > 0 && isArray {
+			if i > int64(math.MaxInt32) {
+				isArray = false
+			}
+			largest = max(largest, int(i))
+			items++
+		} else {
+			isArray = false
+		}
+	}
+	for i, v := range t.array {
+		if v != nil {
+			each(int64(i+1), v)
+		}
+	}
+	t.hash.each(each)
+	if !isArray {
+		return -1
+	}
+	c := e.config
+	if c.sparseRatio > 0 && largest > items*c.sparseRatio && largest > c.sparseSafe {
+		if !c.sparseConvert {
+			Errorf(e.l, "Cannot serialise table: excessively sparse array")
+		}
+		return -1
+	}
+	return largest
+}
+
+func (e *jsonEncoder) table(t *table, depth int) {
+	if depth > e.config.encodeMaxDepth {
+		Errorf(e.l, "Cannot serialise, excessive nesting (%d)", depth)
+	}
+	n := e.arrayLength(t)
+	if n == 0 && !e.config.emptyTableAsObject {
+		e.b.WriteString("[]")
+		return
+	}
+	if n > 0 {
+		e.b.WriteByte('[')
+		for i := 1; i <= n; i++ {
+			if i > 1 {
+				e.b.WriteByte(',')
+			}
+			e.value(t.atInt(i), depth)
+		}
+		e.b.WriteByte(']')
+		return
+	}
+	type member struct {
+		key string
+		v   value
+	}
+	var members []member
+	each := func(k, v value) {
+		switch k := k.(type) {
+		case string:
+			members = append(members, member{k, v})
+		case int64:
+			members = append(members, member{strconv.FormatInt(k, 10), v})
+		case float64:
+			members = append(members, member{strconv.FormatFloat(k, 'g', e.config.precision, 64), v})
+		default:
+			Errorf(e.l, "Cannot serialise table: table key must be a number or string")
+		}
+	}
+	for i, v := range t.array {
+		if v != nil {
+			each(int64(i+1), v)
+		}
+	}
+	t.hash.each(each)
+	sort.SliceStable(members, func(i, j int) bool { return members[i].key < members[j].key })
+	e.b.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			e.b.WriteByte(',')
+		}
+		e.string(m.key)
+		e.b.WriteByte(':')
+		e.value(m.v, depth)
+	}
+	e.b.WriteByte('}')
+}
+
+// The tokens of the JSON decoder, named as in the error messages of
+// lua-cjson.
+const (
+	jsonObjectBegin = iota
+	jsonObjectEnd
+	jsonArrayBegin
+	jsonArrayEnd
+	jsonString
+	jsonNumber
+	jsonBoolean
+	jsonNullToken
+	jsonColon
+	jsonComma
+	jsonEnd
+	jsonError
+)
+
+var jsonTokenNames = []string{
+	"T_OBJ_BEGIN", "T_OBJ_END", "T_ARR_BEGIN", "T_ARR_END", "T_STRING", "T_NUMBER",
+	"T_BOOLEAN", "T_NULL", "T_COLON", "T_COMMA", "T_END", "T_ERROR",
+}
+
+type jsonToken struct {
+	kind  int
+	value value
+	err   string // the message of a jsonError
+	pos   int    // the character where the token starts, from 1
+}
+
+// jsonDecoder reads JSON into Lua values, like lua-cjson.
+type jsonDecoder struct {
+	l      *State
+	config *jsonConfig
+	s      string
+	pos    int
+	depth  int
+}
+
+func (d *jsonDecoder) next() jsonToken {
+	for d.pos < len(d.s) && strings.IndexByte(" \t\n\r", d.s[d.pos]) >= 0 {
+		d.pos++
+	}
+	t := jsonToken{pos: d.pos + 1}
+	if d.pos == len(d.s) {
+		t.kind = jsonEnd
+		return t
+	}
+	switch c := d.s[d.pos]; c {
+	case '{', '}', '[', ']', ':', ',':
+		t.kind = strings.IndexByte("{}[]", c)
+		if c == ':' {
+			t.kind = jsonColon
+		} else if c == ',' {
+			t.kind = jsonComma
+		}
+		d.pos++
+	case '"':
+		d.string(&t)
+	default:
+		if c == '-' || '0' <= c && c <= '9' || d.config.decodeInvalid && (c == 'n' || c == 'N' || c == 'i' || c == 'I') {
+			if d.number(&t) {
+				break
+			}
+		}
+		for _, w := range []struct {
+			word  string
+			kind  int
+			value value
+		}{{"true", jsonBoolean, true}, {"false", jsonBoolean, false}, {"null", jsonNullToken, nullSentinel}} {
+			if strings.HasPrefix(d.s[d.pos:], w.word) {
+				t.kind, t.value = w.kind, w.value
+				d.pos += len(w.word)
+				return t
+			}
+		}
+		t.kind, t.err = jsonError, "invalid token"
+	}
+	return t
+}
+
+// number reads a number, an integer if it has neither a fraction nor an
+// exponent and fits, and with decodeInvalid also nan and inf.
+func (d *jsonDecoder) number(t *jsonToken) bool {
+	s := d.s[d.pos:]
+	if d.config.decodeInvalid {
+		sign, rest := 1.0, s
+		if rest[0] == '-' {
+			sign, rest = -1, rest[1:]
+		}
+		for _, w := range []string{"infinity", "inf", "nan"} {
+			if len(rest) >= len(w) && strings.EqualFold(rest[:len(w)], w) {
+				t.kind, t.value = jsonNumber, sign*math.Inf(1)
+				if w == "nan" {
+					t.value = math.NaN()
+				}
+				d.pos += len(s) - len(rest) + len(w)
+				return true
+			}
+		}
+	}
+	if s[0] != '-' && (s[0] < '0' || '9' < s[0]) {
+		return false
+	}
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	if i == digits || s[digits] == '0' && i > digits+1 {
+		t.kind, t.err = jsonError, "invalid number"
+		return true
+	}
+	integer := true
+	if i < len(s) && s[i] == '.' {
+		integer = false
+		i++
+		start := i
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		if i == start {
+			t.kind, t.err = jsonError, "invalid number"
+			return true
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		integer = false
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		start := i
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		if i == start {
+			t.kind, t.err = jsonError, "invalid number"
+			return true
+		}
+	}
+	t.kind = jsonNumber
+	if integer {
+		if n, err := strconv.ParseInt(s[:i], 10, 64); err == nil {
+			t.value = n
+			d.pos += i
+			return true
+		}
+	}
+	f, _ := strconv.ParseFloat(s[:i], 64)
+	t.value = f
+	d.pos += i
+	return true
+}
+
+func (d *jsonDecoder) string(t *jsonToken) {
+	var b strings.Builder
+	i := d.pos + 1
+	for {
+		if i >= len(d.s) {
+			t.kind, t.err = jsonError, "unexpected end of string"
+			return
+		}
+		c := d.s[i]
+		if c == '"' {
+			break
+		} else if c != '\\' {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(d.s) {
+			t.kind, t.err = jsonError, "unexpected end of string"
+			return
+		}
+		switch e := d.s[i+1]; e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			r, n := d.unicodeEscape(i)
+			if n == 0 {
+				t.kind, t.err = jsonError, "invalid unicode escape code"
+				return
+			}
+			b.WriteRune(r)
+			i += n
+			continue
+		default:
+			t.kind, t.err = jsonError, "invalid escape code"
+			return
+		}
+		i += 2
+	}
+	t.kind, t.value = jsonString, b.String()
+	d.pos = i + 1
+}
+
+// unicodeEscape decodes the \uXXXX escape at i, or a surrogate pair of
+// them, and returns the rune and the length of the escapes, 0 if invalid.
+func (d *jsonDecoder) unicodeEscape(i int) (rune, int) {
+	hex := func(i int) rune {
+		if i+6 > len(d.s) || d.s[i] != '\\' || d.s[i+1] != 'u' {
+			return -1
+		}
+		n, err := strconv.ParseUint(d.s[i+2:i+6], 16, 16)
+		if err != nil {
+			return -1
+		}
+		return rune(n)
+	}
+	r := hex(i)
+	switch {
+	case r < 0:
+		return 0, 0
+	case utf16.IsSurrogate(r):
+		if r >= 0xdc00 {
+			return 0, 0
+		}
+		r2 := hex(i + 6)
+		if r2 < 0xdc00 || r2 > 0xdfff {
+			return 0, 0
+		}
+		return utf16.DecodeRune(r, r2), 12
+	}
+	return r, 6
+}
+
+func (d *jsonDecoder) fail(expected string, t jsonToken) {
+	found := jsonTokenNames[t.kind]
+	if t.kind == jsonError {
+		found = t.err
+	}
+	Errorf(d.l, "Expected %s but found %s at character %d", expected, found, t.pos)
+}
+
+func (d *jsonDecoder) value(t jsonToken) value {
+	switch t.kind {
+	case jsonString, jsonNumber, jsonBoolean, jsonNullToken:
+		return t.value
+	case jsonObjectBegin:
+		d.descend(t)
+		o := newTable()
+		if t = d.next(); t.kind == jsonObjectEnd {
+			d.depth--
+			return o
+		}
+		for {
+			if t.kind != jsonString {
+				d.fail("object key string", t)
+			}
+			k := t.value
+			if t = d.next(); t.kind != jsonColon {
+				d.fail("colon", t)
+			}
+			o.put(d.l, k, d.value(d.next()))
+			if t = d.next(); t.kind == jsonObjectEnd {
+				d.depth--
+				return o
+			} else if t.kind != jsonComma {
+				d.fail("comma or object end", t)
+			}
+			t = d.next()
+		}
+	case jsonArrayBegin:
+		d.descend(t)
+		var items []value
+		if t = d.next(); t.kind != jsonArrayEnd {
+			for {
+				items = append(items, d.value(t))
+				if t = d.next(); t.kind == jsonArrayEnd {
+					break
+				} else if t.kind != jsonComma {
+					d.fail("comma or array end", t)
+				}
+				t = d.next()
+			}
+		}
+		d.depth--
+		a := newTableWithSize(len(items), 0)
+		for i, v := range items {
+			a.put(d.l, int64(i+1), v)
+		}
+		return a
+	}
+	d.fail("value", t)
+	return nil
+}
+
+func (d *jsonDecoder) descend(t jsonToken) {
+	if d.depth++; d.depth > d.config.decodeMaxDepth {
+		Errorf(d.l, "Found too many nested data structures (%d) at character %d", d.depth, t.pos)
+	}
+}
+
+// jsonOption implements the functions that read and change a setting: with
+// an argument, it sets the setting to the argument, true or false or "on"
+// or "off".
+func jsonOption(l *State, index int, setting *bool) {
+	switch l.TypeOf(index) {
+	case TypeNone, TypeNil:
+	case TypeBoolean:
+		*setting = l.ToBoolean(index)
+	default:
+		*setting = CheckOption(l, index, "", []string{"off", "on"}) == 1
+	}
+}
+
+// jsonInteger sets a numeric setting to the argument at index, if any,
+// which must lie between min and max.
+func jsonInteger(l *State, index int, setting *int, min, max int) {
+	if !l.IsNoneOrNil(index) {
+		n := CheckInteger(l, index)
+		ArgumentCheck(l, min <= n && n <= max, index, fmt.Sprintf("expected integer between %d and %d", min, max))
+		*setting = n
+	}
+}
+
+var jsonLibrary = []RegistryFunction{
+	{"encode", func(l *State) int {
+		CheckAny(l, 1)
+		ArgumentCheck(l, l.Top() == 1, 2, "expected 1 argument")
+		e := &jsonEncoder{l: l, config: toJSONConfig(l)}
+		e.value(l.indexToValue(1), 0)
+		l.PushString(e.b.String())
+		return 1
+	}},
+	{"decode", func(l *State) int {
+		ArgumentCheck(l, l.Top() == 1, 2, "expected 1 argument")
+		d := &jsonDecoder{l: l, config: toJSONConfig(l), s: CheckString(l, 1)}
+		v := d.value(d.next())
+		if t := d.next(); t.kind != jsonEnd {
+			d.fail("the end", t)
+		}
+		l.apiPush(v)
+		return 1
+	}},
+	{"encode_sparse_array", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonOption(l, 1, &c.sparseConvert)
+		jsonInteger(l, 2, &c.sparseRatio, 0, math.MaxInt32)
+		jsonInteger(l, 3, &c.sparseSafe, 0, math.MaxInt32)
+		l.PushBoolean(c.sparseConvert)
+		l.PushInteger(c.sparseRatio)
+		l.PushInteger(c.sparseSafe)
+		return 3
+	}},
+	{"encode_max_depth", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonInteger(l, 1, &c.encodeMaxDepth, 1, math.MaxInt32)
+		l.PushInteger(c.encodeMaxDepth)
+		return 1
+	}},
+	{"decode_max_depth", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonInteger(l, 1, &c.decodeMaxDepth, 1, math.MaxInt32)
+		l.PushInteger(c.decodeMaxDepth)
+		return 1
+	}},
+	{"encode_number_precision", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonInteger(l, 1, &c.precision, 1, 16)
+		l.PushInteger(c.precision)
+		return 1
+	}},
+	{"encode_invalid_numbers", func(l *State) int {
+		c := toJSONConfig(l)
+		if l.TypeOf(1) == TypeString && CheckString(l, 1) == "null" {
+			c.encodeInvalid = -1
+		} else if !l.IsNoneOrNil(1) {
+			allow := c.encodeInvalid != 0
+			jsonOption(l, 1, &allow)
+			c.encodeInvalid = map[bool]int{false: 0, true: 1}[allow]
+		}
+		switch c.encodeInvalid {
+		case -1:
+			l.PushString("null")
+		default:
+			l.PushBoolean(c.encodeInvalid == 1)
+		}
+		return 1
+	}},
+	{"decode_invalid_numbers", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonOption(l, 1, &c.decodeInvalid)
+		l.PushBoolean(c.decodeInvalid)
+		return 1
+	}},
+	{"encode_empty_table_as_object", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonOption(l, 1, &c.emptyTableAsObject)
+		l.PushBoolean(c.emptyTableAsObject)
+		return 1
+	}},
+	{"encode_keep_buffer", func(l *State) int {
+		c := toJSONConfig(l)
+		jsonOption(l, 1, &c.keepBuffer)
+		l.PushBoolean(c.keepBuffer)
+		return 1
+	}},
+}
+
+// JSONOpen opens the json library, which encodes and decodes JSON like
+// lua-cjson. It is not opened by OpenLibraries; pass it as a preloaded
+// library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "json", Function: lua.JSONOpen})
+//
+// The library has the functions and settings of lua-cjson 2.1: encode,
+// decode, new, which returns an instance with settings of its own, the
+// null sentinel, for null in arrays and objects, and the configuration
+// functions encode_sparse_array, encode_max_depth, decode_max_depth,
+// encode_number_precision, encode_invalid_numbers, decode_invalid_numbers
+// and encode_keep_buffer, which has no effect, as well as
+// encode_empty_table_as_object of the OpenResty fork. Unlike lua-cjson,
+// decode returns integers for numbers without a fraction or exponent that
+// fit, and encode writes the members of objects sorted by key. Strings are
+// not checked to be valid UTF-8.
+func JSONOpen(l *State) int {
+	NewLibraryTable(l, jsonLibrary)
+	l.PushUserData(newJSONConfig())
+	SetFunctions(l, jsonLibrary, 1)
+	l.PushGoFunction(JSONOpen)
+	l.SetField(-2, "new")
+	l.PushLightUserData(nullSentinel)
+	l.SetField(-2, "null")
+	l.PushString("cjson")
+	l.SetField(-2, "_NAME")
+	l.PushString("2.1.0")
+	l.SetField(-2, "_VERSION")
+	return 1
+}
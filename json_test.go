@@ -0,0 +1,87 @@
+package lua
+
+import "testing"
+
+func TestJSON(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"json", JSONOpen})
+	if err := DoString(l, `
+		local json = require("json")
+		assert(json.encode({1, 2, 3}) == "[1,2,3]")
+		assert(json.encode({b = 1, a = {true, false}}) == '{"a":[true,false],"b":1}')
+		assert(json.encode({}) == "{}")
+		assert(json.encode({[1] = 1, [3] = 3}) == "[1,null,3]")
+		assert(json.encode({1, json.null}) == "[1,null]")
+		assert(json.encode({[2] = "x", y = 1}) == '{"2":"x","y":1}')
+		assert(json.encode(0.1) == "0.1" and json.encode(2^53) == "9.007199254741e+15")
+		assert(json.encode(-7) == "-7" and json.encode(math.maxinteger) == "9223372036854775807")
+		assert(json.encode("a/b\"c\\\n\1") == '"a\\/b\\"c\\\\\\n\\u0001"')
+		assert(json.encode("héllo") == '"héllo"')
+		assert(json.encode(nil) == "null")
+
+		local v = json.decode('{"a": [1, 2.5, -3e2, "x\\u00e9\\ud83d\\ude00", null, true], "b": {}}')
+		assert(v.a[1] == 1 and math.type(v.a[1]) == "integer")
+		assert(v.a[2] == 2.5 and v.a[3] == -300.0 and math.type(v.a[3]) == "float")
+		assert(v.a[4] == "xé😀")
+		assert(v.a[5] == json.null and v.a[6] == true and #v.a == 6)
+		assert(next(v.b) == nil)
+		assert(json.decode("12345678901234567890") == 1.2345678901234567e19)
+		assert(json.decode(' "\\/\\b" ') == "/\b")
+
+		local function fails(f, arg, message)
+			local ok, err = pcall(f, arg)
+			assert(not ok, "no error for " .. tostring(arg))
+			assert(err:find(message, 1, true), err)
+		end
+		fails(json.decode, "", "Expected value but found T_END at character 1")
+		fails(json.decode, "[1,]", "Expected value but found T_ARR_END at character 4")
+		fails(json.decode, "[1 2]", "Expected comma or array end but found T_NUMBER at character 4")
+		fails(json.decode, '{"a" 1}', "Expected colon but found T_NUMBER at character 6")
+		fails(json.decode, '{1: 2}', "Expected object key string but found T_NUMBER at character 2")
+		fails(json.decode, "[1] x", "Expected the end but found invalid token at character 5")
+		fails(json.decode, '"abc', "Expected value but found unexpected end of string at character 1")
+		fails(json.decode, '"\\q"', "invalid escape code")
+		fails(json.decode, '"\\ud83d"', "invalid unicode escape code")
+		fails(json.decode, "01", "invalid number")
+		fails(json.encode, {[1] = 1, [100] = 2}, "Cannot serialise table: excessively sparse array")
+		fails(json.encode, {[true] = 1}, "table key must be a number or string")
+		fails(json.encode, print, "Cannot serialise function: type not supported")
+		fails(json.encode, 0/0, "must not be NaN or Infinity")
+		local t = {} t[1] = t
+		fails(json.encode, t, "Cannot serialise, excessive nesting (1001)")
+		fails(json.decode, string.rep("[", 1001), "Found too many nested data structures (1001) at character 1001")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONSettings(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"json", JSONOpen})
+	if err := DoString(l, `
+		local json = require("json")
+		local other = json.new()
+		assert(select("#", json.encode_sparse_array()) == 3)
+		local convert, ratio, safe = json.encode_sparse_array(true)
+		assert(convert == true and ratio == 2 and safe == 10)
+		assert(json.encode({[1] = 1, [100] = 2}) == '{"1":1,"100":2}')
+		assert(not pcall(other.encode, {[1] = 1, [100] = 2}), "instances share settings")
+
+		assert(json.encode_number_precision(3) == 3 and json.encode(math.pi) == "3.14")
+		assert(not pcall(json.encode_number_precision, 17))
+		assert(json.encode_invalid_numbers("null") == "null" and json.encode(1/0) == "null")
+		assert(json.encode_invalid_numbers(true) == true and json.encode({-1/0, 1/0}) == "[-inf,inf]")
+		assert(json.decode("[NaN, -Infinity]")[2] == -1/0)
+		assert(json.decode_invalid_numbers(false) == false and not pcall(json.decode, "nan"))
+		assert(json.decode("null") == json.null)
+
+		assert(json.encode_max_depth(2) == 2)
+		assert(json.encode({{}}) == "[{}]" and not pcall(json.encode, {{{}}}))
+		assert(json.decode_max_depth(1) == 1)
+		assert(pcall(json.decode, "[]") and not pcall(json.decode, "[[]]"))
+		assert(json.encode_empty_table_as_object("off") == false and json.encode({}) == "[]")
+		assert(json.encode_keep_buffer() == true)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -31,25 +31,32 @@ package lua
 //
 // Except for the basic and the package libraries, each library provides all
 // its functions as fields of a global table or as methods of its objects.
+//
+// Builds with the lua_noos tag leave out the io and os libraries, and the
+// optional mmap and signal libraries, so that scripts have no access to
+// files, commands or the environment. The Go functions that open and
+// configure them, such as IOOpen and SetNumberFormat, are left out too, and
+// the package does not import os. print and warn write only to the writers
+// set with SetStdout and SetStderr, and loadfile, dofile and require read
+// files only through a FileOpener that the host sets. The Go runtime and
+// standard packages such as fmt still link os, but nothing in the VM calls
+// it. Builds for TinyGo's bare metal targets leave out the same libraries.
+//
+// The preloaded libraries are added to package.preload, so that require
+// opens them on first use. So are the libraries of this package written in
+// Lua, before them, so that a preloaded library of the same name replaces
+// one of these:
+//
+//	compat  the functions of Lua 5.1 and 5.2 that Lua 5.4 removed, such as
+//	        unpack, loadstring, setfenv and table.getn, set as globals and
+//	        library fields where they are missing
 func OpenLibraries(l *State, preloaded ...RegistryFunction) {
-	libs := []RegistryFunction{
-		{"_G", BaseOpen},
-		{"package", PackageOpen},
-		{"coroutine", CoroutineOpen},
-		{"table", TableOpen},
-		{"io", IOOpen},
-		{"os", OSOpen},
-		{"string", StringOpen},
-		{"bit32", Bit32Open},
-		{"math", MathOpen},
-		{"debug", DebugOpen},
-		{"utf8", UTF8Open},
-	}
-	for _, lib := range libs {
+	for _, lib := range standardLibraries {
 		Require(l, lib.Name, lib.Function, true)
 		l.Pop(1)
 	}
 	SubTable(l, RegistryIndex, "_PRELOAD")
+	preloadLuaLibraries(l)
 	for _, lib := range preloaded {
 		l.PushGoFunction(lib.Function)
 		l.SetField(-2, lib.Name)
@@ -0,0 +1,291 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// ListChunk writes a listing of the Lua function on the top of the stack and
+// of the functions nested in it to w, in the format of "luac -l". If full is
+// set, it also lists the constants, local variables and upvalues of each
+// function, like "luac -l -l". The function stays on the stack.
+func ListChunk(l *State, w io.Writer, full bool) error {
+	l.checkElementCount(1)
+	return listClosure(l, -1, "ListChunk", w, full, true)
+}
+
+// ListFunction writes a listing of the Lua function at index to w, like
+// ListChunk, but without the functions nested in it. The function may be any
+// Lua closure, such as one taken from a table or returned by debug.getinfo,
+// not only a main chunk. The listing shows the source line of each
+// instruction.
+func ListFunction(l *State, index int, w io.Writer, full bool) error {
+	return listClosure(l, index, "ListFunction", w, full, false)
+}
+
+func listClosure(l *State, index int, caller string, w io.Writer, full, nested bool) error {
+	f, ok := l.indexToValue(index).(*luaClosure)
+	if !ok {
+		panic("lua: " + caller + ": Lua function expected")
+	}
+	b := bufio.NewWriter(w)
+	listFunction(b, f.prototype, full, nested)
+	return b.Flush()
+}
+
+func listFunction(w io.Writer, p *prototype, full, nested bool) {
+	listHeader(w, p)
+	listCode(w, p)
+	if full {
+		listDebug(w, p)
+	}
+	if nested {
+		for i := range p.prototypes {
+			listFunction(w, &p.prototypes[i], full, nested)
+		}
+	}
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+func listHeader(w io.Writer, p *prototype) {
+	source := p.source
+	switch {
+	case source == "":
+		source = "?"
+	case source[0] == '@' || source[0] == '=':
+		source = source[1:]
+	case source[0] == Signature[0]:
+		source = "(bstring)"
+	default:
+		source = "(string)"
+	}
+	kind := "function"
+	if p.lineDefined == 0 {
+		kind = "main"
+	}
+	fmt.Fprintf(w, "\n%s <%s:%d,%d> (%d instruction%s)\n", kind, source, p.lineDefined, p.lastLineDefined, len(p.code), plural(len(p.code)))
+	vararg := ""
+	if p.isVarArg {
+		vararg = "+"
+	}
+	fmt.Fprintf(w, "%d%s param%s, %d slot%s, %d upvalue%s, ", p.parameterCount, vararg, plural(p.parameterCount), p.maxStackSize, plural(p.maxStackSize), len(p.upValues), plural(len(p.upValues)))
+	fmt.Fprintf(w, "%d local%s, %d constant%s, %d function%s\n", len(p.localVariables), plural(len(p.localVariables)), len(p.constants), plural(len(p.constants)), len(p.prototypes), plural(len(p.prototypes)))
+}
+
+func listCode(w io.Writer, p *prototype) {
+	for pc, i := range p.code {
+		line := "[-]"
+		if l := getFuncLine(p, pc); l > 0 {
+			line = "[" + strconv.Itoa(l) + "]"
+		}
+		operands, comment := listOperands(p, pc, i)
+		if comment != "" {
+			comment = "\t; " + comment
+		}
+		fmt.Fprintf(w, "\t%d\t%s\t%-9s\t%s%s\n", pc+1, line, opNames[i.opCode()], operands, comment)
+	}
+}
+
+// listOperands returns the operands of the instruction i at pc as luac shows
+// them, and a comment that explains them.
+func listOperands(p *prototype, pc int, i instruction) (operands, comment string) {
+	a, b, c, k := i.a(), i.b(), i.c(), i.k()
+	constant := func(index int) string {
+		if index < len(p.constants) {
+			return constantString(p.constants[index])
+		}
+		return "?"
+	}
+	rk := func() string { // C is a constant if k is set, else a register
+		if k != 0 {
+			return constant(c)
+		}
+		return ""
+	}
+	upValue := func(index int) string {
+		if index < len(p.upValues) {
+			return p.upValueName(index)
+		}
+		return "?"
+	}
+	kFlag := ""
+	if k != 0 {
+		kFlag = "k"
+	}
+	switch op := i.opCode(); op {
+	case opLoadI, opLoadF:
+		return fmt.Sprintf("%d %d", a, i.sbx()), ""
+	case opLoadConstant:
+		return fmt.Sprintf("%d %d", a, i.bx()), constant(i.bx())
+	case opLoadConstantEx:
+		if pc+1 < len(p.code) {
+			comment = constant(p.code[pc+1].ax())
+		}
+		return fmt.Sprintf("%d", a), comment
+	case opLoadFalse, opLoadFalseSkip, opLoadTrue, opTBC, opClose:
+		return fmt.Sprintf("%d", a), ""
+	case opLoadNil:
+		return fmt.Sprintf("%d %d", a, b), fmt.Sprintf("%d out", b+1)
+	case opGetUpValue, opSetUpValue:
+		return fmt.Sprintf("%d %d", a, b), upValue(b)
+	case opGetTableUp:
+		return fmt.Sprintf("%d %d %d", a, b, c), upValue(b) + " " + constant(c)
+	case opSetTableUp:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), joinComment(upValue(a), constant(b), rk())
+	case opGetField:
+		return fmt.Sprintf("%d %d %d", a, b, c), constant(c)
+	case opSetField:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), joinComment(constant(b), rk())
+	case opSetTable, opSetI:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), rk()
+	case opSelf:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), rk()
+	case opAddI, opShrI, opShlI:
+		return fmt.Sprintf("%d %d %d", a, b, i.sC()), ""
+	case opAddK, opSubK, opMulK, opModK, opPowK, opDivK, opIDivK, opBAndK, opBOrK, opBXorK:
+		return fmt.Sprintf("%d %d %d", a, b, c), constant(c)
+	case opMMBin:
+		return fmt.Sprintf("%d %d %d", a, b, c), eventNames[c]
+	case opMMBinI:
+		return fmt.Sprintf("%d %d %d %d", a, i.sB(), c, k), eventNames[c]
+	case opMMBinK:
+		return fmt.Sprintf("%d %d %d %d", a, b, c, k), joinComment(eventNames[c], constant(b))
+	case opMove, opUnaryMinus, opBNot, opNot, opLength:
+		return fmt.Sprintf("%d %d", a, b), ""
+	case opConcat:
+		return fmt.Sprintf("%d %d", a, b), ""
+	case opJump:
+		return fmt.Sprintf("%d", i.sJ()), fmt.Sprintf("to %d", pc+i.sJ()+2)
+	case opEqual, opLessThan, opLessOrEqual, opTest:
+		return fmt.Sprintf("%d %d %d", a, b, k), ""
+	case opEqualK:
+		return fmt.Sprintf("%d %d %d", a, b, k), constant(b)
+	case opEqualI, opLessThanI, opLessOrEqualI, opGreaterThanI, opGreaterOrEqualI:
+		return fmt.Sprintf("%d %d %d", a, i.sB(), k), ""
+	case opTestSet:
+		return fmt.Sprintf("%d %d %d", a, b, k), ""
+	case opCall:
+		return fmt.Sprintf("%d %d %d", a, b, c), fmt.Sprintf("%s in %s out", countString(b-1), countString(c-1))
+	case opTailCall:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), countString(b-1) + " in"
+	case opReturn:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), countString(b-1) + " out"
+	case opReturn0:
+		return "", ""
+	case opReturn1:
+		return fmt.Sprintf("%d", a), ""
+	case opForLoop, opTForLoop:
+		return fmt.Sprintf("%d %d", a, i.bx()), fmt.Sprintf("to %d", pc-i.bx()+2)
+	case opForPrep, opTForPrep:
+		to := pc + i.bx() + 2
+		if op == opForPrep {
+			to++
+		}
+		return fmt.Sprintf("%d %d", a, i.bx()), fmt.Sprintf("exit to %d", to)
+	case opTForCall:
+		return fmt.Sprintf("%d %d", a, c), ""
+	case opSetList:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), ""
+	case opNewTable:
+		return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), ""
+	case opClosure:
+		return fmt.Sprintf("%d %d", a, i.bx()), ""
+	case opVarArg:
+		return fmt.Sprintf("%d %d", a, c), countString(c-1) + " out"
+	case opVarArgPrep:
+		return fmt.Sprintf("%d", a), ""
+	case opExtraArg:
+		return fmt.Sprintf("%d", i.ax()), ""
+	}
+	switch opMode(i.opCode()) {
+	case iABx:
+		return fmt.Sprintf("%d %d", a, i.bx()), ""
+	case iAsBx:
+		return fmt.Sprintf("%d %d", a, i.sbx()), ""
+	}
+	return fmt.Sprintf("%d %d %d%s", a, b, c, kFlag), ""
+}
+
+// countString shows a count of values, where -1 means all of them.
+func countString(n int) string {
+	if n < 0 {
+		return "all"
+	}
+	return strconv.Itoa(n)
+}
+
+func joinComment(parts ...string) string {
+	s := ""
+	for _, p := range parts {
+		if p == "" {
+			continue
+		} else if s != "" {
+			s += " "
+		}
+		s += p
+	}
+	return s
+}
+
+// constantString shows a constant like luac: strings quoted, floats with a
+// decimal point.
+func constantString(v value) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', 14, 64)
+		if !math.IsInf(v, 0) && !math.IsNaN(v) && v == math.Trunc(v) && strconv.FormatFloat(v, 'f', -1, 64) == s {
+			s += ".0"
+		}
+		return s
+	case string:
+		return strconv.Quote(v)
+	}
+	return "?"
+}
+
+func listDebug(w io.Writer, p *prototype) {
+	fmt.Fprintf(w, "constants (%d):\n", len(p.constants))
+	for i, k := range p.constants {
+		tag := "?"
+		switch k.(type) {
+		case nil:
+			tag = "N"
+		case bool:
+			tag = "B"
+		case int64:
+			tag = "I"
+		case float64:
+			tag = "F"
+		case string:
+			tag = "S"
+		}
+		fmt.Fprintf(w, "\t%d\t%s\t%s\n", i, tag, constantString(k))
+	}
+	fmt.Fprintf(w, "locals (%d):\n", len(p.localVariables))
+	for i, v := range p.localVariables {
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, v.name, v.startPC+1, v.endPC+1)
+	}
+	fmt.Fprintf(w, "upvalues (%d):\n", len(p.upValues))
+	for i, u := range p.upValues {
+		inStack := 0
+		if u.isLocal {
+			inStack = 1
+		}
+		fmt.Fprintf(w, "\t%d\t%s\t%d\t%d\n", i, p.upValueName(i), inStack, u.index)
+	}
+}
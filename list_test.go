@@ -0,0 +1,82 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListChunk(t *testing.T) {
+	l := NewState()
+	if err := LoadBuffer(l, "local t = {}\nfor i = 1, 3 do t[i] = 'x' .. i end\nreturn function(a) return a + 1.5 end", "=list", "t"); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := ListChunk(l, &b, false); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"\nmain <list:0,0> (",
+		"0+ params, ",
+		"1 upvalue, ",
+		"\t1\t[1]\tVARARGPREP\t0\n",
+		"\tFORPREP  \t",
+		"; \"x\"\n",
+		"\nfunction <list:3,3> (",
+		"1 param, ",
+		"\tMMBIN    \t0 1 6\t; __add\n",
+		"; 1.5\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("listing lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "constants (") {
+		t.Errorf("short listing has constants:\n%s", out)
+	}
+
+	b.Reset()
+	if err := ListChunk(l, &b, true); err != nil {
+		t.Fatal(err)
+	}
+	out = b.String()
+	for _, want := range []string{"constants (", "\tS\t\"x\"\n", "locals (", "\tt\t", "upvalues (1):\n\t0\t_ENV\t1\t0\n", "\t0\ta\t1\t"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("full listing lacks %q:\n%s", want, out)
+		}
+	}
+	if l.Top() != 1 {
+		t.Errorf("ListChunk left %d values on the stack, want 1", l.Top())
+	}
+}
+
+func TestListFunction(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, "local t = {}\nfunction t.f(a)\n  local g = function() return a end\n  return g\nend\nreturn t"); err != nil {
+		t.Fatal(err)
+	}
+	l.Field(-1, "f")
+	var b strings.Builder
+	if err := ListFunction(l, -1, &b, true); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{"\nfunction <(string):2,5> (", "1 param, ", "1 function\n", "\t[3]\tCLOSURE  \t", "\t[4]\tRETURN1  \t", "locals (2):\n\t0\ta\t", "\t1\tg\t"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("listing lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, ":3,3>") {
+		t.Errorf("listing has the nested function:\n%s", out)
+	}
+
+	testString(t, `
+		local function f(x) return function() return x end end
+		local s = debug.listing(f)
+		assert(s:find("\nfunction <[^>]*> %(3 instructions%)") and s:find("GETUPVAL"))
+		assert(not s:find("constants %("))
+		assert(debug.listing(f, true):find("locals %(1%):\n\t0\tx\t"))
+		assert(not pcall(debug.listing, print))
+	`)
+}
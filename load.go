@@ -3,7 +3,6 @@ package lua
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 )
@@ -78,12 +77,13 @@ func createSearchersTable(l *State) {
 	}
 }
 
-func readable(filename string) bool {
-	f, err := os.Open(filename)
-	if f != nil {
-		f.Close()
+func readable(l *State, filename string) bool {
+	f, err := openFile(l, filename, readOnly)
+	if err != nil {
+		return false
 	}
-	return err == nil
+	f.Close()
+	return true
 }
 
 func searchPath(l *State, name, path, sep, dirSep string) (string, error) {
@@ -95,7 +95,7 @@ func searchPath(l *State, name, path, sep, dirSep string) (string, error) {
 	for _, template := range filepath.SplitList(path) {
 		if template != "" {
 			filename := strings.Replace(template, "?", name, -1)
-			if readable(filename) {
+			if readable(l, filename) {
 				return filename, nil
 			}
 			msg = fmt.Sprintf("%s\n\tno file '%s'", msg, filename)
@@ -112,7 +112,7 @@ func noEnv(l *State) bool {
 }
 
 func setPath(l *State, field, env, def string) {
-	if path := os.Getenv(env); path == "" || noEnv(l) {
+	if path := getenv(env); path == "" || noEnv(l) {
 		l.PushString(def)
 	} else {
 		o := fmt.Sprintf("%c%c", pathListSeparator, pathListSeparator)
@@ -146,6 +146,12 @@ var packageLibrary = []RegistryFunction{
 		l.PushString(f)
 		return 1
 	}},
+	{"unload", func(l *State) int {
+		// package.unload(name) forgets module name, so the next require
+		// loads it again, and reports whether it was loaded. See Unload.
+		l.PushBoolean(Unload(l, CheckString(l, 1)))
+		return 1
+	}},
 }
 
 // PackageOpen opens the package library. Usually passed to Require.
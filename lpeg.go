@@ -0,0 +1,865 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const lpegHandle = "lpeg-pattern"
+
+// lpegVersion is the LPeg version whose interface the lpeg module follows.
+const lpegVersion = "1.1.0"
+
+type pegOp byte
+
+const (
+	pegAny     pegOp = iota // n arbitrary bytes
+	pegLiteral              // the string s
+	pegSet                  // one byte of set
+	pegTrue                 // the empty string
+	pegFalse                // never matches
+	pegSeq                  // left followed by right
+	pegChoice               // left, or right where left fails
+	pegRep                  // at least n repetitions of left
+	pegOpt                  // at most n repetitions of left
+	pegNot                  // only if left does not match, consumes nothing
+	pegAnd                  // only if left matches, consumes nothing
+	pegBehind               // left matches the n bytes before the position
+	pegCall                 // reference to the rule key, not yet in a grammar
+	pegRule                 // rule key of a grammar, left is its body
+	pegGrammar              // left is the initial rule
+	pegCapture              // capture of kind capture around left
+	pegRunTime              // match-time capture, values[0] is the function
+)
+
+type pegCaptureKind byte
+
+const (
+	capSimple   pegCaptureKind = iota // lpeg.C
+	capPosition                       // lpeg.Cp
+	capConst                          // lpeg.Cc, values are the constants
+	capArg                            // lpeg.Carg, n is the argument number
+	capBack                           // lpeg.Cb, key is the group name
+	capGroup                          // lpeg.Cg, key is the name or nil
+	capTable                          // lpeg.Ct
+	capSubst                          // lpeg.Cs
+	capFold                           // lpeg.Cf, values[0] is the function
+	capString                         // p / string
+	capNumber                         // p / number
+	capQuery                          // p / table
+	capFunction                       // p / function
+)
+
+type pegCharset [4]uint64
+
+func (s *pegCharset) add(c byte)           { s[c>>6] |= 1 << (c & 63) }
+func (s *pegCharset) contains(c byte) bool { return s[c>>6]&(1<<(c&63)) != 0 }
+
+// A pegNode is a node of the tree that represents a pattern. Patterns are
+// immutable once built, so nodes are freely shared between patterns.
+type pegNode struct {
+	op          pegOp
+	capture     pegCaptureKind
+	left, right *pegNode
+	n           int
+	s           string
+	set         pegCharset
+	key         value   // rule or group name
+	values      []value // see pegCaptureKind
+}
+
+var pegTrueNode, pegFalseNode = &pegNode{op: pegTrue}, &pegNode{op: pegFalse}
+
+func pegSequence(left, right *pegNode) *pegNode {
+	if left.op == pegTrue {
+		return right
+	} else if right.op == pegTrue {
+		return left
+	}
+	return &pegNode{op: pegSeq, left: left, right: right}
+}
+
+func pegAlternative(left, right *pegNode) *pegNode {
+	if left.op == pegSet && right.op == pegSet {
+		n := &pegNode{op: pegSet}
+		for i := range n.set {
+			n.set[i] = left.set[i] | right.set[i]
+		}
+		return n
+	} else if left.op == pegFalse {
+		return right
+	} else if right.op == pegFalse {
+		return left
+	}
+	return &pegNode{op: pegChoice, left: left, right: right}
+}
+
+// nullable reports whether n can match the empty string. Rules are assumed
+// not to be nullable while their own body is being examined.
+func (n *pegNode) nullable(visiting map[*pegNode]bool) bool {
+	switch n.op {
+	case pegAny, pegLiteral, pegSet, pegFalse, pegCall:
+		return false
+	case pegSeq:
+		return n.left.nullable(visiting) && n.right.nullable(visiting)
+	case pegChoice:
+		return n.left.nullable(visiting) || n.right.nullable(visiting)
+	case pegRep:
+		return n.n == 0 || n.left.nullable(visiting)
+	case pegRule:
+		if visiting[n] {
+			return false
+		}
+		visiting[n] = true
+		defer delete(visiting, n)
+		return n.left.nullable(visiting)
+	case pegGrammar, pegCapture, pegRunTime:
+		return n.left.nullable(visiting)
+	}
+	return true
+}
+
+// fixedLength returns the number of bytes every match of n has, or -1.
+func (n *pegNode) fixedLength() int {
+	switch n.op {
+	case pegAny:
+		return n.n
+	case pegLiteral:
+		return len(n.s)
+	case pegSet:
+		return 1
+	case pegTrue, pegFalse, pegNot, pegAnd, pegBehind:
+		return 0
+	case pegSeq:
+		if l, r := n.left.fixedLength(), n.right.fixedLength(); l >= 0 && r >= 0 {
+			return l + r
+		}
+	case pegChoice:
+		if l := n.left.fixedLength(); l == n.right.fixedLength() {
+			return l
+		}
+	case pegCapture:
+		return n.left.fixedLength()
+	}
+	return -1
+}
+
+// bindRules returns n with the open references to rules replaced by the
+// rules of a grammar. Parts of n without open references are shared.
+func bindRules(l *State, n *pegNode, rules map[value]*pegNode, done map[*pegNode]*pegNode) *pegNode {
+	switch n.op {
+	case pegCall:
+		r, ok := rules[n.key]
+		if !ok {
+			Errorf(l, "rule '%s' undefined in given grammar", fmt.Sprint(n.key))
+		}
+		return r
+	case pegRule, pegGrammar:
+		return n
+	}
+	if n.left == nil {
+		return n
+	} else if b, ok := done[n]; ok {
+		return b
+	}
+	b := n
+	left, right := bindRules(l, n.left, rules, done), n.right
+	if right != nil {
+		right = bindRules(l, right, rules, done)
+	}
+	if left != n.left || right != n.right {
+		c := *n
+		c.left, c.right = left, right
+		b = &c
+	}
+	done[n] = b
+	return b
+}
+
+// verify raises an error if a rule of a grammar can call itself again
+// before n has consumed any input, following LPeg's verifyrule. path holds
+// the rules being examined and checked those known to be fine.
+func (n *pegNode) verify(l *State, path, checked map[*pegNode]bool) {
+	switch n.op {
+	case pegSeq:
+		n.left.verify(l, path, checked)
+		if n.left.nullable(make(map[*pegNode]bool)) {
+			n.right.verify(l, path, checked)
+		}
+	case pegChoice:
+		n.left.verify(l, path, checked)
+		n.right.verify(l, path, checked)
+	case pegRep, pegOpt, pegNot, pegAnd, pegCapture, pegRunTime:
+		n.left.verify(l, path, checked)
+	case pegRule:
+		if path[n] {
+			Errorf(l, "rule '%s' may be left recursive", fmt.Sprint(n.key))
+		} else if !checked[n] {
+			path[n] = true
+			n.left.verify(l, path, checked)
+			delete(path, n)
+			checked[n] = true
+		}
+	}
+}
+
+// lpegState holds the settings of an lpeg module.
+type lpegState struct {
+	maxStack int
+}
+
+func (lp *lpegState) grammar(l *State, index int) *pegNode {
+	var initial value = int64(1)
+	l.RawGetInt(index, 1)
+	if t := l.TypeOf(-1); t == TypeString || t == TypeNumber {
+		initial = l.indexToValue(-1)
+	}
+	l.Pop(1)
+	bodies := make(map[value]*pegNode)
+	rules := make(map[value]*pegNode)
+	for l.PushNil(); l.Next(index); l.Pop(1) {
+		key := l.indexToValue(-2)
+		if key == int64(1) && initial != int64(1) {
+			continue
+		}
+		bodies[key] = lp.check(l, -1)
+		rules[key] = &pegNode{op: pegRule, key: key}
+	}
+	if _, ok := rules[initial]; !ok {
+		Errorf(l, "rule '%s' undefined in given grammar", fmt.Sprint(initial))
+	}
+	done := make(map[*pegNode]*pegNode)
+	keys := make([]value, 0, len(rules))
+	for key, r := range rules {
+		r.left = bindRules(l, bodies[key], rules, done)
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	path, checked := make(map[*pegNode]bool), make(map[*pegNode]bool)
+	for _, key := range keys {
+		rules[key].verify(l, path, checked)
+	}
+	return &pegNode{op: pegGrammar, left: rules[initial]}
+}
+
+// check converts the value at index to a pattern, following lpeg.P.
+func (lp *lpegState) check(l *State, index int) *pegNode {
+	index = l.AbsIndex(index)
+	switch l.TypeOf(index) {
+	case TypeString:
+		if s, _ := l.ToString(index); s != "" {
+			return &pegNode{op: pegLiteral, s: s}
+		}
+		return pegTrueNode
+	case TypeNumber:
+		if n := CheckInteger(l, index); n > 0 {
+			return &pegNode{op: pegAny, n: n}
+		} else if n < 0 {
+			return &pegNode{op: pegNot, left: &pegNode{op: pegAny, n: -n}}
+		}
+		return pegTrueNode
+	case TypeBoolean:
+		if l.ToBoolean(index) {
+			return pegTrueNode
+		}
+		return pegFalseNode
+	case TypeTable:
+		return lp.grammar(l, index)
+	case TypeFunction:
+		return &pegNode{op: pegRunTime, left: pegTrueNode, values: []value{l.indexToValue(index)}}
+	}
+	if n, ok := l.ToUserData(index).(*pegNode); ok {
+		return n
+	}
+	typeError(l, index, "pattern")
+	return nil
+}
+
+func pushPattern(l *State, n *pegNode) int {
+	l.PushUserData(n)
+	SetMetaTableNamed(l, lpegHandle)
+	return 1
+}
+
+func pegCaptureNode(kind pegCaptureKind, left *pegNode) *pegNode {
+	return &pegNode{op: pegCapture, capture: kind, left: left}
+}
+
+// A pegCaptureRecord is a capture made while matching, together with the
+// captures nested in it. Values are only computed once the match succeeds.
+type pegCaptureRecord struct {
+	node       *pegNode
+	start, end int
+	nested     []pegCaptureRecord
+	values     []value // results of a match-time capture
+}
+
+type pegMatcher struct {
+	l        *State
+	subject  string
+	captures []pegCaptureRecord
+	depth    int
+	maxDepth int
+	extra    int // stack index of the first extra argument of match
+	groups   map[value]*pegCaptureRecord
+}
+
+func (m *pegMatcher) match(n *pegNode, i int) (int, bool) {
+	switch n.op {
+	case pegAny:
+		if i+n.n <= len(m.subject) {
+			return i + n.n, true
+		}
+	case pegLiteral:
+		if strings.HasPrefix(m.subject[i:], n.s) {
+			return i + len(n.s), true
+		}
+	case pegSet:
+		if i < len(m.subject) && n.set.contains(m.subject[i]) {
+			return i + 1, true
+		}
+	case pegTrue:
+		return i, true
+	case pegSeq:
+		if j, ok := m.match(n.left, i); ok {
+			return m.match(n.right, j)
+		}
+	case pegChoice:
+		mark := len(m.captures)
+		if j, ok := m.match(n.left, i); ok {
+			return j, true
+		}
+		m.captures = m.captures[:mark]
+		return m.match(n.right, i)
+	case pegRep:
+		for count := 0; ; count++ {
+			mark := len(m.captures)
+			j, ok := m.match(n.left, i)
+			if !ok {
+				m.captures = m.captures[:mark]
+				return i, count >= n.n
+			} else if j == i && count >= n.n {
+				return i, true
+			}
+			i = j
+		}
+	case pegOpt:
+		for count := 0; count < n.n; count++ {
+			mark := len(m.captures)
+			j, ok := m.match(n.left, i)
+			if !ok {
+				m.captures = m.captures[:mark]
+				break
+			}
+			i = j
+		}
+		return i, true
+	case pegNot:
+		mark := len(m.captures)
+		_, ok := m.match(n.left, i)
+		m.captures = m.captures[:mark]
+		return i, !ok
+	case pegAnd:
+		if _, ok := m.match(n.left, i); ok {
+			return i, true
+		}
+	case pegBehind:
+		if i >= n.n {
+			if j, ok := m.match(n.left, i-n.n); ok && j == i {
+				return i, true
+			}
+		}
+	case pegCall:
+		Errorf(m.l, "rule '%s' used outside a grammar", fmt.Sprint(n.key))
+	case pegRule:
+		if m.depth++; m.depth > m.maxDepth {
+			Errorf(m.l, "backtrack stack overflow (current limit is %d)", m.maxDepth)
+		}
+		j, ok := m.match(n.left, i)
+		m.depth--
+		return j, ok
+	case pegGrammar:
+		return m.match(n.left, i)
+	case pegCapture:
+		mark := len(m.captures)
+		if j, ok := m.match(n.left, i); ok {
+			m.capture(n, mark, i, j)
+			return j, true
+		}
+	case pegRunTime:
+		mark := len(m.captures)
+		if j, ok := m.match(n.left, i); ok {
+			return m.runTimeCapture(n, mark, i, j)
+		}
+	}
+	return 0, false
+}
+
+// capture replaces the captures made since mark with a single record for
+// the capture n of the subject from start to end, which holds them.
+func (m *pegMatcher) capture(n *pegNode, mark, start, end int) *pegCaptureRecord {
+	nested := append([]pegCaptureRecord(nil), m.captures[mark:]...)
+	m.captures = append(m.captures[:mark], pegCaptureRecord{node: n, start: start, end: end, nested: nested})
+	return &m.captures[mark]
+}
+
+func (m *pegMatcher) runTimeCapture(n *pegNode, mark, start, end int) (int, bool) {
+	l := m.l
+	c := m.capture(n, mark, start, end)
+	top := l.Top()
+	l.apiPush(n.values[0])
+	l.PushString(m.subject)
+	l.PushInteger(end + 1)
+	groups := m.groups
+	m.groups = nil
+	m.collectGroups(m.captures[:mark])
+	k := m.pushNested(c.nested)
+	m.groups = groups
+	l.Call(2+k, MultipleReturns)
+	results := l.Top() - top
+	if results == 0 || !l.ToBoolean(top+1) {
+		l.SetTop(top)
+		m.captures = m.captures[:mark]
+		return 0, false
+	}
+	pos := end
+	if l.IsNumber(top + 1) {
+		p, ok := l.ToInteger(top + 1)
+		if !ok || p <= end || p > len(m.subject)+1 {
+			Errorf(l, "invalid position returned by match-time capture")
+		}
+		pos = p - 1
+	}
+	c.nested, c.end = nil, pos
+	for i := top + 2; i <= l.Top(); i++ {
+		c.values = append(c.values, l.indexToValue(i))
+	}
+	l.SetTop(top)
+	return pos, true
+}
+
+func (m *pegMatcher) pushNested(captures []pegCaptureRecord) int {
+	k := 0
+	for i := range captures {
+		k += m.pushCapture(&captures[i])
+	}
+	return k
+}
+
+// pushValues pushes the values of the captures nested in c, or the whole
+// match of c if there are none.
+func (m *pegMatcher) pushValues(c *pegCaptureRecord) int {
+	if len(c.nested) == 0 {
+		m.l.PushString(m.subject[c.start:c.end])
+		return 1
+	}
+	return m.pushNested(c.nested)
+}
+
+// firstValue is like pushValues but keeps only the first value.
+func (m *pegMatcher) firstValue(c *pegCaptureRecord) int {
+	k := m.pushValues(c)
+	if k > 1 {
+		m.l.Pop(k - 1)
+		k = 1
+	}
+	return k
+}
+
+func (m *pegMatcher) pushCapture(c *pegCaptureRecord) int {
+	l, n := m.l, c.node
+	CheckStackWithMessage(l, 4, "too many captures")
+	if n.op == pegRunTime {
+		CheckStackWithMessage(l, len(c.values), "too many captures")
+		for _, v := range c.values {
+			l.apiPush(v)
+		}
+		return len(c.values)
+	}
+	switch n.capture {
+	case capSimple:
+		l.PushString(m.subject[c.start:c.end])
+		return 1 + m.pushNested(c.nested)
+	case capPosition:
+		l.PushInteger(c.start + 1)
+		return 1
+	case capConst:
+		CheckStackWithMessage(l, len(n.values), "too many captures")
+		for _, v := range n.values {
+			l.apiPush(v)
+		}
+		return len(n.values)
+	case capArg:
+		if m.extra+n.n-1 > l.Top() {
+			Errorf(l, "reference to absent extra argument #%d", n.n)
+		}
+		l.PushValue(m.extra + n.n - 1)
+		return 1
+	case capBack:
+		g, ok := m.groups[n.key]
+		if !ok {
+			Errorf(l, "back reference '%s' not found", fmt.Sprint(n.key))
+		}
+		return m.pushValues(g)
+	case capGroup:
+		if n.key != nil {
+			m.nameGroup(c)
+			return 0
+		}
+		return m.pushValues(c)
+	case capTable:
+		l.NewTable()
+		t, i := l.Top(), 1
+		for j := range c.nested {
+			d := &c.nested[j]
+			if d.node.op == pegCapture && d.node.capture == capGroup && d.node.key != nil {
+				m.nameGroup(d)
+				l.apiPush(d.node.key)
+				if m.firstValue(d) == 0 {
+					l.PushNil()
+				}
+				l.RawSet(t)
+				continue
+			}
+			k := m.pushCapture(d)
+			for j := k; j > 0; j-- {
+				l.RawSetInt(t, i+j-1)
+			}
+			i += k
+		}
+		return 1
+	case capSubst:
+		var b bytes.Buffer
+		i := c.start
+		for j := range c.nested {
+			d := &c.nested[j]
+			b.WriteString(m.subject[i:d.start])
+			if k := m.pushCapture(d); k == 0 {
+				b.WriteString(m.subject[d.start:d.end])
+			} else {
+				b.WriteString(m.replacement(-k))
+				l.Pop(k)
+			}
+			i = d.end
+		}
+		b.WriteString(m.subject[i:c.end])
+		l.PushString(b.String())
+		return 1
+	case capFold:
+		k := 0
+		if len(c.nested) > 0 {
+			k = m.pushCapture(&c.nested[0])
+		}
+		if k == 0 {
+			Errorf(l, "no initial value for fold capture")
+		}
+		l.Pop(k - 1)
+		for j := 1; j < len(c.nested); j++ {
+			l.apiPush(n.values[0])
+			l.Insert(-2)
+			l.Call(1+m.pushCapture(&c.nested[j]), 1)
+		}
+		return 1
+	case capString:
+		k := m.pushValues(c)
+		base := l.Top() - k
+		var b bytes.Buffer
+		r := n.values[0].(string)
+		for i := 0; i < len(r); i++ {
+			if r[i] != '%' || i+1 == len(r) {
+				b.WriteByte(r[i])
+				continue
+			}
+			i++
+			if r[i] < '0' || r[i] > '9' {
+				b.WriteByte(r[i])
+			} else if d := int(r[i] - '0'); d == 0 || len(c.nested) == 0 && d == 1 {
+				b.WriteString(m.subject[c.start:c.end])
+			} else if d > k || len(c.nested) == 0 {
+				Errorf(l, "invalid capture index (%d)", d)
+			} else {
+				b.WriteString(m.replacement(base + d))
+			}
+		}
+		l.SetTop(base)
+		l.PushString(b.String())
+		return 1
+	case capNumber:
+		k := m.pushValues(c)
+		if n.n == 0 {
+			l.Pop(k)
+			return 0
+		} else if n.n > k || len(c.nested) == 0 {
+			Errorf(l, "no capture '%d'", n.n)
+		}
+		l.PushValue(-k + n.n - 1)
+		l.Insert(-k - 1)
+		l.Pop(k)
+		return 1
+	case capQuery:
+		l.apiPush(n.values[0])
+		if m.firstValue(c) == 0 {
+			l.PushString(m.subject[c.start:c.end])
+		}
+		l.Table(-2)
+		l.Remove(-2)
+		if l.IsNil(-1) {
+			l.Pop(1)
+			return 0
+		}
+		return 1
+	case capFunction:
+		top := l.Top()
+		l.apiPush(n.values[0])
+		l.Call(m.pushValues(c), MultipleReturns)
+		return l.Top() - top
+	}
+	panic("unreachable")
+}
+
+// collectGroups names the groups among captures, so back references in a
+// match-time capture find the groups matched before it.
+func (m *pegMatcher) collectGroups(captures []pegCaptureRecord) {
+	for i := range captures {
+		c := &captures[i]
+		if c.node.op == pegCapture && c.node.capture == capGroup && c.node.key != nil {
+			m.nameGroup(c)
+		}
+		m.collectGroups(c.nested)
+	}
+}
+
+func (m *pegMatcher) nameGroup(c *pegCaptureRecord) {
+	if m.groups == nil {
+		m.groups = make(map[value]*pegCaptureRecord)
+	}
+	m.groups[c.node.key] = c
+}
+
+// replacement returns the value at index as a string for Cs and p / string.
+func (m *pegMatcher) replacement(index int) string {
+	s, ok := m.l.ToString(index)
+	if !ok {
+		Errorf(m.l, "invalid replacement value (a %s)", TypeNameOf(m.l, index))
+	}
+	return s
+}
+
+func (lp *lpegState) matchPattern(l *State) int {
+	n := lp.check(l, 1)
+	s := CheckString(l, 2)
+	init := len(s) + 1
+	if i := startPosition(OptInteger64(l, 3, 1), len(s)); i < int64(init) {
+		init = int(i)
+	}
+	m := &pegMatcher{l: l, subject: s, maxDepth: lp.maxStack, extra: 4}
+	end, ok := m.match(n, init-1)
+	if !ok {
+		l.PushNil()
+		return 1
+	} else if k := m.pushNested(m.captures); k > 0 {
+		return k
+	}
+	l.PushInteger(end + 1)
+	return 1
+}
+
+func toLPeg(l *State) *lpegState { return l.ToUserData(UpValueIndex(1)).(*lpegState) }
+
+func checkPegNode(l *State, index int) *pegNode { return toLPeg(l).check(l, index) }
+
+var lpegLibrary = []RegistryFunction{
+	{"B", func(l *State) int {
+		n := checkPegNode(l, 1)
+		length := n.fixedLength()
+		ArgumentCheck(l, length >= 0, 1, "pattern may not have fixed length")
+		return pushPattern(l, &pegNode{op: pegBehind, left: n, n: length})
+	}},
+	{"C", func(l *State) int { return pushPattern(l, pegCaptureNode(capSimple, checkPegNode(l, 1))) }},
+	{"Carg", func(l *State) int {
+		n := CheckInteger(l, 1)
+		ArgumentCheck(l, n > 0 && n <= 250, 1, "invalid argument index")
+		return pushPattern(l, &pegNode{op: pegCapture, capture: capArg, left: pegTrueNode, n: n})
+	}},
+	{"Cb", func(l *State) int {
+		CheckAny(l, 1)
+		return pushPattern(l, &pegNode{op: pegCapture, capture: capBack, left: pegTrueNode, key: l.indexToValue(1)})
+	}},
+	{"Cc", func(l *State) int {
+		n := &pegNode{op: pegCapture, capture: capConst, left: pegTrueNode}
+		for i := 1; i <= l.Top(); i++ {
+			n.values = append(n.values, l.indexToValue(i))
+		}
+		return pushPattern(l, n)
+	}},
+	{"Cf", func(l *State) int {
+		n := pegCaptureNode(capFold, checkPegNode(l, 1))
+		CheckType(l, 2, TypeFunction)
+		n.values = []value{l.indexToValue(2)}
+		return pushPattern(l, n)
+	}},
+	{"Cg", func(l *State) int {
+		n := pegCaptureNode(capGroup, checkPegNode(l, 1))
+		if !l.IsNoneOrNil(2) {
+			n.key = l.indexToValue(2)
+		}
+		return pushPattern(l, n)
+	}},
+	{"Cmt", func(l *State) int {
+		n := &pegNode{op: pegRunTime, left: checkPegNode(l, 1)}
+		CheckType(l, 2, TypeFunction)
+		n.values = []value{l.indexToValue(2)}
+		return pushPattern(l, n)
+	}},
+	{"Cp", func(l *State) int {
+		return pushPattern(l, &pegNode{op: pegCapture, capture: capPosition, left: pegTrueNode})
+	}},
+	{"Cs", func(l *State) int { return pushPattern(l, pegCaptureNode(capSubst, checkPegNode(l, 1))) }},
+	{"Ct", func(l *State) int { return pushPattern(l, pegCaptureNode(capTable, checkPegNode(l, 1))) }},
+	{"P", func(l *State) int { return pushPattern(l, checkPegNode(l, 1)) }},
+	{"R", func(l *State) int {
+		n := &pegNode{op: pegSet}
+		for i := 1; i <= l.Top(); i++ {
+			r := CheckString(l, i)
+			ArgumentCheck(l, len(r) == 2, i, "range must have two characters")
+			for c := int(r[0]); c <= int(r[1]); c++ {
+				n.set.add(byte(c))
+			}
+		}
+		return pushPattern(l, n)
+	}},
+	{"S", func(l *State) int {
+		n := &pegNode{op: pegSet}
+		for _, c := range []byte(CheckString(l, 1)) {
+			n.set.add(c)
+		}
+		return pushPattern(l, n)
+	}},
+	{"V", func(l *State) int {
+		CheckAny(l, 1)
+		ArgumentCheck(l, !l.IsNil(1), 1, "non-nil value expected")
+		key := l.indexToValue(1)
+		if f, ok := key.(float64); ok && f == math.Trunc(f) {
+			key = int64(f)
+		}
+		return pushPattern(l, &pegNode{op: pegCall, key: key})
+	}},
+	{"locale", func(l *State) int {
+		if l.IsNoneOrNil(1) {
+			l.CreateTable(0, 12)
+		} else {
+			CheckType(l, 1, TypeTable)
+			l.SetTop(1)
+		}
+		classes := []struct {
+			name  string
+			class byte
+		}{{"alnum", 'w'}, {"alpha", 'a'}, {"cntrl", 'c'}, {"digit", 'd'}, {"graph", 'g'},
+			{"lower", 'l'}, {"print", 0}, {"punct", 'p'}, {"space", 's'}, {"upper", 'u'}, {"xdigit", 'x'}}
+		for _, cl := range classes {
+			n := &pegNode{op: pegSet}
+			for c := 0; c < 256; c++ {
+				if cl.class == 0 && c >= 32 && c < 127 || cl.class != 0 && matchClass(byte(c), cl.class) {
+					n.set.add(byte(c))
+				}
+			}
+			pushPattern(l, n)
+			l.SetField(-2, cl.name)
+		}
+		return 1
+	}},
+	{"match", func(l *State) int { return toLPeg(l).matchPattern(l) }},
+	{"setmaxstack", func(l *State) int {
+		n := CheckInteger(l, 1)
+		ArgumentCheck(l, n > 0, 1, "positive stack size expected")
+		toLPeg(l).maxStack = n
+		return 0
+	}},
+	{"type", func(l *State) int {
+		if _, ok := l.ToUserData(1).(*pegNode); ok {
+			l.PushString("pattern")
+		} else {
+			l.PushNil()
+		}
+		return 1
+	}},
+}
+
+var lpegMetaMethods = []RegistryFunction{
+	{"__add", func(l *State) int {
+		return pushPattern(l, pegAlternative(checkPegNode(l, 1), checkPegNode(l, 2)))
+	}},
+	{"__div", func(l *State) int {
+		n := checkPegNode(l, 1)
+		switch l.TypeOf(2) {
+		case TypeString:
+			s, _ := l.ToString(2)
+			return pushPattern(l, &pegNode{op: pegCapture, capture: capString, left: n, values: []value{s}})
+		case TypeNumber:
+			k := CheckInteger(l, 2)
+			ArgumentCheck(l, k >= 0, 2, "invalid number")
+			return pushPattern(l, &pegNode{op: pegCapture, capture: capNumber, left: n, n: k})
+		case TypeTable:
+			return pushPattern(l, &pegNode{op: pegCapture, capture: capQuery, left: n, values: []value{l.indexToValue(2)}})
+		case TypeFunction:
+			return pushPattern(l, &pegNode{op: pegCapture, capture: capFunction, left: n, values: []value{l.indexToValue(2)}})
+		}
+		ArgumentError(l, 2, "invalid replacement value")
+		return 0
+	}},
+	{"__len", func(l *State) int { return pushPattern(l, &pegNode{op: pegAnd, left: checkPegNode(l, 1)}) }},
+	{"__mul", func(l *State) int { return pushPattern(l, pegSequence(checkPegNode(l, 1), checkPegNode(l, 2))) }},
+	{"__pow", func(l *State) int {
+		left, n := checkPegNode(l, 1), CheckInteger(l, 2)
+		if n < 0 {
+			return pushPattern(l, &pegNode{op: pegOpt, left: left, n: -n})
+		} else if left.nullable(make(map[*pegNode]bool)) {
+			Errorf(l, "loop body may accept empty string")
+		}
+		return pushPattern(l, &pegNode{op: pegRep, left: left, n: n})
+	}},
+	{"__sub", func(l *State) int {
+		left, right := checkPegNode(l, 1), checkPegNode(l, 2)
+		if left.op == pegSet && right.op == pegSet {
+			n := &pegNode{op: pegSet}
+			for i := range n.set {
+				n.set[i] = left.set[i] &^ right.set[i]
+			}
+			return pushPattern(l, n)
+		}
+		return pushPattern(l, pegSequence(&pegNode{op: pegNot, left: right}, left))
+	}},
+	{"__unm", func(l *State) int { return pushPattern(l, &pegNode{op: pegNot, left: checkPegNode(l, 1)}) }},
+}
+
+// LPegOpen opens the lpeg library, a pure Go implementation of the LPeg
+// parsing library. It is not opened by OpenLibraries; pass it as a preloaded
+// library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "lpeg", Function: lua.LPegOpen})
+//
+// Patterns are matched by walking the pattern tree with backtracking
+// instead of being compiled to LPeg's virtual machine. lpeg.ptree,
+// lpeg.pcode and the accumulator capture (p % f) are not provided.
+func LPegOpen(l *State) int {
+	lp := &lpegState{maxStack: 400}
+	NewLibraryTable(l, lpegLibrary)
+	l.PushUserData(lp)
+	SetFunctions(l, lpegLibrary, 1)
+	l.PushString(lpegVersion)
+	l.SetField(-2, "version")
+
+	NewMetaTable(l, lpegHandle)
+	l.PushUserData(lp)
+	SetFunctions(l, lpegMetaMethods, 1)
+	l.CreateTable(0, 1)
+	l.PushUserData(lp)
+	l.PushGoClosure(func(l *State) int { return toLPeg(l).matchPattern(l) }, 1)
+	l.SetField(-2, "match")
+	l.SetField(-2, "__index")
+	l.Pop(1)
+	return 1
+}
@@ -0,0 +1,89 @@
+package lua
+
+import "testing"
+
+func TestLPeg(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"lpeg", LPegOpen})
+	if err := DoString(l, `
+		local lpeg = require("lpeg")
+		local P, R, S, V, C, Ct, Cs, Cc, Cp, Cg, Cb, Cf, Cmt =
+			lpeg.P, lpeg.R, lpeg.S, lpeg.V, lpeg.C, lpeg.Ct, lpeg.Cs, lpeg.Cc, lpeg.Cp, lpeg.Cg, lpeg.Cb, lpeg.Cf, lpeg.Cmt
+		assert(lpeg.version == "1.1.0")
+		assert(lpeg.type(P"a") == "pattern" and lpeg.type("a") == nil)
+
+		-- basic patterns
+		assert(lpeg.match(P"hello", "hello world") == 6)
+		assert(lpeg.match(P"hello", "world") == nil)
+		assert(lpeg.match(P(3), "abcd") == 4 and lpeg.match(P(5), "abcd") == nil)
+		assert(lpeg.match(P(-1), "") == 1 and lpeg.match(P(-1), "a") == nil)
+		assert(lpeg.match(R("az", "09")^1, "abc123!") == 7)
+		assert(lpeg.match(S"+-"^0 * R"09"^1 * -1, "-42") == 4)
+		assert(lpeg.match(P"a"^-2 * "b", "aab") == 4 and lpeg.match(P"a"^-1 * "b", "aab") == nil)
+		assert(lpeg.match(#P"a" * 1, "ab") == 2 and lpeg.match(#P"a", "b") == nil)
+		assert(lpeg.match(R"az" - "q", "q") == nil and lpeg.match((1 - P",")^0, "ab,c") == 3)
+		assert(lpeg.match(P"x" * lpeg.B"x" * "y", "xy") == 3)
+		assert(P"abc":match("xabc", 2) == 5)
+		assert(lpeg.match(P"c", "abc", -1) == 4)
+
+		-- captures
+		assert(lpeg.match(C(R"az"^1) * " " * C(R"az"^1), "hello world") == "hello")
+		assert(select(2, lpeg.match(C(R"az"^1) * " " * C(R"az"^1), "hi yo")) == "yo")
+		local list = lpeg.match(Ct((C((1 - P",")^1) * P","^-1)^0), "a,bb,ccc")
+		assert(#list == 3 and list[3] == "ccc")
+		assert(lpeg.match(Cs((P"dog" / "cat" + 1)^0), "dog eat dog") == "cat eat cat")
+		assert(lpeg.match(Cp() * "ab" * Cp(), "ab") == 1)
+		assert(select(2, lpeg.match(Cc(1, 2) * Cc(3), "")) == 2)
+		local t = lpeg.match(Ct(Cg(C(R"az"^1), "key") * "=" * Cg(C(R"09"^1) / tonumber, "value")), "x=42")
+		assert(t.key == "x" and t.value == 42)
+		assert(lpeg.match(C(R"09"^1) / "<%1>", "123") == "<123>")
+		assert(lpeg.match((C"a" * C"b") / 2, "ab") == "b")
+		assert(lpeg.match(C"a" / {a = "A"}, "a") == "A")
+		local sum = Cf(C(R"09") / tonumber * ("," * C(R"09") / tonumber)^0, function(a, b) return a + b end)
+		assert(lpeg.match(sum, "1,2,3") == 6)
+		local quoted = Cg(C(S"'\""), "q") * (1 - Cmt(C(S"'\"") * Cb"q", function(s, i, a, b) return a == b end))^0 * C(S"'\"")
+		assert(lpeg.match(quoted, [["it's"]]) == '"')
+		assert(lpeg.match(Cmt(P"ab", function(s, i) return i + 1 end), "abc") == 4)
+		assert(lpeg.match(Cmt(P"ab", function() return false end), "abc") == nil)
+		assert(lpeg.match(lpeg.Carg(1) * lpeg.Carg(2), "", 1, "x", "y") == "x")
+
+		-- grammars
+		local function eval(acc, op, v)
+			if op == "+" then return acc + v elseif op == "-" then return acc - v
+			elseif op == "*" then return acc * v else return acc // v end
+		end
+		local expr = P{
+			"Exp",
+			Exp = Cf(V"Term" * Cg(C(S"+-") * V"Term")^0, eval),
+			Term = Cf(V"Factor" * Cg(C(S"*/") * V"Factor")^0, eval),
+			Factor = C(R"09"^1) / tonumber + "(" * V"Exp" * ")",
+		}
+		assert(lpeg.match(expr * -1, "2*(3+4)-10/5") == 12)
+		assert(lpeg.match(expr * -1, "2*(3+4") == nil)
+		local balanced = P{ "(" * ((1 - S"()") + V(1))^0 * ")" }
+		assert(lpeg.match(balanced, "(a(b)c)d") == 8 and lpeg.match(balanced, "(a(b") == nil)
+		local locale = lpeg.locale()
+		assert(lpeg.match(locale.alpha^1 * locale.space * locale.digit, "abc 1") == 6)
+
+		-- errors
+		assert(not pcall(function() return P""^0 end))
+		assert(not pcall(P, {"S", S = V"T"}))
+		for _, g in ipairs{
+			{"S", S = V"S" * "a"},
+			{"A", A = V"B" * "x", B = V"A" + "y"},
+			{"S", S = P"a"^0 * lpeg.C(V"S")},
+		} do
+			local ok, err = pcall(P, g)
+			assert(not ok and err:find("may be left recursive", 1, true), err)
+		end
+		assert(P{"S", S = "a" * V"S" + ""}:match("aaa") == 4)
+		assert(not pcall(lpeg.B, P"a"^1))
+		assert(not pcall(lpeg.match, P"a" / function() error("boom") end, "a"))
+		lpeg.setmaxstack(10)
+		local deep = P{ "(" * V(1)^-1 * ")" }
+		assert(lpeg.match(deep, ("("):rep(5) .. (")"):rep(5)) == 11)
+		assert(not pcall(lpeg.match, deep, ("("):rep(20) .. (")"):rep(20)))
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
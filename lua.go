@@ -1,11 +1,13 @@
 package lua
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"strings"
+	"time"
 )
 
 // MultipleReturns is the argument for argCount or resultCount in ProtectedCall and Call.
@@ -22,11 +24,12 @@ const (
 
 // Errors introduced by the Lua VM.
 var (
-	SyntaxError = errors.New("syntax error")
-	MemoryError = errors.New("memory error")
-	ErrorError  = errors.New("error within the error handler")
-	FileError   = errors.New("file error")
-	yieldError  = errors.New("yield")
+	SyntaxError  = errors.New("syntax error")
+	MemoryError  = errors.New("memory error")
+	ErrorError   = errors.New("error within the error handler")
+	FileError    = errors.New("file error")
+	TimeoutError = errors.New("timeout")
+	yieldError   = errors.New("yield")
 )
 
 // A RuntimeError is an error raised internally by the Lua VM or through Error.
@@ -34,6 +37,125 @@ type RuntimeError string
 
 func (r RuntimeError) Error() string { return "runtime error: " + string(r) }
 
+// An Error is an error returned by Load and ProtectedCall, and so by the
+// functions built on them such as LoadString and DoString. Err is one of
+// SyntaxError, MemoryError, ErrorError and RuntimeError, which errors.Is and
+// errors.As find through Unwrap:
+//
+//	var e *lua.Error
+//	if errors.As(err, &e) && errors.Is(err, lua.SyntaxError) {
+//		fmt.Printf("%s, line %d: %s\n", e.ChunkName, e.Line, e.Message)
+//	}
+//
+// The position is taken from the start of a string error value, where
+// error, Errorf and the compiler put it.
+//
+// Scripts may raise any value as an error, such as a table with an error
+// code, for a structured protocol between scripts and the host. The value
+// is left on the stack by ProtectedCall and Load, and Push pushes it again
+// later. The message of an error value that is not a string is the number,
+// or says the type of the value, using the __name field of its metatable
+// like error messages do:
+//
+//	var e *lua.Error
+//	if err := l.ProtectedCall(0, 0, 0); errors.As(err, &e) {
+//		e.Push(l)
+//		if l.IsTable(-1) {
+//			l.Field(-1, "code")
+//			code, _ := l.ToInteger(-1)
+//			...
+//		}
+//	}
+type Error struct {
+	Err       error
+	ChunkName string      // the chunk name as it appears in messages, e.g. [string "x = "], or ""
+	Line      int         // the line of ChunkName, or 0
+	Message   string      // the message without the position, "" unless the value is a string
+	Value     interface{} // the error value, as ToValue returns it
+
+	text   string // the message with the position
+	value  value
+	global *globalState
+}
+
+func (e *Error) Error() string {
+	if e.Err == SyntaxError && e.text != "" {
+		return "syntax error: " + e.text
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Push pushes the error value onto the stack of l, which must be the state
+// that returned e or one of its threads.
+func (e *Error) Push(l *State) {
+	if l.global != e.global {
+		panic("lua: Error.Push: error of another state")
+	}
+	l.apiPush(e.value)
+}
+
+// newError returns an Error for err with the error value on the top of the
+// stack, or err if it is not an error of Lua, such as a Go panic caught by
+// ProtectedCall or an error of the reader of Load.
+func (l *State) newError(err error) error {
+	_, runtime := err.(RuntimeError)
+	if !runtime && err != SyntaxError && err != MemoryError && err != ErrorError {
+		return err
+	}
+	v := l.stack[l.top-1]
+	e := &Error{Err: err, Value: l.ToValue(-1), value: v, global: l.global}
+	if s, ok := v.(string); ok {
+		e.text = s
+		e.ChunkName, e.Line, e.Message = splitPosition(s)
+	} else if runtime {
+		e.Err = RuntimeError(l.describeErrorValue(v))
+	}
+	return e
+}
+
+// describeErrorValue returns the message of an error value that is not a
+// string, without calling any metamethods.
+func (l *State) describeErrorValue(v value) string {
+	if s, ok := toString(v); ok {
+		return s
+	}
+	name := l.valueToType(v).String()
+	if m := l.metaTableOf(v); m != nil {
+		if n, ok := m.atString("__name").(string); ok {
+			name = n
+		}
+	}
+	return "(error object is a " + name + " value)"
+}
+
+// splitPosition splits the position chunk:line: off the start of the first
+// line of msg.
+func splitPosition(msg string) (chunkName string, line int, message string) {
+	start := 0
+	if strings.HasPrefix(msg, `[string "`) {
+		if start = strings.Index(msg, `"]:`) + 2; start < 2 {
+			return "", 0, msg
+		}
+	}
+	for i := start; i < len(msg) && msg[i] != '\n'; i++ {
+		if msg[i] != ':' {
+			continue
+		}
+		j, n := i+1, 0
+		for ; j < len(msg) && '0' <= msg[j] && msg[j] <= '9' && n < 1e9; j++ {
+			n = n*10 + int(msg[j]-'0')
+		}
+		if j > i+1 && strings.HasPrefix(msg[j:], ": ") {
+			return msg[:i], n, msg[j+2:]
+		} else if start > 0 {
+			break
+		}
+	}
+	return "", 0, msg
+}
+
 // A Type is a symbolic representation of a Lua VM type.
 type Type int
 
@@ -106,6 +228,9 @@ const (
 	RegistryIndexGlobals
 )
 
+// HostSlotCount is the number of host slots, see SetHostSlot.
+const HostSlotCount = 16
+
 // Signature is the mark for precompiled code ('<esc>Lua').
 const Signature = "\033Lua"
 
@@ -245,16 +370,17 @@ type State struct {
 	stack                 []value
 	nonYieldableCallCount int
 	nestedGoCallCount     int
+	callDepthExceeded     bool // the error of SetCallDepthLimit is being handled
 	hookMask              byte
 	allowHook             bool
 	internalHook          bool
 	baseHookCount         int
 	hookCount             int
 	hooker                Hook
-	upValues              *openUpValue
+	upValues              *upValue // the open up values
 	errorFunction         int      // current error handling function (stack index)
 	baseCallInfo          callInfo // callInfo for first level (go calling lua)
-	protectFunction       func()
+	protected             bool     // a protected call or resume runs on this thread
 	status                threadStatus
 	caller                *State // the State that called Resume on this thread
 	tbcList               []int  // Lua 5.4: stack indices of to-be-closed variables
@@ -268,8 +394,32 @@ type globalState struct {
 	metaTables         [TypeCount]*table // metatables for basic types
 	registry           *table
 	panicFunction      Function // to be called in unprotected errors
+	panicPolicy        PanicPolicy
+	callDepthLimit     int
 	version            *float64 // pointer to version number
 	memoryErrorMessage string
+	fileOpener         FileOpener                 // nil means os.OpenFile, see SetFileOpener
+	stdin              io.Reader                  // nil means os.Stdin, see SetStdin
+	stdout, stderr     io.Writer                  // nil means os.Stdout and os.Stderr
+	patterns           patternCache               // compiled patterns of the string library
+	packProfile        *packProfile               // nil means the "lua" profile, see string.packprofile
+	patternStepLimit   int                        // see SetPatternStepLimit
+	unicodePatterns    bool                       // see SetUnicodePatterns
+	tableDepthLimit    int                        // 0 means maxTableDepth, see SetTableDepthLimit
+	sortedPairs        bool                       // see SetSortedPairs
+	crashDump          *crashDump                 // nil unless SetCrashDump is active
+	replayer           *replayer                  // nil unless Record or Replay was called
+	stringPool         *StringPool                // nil unless SetStringPool is active
+	clock              func() time.Time           // nil means time.Now, see SetClock
+	dateLocale         *DateLocale                // nil means CDateLocale, see SetDateLocale
+	customDateLocale   *DateLocale                // the last locale passed to SetDateLocale
+	hostSlots          [HostSlotCount]interface{} // see SetHostSlot
+	profiler           *profiler                  // nil unless StartProfile is active
+	tracer             *tracer                    // nil unless SetTraceWriter is active
+	callContext        context.Context            // nil outside of CallWithContext, see CallContext
+	numberFormat       NumberFormat               // see SetNumberFormat
+	tags               *stringTags                // nil until strings are tagged, see TagString
+	snapshot           *snapshot                  // nil until Snapshot, see Reset
 	// seed uint // randomized seed for hashes
 	// upValueHead upValue // head of double-linked list of all open upvalues
 }
@@ -392,7 +542,8 @@ func (l *State) CallWithContinuation(argCount, resultCount, context int, continu
 // gathered after the return of ProtectedCall, since by then, the stack has
 // unwound.
 //
-// The possible errors are the following:
+// The error is an *Error with the error value, whose Err is one of the
+// following:
 //
 //	RuntimeError  a runtime error
 //	MemoryError   allocating memory, the error handler is not called
@@ -429,7 +580,9 @@ func (l *State) ProtectedCallWithContinuation(argCount, resultCount, errorFuncti
 	f := l.top - (argCount + 1)
 
 	if continuation == nil || l.nonYieldableCallCount > 0 {
-		err = l.protectedCall(func() { l.call(f, resultCount, false) }, f, errorFunction)
+		if err = l.protectedCall(func() { l.call(f, resultCount, false) }, f, errorFunction); err != nil {
+			err = l.newError(err)
+		}
 	} else {
 		// Yieldable pcall: like C Lua's lua_pcallk, call directly without
 		// local error protection. Errors and yields propagate to Resume's
@@ -448,12 +601,16 @@ func (l *State) ProtectedCallWithContinuation(argCount, resultCount, errorFuncti
 
 // Load loads a Lua chunk, without running it. If there are no errors, it
 // pushes the compiled chunk as a Lua function on top of the stack.
-// Otherwise, it pushes an error message.
+// Otherwise, it pushes an error message and returns an *Error whose Err is
+// SyntaxError or MemoryError.
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_load
 func (l *State) Load(r io.Reader, chunkName string, mode string) error {
+	if c := l.global.crashDump; c != nil {
+		c.loaded(chunkName)
+	}
 	if err := protectedParser(l, r, chunkName, mode); err != nil {
-		return err
+		return l.newError(err)
 	}
 
 	if f := l.stack[l.top-1].(*luaClosure); f.upValueCount() == 1 {
@@ -466,7 +623,12 @@ func (l *State) Load(r io.Reader, chunkName string, mode string) error {
 // the top of the stack and produces a binary chunk that, if loaded again,
 // results in a function equivalent to the one dumped.
 //
-// http://www.lua.org/manual/5.3/manual.html#lua_dump
+// The chunk has the layout of luac 5.4, with variable-length sizes and
+// absolute line info, in the byte order of the machine, so that chunks
+// interoperate with the reference implementation on the same platform in
+// both directions. There is no other format to select.
+//
+// http://www.lua.org/manual/5.4/manual.html#lua_dump
 func (l *State) Dump(w io.Writer, strip ...bool) error {
 	l.checkElementCount(1)
 	s := len(strip) > 0 && strip[0]
@@ -482,7 +644,7 @@ func (l *State) Dump(w io.Writer, strip ...bool) error {
 func NewState() *State {
 	v := float64(VersionNumber)
 	l := &State{allowHook: true, error: nil, nonYieldableCallCount: 1}
-	g := &globalState{mainThread: l, registry: newTable(), version: &v, memoryErrorMessage: "not enough memory"}
+	g := &globalState{mainThread: l, registry: newTable(), version: &v, memoryErrorMessage: "not enough memory", callDepthLimit: noCallDepthLimit}
 	l.global = g
 	l.initializeStack()
 	g.registry.putAtInt(RegistryIndexMainThread, l)
@@ -493,11 +655,21 @@ func NewState() *State {
 
 // NewThread creates a new thread (coroutine), represented as a new State
 // sharing the global environment. The new thread is pushed on the stack of l.
+// Like in the reference implementation, it inherits the debug hook of l.
+//
+// Besides driving coroutines with Resume, a thread gives a call a stack of
+// its own: a host can run each request on a new thread with Call or
+// ProtectedCall, so that an error or a forgotten value leaves the stack of l
+// as it was. The thread stays alive while it is on a stack, in a table or
+// held by Go. Threads share the state, so only one of them runs at a time;
+// states for different goroutines are made with NewState.
 //
 // http://www.lua.org/manual/5.3/manual.html#lua_newthread
 func (l *State) NewThread() *State {
 	t := &State{allowHook: true, error: nil, nonYieldableCallCount: 0}
 	t.global = l.global
+	t.hooker, t.hookMask, t.baseHookCount, t.internalHook = l.hooker, l.hookMask, l.baseHookCount, l.internalHook
+	t.resetHookCount()
 	t.initializeStack()
 	l.apiPush(t)
 	return t
@@ -506,14 +678,25 @@ func (l *State) NewThread() *State {
 // XMove exchanges values between different threads of the same global state.
 // This function pops n values from the stack from, and pushes them onto the stack to.
 //
+// Between states created by separate calls to NewState, such as the states
+// of a host that runs one state per goroutine, XMove copies the values
+// instead, since a value of one state must not be used by another. Tables
+// are copied deeply, keeping shared and cyclic references, but without
+// their metatables; strings, numbers, booleans, light userdata and Go
+// functions without upvalues are moved as they are. Lua functions, Go
+// closures, full userdata and threads belong to their state: for them,
+// XMove raises an error in from and moves nothing. Neither state may run on
+// another goroutine during the copy.
+//
 // http://www.lua.org/manual/5.3/manual.html#lua_xmove
 func XMove(from, to *State, n int) {
 	if from == to {
 		return
 	}
 	from.checkElementCount(n)
-	if apiCheck && from.global != to.global {
-		panic("threads must share the same global state")
+	if from.global != to.global {
+		copyValues(from, to, n)
+		return
 	}
 	to.checkStack(n)
 	from.top -= n
@@ -521,6 +704,52 @@ func XMove(from, to *State, n int) {
 	to.top += n
 }
 
+// copyValues pops n values from the stack of from and pushes copies of them
+// onto the stack of to, which belongs to another state. The tags of the
+// strings are copied as well, see TagString.
+func copyValues(from, to *State, n int) {
+	copies := make(map[*table]*table)
+	values := make([]value, n)
+	for i, v := range from.stack[from.top-n : from.top] {
+		values[i] = from.copyValue(to, v, copies, 0)
+	}
+	from.top -= n
+	to.checkStack(n)
+	copy(to.stack[to.top:], values)
+	to.top += n
+}
+
+// copyValue returns a copy of v for the state to, with copies of the tables
+// already copied in copies.
+func (l *State) copyValue(to *State, v value, copies map[*table]*table, depth int) value {
+	switch v := v.(type) {
+	case string:
+		if t := l.global.tags; t != nil {
+			if tags := t.tags[v]; tags != nil {
+				to.stringTags().add(v, tags)
+			}
+		}
+	case *table:
+		if c, ok := copies[v]; ok {
+			return c
+		}
+		l.checkTableDepth(depth)
+		c := newTableWithSize(len(v.array), v.hash.count)
+		c.frozen = v.frozen
+		copies[v] = c
+		for i, x := range v.array {
+			c.array[i] = l.copyValue(to, x, copies, depth+1)
+		}
+		v.hash.each(func(k, x value) {
+			c.put(l, l.copyValue(to, k, copies, depth+1), l.copyValue(to, x, copies, depth+1))
+		})
+		return c
+	case *luaClosure, *goClosure, *userData, *State:
+		Errorf(l, "cannot move a %s to another state", l.valueToType(v).String())
+	}
+	return v
+}
+
 // Status returns the status of the thread l.
 //
 // http://www.lua.org/manual/5.3/manual.html#lua_status
@@ -626,13 +855,13 @@ func (l *State) Resume(from *State, nArgs int) (err error) {
 // resumeRun executes the resume logic in a protected context (defer/recover).
 func (l *State) resumeRun(nArgs int) (err error) {
 	func() {
-		// Set protectFunction so throw() panics on this coroutine
+		// Set protected so throw() panics on this coroutine
 		// instead of delegating to the main thread (which would lose
 		// the original Lua error value and corrupt the main stack).
-		savedProtect := l.protectFunction
-		l.protectFunction = func() {} // non-nil sentinel
+		savedProtected := l.protected
+		l.protected = true
 		defer func() {
-			l.protectFunction = savedProtect
+			l.protected = savedProtected
 			if r := recover(); r != nil {
 				if r == yieldError {
 					return // coroutine yielded successfully
@@ -818,6 +1047,7 @@ func (l *State) recoverFromError(status error) bool {
 	l.allowHook = ci.oldAllowHook
 	l.nonYieldableCallCount = 0
 	l.errorFunction = ci.oldErrorFunction
+	l.callDepthExceeded = false
 	return true
 }
 
@@ -841,6 +1071,29 @@ func apiCheckStackIndex(index int, v value) {
 	}
 }
 
+// stackIndexError panics with a message naming the API call and the index
+// it was given, so that misuse of the stack from Go is reported as such
+// rather than as a slice bounds error somewhere below.
+func (l *State) stackIndexError(call string, index int, problem string) {
+	panic(fmt.Sprintf("lua: %s(%d): %s (stack has %d elements)", call, index, problem, l.top-(l.callInfo.function+1)))
+}
+
+// checkStackIndex returns the stack position of index, which must refer to
+// an element of the current stack frame. The check is cheap, so unlike the
+// apiCheck assertions it is always done.
+func (l *State) checkStackIndex(call string, index int) int {
+	f := l.callInfo.function
+	switch n := l.top - (f + 1); {
+	case isPseudoIndex(index):
+		l.stackIndexError(call, index, "pseudo-index not allowed")
+	case index == 0 || index > n || -index > n:
+		l.stackIndexError(call, index, "index not in the stack")
+	case index < 0:
+		return l.top + index
+	}
+	return f + index
+}
+
 // SetField does the equivalent of table[key]=v where table is the value at
 // index and v is the value on top of the stack.
 //
@@ -926,16 +1179,16 @@ func (l *State) AbsIndex(index int) int {
 func (l *State) SetTop(index int) {
 	f := l.callInfo.function
 	if index >= 0 {
-		if apiCheck && index > l.stackLast-(f+1) {
-			panic("new top too large")
+		if index > l.stackLast-(f+1) {
+			l.stackIndexError("SetTop", index, "new top too large")
 		}
 		i := l.top
 		for l.top = f + 1 + index; i < l.top; i++ {
 			l.stack[i] = nil
 		}
 	} else {
-		if apiCheck && -(index+1) > l.top-(f+1) {
-			panic("invalid new top")
+		if -(index + 1) > l.top-(f+1) {
+			l.stackIndexError("SetTop", index, "invalid new top")
 		}
 		l.top += index + 1 // 'subtract' index (index is negative)
 	}
@@ -947,8 +1200,7 @@ func (l *State) SetTop(index int) {
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_remove
 func (l *State) Remove(index int) {
-	apiCheckStackIndex(index, l.indexToValue(index))
-	i := l.callInfo.function + l.AbsIndex(index)
+	i := l.checkStackIndex("Remove", index)
 	copy(l.stack[i:l.top-1], l.stack[i+1:l.top])
 	l.top--
 }
@@ -959,8 +1211,7 @@ func (l *State) Remove(index int) {
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_insert
 func (l *State) Insert(index int) {
-	apiCheckStackIndex(index, l.indexToValue(index))
-	i := l.callInfo.function + l.AbsIndex(index)
+	i := l.checkStackIndex("Insert", index)
 	copy(l.stack[i+1:l.top+1], l.stack[i:l.top])
 	l.stack[i] = l.stack[l.top]
 }
@@ -973,7 +1224,12 @@ func (l *State) move(dest int, src value) { l.setIndexToValue(dest, src) }
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_replace
 func (l *State) Replace(index int) {
-	l.checkElementCount(1)
+	if l.top-l.callInfo.function <= 1 {
+		l.stackIndexError("Replace", index, "no value on the stack to move")
+	}
+	if !isPseudoIndex(index) {
+		l.checkStackIndex("Replace", index)
+	}
 	l.move(index, l.stack[l.top-1])
 	l.top--
 }
@@ -981,6 +1237,9 @@ func (l *State) Replace(index int) {
 // CheckStack ensures that there are at least size free stack slots in the
 // stack. This call will not panic(), unlike the other Check*() functions.
 //
+// Growing the stack may move it, as may any call back into Lua. Go functions
+// refer to stack elements by index, which stays valid when that happens.
+//
 // http://www.lua.org/manual/5.2/manual.html#lua_checkstack
 func (l *State) CheckStack(size int) bool {
 	callInfo := l.callInfo
@@ -994,7 +1253,11 @@ func (l *State) CheckStack(size int) bool {
 	return ok
 }
 
-// AtPanic sets a new panic function and returns the old one.
+// AtPanic sets a new panic function and returns the old one. The panic
+// function is called with the error value on the top of the stack when an
+// error happens outside of any protected call. When it returns, the error
+// is handled according to the policy set with SetPanicPolicy; it may also
+// panic with a value of its own to leave the call.
 func AtPanic(l *State, panicFunction Function) Function {
 	panicFunction, l.global.panicFunction = l.global.panicFunction, panicFunction
 	return panicFunction
@@ -1445,15 +1708,7 @@ func (l *State) CreateTable(arrayCount, recordCount int) {
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_getmetatable
 func (l *State) MetaTable(index int) bool {
-	var mt *table
-	switch v := l.indexToValue(index).(type) {
-	case *table:
-		mt = v.metaTable
-	case *userData:
-		mt = v.metaTable
-	default:
-		mt = l.global.metaTable(v)
-	}
+	mt := l.metaTableOf(l.indexToValue(index))
 	if mt == nil {
 		return false
 	}
@@ -1507,6 +1762,7 @@ func (l *State) SetTable(index int) {
 func (l *State) RawSet(index int) {
 	l.checkElementCount(2)
 	t := l.indexToValue(index).(*table)
+	l.checkWritable(t)
 	t.put(l, l.stack[l.top-2], l.stack[l.top-1])
 	t.invalidateTagMethodCache()
 	l.top -= 2
@@ -1522,6 +1778,7 @@ func (l *State) RawSet(index int) {
 func (l *State) RawSetInt(index, key int) {
 	l.checkElementCount(1)
 	t := l.indexToValue(index).(*table)
+	l.checkWritable(t)
 	t.putAtInt(key, l.stack[l.top-1])
 	l.top--
 }
@@ -1554,6 +1811,7 @@ func (l *State) SetMetaTable(index int) {
 	}
 	switch v := l.indexToValue(index).(type) {
 	case *table:
+		l.checkWritable(v)
 		v.metaTable = mt
 	case *userData:
 		v.metaTable = mt
@@ -1772,6 +2030,14 @@ func UpValueJoin(l *State, f1, n1, f2, n2 int) {
 // Note that the code above is "balanced": at its end, the stack is back to
 // its original configuration. This is considered good programming practice.
 //
+// A Go function called from Lua may call back into Lua with Call or
+// ProtectedCall on the State it is passed, also from hooks and metamethods.
+// The nested call works on the stack of the Go function, whose indices stay
+// valid. An error in it unwinds the Go function like a panic, so that
+// deferred functions run; use ProtectedCall to handle it in Go instead. The
+// called function cannot yield, unless called with CallWithContinuation, and
+// nesting deeper than about 200 Go functions is a "stack overflow" error.
+//
 // http://www.lua.org/manual/5.2/manual.html#lua_call
 func (l *State) Call(argCount, resultCount int) {
 	l.CallWithContinuation(argCount, resultCount, 0, nil)
@@ -1857,10 +2123,10 @@ func (l *State) PushNumber(n float64) { l.apiPush(n) }
 // PushInteger pushes n onto the stack as a Lua integer.
 //
 // http://www.lua.org/manual/5.3/manual.html#lua_pushinteger
-func (l *State) PushInteger(n int) { l.apiPush(int64(n)) }
+func (l *State) PushInteger(n int) { l.apiPush(intValue(int64(n))) }
 
 // PushInteger64 pushes n onto the stack as a Lua integer.
-func (l *State) PushInteger64(n int64) { l.apiPush(n) }
+func (l *State) PushInteger64(n int64) { l.apiPush(intValue(n)) }
 
 // PushUnsigned pushes n onto the stack as a Lua integer.
 //
@@ -1892,7 +2158,12 @@ func (l *State) Length(index int) { l.apiPush(l.objectLength(l.indexToValue(inde
 // Pop pops n elements from the stack.
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_pop
-func (l *State) Pop(n int) { l.SetTop(-n - 1) }
+func (l *State) Pop(n int) {
+	if n < 0 || n > l.top-(l.callInfo.function+1) {
+		l.stackIndexError("Pop", n, "cannot pop that many elements")
+	}
+	l.top -= n
+}
 
 // NewTable creates a new empty table and pushes it onto the stack. It is
 // equivalent to l.CreateTable(0, 0).
@@ -1950,3 +2221,53 @@ func (l *State) IsNoneOrNil(index int) bool { return l.TypeOf(index) <= TypeNil
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_pushglobaltable
 func (l *State) PushGlobalTable() { l.RawGetInt(RegistryIndex, RegistryIndexGlobals) }
+
+// SetHostSlot stores v in the host slot with the given number, which must be
+// between 0 and HostSlotCount-1, and returns the previous value. Host slots
+// hold Go values that the host wants at hand in every callback, such as a
+// context, a logger or a service container. Unlike a value stored in the
+// registry under a string key, reading a slot with HostSlot costs an array
+// access and does not touch the Lua stack. The slots are shared by all
+// threads of l; the embedding program is responsible for assigning the slot
+// numbers.
+func SetHostSlot(l *State, slot int, v interface{}) interface{} {
+	checkHostSlot(slot)
+	prev := l.global.hostSlots[slot]
+	l.global.hostSlots[slot] = v
+	return prev
+}
+
+// HostSlot returns the value stored in a host slot by SetHostSlot, or nil.
+func HostSlot(l *State, slot int) interface{} {
+	checkHostSlot(slot)
+	return l.global.hostSlots[slot]
+}
+
+func checkHostSlot(slot int) {
+	if slot < 0 || slot >= HostSlotCount {
+		panic(fmt.Sprintf("lua: host slot %d out of range [0, %d)", slot, HostSlotCount))
+	}
+}
+
+// PushGoClosureWithData is like PushGoClosure, but the new closure also
+// carries data, which the function reads with ClosureData while it runs.
+// This attaches Go state to a callback directly, without wrapping it in a
+// userdata upvalue and fetching it from the stack on every call. The closure
+// is a Go closure even if upValueCount is 0.
+func PushGoClosureWithData(l *State, function Function, data interface{}, upValueCount uint8) {
+	n := int(upValueCount)
+	l.checkElementCount(n)
+	cl := &goClosure{function: function, upValues: make([]value, n), data: data}
+	l.top -= n
+	copy(cl.upValues, l.stack[l.top:l.top+n])
+	l.apiPush(cl)
+}
+
+// ClosureData returns the data of the running Go function, which was pushed
+// with PushGoClosureWithData, or nil if it has none.
+func ClosureData(l *State) interface{} {
+	if cl, ok := l.stack[l.callInfo.function].(*goClosure); ok {
+		return cl.data
+	}
+	return nil
+}
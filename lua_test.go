@@ -29,3 +29,231 @@ func TestToBooleanOutOfRange(t *testing.T) {
 		}
 	}
 }
+
+func TestStackIndexErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		f    func(l *State)
+		want string
+	}{
+		{"SetTop", func(l *State) { l.SetTop(-4) }, "lua: SetTop(-4): invalid new top (stack has 2 elements)"},
+		{"Pop", func(l *State) { l.Pop(3) }, "lua: Pop(3): cannot pop that many elements (stack has 2 elements)"},
+		{"Insert", func(l *State) { l.Insert(3) }, "lua: Insert(3): index not in the stack (stack has 2 elements)"},
+		{"Remove", func(l *State) { l.Remove(-3) }, "lua: Remove(-3): index not in the stack (stack has 2 elements)"},
+		{"RemoveZero", func(l *State) { l.Remove(0) }, "lua: Remove(0): index not in the stack (stack has 2 elements)"},
+		{"RemovePseudo", func(l *State) { l.Remove(RegistryIndex) }, fmt.Sprintf("lua: Remove(%d): pseudo-index not allowed (stack has 2 elements)", RegistryIndex)},
+		{"Replace", func(l *State) { l.Replace(5) }, "lua: Replace(5): index not in the stack (stack has 2 elements)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewState()
+			l.PushInteger(1)
+			l.PushInteger(2)
+			defer func() {
+				if r := recover(); r != tc.want {
+					t.Errorf("got panic %v, want %q", r, tc.want)
+				}
+			}()
+			tc.f(l)
+		})
+	}
+}
+
+func TestStackIndexValid(t *testing.T) {
+	l := NewState()
+	for i := 1; i <= 4; i++ {
+		l.PushInteger(i)
+	}
+	l.Insert(1)  // 4 1 2 3
+	l.Remove(-2) // 4 1 3
+	l.PushInteger(5)
+	l.Replace(2) // 4 5 3
+	l.Pop(1)     // 4 5
+	if l.Top() != 2 {
+		t.Fatalf("top is %d, want 2", l.Top())
+	}
+	for i, want := range []int{4, 5} {
+		if got, _ := l.ToInteger(i + 1); got != want {
+			t.Errorf("element %d is %d, want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestHostSlots(t *testing.T) {
+	type logger struct{ prefix string }
+	l := NewState()
+	OpenLibraries(l)
+	if prev := SetHostSlot(l, 3, &logger{"app"}); prev != nil {
+		t.Errorf("new slot holds %v", prev)
+	}
+	var seen []string
+	l.Register("log", func(l *State) int {
+		seen = append(seen, HostSlot(l, 3).(*logger).prefix+": "+CheckString(l, 1))
+		return 0
+	})
+	if err := DoString(l, `log("main"); coroutine.wrap(function() log("coroutine") end)()`); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[0] != "app: main" || seen[1] != "app: coroutine" {
+		t.Errorf("got %q", seen)
+	}
+	if prev := SetHostSlot(l, 3, nil); prev.(*logger).prefix != "app" || HostSlot(l, 3) != nil {
+		t.Error("slot not cleared")
+	}
+	defer func() {
+		if r := recover(); r != "lua: host slot 16 out of range [0, 16)" {
+			t.Errorf("got panic %v", r)
+		}
+	}()
+	HostSlot(l, HostSlotCount)
+}
+
+func TestClosureData(t *testing.T) {
+	type counter struct{ n int }
+	l := NewState()
+	OpenLibraries(l)
+	c := &counter{}
+	PushGoClosureWithData(l, func(l *State) int {
+		c := ClosureData(l).(*counter)
+		c.n += CheckInteger(l, 1)
+		l.PushInteger(c.n)
+		return 1
+	}, c, 0)
+	l.SetGlobal("add")
+	l.PushString("up")
+	PushGoClosureWithData(l, func(l *State) int {
+		l.PushString(ClosureData(l).(string))
+		l.PushValue(UpValueIndex(1))
+		return 2
+	}, "data", 1)
+	l.SetGlobal("both")
+	l.Register("none", func(l *State) int {
+		l.PushBoolean(ClosureData(l) == nil)
+		return 1
+	})
+	if err := DoString(l, `
+		assert(add(2) == 2 and add(3) == 5)
+		local d, u = both()
+		assert(d == "data" and u == "up")
+		assert(none())
+		assert(debug.getupvalue(both, 1) == "" and debug.getupvalue(add, 1) == nil)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 5 {
+		t.Errorf("counter is %d", c.n)
+	}
+}
+
+func BenchmarkHostSlot(b *testing.B) {
+	l := NewState()
+	SetHostSlot(l, 0, b)
+	for i := 0; i < b.N; i++ {
+		if HostSlot(l, 0) != b {
+			b.Fatal("wrong value")
+		}
+	}
+}
+
+func BenchmarkRegistryField(b *testing.B) {
+	l := NewState()
+	l.PushUserData(b)
+	l.SetField(RegistryIndex, "host.benchmark")
+	for i := 0; i < b.N; i++ {
+		l.Field(RegistryIndex, "host.benchmark")
+		if l.ToUserData(-1) != b {
+			b.Fatal("wrong value")
+		}
+		l.Pop(1)
+	}
+}
+
+func TestXMoveBetweenStates(t *testing.T) {
+	from, to := NewState(), NewState()
+	OpenLibraries(from)
+	OpenLibraries(to)
+	if err := DoString(from, `
+		local shared = {1, 2}
+		local t = {name = "x", list = shared, again = shared, [shared] = true, nested = {n = 1.5}}
+		t.self = t
+		return t, "s", 42, table.freeze({})
+	`); err != nil {
+		t.Fatal(err)
+	}
+	from.PushGoFunction(func(l *State) int { l.PushString("go"); return 1 })
+	from.PushString("s")
+	TagString(from, -1, "user-input")
+	from.PushString("x")
+	TagString(from, -1, "name")
+	from.Pop(2)
+	XMove(from, to, 5)
+	if from.Top() != 0 || to.Top() != 5 {
+		t.Fatalf("tops %d and %d", from.Top(), to.Top())
+	}
+	to.SetGlobal("f")
+	to.SetGlobal("frozen")
+	to.SetGlobal("n")
+	to.SetGlobal("s")
+	to.SetGlobal("t")
+	if err := DoString(to, `
+		assert(t.name == "x" and t.self == t and t.list == t.again and t[t.list])
+		assert(t.list[2] == 2 and t.nested.n == 1.5 and s == "s" and math.type(n) == "integer")
+		assert(not pcall(function() frozen.x = 1 end))
+		assert(f() == "go")
+	`); err != nil {
+		t.Fatal(err)
+	}
+	to.Global("s")
+	to.Global("t")
+	to.Field(-1, "name")
+	if tags, nameTags := StringTags(to, -3), StringTags(to, -1); len(tags) != 1 || tags[0] != "user-input" || len(nameTags) != 1 || nameTags[0] != "name" {
+		t.Errorf("moved strings tagged %v and %v", tags, nameTags)
+	}
+	to.SetTop(0)
+
+	// Values that belong to a state are not moved, nor is anything else.
+	from.PushInteger(1)
+	if err := DoString(from, `return {f = function() end}`); err != nil {
+		t.Fatal(err)
+	}
+	from.PushGoFunction(func(l *State) int {
+		XMove(l, to, 2)
+		return 0
+	})
+	from.Insert(1)
+	if err := from.ProtectedCall(2, 0, 0); err == nil || err.Error() != "runtime error: cannot move a function to another state" {
+		t.Errorf("got %v", err)
+	}
+	if to.Top() != 0 {
+		t.Errorf("moved %d values", to.Top())
+	}
+}
+
+func TestNewThread(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.PushString("below")
+	co := l.NewThread()
+	if l.TypeOf(-1) != TypeThread || !l.IsThread(-1) || l.ToThread(-1) != co || TypeNameOf(l, -1) != "thread" {
+		t.Fatal("the new thread is not on the stack")
+	}
+	if co.PushThread() || !l.PushThread() {
+		t.Error("PushThread does not tell the main thread")
+	}
+	l.Pop(2)
+
+	// The thread shares the globals, but has a stack of its own.
+	if err := DoString(co, `shared = "set by co" error("request failed")`); err == nil {
+		t.Fatal("no error")
+	}
+	l.Global("shared")
+	if s, _ := l.ToString(-1); s != "set by co" || l.Top() != 2 {
+		t.Errorf("got %q, top %d", s, l.Top())
+	}
+	if s, _ := l.ToString(1); s != "below" {
+		t.Errorf("the stack of l changed: %q", s)
+	}
+	co.SetTop(0)
+	if err := DoString(co, `return 1 + 1`); err != nil || co.Top() != 1 {
+		t.Errorf("got %v, top %d", err, co.Top())
+	}
+}
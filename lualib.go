@@ -0,0 +1,54 @@
+package lua
+
+import (
+	"bytes"
+	"embed"
+	"path"
+	"strings"
+)
+
+//go:generate go run lualib/gen.go
+
+// The libraries of the package that are written in Lua, compiled by go
+// generate from the sources in lualib. OpenLibraries preloads them, so that
+// require loads them without parsing.
+//
+//go:embed lualib/*.luac
+var luaLibraries embed.FS
+
+// ChunkLibrary returns a library that is opened by running a binary chunk,
+// as produced by Dump, for OpenLibraries or Require:
+//
+//	//go:embed mylib.luac
+//	var mylib []byte
+//
+//	lua.OpenLibraries(l, lua.ChunkLibrary("mylib", mylib))
+//
+// Compiling a library written in Lua at build time saves parsing it each
+// time a state opens it. The chunk is called like a Lua module loaded by
+// require, with the arguments of the open function, and its first result is
+// the module; the open function raises an error if the chunk cannot be
+// loaded.
+func ChunkLibrary(name string, chunk []byte) RegistryFunction {
+	return RegistryFunction{Name: name, Function: func(l *State) int {
+		n := l.Top()
+		if err := l.Load(bytes.NewReader(chunk), "="+name, "b"); err != nil {
+			l.Error()
+		}
+		l.Insert(1)
+		l.Call(n, 1)
+		return 1
+	}}
+}
+
+// preloadLuaLibraries adds the libraries written in Lua to the table on the
+// top of the stack, by module name.
+func preloadLuaLibraries(l *State) {
+	entries, _ := luaLibraries.ReadDir("lualib")
+	for _, e := range entries {
+		chunk, _ := luaLibraries.ReadFile("lualib/" + e.Name())
+		lib := ChunkLibrary(strings.TrimSuffix(e.Name(), path.Ext(e.Name())), chunk)
+		l.PushGoFunction(lib.Function)
+		l.SetField(-2, lib.Name)
+	}
+}
@@ -0,0 +1,106 @@
+-- compat: functions of Lua 5.1 and 5.2 that Lua 5.4 removed, for old scripts.
+--
+-- require("compat") sets the globals and library fields below that are
+-- missing, leaving those that exist alone, and returns a table of all of
+-- them.
+
+local compat = {}
+
+compat.unpack = table.unpack
+
+function compat.loadstring(s, chunkname)
+  return load(s, chunkname)
+end
+
+function compat.getn(t)
+  return #t
+end
+
+function compat.maxn(t)
+  local n = 0
+  for k in pairs(t) do
+    if math.type(k) and k > n then
+      n = k
+    end
+  end
+  return n
+end
+
+compat.mod = math.fmod
+compat.gfind = string.gmatch
+
+-- getfenv and setfenv find the _ENV upvalue of a function, or of the
+-- function at a level of the stack.
+
+local function envfunction(f, name)
+  if f == nil then
+    f = 1
+  end
+  if type(f) == "number" then
+    if f < 0 then
+      error("bad argument #1 to '" .. name .. "' (level must be non-negative)", 3)
+    elseif f == 0 then
+      return nil
+    end
+    local info = debug.getinfo(f + 2, "f")
+    if info == nil then
+      error("bad argument #1 to '" .. name .. "' (invalid level)", 3)
+    end
+    return info.func
+  end
+  if type(f) ~= "function" then
+    error("bad argument #1 to '" .. name .. "' (number expected, got " .. type(f) .. ")", 3)
+  end
+  return f
+end
+
+local function envupvalue(f)
+  local i = 1
+  while true do
+    local name = debug.getupvalue(f, i)
+    if name == nil then
+      return nil
+    elseif name == "_ENV" then
+      return i
+    end
+    i = i + 1
+  end
+end
+
+function compat.getfenv(f)
+  f = envfunction(f, "getfenv")
+  local i = f and envupvalue(f)
+  if i == nil then
+    return _G
+  end
+  local _, env = debug.getupvalue(f, i)
+  return env
+end
+
+function compat.setfenv(f, env)
+  if type(env) ~= "table" then
+    error("bad argument #2 to 'setfenv' (table expected, got " .. type(env) .. ")", 2)
+  end
+  f = envfunction(f, "setfenv")
+  local i = f and envupvalue(f)
+  if i == nil then
+    error("'setfenv' cannot change environment of given object", 2)
+  end
+  -- Give f an _ENV of its own, so that other functions sharing it keep theirs.
+  debug.upvaluejoin(f, i, function() return env end, 1)
+  return f
+end
+
+local fields = {
+  {_G, "unpack"}, {_G, "loadstring"}, {_G, "getfenv"}, {_G, "setfenv"},
+  {table, "getn"}, {table, "maxn"},
+  {math, "mod"}, {string, "gfind"},
+}
+for _, field in ipairs(fields) do
+  local t, name = field[1], field[2]
+  if t[name] == nil then
+    t[name] = compat[name]
+  end
+end
+
+return compat
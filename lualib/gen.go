@@ -0,0 +1,54 @@
+//go:build ignore
+
+// Command gen compiles the Lua libraries in this directory into the binary
+// chunks that the package embeds. It is run by go generate in the package
+// directory:
+//
+//	go generate
+//
+// Each file name.lua becomes name.luac, which OpenLibraries preloads as the
+// module name. The chunks keep their debug information, so that errors and
+// tracebacks name the lines of the sources.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("lualib/gen: ")
+	sources, err := filepath.Glob("lualib/*.lua")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, source := range sources {
+		if err := compile(source); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func compile(source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l := lua.NewState()
+	if err := l.Load(f, "@"+filepath.ToSlash(source), "t"); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := l.Dump(&b); err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	return os.WriteFile(strings.TrimSuffix(source, ".lua")+".luac", b.Bytes(), 0o644)
+}
@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompatLibrary(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		assert(unpack == nil and setfenv == nil)
+		local gmatch = string.gmatch
+		string.gfind = gmatch
+		local compat = require("compat")
+		assert(package.loaded.compat == compat)
+		assert(unpack == table.unpack and select("#", unpack({1, 2, 3})) == 3)
+		assert(loadstring("return 1 + 1")() == 2)
+		assert(table.getn({1, 2, 3}) == 3)
+		assert(table.maxn({1, 2, [10] = true, [2.5] = true, x = 1}) == 10)
+		assert(math.mod(7, 3) == 1)
+		assert(string.gfind == gmatch and compat.gfind == gmatch)
+
+		local function f() return x end
+		local function g() return x end
+		local env = {x = "mine"}
+		assert(setfenv(f, env) == f and getfenv(f) == env)
+		assert(f() == "mine" and g() == nil and getfenv(g) == _G)
+		assert(getfenv(0) == _G and getfenv(print) == _G)
+		local getfenv = getfenv
+		local function level() return getfenv(1), x end
+		setfenv(level, env)
+		assert(level() == env)
+		local ok, err = pcall(setfenv, print, env)
+		assert(not ok and err:match("cannot change environment"))
+		ok, err = pcall(getfenv, -1)
+		assert(not ok and err:match("level must be non%-negative"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLuaLibraryOverride(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"compat", func(l *State) int {
+		l.PushString("host")
+		return 1
+	}})
+	if err := DoString(l, `assert(require("compat") == "host")`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkLibrary(t *testing.T) {
+	l := NewState()
+	if err := l.Load(strings.NewReader(`local name = ... return {name = name, f = function() error("boom") end}`), "@mylib.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := l.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	l = NewState()
+	OpenLibraries(l, ChunkLibrary("mylib", b.Bytes()), ChunkLibrary("broken", []byte("\x1bLua")))
+	if err := DoString(l, `
+		local mylib = require("mylib")
+		assert(mylib.name == "mylib")
+		local ok, err = pcall(mylib.f)
+		assert(not ok and err == "mylib.lua:1: boom", err)
+		ok, err = pcall(require, "broken")
+		assert(not ok and err:match("broken"), err)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLuaLibrariesGenerated checks that the embedded chunks are those that
+// go generate makes from the sources.
+func TestLuaLibrariesGenerated(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the chunks are generated on a little-endian machine")
+	}
+	sources, err := filepath.Glob("lualib/*.lua")
+	if err != nil || len(sources) == 0 {
+		t.Fatal("no sources", err)
+	}
+	for _, source := range sources {
+		src, err := os.ReadFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := NewState()
+		if err := l.Load(bytes.NewReader(src), "@"+source, "t"); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := l.Dump(&b); err != nil {
+			t.Fatal(err)
+		}
+		chunk, err := luaLibraries.ReadFile(strings.TrimSuffix(source, ".lua") + ".luac")
+		if err != nil || !bytes.Equal(chunk, b.Bytes()) {
+			t.Errorf("%s: the chunk is out of date, run go generate", source)
+		}
+	}
+}
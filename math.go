@@ -1,8 +1,12 @@
 package lua
 
 import (
+	"encoding/binary"
+	"fmt"
 	"math"
 	"math/rand"
+	"sort"
+	"time"
 )
 
 const radiansPerDegree = math.Pi / 180.0
@@ -21,6 +25,151 @@ func mathBinaryOp(f func(float64, float64) float64) Function {
 	}
 }
 
+// pushIntegral pushes the integral float f as an integer if it fits, and as
+// a float otherwise.
+func pushIntegral(l *State, f float64) {
+	if i := int64(f); float64(i) == f && f >= float64(math.MinInt64) && f < -float64(math.MinInt64) {
+		l.PushInteger64(i)
+	} else {
+		l.PushNumber(f)
+	}
+}
+
+// roundingFunction creates a function that rounds its numeric argument with
+// f, preserving integers and returning an integer result when it fits.
+func roundingFunction(f func(float64) float64) Function {
+	return func(l *State) int {
+		if l.IsInteger(1) {
+			l.SetTop(1) // integers are already rounded
+		} else {
+			pushIntegral(l, f(CheckNumber(l, 1)))
+		}
+		return 1
+	}
+}
+
+// sequenceNumbers returns the numbers in the sequence at index, read with raw
+// access. allInt reports whether they are all integers.
+func sequenceNumbers(l *State, index int) (numbers []float64, integers []int64, allInt bool) {
+	CheckType(l, index, TypeTable)
+	n := l.RawLength(index)
+	numbers, allInt = make([]float64, n), true
+	for i := 1; i <= n; i++ {
+		l.RawGetInt(index, i)
+		switch t := l.TypeOf(-1); t {
+		case TypeNumber:
+			if allInt && l.IsInteger(-1) {
+				x, _ := l.ToInteger64(-1)
+				integers = append(integers, x)
+			} else {
+				allInt = false
+			}
+			numbers[i-1], _ = l.ToNumber(-1)
+		default:
+			ArgumentError(l, index, fmt.Sprintf("number expected at index %d, got %s", i, t))
+		}
+		l.Pop(1)
+	}
+	return
+}
+
+// sum adds numbers using Neumaier's variant of Kahan summation, which keeps
+// the rounding error independent of the length of the sequence.
+func sum(numbers []float64) float64 {
+	var s, c float64
+	for _, x := range numbers {
+		t := s + x
+		if math.Abs(s) >= math.Abs(x) {
+			c += (s - t) + x
+		} else {
+			c += (x - t) + s
+		}
+		s = t
+	}
+	return s + c
+}
+
+func mean(numbers []float64) float64 { return sum(numbers) / float64(len(numbers)) }
+
+var statisticsLibrary = []RegistryFunction{
+	{"sum", func(l *State) int {
+		// math.sum(t) returns an integer if all elements are integers
+		// (wrapping around on overflow) and a float otherwise.
+		numbers, integers, allInt := sequenceNumbers(l, 1)
+		if allInt {
+			var s int64
+			for _, x := range integers {
+				s += x
+			}
+			l.PushInteger64(s)
+		} else {
+			l.PushNumber(sum(numbers))
+		}
+		return 1
+	}},
+	{"mean", func(l *State) int {
+		numbers, _, _ := sequenceNumbers(l, 1)
+		l.PushNumber(mean(numbers))
+		return 1
+	}},
+	{"median", func(l *State) int {
+		numbers, _, _ := sequenceNumbers(l, 1)
+		sort.Float64s(numbers)
+		switch n := len(numbers); {
+		case n == 0:
+			l.PushNumber(math.NaN())
+		case n%2 == 1:
+			l.PushNumber(numbers[n/2])
+		default:
+			l.PushNumber(numbers[n/2-1]/2 + numbers[n/2]/2)
+		}
+		return 1
+	}},
+	{"stddev", func(l *State) int {
+		// math.stddev(t [, sample]) returns the population standard deviation,
+		// or the sample standard deviation if sample is true.
+		numbers, _, _ := sequenceNumbers(l, 1)
+		n := float64(len(numbers))
+		if l.ToBoolean(2) {
+			n--
+		}
+		m := mean(numbers)
+		squares := make([]float64, len(numbers))
+		for i, x := range numbers {
+			squares[i] = (x - m) * (x - m)
+		}
+		l.PushNumber(math.Sqrt(sum(squares) / n))
+		return 1
+	}},
+}
+
+// checkedOp creates a function that applies f to two integer arguments and
+// returns the wrapped result together with a flag telling whether the
+// operation overflowed.
+func checkedOp(f func(a, b int64) (int64, bool)) Function {
+	return func(l *State) int {
+		r, overflow := f(CheckInteger64(l, 1), CheckInteger64(l, 2))
+		l.PushInteger64(r)
+		l.PushBoolean(overflow)
+		return 2
+	}
+}
+
+func addOverflow(a, b int64) (int64, bool) {
+	r := a + b
+	return r, (a >= 0) == (b >= 0) && (r >= 0) != (a >= 0)
+}
+
+func subOverflow(a, b int64) (int64, bool) {
+	r := a - b
+	return r, (a >= 0) != (b >= 0) && (r >= 0) != (a >= 0)
+}
+
+func mulOverflow(a, b int64) (int64, bool) {
+	r := a * b
+	return r, a != 0 && (r/a != b || a == -1 && b == math.MinInt64)
+}
+
 // reduce creates a min/max function that preserves integer type in Lua 5.3
 func reduce(f func(float64, float64) float64, isMax bool) Function {
 	return func(l *State) int {
@@ -87,6 +236,7 @@ var mathLibrary = []RegistryFunction{
 		return 1
 	}},
 	{"acos", mathUnaryOp(math.Acos)},
+	{"addov", checkedOp(addOverflow)},
 	{"asin", mathUnaryOp(math.Asin)},
 	{"atan2", mathBinaryOp(math.Atan2)},
 	{"atan", func(l *State) int {
@@ -188,62 +338,22 @@ var mathLibrary = []RegistryFunction{
 		l.PushNumber(f)
 		return 2
 	}},
+	{"mulov", checkedOp(mulOverflow)},
+	{"nextafter", mathBinaryOp(math.Nextafter)},
 	{"pow", mathBinaryOp(math.Pow)},
 	{"rad", mathUnaryOp(func(x float64) float64 { return x * radiansPerDegree })},
-	{"random", func(l *State) int {
-		// Helper to get int64 argument
-		checkInt64 := func(index int) int64 {
-			i, ok := l.ToInteger64(index)
-			if !ok {
-				ArgumentError(l, index, "integer expected")
-			}
-			return i
-		}
-		// randRange returns a random int64 in [lo, u] inclusive
-		randRange := func(lo, u int64) int64 {
-			// Use uint64 arithmetic to avoid overflow
-			rangeLow := uint64(lo - math.MinInt64)
-			rangeHigh := uint64(u - math.MinInt64)
-			rangeSize := rangeHigh - rangeLow + 1
-			if rangeSize == 0 {
-				// Full 64-bit range (overflow to 0 means 2^64)
-				return int64(rand.Uint64())
-			}
-			// Unbiased: use rejection sampling for large ranges
-			r := rand.Uint64() % rangeSize
-			return int64(r+rangeLow) + math.MinInt64
-		}
-		switch l.Top() {
-		case 0: // no arguments - returns float in [0,1)
-			// Use exactly 53 bits of randomness, like C Lua 5.4
-			l.PushNumber(float64(rand.Int63()>>10) / float64(int64(1)<<53))
-		case 1: // upper limit only - returns integer in [1, u], or full-range for 0
-			u := checkInt64(1)
-			if u == 0 {
-				// Lua 5.4: random(0) returns a full-range random integer
-				l.PushInteger64(int64(rand.Uint64()))
-			} else {
-				ArgumentCheck(l, 1 <= u, 1, "interval is empty")
-				l.PushInteger64(randRange(1, u))
-			}
-		case 2: // lower and upper limits - returns integer in [lo, u]
-			lo := checkInt64(1)
-			u := checkInt64(2)
-			ArgumentCheck(l, lo <= u, 2, "interval is empty")
-			l.PushInteger64(randRange(lo, u))
-		default:
-			Errorf(l, "wrong number of arguments")
-		}
-		return 1
-	}},
-	{"randomseed", func(l *State) int {
-		rand.Seed(int64(CheckUnsigned(l, 1)))
-		rand.Float64() // discard first value to avoid undesirable correlations
-		return 0
+	{"round", func(l *State) int {
+		// math.round(x [, mode]) rounds halfway cases away from zero, or to
+		// the nearest even integer when mode is "even".
+		round := []func(float64) float64{math.Round, math.RoundToEven}
+		op := CheckOption(l, 2, "away", []string{"away", "even"})
+		l.SetTop(1)
+		return roundingFunction(round[op])(l)
 	}},
 	{"sinh", mathUnaryOp(math.Sinh)},
 	{"sin", mathUnaryOp(math.Sin)},
 	{"sqrt", mathUnaryOp(math.Sqrt)},
+	{"subov", checkedOp(subOverflow)},
 	{"tanh", mathUnaryOp(math.Tanh)},
 	{"tan", mathUnaryOp(math.Tan)},
 	// Lua 5.3: integer functions
@@ -288,6 +398,7 @@ var mathLibrary = []RegistryFunction{
 		}
 		return 1
 	}},
+	{"trunc", roundingFunction(math.Trunc)},
 	{"type", func(l *State) int {
 		CheckAny(l, 1)
 		// Check actual type, not convertible type (strings should return nil)
@@ -302,6 +413,14 @@ var mathLibrary = []RegistryFunction{
 		}
 		return 1
 	}},
+	{"ulp", mathUnaryOp(func(x float64) float64 {
+		// distance to the next float away from zero
+		x = math.Abs(x)
+		if x == math.MaxFloat64 {
+			return x - math.Nextafter(x, 0)
+		}
+		return math.Nextafter(x, math.Inf(1)) - x
+	})},
 	{"ult", func(l *State) int {
 		a, ok1 := l.ToInteger64(1)
 		b, ok2 := l.ToInteger64(2)
@@ -316,9 +435,145 @@ var mathLibrary = []RegistryFunction{
 	}},
 }
 
+// randomState is the state of the xoshiro256** generator behind math.random.
+// It is the same algorithm the reference implementation uses, so a given
+// seed produces the same sequence as in C Lua. Each math library instance
+// owns its own generator, stored as the first upvalue of the functions in
+// randomLibrary.
+type randomState [4]uint64
+
+const randomStateSize = 4 * 8 // length of the string returned by math.randomstate
+
+func rotl(x uint64, n uint) uint64 { return x<<n | x>>(64-n) }
+
+func (s *randomState) next() uint64 {
+	s0, s1, s2, s3 := s[0], s[1], s[2]^s[0], s[3]^s[1]
+	result := rotl(s1*5, 7) * 9
+	s[0] = s0 ^ s3
+	s[1] = s1 ^ s2
+	s[2] = s2 ^ s1<<17
+	s[3] = rotl(s3, 45)
+	return result
+}
+
+func (s *randomState) seed(n1, n2 uint64) {
+	*s = randomState{n1, 0xff, n2, 0} // avoid a zero state
+	for i := 0; i < 16; i++ {
+		s.next() // discard initial values to "spread" the seed
+	}
+}
+
+// project projects a random value into the interval [0, n], drawing new
+// values as needed so that the result is unbiased.
+func (s *randomState) project(ran, n uint64) uint64 {
+	if n&(n+1) == 0 { // is n + 1 a power of 2?
+		return ran & n
+	}
+	lim := n // compute the smallest 2^b - 1 not smaller than n
+	for shift := uint(1); shift < 64; shift <<= 1 {
+		lim |= lim >> shift
+	}
+	for ran &= lim; ran > n; ran &= lim {
+		ran = s.next()
+	}
+	return ran
+}
+
+func (s *randomState) bytes() string {
+	b := make([]byte, randomStateSize)
+	for i, x := range s {
+		binary.LittleEndian.PutUint64(b[8*i:], x)
+	}
+	return string(b)
+}
+
+func randomStateUpValue(l *State) *randomState {
+	return l.ToUserData(UpValueIndex(1)).(*randomState)
+}
+
+// randomSeed seeds the generator with time-dependent values and pushes the
+// two seeds used, so that the sequence can be reproduced later.
+func randomSeed(l *State, s *randomState) {
+	n1, n2 := time.Now().UnixNano(), rand.Int63()
+	s.seed(uint64(n1), uint64(n2))
+	l.PushInteger64(n1)
+	l.PushInteger64(n2)
+}
+
+// seedArgument returns the seed at index. Floats are accepted and converted
+// by their bit pattern when they have no integer representation.
+func seedArgument(l *State, index int) uint64 {
+	if i, ok := l.ToInteger64(index); ok {
+		return uint64(i)
+	}
+	return math.Float64bits(CheckNumber(l, index))
+}
+
+var randomLibrary = []RegistryFunction{
+	{"random", func(l *State) int {
+		s := randomStateUpValue(l)
+		rv := s.next()
+		var lo, up int64
+		switch l.Top() {
+		case 0: // no arguments - returns float in [0,1)
+			l.PushNumber(float64(rv>>11) * (0.5 / (1 << 52)))
+			return 1
+		case 1: // upper limit only - returns integer in [1, u], or full-range for 0
+			lo, up = 1, CheckInteger64(l, 1)
+			if up == 0 {
+				l.PushInteger64(int64(rv))
+				return 1
+			}
+		case 2: // lower and upper limits - returns integer in [lo, u]
+			lo, up = CheckInteger64(l, 1), CheckInteger64(l, 2)
+		default:
+			Errorf(l, "wrong number of arguments")
+		}
+		ArgumentCheck(l, lo <= up, 1, "interval is empty")
+		l.PushInteger64(int64(s.project(rv, uint64(up)-uint64(lo)) + uint64(lo)))
+		return 1
+	}},
+	{"randomseed", func(l *State) int {
+		s := randomStateUpValue(l)
+		if l.IsNone(1) {
+			randomSeed(l, s)
+		} else {
+			n1 := seedArgument(l, 1)
+			var n2 uint64
+			if !l.IsNoneOrNil(2) {
+				n2 = seedArgument(l, 2)
+			}
+			s.seed(n1, n2)
+			l.PushInteger64(int64(n1))
+			l.PushInteger64(int64(n2))
+		}
+		return 2
+	}},
+	{"randomstate", func(l *State) int {
+		// Returns the current state as an opaque string. If a string from an
+		// earlier call is given, the generator is restored to that state.
+		s := randomStateUpValue(l)
+		l.PushString(s.bytes())
+		if !l.IsNoneOrNil(1) {
+			b := CheckString(l, 1)
+			ArgumentCheck(l, len(b) == randomStateSize, 1, "invalid random state")
+			for i := range s {
+				s[i] = binary.LittleEndian.Uint64([]byte(b[8*i:]))
+			}
+		}
+		return 1
+	}},
+}
+
 // MathOpen opens the math library. Usually passed to Require.
 func MathOpen(l *State) int {
 	NewLibrary(l, mathLibrary)
+	s := new(randomState)
+	l.PushUserData(s)
+	SetFunctions(l, randomLibrary, 1)
+	SetFunctions(l, statisticsLibrary, 0)
+	randomSeed(l, s)
+	l.Pop(2)
 	l.PushNumber(3.1415926535897932384626433832795) // TODO use math.Pi instead? Values differ.
 	l.SetField(-2, "pi")
 	l.PushNumber(math.Inf(1)) // Lua defines math.huge as infinity
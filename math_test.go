@@ -0,0 +1,117 @@
+package lua
+
+import "testing"
+
+func TestMathRandomState(t *testing.T) {
+	testString(t, `
+		math.randomseed(42)
+		local saved = math.randomstate()
+		assert(type(saved) == "string" and #saved == 32)
+		local a = {math.random(0), math.random(), math.random(1, 100)}
+		assert(math.randomstate(saved) ~= saved) -- returns the state being replaced
+		local b = {math.random(0), math.random(), math.random(1, 100)}
+		for i = 1, #a do assert(a[i] == b[i]) end
+		assert(not pcall(math.randomstate, "short"))
+	`)
+
+	// Each State has its own generator.
+	l1, l2 := NewState(), NewState()
+	OpenLibraries(l1)
+	OpenLibraries(l2)
+	for _, step := range []struct {
+		l    *State
+		code string
+	}{
+		{l1, "math.randomseed(7)"},
+		{l2, "math.randomseed(7)"},
+		{l1, "x = math.random(0)"},
+		{l1, "math.random(0)"},
+		{l2, "x = math.random(0)"},
+	} {
+		if err := DoString(step.l, step.code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []*State{l1, l2} {
+		l.Global("x")
+	}
+	x1, _ := l1.ToInteger64(-1)
+	x2, _ := l2.ToInteger64(-1)
+	if x1 != x2 {
+		t.Errorf("same seed produced %d and %d", x1, x2)
+	}
+}
+
+func TestMathCheckedArithmetic(t *testing.T) {
+	testString(t, `
+		local maxi, mini = math.maxinteger, math.mininteger
+		local function check(f, a, b, r, ov)
+			local x, o = f(a, b)
+			assert(math.type(x) == "integer" and x == r and o == ov)
+		end
+		check(math.addov, 1, 2, 3, false)
+		check(math.addov, maxi, 1, mini, true)
+		check(math.addov, mini, -1, maxi, true)
+		check(math.addov, maxi, mini, -1, false)
+		check(math.subov, 5, 7, -2, false)
+		check(math.subov, mini, 1, maxi, true)
+		check(math.subov, 0, mini, mini, true)
+		check(math.subov, -1, mini, maxi, false)
+		check(math.mulov, 6, 7, 42, false)
+		check(math.mulov, maxi, 2, -2, true)
+		check(math.mulov, mini, -1, mini, true)
+		check(math.mulov, -1, mini, mini, true)
+		check(math.mulov, 0, mini, 0, false)
+		check(math.mulov, 1 << 31, 1 << 31, 1 << 62, false)
+		check(math.mulov, 3.0, 4, 12, false)
+		assert(not pcall(math.addov, 1.5, 1))
+	`)
+}
+
+func TestMathRounding(t *testing.T) {
+	testString(t, `
+		local function same(a, b) return a == b and math.type(a) == math.type(b) end
+		assert(same(math.round(2.5), 3))
+		assert(same(math.round(-2.5), -3))
+		assert(same(math.round(-2.4), -2))
+		assert(same(math.round(2.5, "even"), 2))
+		assert(same(math.round(3.5, "even"), 4))
+		assert(same(math.round(-0.5, "even"), 0))
+		assert(same(math.round(7), 7))
+		assert(same(math.round(2^70), 2^70))
+		assert(math.round(1/0) == 1/0)
+		assert(not pcall(math.round, 1.5, "up"))
+		assert(same(math.trunc(-3.7), -3))
+		assert(same(math.trunc(3.7), 3))
+		assert(same(math.trunc(-5), -5))
+		assert(same(math.trunc(-2^63), math.mininteger))
+		assert(same(math.trunc(2^63), 2^63))
+		assert(math.ulp(1.0) == 2^-52)
+		assert(math.ulp(-1.0) == 2^-52)
+		assert(math.ulp(0) == 2^-1074)
+		assert(math.nextafter(1.0, 2) == 1 + 2^-52)
+		assert(math.nextafter(1.0, 0) == 1 - 2^-53)
+		assert(math.nextafter(0, -1) == -2^-1074)
+	`)
+}
+
+func TestMathStatistics(t *testing.T) {
+	testString(t, `
+		assert(math.sum({}) == 0 and math.type(math.sum({})) == "integer")
+		assert(math.sum({1, 2, 3}) == 6 and math.type(math.sum({1, 2, 3})) == "integer")
+		assert(math.sum({1, 2.5}) == 3.5)
+		local t = {1.0}
+		for i = 2, 10001 do t[i] = 1e-16 end
+		assert(math.sum(t) == 1 + 1e-12) -- naive summation returns 1.0
+		assert(math.sum({1e100, 1.0, -1e100}) == 1.0)
+		assert(math.mean({1, 2, 3, 4}) == 2.5)
+		assert(math.median({5, 1, 3}) == 3)
+		assert(math.median({4, 1, 3, 2}) == 2.5)
+		local m = math.median({})
+		assert(m ~= m)
+		assert(math.stddev({2, 4, 4, 4, 5, 5, 7, 9}) == 2)
+		assert(math.abs(math.stddev({2, 4, 4, 4, 5, 5, 7, 9}, true) - 2.1380899352994) < 1e-12)
+		local ok, msg = pcall(math.sum, {1, "2"})
+		assert(not ok and msg:find("number expected at index 2, got string"))
+	`)
+}
@@ -0,0 +1,199 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"unsafe"
+)
+
+const mappingHandle = "MMAP*"
+
+// A mapping is a read-only view of the contents of a file. Where the
+// platform supports it the file is mapped into memory, so only the pages
+// that are touched are read.
+type mapping struct {
+	data   []byte
+	unmap  func([]byte) error // nil if data is an ordinary slice
+	closed bool
+}
+
+func (m *mapping) close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	data := m.data
+	m.data = nil
+	if m.unmap != nil && data != nil {
+		return m.unmap(data)
+	}
+	return nil
+}
+
+// string returns the contents without copying them. Strings derived from
+// the result must be copied before they outlive the current call.
+func (m *mapping) string() string {
+	return unsafe.String(unsafe.SliceData(m.data), len(m.data))
+}
+
+func openMapping(l *State, name string) (*mapping, error) {
+	f, err := openFile(l, name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if osFile, ok := f.(*os.File); ok {
+		return mapFile(osFile)
+	}
+	return readMapping(f)
+}
+
+// readMapping is the fallback for files that cannot be mapped: the contents
+// are read into memory.
+func readMapping(r io.Reader) (*mapping, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &mapping{data: data}, nil
+}
+
+func toMapping(l *State) *mapping {
+	m := CheckUserData(l, 1, mappingHandle).(*mapping)
+	if m.closed {
+		Errorf(l, "attempt to use a closed mapping")
+	}
+	return m
+}
+
+// unpackData returns the data argument of string.unpack, which is either a
+// string or a mapping. If it is a mapping, strings taken from the data must
+// be copied before they are pushed.
+func unpackData(l *State, index int) (data string, mapped bool) {
+	if m, ok := l.ToUserData(index).(*mapping); ok {
+		if m.closed {
+			Errorf(l, "attempt to use a closed mapping")
+		}
+		return m.string(), true
+	}
+	return CheckString(l, index), false
+}
+
+var mappingMethods = []RegistryFunction{
+	{"byte", func(l *State) int {
+		m := toMapping(l)
+		i := OptInteger64(l, 2, 1)
+		start64, end := startPosition(i, len(m.data)), endPosition(OptInteger64(l, 3, i), len(m.data))
+		if start64 > int64(end) {
+			return 0
+		}
+		start := int(start64)
+		CheckStackWithMessage(l, end-start+1, "string slice too long")
+		for _, c := range m.data[start-1 : end] {
+			l.PushInteger(int(c))
+		}
+		return end - start + 1
+	}},
+	{"close", func(l *State) int {
+		return FileResult(l, toMapping(l).close(), "")
+	}},
+	{"find", func(l *State) int {
+		// m:find(s [, init]) searches for the plain string s.
+		m := toMapping(l)
+		s := CheckString(l, 2)
+		init64 := startPosition(OptInteger64(l, 3, 1), len(m.data))
+		if init64 > int64(len(m.data))+1 {
+			l.PushNil()
+			return 1
+		}
+		init := int(init64)
+		if i := bytes.Index(m.data[init-1:], []byte(s)); i >= 0 {
+			l.PushInteger(init + i)
+			l.PushInteger(init + i + len(s) - 1)
+			return 2
+		}
+		l.PushNil()
+		return 1
+	}},
+	{"len", func(l *State) int {
+		l.PushInteger(len(toMapping(l).data))
+		return 1
+	}},
+	{"sub", func(l *State) int {
+		m := toMapping(l)
+		start, end := startPosition(CheckInteger64(l, 2), len(m.data)), endPosition(OptInteger64(l, 3, -1), len(m.data))
+		if start <= int64(end) {
+			l.PushString(string(m.data[start-1 : end]))
+		} else {
+			l.PushString("")
+		}
+		return 1
+	}},
+	{"unpack", func(l *State) int {
+		// m:unpack(fmt [, pos]) is string.unpack(fmt, m [, pos]).
+		toMapping(l)
+		l.PushValue(2)
+		l.Insert(1)
+		l.Remove(3)
+		return stringUnpack(l)
+	}},
+	{"__close", func(l *State) int {
+		CheckUserData(l, 1, mappingHandle).(*mapping).close()
+		return 0
+	}},
+	{"__len", func(l *State) int {
+		l.PushInteger(len(toMapping(l).data))
+		return 1
+	}},
+	{"__tostring", func(l *State) int {
+		if m := CheckUserData(l, 1, mappingHandle).(*mapping); m.closed {
+			l.PushString("mapping (closed)")
+		} else {
+			l.PushString(fmt.Sprintf("mapping (%p)", m))
+		}
+		return 1
+	}},
+}
+
+var mmapLibrary = []RegistryFunction{
+	{"open", func(l *State) int {
+		// mmap.open(name) returns a read-only view of the file, or nil and
+		// an error message.
+		name := CheckString(l, 1)
+		m, err := openMapping(l, name)
+		if err != nil {
+			return FileResult(l, err, name)
+		}
+		runtime.SetFinalizer(m, (*mapping).close)
+		l.PushUserData(m)
+		SetMetaTableNamed(l, mappingHandle)
+		return 1
+	}},
+}
+
+// MmapOpen opens the mmap library. It is not opened by OpenLibraries; pass
+// it as a preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "mmap", Function: lua.MmapOpen})
+//
+// mmap.open returns a mapping with the methods byte, find, sub, unpack,
+// len and close. A mapping can also be passed to string.unpack in place of
+// the data string, so large binary files can be parsed without reading them
+// into a Lua string. Files are opened through the FileOpener of the state;
+// files that are not *os.File, and all files on Windows, are read into
+// memory instead of being mapped.
+func MmapOpen(l *State) int {
+	NewMetaTable(l, mappingHandle)
+	l.PushValue(-1)
+	l.SetField(-2, "__index")
+	SetFunctions(l, mappingMethods, 0)
+	l.Pop(1)
+	NewLibrary(l, mmapLibrary)
+	return 1
+}
@@ -0,0 +1,51 @@
+//go:build !lua_noos
+// +build !lua_noos
+
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmap(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(name, []byte("\x01\x00\x02\x00hello\x00tail"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"mmap", MmapOpen})
+	l.PushString(dir)
+	l.SetGlobal("dir")
+	if err := DoString(l, `
+		local mmap = require("mmap")
+		local m = assert(mmap.open(dir .. "/data.bin"))
+		assert(#m == 14 and m:len() == 14)
+		assert(m:sub(5, 9) == "hello" and m:sub(-4) == "tail")
+		assert(m:byte(1) == 1 and select("#", m:byte(1, -1)) == 14)
+		assert(m:find("tail") == 11 and m:find("nope") == nil)
+		local a, b, s, pos = string.unpack("<i2 i2 z", m)
+		assert(a == 1 and b == 2 and s == "hello" and pos == 11)
+		assert(m:unpack("c4", pos) == "tail")
+		assert(tostring(m):find("^mapping"))
+		assert(m:close())
+		assert(tostring(m) == "mapping (closed)")
+		assert(not pcall(m.sub, m, 1))
+		assert(not pcall(string.unpack, "b", m))
+		assert(s == "hello")
+
+		do
+			local e <close> = assert(mmap.open(dir .. "/empty"))
+			assert(#e == 0 and e:sub(1) == "")
+		end
+		local ok, err = mmap.open(dir .. "/missing")
+		assert(ok == nil and err:find("missing"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
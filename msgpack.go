@@ -0,0 +1,298 @@
+package lua
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sort"
+)
+
+// msgpackEncoder writes values in the MessagePack format.
+type msgpackEncoder struct {
+	l *State
+	b []byte
+}
+
+// header writes the length n of a string, array or map in the fix format
+// small, if given, or the 16-bit format code or the 32-bit one after it.
+func (e *msgpackEncoder) header(small, code byte, n int) {
+	switch {
+	case n < 16 && small != 0:
+		e.b = append(e.b, small|byte(n))
+	case n <= math.MaxUint16:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, code), uint16(n))
+	default:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, code+1), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) integer(i int64) {
+	switch {
+	case -32 <= i && i <= math.MaxInt8:
+		e.b = append(e.b, byte(i))
+	case 0 <= i && i <= math.MaxUint8:
+		e.b = append(e.b, 0xcc, byte(i))
+	case 0 <= i && i <= math.MaxUint16:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, 0xcd), uint16(i))
+	case 0 <= i && i <= math.MaxUint32:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, 0xce), uint32(i))
+	case 0 <= i:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, 0xcf), uint64(i))
+	case math.MinInt8 <= i:
+		e.b = append(e.b, 0xd0, byte(i))
+	case math.MinInt16 <= i:
+		e.b = binary.BigEndian.AppendUint16(append(e.b, 0xd1), uint16(i))
+	case math.MinInt32 <= i:
+		e.b = binary.BigEndian.AppendUint32(append(e.b, 0xd2), uint32(i))
+	default:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, 0xd3), uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) value(v value, depth int) {
+	switch v := v.(type) {
+	case nil:
+		e.b = append(e.b, 0xc0)
+	case bool:
+		if v {
+			e.b = append(e.b, 0xc3)
+		} else {
+			e.b = append(e.b, 0xc2)
+		}
+	case int64:
+		e.integer(v)
+	case float64:
+		e.b = binary.BigEndian.AppendUint64(append(e.b, 0xcb), math.Float64bits(v))
+	case string:
+		if len(v) < 32 {
+			e.b = append(e.b, 0xa0|byte(len(v)))
+		} else if len(v) <= math.MaxUint8 {
+			e.b = append(e.b, 0xd9, byte(len(v)))
+		} else {
+			e.header(0, 0xda, len(v))
+		}
+		e.b = append(e.b, v...)
+	case *table:
+		e.l.checkTableDepth(depth + 1)
+		e.table(v, depth+1)
+	default:
+		if v == nullSentinel {
+			e.b = append(e.b, 0xc0)
+			return
+		}
+		Errorf(e.l, "cannot encode a %s", e.l.valueToType(v).String())
+	}
+}
+
+// table writes t as an array if its keys are 1 to n, the empty table
+// included, and otherwise as a map with the keys in a fixed order.
+func (e *msgpackEncoder) table(t *table, depth int) {
+	var keys []value
+	t.hash.each(func(k, _ value) { keys = append(keys, k) })
+	n := len(t.array)
+	for n > 0 && t.array[n-1] == nil {
+		n--
+	}
+	isArray := true
+	for _, v := range t.array[:n] {
+		isArray = isArray && v != nil
+	}
+	total := n + len(keys)
+	for _, k := range keys {
+		i := arrayIndex(k)
+		isArray = isArray && n < i && i <= total
+	}
+	n = total
+	if isArray {
+		e.header(0x90, 0xdc, n)
+		for i := 1; i <= n; i++ {
+			e.value(t.atInt(i), depth)
+		}
+		return
+	}
+	keys = keys[:0]
+	for i, v := range t.array {
+		if v != nil {
+			keys = append(keys, int64(i+1))
+		}
+	}
+	t.hash.each(func(k, _ value) { keys = append(keys, k) })
+	sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+	e.header(0x80, 0xde, len(keys))
+	for _, k := range keys {
+		e.value(k, depth)
+		e.value(t.at(k), depth)
+	}
+}
+
+// msgpackDecoder reads values in the MessagePack format.
+type msgpackDecoder struct {
+	l   *State
+	s   string
+	pos int
+}
+
+func (d *msgpackDecoder) bytes(n int) string {
+	if n < 0 || n > len(d.s)-d.pos {
+		Errorf(d.l, "truncated data at position %d", d.pos+1)
+	}
+	b := d.s[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *msgpackDecoder) uint(n int) uint64 {
+	b := d.bytes(n)
+	var x uint64
+	for i := 0; i < n; i++ {
+		x = x<<8 | uint64(b[i])
+	}
+	return x
+}
+
+// length reads a length of n bytes, of elements that take at least one
+// byte each.
+func (d *msgpackDecoder) length(n int) int {
+	x := d.uint(n)
+	if x > uint64(len(d.s)-d.pos) {
+		Errorf(d.l, "truncated data at position %d", d.pos+1)
+	}
+	return int(x)
+}
+
+// value reads a value; nil stands for itself at the top level and for
+// msgpack.null in arrays and maps.
+func (d *msgpackDecoder) value(depth int) value {
+	start := d.pos
+	c := d.bytes(1)[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c)
+	case c >= 0xe0:
+		return int64(int8(c))
+	case c&0xf0 == 0x80:
+		return d.table(depth, 0, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return d.table(depth, int(c&0x0f), 0)
+	case c&0xe0 == 0xa0:
+		return d.bytes(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		if depth > 0 {
+			return nullSentinel
+		}
+		return nil
+	case 0xc2:
+		return false
+	case 0xc3:
+		return true
+	case 0xc4, 0xd9:
+		return d.bytes(d.length(1))
+	case 0xc5, 0xda:
+		return d.bytes(d.length(2))
+	case 0xc6, 0xdb:
+		return d.bytes(d.length(4))
+	case 0xca:
+		return float64(math.Float32frombits(uint32(d.uint(4))))
+	case 0xcb:
+		return math.Float64frombits(d.uint(8))
+	case 0xcc:
+		return int64(d.uint(1))
+	case 0xcd:
+		return int64(d.uint(2))
+	case 0xce:
+		return int64(d.uint(4))
+	case 0xcf:
+		x := d.uint(8)
+		if x > math.MaxInt64 {
+			return float64(x)
+		}
+		return int64(x)
+	case 0xd0:
+		return int64(int8(d.uint(1)))
+	case 0xd1:
+		return int64(int16(d.uint(2)))
+	case 0xd2:
+		return int64(int32(d.uint(4)))
+	case 0xd3:
+		return int64(d.uint(8))
+	case 0xdc:
+		return d.table(depth, d.length(2), 0)
+	case 0xdd:
+		return d.table(depth, d.length(4), 0)
+	case 0xde:
+		return d.table(depth, 0, d.length(2))
+	case 0xdf:
+		return d.table(depth, 0, d.length(4))
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		Errorf(d.l, "unsupported extension type at position %d", start+1)
+	}
+	Errorf(d.l, "invalid byte 0x%s at position %d", hex.EncodeToString([]byte{c}), start+1)
+	return nil
+}
+
+// table reads an array of n elements or a map of m pairs.
+func (d *msgpackDecoder) table(depth, n, m int) value {
+	d.l.checkTableDepth(depth + 1)
+	t := newTableWithSize(n, m)
+	for i := 1; i <= n; i++ {
+		t.put(d.l, int64(i), d.value(depth+1))
+	}
+	for ; m > 0; m-- {
+		start := d.pos
+		k := d.value(depth + 1)
+		if f, ok := k.(float64); k == nullSentinel || ok && math.IsNaN(f) {
+			Errorf(d.l, "invalid map key at position %d", start+1)
+		}
+		t.put(d.l, k, d.value(depth+1))
+	}
+	return t
+}
+
+var msgpackLibrary = []RegistryFunction{
+	{"encode", func(l *State) int {
+		CheckAny(l, 1)
+		e := &msgpackEncoder{l: l}
+		e.value(l.indexToValue(1), 0)
+		l.PushString(string(e.b))
+		return 1
+	}},
+	{"decode", func(l *State) int {
+		s := CheckString(l, 1)
+		init := startPosition(OptInteger64(l, 2, 1), len(s))
+		ArgumentCheck(l, 1 <= init && init <= int64(len(s)), 2, "initial position out of string")
+		d := &msgpackDecoder{l: l, s: s, pos: int(init) - 1}
+		l.apiPush(d.value(0))
+		l.PushInteger(d.pos + 1)
+		return 2
+	}},
+}
+
+// MsgPackOpen opens the msgpack library, which encodes Lua values to
+// MessagePack and decodes them. It is not opened by OpenLibraries; pass it
+// as a preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "msgpack", Function: lua.MsgPackOpen})
+//
+// msgpack.encode(v) returns v encoded as a string. Integers and floats keep
+// their subtype: integers take the smallest integer format and floats are
+// written as 64-bit floats, even when they have an integral value. Strings
+// are written in the str format. A table is an array if its keys are 1 to
+// n, and a map otherwise, with the keys in a fixed order; msgpack.null, the
+// same value as json.null, stands for nil in both. Functions, userdata and
+// threads cannot be encoded.
+//
+// msgpack.decode(s [, init]) decodes the value that starts at position init
+// of s, 1 by default, and returns it and the position after it, so that a
+// stream of values can be decoded one by one. Both str and bin become
+// strings, unsigned integers beyond math.maxinteger become floats, and nil
+// in an array or map becomes msgpack.null. Extension types are not
+// supported. Tables nested beyond SetTableDepthLimit are an error both
+// ways.
+func MsgPackOpen(l *State) int {
+	NewLibrary(l, msgpackLibrary)
+	l.PushLightUserData(nullSentinel)
+	l.SetField(-2, "null")
+	return 1
+}
@@ -0,0 +1,71 @@
+package lua
+
+import "testing"
+
+func TestMsgPack(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"msgpack", MsgPackOpen}, RegistryFunction{"json", JSONOpen})
+	if err := DoString(l, `
+		local mp = require("msgpack")
+		local function hex(s) return (s:gsub(".", function(c) return string.format("%02x", c:byte()) end)) end
+		local cases = {
+			{nil, "c0"}, {false, "c2"}, {true, "c3"},
+			{0, "00"}, {127, "7f"}, {-1, "ff"}, {-32, "e0"}, {-33, "d0df"},
+			{128, "cc80"}, {256, "cd0100"}, {65536, "ce00010000"}, {2^32 | 0, "cf0000000100000000"},
+			{-129, "d1ff7f"}, {-32769, "d2ffff7fff"}, {math.mininteger, "d38000000000000000"},
+			{1.0, "cb3ff0000000000000"}, {1.5, "cb3ff8000000000000"},
+			{"", "a0"}, {"abc", "a3616263"}, {string.rep("x", 32), "d920" .. string.rep("78", 32)},
+			{{}, "90"}, {{1, 2}, "920102"}, {{a = 1}, "81a16101"}, {{[2] = 1}, "810201"},
+			{{1, mp.null, 3}, "9301c003"},
+		}
+		for _, c in ipairs(cases) do
+			local s = mp.encode(c[1])
+			assert(hex(s) == c[2], tostring(c[1]) .. " encoded as " .. hex(s))
+			local v, next = mp.decode(s)
+			assert(next == #s + 1)
+			if type(c[1]) ~= "table" then
+				assert(v == c[1] and math.type(v) == math.type(c[1]), hex(s))
+			end
+		end
+		assert(hex(mp.encode({b = 2, a = 1, [1] = true, [2.5] = 0})) == "84" .. "01c3" .. "cb400400000000000000" .. "a16101" .. "a16202")
+
+		local big = {}
+		for i = 1, 70000 do big[i] = i end
+		local t = mp.decode(mp.encode({list = big, nested = {x = {1.0, "y"}}, s = string.rep("z", 300)}))
+		assert(#t.list == 70000 and t.list[70000] == 70000)
+		assert(math.type(t.nested.x[1]) == "float" and t.nested.x[2] == "y" and #t.s == 300)
+
+		local json = require("json")
+		assert(mp.null == json.null)
+		local v = mp.decode(mp.encode(json.decode('[null, {"k": null}]')))
+		assert(v[1] == json.null and v[2].k == json.null)
+
+		local stream = mp.encode(1) .. mp.encode("two") .. mp.encode({3})
+		local a, pos = mp.decode(stream)
+		local b, pos = mp.decode(stream, pos)
+		local c, pos = mp.decode(stream, pos)
+		assert(a == 1 and b == "two" and c[1] == 3 and pos == #stream + 1)
+		assert(mp.decode("\xc4\x02hi") == "hi", "bin")
+		assert(mp.decode("\xca\x3f\xc0\x00\x00") == 1.5, "float 32")
+		assert(mp.decode("\xcf\xff\xff\xff\xff\xff\xff\xff\xff") == 2^64)
+
+		local function fails(f, arg, message)
+			local ok, err = pcall(f, arg)
+			assert(not ok, "no error for " .. tostring(arg))
+			assert(err:find(message, 1, true), err)
+		end
+		fails(mp.encode, print, "cannot encode a function")
+		fails(mp.encode, {f = coroutine.create(print)}, "cannot encode a thread")
+		local cycle = {} cycle[1] = cycle
+		fails(mp.encode, cycle, "table nested too deep")
+		fails(mp.decode, "", "initial position out of string")
+		fails(mp.decode, "\x92\x01", "truncated data at position 3")
+		fails(mp.decode, "\xdd\xff\xff\xff\xff", "truncated data")
+		fails(mp.decode, "\xc1", "invalid byte 0xc1 at position 1")
+		fails(mp.decode, "\xd4\x01\x00", "unsupported extension type")
+		fails(mp.decode, "\x81\xc0\x01", "invalid map key at position 2")
+		fails(mp.decode, string.rep("\x91", 1001) .. "\x90", "table nested too deep")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build lua_noos || baremetal
+// +build lua_noos baremetal
+
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Builds with the lua_noos tag leave out the io and os libraries and the
+// optional libraries mmap and signal, so that scripts cannot reach files,
+// commands or the environment. So do builds for TinyGo's bare metal targets,
+// which have none of these. This file stands in for what the rest of the
+// package uses from them.
+
+var (
+	osLibraries         []RegistryFunction
+	osOptionalLibraries []RegistryFunction
+)
+
+// errNoFileAccess is the error of the default FileOpener.
+var errNoFileAccess = errors.New("no file access in this build")
+
+func defaultFileOpener(name string, flag int) (File, error) { return nil, errNoFileAccess }
+
+// readOnly is the flag for opening a file to read it, the value of
+// os.O_RDONLY on all systems.
+const readOnly = 0
+
+// Without the host's streams, io.stdin is empty and output is discarded.
+func defaultStdin() io.Reader  { return strings.NewReader("") }
+func defaultStdout() io.Writer { return io.Discard }
+func defaultStderr() io.Writer { return io.Discard }
+
+// isTimeout reports false: files that time out come with the io library.
+func isTimeout(err error) bool { return false }
+
+// getenv ignores the environment, so package.path and package.cpath keep
+// their defaults.
+func getenv(name string) string { return "" }
+
+// panicUncaught panics with the message of an error outside of any
+// protected call. It does not log it, as the log package writes to the
+// host's standard error.
+func panicUncaught(err error) { panic(fmt.Sprintf("Uncaught Lua error: %v", err)) }
+
+func hashData(l *State, h io.Writer, index int) error {
+	_, err := io.WriteString(h, CheckString(l, index))
+	return err
+}
+
+func unpackData(l *State, index int) (data string, mapped bool) {
+	return CheckString(l, index), false
+}
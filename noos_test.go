@@ -0,0 +1,47 @@
+package lua
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBuildWithoutOS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the package")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	if out, err := exec.Command("go", "build", "-tags", "lua_noos", ".").CombinedOutput(); err != nil {
+		t.Fatalf("build with lua_noos failed: %v\n%s", err, out)
+	}
+	// fmt and time import os and syscall, so only the imports of the
+	// package itself can be checked.
+	out, err := exec.Command("go", "list", "-f", "{{join .Imports \" \"}}", "-tags", "lua_noos", ".").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		switch dep {
+		case "os", "os/exec", "os/signal", "syscall", "log":
+			t.Errorf("the build with lua_noos imports %s", dep)
+		}
+	}
+}
+
+// TestBuildTinyGoFallbacks only checks that the files selected by TinyGo's
+// tags compile with the go command. It does not run TinyGo.
+func TestBuildTinyGoFallbacks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the package")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command")
+	}
+	for _, tags := range []string{"tinygo", "tinygo baremetal"} {
+		if out, err := exec.Command("go", "build", "-tags", tags, ".").CombinedOutput(); err != nil {
+			t.Errorf("build with %q failed: %v\n%s", tags, err, out)
+		}
+	}
+}
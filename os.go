@@ -1,10 +1,15 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
 package lua
 
 import (
 	"fmt"
+	"log"
 	"math"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -51,8 +56,9 @@ func field(l *State, key string, def int, delta int64) int {
 	return int(res)
 }
 
-// strftime formats a time according to C strftime-style format specifiers.
-func strftime(format string, t time.Time) (string, error) {
+// strftime formats a time according to C strftime-style format specifiers,
+// taking names and the formats of %c, %x and %X from loc.
+func strftime(format string, t time.Time, loc *DateLocale) (string, error) {
 	var result []byte
 	for i := 0; i < len(format); i++ {
 		if format[i] != '%' {
@@ -65,15 +71,29 @@ func strftime(format string, t time.Time) (string, error) {
 		}
 		switch format[i] {
 		case 'a':
-			result = append(result, t.Format("Mon")...)
+			result = append(result, loc.ShortDays[t.Weekday()]...)
 		case 'A':
-			result = append(result, t.Format("Monday")...)
+			result = append(result, loc.Days[t.Weekday()]...)
 		case 'b', 'h':
-			result = append(result, t.Format("Jan")...)
+			result = append(result, loc.ShortMonths[t.Month()-1]...)
 		case 'B':
-			result = append(result, t.Format("January")...)
-		case 'c':
-			result = append(result, t.Format("Mon Jan  2 15:04:05 2006")...)
+			result = append(result, loc.Months[t.Month()-1]...)
+		case 'c', 'x', 'X':
+			sub := loc.DateTime
+			if format[i] == 'x' {
+				sub = loc.Date
+			} else if format[i] == 'X' {
+				sub = loc.Time
+			}
+			// The C formats don't nest, so a locale whose formats use
+			// %c, %x or %X can't recurse forever.
+			nested := *loc
+			nested.DateTime, nested.Date, nested.Time = CDateLocale.DateTime, CDateLocale.Date, CDateLocale.Time
+			s, err := strftime(sub, t, &nested)
+			if err != nil {
+				return "", err
+			}
+			result = append(result, s...)
 		case 'd':
 			result = append(result, fmt.Sprintf("%02d", t.Day())...)
 		case 'e':
@@ -96,9 +116,9 @@ func strftime(format string, t time.Time) (string, error) {
 			result = append(result, '\n')
 		case 'p':
 			if t.Hour() < 12 {
-				result = append(result, "AM"...)
+				result = append(result, loc.AM...)
 			} else {
-				result = append(result, "PM"...)
+				result = append(result, loc.PM...)
 			}
 		case 'S':
 			result = append(result, fmt.Sprintf("%02d", t.Second())...)
@@ -121,10 +141,6 @@ func strftime(format string, t time.Time) (string, error) {
 				wday--
 			}
 			result = append(result, fmt.Sprintf("%02d", (yday+6-wday)/7)...)
-		case 'x':
-			result = append(result, fmt.Sprintf("%02d/%02d/%02d", int(t.Month()), t.Day(), t.Year()%100)...)
-		case 'X':
-			result = append(result, fmt.Sprintf("%02d:%02d:%02d", t.Hour(), t.Minute(), t.Second())...)
 		case 'y':
 			result = append(result, fmt.Sprintf("%02d", t.Year()%100)...)
 		case 'Y':
@@ -141,11 +157,33 @@ func strftime(format string, t time.Time) (string, error) {
 	return string(result), nil
 }
 
+// SetClock sets the function that os.time, os.timens and os.date without a
+// time argument call for the current time, and returns the previous one. A
+// nil clock restores time.Now. Tests can freeze time with a clock that
+// returns a fixed time; os.date shows it in the local time zone, like the
+// result of os.time. os.clock and os.clockns measure elapsed time and keep
+// using the system clocks. The clock is shared by all threads of l.
+func SetClock(l *State, clock func() time.Time) func() time.Time {
+	old := l.global.clock
+	if old == nil {
+		old = time.Now
+	}
+	l.global.clock = clock
+	return old
+}
+
+func (g *globalState) now() time.Time {
+	if g.clock != nil {
+		return g.clock().Local()
+	}
+	return time.Now()
+}
+
 func osDate(l *State) int {
 	format := OptString(l, 1, "%c")
 	var t time.Time
 	if l.IsNoneOrNil(2) {
-		t = time.Now()
+		t = l.global.now()
 	} else {
 		ts := CheckNumber(l, 2)
 		t = time.Unix(int64(ts), 0)
@@ -182,7 +220,7 @@ func osDate(l *State) int {
 		return 1
 	}
 
-	result, err := strftime(format, t)
+	result, err := strftime(format, t, l.global.timeLocale())
 	if err != nil {
 		Errorf(l, "%s", err.Error())
 	}
@@ -190,19 +228,129 @@ func osDate(l *State) int {
 	return 1
 }
 
+// spawn implements os.spawn(argv [, options]). Unlike os.execute it runs the
+// program directly, without a shell, so arguments need no quoting. argv is a
+// sequence {program, arg1, ...}; the optional options table may contain cwd
+// (working directory), env (a table of variables added to the inherited
+// environment) and stdin (a string written to the standard input). It
+// returns the results of os.execute followed by the captured standard output
+// and standard error.
+func spawn(l *State) int {
+	CheckType(l, 1, TypeTable)
+	n := l.RawLength(1)
+	ArgumentCheck(l, n > 0, 1, "program name expected")
+	argv := make([]string, n)
+	for i := range argv {
+		l.RawGetInt(1, i+1)
+		s, ok := l.ToString(-1)
+		if !ok {
+			ArgumentError(l, 1, fmt.Sprintf("argument %d is not a string", i+1))
+		}
+		checkTags(l, "os.spawn", s)
+		argv[i] = s
+		l.Pop(1)
+	}
+
+	cmd := exec.CommandContext(CallContext(l), argv[0], argv[1:]...)
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if !l.IsNoneOrNil(2) {
+		CheckType(l, 2, TypeTable)
+		l.Field(2, "cwd")
+		cmd.Dir = OptString(l, -1, "")
+		l.Field(2, "stdin")
+		if !l.IsNil(-1) {
+			cmd.Stdin = strings.NewReader(CheckString(l, -1))
+		}
+		l.Field(2, "env")
+		if !l.IsNil(-1) {
+			CheckType(l, -1, TypeTable)
+			cmd.Env = os.Environ()
+			for l.PushNil(); l.Next(-2); l.Pop(1) {
+				if l.TypeOf(-2) != TypeString { // ToString would confuse Next
+					ArgumentError(l, 2, "env entries must be strings")
+				}
+				k, _ := l.ToString(-2)
+				v, ok := l.ToString(-1)
+				if !ok {
+					ArgumentError(l, 2, "env entries must be strings")
+				}
+				cmd.Env = append(cmd.Env, k+"="+v) // later entries take precedence
+			}
+		}
+		l.Pop(3)
+	}
+
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok { // not started
+		return FileResult(l, err, argv[0])
+	}
+	if err == nil {
+		l.PushBoolean(true)
+		l.PushString("exit")
+		l.PushInteger(0)
+	} else {
+		reason, code := exitReasonAndCode(err.(*exec.ExitError))
+		l.PushNil()
+		l.PushString(reason)
+		l.PushInteger(code)
+	}
+	l.PushString(stdout.String())
+	l.PushString(stderr.String())
+	return 5
+}
+
+// osLibraries are the standard libraries and osOptionalLibraries the
+// optional ones that give scripts access to the operating system, which
+// builds with the lua_noos tag leave out.
+var (
+	osLibraries         = []RegistryFunction{{"io", IOOpen}, {"os", OSOpen}}
+	osOptionalLibraries = []RegistryFunction{{"mmap", MmapOpen}, {"signal", SignalOpen}}
+)
+
+// getenv returns the value of an environment variable, such as LUA_PATH.
+func getenv(name string) string { return os.Getenv(name) }
+
+// panicUncaught logs an error outside of any protected call and panics with
+// its message, as PanicLog does.
+func panicUncaught(err error) { log.Panicf("Uncaught Lua error: %v", err) }
+
+// processStart is the origin of os.clockns.
+var processStart = time.Now()
+
 var osLibrary = []RegistryFunction{
 	{"clock", clock},
+	{"clockns", func(l *State) int {
+		// os.clockns() returns the nanoseconds elapsed on a monotonic clock
+		// since the program started. Unlike os.clock it measures wall time,
+		// and it is not affected by changes of the system clock.
+		l.PushInteger64(int64(time.Since(processStart)))
+		return 1
+	}},
 	{"date", osDate},
 	{"difftime", func(l *State) int {
 		l.PushNumber(time.Unix(int64(CheckNumber(l, 1)), 0).Sub(time.Unix(int64(OptNumber(l, 2, 0)), 0)).Seconds())
 		return 1
 	}},
+	{"difftimens", func(l *State) int {
+		// os.difftimens(t2 [, t1]) returns t2 - t1 in seconds, for times and
+		// clock readings in nanoseconds.
+		l.PushNumber(time.Duration(CheckInteger64(l, 1) - OptInteger64(l, 2, 0)).Seconds())
+		return 1
+	}},
+	{"durationns", func(l *State) int {
+		// os.durationns(d) formats a duration in nanoseconds, for example
+		// "1.5ms" or "2h3m0.5s".
+		l.PushString(time.Duration(CheckInteger64(l, 1)).String())
+		return 1
+	}},
 
 	// From the Lua manual:
 	// "This function is equivalent to the ISO C function system"
 	// https://www.lua.org/manual/5.2/manual.html#pdf-os.execute
 	{"execute", func(l *State) int {
 		c := OptString(l, 1, "")
+		checkTags(l, "os.execute", c)
 
 		if c == "" {
 			// Check whether "sh" is available on the system.
@@ -216,9 +364,9 @@ var osLibrary = []RegistryFunction{
 		terminationData := 0
 
 		// Create the command.
-		cmd := exec.Command("sh", "-c", c)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd := exec.CommandContext(CallContext(l), "sh", "-c", c)
+		cmd.Stdout = l.global.stdoutWriter()
+		cmd.Stderr = l.global.stderrWriter()
 
 		// Run the command.
 		if err := cmd.Run(); err != nil {
@@ -277,19 +425,38 @@ var osLibrary = []RegistryFunction{
 	{"remove", func(l *State) int { name := CheckString(l, 1); return FileResult(l, os.Remove(name), name) }},
 	{"rename", func(l *State) int { return FileResult(l, os.Rename(CheckString(l, 1), CheckString(l, 2)), "") }},
 	{"setlocale", func(l *State) int {
-		// Go has no C-style locale support. Only "C" locale is supported.
-		_ = CheckOption(l, 2, "all", []string{"all", "collate", "ctype", "monetary", "numeric", "time"})
-		locale := OptString(l, 1, "")
-		if locale == "" || locale == "C" || locale == "POSIX" {
+		// Go has no C-style locale support. The "time" category, which is
+		// part of "all", may be any locale known to SetDateLocale; the
+		// others support the "C" locale only.
+		category := CheckOption(l, 2, "all", []string{"all", "collate", "ctype", "monetary", "numeric", "time"})
+		if l.IsNoneOrNil(1) {
+			if category == 5 || category == 0 {
+				l.PushString(l.global.timeLocale().Name)
+			} else {
+				l.PushString("C")
+			}
+			return 1
+		}
+		locale := CheckString(l, 1)
+		if locale == "" {
+			locale = "C" // no locale environment to take it from
+		}
+		if loc := l.global.findDateLocale(locale); loc == nil {
+			l.PushNil() // unsupported locale
+		} else if category == 5 || category == 0 {
+			l.global.dateLocale = loc
+			l.PushString(loc.Name)
+		} else if loc.Name == "C" {
 			l.PushString("C")
 		} else {
-			l.PushNil() // unsupported locale
+			l.PushNil()
 		}
 		return 1
 	}},
+	{"spawn", spawn},
 	{"time", func(l *State) int {
 		if l.IsNoneOrNil(1) {
-			l.PushNumber(float64(time.Now().Unix()))
+			l.PushNumber(float64(l.global.now().Unix()))
 		} else {
 			CheckType(l, 1, TypeTable)
 			l.SetTop(1)
@@ -319,6 +486,12 @@ var osLibrary = []RegistryFunction{
 		}
 		return 1
 	}},
+	{"timens", func(l *State) int {
+		// os.timens() returns the current time in nanoseconds since the
+		// epoch. os.date accepts it divided by 1e9.
+		l.PushInteger64(l.global.now().UnixNano())
+		return 1
+	}},
 	{"tmpname", func(l *State) int {
 		f, err := os.CreateTemp("", "lua_")
 		if err != nil {
@@ -0,0 +1,38 @@
+package lua
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestOSSpawn(t *testing.T) {
+	skipWithoutCommands(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	testString(t, `
+		local ok, how, code, out, err = os.spawn({"sh", "-c", "echo \"$1\"; echo oops >&2", "sh", "a b; rm -rf /"})
+		assert(ok == true and how == "exit" and code == 0)
+		assert(out == "a b; rm -rf /\n", out)
+		assert(err == "oops\n", err)
+
+		ok, how, code = os.spawn({"sh", "-c", "exit 3"})
+		assert(ok == nil and how == "exit" and code == 3)
+
+		ok, how, code, out = os.spawn({"sh", "-c", "cat; echo $GOLUA_TEST; pwd"},
+			{stdin = "input\n", env = {GOLUA_TEST = "value"}, cwd = "/"})
+		assert(ok and out == "input\nvalue\n/\n", out)
+
+		ok, how = os.spawn({"/nonexistent/program"})
+		assert(ok == nil and how:find("/nonexistent/program"))
+
+		assert(not pcall(os.spawn, {}))
+		assert(not pcall(os.spawn, {"echo", {}}))
+		local ok, err = pcall(os.spawn, {"true"}, {env = {"A=1"}})
+		assert(not ok and err:find("env entries must be strings"), err)
+
+		-- argv is read raw, ignoring __len
+		ok, how, code, out = os.spawn(setmetatable({"echo", "raw"}, {__len = function() return 5 end}))
+		assert(ok and out == "raw\n", out)
+	`)
+}
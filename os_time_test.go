@@ -0,0 +1,92 @@
+//go:build !lua_noos
+// +build !lua_noos
+
+package lua
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOSTimeNanoseconds(t *testing.T) {
+	testString(t, `
+		local t = os.timens()
+		assert(math.type(t) == "integer")
+		assert(math.abs(t // 1000000000 - os.time()) <= 1)
+		assert(os.date("!%Y", t / 1e9) == os.date("!%Y", os.time()))
+
+		local c1 = os.clockns()
+		local x = 0
+		for i = 1, 100000 do x = x + i end
+		local c2 = os.clockns()
+		assert(math.type(c1) == "integer" and c2 >= c1)
+
+		assert(os.difftimens(2500000000, 1000000000) == 1.5)
+		assert(os.difftimens(-500000000) == -0.5)
+		assert(os.durationns(1500000) == "1.5ms")
+		assert(os.durationns(0) == "0s")
+		assert(os.durationns(3723000000000) == "1h2m3s")
+		assert(not pcall(os.difftimens, 1.5))
+	`)
+}
+
+func TestSetClock(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	frozen := time.Date(2024, time.February, 29, 13, 14, 15, 500, time.UTC)
+	if old := SetClock(l, func() time.Time { return frozen }); old == nil {
+		t.Error("SetClock returned a nil previous clock")
+	}
+	if err := DoString(l, `
+		assert(os.time() == 1709212455)
+		assert(os.timens() == 1709212455000000500)
+		assert(os.date("!%Y-%m-%d %H:%M:%S") == "2024-02-29 13:14:15")
+		assert(os.date("%c") == os.date("%c", os.time()))
+		local d = os.date("!*t")
+		assert(d.year == 2024 and d.month == 2 and d.day == 29 and d.sec == 15)
+		assert(os.date("!%H", 0) == "00") -- explicit times are unaffected
+	`); err != nil {
+		t.Fatal(err)
+	}
+	SetClock(l, nil)
+	if err := DoString(l, `assert(os.time() > 1709212455)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDateLocale(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		local t = os.time({year = 2024, month = 3, day = 4, hour = 15, min = 6, sec = 7})
+		assert(os.setlocale() == "C")
+		assert(os.date("%A %B %c", t) == "Monday March Mon Mar  4 15:06:07 2024")
+
+		assert(os.setlocale("de_DE.UTF-8", "time") == "de_DE")
+		assert(os.setlocale(nil, "time") == "de_DE" and os.setlocale(nil, "numeric") == "C")
+		assert(os.date("%A, %d. %B %Y", t) == "Montag, 04. März 2024")
+		assert(os.date("%x %X", t) == "04.03.2024 15:06:07")
+		assert(os.date("%a %b", t) == "Mo Mär")
+
+		assert(os.setlocale("fr_FR", "all") == "fr_FR")
+		assert(os.date("%A %e %B", t) == "lundi  4 mars")
+		assert(os.setlocale("xx_XX") == nil and os.setlocale(nil) == "fr_FR")
+		assert(os.setlocale("de_DE", "numeric") == nil)
+		assert(os.setlocale("en_US") == "en_US" and os.date("%x %p", t) == "03/04/2024 PM")
+		assert(os.setlocale("") == "C" and os.date("%x", t) == "03/04/24")
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	nl := &DateLocale{Name: "nl_NL", Months: [12]string{"januari", "februari", "maart"}, DateTime: "%e %B %c"}
+	if old := SetDateLocale(l, nl); old != CDateLocale {
+		t.Errorf("SetDateLocale returned %v, want CDateLocale", old.Name)
+	}
+	if err := DoString(l, `
+		local t = os.time({year = 2024, month = 3, day = 4, hour = 15})
+		assert(os.date("%c", t) == " 4 maart    4 15:00:00 2024") -- %c inside %c uses the C format
+		assert(os.setlocale("C") == "C" and os.setlocale("nl_NL") == "nl_NL")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build (js || wasip1) && !lua_noos && !baremetal
+// +build js wasip1
+// +build !lua_noos
+// +build !baremetal
+
+package lua
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// clock returns the time since the program started: WebAssembly has no
+// measure of processor time, and its single thread runs the program alone.
+func clock(l *State) int {
+	l.PushNumber(time.Since(processStart).Seconds())
+	return 1
+}
+
+func exitReasonAndCode(exitErr *exec.ExitError) (string, int) {
+	return "exit", exitErr.ExitCode()
+}
+
+func mapFile(f *os.File) (*mapping, error) {
+	return readMapping(f)
+}
@@ -1,6 +1,12 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
 package lua
 
-import "os/exec"
+import (
+	"os"
+	"os/exec"
+)
 
 func clock(l *State) int {
 	Errorf(l, "os.clock not yet supported on Windows")
@@ -10,3 +16,7 @@ func clock(l *State) int {
 func exitReasonAndCode(exitErr *exec.ExitError) (string, int) {
 	return "exit", exitErr.ExitCode()
 }
+
+func mapFile(f *os.File) (*mapping, error) {
+	return readMapping(f)
+}
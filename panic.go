@@ -0,0 +1,86 @@
+package lua
+
+// A PanicPolicy selects what an error outside of any protected call does,
+// once the panic function set with AtPanic has returned.
+type PanicPolicy int
+
+const (
+	// PanicLog logs the error with the log package and panics with its
+	// message. It is the default. Builds with the lua_noos tag panic
+	// without logging.
+	PanicLog PanicPolicy = iota
+	// PanicError panics with the *Error that ProtectedCall would have
+	// returned, without logging. Before, the stack of the state is reset:
+	// its calls are unwound, closing their to-be-closed variables, and the
+	// stack holds just the error value, so that the state can be used again
+	// once the panic is recovered above the outermost call. RecoverError
+	// recovers it as the error of a function, and CallError returns it.
+	PanicError
+)
+
+// SetPanicPolicy sets the policy for errors outside of any protected call
+// and returns the previous one.
+func SetPanicPolicy(l *State, p PanicPolicy) PanicPolicy {
+	old := l.global.panicPolicy
+	l.global.panicPolicy = p
+	return old
+}
+
+// RecoverError recovers the panic of an error outside of any protected call
+// under PanicError and stores the error in *err. Other panics go on. It must
+// be deferred directly, by the function that makes the outermost call into
+// Lua:
+//
+//	func run(l *lua.State) (err error) {
+//		defer lua.RecoverError(&err)
+//		l.Global("main")
+//		l.Call(0, 0)
+//		return nil
+//	}
+func RecoverError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*Error)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
+}
+
+// CallError calls a function like Call and returns an error outside of any
+// protected call as the *Error that PanicError panics with, whatever the
+// policy, so that the caller needs no deferred RecoverError. The panic
+// function set with AtPanic is called first, and on an error the stack of
+// the state holds just the error value. Called from a Go function that Lua
+// called, CallError is the same as Call: the error goes on to the script.
+func CallError(l *State, argCount, resultCount int) (err error) {
+	if l.callInfo != &l.baseCallInfo {
+		l.Call(argCount, resultCount)
+		return nil
+	}
+	defer SetPanicPolicy(l, SetPanicPolicy(l, PanicError))
+	defer RecoverError(&err)
+	l.Call(argCount, resultCount)
+	return nil
+}
+
+// unwind resets l after an error outside of any protected call, like a
+// protected call around everything l runs would, and leaves the error value
+// on the stack. It returns the error value, which a __close metamethod may
+// have replaced.
+func (l *State) unwind(errObj value) value {
+	base := l.baseCallInfo.function + 1
+	l.callInfo, l.allowHook, l.errorFunction = &l.baseCallInfo, true, 0
+	l.nestedGoCallCount, l.nonYieldableCallCount, l.callDepthExceeded = 0, 0, false
+	if l == l.global.mainThread {
+		l.nonYieldableCallCount = 1
+	}
+	l.closeUpValues(base)
+	if finalErr := l.closeTBCProtected(base, errObj); finalErr != nil {
+		errObj = finalErr
+	}
+	l.stack[base] = errObj
+	l.top = base + 1
+	l.shrinkStack()
+	return errObj
+}
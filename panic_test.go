@@ -0,0 +1,137 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+)
+
+func TestPanicError(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	panicked := 0
+	AtPanic(l, func(l *State) int { panicked++; return 0 })
+	if old := SetPanicPolicy(l, PanicError); old != PanicLog {
+		t.Errorf("default policy %v", old)
+	}
+	run := func(chunk string) (err error) {
+		defer RecoverError(&err)
+		if err := LoadString(l, chunk); err != nil {
+			t.Fatal(err)
+		}
+		l.Call(0, 0)
+		return nil
+	}
+	l.PushGoFunction(func(l *State) int {
+		l.PushString("x")
+		l.Global("error")
+		l.PushValue(1)
+		l.Call(1, 0) // an unprotected error in a call from Go called from Lua
+		return 0
+	})
+	l.SetGlobal("raise")
+	err := run(`
+		closed = false
+		local c <close> = setmetatable({}, {__close = function() closed = true end})
+		raise({code = 7})
+	`)
+	var e *Error
+	if !errors.As(err, &e) || panicked != 1 {
+		t.Fatalf("got %v, panic function called %d times", err, panicked)
+	}
+	if l.Top() != 1 {
+		t.Errorf("stack holds %d values", l.Top())
+	}
+	l.Field(-1, "code")
+	if code, _ := l.ToInteger(-1); code != 7 {
+		t.Errorf("code %d", code)
+	}
+	l.SetTop(0)
+
+	// The state is usable again, and the to-be-closed variables are closed.
+	if err := DoString(l, `assert(closed)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(`error("again")`); err == nil || err.Error() != `runtime error: [string "error("again")"]:1: again` {
+		t.Errorf("got %v", err)
+	}
+
+	// Other panics go on.
+	defer func() {
+		if r := recover(); r != "not Lua" {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	func() (err error) {
+		defer RecoverError(&err)
+		panic("not Lua")
+	}()
+}
+
+func TestCallError(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	panicked := 0
+	AtPanic(l, func(l *State) int { panicked++; return 0 })
+	call := func(chunk string, results int) error {
+		if err := LoadString(l, chunk); err != nil {
+			t.Fatal(err)
+		}
+		return CallError(l, 0, results)
+	}
+	if err := call(`return 1, 2`, 2); err != nil || l.Top() != 2 {
+		t.Fatalf("got %v with %d values", err, l.Top())
+	}
+	l.SetTop(0)
+
+	var e *Error
+	if err := call(`error({code = 7})`, 0); !errors.As(err, &e) || panicked != 1 {
+		t.Fatalf("got %v, panic function called %d times", err, panicked)
+	}
+	if l.Top() != 1 {
+		t.Errorf("stack holds %d values", l.Top())
+	}
+	if policy := SetPanicPolicy(l, PanicLog); policy != PanicLog {
+		t.Errorf("policy left at %v", policy)
+	}
+	l.SetTop(0)
+
+	// In a Go function called from Lua, the error reaches the script.
+	l.Register("raise", func(l *State) int {
+		l.Global("error")
+		l.PushString("from Go")
+		if err := CallError(l, 1, 0); err != nil {
+			t.Errorf("nested CallError returned %v", err)
+		}
+		return 0
+	})
+	if err := call(`local ok, msg = pcall(raise) assert(not ok and msg == "from Go")`, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPanicLog(t *testing.T) {
+	skipWithoutOS(t)
+	var b bytes.Buffer
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}()
+	l := NewState()
+	func() {
+		defer func() {
+			if r, _ := recover().(string); r != "Uncaught Lua error: runtime error: boom" {
+				t.Errorf("panicked with %q", r)
+			}
+		}()
+		l.PushGoFunction(func(l *State) int { Errorf(l, "boom"); return 0 })
+		l.Call(0, 0)
+	}()
+	if b.String() != "Uncaught Lua error: runtime error: boom\n" {
+		t.Errorf("logged %q", b.String())
+	}
+}
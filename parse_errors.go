@@ -0,0 +1,167 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// A ParseError is a syntax error found by CheckSyntax.
+type ParseError struct {
+	Source  string // the chunk name as it appears in messages, e.g. [string "x = "]
+	Line    int
+	Message string // the message without the position, e.g. "unexpected symbol near '='"
+
+	atEnd bool // reported at the end of the source
+}
+
+// Error returns the message in the format of the errors of Load.
+func (e ParseError) Error() string { return fmt.Sprintf("%s:%d: %s", e.Source, e.Line, e.Message) }
+
+// CheckSyntax compiles the Lua source read from r, named name in messages
+// like in Load, and returns all its syntax errors, up to maxErrors if
+// maxErrors > 0. It neither runs nor keeps the chunk and leaves the stack of
+// l unchanged. Unlike Load, which stops at the first error, it reports an
+// error, skips to the start of the next statement and goes on, so that an
+// editor can mark all the mistakes in a file at once.
+//
+// A statement that fails to compile is skipped together with the blocks it
+// opens, such as the body of a function whose parameter list is wrong. The
+// errors after the first may still follow from it; an error at the end of
+// the chunk, like a missing 'end', is reported once.
+func CheckSyntax(l *State, r io.Reader, name string, maxErrors int) []ParseError {
+	rec := &recovery{max: maxErrors}
+	top := l.top
+	l.nonYieldableCallCount++
+	_ = l.protectedCall(func() {
+		defer func() {
+			if e := recover(); e != nil && e != SyntaxError && e != errTooManyErrors {
+				panic(e)
+			}
+		}()
+		b := bufio.NewReader(r)
+		p := &parser{scanner: scanner{r: b, lineNumber: 1, lastLine: 1, lookAheadToken: token{t: tkEOS}, l: l, source: name, recovery: rec}}
+		p.function = &function{f: &prototype{source: name, maxStackSize: 2, isVarArg: true}, constantLookup: make(map[value]int), p: p, jumpPC: noJump}
+		p.mainFunction()
+	}, top, l.errorFunction)
+	l.nonYieldableCallCount--
+	l.top = top
+	return rec.errors
+}
+
+// errTooManyErrors stops CheckSyntax once it has found maxErrors errors.
+var errTooManyErrors = fmt.Errorf("too many syntax errors")
+
+// A recovery holds the state of CheckSyntax.
+type recovery struct {
+	errors   []ParseError
+	max      int
+	skipping bool // errors are not recorded while the rest of a statement is skipped
+	depth    int  // the blocks opened minus the blocks closed by the tokens read
+	tokens   int  // the number of tokens read
+}
+
+// add records an error. Once the end of the source has been reached, only
+// the first error is kept: the others are its consequences.
+func (r *recovery) add(e ParseError, atEnd bool) {
+	if r.skipping || atEnd && len(r.errors) > 0 && r.errors[len(r.errors)-1].atEnd {
+		return
+	}
+	e.atEnd = atEnd
+	r.errors = append(r.errors, e)
+}
+
+func blockDelta(t rune) int {
+	switch t {
+	case tkFunction, tkIf, tkDo, tkRepeat:
+		return 1
+	case tkEnd, tkUntil:
+		return -1
+	}
+	return 0
+}
+
+func (r *recovery) count(t rune) {
+	r.tokens++
+	r.depth += blockDelta(t)
+}
+
+// recoverStatement calls statement, which compiles a statement. Unless
+// syntax errors are being collected, it is just that. Otherwise a syntax
+// error in the statement is caught: the compiler state is restored to where
+// the statement began, the rest of the statement is skipped, and false is
+// returned.
+func (p *parser) recoverStatement(statement func()) (ok bool) {
+	r := p.recovery
+	if r == nil {
+		statement()
+		return true
+	}
+	f, block, top := p.function, p.function.block, p.l.top
+	activeVariableCount, freeRegisterCount := f.activeVariableCount, f.freeRegisterCount
+	variables, gotos, labels := len(p.activeVariables), len(p.pendingGotos), len(p.activeLabels)
+	level, tokens, depth := p.l.nestedGoCallCount, r.tokens, r.depth-blockDelta(p.t)
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		} else if e != SyntaxError {
+			panic(e)
+		} else if r.max > 0 && len(r.errors) >= r.max {
+			panic(errTooManyErrors)
+		}
+		p.function, f.block, p.l.top = f, block, top
+		f.activeVariableCount, f.freeRegisterCount = activeVariableCount, freeRegisterCount
+		p.activeVariables, p.pendingGotos, p.activeLabels = p.activeVariables[:variables], p.pendingGotos[:gotos], p.activeLabels[:labels]
+		p.l.nestedGoCallCount = level
+		p.skipStatement(tokens, depth)
+	}()
+	statement()
+	return true
+}
+
+// skipStatement skips the rest of a statement that failed to compile: the
+// tokens up to the start of the next statement, or to the end of the
+// enclosing block, but at least one, and any block the statement opened.
+// tokens and depth are the token count and the block depth of the start of
+// the statement.
+func (p *parser) skipStatement(tokens, depth int) {
+	r := p.recovery
+	line := p.lineNumber
+	if r.tokens == tokens {
+		p.skipToken()
+	}
+	for p.t != tkEOS {
+		if before := r.depth - blockDelta(p.t); before == depth {
+			switch p.t {
+			case tkEnd, tkUntil, tkElse, tkElseif: // of the enclosing block
+				return
+			case tkIf, tkWhile, tkDo, tkFor, tkRepeat, tkFunction, tkLocal, tkDoubleColon, tkReturn, tkBreak, tkGoto, ';':
+				return
+			case tkName:
+				if p.lineNumber > line {
+					return
+				}
+			}
+		} else if before < depth {
+			return
+		}
+		p.skipToken()
+	}
+}
+
+func (p *parser) skipToken() {
+	r, top := p.recovery, p.l.top
+	r.skipping = true
+	defer func() {
+		r.skipping = false
+		if e := recover(); e != nil {
+			if e != SyntaxError {
+				panic(e)
+			}
+			p.l.top = top
+			p.buffer.Reset()
+		}
+	}()
+	p.next()
+}
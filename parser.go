@@ -322,10 +322,12 @@ func (p *parser) blockFollow(withUntil bool) bool {
 func (p *parser) statementList() {
 	for !p.blockFollow(true) {
 		if p.t == tkReturn {
-			p.statement()
-			return
+			if p.recoverStatement(p.statement) {
+				return
+			}
+			continue
 		}
-		p.statement()
+		p.recoverStatement(p.statement)
 	}
 }
 
@@ -773,6 +775,10 @@ func (p *parser) mainFunction() {
 	p.function.OpenMainFunction()
 	p.next()
 	p.statementList()
+	for p.recovery != nil && p.t != tkEOS { // a stray 'end' or 'until'
+		p.recoverStatement(func() { p.check(tkEOS) })
+		p.statementList()
+	}
 	p.check(tkEOS)
 	p.function = p.function.CloseMainFunction()
 }
@@ -795,6 +801,15 @@ func (l *State) checkMode(mode, x string) {
 	}
 }
 
+// A bufferedReader reads from a bufio.Reader around r and tells the length
+// of the rest, so that undump can check the counts it reads.
+type bufferedReader struct {
+	*bufio.Reader
+	r interface{ Len() int }
+}
+
+func (b bufferedReader) Len() int { return b.r.Len() + b.Buffered() }
+
 func protectedParser(l *State, r io.Reader, name, chunkMode string) error {
 	l.nonYieldableCallCount++
 	err := l.protectedCall(func() {
@@ -807,7 +822,11 @@ func protectedParser(l *State, r io.Reader, name, chunkMode string) error {
 			l.checkMode(chunkMode, "binary")
 			b.UnreadByte()
 			var undumpErr error
-			closure, undumpErr = l.undump(b, name)
+			if lr, ok := r.(interface{ Len() int }); ok {
+				closure, undumpErr = l.undump(bufferedReader{b, lr}, name)
+			} else {
+				closure, undumpErr = l.undump(b, name)
+			}
 			if undumpErr != nil {
 				l.push(fmt.Sprintf("%s: %s precompiled chunk", name, undumpErr.Error()))
 				l.throw(SyntaxError)
@@ -817,6 +836,9 @@ func protectedParser(l *State, r io.Reader, name, chunkMode string) error {
 			b.UnreadByte()
 			closure = l.parse(b, name)
 		}
+		if pool := l.global.stringPool; pool != nil {
+			pool.internPrototype(closure.prototype)
+		}
 		l.assert(closure.upValueCount() == len(closure.prototype.upValues))
 		for i := range closure.upValues {
 			closure.upValues[i] = l.newUpValue()
@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"fmt"
 	"math"
 	"os/exec"
 	"path/filepath"
@@ -18,6 +19,7 @@ func load(l *State, t *testing.T, fileName string) *luaClosure {
 }
 
 func TestParser(t *testing.T) {
+	skipWithoutOS(t)
 	l := NewState()
 	OpenLibraries(l)
 
@@ -195,3 +197,235 @@ func comparePrototypesLenient(t *testing.T, a, b *prototype) {
 		comparePrototypesLenient(t, &a.prototypes[i], &b.prototypes[i])
 	}
 }
+
+func TestDeadCodeAndJumpChains(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	src := `
+		local function f(a, b)
+			if a then
+				return 1
+			else
+				return 2
+			end
+		end
+		local function g(n)
+			local s = 0
+			while true do
+				if n > 10 then break end
+				while n < 5 do
+					if n % 2 == 0 then n = n + 3 else n = n + 1 end
+				end
+				s = s + n
+				n = n + 1
+			end
+			return s
+		end
+		local function h(x)
+			do return x end
+			print("unreachable")
+		end
+		return f(true), f(false), g(0), h(7)`
+	if err := LoadString(l, src); err != nil {
+		t.Fatal(err)
+	}
+	main := l.ToValue(-1).(*luaClosure).prototype
+	for _, p := range main.prototypes {
+		reachable := make(map[int]bool)
+		var walk func(pc int)
+		walk = func(pc int) {
+			if pc >= len(p.code) || reachable[pc] {
+				return
+			}
+			reachable[pc] = true
+			fn := &function{f: &p}
+			fn.successors(pc, walk)
+		}
+		walk(0)
+		for pc, i := range p.code {
+			if !reachable[pc] && pc != len(p.code)-1 {
+				t.Errorf("function at line %d: unreachable instruction %d: %s", p.lineDefined, pc, i)
+			}
+			if i.opCode() == opJump {
+				if target := p.code[pc+1+i.sJ()]; target.opCode() == opJump {
+					t.Errorf("function at line %d: jump %d goes to another jump", p.lineDefined, pc)
+				}
+			}
+		}
+		if len(p.lineInfo) != len(p.code) {
+			t.Errorf("function at line %d: %d instructions, %d line infos", p.lineDefined, len(p.code), len(p.lineInfo))
+		}
+	}
+	if h := main.prototypes[2]; len(h.code) > 3 {
+		t.Errorf("code after return was kept: %d instructions", len(h.code))
+	}
+	if err := l.ProtectedCall(0, MultipleReturns, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{1, 2, 34, 7} {
+		if n, _ := l.ToInteger(i + 1); n != want {
+			t.Errorf("result %d is %d, want %d", i+1, n, want)
+		}
+	}
+}
+
+func TestDeadCodeInLoops(t *testing.T) {
+	testString(t, `
+		local function ret(a) for i = 1, a do return i end local y = 7 return y end
+		assert(ret(0) == 7 and ret(3) == 1)
+		local function brk(a) local r = 0 for i = 1, a do r = i break end return r + 10 end
+		assert(brk(0) == 10 and brk(3) == 11)
+		local function jmp(a) local r = 0 for i = 1, a do r = i goto done end r = -1 ::done:: return r end
+		assert(jmp(0) == -1 and jmp(3) == 1)
+		local function gret(t) for k, v in pairs(t) do return v end local y = 7 return y end
+		assert(gret({}) == 7 and gret({5}) == 5)
+		local function gbrk(t) local r = 0 for _, v in ipairs(t) do r = v break end return r + 10 end
+		assert(gbrk({}) == 10 and gbrk({4, 5}) == 14)
+		local function gjmp(t) local r = 0 for _, v in ipairs(t) do r = v goto done end r = -1 ::done:: return r end
+		assert(gjmp({}) == -1 and gjmp({4}) == 4)
+	`)
+}
+
+// generate joins n pieces that f makes from 1 to n.
+func generate(n int, sep string, f func(i int) string) string {
+	pieces := make([]string, n)
+	for i := range pieces {
+		pieces[i] = f(i + 1)
+	}
+	return strings.Join(pieces, sep)
+}
+
+// TestParserStress compiles and runs chunks near the limits of the compiler,
+// as generated code reaches sizes hand-written code never does. Each chunk
+// either returns want or fails to compile with err.
+func TestParserStress(t *testing.T) {
+	statements := func(n int) string { return strings.Repeat("x = x + 1\n", n) }
+	tests := []struct {
+		name, source string
+		want         int
+		err          string
+	}{
+		{"many lines", strings.Repeat("\n", 1000000) + "return debug.getinfo(1, 'l').currentline", 1000001, ""},
+		{"nested blocks", strings.Repeat("do ", 190) + "x = 1 " + strings.Repeat("end ", 190) + "return x", 1, ""},
+		{"too deeply nested blocks", strings.Repeat("do ", 250) + strings.Repeat("end ", 250), 0, "too many Go levels"},
+		{"nested ifs", strings.Repeat("if true then ", 150) + "x = 2 " + strings.Repeat("end ", 150) + "return x", 2, ""},
+		{"nested loops", strings.Repeat("for i = 1, 1 do while true do ", 45) + "x = 3 " + strings.Repeat("break end end ", 45) + "return x", 3, ""},
+		{"nested parentheses", "return " + strings.Repeat("(", 190) + "4" + strings.Repeat(")", 190), 4, ""},
+		{"nested tables", "return #" + strings.Repeat("{", 190) + strings.Repeat("}", 190), 1, ""},
+		{"locals in blocks", generate(5000, "\n", func(i int) string { return fmt.Sprintf("do local v%d = %d end", i, i) }) + " return 5", 5, ""},
+		{"local limit", generate(200, " ", func(i int) string { return fmt.Sprintf("local v%d = %d", i, i) }) + " return v200", 200, ""},
+		{"too many locals", generate(201, " ", func(i int) string { return fmt.Sprintf("local v%d = %d", i, i) }), 0, "too many local variables"},
+		{"upvalues", generate(200, " ", func(i int) string { return fmt.Sprintf("local u%d = 1", i) }) +
+			" return (function() return " + generate(200, "+", func(i int) string { return fmt.Sprintf("u%d", i) }) + " end)()", 200, ""},
+		{"long if", "x = 0 if x == 0 then " + statements(100000) + " end return x", 100000, ""},
+		{"long while", "x = 0 while x == 0 do " + statements(100000) + " end return x", 100000, ""},
+		{"long repeat", "x = 0 repeat " + statements(100000) + " until x > 0 return x", 100000, ""},
+		{"long for", "x = 0 for i = 1, 2 do " + statements(20000) + " end return x", 40000, ""},
+		{"too long for", "x = 0 for i = 1, 2 do " + statements(30000) + " end", 0, "control structure too long"},
+		{"long goto", "x = 0 goto skip " + statements(100000) + " ::skip:: return x", 0, ""},
+		{"many labels", generate(5000, " ", func(i int) string { return fmt.Sprintf("::l%d:: goto l%d", i, i+1) }) + " ::l5001:: return 6", 6, ""},
+		{"and chain", "x = 7 return " + strings.Repeat("x and ", 5000) + "x", 7, ""},
+		{"or chain", "return " + strings.Repeat("x or ", 5000) + "8", 8, ""},
+		{"elseif chain", "local x = 2000 if x == 0 then " + generate(2000, " ", func(i int) string { return fmt.Sprintf("elseif x == %d then return %d", i, i) }) + " end", 2000, ""},
+		{"constants", "return #{" + generate(100000, ",", func(i int) string { return fmt.Sprintf("'s%d'", i) }) + "}", 100000, ""},
+		{"fields", "return #{" + generate(100000, ",", func(i int) string { return fmt.Sprintf("k%d = %d", i, i) }) + "}", 0, ""},
+	}
+	for _, test := range tests {
+		l := NewState()
+		OpenLibraries(l)
+		if err := LoadString(l, test.source); err != nil {
+			if msg, _ := l.ToString(-1); test.err == "" || !strings.Contains(msg, test.err) {
+				t.Errorf("%s: %v", test.name, msg)
+			}
+			continue
+		} else if test.err != "" {
+			t.Errorf("%s: compiled, want error %q", test.name, test.err)
+			continue
+		}
+		if err := l.ProtectedCall(0, 1, 0); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if n, _ := l.ToInteger(-1); n != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, n, test.want)
+		}
+	}
+}
+
+func TestConstantEnvironment(t *testing.T) {
+	testString(t, `
+		local function f()
+			local _ENV <const> = 11
+			X = "hi"
+		end
+		local ok, msg = pcall(f)
+		assert(not ok and string.find(msg, "number"))
+		local function g()
+			local _ENV <const> = {y = 5}
+			return y
+		end
+		assert(g() == 5)
+	`)
+}
+
+func TestCheckSyntax(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"x = 1\nlocal function f() return x end", nil},
+		{"x = = 1\ny = 2\nz = )\nprint(1)", []string{
+			"src:1: unexpected symbol near '='",
+			"src:3: unexpected symbol near ')'",
+		}},
+		{"if x == then y() end\nw = 3 3\nfunction f(a,, b) return a end", []string{
+			"src:1: unexpected symbol near 'then'",
+			"src:2: unexpected symbol near '3'",
+			"src:3: <name> or '...' expected near ','",
+		}},
+		{"local function f()\n  x = \nend\nreturn 1 2", []string{
+			"src:3: unexpected symbol near 'end'",
+			"src:4: <eof> expected near '2'",
+		}},
+		{"end\nx = 1\nuntil\ny = ", []string{
+			"src:1: <eof> expected near 'end'",
+			"src:3: <eof> expected near 'until'",
+			"src:4: unexpected symbol near <eof>",
+		}},
+		{"function f()\n  if x then\n", []string{
+			"src:3: 'end' expected (to close 'if' at line 2) near <eof>",
+		}},
+		{"x = 'abc\ny = 1\nz = \"q\\q\"\ngoto nowhere", []string{
+			"src:1: unfinished string near ''abc'",
+			"src:3: invalid escape sequence near '\"q\\q'",
+			"src:4: no visible label 'nowhere' for <goto> at line 4",
+		}},
+		{"for i = 1, do x() end\nwhile x = 1 do end\nrepeat x = until y\nlocal x <foo> = 1", []string{
+			"src:1: unexpected symbol near 'do'",
+			"src:2: 'do' expected near '='",
+			"src:3: unexpected symbol near 'until'",
+			"src:4: unknown attribute 'foo' near '='",
+		}},
+	}
+	l := NewState()
+	for _, tt := range tests {
+		var got []string
+		for _, e := range CheckSyntax(l, strings.NewReader(tt.source), "=src", 0) {
+			got = append(got, e.Error())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q:\ngot  %q\nwant %q", tt.source, got, tt.want)
+		}
+		if len(tt.want) > 0 { // the first error is the one Load reports
+			LoadBuffer(l, tt.source, "=src", "t")
+			if msg, _ := l.ToString(-1); msg != tt.want[0] {
+				t.Errorf("%q: Load reports %q", tt.source, msg)
+			}
+			l.Pop(1)
+		}
+		if l.Top() != 0 {
+			t.Fatalf("%q: %d values left on the stack", tt.source, l.Top())
+		}
+	}
+	if errs := CheckSyntax(l, strings.NewReader("x = = 1\ny = = 2\nz = = 3"), "=src", 2); len(errs) != 2 {
+		t.Errorf("got %d errors with a limit of 2", len(errs))
+	}
+}
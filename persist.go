@@ -0,0 +1,556 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// PersistOptions configure Persist and Unpersist.
+type PersistOptions struct {
+	// Permanents is the stack index of a table of the values that are not
+	// written but referred to by name, such as Go functions, which cannot
+	// be written, and tables that the restored values should share with
+	// the state, such as the library tables. For Persist, its keys are the
+	// values and its values the names; for Unpersist, its keys are the
+	// names. The names are strings. 0 selects the default permanents: the
+	// modules in package.loaded, such as "string", the Go functions and
+	// tables in them, such as "string.format", the metatables registered
+	// with NewMetaTable, as "registry.FILE*", and the metatables of the
+	// basic types, as "metatable.string".
+	Permanents int
+	// PersistUserData returns the bytes that stand for the data of a full
+	// userdata. Without it, userdata cannot be persisted.
+	PersistUserData func(l *State, data interface{}) ([]byte, error)
+	// UnpersistUserData returns the data of a userdata from the bytes that
+	// PersistUserData returned.
+	UnpersistUserData func(l *State, b []byte) (interface{}, error)
+}
+
+// persistSignature starts the output of Persist, followed by the version
+// of the format.
+const persistSignature = "\x1bLuaP\x01"
+
+// The tags of the values written by Persist. A table, a closure, a
+// prototype, an upvalue or a userdata is written once, in full, and then by
+// reference to its number in the order of writing.
+const (
+	persistNil byte = iota
+	persistFalse
+	persistTrue
+	persistInteger
+	persistFloat
+	persistString
+	persistReference
+	persistPermanent
+	persistTable
+	persistClosure
+	persistPrototype
+	persistUpValue
+	persistUserData
+)
+
+// Persist writes the value on the top of the stack to w, together with all
+// the values reachable from it, so that Unpersist can restore them in this
+// or another state, also in another process: the fields and metatables of
+// tables, the prototypes and upvalues of Lua functions and the data,
+// metatables and user values of full userdata. Values that are shared or
+// cyclic are restored that way; upvalues that several functions share are
+// shared again. The value stays on the stack.
+//
+// The permanents of opts are written by name. Other Go functions, threads
+// and light userdata cannot be persisted, and full userdata only through
+// opts.PersistUserData; for them, Persist returns an error and writes
+// nothing. Lua functions keep their debug information. The value on the
+// top of the stack is written in full even when it is a permanent, so that
+// Persist can save a table such as the globals.
+func Persist(l *State, w io.Writer, opts PersistOptions) (err error) {
+	p := &persister{l: l, opts: opts, refs: make(map[interface{}]int)}
+	if p.permanents, err = persistPermanents(l, opts.Permanents); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(persistError)
+			if !ok {
+				panic(r)
+			}
+			err = e.err
+		}
+	}()
+	p.buf.WriteString(persistSignature)
+	p.value(l.stack[l.top-1], 0, true)
+	_, err = w.Write(p.buf.Bytes())
+	return err
+}
+
+// Unpersist reads the values written by Persist from r and pushes the
+// value that was on the top of the stack. The permanents of opts must have
+// the names used by Persist. It returns an error, and pushes nothing, if
+// the input is not valid or refers to a missing permanent. Functions are
+// restored from their bytecode, which is not verified, so like binary
+// chunks given to load, the input must come from a trusted source.
+func Unpersist(l *State, r io.Reader, opts PersistOptions) (err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(persistSignature)) {
+		return errors.New("lua: unpersist: not the output of Persist")
+	}
+	u := &unpersister{l: l, opts: opts, data: data[len(persistSignature):]}
+	if u.permanents, err = unpersistPermanents(l, opts.Permanents); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(persistError)
+			if !ok {
+				panic(r)
+			}
+			err = e.err
+		}
+	}()
+	v := u.value(0)
+	if len(u.data) > 0 {
+		u.fail("trailing data")
+	}
+	l.apiPush(v)
+	return nil
+}
+
+// A persistError carries an error of Persist or Unpersist out of the
+// recursion.
+type persistError struct{ err error }
+
+// persistPermanents returns the names of the permanents at index, or of
+// the default permanents for 0.
+func persistPermanents(l *State, index int) (map[interface{}]string, error) {
+	names := make(map[interface{}]string)
+	if index == 0 {
+		defaultPermanents(l, func(name string, v value) {
+			if _, ok := names[v]; !ok {
+				names[v] = name
+			}
+		})
+		return names, nil
+	}
+	t, ok := l.indexToValue(index).(*table)
+	if !ok {
+		return nil, errors.New("lua: persist: permanents must be a table")
+	}
+	var err error
+	t.each(func(k, v value) {
+		if name, ok := v.(string); ok {
+			names[k] = name
+		} else if err == nil {
+			err = fmt.Errorf("lua: persist: permanent name is a %s, not a string", l.valueToType(v))
+		}
+	})
+	return names, err
+}
+
+// unpersistPermanents returns the permanents at index by name, or the
+// default permanents for 0.
+func unpersistPermanents(l *State, index int) (map[string]value, error) {
+	values := make(map[string]value)
+	if index == 0 {
+		defaultPermanents(l, func(name string, v value) { values[name] = v })
+		return values, nil
+	}
+	t, ok := l.indexToValue(index).(*table)
+	if !ok {
+		return nil, errors.New("lua: unpersist: permanents must be a table")
+	}
+	t.each(func(k, v value) {
+		if name, ok := k.(string); ok {
+			values[name] = v
+		}
+	})
+	return values, nil
+}
+
+// defaultPermanents calls f with the default permanents, described at
+// PersistOptions, in a fixed order so that the first name of a value that
+// has several is always the same.
+func defaultPermanents(l *State, f func(name string, v value)) {
+	fields := func(prefix string, t *table) {
+		var keys []string
+		t.each(func(k, v value) {
+			if k, ok := k.(string); ok {
+				switch v.(type) {
+				case *table, *goFunction, *goClosure:
+					keys = append(keys, k)
+				}
+			}
+		})
+		sort.Strings(keys)
+		for _, k := range keys {
+			f(prefix+k, t.atString(k))
+		}
+	}
+	registry := l.global.registry
+	if loaded, ok := registry.atString("_LOADED").(*table); ok {
+		var names []string
+		loaded.each(func(k, v value) {
+			if k, ok := k.(string); ok {
+				if _, ok := v.(*table); ok {
+					names = append(names, k)
+				}
+			}
+		})
+		sort.Strings(names)
+		for _, name := range names {
+			f(name, loaded.atString(name))
+		}
+		for _, name := range names {
+			fields(name+".", loaded.atString(name).(*table))
+		}
+	}
+	fields("registry.", registry)
+	for t, mt := range l.global.metaTables {
+		if mt != nil {
+			f("metatable."+Type(t).String(), mt)
+		}
+	}
+}
+
+// each calls f for every field of t.
+func (t *table) each(f func(k, v value)) {
+	for i, v := range t.array {
+		if v != nil {
+			f(int64(i+1), v)
+		}
+	}
+	t.hash.each(f)
+}
+
+type persister struct {
+	l          *State
+	opts       PersistOptions
+	permanents map[interface{}]string
+	refs       map[interface{}]int // table, closure, prototype, upvalue or userdata -> number
+	buf        bytes.Buffer
+}
+
+func (p *persister) fail(format string, a ...interface{}) {
+	panic(persistError{fmt.Errorf("lua: persist: "+format, a...)})
+}
+
+func (p *persister) byte(b byte) { p.buf.WriteByte(b) }
+
+func (p *persister) uint(x uint64) { p.buf.Write(binary.AppendUvarint(nil, x)) }
+
+func (p *persister) string(s string) {
+	p.uint(uint64(len(s)))
+	p.buf.WriteString(s)
+}
+
+// ref writes a reference to o if it was written before, or registers it to
+// be written now, which the caller does.
+func (p *persister) ref(o interface{}) bool {
+	if n, ok := p.refs[o]; ok {
+		p.byte(persistReference)
+		p.uint(uint64(n))
+		return true
+	}
+	p.refs[o] = len(p.refs)
+	return false
+}
+
+func (p *persister) value(v value, depth int, root bool) {
+	switch v := v.(type) {
+	case nil:
+		p.byte(persistNil)
+		return
+	case bool:
+		if v {
+			p.byte(persistTrue)
+		} else {
+			p.byte(persistFalse)
+		}
+		return
+	case int64:
+		p.byte(persistInteger)
+		p.buf.Write(binary.AppendVarint(nil, v))
+		return
+	case float64:
+		p.byte(persistFloat)
+		p.buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+		return
+	case string:
+		p.byte(persistString)
+		p.string(v)
+		return
+	}
+	if _, ok := p.refs[v]; !ok && !root {
+		if name, ok := p.permanents[v]; ok {
+			p.byte(persistPermanent)
+			p.string(name)
+			return
+		}
+	}
+	if depth > p.l.tableDepthLimit() {
+		p.fail("values nested too deep (limit is %d)", p.l.tableDepthLimit())
+	}
+	switch v := v.(type) {
+	case *table:
+		if p.ref(v) {
+			return
+		}
+		p.byte(persistTable)
+		n := len(v.array)
+		for n > 0 && v.array[n-1] == nil {
+			n--
+		}
+		p.uint(uint64(n))
+		for _, x := range v.array[:n] {
+			p.value(x, depth+1, false)
+		}
+		p.uint(uint64(v.hash.count))
+		v.hash.each(func(k, x value) {
+			p.value(k, depth+1, false)
+			p.value(x, depth+1, false)
+		})
+		p.metaTable(v.metaTable, depth)
+		if v.frozen {
+			p.byte(persistTrue)
+		} else {
+			p.byte(persistFalse)
+		}
+	case *luaClosure:
+		if p.ref(v) {
+			return
+		}
+		p.byte(persistClosure)
+		if !p.ref(v.prototype) {
+			var b bytes.Buffer
+			if err := p.l.dump(v.prototype, &b, false); err != nil {
+				p.fail("%v", err)
+			}
+			p.byte(persistPrototype)
+			p.string(b.String())
+		}
+		for _, uv := range v.upValues {
+			if !p.ref(uv) {
+				p.byte(persistUpValue)
+				p.value(uv.value(), depth+1, false)
+			}
+		}
+	case *userData:
+		if p.opts.PersistUserData == nil {
+			p.fail("cannot persist a userdata without PersistUserData")
+		}
+		if p.ref(v) {
+			return
+		}
+		b, err := p.opts.PersistUserData(p.l, v.data)
+		if err != nil {
+			p.fail("%v", err)
+		}
+		p.byte(persistUserData)
+		p.string(string(b))
+		p.metaTable(v.metaTable, depth)
+		p.metaTable(v.env, depth)
+	default:
+		p.fail("cannot persist a %s", p.l.valueToType(v))
+	}
+}
+
+// metaTable writes a metatable or user value, which may be nil.
+func (p *persister) metaTable(t *table, depth int) {
+	if t == nil {
+		p.byte(persistNil)
+	} else {
+		p.value(t, depth+1, false)
+	}
+}
+
+type unpersister struct {
+	l          *State
+	opts       PersistOptions
+	permanents map[string]value
+	objects    []interface{} // the referenced objects in the order of writing
+	data       []byte
+}
+
+func (u *unpersister) fail(format string, a ...interface{}) {
+	panic(persistError{fmt.Errorf("lua: unpersist: "+format, a...)})
+}
+
+func (u *unpersister) byte() byte {
+	if len(u.data) == 0 {
+		u.fail("unexpected end of data")
+	}
+	b := u.data[0]
+	u.data = u.data[1:]
+	return b
+}
+
+func (u *unpersister) uint() uint64 {
+	x, n := binary.Uvarint(u.data)
+	if n <= 0 {
+		u.fail("malformed number")
+	}
+	u.data = u.data[n:]
+	return x
+}
+
+// count reads a number of elements, each of which takes at least one byte.
+func (u *unpersister) count() int {
+	n := u.uint()
+	if n > uint64(len(u.data)) {
+		u.fail("malformed count")
+	}
+	return int(n)
+}
+
+func (u *unpersister) string() string {
+	n := u.count()
+	s := string(u.data[:n])
+	u.data = u.data[n:]
+	return s
+}
+
+func (u *unpersister) register(o interface{}) { u.objects = append(u.objects, o) }
+
+// reference reads the number of an object read before.
+func (u *unpersister) reference() interface{} {
+	n := u.uint()
+	if n >= uint64(len(u.objects)) {
+		u.fail("invalid reference")
+	}
+	return u.objects[n]
+}
+
+func (u *unpersister) value(depth int) value {
+	if depth > u.l.tableDepthLimit() {
+		u.fail("values nested too deep (limit is %d)", u.l.tableDepthLimit())
+	}
+	switch tag := u.byte(); tag {
+	case persistNil:
+		return nil
+	case persistFalse:
+		return false
+	case persistTrue:
+		return true
+	case persistInteger:
+		x, n := binary.Varint(u.data)
+		if n <= 0 {
+			u.fail("malformed number")
+		}
+		u.data = u.data[n:]
+		return x
+	case persistFloat:
+		if len(u.data) < 8 {
+			u.fail("unexpected end of data")
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(u.data))
+		u.data = u.data[8:]
+		return f
+	case persistString:
+		return u.string()
+	case persistReference:
+		switch o := u.reference().(type) {
+		case *table, *luaClosure, *userData:
+			return o
+		}
+		u.fail("invalid reference")
+	case persistPermanent:
+		name := u.string()
+		v, ok := u.permanents[name]
+		if !ok {
+			u.fail("missing permanent %q", name)
+		}
+		return v
+	case persistTable:
+		t := newTable()
+		u.register(t)
+		n := u.count()
+		t.array = make([]value, n)
+		for i := range t.array {
+			t.array[i] = u.value(depth + 1)
+		}
+		for i := u.count(); i > 0; i-- {
+			k := u.value(depth + 1)
+			if f, ok := k.(float64); k == nil || ok && math.IsNaN(f) {
+				u.fail("invalid table key")
+			}
+			t.put(u.l, k, u.value(depth+1))
+		}
+		t.metaTable = u.metaTable(depth)
+		t.frozen = u.byte() == persistTrue
+		return t
+	case persistClosure:
+		c := &luaClosure{}
+		u.register(c)
+		switch u.byte() {
+		case persistReference:
+			p, ok := u.reference().(*prototype)
+			if !ok {
+				u.fail("invalid reference")
+			}
+			c.prototype = p
+		case persistPrototype:
+			f, err := u.l.undump(bytes.NewReader([]byte(u.string())), "")
+			if err != nil {
+				u.fail("%v", err)
+			}
+			u.l.top--
+			c.prototype = f.prototype
+			u.register(c.prototype)
+		default:
+			u.fail("malformed function")
+		}
+		c.upValues = make([]*upValue, len(c.prototype.upValues))
+		for i := range c.upValues {
+			switch u.byte() {
+			case persistReference:
+				uv, ok := u.reference().(*upValue)
+				if !ok {
+					u.fail("invalid reference")
+				}
+				c.upValues[i] = uv
+			case persistUpValue:
+				uv := u.l.newUpValue()
+				u.register(uv)
+				uv.closed = u.value(depth + 1)
+				c.upValues[i] = uv
+			default:
+				u.fail("malformed function")
+			}
+		}
+		return c
+	case persistUserData:
+		if u.opts.UnpersistUserData == nil {
+			u.fail("cannot unpersist a userdata without UnpersistUserData")
+		}
+		d := &userData{}
+		u.register(d)
+		var err error
+		if d.data, err = u.opts.UnpersistUserData(u.l, []byte(u.string())); err != nil {
+			u.fail("%v", err)
+		}
+		d.metaTable = u.metaTable(depth)
+		d.env = u.metaTable(depth)
+		return d
+	}
+	u.fail("malformed value")
+	panic("unreachable")
+}
+
+// metaTable reads a metatable or user value, which may be nil.
+func (u *unpersister) metaTable(depth int) *table {
+	switch v := u.value(depth + 1).(type) {
+	case nil:
+		return nil
+	case *table:
+		return v
+	}
+	u.fail("metatable is not a table")
+	panic("unreachable")
+}
@@ -0,0 +1,209 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPersist(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		local count = 0
+		local function counter() count = count + 1 return count end
+		local function peek() return count end
+		local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		local point = setmetatable({x = 1, y = 2}, {__tostring = function(p) return p.x .. "," .. p.y end})
+		save = {
+			counter = counter, peek = peek, fib = fib, point = point,
+			list = {1, 2.5, "three", true, [10] = -7, [1.5] = "float key"},
+			format = string.format, strings = string,
+			frozen = table.freeze({"f"}),
+		}
+		save.self = save
+		save.alias = save.list
+		counter()
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("save")
+	var b bytes.Buffer
+	if err := Persist(l, &b, PersistOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Top() != 1 {
+		t.Errorf("Persist left %d values on the stack", l.Top())
+	}
+
+	m := NewState()
+	OpenLibraries(m)
+	if err := Unpersist(m, bytes.NewReader(b.Bytes()), PersistOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	m.SetGlobal("save")
+	if err := DoString(m, `
+		assert(save.self == save and save.alias == save.list)
+		assert(save.counter() == 2 and save.peek() == 2, "shared upvalue")
+		assert(save.fib(10) == 55)
+		assert(tostring(save.point) == "1,2")
+		local l = save.list
+		assert(l[1] == 1 and math.type(l[1]) == "integer" and l[2] == 2.5 and l[3] == "three" and l[4] == true)
+		assert(l[10] == -7 and l[1.5] == "float key")
+		assert(save.format == string.format and save.strings == string, "permanents")
+		assert(table.isfrozen(save.frozen) and save.frozen[1] == "f")
+		assert(debug.getinfo(save.fib, "S").linedefined == 5, "debug information")
+	`); err != nil {
+		t.Error(err)
+	}
+
+	// The original is untouched.
+	if err := DoString(l, `assert(save.peek() == 1)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPersistPermanents(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Register("host", func(l *State) int { l.PushString("host"); return 1 })
+	if err := DoString(l, `save = {f = host} host = nil`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("save")
+	var b bytes.Buffer
+	if err := Persist(l, &b, PersistOptions{}); err == nil || !strings.Contains(err.Error(), "cannot persist a function") {
+		t.Errorf("Go function persisted: %v", err)
+	}
+	if b.Len() != 0 {
+		t.Error("Persist wrote output on error")
+	}
+
+	l.NewTable()
+	l.Global("save")
+	l.Field(-1, "f")
+	l.Remove(-2)
+	l.PushString("host")
+	l.SetTable(-3)
+	l.PushValue(-2)
+	if err := Persist(l, &b, PersistOptions{Permanents: -2}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewState()
+	OpenLibraries(m)
+	if err := Unpersist(m, bytes.NewReader(b.Bytes()), PersistOptions{Permanents: 0}); err == nil || !strings.Contains(err.Error(), `missing permanent "host"`) {
+		t.Errorf("missing permanent: %v", err)
+	}
+	m.NewTable()
+	m.PushGoFunction(func(l *State) int { l.PushString("other host"); return 1 })
+	m.SetField(-2, "host")
+	if err := Unpersist(m, bytes.NewReader(b.Bytes()), PersistOptions{Permanents: -1}); err != nil {
+		t.Fatal(err)
+	}
+	m.Field(-1, "f")
+	m.Call(0, 1)
+	if s, _ := m.ToString(-1); s != "other host" {
+		t.Errorf("permanent called %q", s)
+	}
+}
+
+func TestPersistUserData(t *testing.T) {
+	type point struct{ x, y int }
+	opts := PersistOptions{
+		PersistUserData: func(l *State, data interface{}) ([]byte, error) {
+			p, ok := data.(*point)
+			if !ok {
+				return nil, errors.New("not a point")
+			}
+			return []byte{byte(p.x), byte(p.y)}, nil
+		},
+		UnpersistUserData: func(l *State, b []byte) (interface{}, error) {
+			if len(b) != 2 {
+				return nil, errors.New("bad point")
+			}
+			return &point{int(b[0]), int(b[1])}, nil
+		},
+	}
+	l := NewState()
+	OpenLibraries(l)
+	l.PushUserData(&point{3, 4})
+	NewMetaTable(l, "point")
+	l.SetMetaTable(-2)
+	var b bytes.Buffer
+	if err := Persist(l, &b, PersistOptions{}); err == nil {
+		t.Error("userdata persisted without PersistUserData")
+	}
+	if err := Persist(l, &b, opts); err != nil {
+		t.Fatal(err)
+	}
+	l.PushUserData("not a point")
+	if err := Persist(l, new(bytes.Buffer), opts); err == nil || !strings.Contains(err.Error(), "not a point") {
+		t.Errorf("callback error: %v", err)
+	}
+
+	m := NewState()
+	OpenLibraries(m)
+	NewMetaTable(m, "point")
+	m.Pop(1)
+	if err := Unpersist(m, bytes.NewReader(b.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := CheckUserData(m, -1, "point").(*point); !ok || *p != (point{3, 4}) {
+		t.Errorf("userdata restored as %v", m.ToUserData(-1))
+	}
+}
+
+func TestPersistErrors(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `save = {co = coroutine.create(print)}`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("save")
+	var b bytes.Buffer
+	if err := Persist(l, &b, PersistOptions{}); err == nil || !strings.Contains(err.Error(), "cannot persist a thread") {
+		t.Errorf("thread persisted: %v", err)
+	}
+
+	l.PushString("x")
+	b.Reset()
+	if err := Persist(l, &b, PersistOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	for _, input := range []string{"", "not persisted", string(data[:len(data)-1]), string(data) + "x", persistSignature + "\xff"} {
+		top := l.Top()
+		if err := Unpersist(l, strings.NewReader(input), PersistOptions{}); err == nil {
+			t.Errorf("Unpersist(%q) succeeded", input)
+		}
+		if l.Top() != top {
+			t.Errorf("Unpersist(%q) changed the stack", input)
+		}
+	}
+}
+
+func TestUnpersistCorruptedFunction(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `save = function(a) local t = {a, "x", 1.5} return #t end`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("save")
+	var b bytes.Buffer
+	if err := Persist(l, &b, PersistOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	for i := len(persistSignature); i < len(data); i++ {
+		for _, c := range []byte{0x00, 0x7f, 0xff} {
+			corrupted := append([]byte(nil), data...)
+			corrupted[i] = c
+			top := l.Top()
+			if err := Unpersist(l, bytes.NewReader(corrupted), PersistOptions{}); err == nil {
+				l.SetTop(top)
+			}
+		}
+	}
+}
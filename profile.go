@@ -0,0 +1,290 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// profileCheckCount is the number of instructions between checks of the
+// sampling clock.
+const profileCheckCount = 1000
+
+// DefaultProfileInterval is the sampling interval of StartProfile when none
+// is given, the rate of the Go CPU profiler.
+const DefaultProfileInterval = 10 * time.Millisecond
+
+// A profiler is the state of StartProfile.
+type profiler struct {
+	l        *State
+	w        io.Writer
+	interval time.Duration
+	start    time.Time
+	next     time.Time // the time of the next sample
+	stopped  bool
+
+	hook     Hook // the hook installed before, which the profiler chains
+	mask     byte
+	count    int
+	internal bool
+
+	functions map[profileFunction]int // function -> id
+	locations map[profileLocation]int // location -> id
+	samples   map[string]int          // stack of location ids -> samples
+	stacks    []string                // the keys of samples in the order seen
+}
+
+type profileFunction struct {
+	key  interface{} // *prototype or the entry PC of a Go function
+	name string
+}
+
+type profileLocation struct {
+	function, line int
+}
+
+// StartProfile starts a sampling profiler for the Lua code that l and the
+// coroutines it creates from now on run. About once every interval of
+// wall-clock time, it records the stack of Lua functions running, with
+// their current lines, and the Go functions called from Lua on that stack.
+// StopProfile writes the samples to w in the format of runtime/pprof, so
+// that go tool pprof shows them; the sample types are those of a Go CPU
+// profile, so a profile of the host taken over the same period can be
+// viewed together with it. An interval of 0 means DefaultProfileInterval.
+//
+// The profiler samples from a count hook, which is chained to any hook
+// already installed, so it only samples while Lua instructions run: the
+// time spent in a Go function shows in the Go profile of the host, not in
+// the Lua profile. It is an error to start a second profile on the same
+// state.
+func StartProfile(l *State, w io.Writer, interval time.Duration) error {
+	if l.global.profiler != nil {
+		return fmt.Errorf("lua: profiling already enabled")
+	}
+	if interval <= 0 {
+		interval = DefaultProfileInterval
+	}
+	p := &profiler{
+		l: l, w: w, interval: interval, start: time.Now(),
+		hook: l.hooker, mask: l.hookMask, count: l.baseHookCount, internal: l.internalHook,
+		functions: make(map[profileFunction]int),
+		locations: make(map[profileLocation]int),
+		samples:   make(map[string]int),
+	}
+	p.next = p.start.Add(interval)
+	checkCount := profileCheckCount
+	if p.mask&MaskCount != 0 {
+		checkCount = p.count
+	}
+	SetDebugHook(l, p.sample, p.mask|MaskCount, checkCount)
+	l.internalHook = p.internal
+	l.global.profiler = p
+	return nil
+}
+
+// StopProfile stops the profiler started with StartProfile, restores the
+// hook that was installed before and writes the profile.
+func StopProfile(l *State) error {
+	p := l.global.profiler
+	if p == nil {
+		return fmt.Errorf("lua: profiling not enabled")
+	}
+	l.global.profiler, p.stopped = nil, true
+	SetDebugHook(p.l, p.hook, p.mask, p.count)
+	p.l.internalHook = p.internal
+	return p.write(time.Now())
+}
+
+var hookEventMasks = []byte{MaskCall, MaskReturn, MaskLine, MaskCount, MaskCall}
+
+func (p *profiler) sample(l *State, d Debug) {
+	if !p.stopped && d.Event == HookCount {
+		if now := time.Now(); !now.Before(p.next) {
+			p.next = now.Add(p.interval)
+			p.record(l)
+		}
+	}
+	if p.hook != nil && p.mask&hookEventMasks[d.Event] != 0 {
+		p.hook(l, d)
+	}
+}
+
+// record adds a sample of the stack of l.
+func (p *profiler) record(l *State) {
+	var stack []byte
+	for ci := l.callInfo; ci != &l.baseCallInfo; ci = ci.previous {
+		fn, line := p.function(l, ci)
+		loc := profileLocation{fn, line}
+		id, ok := p.locations[loc]
+		if !ok {
+			id = len(p.locations) + 1
+			p.locations[loc] = id
+		}
+		stack = appendVarint(stack, uint64(id))
+	}
+	key := string(stack)
+	if _, ok := p.samples[key]; !ok {
+		p.stacks = append(p.stacks, key)
+	}
+	p.samples[key]++
+}
+
+// function returns the id of the function running in ci and its current
+// line. A function gets the name by which it was called, so the same
+// function called by different names shows as several functions.
+func (p *profiler) function(l *State, ci *callInfo) (int, int) {
+	var name string
+	if !ci.isCallStatus(callStatusTail) && ci.previous.isLua() {
+		name, _ = l.functionName(ci.previous)
+	}
+	var f profileFunction
+	line := 0
+	switch fn := l.stack[ci.function].(type) {
+	case *luaClosure:
+		f.key, line = fn.prototype, l.currentLine(ci)
+	case *goFunction:
+		f.key = goFunctionPC(fn.Function)
+	case *goClosure:
+		f.key = goFunctionPC(fn.function)
+	}
+	f.name = name
+	id, ok := p.functions[f]
+	if !ok {
+		id = len(p.functions) + 1
+		p.functions[f] = id
+	}
+	return id, line
+}
+
+// write writes the profile in the gzip-compressed protocol buffer format
+// of pprof, described in github.com/google/pprof/proto/profile.proto.
+func (p *profiler) write(end time.Time) error {
+	var b protoBuffer
+	indexes := map[string]int{"": 0}
+	stringTable := []string{""}
+	str := func(s string) uint64 {
+		i, ok := indexes[s]
+		if !ok {
+			i = len(stringTable)
+			indexes[s] = i
+			stringTable = append(stringTable, s)
+		}
+		return uint64(i)
+	}
+	valueType := func(tag int, typ, unit string) {
+		var m protoBuffer
+		m.uint64(1, str(typ))
+		m.uint64(2, str(unit))
+		b.message(tag, &m)
+	}
+	valueType(1, "samples", "count")
+	valueType(1, "cpu", "nanoseconds")
+	for _, key := range p.stacks {
+		var m protoBuffer
+		m.bytes(1, []byte(key)) // packed location ids
+		n := uint64(p.samples[key])
+		m.bytes(2, appendVarint(appendVarint(nil, n), n*uint64(p.interval)))
+		b.message(2, &m)
+	}
+	for loc, id := range p.locations {
+		var m, line protoBuffer
+		m.uint64(1, uint64(id))
+		line.uint64(1, uint64(loc.function))
+		line.uint64(2, uint64(loc.line))
+		m.message(4, &line)
+		b.message(4, &m)
+	}
+	for f, id := range p.functions {
+		name, systemName, file, start := p.describe(f)
+		var m protoBuffer
+		m.uint64(1, uint64(id))
+		m.uint64(2, str(name))
+		m.uint64(3, str(systemName))
+		m.uint64(4, str(file))
+		m.uint64(5, uint64(start))
+		b.message(5, &m)
+	}
+	// The strings of the sample types and functions are all known now.
+	var tail protoBuffer
+	tail.uint64(9, uint64(p.start.UnixNano()))
+	tail.uint64(10, uint64(end.Sub(p.start)))
+	var period protoBuffer
+	period.uint64(1, str("cpu"))
+	period.uint64(2, str("nanoseconds"))
+	tail.message(11, &period)
+	tail.uint64(12, uint64(p.interval))
+	for _, s := range stringTable {
+		b.bytes(6, []byte(s))
+	}
+	b.Write(tail.Bytes())
+	z := gzip.NewWriter(p.w)
+	if _, err := z.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// describe returns the name, system name, file and first line of a
+// function. Lua functions are named like in tracebacks and their system
+// name is their source and line; Go functions have their Go name and file.
+func (p *profiler) describe(f profileFunction) (name, systemName, file string, start int) {
+	switch key := f.key.(type) {
+	case *prototype:
+		file = strings.TrimPrefix(key.source, "@")
+		start = key.lineDefined
+		systemName = fmt.Sprintf("%s:%d", chunkID(key.source), start)
+		switch {
+		case f.name != "":
+			name = f.name
+		case start == 0:
+			name = "main chunk"
+		default:
+			name = fmt.Sprintf("function <%s>", systemName)
+		}
+	case uintptr:
+		name, file = "?", "[Go]"
+		if fnName, fnFile, line := goFunctionInfo(key); fnName != "" {
+			systemName, file, start = fnName, fnFile, line
+			name = systemName
+		}
+		if f.name != "" {
+			name = f.name
+		}
+	}
+	return
+}
+
+// A protoBuffer encodes a protocol buffer message.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func (b *protoBuffer) varint(x uint64) { b.Write(appendVarint(nil, x)) }
+
+// uint64 writes a varint field, omitting zero as protocol buffers do.
+func (b *protoBuffer) uint64(tag int, x uint64) {
+	if x != 0 {
+		b.varint(uint64(tag) << 3)
+		b.varint(x)
+	}
+}
+
+// bytes writes a length-delimited field.
+func (b *protoBuffer) bytes(tag int, data []byte) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) message(tag int, m *protoBuffer) { b.bytes(tag, m.Bytes()) }
@@ -0,0 +1,186 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// protoFields splits a protocol buffer message into its fields: varints
+// as uint64 and length-delimited fields as []byte.
+func protoFields(t *testing.T, b []byte) (fields []struct {
+	tag   int
+	value interface{}
+}) {
+	varint := func() uint64 {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("truncated varint")
+		}
+		b = b[n:]
+		return x
+	}
+	for len(b) > 0 {
+		key := varint()
+		f := struct {
+			tag   int
+			value interface{}
+		}{tag: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.value = varint()
+		case 2:
+			n := varint()
+			f.value, b = b[:n], b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return
+}
+
+func unpackVarints(b []byte) (list []uint64) {
+	for len(b) > 0 {
+		x, n := binary.Uvarint(b)
+		list, b = append(list, x), b[n:]
+	}
+	return list
+}
+
+// samplesByFunction decodes a profile and returns the samples of each
+// function name, counting each function once per sample.
+func samplesByFunction(t *testing.T, profile []byte) map[string]int {
+	z, err := gzip.NewReader(bytes.NewReader(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stringTable []string
+	functionNames := map[uint64]uint64{} // function id -> string index
+	locationFunctions := map[uint64]uint64{}
+	var samples []struct{ locations, values []uint64 }
+	for _, f := range protoFields(t, data) {
+		switch f.tag {
+		case 6:
+			stringTable = append(stringTable, string(f.value.([]byte)))
+		case 5:
+			var id, name uint64
+			for _, g := range protoFields(t, f.value.([]byte)) {
+				switch g.tag {
+				case 1:
+					id = g.value.(uint64)
+				case 2:
+					name = g.value.(uint64)
+				}
+			}
+			functionNames[id] = name
+		case 4:
+			var id, function uint64
+			for _, g := range protoFields(t, f.value.([]byte)) {
+				switch g.tag {
+				case 1:
+					id = g.value.(uint64)
+				case 4:
+					function = protoFields(t, g.value.([]byte))[0].value.(uint64)
+				}
+			}
+			locationFunctions[id] = function
+		case 2:
+			var sample struct{ locations, values []uint64 }
+			for _, g := range protoFields(t, f.value.([]byte)) {
+				packed := unpackVarints(g.value.([]byte))
+				if g.tag == 1 {
+					sample.locations = packed
+				} else {
+					sample.values = packed
+				}
+			}
+			samples = append(samples, sample)
+		}
+	}
+	counts := map[string]int{}
+	for _, s := range samples {
+		seen := map[string]bool{}
+		n := int(s.values[0])
+		for _, loc := range s.locations {
+			name := stringTable[functionNames[locationFunctions[loc]]]
+			if !seen[name] {
+				counts[name] += n
+				seen[name] = true
+			}
+		}
+	}
+	return counts
+}
+
+func TestProfile(t *testing.T) {
+	skipWithoutOS(t)
+	l := NewState()
+	OpenLibraries(l)
+	var out bytes.Buffer
+	if err := StartProfile(l, &out, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartProfile(l, &out, 0); err == nil {
+		t.Error("started a second profile")
+	}
+	err := DoString(l, `
+		local function spin(n) local x = 0 for i = 1, n do x = x + i % 7 end return x end
+		local function light() return spin(1000) end
+		local deadline = os.clock() + 0.1
+		while os.clock() < deadline do
+			spin(100000)
+			pcall(light)
+		end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StopProfile(l); err != nil {
+		t.Fatal(err)
+	}
+	if DebugHook(l) != nil {
+		t.Error("the hook was not removed")
+	}
+	counts := samplesByFunction(t, out.Bytes())
+	if counts["main chunk"] < 20 {
+		t.Fatalf("too few samples: %v", counts)
+	}
+	if counts["spin"] < counts["main chunk"]*3/4 || counts["spin"] <= counts["light"] {
+		t.Errorf("spin is not the hot function: %v", counts)
+	}
+	if err := StopProfile(l); err == nil {
+		t.Error("stopped a profile twice")
+	}
+}
+
+// TestProfileChainsHook checks that a hook installed before the profiler
+// still runs while profiling and is restored afterwards.
+func TestProfileChainsHook(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	lines := 0
+	hook := func(l *State, d Debug) { lines++ }
+	SetDebugHook(l, hook, MaskLine, 0)
+	if err := StartProfile(l, io.Discard, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(l, "local x = 1\nx = x + 1\nx = x + 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopProfile(l); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 3 {
+		t.Errorf("line hook ran %d times, want 3", lines)
+	}
+	if DebugHookMask(l) != MaskLine {
+		t.Errorf("hook mask is %d after the profile", DebugHookMask(l))
+	}
+}
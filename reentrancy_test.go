@@ -0,0 +1,156 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+// openReentrancy registers Go functions that call back into l:
+//
+//	callback(f, ...)   calls f with Call and returns its results
+//	pcallback(f, ...)  like pcall, but with ProtectedCall
+//	tbcall(f, ...)     calls f with a traceback handler and returns the results or the traceback
+func openReentrancy(t *testing.T, l *State) {
+	l.Register("callback", func(l *State) int {
+		n := l.Top()
+		l.Call(n-1, MultipleReturns)
+		return l.Top()
+	})
+	l.Register("pcallback", func(l *State) int {
+		n := l.Top()
+		if err := l.ProtectedCall(n-1, MultipleReturns, 0); err != nil {
+			if l.Top() != 1 {
+				t.Errorf("ProtectedCall left %d values instead of the error", l.Top())
+			}
+			l.PushBoolean(false)
+			l.Insert(1)
+			return 2
+		}
+		l.PushBoolean(true)
+		l.Insert(1)
+		return l.Top()
+	})
+	l.Register("tbcall", func(l *State) int {
+		n := l.Top()
+		l.PushGoFunction(func(l *State) int {
+			Traceback(l, l, CheckString(l, 1), 1)
+			return 1
+		})
+		l.Insert(1)
+		if err := l.ProtectedCall(n-1, MultipleReturns, 1); err != nil {
+			return 1
+		}
+		return l.Top() - 1
+	})
+}
+
+func TestReentrancy(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	openReentrancy(t, l)
+	for _, s := range []string{
+		// results and errors
+		`assert(callback(function(a, b) return a + b, a * b end, 3, 4) == 7)`,
+		`local ok, e = pcall(callback, function() error("boom") end); assert(not ok and e:find("boom"))`,
+		`local ok, e = pcallback(function() error({code = 1}) end); assert(not ok and e.code == 1)`,
+		`local ok, a, b = pcallback(function() return 1, 2 end); assert(ok and a == 1 and b == 2)`,
+		`local ok, e = pcall(callback, setmetatable({}, {__call = function() error("in call") end})); assert(e:find("in call"))`,
+		`local t = setmetatable({}, {__index = function(_, k) return callback(string.rep, k, 2) end}); assert(t.ab == "abab")`,
+		`local ok, e = pcall(table.sort, {3, 2, 1}, function() return callback(error, "cmp") end); assert(e:find("cmp"))`,
+		`local tb = tbcall(function() callback(error, "deep") end)
+		 assert(tb:find("deep") and tb:find("in global 'callback'"), tb)`,
+
+		// nesting and stack accounting
+		`local function f(n) if n == 0 then return 0 end return 1 + callback(f, n - 1) end; assert(f(150) == 150)`,
+		`local function f(n) return callback(f, n + 1) end
+		 local ok, e = pcall(f, 0); assert(not ok and e:find("stack overflow"), e)
+		 assert(callback(function() return 1 end) == 1)`,
+		`local function big(n) local t = {} for i = 1, n do t[i] = i end return table.unpack(t) end
+		 assert(select("#", callback(big, 5000)) == 5000)
+		 assert(select("#", callback(callback, big, 10000)) == 10000)`,
+
+		// yields cannot cross Call
+		`local co = coroutine.wrap(function() return callback(coroutine.yield, 1) end)
+		 local ok, e = pcall(co); assert(not ok and e:find("yield across"), e)`,
+		`local co = coroutine.create(function() return callback(function() coroutine.yield(1) end) end)
+		 assert(not coroutine.resume(co) and coroutine.status(co) == "dead")`,
+
+		// hooks run in nested calls, and a hook may call back
+		`local n = 0; debug.sethook(function() n = n + 1 end, "", 1)
+		 callback(function() for i = 1, 10 do end end)
+		 debug.sethook(); assert(n > 10, n)`,
+		`debug.sethook(function() callback(function() end) end, "", 1)
+		 callback(function() for i = 1, 3 do end end)
+		 debug.sethook()`,
+		`local on = true
+		 debug.sethook(function() if on then on = false; error("hook error") end end, "", 5)
+		 local ok, e = pcall(callback, function() for i = 1, 100 do end end)
+		 debug.sethook(); assert(not ok and e:find("hook error"))`,
+
+		// errors in __close
+		`local ok, e = pcall(callback, function()
+		   local x <close> = setmetatable({}, {__close = function() error("close") end})
+		 end)
+		 assert(not ok and e:find("close"), e)`,
+		`local ok, e = pcallback(function()
+		   local x <close> = setmetatable({}, {__close = function() error("close2") end})
+		   error("body")
+		 end)
+		 assert(not ok and e:find("close2"), e)`,
+		`local ok, e = pcallback(function()
+		   local x <close> = setmetatable({}, {__close = function()
+		     debug.sethook(function() debug.sethook(); error("hook in close") end, "", 1)
+		     local y = 1
+		   end})
+		   error("body")
+		 end)
+		 assert(not ok and e:find("hook in close"), e)`,
+	} {
+		top := l.Top()
+		if err := DoString(l, s); err != nil {
+			t.Errorf("%s: %v", strings.TrimSpace(strings.SplitN(s, "\n", 2)[0]), err)
+		}
+		if l.Top() != top {
+			t.Errorf("%s: top %d, want %d", s, l.Top(), top)
+			l.SetTop(top)
+		}
+		// The state is as before the chunk, so that the next one can yield
+		// and be hooked.
+		if l.callInfo != &l.baseCallInfo || l.nestedGoCallCount != 0 || l.nonYieldableCallCount != 1 || !l.allowHook {
+			t.Errorf("%s: %d nested Go calls, %d non-yieldable calls, hooks allowed: %v", s, l.nestedGoCallCount, l.nonYieldableCallCount, l.allowHook)
+		}
+	}
+}
+
+// TestReentrancyCapturedState calls back into a State captured by a Go
+// function, which is not the thread running it when it is called from a
+// coroutine.
+func TestReentrancyCapturedState(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Register("double", func(*State) int {
+		l.Global("f")
+		l.PushInteger(21)
+		l.Call(1, 1)
+		if v, _ := l.ToInteger(-1); v != 42 {
+			t.Errorf("f(21) = %d", v)
+		}
+		l.Pop(1)
+		l.Global("g")
+		l.Call(0, 0)
+		return 0
+	})
+	if err := DoString(l, `
+		function f(x) return x * 2 end
+		function g() local t = {} for i = 1, 1000 do t[i] = i end return table.unpack(t) end
+		local co = coroutine.wrap(function(a) double(); local b = coroutine.yield(a + 1); double(); return b * 2 end)
+		assert(co(1) == 2)
+		assert(co(5) == 10)
+		assert(not pcall(coroutine.wrap(function() double(); error("x") end)))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if l.Top() != 0 || l.nestedGoCallCount != 0 {
+		t.Errorf("top %d, %d nested Go calls", l.Top(), l.nestedGoCallCount)
+	}
+}
@@ -0,0 +1,227 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+const regexHandle = "REGEX*"
+
+// checkRegex returns the regular expression at index, which is either a
+// compiled regex object or a string that is compiled on the fly.
+func checkRegex(l *State, index int) *regexp.Regexp {
+	if re, ok := l.ToUserData(index).(*regexp.Regexp); ok {
+		return re
+	}
+	re, err := regexp.Compile(CheckString(l, index))
+	if err != nil {
+		Errorf(l, "%s", err.Error())
+	}
+	return re
+}
+
+func toRegex(l *State) *regexp.Regexp { return CheckUserData(l, 1, regexHandle).(*regexp.Regexp) }
+
+// regexInit returns the 0-based offset given by the optional init argument
+// at index, or -1 if it lies beyond the end of s.
+func regexInit(l *State, index int, s string) int {
+	init := startPosition(OptInteger64(l, index, 1), len(s))
+	if init > int64(len(s))+1 {
+		return -1
+	}
+	return int(init) - 1
+}
+
+// pushSubmatches pushes the captures of the match loc of s, or the whole
+// match if the expression has no groups. Groups that did not take part in
+// the match are false.
+func pushSubmatches(l *State, s string, loc []int) int {
+	if len(loc) == 2 {
+		l.PushString(s[loc[0]:loc[1]])
+		return 1
+	}
+	n := len(loc)/2 - 1
+	CheckStackWithMessage(l, n, "too many captures")
+	for i := 1; i <= n; i++ {
+		if loc[2*i] < 0 {
+			l.PushBoolean(false)
+		} else {
+			l.PushString(s[loc[2*i]:loc[2*i+1]])
+		}
+	}
+	return n
+}
+
+func regexFind(l *State, re *regexp.Regexp, s string, isFind bool) int {
+	init := regexInit(l, 3, s)
+	if init < 0 {
+		l.PushNil()
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[init:])
+	if loc == nil {
+		l.PushNil()
+		return 1
+	}
+	for i := range loc {
+		if loc[i] >= 0 {
+			loc[i] += init
+		}
+	}
+	if !isFind {
+		return pushSubmatches(l, s, loc)
+	}
+	l.PushInteger(loc[0] + 1)
+	l.PushInteger(loc[1])
+	if len(loc) == 2 {
+		return 2
+	}
+	return 2 + pushSubmatches(l, s, loc)
+}
+
+func regexGmatch(l *State, re *regexp.Regexp, s string) int {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	l.PushGoFunction(func(l *State) int {
+		if len(matches) == 0 {
+			return 0
+		}
+		loc := matches[0]
+		matches = matches[1:]
+		return pushSubmatches(l, s, loc)
+	})
+	return 1
+}
+
+// regexGsub replaces the matches of re in s by the replacement at index 3,
+// which is used like the one of string.gsub.
+func regexGsub(l *State, re *regexp.Regexp, s string) int {
+	n := OptInteger(l, 4, -1)
+	if n < 0 {
+		n = -1
+	}
+	switch l.TypeOf(3) {
+	case TypeString, TypeNumber, TypeTable, TypeFunction:
+	default:
+		ArgumentError(l, 3, "string/function/table expected")
+	}
+	matches := re.FindAllStringSubmatchIndex(s, n)
+	var b bytes.Buffer
+	last := 0
+	for _, loc := range matches {
+		b.WriteString(s[last:loc[0]])
+		last = loc[1]
+		whole := s[loc[0]:loc[1]]
+		switch l.TypeOf(3) {
+		case TypeString, TypeNumber:
+			repl, _ := l.ToString(3)
+			for i := 0; i < len(repl); i++ {
+				if repl[i] != '%' {
+					b.WriteByte(repl[i])
+				} else if i++; i == len(repl) {
+					Errorf(l, "invalid use of '%%' in replacement string")
+				} else if repl[i] == '%' {
+					b.WriteByte('%')
+				} else if d := int(repl[i] - '0'); d == 0 || d == 1 && len(loc) == 2 {
+					b.WriteString(whole)
+				} else if d > 9 || 2*d >= len(loc) {
+					Errorf(l, "invalid capture index %%%c in replacement string", rune(repl[i]))
+				} else if loc[2*d] >= 0 {
+					b.WriteString(s[loc[2*d]:loc[2*d+1]])
+				}
+			}
+			continue
+		case TypeFunction:
+			l.PushValue(3)
+			l.Call(pushSubmatches(l, s, loc), 1)
+		case TypeTable:
+			if k := pushSubmatches(l, s, loc); k > 1 {
+				l.Pop(k - 1) // the first capture is the key
+			}
+			l.Table(3)
+		}
+		if !l.ToBoolean(-1) {
+			b.WriteString(whole)
+		} else if r, ok := l.ToString(-1); ok {
+			b.WriteString(r)
+		} else {
+			Errorf(l, "invalid replacement value (a %s)", TypeNameOf(l, -1))
+		}
+		l.Pop(1)
+	}
+	b.WriteString(s[last:])
+	l.PushString(b.String())
+	l.PushInteger(len(matches))
+	return 2
+}
+
+func regexSplit(l *State, re *regexp.Regexp, s string) int {
+	n := OptInteger(l, 3, -1)
+	if n < 0 {
+		n = -1
+	}
+	parts := re.Split(s, n)
+	l.CreateTable(len(parts), 0)
+	for i, p := range parts {
+		l.PushString(p)
+		l.RawSetInt(-2, i+1)
+	}
+	return 1
+}
+
+var regexMethods = []RegistryFunction{
+	{"find", func(l *State) int { re := toRegex(l); return regexFind(l, re, CheckString(l, 2), true) }},
+	{"gmatch", func(l *State) int { re := toRegex(l); return regexGmatch(l, re, CheckString(l, 2)) }},
+	{"gsub", func(l *State) int { re := toRegex(l); return regexGsub(l, re, CheckString(l, 2)) }},
+	{"match", func(l *State) int { re := toRegex(l); return regexFind(l, re, CheckString(l, 2), false) }},
+	{"split", func(l *State) int { re := toRegex(l); return regexSplit(l, re, CheckString(l, 2)) }},
+	{"__tostring", func(l *State) int { l.PushString(toRegex(l).String()); return 1 }},
+}
+
+var regexLibrary = []RegistryFunction{
+	{"compile", func(l *State) int {
+		// regex.compile(pattern [, flags]) returns a regex object, or nil and
+		// an error message. flags is a combination of the RE2 flags i, m, s
+		// and U.
+		pattern := CheckString(l, 1)
+		if flags := OptString(l, 2, ""); flags != "" {
+			pattern = fmt.Sprintf("(?%s)%s", flags, pattern)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			l.PushNil()
+			l.PushString(err.Error())
+			return 2
+		}
+		l.PushUserData(re)
+		SetMetaTableNamed(l, regexHandle)
+		return 1
+	}},
+	{"find", func(l *State) int { s := CheckString(l, 1); return regexFind(l, checkRegex(l, 2), s, true) }},
+	{"gmatch", func(l *State) int { s := CheckString(l, 1); return regexGmatch(l, checkRegex(l, 2), s) }},
+	{"gsub", func(l *State) int { s := CheckString(l, 1); return regexGsub(l, checkRegex(l, 2), s) }},
+	{"match", func(l *State) int { s := CheckString(l, 1); return regexFind(l, checkRegex(l, 2), s, false) }},
+	{"quote", func(l *State) int { l.PushString(regexp.QuoteMeta(CheckString(l, 1))); return 1 }},
+	{"split", func(l *State) int { s := CheckString(l, 1); return regexSplit(l, checkRegex(l, 2), s) }},
+}
+
+// RegexOpen opens the regex library, which provides regular expressions in
+// RE2 syntax backed by Go's regexp package. Matching takes time linear in
+// the size of the input, so unlike Lua patterns they are safe to use on
+// untrusted input. It is not opened by OpenLibraries; pass it as a
+// preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "regex", Function: lua.RegexOpen})
+//
+// The functions find, match, gmatch and gsub work like their string library
+// counterparts, taking a pattern string or an object made by
+// regex.compile. Positions are byte offsets.
+func RegexOpen(l *State) int {
+	NewMetaTable(l, regexHandle)
+	l.PushValue(-1)
+	l.SetField(-2, "__index")
+	SetFunctions(l, regexMethods, 0)
+	l.Pop(1)
+	NewLibrary(l, regexLibrary)
+	return 1
+}
@@ -0,0 +1,43 @@
+package lua
+
+import "testing"
+
+func TestRegex(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"regex", RegexOpen})
+	if err := DoString(l, `
+		local regex = require("regex")
+		local date = assert(regex.compile([[(\d{4})-(\d{2})-(\d{2})]]))
+		assert(tostring(date) == [[(\d{4})-(\d{2})-(\d{2})]])
+		local y, m, d = date:match("on 2024-03-15.")
+		assert(y == "2024" and m == "03" and d == "15")
+		local s, e, year = date:find("on 2024-03-15.")
+		assert(s == 4 and e == 13 and year == "2024")
+		assert(date:find("2024-03-15", 2) == nil)
+		assert(regex.match("abc", "b") == "b" and regex.find("abc", "c") == 3)
+		assert(regex.match("ac", "a(b)?c") == false)
+
+		local words = {}
+		for w in regex.gmatch("one two  three", [[\w+]]) do words[#words + 1] = w end
+		assert(table.concat(words, ",") == "one,two,three")
+		assert(regex.gsub("hello world", [[(\w+)]], "<%1>") == "<hello> <world>")
+		assert(select(2, regex.gsub("aaa", "a", "b", 2)) == 2)
+		assert(date:gsub("2024-03-15", function(y, m, d) return d .. "." .. m .. "." .. y end) == "15.03.2024")
+		assert(regex.gsub("a b", [[\w]], {a = "A"}) == "A b")
+		assert(table.concat(regex.split("a, b,c", [[,\s*]]), "|") == "a|b|c")
+		assert(regex.quote("a.b") == [[a\.b]])
+		assert(regex.compile("HELLO", "i"):match("say hello") == "hello")
+
+		local re, err = regex.compile("(")
+		assert(re == nil and err:find("missing closing"))
+		assert(not pcall(regex.match, "x", "("))
+		local ok, msg = pcall(regex.gsub, "abc", "(b)", "%9")
+		assert(not ok and msg:find("invalid capture index %9 in replacement string", 1, true), msg)
+
+		-- no exponential backtracking
+		local evil = string.rep("a", 10000)
+		assert(regex.match(evil, "(a*)*b") == nil)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,224 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// An editor reads lines from a terminal in raw mode with basic Emacs-style
+// line editing and a history of the lines entered.
+type editor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	raw     func() (restore func(), err error)
+	history []string
+
+	prompt string
+	line   []rune
+	pos    int
+}
+
+// NewTerminal returns a LineReader for the terminal in, with line editing and
+// a history that the up and down keys browse. The prompts and the line are
+// written to out. If in is not a terminal, or raw mode is not supported on
+// this system, it returns NewLineReader(in, out).
+//
+// The keys are those of Emacs and readline: the arrow keys, Home and End,
+// Backspace and Delete, Ctrl-A and Ctrl-E to move to the start and end of
+// the line, Ctrl-B and Ctrl-F to move by a character, Ctrl-K and Ctrl-U to
+// delete to the end and to the start, Ctrl-W to delete a word, Ctrl-P and
+// Ctrl-N for the history, Ctrl-C to cancel the line and Ctrl-D on an empty
+// line to end the input.
+func NewTerminal(in *os.File, out io.Writer) LineReader {
+	fd := int(in.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return NewLineReader(in, out)
+	}
+	restore()
+	return &editor{in: bufio.NewReader(in), out: out, raw: func() (func(), error) { return makeRaw(fd) }}
+}
+
+func (e *editor) ReadLine(prompt string) (string, error) {
+	if e.raw != nil {
+		restore, err := e.raw()
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+	e.prompt, e.line, e.pos = prompt, nil, 0
+	e.refresh()
+	line, err := e.edit()
+	if err == nil && line != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+	}
+	return line, err
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyCtrlK     = 11
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+func (e *editor) edit() (string, error) {
+	current := len(e.history) // the history entry shown; len(e.history) is the new line
+	var saved []rune          // the new line while browsing the history
+	browse := func(to int) {
+		if to < 0 || to > len(e.history) || to == current {
+			return
+		}
+		if current == len(e.history) {
+			saved = e.line
+		}
+		if current = to; to == len(e.history) {
+			e.line = saved
+		} else {
+			e.line = []rune(e.history[to])
+		}
+		e.pos = len(e.line)
+	}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(e.line) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(e.line), nil
+			}
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C")
+			return "", ErrInterrupt
+		case keyCtrlD:
+			if len(e.line) == 0 {
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case keyCtrlA:
+			e.pos = 0
+		case keyCtrlE:
+			e.pos = len(e.line)
+		case keyCtrlB:
+			e.pos = max(e.pos-1, 0)
+		case keyCtrlF:
+			e.pos = min(e.pos+1, len(e.line))
+		case keyBackspace, keyDelete:
+			e.delete(e.pos-1, e.pos)
+		case keyCtrlK:
+			e.delete(e.pos, len(e.line))
+		case keyCtrlU:
+			e.delete(0, e.pos)
+		case keyCtrlW:
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.line[start-1]) {
+				start--
+			}
+			e.delete(start, e.pos)
+		case keyCtrlP:
+			browse(current - 1)
+		case keyCtrlN:
+			browse(current + 1)
+		case keyEscape:
+			switch e.escape() {
+			case 'A':
+				browse(current - 1)
+			case 'B':
+				browse(current + 1)
+			case 'C':
+				e.pos = min(e.pos+1, len(e.line))
+			case 'D':
+				e.pos = max(e.pos-1, 0)
+			case 'H':
+				e.pos = 0
+			case 'F':
+				e.pos = len(e.line)
+			case '3':
+				e.delete(e.pos, e.pos+1)
+			}
+		default:
+			if r == utf8.RuneError || unicode.IsControl(r) {
+				continue
+			}
+			e.line = append(e.line[:e.pos], append([]rune{r}, e.line[e.pos:]...)...)
+			e.pos++
+		}
+		e.refresh()
+	}
+}
+
+// escape reads the rest of an escape sequence and returns its final byte,
+// or '3' for Delete, which is ESC [ 3 ~. Home and End are also sent as
+// ESC [ 1 ~ and ESC [ 4 ~.
+func (e *editor) escape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+	var param byte
+	for {
+		b, err = e.in.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if b >= '0' && b <= '9' || b == ';' {
+			if param == 0 {
+				param = b
+			}
+			continue
+		}
+		break
+	}
+	if b != '~' {
+		return b
+	}
+	switch param {
+	case '1', '7':
+		return 'H'
+	case '4', '8':
+		return 'F'
+	}
+	return param
+}
+
+// delete removes the runes from start to end, clipped to the line, and moves
+// the cursor to start.
+func (e *editor) delete(start, end int) {
+	start, end = max(start, 0), min(end, len(e.line))
+	if start >= end {
+		return
+	}
+	e.line = append(e.line[:start], e.line[end:]...)
+	e.pos = start
+}
+
+// refresh redraws the line and puts the cursor at its position.
+func (e *editor) refresh() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", e.prompt, string(e.line))
+	if n := len(e.line) - e.pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
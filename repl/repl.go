@@ -0,0 +1,173 @@
+// Package repl implements the interactive mode of a stand-alone Lua
+// interpreter: it reads statements, runs them and prints their results.
+//
+// As in the lua program, a line that is an expression prints its values, a
+// line starting with '=' is a shorthand for "return", and a statement that is
+// not complete yet, such as the first line of a function, is continued on the
+// next lines. The prompts are the values of the globals _PROMPT and _PROMPT2
+// if they are set, and "> " and ">> " otherwise.
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// A LineReader reads the input of a REPL line by line.
+type LineReader interface {
+	// ReadLine shows prompt and returns the next line without its line
+	// ending. At the end of the input it returns io.EOF. If the user cancels
+	// the line, it returns ErrInterrupt.
+	ReadLine(prompt string) (string, error)
+}
+
+// ErrInterrupt is returned by a LineReader whose line was cancelled, e.g.
+// with Ctrl-C. Run discards the statement read so far and continues.
+var ErrInterrupt = errors.New("interrupt")
+
+type plainReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// NewLineReader returns a LineReader that reads lines from in without line
+// editing and writes the prompts to out.
+func NewLineReader(in io.Reader, out io.Writer) LineReader {
+	return &plainReader{in: bufio.NewReader(in), out: out}
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	line, err := r.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// Depth is the nesting depth up to which Run shows the contents of tables
+// in results.
+const Depth = 4
+
+// Run reads statements from in, runs them in l and writes their results and
+// errors to out, until the input ends. l should have its libraries opened.
+func Run(l *lua.State, in LineReader, out io.Writer) error {
+	for {
+		err := runStatement(l, in, out)
+		if err == io.EOF {
+			fmt.Fprintln(out)
+			return nil
+		} else if err == ErrInterrupt {
+			fmt.Fprintln(out)
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// runStatement reads and runs one statement. Errors of the statement are
+// written to out; only errors of in are returned.
+func runStatement(l *lua.State, in LineReader, out io.Writer) error {
+	l.SetTop(0)
+	line, err := in.ReadLine(prompt(l, true))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(line, "=") {
+		line = "return " + line[1:]
+	}
+	if err := loadStatement(l, in, line); err == io.EOF || err == ErrInterrupt {
+		return err
+	} else if err != nil {
+		msg, _ := l.ToString(-1)
+		fmt.Fprintln(out, msg)
+		return nil
+	}
+	if err := call(l); err != nil {
+		msg, _ := l.ToString(-1)
+		fmt.Fprintln(out, msg)
+		return nil
+	}
+	if n := l.Top(); n > 0 {
+		results := make([]string, n)
+		for i := range results {
+			results[i] = lua.Inspect(l, i+1, Depth)
+		}
+		fmt.Fprintln(out, strings.Join(results, "\t"))
+	}
+	return nil
+}
+
+func prompt(l *lua.State, first bool) string {
+	name, p := "_PROMPT", "> "
+	if !first {
+		name, p = "_PROMPT2", ">> "
+	}
+	l.Global(name)
+	if s, ok := l.ToString(-1); ok {
+		p = s
+	}
+	l.Pop(1)
+	return p
+}
+
+// loadStatement compiles line as an expression whose values are returned or,
+// failing that, as a statement. While the statement is incomplete, it reads
+// more lines. It leaves the function or the error message on the stack.
+func loadStatement(l *lua.State, in LineReader, line string) error {
+	if lua.LoadBuffer(l, "return "+line, "=stdin", "t") == nil {
+		return nil
+	}
+	l.Pop(1)
+	for {
+		err := lua.LoadBuffer(l, line, "=stdin", "t")
+		if err == nil || !incomplete(l) {
+			return err
+		}
+		l.Pop(1)
+		more, err := in.ReadLine(prompt(l, false))
+		if err != nil {
+			return err
+		}
+		line += "\n" + more
+	}
+}
+
+// incomplete reports whether the syntax error on the top of the stack was
+// raised at the end of the input, so that more input could complete the
+// statement.
+func incomplete(l *lua.State) bool {
+	msg, _ := l.ToString(-1)
+	return strings.HasSuffix(msg, "<eof>")
+}
+
+// call calls the function on the stack with a traceback for errors, leaving
+// its results or the error message.
+func call(l *lua.State) error {
+	l.PushGoFunction(MessageHandler)
+	l.Insert(1)
+	err := l.ProtectedCall(0, lua.MultipleReturns, 1)
+	l.Remove(1)
+	return err
+}
+
+// MessageHandler is the message handler of the lua program, for use with
+// ProtectedCall. It appends a traceback to the error message. An error
+// object that is not a string is converted with its __tostring metamethod,
+// or replaced by a message that names its type.
+func MessageHandler(l *lua.State) int {
+	msg, ok := l.ToString(1)
+	if !ok {
+		if lua.CallMeta(l, 1, "__tostring") && l.IsString(-1) {
+			return 1
+		}
+		msg = fmt.Sprintf("(error object is a %s value)", lua.TypeNameOf(l, 1))
+	}
+	lua.Traceback(l, l, msg, 1)
+	return 1
+}
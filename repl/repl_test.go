@@ -0,0 +1,123 @@
+package repl
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestRun(t *testing.T) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var out strings.Builder
+	lua.SetStdout(l, &out)
+	input := strings.Join([]string{
+		"1 + 2",
+		"=3 * 4",
+		"x = 5",
+		"x, 'a', nil",
+		"function f(a)",
+		"  return {a, n = a * 2}",
+		"end",
+		"f(x)",
+		"error('boom')",
+		"x = = 1",
+		"print('printed')",
+		"_PROMPT = '$ '",
+		"for i = 1, 2 do",
+		"  print(i)",
+		"end",
+	}, "\n")
+	if err := Run(l, NewLineReader(strings.NewReader(input), &out), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"> 3\n",
+		"> 12\n",
+		"> > 5\t\"a\"\tnil\n",
+		"> >> >> > { 5,\n  n = 10\n}\n",
+		"> stdin:1: boom\nstack traceback:\n",
+		"> stdin:1: unexpected symbol near '='\n",
+		"> printed\n",
+		"> $ >> >> 1\n2\n$ \n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, got)
+		}
+	}
+	if l.Top() != 0 {
+		t.Errorf("Run left %d values on the stack", l.Top())
+	}
+}
+
+func TestRunInterrupt(t *testing.T) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var out strings.Builder
+	in := &scriptedReader{lines: []string{"if true then", "", "=1"}, errs: map[int]error{1: ErrInterrupt}}
+	if err := Run(l, in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "\n1\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type scriptedReader struct {
+	lines []string
+	errs  map[int]error
+	n     int
+}
+
+func (r *scriptedReader) ReadLine(prompt string) (string, error) {
+	defer func() { r.n++ }()
+	if err := r.errs[r.n]; err != nil {
+		return "", err
+	} else if r.n >= len(r.lines) {
+		return "", io.EOF
+	}
+	return r.lines[r.n], nil
+}
+
+func TestEditor(t *testing.T) {
+	var out strings.Builder
+	keys := strings.Join([]string{
+		"hello\r",
+		"abc\x1b[D\x1b[DX\x01Y\x05Z\r",     // insert in the middle, at the start and at the end
+		"one two\x17three\r",               // Ctrl-W deletes a word
+		"abcdef\x1b[D\x1b[D\x0b\x02\x08\r", // Ctrl-K, Ctrl-B, Backspace
+		"\x1b[A\x1b[A\x1b[A\r",             // history
+		"new\x1b[A\x1b[B\r",                // back to the new line
+		"xyz\x01\x1b[3~\x04\x05\x15q\r",    // Delete, Ctrl-D, Ctrl-U
+		"gone\x03",
+		"é\x1bOH\x1b[4~!\r",
+		"\x04",
+	}, "")
+	e := &editor{in: bufio.NewReader(strings.NewReader(keys)), out: &out}
+	var lines []string
+	for {
+		line, err := e.ReadLine("> ")
+		if err == io.EOF {
+			break
+		} else if err == ErrInterrupt {
+			line = "<interrupt>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	want := []string{"hello", "YaXbcZ", "one three", "abd", "YaXbcZ", "new", "q", "<interrupt>", "é!"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	if want := []string{"hello", "YaXbcZ", "one three", "abd", "YaXbcZ", "new", "q", "é!"}; strings.Join(e.history, "|") != strings.Join(want, "|") {
+		t.Errorf("history is %q, want %q", e.history, want)
+	}
+	if !strings.Contains(out.String(), "\r> YaXbcZ\x1b[K") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
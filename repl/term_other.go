@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package repl
+
+import "errors"
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("line editing is not supported on this system")
+}
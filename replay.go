@@ -0,0 +1,197 @@
+package lua
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// A Recording holds the results of the nondeterministic calls made while a
+// state was recording, in the order in which they were made. Replaying it
+// makes a script see exactly the same times, random numbers, input and host
+// callback results again, so a bug report can be reproduced exactly.
+type Recording struct {
+	Calls []RecordedCall
+}
+
+// A RecordedCall is the outcome of one recorded call. Results are nil,
+// bool, int64, float64, string, or map[string]interface{} for tables with
+// string keys, such as the result of os.date("*t").
+type RecordedCall struct {
+	Function string
+	Results  []interface{}
+}
+
+func init() { gob.Register(map[string]interface{}{}) }
+
+// Encode writes the recording to w in gob format.
+func (r *Recording) Encode(w io.Writer) error { return gob.NewEncoder(w).Encode(r) }
+
+// DecodeRecording reads a recording written by Encode.
+func DecodeRecording(r io.Reader) (*Recording, error) {
+	var rec Recording
+	if err := gob.NewDecoder(r).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+type replayer struct {
+	recording *Recording
+	replaying bool
+	next      int // index of the next call to replay
+}
+
+// recordedFunctions are the library functions whose results Record and
+// Replay capture, as library (a key of package.loaded) and field, or as
+// metatable name and method.
+var recordedFunctions = []struct{ library, name string }{
+	{"os", "time"},
+	{"os", "clock"},
+	{"os", "timens"},
+	{"os", "clockns"},
+	{"os", "date"},
+	{"os", "getenv"},
+	{"math", "random"},
+	{"io", "read"},
+	{fileHandle, "read"},
+}
+
+// Record starts recording the results of the nondeterministic functions of
+// the standard library opened in l (os.time, os.clock, os.timens,
+// os.clockns, os.date, os.getenv, math.random, io.read, the read method of
+// files and the iterators returned by io.lines and file:lines) and of host
+// functions wrapped with Recorded. The returned recording grows as the state
+// runs.
+//
+// Record must be called after the libraries are opened, and before the
+// functions are copied to other places by scripts.
+func Record(l *State) *Recording {
+	r := &Recording{}
+	setReplayer(l, &replayer{recording: r})
+	return r
+}
+
+// Replay makes the functions that Record captures return the results stored
+// in r instead of running, in the order in which they were recorded. A call
+// of a different function than the recorded one, or a call beyond the end of
+// the recording, raises an error, since the script has taken a different
+// path than during recording. The same restrictions apply as for Record.
+func Replay(l *State, r *Recording) {
+	setReplayer(l, &replayer{recording: r, replaying: true})
+}
+
+func setReplayer(l *State, rp *replayer) {
+	wrapped := l.global.replayer != nil
+	if l.global.replayer = rp; !wrapped {
+		wrapRecordedFunctions(l)
+	}
+}
+
+// Recorded wraps the host function f, so that its results are captured
+// under name while l is recording, and replayed instead of calling f while
+// it is replaying. Otherwise the wrapper just calls f.
+func Recorded(name string, f Function) Function {
+	return func(l *State) int {
+		rp := l.global.replayer
+		if rp == nil {
+			return f(l)
+		} else if rp.replaying {
+			return rp.replay(l, name)
+		}
+		n := f(l)
+		rp.record(l, name, n)
+		return n
+	}
+}
+
+func wrapRecordedFunctions(l *State) {
+	for _, rf := range recordedFunctions {
+		if rf.library == fileHandle {
+			MetaTableNamed(l, fileHandle)
+		} else {
+			SubTable(l, RegistryIndex, "_LOADED")
+			l.Field(-1, rf.library)
+			l.Remove(-2)
+		}
+		if l.IsTable(-1) {
+			l.Field(-1, rf.name)
+			name := rf.library + "." + rf.name
+			if rf.library == fileHandle {
+				name = "file:" + rf.name
+			}
+			switch f := l.indexToValue(-1).(type) {
+			case *goFunction:
+				l.PushGoFunction(Recorded(name, f.Function))
+				l.SetField(-3, rf.name)
+			case *goClosure:
+				l.apiPush(&goClosure{function: Recorded(name, f.function), upValues: f.upValues, data: f.data})
+				l.SetField(-3, rf.name)
+			}
+			l.Pop(1)
+		}
+		l.Pop(1)
+	}
+}
+
+func (rp *replayer) record(l *State, name string, n int) {
+	results := make([]interface{}, n)
+	for i := range results {
+		results[i] = recordableValue(l, l.Top()-n+1+i, name, 1)
+	}
+	rp.recording.Calls = append(rp.recording.Calls, RecordedCall{Function: name, Results: results})
+}
+
+func (rp *replayer) replay(l *State, name string) int {
+	if rp.next >= len(rp.recording.Calls) {
+		Errorf(l, "replay: unexpected call of %s after the end of the recording", name)
+	}
+	call := rp.recording.Calls[rp.next]
+	if call.Function != name {
+		Errorf(l, "replay: call %d is %s, but %s was recorded", rp.next+1, name, call.Function)
+	}
+	rp.next++
+	CheckStackWithMessage(l, len(call.Results), "too many results")
+	for _, v := range call.Results {
+		pushRecordedValue(l, v, 1)
+	}
+	return len(call.Results)
+}
+
+func recordableValue(l *State, index int, name string, depth int) interface{} {
+	switch v := l.indexToValue(index).(type) {
+	case nil, bool, int64, float64, string:
+		return v
+	case *table:
+		l.checkTableDepth(depth)
+		CheckStackWithMessage(l, 2, "table nested too deep")
+		m := make(map[string]interface{})
+		for l.PushNil(); l.Next(index); l.Pop(1) {
+			k, ok := l.ToValue(-2).(string)
+			if !ok {
+				Errorf(l, "cannot record a table with a %s key returned by %s", TypeNameOf(l, -2), name)
+			}
+			m[k] = recordableValue(l, l.Top(), name, depth+1)
+		}
+		return m
+	}
+	Errorf(l, "cannot record a %s returned by %s", TypeNameOf(l, index), name)
+	panic("unreachable")
+}
+
+func pushRecordedValue(l *State, v interface{}, depth int) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		l.checkTableDepth(depth)
+		CheckStackWithMessage(l, 2, "table nested too deep")
+		l.CreateTable(0, len(v))
+		for k, x := range v {
+			pushRecordedValue(l, x, depth+1)
+			l.SetField(-2, k)
+		}
+	case nil, bool, int64, float64, string:
+		l.apiPush(v)
+	default:
+		panic(fmt.Sprintf("invalid recorded value %#v", v))
+	}
+}
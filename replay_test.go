@@ -0,0 +1,117 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	skipWithoutOS(t)
+	const script = `
+		local t = os.time()
+		local r1, r2 = math.random(), math.random(1, 1000000)
+		local line = io.read("l")
+		local d = os.date("*t")
+		local cb = callback()
+		result = table.concat({t, r1, r2, line, d.year, d.hour, cb}, "|")
+	`
+	run := func(input string, callbackResult int, setup func(*State)) (string, error) {
+		l := NewState()
+		OpenLibraries(l)
+		SetStdin(l, strings.NewReader(input))
+		l.Register("callback", Recorded("callback", func(l *State) int {
+			l.PushInteger(callbackResult)
+			return 1
+		}))
+		setup(l)
+		if err := DoString(l, script); err != nil {
+			return "", err
+		}
+		l.Global("result")
+		s, _ := l.ToString(-1)
+		return s, nil
+	}
+
+	var rec *Recording
+	recorded, err := run("customer input\n", 42, func(l *State) { rec = Record(l) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Calls) != 6 || rec.Calls[0].Function != "os.time" || rec.Calls[5].Function != "callback" {
+		t.Fatalf("unexpected recording %+v", rec.Calls)
+	}
+	var b bytes.Buffer
+	if err := rec.Encode(&b); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeRecording(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := run("", 7, func(l *State) { Replay(l, decoded) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != recorded || !strings.Contains(replayed, "|customer input|") || !strings.HasSuffix(replayed, "|42") {
+		t.Errorf("replayed %q, recorded %q", replayed, recorded)
+	}
+
+	decoded.Calls = decoded.Calls[:3]
+	if _, err := run("", 7, func(l *State) { Replay(l, decoded) }); err == nil || !strings.Contains(err.Error(), "after the end of the recording") {
+		t.Errorf("short recording: got %v", err)
+	}
+	decoded.Calls[1].Function = "os.clock"
+	if _, err := run("", 7, func(l *State) { Replay(l, decoded) }); err == nil || !strings.Contains(err.Error(), "but os.clock was recorded") {
+		t.Errorf("diverging replay: got %v", err)
+	}
+}
+
+func TestRecordReplayLines(t *testing.T) {
+	skipWithoutOS(t)
+	run := func(input string, setup func(*State)) (string, error) {
+		l := NewState()
+		OpenLibraries(l)
+		SetStdin(l, strings.NewReader(input))
+		setup(l)
+		if err := DoString(l, `
+			local t = {}
+			for line in io.lines() do t[#t + 1] = line end
+			result = table.concat(t, ",")
+		`); err != nil {
+			return "", err
+		}
+		l.Global("result")
+		s, _ := l.ToString(-1)
+		return s, nil
+	}
+	var rec *Recording
+	recorded, err := run("one\ntwo", func(l *State) { rec = Record(l) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != "one,two" || len(rec.Calls) != 3 || rec.Calls[0].Function != "io.lines" {
+		t.Fatalf("recorded %q as %+v", recorded, rec.Calls)
+	}
+	replayed, err := run("three", func(l *State) { Replay(l, rec) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != recorded {
+		t.Errorf("replayed %q, recorded %q", replayed, recorded)
+	}
+}
+
+func TestRecordDeepTable(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Register("cyclic", Recorded("cyclic", func(l *State) int {
+		DoString(l, "local t = {} t.self = t return t")
+		return 1
+	}))
+	Record(l)
+	err := DoString(l, "cyclic()")
+	if err == nil || !strings.Contains(err.Error(), "table nested too deep (limit is 1000)") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package lua
+
+// snapshotDepth is the number of levels of tables below the registry that
+// Snapshot records: the globals and the loaded modules, and the library
+// tables in them.
+const snapshotDepth = 2
+
+// A snapshot holds the contents of the tables and the string tags that
+// Reset restores.
+type snapshot struct {
+	tables     map[*table]tableContents
+	metaTables [TypeCount]*table
+	tags       map[string][]string
+}
+
+type tableContents struct {
+	array     []value
+	hash      hashPart
+	metaTable *table
+	frozen    bool // frozen at the snapshot; the contents are not recorded
+}
+
+// Snapshot records the globals and the registry of l, so that Reset can
+// return l to this point. It is meant to be called once the libraries are
+// open and the code shared by all uses of the state is loaded:
+//
+//	l := lua.NewState()
+//	lua.OpenLibraries(l)
+//	lua.DoString(l, prelude)
+//	l.Snapshot()
+//
+// It records the contents of the registry, of the tables in it, such as the
+// globals and package.loaded, and of the tables in those, such as the
+// library tables, together with their metatables and the metatables of the
+// basic types, and it records the string tags. Values reachable otherwise,
+// such as the fields of deeper tables and the upvalues of functions, are
+// shared with the snapshot, so changes to them persist across Reset. Tables that are frozen already
+// cannot change, so Reset leaves them alone, and other goroutines may keep
+// reading them through a FrozenTable while it runs. A later Snapshot
+// replaces the previous one.
+func (l *State) Snapshot() {
+	s := &snapshot{tables: make(map[*table]tableContents), metaTables: l.global.metaTables}
+	s.record(l.global.registry, 0)
+	if t := l.global.tags; t != nil {
+		s.tags = copyTags(t.tags)
+	}
+	for _, mt := range s.metaTables {
+		if mt != nil {
+			s.record(mt, snapshotDepth-1)
+		}
+	}
+	l.global.snapshot = s
+}
+
+func (s *snapshot) record(t *table, depth int) {
+	if _, ok := s.tables[t]; ok {
+		return
+	}
+	if t.frozen {
+		s.tables[t] = tableContents{frozen: true}
+	} else {
+		s.tables[t] = tableContents{
+			array:     append([]value(nil), t.array...),
+			hash:      hashPart{nodes: append([]hashNode(nil), t.hash.nodes...), count: t.hash.count, used: t.hash.used},
+			metaTable: t.metaTable,
+		}
+	}
+	if t.metaTable != nil {
+		s.record(t.metaTable, depth)
+	}
+	if depth == snapshotDepth {
+		return
+	}
+	record := func(v value) {
+		if t, ok := v.(*table); ok {
+			s.record(t, depth+1)
+		}
+	}
+	for _, v := range t.array {
+		record(v)
+	}
+	t.hash.each(func(_, v value) { record(v) })
+}
+
+// Reset returns l to the point recorded by Snapshot, so that a state can be
+// reused for another request instead of creating a new one: it empties the
+// stack and restores the contents of the tables that Snapshot recorded,
+// which drops the globals, modules and registry entries added since and
+// undoes the changes to the library tables, and it restores the string tags,
+// so that strings tagged by one request are not tagged in the next. The
+// settings of the state, such as hooks, limits, host slots and the
+// TagCheck, are kept, and files the script opened are not closed. Reset panics if Snapshot was not called, if l is not the
+// main thread or if it is running.
+func (l *State) Reset() {
+	s := l.global.snapshot
+	switch {
+	case s == nil:
+		panic("lua: Reset without Snapshot")
+	case l != l.global.mainThread || l.callInfo != &l.baseCallInfo:
+		panic("lua: Reset of a running state")
+	}
+	base := l.baseCallInfo.function + 1
+	l.closeUpValues(base)
+	l.tbcList = l.tbcList[:0]
+	clear(l.stack[base:l.top])
+	l.top = base
+	l.shrinkStack()
+	for t, c := range s.tables {
+		if c.frozen {
+			continue
+		}
+		t.array = append([]value(nil), c.array...)
+		t.hash = hashPart{nodes: append([]hashNode(nil), c.hash.nodes...), count: c.hash.count, used: c.hash.used}
+		t.metaTable, t.frozen = c.metaTable, false
+		t.iterationKeys, t.iterationKeyIndex = nil, nil
+		t.invalidateTagMethodCache()
+	}
+	l.global.metaTables = s.metaTables
+	if t := l.global.tags; t != nil {
+		t.tags = copyTags(s.tags)
+	}
+}
+
+func copyTags(tags map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(tags))
+	for s, t := range tags {
+		c[s] = t // add copies a tag list before it changes it
+	}
+	return c
+}
@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `config = {name = "base"}`); err != nil {
+		t.Fatal(err)
+	}
+	l.Snapshot()
+	l.PushString("left on the stack")
+	if err := DoString(l, `
+		x = 1
+		config.name = "changed"
+		string.upper = nil
+		getmetatable("").__index = {}
+		package.loaded.mod = {}
+		table.freeze(config)
+		setmetatable(_G, {__index = function() return "default" end})
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Reset()
+	if l.Top() != 0 {
+		t.Errorf("stack holds %d values", l.Top())
+	}
+	if err := DoString(l, `
+		assert(x == nil and getmetatable(_G) == nil)
+		assert(config.name == "base")
+		config.name = "writable"
+		assert(("x"):upper() == "X" and string.upper("y") == "Y")
+		assert(package.loaded.mod == nil and package.loaded.string == string)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Reset()
+	if err := DoString(l, `assert(config.name == "base")`); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Register("reset", func(l *State) int {
+		l.Reset()
+		return 0
+	})
+	if err := DoString(l, `reset()`); err == nil {
+		t.Error("Reset of a running state did not fail")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Reset without Snapshot did not panic")
+			}
+		}()
+		NewState().Reset()
+	}()
+}
+
+func TestResetStringTags(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.PushString("trusted")
+	TagString(l, -1, "prelude")
+	l.Pop(1)
+	l.Snapshot()
+	l.PushString("request input")
+	TagString(l, -1, "user-input")
+	l.PushString("trusted")
+	TagString(l, -1, "user-input")
+	l.Reset()
+	l.PushString("request input")
+	if tags := StringTags(l, -1); tags != nil {
+		t.Errorf("tags %v survived Reset", tags)
+	}
+	l.PushString("trusted")
+	if tags := StringTags(l, -1); len(tags) != 1 || tags[0] != "prelude" {
+		t.Errorf("tags %v after Reset, want [prelude]", tags)
+	}
+}
+
+func TestResetFrozenTableConcurrentReads(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `config = table.freeze({name = "app", limits = table.freeze({cpu = 2})})`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("config")
+	config, _ := ToFrozenTable(l, -1)
+	l.Pop(1)
+	l.Snapshot()
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	errs := make(chan string, 4)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				limits, ok := config.Field("limits").(FrozenTable)
+				if config.Field("name") != "app" || !ok || limits.Get("cpu") != int64(2) {
+					errs <- "wrong value"
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		if err := DoString(l, `x = {} assert(config.name == "app")`); err != nil {
+			t.Fatal(err)
+		}
+		l.Reset()
+	}
+	done.Store(true)
+	wg.Wait()
+	if len(errs) > 0 {
+		t.Error(<-errs)
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Snapshot()
+	for i := 0; i < b.N; i++ {
+		DoString(l, `x = {} string.y = 1`)
+		l.Reset()
+	}
+}
+
+func BenchmarkNewStateOpenLibraries(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		l := NewState()
+		OpenLibraries(l)
+		DoString(l, `x = {} string.y = 1`)
+	}
+}
@@ -14,6 +14,10 @@ const firstReserved = 257
 const endOfStream = -1
 const maxInt = int(^uint(0) >> 1)
 
+// maxLine is the highest line number of a chunk. Binary chunks store line
+// numbers as C ints, so luac cannot load chunks with higher ones.
+const maxLine = math.MaxInt32
+
 const (
 	tkAnd = iota + firstReserved
 	tkBreak
@@ -84,9 +88,9 @@ type scanner struct {
 	lookAheadToken       token
 	tokenBuf             string // last token's buffer content for error messages
 	token
+	recovery *recovery // collects the syntax errors for CheckSyntax, or nil
 }
 
-func (s *scanner) assert(cond bool)           { s.l.assert(cond) }
 func (s *scanner) syntaxError(message string) { s.scanError(message, s.t) }
 func (s *scanner) errorExpected(t rune)       { s.syntaxError(s.tokenToString(t) + " expected") }
 func (s *scanner) numberError()               { s.scanError("malformed number", tkNumber) }
@@ -127,10 +131,12 @@ func (s *scanner) txtToken(token rune) string {
 func (s *scanner) scanError(message string, token rune) {
 	buff := chunkID(s.source)
 	if token != 0 {
-		message = fmt.Sprintf("%s:%d: %s near %s", buff, s.lineNumber, message, s.txtToken(token))
-	} else {
-		message = fmt.Sprintf("%s:%d: %s", buff, s.lineNumber, message)
+		message = fmt.Sprintf("%s near %s", message, s.txtToken(token))
 	}
+	if s.recovery != nil {
+		s.recovery.add(ParseError{Source: buff, Line: s.lineNumber, Message: message}, token == tkEOS)
+	}
+	message = fmt.Sprintf("%s:%d: %s", buff, s.lineNumber, message)
 	s.l.push(message)
 	s.l.throw(SyntaxError)
 }
@@ -141,7 +147,7 @@ func (s *scanner) incrementLineNumber() {
 	if s.advance(); isNewLine(s.current) && s.current != old {
 		s.advance()
 	}
-	if s.lineNumber++; s.lineNumber >= maxInt {
+	if s.lineNumber++; s.lineNumber >= maxLine {
 		s.syntaxError("chunk has too many lines")
 	}
 }
@@ -274,7 +280,7 @@ func (s *scanner) readHexNumber(x float64) (n float64, c rune, i int, overflow i
 // and cases with many trailing zeros by dividing instead of multiplying.
 func (s *scanner) readHexFraction() (frac float64, c rune, count int, expAdj int) {
 	c = s.current
-	leadingZeros := 0
+	leadingZeros, accumulated := 0, 0
 	gotSignificant := false
 	const maxPrecise = float64(1 << 53)
 
@@ -306,6 +312,7 @@ func (s *scanner) readHexFraction() (frac float64, c rune, count int, expAdj int
 		// Accumulate as integer-like value (we'll adjust with exponent)
 		if frac < maxPrecise {
 			frac = frac*16.0 + digit
+			accumulated++
 		}
 		// Digits beyond precision are ignored (they don't affect float64 result)
 	}
@@ -314,8 +321,7 @@ func (s *scanner) readHexFraction() (frac float64, c rune, count int, expAdj int
 	// Actually simpler: expAdj tells us how many positions to shift
 	// frac * 2^expAdj gives the correct fractional value
 	if gotSignificant {
-		digitsAccumulated := count - leadingZeros
-		expAdj = -(leadingZeros + digitsAccumulated) * 4
+		expAdj = -(leadingZeros + accumulated) * 4
 	}
 	return
 }
@@ -772,6 +778,9 @@ func (s *scanner) next() {
 		s.token = s.scan()
 	}
 	s.tokenBuf = s.token.raw
+	if s.recovery != nil {
+		s.recovery.count(s.t)
+	}
 }
 
 func (s *scanner) lookAhead() rune {
@@ -35,6 +35,8 @@ func TestScanner(t *testing.T) {
 		{"0x0.1E", []token{{t: tkNumber, n: 0.1171875}}},
 		{"0xA23p-4", []token{{t: tkNumber, n: 162.1875}}},
 		{"0X1.921FB54442D18P+1", []token{{t: tkNumber, n: 3.141592653589793}}},
+		{"0x.FFFFFFFFFFFFFFFFF", []token{{t: tkNumber, n: 0x.FFFFFFFFFFFFFFFFFp0}}},
+		{"0x0.000123456789ABCDEF1p8", []token{{t: tkNumber, n: 0x0.000123456789ABCDEF1p8}}},
 		{"  -0xa  ", []token{{t: '-'}, {t: tkInteger, i: 10}}}, // Lua 5.3: hex integer literal
 	}
 	for i, v := range tests {
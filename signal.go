@@ -0,0 +1,154 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
+package lua
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+)
+
+const signalHandlers = "_SIGNAL_HANDLERS"
+
+// signalCheckCount is the number of instructions between checks for
+// pending signals when no other count hook is installed.
+const signalCheckCount = 1000
+
+type signalWatch struct {
+	ch      chan os.Signal
+	stop    chan struct{}
+	pending int32 // number of signals received but not yet dispatched
+}
+
+// A signalDispatcher delivers signals to the handlers registered by a
+// script. Signals arrive on their own goroutine and are only counted there;
+// the handlers run from a debug hook, so they are called at a point where
+// the interpreter is in a consistent state. Any hook that was installed
+// before is chained, and restored when the last handler is removed.
+type signalDispatcher struct {
+	watches   map[string]*signalWatch
+	installed *State // the thread with the hook, if any
+	hook      Hook
+	mask      byte
+	count     int
+	internal  bool
+}
+
+func (sd *signalDispatcher) install(l *State) {
+	if sd.installed != nil {
+		return
+	}
+	sd.installed = l
+	sd.hook, sd.mask, sd.count, sd.internal = l.hooker, l.hookMask, l.baseHookCount, l.internalHook
+	count := signalCheckCount
+	if sd.mask&MaskCount != 0 {
+		count = sd.count
+	}
+	SetDebugHook(l, sd.dispatch, sd.mask|MaskCall|MaskCount, count)
+	l.internalHook = sd.internal
+}
+
+func (sd *signalDispatcher) uninstall() {
+	if l := sd.installed; l != nil {
+		SetDebugHook(l, sd.hook, sd.mask, sd.count)
+		l.internalHook = sd.internal
+		sd.installed = nil
+	}
+}
+
+func (sd *signalDispatcher) dispatch(l *State, d Debug) {
+	for name, w := range sd.watches {
+		if atomic.SwapInt32(&w.pending, 0) == 0 {
+			continue
+		}
+		l.Field(RegistryIndex, signalHandlers)
+		l.Field(-1, name)
+		l.Remove(-2)
+		if l.IsFunction(-1) {
+			l.PushString(name)
+			l.Call(1, 0)
+		} else {
+			l.Pop(1)
+		}
+	}
+	eventMasks := []byte{MaskCall, MaskReturn, MaskLine, MaskCount, MaskCall}
+	if sd.hook != nil && sd.mask&eventMasks[d.Event] != 0 {
+		sd.hook(l, d)
+	}
+}
+
+func (sd *signalDispatcher) watch(name string) {
+	if _, ok := sd.watches[name]; ok {
+		return
+	}
+	w := &signalWatch{ch: make(chan os.Signal, 1), stop: make(chan struct{})}
+	sd.watches[name] = w
+	signal.Notify(w.ch, signalNames[name])
+	go func() {
+		for {
+			select {
+			case <-w.ch:
+				atomic.AddInt32(&w.pending, 1)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (sd *signalDispatcher) unwatch(name string) {
+	if w, ok := sd.watches[name]; ok {
+		signal.Stop(w.ch)
+		w.stop <- struct{}{}
+		delete(sd.watches, name)
+	}
+}
+
+var signalLibrary = []RegistryFunction{
+	{"signal", func(l *State) int {
+		// signal.signal(name, handler) sets the function called with the
+		// signal name when the signal arrives and returns the previous one.
+		// A nil handler restores the default behavior of the signal.
+		sd := l.ToUserData(UpValueIndex(1)).(*signalDispatcher)
+		name := CheckString(l, 1)
+		if _, ok := signalNames[name]; !ok {
+			ArgumentError(l, 1, l.PushFString("unknown signal '%s'", name))
+		}
+		if !l.IsNil(2) {
+			CheckType(l, 2, TypeFunction)
+		}
+		l.SetTop(2)
+		SubTable(l, RegistryIndex, signalHandlers)
+		l.Field(-1, name) // previous handler
+		l.PushValue(2)
+		l.SetField(-3, name)
+		if l.IsNil(2) {
+			sd.unwatch(name)
+			if len(sd.watches) == 0 {
+				sd.uninstall()
+			}
+		} else {
+			sd.install(l)
+			sd.watch(name)
+		}
+		return 1
+	}},
+}
+
+// SignalOpen opens the signal library. It is not opened by OpenLibraries;
+// pass it as a preloaded library to make it available through require:
+//
+//	lua.OpenLibraries(l, lua.RegistryFunction{Name: "signal", Function: lua.SignalOpen})
+//
+// Handlers are dispatched from a hook installed on the thread that registers
+// the first handler and removed with the last one, so they run between
+// instructions of Lua code or when a function is called. Replacing that hook
+// with debug.sethook stops the dispatch. The supported signals are SIGINT,
+// SIGTERM and SIGHUP.
+func SignalOpen(l *State) int {
+	NewLibraryTable(l, signalLibrary)
+	l.PushUserData(&signalDispatcher{watches: make(map[string]*signalWatch)})
+	SetFunctions(l, signalLibrary, 1)
+	return 1
+}
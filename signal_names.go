@@ -0,0 +1,16 @@
+//go:build !js && !lua_noos && !baremetal
+// +build !js,!lua_noos,!baremetal
+
+package lua
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalNames lists the signals that scripts can catch.
+var signalNames = map[string]os.Signal{
+	"SIGINT":  os.Interrupt,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+}
@@ -0,0 +1,16 @@
+//go:build !lua_noos && !baremetal
+// +build !lua_noos,!baremetal
+
+package lua
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalNames lists the signals that scripts can catch. JavaScript hosts
+// have no SIGHUP.
+var signalNames = map[string]os.Signal{
+	"SIGINT":  os.Interrupt,
+	"SIGTERM": syscall.SIGTERM,
+}
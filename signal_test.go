@@ -0,0 +1,41 @@
+//go:build !windows && !js && !wasip1 && !lua_noos
+// +build !windows,!js,!wasip1,!lua_noos
+
+package lua
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestSignal(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l, RegistryFunction{"signal", SignalOpen})
+	lines := 0
+	SetDebugHook(l, func(*State, Debug) { lines++ }, MaskLine, 0)
+	if err := DoString(l, `
+		signal = require("signal")
+		received = nil
+		assert(signal.signal("SIGHUP", function(name) received = name end) == nil)
+		assert(not pcall(signal.signal, "SIGFOO", print))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(l, `
+		local clock = os.clock()
+		while not received and os.clock() - clock < 5 do end
+		assert(received == "SIGHUP")
+		assert(type(signal.signal("SIGHUP", nil)) == "function")
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if DebugHookMask(l) != MaskLine || DebugHookCount(l) != 0 {
+		t.Errorf("hook not restored: mask %d, count %d", DebugHookMask(l), DebugHookCount(l))
+	}
+	if lines == 0 {
+		t.Error("the previous hook was not chained")
+	}
+}
@@ -1,9 +1,6 @@
 package lua
 
-import (
-	"fmt"
-	"log"
-)
+import "fmt"
 
 func (l *State) push(v value) {
 	l.stack[l.top] = v
@@ -15,8 +12,15 @@ func (l *State) pop() value {
 	return l.stack[l.top]
 }
 
+// An upValue is open while the variable it refers to lives on the stack of
+// state at index, and closed once the variable has left the stack and been
+// copied to closed. Open up values are linked through next, so that opening
+// one takes a single allocation.
 type upValue struct {
-	home interface{}
+	state  *State // nil when closed
+	index  int
+	closed value
+	next   *upValue // the next open up value of state
 }
 
 type closure interface {
@@ -33,6 +37,7 @@ type luaClosure struct {
 type goClosure struct {
 	function Function
 	upValues []value
+	data     interface{} // set by PushGoClosureWithData
 }
 
 // Function wrapper, to allow go functions as keys in maps. Explicitly not a closure.
@@ -40,20 +45,13 @@ type goFunction struct {
 	Function
 }
 
-func (c *luaClosure) upValue(i int) value {
-	uv := c.upValues[i]
-	if home, ok := uv.home.(stackLocation); ok {
-		return home.state.stack[home.index]
-	}
-	return uv.home
-}
+func (c *luaClosure) upValue(i int) value { return c.upValues[i].value() }
 
 func (c *luaClosure) setUpValue(i int, v value) {
-	uv := c.upValues[i]
-	if home, ok := uv.home.(stackLocation); ok {
-		home.state.stack[home.index] = v
+	if uv := c.upValues[i]; uv.state != nil {
+		uv.state.stack[uv.index] = v
 	} else {
-		uv.home = v
+		uv.closed = v
 	}
 }
 
@@ -61,45 +59,37 @@ func (c *luaClosure) upValueCount() int        { return len(c.upValues) }
 func (c *goClosure) upValue(i int) value       { return c.upValues[i] }
 func (c *goClosure) setUpValue(i int, v value) { c.upValues[i] = v }
 func (c *goClosure) upValueCount() int         { return len(c.upValues) }
-func (l *State) newUpValue() *upValue          { return &upValue{home: nil} }
+func (l *State) newUpValue() *upValue          { return &upValue{} }
 
 func (uv *upValue) value() value {
-	if home, ok := uv.home.(stackLocation); ok {
-		return home.state.stack[home.index]
+	if uv.state != nil {
+		return uv.state.stack[uv.index]
 	}
-	return uv.home
+	return uv.closed
 }
 
 func (uv *upValue) close() {
-	if home, ok := uv.home.(stackLocation); ok {
-		uv.home = home.state.stack[home.index]
-	} else {
+	if uv.state == nil {
 		panic("attempt to close already-closed up value")
 	}
+	uv.closed, uv.state, uv.next = uv.state.stack[uv.index], nil, nil
 }
 
-func (uv *upValue) isInStackAt(level int) bool {
-	if home, ok := uv.home.(stackLocation); ok {
-		return home.index == level
-	}
-	return false
-}
+func (uv *upValue) isInStackAt(level int) bool    { return uv.state != nil && uv.index == level }
+func (uv *upValue) isInStackAbove(level int) bool { return uv.state != nil && uv.index >= level }
 
-func (uv *upValue) isInStackAbove(level int) bool {
-	if home, ok := uv.home.(stackLocation); ok {
-		return home.index >= level
+// sameHome reports whether uv and other refer to the same variable on the
+// stack, or are closed with the same value.
+func (uv *upValue) sameHome(other *upValue) bool {
+	if uv.state != nil || other.state != nil {
+		return uv.state == other.state && uv.index == other.index
 	}
-	return false
-}
-
-type openUpValue struct {
-	upValue *upValue
-	next    *openUpValue
+	return uv.closed == other.closed
 }
 
 func (l *State) newUpValueAt(level int) *upValue {
-	uv := &upValue{home: stackLocation{state: l, index: level}}
-	l.upValues = &openUpValue{upValue: uv, next: l.upValues}
+	uv := &upValue{state: l, index: level, next: l.upValues}
+	l.upValues = uv
 	return uv
 }
 
@@ -116,15 +106,12 @@ func (l *State) closeWithError(level int, errObj value) {
 
 func (l *State) closeUpValues(level int) {
 	// TODO this seems really inefficient - how can we terminate early?
-	var p *openUpValue
-	for e := l.upValues; e != nil; e, p = e.next, e {
-		if e.upValue.isInStackAbove(level) {
-			e.upValue.close()
-			if p != nil {
-				p.next = e.next
-			} else {
-				l.upValues = e.next
-			}
+	for p := &l.upValues; *p != nil; {
+		if uv := *p; uv.isInStackAbove(level) {
+			*p = uv.next
+			uv.close()
+		} else {
+			p = &uv.next
 		}
 	}
 }
@@ -190,8 +177,7 @@ func (l *State) closeTBCProtected(level int, initialErr value) (finalErr value)
 		tm := l.tagMethodByObject(obj, tmClose)
 		// Call even if tm is nil — matches C Lua behavior where callclosemethod
 		// pushes tm unconditionally. If nil/non-callable, the call will error.
-		savedCI := l.callInfo
-		savedTop := l.top
+		savedCI, savedTop, allowHook := l.callInfo, l.top, l.allowHook
 		callErr := l.protect(func() {
 			l.push(tm)
 			l.push(obj)
@@ -204,8 +190,7 @@ func (l *State) closeTBCProtected(level int, initialErr value) (finalErr value)
 			if l.top > savedTop {
 				errObj = l.stack[l.top-1]
 			}
-			l.callInfo = savedCI
-			l.top = savedTop
+			l.callInfo, l.top, l.allowHook = savedCI, savedTop, allowHook
 		}
 	}
 	return errObj
@@ -214,6 +199,7 @@ func (l *State) closeTBCProtected(level int, initialErr value) (finalErr value)
 // information about a call
 type callInfo struct {
 	function, top, resultCount int
+	depth                      int // the number of calls below, fixed by the position in the chain
 	previous, next             *callInfo
 	callStatus                 callStatus
 	*luaCallInfo
@@ -264,9 +250,13 @@ func (ci *callInfo) frameIndex(stackSlot int) int {
 func (l *State) pushLuaFrame(function, base, resultCount int, p *prototype) *callInfo {
 	ci := l.callInfo.next
 	if ci == nil {
-		ci = &callInfo{previous: l.callInfo, luaCallInfo: &luaCallInfo{code: p.code}}
+		ci = &callInfo{previous: l.callInfo, depth: l.callInfo.depth + 1, luaCallInfo: &luaCallInfo{code: p.code}}
 		l.callInfo.next = ci
-	} else if ci.luaCallInfo == nil {
+	}
+	if ci.depth >= l.global.callDepthLimit {
+		l.callDepthError(ci.depth)
+	}
+	if ci.luaCallInfo == nil {
 		ci.goCallInfo = nil
 		ci.luaCallInfo = &luaCallInfo{code: p.code}
 	} else {
@@ -287,9 +277,13 @@ func (l *State) pushLuaFrame(function, base, resultCount int, p *prototype) *cal
 func (l *State) pushGoFrame(function, resultCount int) {
 	ci := l.callInfo.next
 	if ci == nil {
-		ci = &callInfo{previous: l.callInfo, goCallInfo: &goCallInfo{}}
+		ci = &callInfo{previous: l.callInfo, depth: l.callInfo.depth + 1, goCallInfo: &goCallInfo{}}
 		l.callInfo.next = ci
-	} else if ci.goCallInfo == nil {
+	}
+	if ci.depth >= l.global.callDepthLimit {
+		l.callDepthError(ci.depth)
+	}
+	if ci.goCallInfo == nil {
 		ci.goCallInfo = &goCallInfo{}
 		ci.luaCallInfo = nil
 	}
@@ -312,9 +306,9 @@ func (l *State) newLuaClosure(p *prototype) *luaClosure {
 }
 
 func (l *State) findUpValue(level int) *upValue {
-	for e := l.upValues; e != nil; e = e.next {
-		if e.upValue.isInStackAt(level) {
-			return e.upValue
+	for uv := l.upValues; uv != nil; uv = uv.next {
+		if uv.isInStackAt(level) {
+			return uv
 		}
 	}
 	return l.newUpValueAt(level)
@@ -339,7 +333,7 @@ func cached(p *prototype, upValues []*upValue, base int) *luaClosure {
 		for i, uv := range p.upValues {
 			if uv.isLocal && !c.upValues[i].isInStackAt(base+uv.index) {
 				return nil
-			} else if !uv.isLocal && c.upValues[i].home != upValues[uv.index].home {
+			} else if !uv.isLocal && !c.upValues[i].sameHome(upValues[uv.index]) {
 				return nil
 			}
 		}
@@ -473,6 +467,39 @@ func (l *State) postCall(firstResult int) bool {
 	return wanted != MultipleReturns
 }
 
+// SetCallDepthLimit limits the number of nested calls, of Lua and Go
+// functions, in each thread of the state, and returns the previous limit.
+// A call beyond the limit raises the error "stack overflow", which pcall
+// catches and a message handler such as debug.traceback sees with the
+// stack of calls; a few calls beyond the limit are left for the handler.
+// Tail calls do not nest. A limit of 0 or less removes the limit, so that
+// only the size of the stack, a million values, bounds the recursion of Lua
+// functions. Go functions that call back into Lua and metamethods nest
+// further in the Go stack, which is limited to about 200 levels in any case.
+func SetCallDepthLimit(l *State, depth int) int {
+	prev := l.global.callDepthLimit
+	if prev == noCallDepthLimit {
+		prev = 0
+	}
+	if depth <= 0 {
+		depth = noCallDepthLimit
+	}
+	l.global.callDepthLimit = depth
+	return prev
+}
+
+// callDepthError raises the error of a call at depth beyond the limit of
+// SetCallDepthLimit. While the error is handled, the calls left for the
+// handler are allowed, and ErrorError is raised beyond them.
+func (l *State) callDepthError(depth int) {
+	if limit := l.global.callDepthLimit; !l.callDepthExceeded {
+		l.callDepthExceeded = true
+		l.runtimeError("stack overflow")
+	} else if depth >= limit+limit>>3+extraCallDepth {
+		l.throw(ErrorError) // error while handling stack error
+	}
+}
+
 // Call a Go or Lua function. The function to be called is at function.
 // The arguments are on the stack, right after the function. On return, all the
 // results are on the stack, starting at the original function position.
@@ -495,25 +522,40 @@ func (l *State) call(function int, resultCount int, allowYield bool) {
 }
 
 func (l *State) throw(errorCode error) {
-	if l.protectFunction != nil {
+	if l.protected {
 		panic(errorCode)
 	} else {
 		l.error = errorCode
-		if g := l.global.mainThread; g.protectFunction != nil {
+		if g := l.global.mainThread; g.protected {
 			g.push(l.stack[l.top-1])
 			g.throw(errorCode)
 		} else {
+			if c := l.global.crashDump; c != nil {
+				c.write(l, errorCode)
+			}
 			if l.global.panicFunction != nil {
 				l.global.panicFunction(l)
 			}
-			log.Panicf("Uncaught Lua error: %v", errorCode)
+			if l.global.panicPolicy == PanicError {
+				errObj := l.unwind(l.stack[l.top-1])
+				if l != g {
+					g.unwind(errObj)
+				}
+				panic(l.newError(errorCode))
+			}
+			panicUncaught(errorCode)
 		}
 	}
 }
 
+// protect calls f and returns the error that f throws. The deferred closure
+// is not stored anywhere, so it stays on the stack: a protected call does not
+// allocate. Like the call counts of C Lua, those of the calls that f leaves
+// by the error are restored.
 func (l *State) protect(f func()) (err error) {
-	nestedGoCallCount, protectFunction := l.nestedGoCallCount, l.protectFunction
-	l.protectFunction = func() {
+	nestedGoCallCount, nonYieldableCallCount, protected, callDepthExceeded := l.nestedGoCallCount, l.nonYieldableCallCount, l.protected, l.callDepthExceeded
+	l.protected = true
+	defer func() {
 		if e := recover(); e != nil {
 			// Let yield errors propagate through to Resume's recover
 			if e == yieldError {
@@ -525,12 +567,10 @@ func (l *State) protect(f func()) (err error) {
 				// Handle non-error panics (e.g., strings)
 				err = fmt.Errorf("%v", e)
 			}
-			l.nestedGoCallCount, l.protectFunction = nestedGoCallCount, protectFunction
 		}
-	}
-	defer l.protectFunction()
+		l.nestedGoCallCount, l.nonYieldableCallCount, l.protected, l.callDepthExceeded = nestedGoCallCount, nonYieldableCallCount, protected, callDepthExceeded
+	}()
 	f()
-	l.nestedGoCallCount, l.protectFunction = nestedGoCallCount, protectFunction
 	return err
 }
 
@@ -570,6 +610,10 @@ func (l *State) checkStack(n int) {
 	}
 }
 
+// reallocStack resizes the stack, which may move it to a new array. The
+// frames of the Lua functions on the call stack are updated, but the VM
+// must reload its copy of the current frame after any operation that can
+// call a hook, a metamethod or a function.
 func (l *State) reallocStack(newSize int) {
 	l.assert(newSize <= maxStack || newSize == errorStackSize)
 	oldSize := len(l.stack)
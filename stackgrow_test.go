@@ -0,0 +1,134 @@
+package lua
+
+import "testing"
+
+// moveStack moves the stack of l to a new array, like growing it does, so
+// that any slice of the old stack held across the call is stale afterwards.
+func moveStack(l *State) {
+	l.stack = append(make([]value, 0, len(l.stack)), l.stack...)
+	l.reallocStack(len(l.stack))
+}
+
+func TestStackGrowthInCallbacks(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	l.Register("grow", func(l *State) int {
+		l.SetTop(1)
+		moveStack(l)
+		return 1
+	})
+	if err := DoString(l, `
+		local g = grow
+		local mt = {
+			__index = function(t, k) return g(k) end,
+			__newindex = function(t, k, v) rawset(t, k, g(v)) end,
+			__add = function(a, b) return g(10) end,
+			__sub = function(a, b) return g(11) end,
+			__unm = function(a) return g(12) end,
+			__len = function(a) return g(13) end,
+			__concat = function(a, b) return g("cat") end,
+			__eq = function(a, b) return g(true) end,
+			__lt = function(a, b) return g(true) end,
+			__le = function(a, b) return g(false) end,
+			__call = function(self, x) return g(x) end,
+			__band = function(a, b) return g(14) end,
+			__idiv = function(a, b) return g(15) end,
+		}
+		local function check(a, b, x, y, z)
+			local o, p = setmetatable({}, mt), setmetatable({}, mt)
+			assert(o.key == "key")
+			o.field = 5
+			assert(rawget(o, "field") == 5)
+			assert(o + 1 == 10 and 1 - o == 11 and -o == 12 and #o == 13)
+			assert(o .. "x" == "cat" and o & 1 == 14 and o // 2 == 15)
+			assert(o == p and o < p and not (o <= p))
+			assert(o(7) == 7)
+			local s = 0
+			for i, v in function(_, i) if i < 3 then return g(i + 1), i end end, nil, 0 do s = s + i end
+			assert(s == 6)
+			do local c <close> = setmetatable({}, {__close = function() g(0) end}) end
+			assert(select("#", g(1, 2, 3)) == 1)
+			local t = {g(1), g(2), g(3)}
+			assert(#t == 3 and t[3] == 3)
+			assert(pcall(g, "ok"))
+			assert(tostring(setmetatable({}, {__tostring = function() return g("str") end})) == "str")
+			assert(string.gsub("abc", "%w", function(c) return g(c:upper()) end) == "ABC")
+			table.sort({3, 1, 2}, function(a, b) g(0) return a < b end)
+			local co = coroutine.wrap(function(v) coroutine.yield(g(v)) return g(v + 1) end)
+			assert(co(1) == 1 and co() == 2)
+			return a, b, x, y, z
+		end
+		for i = 1, 3 do
+			local a, b, x, y, z = check(1, 2, 3, 4, 5)
+			assert(a == 1 and b == 2 and x == 3 and y == 4 and z == 5)
+		end
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStackGrowthInHooks(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	SetDebugHook(l, func(l *State, ar Debug) { moveStack(l) }, MaskCall|MaskReturn|MaskCount, 1)
+	if err := DoString(l, `
+		local function sum(...)
+			local s = 0
+			for _, v in ipairs({...}) do s = s + v end
+			return s
+		end
+		local a, b = 1, 2
+		do
+			local c <close> = setmetatable({}, {__close = function() end})
+			a = a + 1
+		end
+		b = b + a
+		assert(a == 2 and b == 4)
+		assert(sum(a, b, 3) == 9)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if prev := SetCallDepthLimit(l, 50); prev != 0 {
+		t.Errorf("default limit %d", prev)
+	}
+	if err := DoString(l, `
+		local function f() return 1 + f() end
+		local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+		local function tail(n) if n == 0 then return "done" end return tail(n - 1) end
+
+		local ok, msg = xpcall(f, debug.traceback)
+		assert(not ok and msg:match("^%[string \"...\"%]:2: stack overflow\nstack traceback:"), msg)
+		assert(msg:match("skipping %d+ levels"), msg)
+		assert(depth(40) == 40 and not pcall(depth, 60))
+		assert(tail(1000) == "done")
+
+		-- the limit holds for Go functions and in coroutines, and again after an error
+		ok, msg = pcall(string.gsub, "a", ".", f)
+		assert(not ok and msg:match("stack overflow"), msg)
+		local co = coroutine.wrap(function()
+			assert(not pcall(f) and not pcall(f))
+			return depth(45)
+		end)
+		assert(co() == 45)
+
+		-- a handler that overflows too fails
+		ok, msg = xpcall(f, f)
+		assert(not ok and msg == "error in error handling", msg)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if prev := SetCallDepthLimit(l, 0); prev != 50 {
+		t.Errorf("limit %d", prev)
+	}
+	if err := DoString(l, `
+		local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+		assert(depth(10000) == 10000)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
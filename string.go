@@ -1,22 +1,50 @@
 package lua
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
-func relativePosition(pos, length int) int {
+// relativePosition converts pos, which counts from the end of a string of
+// the given length if it is negative, into a position counting from the
+// start. Positions before the start become 0. Positions are int64 like Lua
+// integers, so that they aren't truncated where int has 32 bits.
+func relativePosition(pos int64, length int) int64 {
 	if pos >= 0 {
 		return pos
-	} else if -pos > length {
+	} else if pos < -int64(length) { // also avoids negating math.MinInt64
 		return 0
 	}
-	return length + pos + 1
+	return int64(length) + pos + 1
+}
+
+// startPosition is relativePosition for the start of a range: positions
+// before the start become 1. The result may lie beyond the end.
+func startPosition(pos int64, length int) int64 {
+	if pos = relativePosition(pos, length); pos < 1 {
+		return 1
+	}
+	return pos
+}
+
+// endPosition is relativePosition for the end of a range: positions beyond
+// the end become length.
+func endPosition(pos int64, length int) int {
+	if pos = relativePosition(pos, length); pos > int64(length) {
+		return length
+	}
+	return int(pos)
 }
 
 // Pattern matching constants
@@ -28,6 +56,11 @@ const (
 // maxStringSize is the maximum size of strings created by string operations.
 // This matches Lua 5.3's MAX_SIZE which is typically limited to ~2GB to match
 // 32-bit int limits (even on 64-bit systems) for compatibility.
+//
+// Positions and lengths are ints and pushed with PushInteger, which converts
+// them to int64 without loss; they are never pushed as floats, so they stay
+// exact beyond 2^53. Subjects larger than this limit, such as mapped files,
+// need an int of 64 bits, which every 64-bit platform has.
 const maxStringSize = 0x7FFFFFFF // 2^31 - 1
 
 // Capture represents a captured substring
@@ -43,12 +76,57 @@ type matchState struct {
 	src         string
 	srcEnd      int
 	pattern     string
+	classes     []int // see compiledPattern
 	captures    []capture
 	numCaptures int
+	steps       int
+	maxSteps    int  // 0 means no limit, see SetPatternStepLimit
+	unicode     bool // see SetUnicodePatterns
+
+	replacements []string // the strings of a gsub function or table, for their tags
 }
 
 const maxMatchDepth = 200
 
+// SetPatternStepLimit bounds the work a single call of string.find, match,
+// gmatch (per iteration) or gsub may spend matching a pattern. Each step
+// tries one pattern item at one position of the subject; when the limit is
+// exceeded the call fails with "pattern too complex". This protects against
+// patterns that backtrack exponentially on untrusted input, which the
+// recursion limit alone does not catch. A limit of 0, the default, means no
+// limit. The previous limit is returned.
+func SetPatternStepLimit(l *State, steps int) int {
+	prev := l.global.patternStepLimit
+	l.global.patternStepLimit = steps
+	return prev
+}
+
+// SetUnicodePatterns selects whether the character classes of Lua patterns
+// match Unicode characters. When enabled, %a, %c, %d, %g, %l, %p, %s, %u and
+// %w and their complements, alone or in sets, match a whole UTF-8 encoded
+// character of the corresponding Unicode category: %a letters, %d decimal
+// digits, %l and %u lower and upper case letters, %p punctuation and
+// symbols, %s white space, %w letters, digits and combining marks, and so
+// on. Sets then also treat UTF-8 encoded characters written in them, and
+// ranges of them such as [à-ÿ], as single characters. Other pattern items,
+// including '.', still match single bytes; use utf8.charpattern to match any
+// character. Matches start only at character boundaries, and bytes that
+// are not valid UTF-8 belong to no class. It returns the previous setting.
+func SetUnicodePatterns(l *State, enabled bool) bool {
+	prev := l.global.unicodePatterns
+	l.global.unicodePatterns = enabled
+	return prev
+}
+
+// step accounts for one matching step against the step limit.
+func (ms *matchState) step() {
+	if ms.maxSteps > 0 {
+		if ms.steps++; ms.steps > ms.maxSteps {
+			Errorf(ms.l, "pattern too complex")
+		}
+	}
+}
+
 // Check if character c matches character class cl
 func matchClass(c byte, cl byte) bool {
 	var res bool
@@ -86,6 +164,43 @@ func matchClass(c byte, cl byte) bool {
 	return res
 }
 
+// invalidRune stands for a byte that is not valid UTF-8 in Unicode mode. It
+// belongs to no class and equals no character.
+const invalidRune = -1
+
+// matchUnicodeClass is matchClass for a non-ASCII character in Unicode
+// mode. ok is false if cl is not a class letter.
+func matchUnicodeClass(r rune, cl byte) (res, ok bool) {
+	valid := r != invalidRune
+	switch cl | 0x20 { // lowercase
+	case 'a':
+		res = valid && unicode.IsLetter(r)
+	case 'c':
+		res = valid && unicode.IsControl(r)
+	case 'd':
+		res = valid && unicode.IsDigit(r)
+	case 'g':
+		res = valid && unicode.IsGraphic(r) && !unicode.IsSpace(r)
+	case 'l':
+		res = valid && unicode.IsLower(r)
+	case 'p':
+		res = valid && (unicode.IsPunct(r) || unicode.IsSymbol(r))
+	case 's':
+		res = valid && unicode.IsSpace(r)
+	case 'u':
+		res = valid && unicode.IsUpper(r)
+	case 'w':
+		res = valid && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r))
+	case 'x', 'z': // only ASCII characters
+	default:
+		return false, false
+	}
+	if cl >= 'A' && cl <= 'Z' {
+		return !res, true
+	}
+	return res, true
+}
+
 // Find end of character class [...], returns index after ]
 // Returns -1 if malformed (missing ])
 func classEnd(pattern string, p int) int {
@@ -115,6 +230,16 @@ func classEnd(pattern string, p int) int {
 	}
 }
 
+// classEnd returns the end of the class starting with '[' at p, as computed
+// when the pattern was compiled.
+func (ms *matchState) classEnd(p int) int {
+	end := ms.classes[p]
+	if end < 0 {
+		Errorf(ms.l, "malformed pattern (missing ']')")
+	}
+	return end
+}
+
 // Check if character c matches the class at pattern[p]
 // Returns (matched, next position in pattern)
 func (ms *matchState) singleMatch(c byte, p int) (bool, int) {
@@ -130,16 +255,137 @@ func (ms *matchState) singleMatch(c byte, p int) (bool, int) {
 		}
 		return matchClass(c, ms.pattern[p+1]), p + 2
 	case '[':
-		end := classEnd(ms.pattern, p)
-		if end < 0 {
-			Errorf(ms.l, "malformed pattern (missing ']')")
-		}
+		end := ms.classEnd(p)
 		return ms.matchBracketClass(c, p, end), end
 	default:
 		return c == ms.pattern[p], p + 1
 	}
 }
 
+// itemWidth returns the number of bytes of the subject at s, which must be
+// before its end, matched by the single character item at p, or 0 if it
+// does not match. In Unicode mode classes and sets match whole characters.
+func (ms *matchState) itemWidth(s, p int) int {
+	c := ms.src[s]
+	if ms.unicode && c >= utf8.RuneSelf && p < len(ms.pattern) {
+		r, w := ms.runeAt(s)
+		switch ms.pattern[p] {
+		case '%':
+			if p+1 < len(ms.pattern) {
+				if res, ok := matchUnicodeClass(r, ms.pattern[p+1]); ok {
+					return boolToWidth(res, w)
+				}
+			}
+		case '[':
+			return boolToWidth(ms.matchBracketRune(r, p, ms.classEnd(p)), w)
+		}
+	}
+	if matched, _ := ms.singleMatch(c, p); matched {
+		return 1
+	}
+	return 0
+}
+
+// runeAt decodes the non-ASCII character at s in Unicode mode. A byte that
+// does not start a valid UTF-8 sequence is invalidRune of width 1.
+func (ms *matchState) runeAt(s int) (rune, int) {
+	r, w := utf8.DecodeRuneInString(ms.src[s:ms.srcEnd])
+	if w == 1 {
+		return invalidRune, 1
+	}
+	return r, w
+}
+
+func boolToWidth(matched bool, w int) int {
+	if matched {
+		return w
+	}
+	return 0
+}
+
+// matchSet matches the set [...] at p against the character that starts at
+// s, or ends at s if before is true. Outside the subject it sees '\0'.
+func (ms *matchState) matchSet(s, p, end int, before bool) bool {
+	if before && s == 0 || !before && s >= ms.srcEnd {
+		return ms.matchBracketClass(0, p, end)
+	}
+	i := s
+	if before {
+		i--
+	}
+	if c := ms.src[i]; !ms.unicode || c < utf8.RuneSelf {
+		return ms.matchBracketClass(c, p, end)
+	}
+	if !before {
+		r, _ := ms.runeAt(s)
+		return ms.matchBracketRune(r, p, end)
+	}
+	r, w := utf8.DecodeLastRuneInString(ms.src[:s])
+	if w == 1 {
+		r = invalidRune
+	}
+	return ms.matchBracketRune(r, p, end)
+}
+
+// matchBracketRune is matchBracketClass for a non-ASCII character in
+// Unicode mode. Characters written in the set are decoded from UTF-8.
+func (ms *matchState) matchBracketRune(r rune, p, end int) bool {
+	sig := true
+	p++ // skip '['
+	if p < end && ms.pattern[p] == '^' {
+		sig = false
+		p++
+	}
+	if p < end-1 && ms.pattern[p] == ']' {
+		p++ // a literal ']' never matches a non-ASCII character
+	}
+	for p < end-1 {
+		if ms.pattern[p] == '%' {
+			p++
+			if p >= end-1 {
+				break
+			}
+			if res, ok := matchUnicodeClass(r, ms.pattern[p]); ok {
+				if res {
+					return sig
+				}
+				p++
+				continue
+			}
+			c, w := utf8.DecodeRuneInString(ms.pattern[p : end-1]) // escaped character
+			if c == r {
+				return sig
+			}
+			p += w
+			continue
+		}
+		lo, w := utf8.DecodeRuneInString(ms.pattern[p : end-1])
+		if p+w+1 < end-1 && ms.pattern[p+w] == '-' {
+			hi, w2 := utf8.DecodeRuneInString(ms.pattern[p+w+1 : end-1])
+			if lo <= r && r <= hi {
+				return sig
+			}
+			p += w + 1 + w2
+		} else {
+			if lo == r {
+				return sig
+			}
+			p += w
+		}
+	}
+	return !sig
+}
+
+// nextStart returns the position after s where the next match is tried.
+// In Unicode mode matches start only at character boundaries.
+func (ms *matchState) nextStart(s int) int {
+	if ms.unicode && s < ms.srcEnd && ms.src[s] >= utf8.RuneSelf {
+		_, w := utf8.DecodeRuneInString(ms.src[s:ms.srcEnd])
+		return s + w
+	}
+	return s + 1
+}
+
 // Match character against bracket class [...]
 func (ms *matchState) matchBracketClass(c byte, p, end int) bool {
 	sig := true
@@ -267,19 +513,8 @@ func (ms *matchState) matchFrontier(s, p int) (int, bool) {
 	if p >= len(ms.pattern) || ms.pattern[p] != '[' {
 		Errorf(ms.l, "missing '[' after '%%f' in pattern")
 	}
-	end := classEnd(ms.pattern, p)
-	if end < 0 {
-		Errorf(ms.l, "malformed pattern (missing ']')")
-	}
-	var prev byte = 0
-	if s > 0 {
-		prev = ms.src[s-1]
-	}
-	var curr byte = 0
-	if s < ms.srcEnd {
-		curr = ms.src[s]
-	}
-	if ms.matchBracketClass(prev, p, end) || !ms.matchBracketClass(curr, p, end) {
+	end := ms.classEnd(p)
+	if ms.matchSet(s, p, end, true) || !ms.matchSet(s, p, end, false) {
 		return 0, false
 	}
 	return s, true // Return same position (frontier is zero-width)
@@ -287,6 +522,9 @@ func (ms *matchState) matchFrontier(s, p int) (int, bool) {
 
 // Match with max expansion (greedy)
 func (ms *matchState) maxExpand(s, p, ep int) (int, bool) {
+	if ms.unicode {
+		return ms.maxExpandUnicode(s, p, ep)
+	}
 	i := 0
 	for s+i < ms.srcEnd {
 		matched, _ := ms.singleMatch(ms.src[s+i], p)
@@ -306,6 +544,25 @@ func (ms *matchState) maxExpand(s, p, ep int) (int, bool) {
 	return 0, false
 }
 
+// maxExpandUnicode is maxExpand for items that may match several bytes.
+func (ms *matchState) maxExpandUnicode(s, p, ep int) (int, bool) {
+	ends := []int{s}
+	for e := s; e < ms.srcEnd; {
+		w := ms.itemWidth(e, p)
+		if w == 0 {
+			break
+		}
+		e += w
+		ends = append(ends, e)
+	}
+	for i := len(ends) - 1; i >= 0; i-- {
+		if res, ok := ms.match(ends[i], ep); ok {
+			return res, true
+		}
+	}
+	return 0, false
+}
+
 // Match with min expansion (non-greedy)
 func (ms *matchState) minExpand(s, p, ep int) (int, bool) {
 	for {
@@ -314,9 +571,8 @@ func (ms *matchState) minExpand(s, p, ep int) (int, bool) {
 			return res, true
 		}
 		if s < ms.srcEnd {
-			matched, _ := ms.singleMatch(ms.src[s], p)
-			if matched {
-				s++
+			if w := ms.itemWidth(s, p); w > 0 {
+				s += w
 				continue
 			}
 		}
@@ -333,6 +589,7 @@ func (ms *matchState) match(s, p int) (int, bool) {
 	defer func() { ms.matchDepth-- }()
 
 	for p < len(ms.pattern) {
+		ms.step()
 		switch ms.pattern[p] {
 		case '(':
 			if p+1 < len(ms.pattern) && ms.pattern[p+1] == ')' {
@@ -371,11 +628,7 @@ func (ms *matchState) match(s, p int) (int, bool) {
 					return 0, false
 				}
 				s = newS
-				end := classEnd(ms.pattern, p+2)
-				if end < 0 {
-					Errorf(ms.l, "malformed pattern (missing ']')")
-				}
-				p = end
+				p = ms.classEnd(p + 2)
 				continue
 			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 				newS, ok := ms.matchCapture(s, p+1)
@@ -398,10 +651,7 @@ func (ms *matchState) match(s, p int) (int, bool) {
 		case '%':
 			ep = p + 2
 		case '[':
-			ep = classEnd(ms.pattern, p)
-			if ep < 0 {
-				Errorf(ms.l, "malformed pattern (missing ']')")
-			}
+			ep = ms.classEnd(p)
 		default:
 			ep = p + 1
 		}
@@ -414,9 +664,8 @@ func (ms *matchState) match(s, p int) (int, bool) {
 			case '+':
 				// One or more
 				if s < ms.srcEnd {
-					matched, _ := ms.singleMatch(ms.src[s], p)
-					if matched {
-						return ms.maxExpand(s+1, p, ep+1)
+					if w := ms.itemWidth(s, p); w > 0 {
+						return ms.maxExpand(s+w, p, ep+1)
 					}
 				}
 				return 0, false
@@ -425,9 +674,8 @@ func (ms *matchState) match(s, p int) (int, bool) {
 			case '?':
 				// Zero or one
 				if s < ms.srcEnd {
-					matched, _ := ms.singleMatch(ms.src[s], p)
-					if matched {
-						res, ok := ms.match(s+1, ep+1)
+					if w := ms.itemWidth(s, p); w > 0 {
+						res, ok := ms.match(s+w, ep+1)
 						if ok {
 							return res, true
 						}
@@ -441,11 +689,11 @@ func (ms *matchState) match(s, p int) (int, bool) {
 		if s >= ms.srcEnd {
 			return 0, false
 		}
-		matched, _ := ms.singleMatch(ms.src[s], p)
-		if !matched {
+		w := ms.itemWidth(s, p)
+		if w == 0 {
 			return 0, false
 		}
-		s++
+		s += w
 		p = ep
 	}
 	return s, true
@@ -456,6 +704,7 @@ func (ms *matchState) pushCaptures(sstart, send int) int {
 	if ms.numCaptures == 0 {
 		// No captures, push whole match
 		ms.l.PushString(ms.src[sstart:send])
+		ms.l.deriveTags(ms.src[sstart:send], ms.src)
 		return 1
 	}
 	for i := 0; i < ms.numCaptures; i++ {
@@ -468,6 +717,7 @@ func (ms *matchState) pushCaptures(sstart, send int) int {
 			ms.l.PushInteger(cap.start + 1) // 1-based position
 		} else {
 			ms.l.PushString(ms.src[cap.start:cap.end])
+			ms.l.deriveTags(ms.src[cap.start:cap.end], ms.src)
 		}
 	}
 	return ms.numCaptures
@@ -478,6 +728,7 @@ func (ms *matchState) pushOneCapture(i, sstart, send int) {
 	if i >= ms.numCaptures {
 		if i == 0 {
 			ms.l.PushString(ms.src[sstart:send])
+			ms.l.deriveTags(ms.src[sstart:send], ms.src)
 		} else {
 			Errorf(ms.l, "invalid capture index %%%d", i+1)
 		}
@@ -492,6 +743,7 @@ func (ms *matchState) pushOneCapture(i, sstart, send int) {
 		ms.l.PushInteger(cap.start + 1)
 	} else {
 		ms.l.PushString(ms.src[cap.start:cap.end])
+		ms.l.deriveTags(ms.src[cap.start:cap.end], ms.src)
 	}
 }
 
@@ -500,20 +752,155 @@ func noSpecials(pattern string) bool {
 	return !strings.ContainsAny(pattern, patternSpecials)
 }
 
+// A compiledPattern is a pattern that has been scanned once. It records
+// where each bracket class ends, so matching does not look for the closing
+// ']' again every time the class is tried.
+type compiledPattern struct {
+	source  string // the pattern as written
+	pattern string // the pattern without a leading '^'
+	anchor  bool
+	plain   bool  // no special characters, find can search for a substring
+	classes []int // end of the class opened by each '[', -1 if malformed
+}
+
+func compilePattern(p string) *compiledPattern {
+	cp := &compiledPattern{source: p, plain: noSpecials(p)}
+	if cp.anchor = len(p) > 0 && p[0] == '^'; cp.anchor {
+		p = p[1:]
+	}
+	cp.pattern = p
+	for i := 0; i < len(p); i++ {
+		if p[i] == '[' {
+			if cp.classes == nil {
+				cp.classes = make([]int, len(p))
+			}
+			cp.classes[i] = classEnd(p, i)
+		}
+	}
+	return cp
+}
+
+// validate reports the first error that matching with the pattern could
+// raise regardless of the subject, or "" if there is none.
+func (cp *compiledPattern) validate() string {
+	p, open, captures := cp.pattern, 0, 0
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '(':
+			if captures++; captures > patternMaxCaptures {
+				return "too many captures"
+			}
+			if i+1 < len(p) && p[i+1] == ')' {
+				i++
+			} else {
+				open++
+			}
+		case ')':
+			if open--; open < 0 {
+				return "invalid pattern capture"
+			}
+		case '%':
+			if i++; i >= len(p) {
+				return "malformed pattern (ends with '%')"
+			}
+			switch p[i] {
+			case 'b':
+				if i += 2; i >= len(p) {
+					return "malformed pattern (missing arguments to '%b')"
+				}
+			case 'f':
+				if i+1 >= len(p) || p[i+1] != '[' {
+					return "missing '[' after '%f' in pattern"
+				}
+			}
+		case '[':
+			if cp.classes[i] < 0 {
+				return "malformed pattern (missing ']')"
+			}
+			i = cp.classes[i] - 1
+		}
+	}
+	if open > 0 {
+		return "unfinished capture"
+	}
+	return ""
+}
+
+func (cp *compiledPattern) matchState(l *State, s string) *matchState {
+	return &matchState{
+		l:        l,
+		src:      s,
+		srcEnd:   len(s),
+		pattern:  cp.pattern,
+		classes:  cp.classes,
+		maxSteps: l.global.patternStepLimit,
+		unicode:  l.global.unicodePatterns,
+	}
+}
+
+// patternCacheSize is the number of compiled patterns kept by each state.
+// Patterns longer than maxCachedPattern are compiled on every use.
+const (
+	patternCacheSize = 64
+	maxCachedPattern = 1024
+)
+
+// A patternCache holds the most recently used compiled patterns, so hot
+// loops calling string.find or string.gsub with the same pattern do not
+// compile it over and over.
+type patternCache struct {
+	entries map[string]*list.Element
+	order   list.List // most recently used first
+}
+
+func (c *patternCache) get(p string) *compiledPattern {
+	if e, ok := c.entries[p]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*compiledPattern)
+	}
+	cp := compilePattern(p)
+	if len(p) > maxCachedPattern {
+		return cp
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[p] = c.order.PushFront(cp)
+	if c.order.Len() > patternCacheSize {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*compiledPattern).source)
+	}
+	return cp
+}
+
+// checkPattern returns the pattern at index, which is either a string or a
+// pattern object created by string.pattern.
+func checkPattern(l *State, index int) *compiledPattern {
+	if cp, ok := l.ToUserData(index).(*compiledPattern); ok {
+		return cp
+	}
+	return l.global.patterns.get(CheckString(l, index))
+}
+
 func findHelper(l *State, isFind bool) int {
-	s, p := CheckString(l, 1), CheckString(l, 2)
-	init := relativePosition(OptInteger(l, 3, 1), len(s))
-	if init < 1 {
-		init = 1
-	} else if init > len(s)+1 {
+	s := CheckString(l, 1)
+	return find(l, s, checkPattern(l, 2), isFind)
+}
+
+// find implements find and match for the subject s. The optional init and
+// plain arguments are at indices 3 and 4.
+func find(l *State, s string, cp *compiledPattern, isFind bool) int {
+	init64 := startPosition(OptInteger64(l, 3, 1), len(s))
+	if init64 > int64(len(s))+1 {
 		l.PushNil()
 		return 1
 	}
+	init := int(init64)
 
 	// For find with plain=true or no special characters, use simple search
 	if isFind {
-		isPlain := l.ToBoolean(4)
-		if isPlain || noSpecials(p) {
+		if p := cp.source; l.ToBoolean(4) || cp.plain {
 			if start := strings.Index(s[init-1:], p); start >= 0 {
 				l.PushInteger(start + init)
 				l.PushInteger(start + init + len(p) - 1)
@@ -525,19 +912,7 @@ func findHelper(l *State, isFind bool) int {
 	}
 
 	// Pattern matching
-	anchor := len(p) > 0 && p[0] == '^'
-	patStart := 0
-	if anchor {
-		patStart = 1
-	}
-
-	ms := &matchState{
-		l:       l,
-		src:     s,
-		srcEnd:  len(s),
-		pattern: p[patStart:],
-	}
-
+	ms := cp.matchState(l, s)
 	spos := init - 1 // Convert to 0-based
 	for {
 		ms.captures = ms.captures[:0]
@@ -548,13 +923,16 @@ func findHelper(l *State, isFind bool) int {
 			if isFind {
 				l.PushInteger(spos + 1) // 1-based start
 				l.PushInteger(end)      // 1-based end (end is already past-the-end in 0-based)
+				if ms.numCaptures == 0 {
+					return 2 // unlike match, find doesn't repeat the whole match
+				}
 				return 2 + ms.pushCaptures(spos, end)
 			}
 			return ms.pushCaptures(spos, end)
 		}
 
-		spos++
-		if spos > len(s) || anchor {
+		spos = ms.nextStart(spos)
+		if spos > len(s) || cp.anchor {
 			break
 		}
 	}
@@ -564,18 +942,80 @@ func findHelper(l *State, isFind bool) int {
 }
 
 // scanFormat greedily scans a format specifier (like C Lua's getformat).
-// It collects flags, digits, dots, and the conversion character.
+// It collects flags, digits, dots, and the conversion character following
+// the '%' that fs starts with, and returns the specifier as a slice of fs.
 func scanFormat(l *State, fs string) string {
 	const allFlags = "-+ #0123456789."
-	i := 0
-	for i < len(fs) && strings.ContainsRune(allFlags, rune(fs[i])) {
+	i := 1
+	for i < len(fs) && strings.IndexByte(allFlags, fs[i]) >= 0 {
 		i++
 	}
-	i++         // include the conversion specifier
 	if i > 22 { // MAX_FORMAT - 10
 		Errorf(l, "invalid format (too long)")
 	}
-	return "%" + fs[:i]
+	return fs[:min(i+1, len(fs))] // include the conversion specifier
+}
+
+// A formatSpec is a conversion specifier of string.format that has been
+// validated by checkFormat, broken up into its parts.
+type formatSpec struct {
+	minus, zero, other bool // other is set for the flags '+', ' ' and '#'
+	width, precision   int  // precision is -1 if there is none
+}
+
+func parseFormatSpec(f string) (spec formatSpec) {
+	i := 1
+	for ; i < len(f); i++ {
+		if c := f[i]; c == '-' {
+			spec.minus = true
+		} else if c == '0' {
+			spec.zero = true
+		} else if c == '+' || c == ' ' || c == '#' {
+			spec.other = true
+		} else {
+			break
+		}
+	}
+	for ; f[i] >= '0' && f[i] <= '9'; i++ {
+		spec.width = spec.width*10 + int(f[i]-'0')
+	}
+	spec.precision = -1
+	if f[i] == '.' {
+		spec.precision = 0
+		for i++; f[i] >= '0' && f[i] <= '9'; i++ {
+			spec.precision = spec.precision*10 + int(f[i]-'0')
+		}
+	}
+	return
+}
+
+// writePadded writes num padded to the width of spec like fmt does: with
+// spaces on the left, on the right for '-', or with zeros after the sign.
+func (spec formatSpec) writePadded(b *strings.Builder, num []byte) {
+	pad := spec.width - len(num)
+	switch {
+	case pad <= 0:
+		b.Write(num)
+	case spec.minus:
+		b.Write(num)
+		writeRepeated(b, ' ', pad)
+	case spec.zero:
+		if num[0] == '-' {
+			b.WriteByte('-')
+			num = num[1:]
+		}
+		writeRepeated(b, '0', pad)
+		b.Write(num)
+	default:
+		writeRepeated(b, ' ', pad)
+		b.Write(num)
+	}
+}
+
+func writeRepeated(b *strings.Builder, c byte, n int) {
+	for ; n > 0; n-- {
+		b.WriteByte(c)
+	}
 }
 
 // checkFormat validates a format specifier per conversion type (like C Lua's checkformat).
@@ -609,72 +1049,120 @@ func checkFormat(l *State, form string, flags string, precision bool) {
 }
 
 func formatHelper(l *State, fs string, argCount int) string {
-	var b bytes.Buffer
+	var b strings.Builder
+	var scratch [72]byte // holds any number formatted by strconv
+	b.Grow(len(fs))
 	for i, arg := 0, 1; i < len(fs); i++ {
 		if fs[i] != '%' {
-			b.WriteByte(fs[i])
-		} else if i++; fs[i] == '%' {
-			b.WriteByte(fs[i])
+			j := strings.IndexByte(fs[i:], '%')
+			if j < 0 {
+				j = len(fs) - i
+			}
+			b.WriteString(fs[i : i+j])
+			i += j - 1
+		} else if i+1 < len(fs) && fs[i+1] == '%' {
+			b.WriteByte('%')
+			i++
 		} else {
 			if arg++; arg > argCount {
 				ArgumentError(l, arg, "no value")
 			}
 			f := scanFormat(l, fs[i:])
-			switch i += len(f) - 2; fs[i] {
+			if i += len(f) - 1; len(f) < 2 || strings.IndexByte("-+ #0123456789.", f[len(f)-1]) >= 0 {
+				Errorf(l, "invalid conversion '%s' to 'format'", f)
+			}
+			switch fs[i] {
 			case 'c':
 				checkFormat(l, f, "-", false)
 				// Lua's %c produces a single byte (like string.char), not UTF-8
 				c := CheckInteger(l, arg)
-				charStr := string([]byte{byte(c)})
-				fmtStr := f[:len(f)-1] + "s"
-				fmt.Fprintf(&b, fmtStr, charStr)
+				if len(f) == 2 {
+					b.WriteByte(byte(c))
+				} else {
+					parseFormatSpec(f).writePadded(&b, []byte{byte(c)})
+				}
 			case 'i': // The fmt package doesn't support %i.
 				f = f[:len(f)-1] + "d"
 				fallthrough
 			case 'd':
 				checkFormat(l, f, "-+0 ", true)
 				// Lua 5.3: handle integers directly to preserve precision
-				v := l.ToValue(arg)
-				switch val := v.(type) {
+				var n int64
+				switch val := l.ToValue(arg).(type) {
 				case int64:
-					fmt.Fprintf(&b, f, val)
+					n = val
 				case float64:
 					ArgumentCheck(l, math.Floor(val) == val && -math.Pow(2, 63) <= val && val < math.Pow(2, 63), arg, "number has no integer representation")
-					fmt.Fprintf(&b, f, int64(val))
+					n = int64(val)
 				default:
 					Errorf(l, "number expected")
 				}
+				if spec := parseFormatSpec(f); !spec.other && spec.precision < 0 {
+					spec.writePadded(&b, strconv.AppendInt(scratch[:0], n, 10))
+				} else {
+					fmt.Fprintf(&b, f, n)
+				}
 			case 'u': // The fmt package doesn't support %u.
 				checkFormat(l, f, "-0", true)
 				// Lua 5.3: handle integers as unsigned
-				// Preserve format flags/precision by replacing 'u' with 'd'
-				fmtStr := f[:len(f)-1] + "d"
-				v := l.ToValue(arg)
-				switch val := v.(type) {
+				var n uint64
+				switch val := l.ToValue(arg).(type) {
 				case int64:
-					fmt.Fprintf(&b, fmtStr, uint64(val))
+					n = uint64(val)
 				case float64:
 					ArgumentCheck(l, math.Floor(val) == val && 0.0 <= val && val < math.Pow(2, 64), arg, "not a non-negative number in proper range")
-					fmt.Fprintf(&b, fmtStr, uint64(val))
+					n = uint64(val)
 				default:
 					Errorf(l, "number expected")
 				}
+				if spec := parseFormatSpec(f); spec.precision < 0 {
+					spec.writePadded(&b, strconv.AppendUint(scratch[:0], n, 10))
+				} else {
+					// Preserve format flags/precision by replacing 'u' with 'd'
+					fmt.Fprintf(&b, f[:len(f)-1]+"d", n)
+				}
 			case 'o', 'x', 'X':
 				checkFormat(l, f, "-#0", true)
 				// Lua 5.3: integers (including negative) are treated as unsigned
-				v := l.ToValue(arg)
-				switch val := v.(type) {
+				var n uint64
+				switch val := l.ToValue(arg).(type) {
 				case int64:
-					fmt.Fprintf(&b, f, uint64(val))
+					n = uint64(val)
 				case float64:
 					ArgumentCheck(l, 0.0 <= val && val < math.Pow(2, 64), arg, "not a non-negative number in proper range")
-					fmt.Fprintf(&b, f, uint64(val))
+					n = uint64(val)
 				default:
 					Errorf(l, "number expected")
 				}
+				if spec := parseFormatSpec(f); !spec.other && spec.precision < 0 {
+					base := 16
+					if fs[i] == 'o' {
+						base = 8
+					}
+					num := strconv.AppendUint(scratch[:0], n, base)
+					if fs[i] == 'X' {
+						for k, c := range num {
+							if c >= 'a' {
+								num[k] = c - 'a' + 'A'
+							}
+						}
+					}
+					spec.writePadded(&b, num)
+				} else {
+					fmt.Fprintf(&b, f, n)
+				}
 			case 'e', 'E', 'f', 'g', 'G':
 				checkFormat(l, f, "-+ #0", true)
-				fmt.Fprintf(&b, f, CheckNumber(l, arg))
+				n := CheckNumber(l, arg)
+				if spec := parseFormatSpec(f); !spec.other && !math.IsInf(n, 0) && !math.IsNaN(n) {
+					precision := spec.precision
+					if precision < 0 && fs[i] != 'g' && fs[i] != 'G' {
+						precision = 6
+					}
+					spec.writePadded(&b, strconv.AppendFloat(scratch[:0], n, fs[i], precision, 64))
+				} else {
+					fmt.Fprintf(&b, f, n)
+				}
 			case 'a', 'A':
 				checkFormat(l, f, "-+ #0", true)
 				// Lua 5.3: hexadecimal floating-point format
@@ -827,17 +1315,61 @@ func formatHelper(l *State, fs string, argCount int) string {
 //   ![n] = set max alignment to n (1-16, default native)
 //   b/B = signed/unsigned byte
 //   h/H = signed/unsigned short (2 bytes)
-//   l/L = signed/unsigned long (4 bytes)
+//   l/L = signed/unsigned long (4 bytes, see packProfiles)
 //   j/J = lua_Integer/lua_Unsigned (8 bytes)
-//   T = size_t (8 bytes)
+//   T = size_t (8 bytes, see packProfiles)
 //   i[n]/I[n] = signed/unsigned int with n bytes (default 4)
-//   f = float (4 bytes), d = double (8 bytes), n = lua_Number (8 bytes)
+//   e = half float (2 bytes), f = float (4 bytes), d = double (8 bytes),
+//   n = lua_Number (8 bytes)
 //   cn = fixed string of n bytes
 //   z = zero-terminated string
-//   s[n] = string with length prefix of n bytes (default 8)
+//   s[n] = string with length prefix of n bytes (default size_t)
 //   x = one byte padding
 //   Xop = align to option op (no data)
 //   (space) = ignored
+//
+// Infinities and signed zeros round-trip through all float options. NaNs
+// stay NaNs: e and f keep their sign and signaling NaNs, and narrow the
+// payload with narrowNaN, which keeps its high bits. Finite numbers are
+// rounded to the nearest value of e or f, and become infinities if they are
+// out of range.
+
+// A packProfile describes the C ABI that pack formats start from: the byte
+// order, the alignment, and the sizes of long and size_t.
+type packProfile struct {
+	name    string
+	endian  byte // '<', '>' or '=' for native
+	align   int  // maximum alignment, also the default for '!'
+	aligned bool // whether formats start aligned, as if they began with '!'
+	long    int
+	sizeT   int
+}
+
+// packProfiles lists the profiles selectable with string.packprofile. The
+// first one is the default and matches plain Lua.
+var packProfiles = []*packProfile{
+	{name: "lua", endian: '=', align: 8, long: 4, sizeT: 8},
+	{name: "c-amd64", endian: '<', align: 8, aligned: true, long: 8, sizeT: 8},
+	{name: "c-arm64", endian: '<', align: 8, aligned: true, long: 8, sizeT: 8},
+	{name: "c-win64", endian: '<', align: 8, aligned: true, long: 4, sizeT: 8},
+	{name: "c-i386", endian: '<', align: 4, aligned: true, long: 4, sizeT: 4},
+	{name: "c-arm", endian: '<', align: 8, aligned: true, long: 4, sizeT: 4},
+	{name: "c-ppc64", endian: '>', align: 8, aligned: true, long: 8, sizeT: 8},
+}
+
+func (g *globalState) packLayout() *packProfile {
+	if g.packProfile == nil {
+		return packProfiles[0]
+	}
+	return g.packProfile
+}
+
+func (pp *packProfile) littleEndian() bool {
+	if pp.endian == '=' {
+		return endianness() == binary.LittleEndian
+	}
+	return pp.endian == '<'
+}
 
 type packState struct {
 	fmt           string
@@ -845,26 +1377,40 @@ type packState struct {
 	littleEnd     bool
 	maxAlign      int
 	alignExplicit bool // true if ! was used explicitly
+	profile       *packProfile
+	fail          func(arg int, message string) // does not return; arg 0 is no particular argument
+	lengthField   bool                          // the next integer is a length for 'c#'
+	length        int64                         // the last length field, for 'c#'
+	haveLength    bool
 }
 
-func newPackState(fmt string) *packState {
-	return &packState{
+func newPackState(l *State, fmt string) *packState {
+	return newPackStateWithProfile(fmt, l.global.packLayout(), func(arg int, message string) {
+		if arg == 0 {
+			Errorf(l, "%s", message)
+		}
+		ArgumentError(l, arg, message)
+	})
+}
+
+func newPackStateWithProfile(fmt string, pp *packProfile, fail func(int, string)) *packState {
+	ps := &packState{
 		fmt:           fmt,
 		pos:           0,
-		littleEnd:     nativeEndian() == binary.LittleEndian,
+		littleEnd:     pp.littleEndian(),
 		maxAlign:      1, // default is 1 (no alignment); ! option changes this
-		alignExplicit: false,
+		alignExplicit: pp.aligned,
+		profile:       pp,
+		fail:          fail,
+	}
+	if pp.aligned {
+		ps.maxAlign = pp.align
 	}
+	return ps
 }
 
-func nativeEndian() binary.ByteOrder {
-	// Check native endianness using unsafe
-	var x uint16 = 0x0102
-	b := *(*[2]byte)(unsafe.Pointer(&x))
-	if b[0] == 0x02 {
-		return binary.LittleEndian
-	}
-	return binary.BigEndian
+func (ps *packState) errorf(format string, args ...interface{}) {
+	ps.fail(0, fmt.Sprintf(format, args...))
 }
 
 func (ps *packState) byteOrder() binary.ByteOrder {
@@ -874,6 +1420,35 @@ func (ps *packState) byteOrder() binary.ByteOrder {
 	return binary.BigEndian
 }
 
+// putInteger writes the low size bytes of n, for sizes up to 8.
+func (ps *packState) putInteger(buf *bytes.Buffer, n uint64, size int) {
+	b := make([]byte, 8)
+	if ps.littleEnd {
+		binary.LittleEndian.PutUint64(b, n)
+		buf.Write(b[:size])
+	} else {
+		binary.BigEndian.PutUint64(b, n)
+		buf.Write(b[8-size:])
+	}
+}
+
+// integer reads an integer of up to 8 bytes from the start of data.
+func (ps *packState) integer(data string, size int, signed bool) int64 {
+	b := make([]byte, 8)
+	var v uint64
+	if ps.littleEnd {
+		copy(b, data[:size])
+		v = binary.LittleEndian.Uint64(b)
+	} else {
+		copy(b[8-size:], data[:size])
+		v = binary.BigEndian.Uint64(b)
+	}
+	if shift := uint(64 - 8*size); signed && shift > 0 {
+		return int64(v<<shift) >> shift
+	}
+	return int64(v)
+}
+
 func (ps *packState) eof() bool {
 	return ps.pos >= len(ps.fmt)
 }
@@ -911,6 +1486,45 @@ func (ps *packState) getNum(def int) int {
 	return n
 }
 
+// stringSize returns the size of a 'c' option. "c#" takes it from the last
+// integer that was marked as a length field with '#', as in ">#I2 B c#",
+// for layouts where a length precedes the bytes, possibly with other fields
+// in between.
+func (ps *packState) stringSize() int {
+	if !ps.eof() && ps.peek() == '#' {
+		ps.next()
+		if !ps.haveLength {
+			ps.errorf("no length field ('#') before option 'c#'")
+		} else if ps.length < 0 || ps.length > 0x7FFFFFFF {
+			ps.errorf("invalid length (%d) for option 'c#'", ps.length)
+		}
+		return int(ps.length)
+	}
+	size := ps.getNum(-1)
+	if size < 0 {
+		ps.errorf("missing size for format option 'c'")
+	}
+	return size
+}
+
+// markLength handles the '#' option, which marks the following integer
+// option as a length field.
+func (ps *packState) markLength() {
+	if ps.eof() || strings.IndexByte("bBhHlLTjJiI", ps.peek()) < 0 {
+		ps.errorf("option '#' must precede an integer option")
+	}
+	ps.lengthField = true
+}
+
+// setInt records n as the length for a following "c#" if its option was
+// marked with '#'.
+func (ps *packState) setInt(n int64) int64 {
+	if ps.lengthField {
+		ps.length, ps.haveLength, ps.lengthField = n, true, false
+	}
+	return n
+}
+
 func isDigit(c byte) bool {
 	return c >= '0' && c <= '9'
 }
@@ -931,6 +1545,85 @@ func isPowerOf2(n int) bool {
 	return n > 0 && (n&(n-1)) == 0
 }
 
+// float16bits returns the IEEE 754 half precision encoding of f, rounding
+// to nearest even.
+func float16bits(f float64) uint16 {
+	b := math.Float64bits(f)
+	sign := uint16(b>>48) & 0x8000
+	exp, mant := int(b>>52)&0x7ff, b&(1<<52-1)
+	roundShift := func(m uint64, s uint) uint64 {
+		r, rem, half := m>>s, m&(1<<s-1), uint64(1)<<(s-1)
+		if rem > half || rem == half && r&1 == 1 {
+			r++
+		}
+		return r
+	}
+	switch e := exp - 1023 + 15; {
+	case exp == 0x7ff && mant == 0:
+		return sign | 0x7c00
+	case exp == 0x7ff:
+		return sign | 0x7c00 | uint16(narrowNaN(mant, 42))
+	case e >= 31:
+		return sign | 0x7c00
+	case e > 0: // a carry out of the mantissa correctly increments the exponent
+		return sign | uint16(uint64(e)<<10+roundShift(mant, 42))
+	case e > -11:
+		return sign | uint16(roundShift(mant|1<<52, uint(43-e)))
+	}
+	return sign
+}
+
+// narrowNaN returns the mantissa of a NaN with the 52-bit mantissa mant in
+// a format with shift fewer mantissa bits. It keeps the quiet bit and the
+// high bits of the payload. A signaling NaN whose payload is in the low bits
+// only keeps its lowest bit set, so that it does not become an infinity.
+func narrowNaN(mant uint64, shift uint) uint64 {
+	if m := mant >> shift; m != 0 {
+		return m
+	}
+	return 1
+}
+
+// float32bits returns the IEEE 754 single precision encoding of f. Numbers
+// are rounded to nearest even by the conversion. NaNs are converted
+// explicitly, as the hardware conversion makes signaling NaNs quiet: the
+// sign, the quiet bit and the high 22 bits of the payload are kept.
+func float32bits(f float64) uint32 {
+	if f != f {
+		b := math.Float64bits(f)
+		return uint32(b>>32)&0x80000000 | 0x7f800000 | uint32(narrowNaN(b&(1<<52-1), 29))
+	}
+	return math.Float32bits(float32(f))
+}
+
+// float32frombits returns the number whose single precision encoding is b.
+// NaNs keep their sign, quiet bit and payload.
+func float32frombits(b uint32) float64 {
+	if b&0x7f800000 == 0x7f800000 && b&0x7fffff != 0 {
+		return math.Float64frombits(uint64(b&0x80000000)<<32 | 0x7ff<<52 | uint64(b&0x7fffff)<<29)
+	}
+	return float64(math.Float32frombits(b))
+}
+
+// float16frombits returns the number whose half precision encoding is h.
+func float16frombits(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	switch exp, mant := int(h>>10)&0x1f, uint64(h&0x3ff); exp {
+	case 0:
+		return sign * math.Ldexp(float64(mant), -24)
+	case 0x1f:
+		if mant == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.Float64frombits(uint64(h&0x8000)<<48 | 0x7ff<<52 | mant<<42)
+	default:
+		return sign * math.Ldexp(float64(mant|0x400), exp-25)
+	}
+}
+
 func addPadding(buf *bytes.Buffer, pos, align int) int {
 	if align <= 1 {
 		return 0
@@ -943,10 +1636,33 @@ func addPadding(buf *bytes.Buffer, pos, align int) int {
 }
 
 func stringPack(l *State) int {
-	fmtStr := CheckString(l, 1)
-	ps := newPackState(fmtStr)
 	var buf bytes.Buffer
-	arg := 2
+	newPackState(l, CheckString(l, 1)).pack(&buf, luaPackSource{l}, 2)
+	l.PushString(buf.String())
+	return 1
+}
+
+// A packSource supplies the values that pack writes, by argument number.
+// Errors are reported through the fail function of the pack state.
+type packSource interface {
+	checkInteger(ps *packState, arg int) int64      // like CheckInteger
+	toInteger(ps *packState, arg int) (int64, bool) // like ToInteger
+	checkNumber(ps *packState, arg int) float64     // like CheckNumber
+	checkString(ps *packState, arg int) string      // like CheckString
+}
+
+// A luaPackSource supplies the arguments of string.pack.
+type luaPackSource struct{ l *State }
+
+func (s luaPackSource) checkInteger(_ *packState, arg int) int64 { return CheckInteger64(s.l, arg) }
+func (s luaPackSource) toInteger(_ *packState, arg int) (int64, bool) {
+	return s.l.ToInteger64(arg)
+}
+func (s luaPackSource) checkNumber(_ *packState, arg int) float64 { return CheckNumber(s.l, arg) }
+func (s luaPackSource) checkString(_ *packState, arg int) string  { return CheckString(s.l, arg) }
+
+// pack appends the values of src, starting with argument arg, to buf.
+func (ps *packState) pack(buf *bytes.Buffer, src packSource, arg int) {
 	totalSize := 0
 
 	for !ps.eof() {
@@ -959,120 +1675,112 @@ func stringPack(l *State) int {
 		case '>':
 			ps.littleEnd = false
 		case '=':
-			ps.littleEnd = nativeEndian() == binary.LittleEndian
+			ps.littleEnd = ps.profile.littleEndian()
+		case '#':
+			ps.markLength()
 		case '!':
-			ps.maxAlign = ps.optSize(8)
+			ps.maxAlign = ps.optSize(ps.profile.align)
 			ps.alignExplicit = true
 			if ps.maxAlign < 1 || ps.maxAlign > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", ps.maxAlign)
+				ps.errorf("integral size (%d) out of limits [1,16]", ps.maxAlign)
 			}
 		case 'b': // signed byte
-			n := CheckInteger(l, arg)
+			n := ps.setInt(src.checkInteger(ps, arg))
 			arg++
 			if n < -128 || n > 127 {
-				ArgumentError(l, arg-1, "integer overflow")
+				ps.fail(arg-1, "integer overflow")
 			}
 			buf.WriteByte(byte(int8(n)))
 			totalSize++
 		case 'B': // unsigned byte
-			n := CheckInteger(l, arg)
+			n := ps.setInt(src.checkInteger(ps, arg))
 			arg++
 			if n < 0 || n > 255 {
-				ArgumentError(l, arg-1, "unsigned overflow")
+				ps.fail(arg-1, "unsigned overflow")
 			}
 			buf.WriteByte(byte(n))
 			totalSize++
 		case 'h': // signed short (2 bytes)
-			n := CheckInteger(l, arg)
+			n := ps.setInt(src.checkInteger(ps, arg))
 			arg++
 			align := ps.align(2)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 2)
 			ps.byteOrder().PutUint16(b, uint16(int16(n)))
 			buf.Write(b)
 			totalSize += 2
 		case 'H': // unsigned short (2 bytes)
-			n := CheckInteger(l, arg)
+			n := ps.setInt(src.checkInteger(ps, arg))
 			arg++
 			align := ps.align(2)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 2)
 			ps.byteOrder().PutUint16(b, uint16(n))
 			buf.Write(b)
 			totalSize += 2
-		case 'l': // signed long (4 bytes)
-			n := CheckInteger(l, arg)
+		case 'l', 'L': // signed/unsigned long
+			n := ps.setInt(src.checkInteger(ps, arg))
 			arg++
-			align := ps.align(4)
-			pad := addPadding(&buf, totalSize, align)
-			totalSize += pad
-			b := make([]byte, 4)
-			ps.byteOrder().PutUint32(b, uint32(int32(n)))
-			buf.Write(b)
-			totalSize += 4
-		case 'L': // unsigned long (4 bytes)
-			n := CheckInteger(l, arg)
-			arg++
-			align := ps.align(4)
-			pad := addPadding(&buf, totalSize, align)
-			totalSize += pad
-			b := make([]byte, 4)
-			ps.byteOrder().PutUint32(b, uint32(n))
-			buf.Write(b)
-			totalSize += 4
+			size := ps.profile.long
+			totalSize += addPadding(buf, totalSize, ps.align(size))
+			ps.putInteger(buf, uint64(n), size)
+			totalSize += size
 		case 'j': // lua_Integer (8 bytes signed)
-			n, ok := l.ToInteger64(arg)
+			n, ok := src.toInteger(ps, arg)
 			if !ok {
-				ArgumentError(l, arg, "integer expected")
+				ps.fail(arg, "integer expected")
 			}
+			ps.setInt(n)
 			arg++
 			align := ps.align(8)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 8)
 			ps.byteOrder().PutUint64(b, uint64(n))
 			buf.Write(b)
 			totalSize += 8
 		case 'J': // lua_Unsigned (8 bytes unsigned)
-			n, ok := l.ToInteger64(arg)
+			n, ok := src.toInteger(ps, arg)
 			if !ok {
-				ArgumentError(l, arg, "integer expected")
+				ps.fail(arg, "integer expected")
 			}
+			ps.setInt(n)
 			arg++
 			align := ps.align(8)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 8)
 			ps.byteOrder().PutUint64(b, uint64(n))
 			buf.Write(b)
 			totalSize += 8
-		case 'T': // size_t (8 bytes on 64-bit)
-			n, ok := l.ToInteger64(arg)
+		case 'T': // size_t
+			n, ok := src.toInteger(ps, arg)
 			if !ok {
-				ArgumentError(l, arg, "integer expected")
+				ps.fail(arg, "integer expected")
 			}
+			ps.setInt(n)
 			arg++
+			size := ps.profile.sizeT
 			if n < 0 {
-				ArgumentError(l, arg-1, "value out of range")
+				ps.fail(arg-1, "value out of range")
+			} else if size < 8 && uint64(n) >= uint64(1)<<uint(size*8) {
+				ps.fail(arg-1, "unsigned overflow")
 			}
-			align := ps.align(8)
-			pad := addPadding(&buf, totalSize, align)
-			totalSize += pad
-			b := make([]byte, 8)
-			ps.byteOrder().PutUint64(b, uint64(n))
-			buf.Write(b)
-			totalSize += 8
+			totalSize += addPadding(buf, totalSize, ps.align(size))
+			ps.putInteger(buf, uint64(n), size)
+			totalSize += size
 		case 'i', 'I': // signed/unsigned int with optional size
 			size := ps.optSize(4)
 			if size < 1 || size > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+				ps.errorf("integral size (%d) out of limits [1,16]", size)
 			}
-			n, ok := l.ToInteger64(arg)
+			n, ok := src.toInteger(ps, arg)
 			if !ok {
-				ArgumentError(l, arg, "integer expected")
+				ps.fail(arg, "integer expected")
 			}
+			ps.setInt(n)
 			arg++
 			// Overflow check for sizes < 8 bytes
 			if size < 8 {
@@ -1080,21 +1788,21 @@ func stringPack(l *State) int {
 					// Unsigned: check [0, 2^(size*8)-1]
 					maxVal := uint64(1) << uint(size*8)
 					if n < 0 || uint64(n) >= maxVal {
-						ArgumentError(l, arg-1, "unsigned overflow")
+						ps.fail(arg-1, "unsigned overflow")
 					}
 				} else {
 					// Signed: check [-2^(size*8-1), 2^(size*8-1)-1]
 					lim := int64(1) << uint(size*8-1)
 					if n < -lim || n >= lim {
-						ArgumentError(l, arg-1, "integer overflow")
+						ps.fail(arg-1, "integer overflow")
 					}
 				}
 			}
 			align := ps.align(size)
 			if ps.alignExplicit && align > 1 && !isPowerOf2(align) {
-				ArgumentError(l, 1, "format asks for alignment not power of 2")
+				ps.fail(1, "format asks for alignment not power of 2")
 			}
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 16)
 			if opt == 'I' {
@@ -1128,35 +1836,40 @@ func stringPack(l *State) int {
 				buf.Write(b[16-size:])
 			}
 			totalSize += size
+		case 'e': // half float (2 bytes)
+			n := src.checkNumber(ps, arg)
+			arg++
+			totalSize += addPadding(buf, totalSize, ps.align(2))
+			b := make([]byte, 2)
+			ps.byteOrder().PutUint16(b, float16bits(n))
+			buf.Write(b)
+			totalSize += 2
 		case 'f': // float (4 bytes)
-			n := CheckNumber(l, arg)
+			n := src.checkNumber(ps, arg)
 			arg++
 			align := ps.align(4)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 4)
-			ps.byteOrder().PutUint32(b, math.Float32bits(float32(n)))
+			ps.byteOrder().PutUint32(b, float32bits(n))
 			buf.Write(b)
 			totalSize += 4
 		case 'd', 'n': // double / lua_Number (8 bytes)
-			n := CheckNumber(l, arg)
+			n := src.checkNumber(ps, arg)
 			arg++
 			align := ps.align(8)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			b := make([]byte, 8)
 			ps.byteOrder().PutUint64(b, math.Float64bits(n))
 			buf.Write(b)
 			totalSize += 8
 		case 'c': // fixed string
-			size := ps.getNum(-1)
-			if size < 0 {
-				Errorf(l, "missing size for format option 'c'")
-			}
-			s := CheckString(l, arg)
+			size := ps.stringSize()
+			s := src.checkString(ps, arg)
 			arg++
 			if len(s) > size {
-				ArgumentError(l, arg-1, "string longer than given size")
+				ps.fail(arg-1, "string longer than given size")
 			}
 			if len(s) < size {
 				buf.WriteString(s)
@@ -1168,31 +1881,31 @@ func stringPack(l *State) int {
 			}
 			totalSize += size
 		case 'z': // zero-terminated string
-			s := CheckString(l, arg)
+			s := src.checkString(ps, arg)
 			arg++
 			// Check for embedded nulls
 			if strings.ContainsRune(s, 0) {
-				ArgumentError(l, arg-1, "string contains zeros")
+				ps.fail(arg-1, "string contains zeros")
 			}
 			buf.WriteString(s)
 			buf.WriteByte(0)
 			totalSize += len(s) + 1
 		case 's': // string with length prefix
-			size := ps.optSize(8)
+			size := ps.optSize(ps.profile.sizeT)
 			if size < 1 || size > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+				ps.errorf("integral size (%d) out of limits [1,16]", size)
 			}
-			s := CheckString(l, arg)
+			s := src.checkString(ps, arg)
 			arg++
 			// Check if string length fits in size bytes
 			if size < 8 {
 				maxLen := uint64(1) << uint(size*8)
 				if uint64(len(s)) >= maxLen {
-					ArgumentError(l, arg-1, "string length does not fit in given size")
+					ps.fail(arg-1, "string length does not fit in given size")
 				}
 			}
 			align := ps.align(size)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 			// Write length (support up to 16 bytes)
 			b := make([]byte, 16)
@@ -1214,31 +1927,33 @@ func stringPack(l *State) int {
 			totalSize++
 		case 'X': // alignment only (no data read)
 			if ps.eof() {
-				Errorf(l, "invalid next option for option 'X'")
+				ps.errorf("invalid next option for option 'X'")
 			}
 			alignOpt := ps.next()
-			alignSize := getOptionSizeForX(alignOpt, ps, l)
+			alignSize := getOptionSizeForX(alignOpt, ps)
 			align := ps.align(alignSize)
-			pad := addPadding(&buf, totalSize, align)
+			pad := addPadding(buf, totalSize, align)
 			totalSize += pad
 		default:
-			Errorf(l, fmt.Sprintf("invalid format option '%c'", opt))
+			ps.errorf("invalid format option '%c'", opt)
 		}
 	}
 
-	l.PushString(buf.String())
-	return 1
 }
 
 func getOptionSize(opt byte, ps *packState, l *State) int {
 	switch opt {
 	case 'b', 'B', 'x':
 		return 1
-	case 'h', 'H':
+	case 'h', 'H', 'e':
 		return 2
-	case 'l', 'L', 'f':
+	case 'f':
 		return 4
-	case 'j', 'J', 'T', 'd', 'n':
+	case 'l', 'L':
+		return ps.profile.long
+	case 'T':
+		return ps.profile.sizeT
+	case 'j', 'J', 'd', 'n':
 		return 8
 	case 'i', 'I':
 		size := ps.optSize(4)
@@ -1247,7 +1962,7 @@ func getOptionSize(opt byte, ps *packState, l *State) int {
 		}
 		return size
 	case 's':
-		size := ps.optSize(8)
+		size := ps.optSize(ps.profile.sizeT)
 		if size < 1 || size > 16 {
 			Errorf(l, "integral size (%d) out of limits [1,16]", size)
 		}
@@ -1258,51 +1973,111 @@ func getOptionSize(opt byte, ps *packState, l *State) int {
 }
 
 // getOptionSizeForX is like getOptionSize but errors on invalid options for X
-func getOptionSizeForX(opt byte, ps *packState, l *State) int {
+func getOptionSizeForX(opt byte, ps *packState) int {
 	switch opt {
 	case 'b', 'B', 'x':
 		return 1
-	case 'h', 'H':
+	case 'h', 'H', 'e':
 		return 2
-	case 'l', 'L', 'f':
+	case 'f':
 		return 4
-	case 'j', 'J', 'T', 'd', 'n':
+	case 'l', 'L':
+		return ps.profile.long
+	case 'T':
+		return ps.profile.sizeT
+	case 'j', 'J', 'd', 'n':
 		return 8
 	case 'i', 'I':
 		size := ps.optSize(4)
 		if size < 1 || size > 16 {
-			Errorf(l, "integral size (%d) out of limits [1,16]", size)
+			ps.errorf("integral size (%d) out of limits [1,16]", size)
 		}
 		return size
 	case 's':
-		size := ps.optSize(8)
+		size := ps.optSize(ps.profile.sizeT)
 		if size < 1 || size > 16 {
-			Errorf(l, "integral size (%d) out of limits [1,16]", size)
+			ps.errorf("integral size (%d) out of limits [1,16]", size)
 		}
 		return size
 	default:
 		// Invalid options for X: c, z, X, spaces, etc.
-		Errorf(l, "invalid next option for option 'X'")
+		ps.errorf("invalid next option for option 'X'")
 		return 1 // never reached
 	}
 }
 
 func stringUnpack(l *State) int {
 	fmtStr := CheckString(l, 1)
-	data := CheckString(l, 2)
-	pos := OptInteger(l, 3, 1)
-	// Handle negative indices (count from end)
-	if pos < 0 {
-		pos = len(data) + pos + 1
-	}
-	if pos < 1 || pos > len(data)+1 {
-		Errorf(l, "initial position out of string")
+	data, mapped := unpackData(l, 2)
+	pos64 := startPosition(OptInteger64(l, 3, 1), len(data))
+	ArgumentCheck(l, pos64 <= int64(len(data))+1, 3, "initial position out of string")
+	pos := int(pos64) - 1 // Convert to 0-based
+
+	out := &luaUnpackSink{l: l, clone: mapped}
+	pos = newPackState(l, fmtStr).unpack(&unpackInput{data: data}, pos, out)
+	// Push final position (1-based)
+	l.PushInteger(pos + 1)
+	return out.results + 1
+}
+
+// An unpackSink receives the values that unpack reads.
+type unpackSink interface {
+	integer(n int64)
+	number(n float64)
+	string(s string) // s may alias the input
+}
+
+// A luaUnpackSink pushes the results of string.unpack.
+type luaUnpackSink struct {
+	l       *State
+	clone   bool // whether strings must be copied, see unpackData
+	results int
+}
+
+func (s *luaUnpackSink) push() {
+	CheckStackWithMessage(s.l, 2, "too many results")
+	s.results++
+}
+
+func (s *luaUnpackSink) integer(n int64)  { s.push(); s.l.PushInteger64(n) }
+func (s *luaUnpackSink) number(n float64) { s.push(); s.l.PushNumber(n) }
+func (s *luaUnpackSink) string(str string) {
+	if s.push(); s.clone {
+		str = strings.Clone(str)
 	}
-	pos-- // Convert to 0-based
+	s.l.PushString(str)
+}
 
-	ps := newPackState(fmtStr)
-	results := 0
+// An unpackInput is the data that unpack reads: a string, or a reader that
+// more data is read from as it is needed.
+type unpackInput struct {
+	data string
+	r    io.Reader
+	buf  []byte // the data read from r; data aliases it
+	err  error  // the error that ended reading from r, other than io.EOF
+}
 
+// has reports whether the input is at least n bytes long.
+func (in *unpackInput) has(n int) bool {
+	for n > len(in.data) && in.r != nil {
+		const chunk = 64 << 10 // don't trust huge lengths before the data arrives
+		need := min(n-len(in.data), chunk)
+		in.buf = slices.Grow(in.buf, need)
+		m, err := io.ReadFull(in.r, in.buf[len(in.buf):len(in.buf)+need])
+		in.buf = in.buf[:len(in.buf)+m]
+		in.data = unsafe.String(unsafe.SliceData(in.buf), len(in.buf))
+		if err != nil {
+			if in.r = nil; err != io.EOF && err != io.ErrUnexpectedEOF {
+				in.err = err
+			}
+		}
+	}
+	return n <= len(in.data)
+}
+
+// unpack reads the values described by the format from in, starting at pos,
+// and returns the position after them.
+func (ps *packState) unpack(in *unpackInput, pos int, out unpackSink) int {
 	for !ps.eof() {
 		opt := ps.next()
 		switch opt {
@@ -1313,115 +2088,102 @@ func stringUnpack(l *State) int {
 		case '>':
 			ps.littleEnd = false
 		case '=':
-			ps.littleEnd = nativeEndian() == binary.LittleEndian
+			ps.littleEnd = ps.profile.littleEndian()
+		case '#':
+			ps.markLength()
 		case '!':
-			ps.maxAlign = ps.optSize(8)
+			ps.maxAlign = ps.optSize(ps.profile.align)
 		case 'b': // signed byte
-			if pos >= len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 1) {
+				ps.errorf("data string too short")
 			}
-			l.PushInteger(int(int8(data[pos])))
+			out.integer(ps.setInt(int64(int8(in.data[pos]))))
 			pos++
-			results++
 		case 'B': // unsigned byte
-			if pos >= len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 1) {
+				ps.errorf("data string too short")
 			}
-			l.PushInteger(int(data[pos]))
+			out.integer(ps.setInt(int64(in.data[pos])))
 			pos++
-			results++
 		case 'h': // signed short
 			align := ps.align(2)
 			pos = alignPos(pos, align)
-			if pos+2 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 2) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint16([]byte(data[pos : pos+2]))
-			l.PushInteger(int(int16(v)))
+			v := ps.byteOrder().Uint16([]byte(in.data[pos : pos+2]))
+			out.integer(ps.setInt(int64(int16(v))))
 			pos += 2
-			results++
 		case 'H': // unsigned short
 			align := ps.align(2)
 			pos = alignPos(pos, align)
-			if pos+2 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 2) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint16([]byte(data[pos : pos+2]))
-			l.PushInteger(int(v))
+			v := ps.byteOrder().Uint16([]byte(in.data[pos : pos+2]))
+			out.integer(ps.setInt(int64(v)))
 			pos += 2
-			results++
-		case 'l': // signed long (4 bytes)
-			align := ps.align(4)
-			pos = alignPos(pos, align)
-			if pos+4 > len(data) {
-				Errorf(l, "data string too short")
+		case 'l', 'L', 'T': // signed/unsigned long, size_t
+			size := ps.profile.long
+			if opt == 'T' {
+				size = ps.profile.sizeT
 			}
-			v := ps.byteOrder().Uint32([]byte(data[pos : pos+4]))
-			l.PushInteger(int(int32(v)))
-			pos += 4
-			results++
-		case 'L': // unsigned long (4 bytes)
-			align := ps.align(4)
-			pos = alignPos(pos, align)
-			if pos+4 > len(data) {
-				Errorf(l, "data string too short")
+			pos = alignPos(pos, ps.align(size))
+			if !in.has(pos + size) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint32([]byte(data[pos : pos+4]))
-			l.PushInteger64(int64(v))
-			pos += 4
-			results++
+			out.integer(ps.setInt(ps.integer(in.data[pos:], size, opt == 'l')))
+			pos += size
 		case 'j': // lua_Integer (8 bytes signed)
 			align := ps.align(8)
 			pos = alignPos(pos, align)
-			if pos+8 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 8) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint64([]byte(data[pos : pos+8]))
-			l.PushInteger64(int64(v))
+			v := ps.byteOrder().Uint64([]byte(in.data[pos : pos+8]))
+			out.integer(ps.setInt(int64(v)))
 			pos += 8
-			results++
-		case 'J', 'T': // lua_Unsigned / size_t (8 bytes)
+		case 'J': // lua_Unsigned (8 bytes)
 			align := ps.align(8)
 			pos = alignPos(pos, align)
-			if pos+8 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 8) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint64([]byte(data[pos : pos+8]))
-			l.PushInteger64(int64(v))
+			v := ps.byteOrder().Uint64([]byte(in.data[pos : pos+8]))
+			out.integer(ps.setInt(int64(v)))
 			pos += 8
-			results++
 		case 'i': // signed int with optional size
 			size := ps.optSize(4)
 			if size < 1 || size > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+				ps.errorf("integral size (%d) out of limits [1,16]", size)
 			}
 			align := ps.align(size)
 			pos = alignPos(pos, align)
-			if pos+size > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + size) {
+				ps.errorf("data string too short")
 			}
 			var v int64
 			if ps.littleEnd {
 				b := make([]byte, 8)
 				if size <= 8 {
-					copy(b, data[pos:pos+size])
+					copy(b, in.data[pos:pos+size])
 					// Sign extend
-					if data[pos+size-1]&0x80 != 0 {
+					if in.data[pos+size-1]&0x80 != 0 {
 						for i := size; i < 8; i++ {
 							b[i] = 0xff
 						}
 					}
 				} else {
 					// For sizes > 8, take lower 8 bytes
-					copy(b, data[pos:pos+8])
+					copy(b, in.data[pos:pos+8])
 					// Check upper bytes for proper sign extension
 					signByte := byte(0)
 					if b[7]&0x80 != 0 {
 						signByte = 0xff
 					}
 					for i := 8; i < size; i++ {
-						if data[pos+i] != signByte {
-							Errorf(l, "%d-byte integer does not fit into Lua Integer", size)
+						if in.data[pos+i] != signByte {
+							ps.errorf("%d-byte integer does not fit into Lua Integer", size)
 						}
 					}
 				}
@@ -1429,54 +2191,53 @@ func stringUnpack(l *State) int {
 			} else {
 				b := make([]byte, 8)
 				if size <= 8 {
-					copy(b[8-size:], data[pos:pos+size])
+					copy(b[8-size:], in.data[pos:pos+size])
 					// Sign extend
-					if data[pos]&0x80 != 0 {
+					if in.data[pos]&0x80 != 0 {
 						for i := 0; i < 8-size; i++ {
 							b[i] = 0xff
 						}
 					}
 				} else {
 					// For sizes > 8, take lower 8 bytes
-					copy(b, data[pos+size-8:pos+size])
+					copy(b, in.data[pos+size-8:pos+size])
 					// Check upper bytes for proper sign extension
 					signByte := byte(0)
 					if b[0]&0x80 != 0 {
 						signByte = 0xff
 					}
 					for i := 0; i < size-8; i++ {
-						if data[pos+i] != signByte {
-							Errorf(l, "%d-byte integer does not fit into Lua Integer", size)
+						if in.data[pos+i] != signByte {
+							ps.errorf("%d-byte integer does not fit into Lua Integer", size)
 						}
 					}
 				}
 				v = int64(binary.BigEndian.Uint64(b))
 			}
-			l.PushInteger64(v)
+			out.integer(ps.setInt(v))
 			pos += size
-			results++
 		case 'I': // unsigned int with optional size
 			size := ps.optSize(4)
 			if size < 1 || size > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+				ps.errorf("integral size (%d) out of limits [1,16]", size)
 			}
 			align := ps.align(size)
 			pos = alignPos(pos, align)
-			if pos+size > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + size) {
+				ps.errorf("data string too short")
 			}
 			var v uint64
 			if ps.littleEnd {
 				b := make([]byte, 8)
 				if size <= 8 {
-					copy(b, data[pos:pos+size])
+					copy(b, in.data[pos:pos+size])
 				} else {
 					// For sizes > 8, take lower 8 bytes
-					copy(b, data[pos:pos+8])
+					copy(b, in.data[pos:pos+8])
 					// Check upper bytes are zero
 					for i := 8; i < size; i++ {
-						if data[pos+i] != 0 {
-							Errorf(l, "%d-byte integer does not fit into Lua Integer", size)
+						if in.data[pos+i] != 0 {
+							ps.errorf("%d-byte integer does not fit into Lua Integer", size)
 						}
 					}
 				}
@@ -1484,113 +2245,109 @@ func stringUnpack(l *State) int {
 			} else {
 				b := make([]byte, 8)
 				if size <= 8 {
-					copy(b[8-size:], data[pos:pos+size])
+					copy(b[8-size:], in.data[pos:pos+size])
 				} else {
 					// For sizes > 8, take lower 8 bytes
-					copy(b, data[pos+size-8:pos+size])
+					copy(b, in.data[pos+size-8:pos+size])
 					// Check upper bytes are zero
 					for i := 0; i < size-8; i++ {
-						if data[pos+i] != 0 {
-							Errorf(l, "%d-byte integer does not fit into Lua Integer", size)
+						if in.data[pos+i] != 0 {
+							ps.errorf("%d-byte integer does not fit into Lua Integer", size)
 						}
 					}
 				}
 				v = binary.BigEndian.Uint64(b)
 			}
-			l.PushInteger64(int64(v))
+			out.integer(ps.setInt(int64(v)))
 			pos += size
-			results++
+		case 'e': // half float (2 bytes)
+			pos = alignPos(pos, ps.align(2))
+			if !in.has(pos + 2) {
+				ps.errorf("data string too short")
+			}
+			out.number(float16frombits(ps.byteOrder().Uint16([]byte(in.data[pos : pos+2]))))
+			pos += 2
 		case 'f': // float (4 bytes)
 			align := ps.align(4)
 			pos = alignPos(pos, align)
-			if pos+4 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 4) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint32([]byte(data[pos : pos+4]))
-			l.PushNumber(float64(math.Float32frombits(v)))
+			v := ps.byteOrder().Uint32([]byte(in.data[pos : pos+4]))
+			out.number(float32frombits(v))
 			pos += 4
-			results++
 		case 'd', 'n': // double / lua_Number (8 bytes)
 			align := ps.align(8)
 			pos = alignPos(pos, align)
-			if pos+8 > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 8) {
+				ps.errorf("data string too short")
 			}
-			v := ps.byteOrder().Uint64([]byte(data[pos : pos+8]))
-			l.PushNumber(math.Float64frombits(v))
+			v := ps.byteOrder().Uint64([]byte(in.data[pos : pos+8]))
+			out.number(math.Float64frombits(v))
 			pos += 8
-			results++
 		case 'c': // fixed string
-			size := ps.getNum(-1)
-			if size < 0 {
-				Errorf(l, "missing size for format option 'c'")
-			}
-			if pos+size > len(data) {
-				Errorf(l, "data string too short")
+			size := ps.stringSize()
+			if !in.has(pos + size) {
+				ps.errorf("data string too short")
 			}
-			l.PushString(data[pos : pos+size])
+			out.string(in.data[pos : pos+size])
 			pos += size
-			results++
 		case 'z': // zero-terminated string
 			end := pos
-			for end < len(data) && data[end] != 0 {
+			for in.has(end+1) && in.data[end] != 0 {
 				end++
 			}
-			if end >= len(data) {
-				Errorf(l, "unfinished string for format 'z'")
+			if !in.has(end + 1) {
+				ps.errorf("unfinished string for format 'z'")
 			}
-			l.PushString(data[pos:end])
+			out.string(in.data[pos:end])
 			pos = end + 1
-			results++
 		case 's': // string with length prefix
-			size := ps.optSize(8)
+			size := ps.optSize(ps.profile.sizeT)
 			if size < 1 || size > 16 {
-				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+				ps.errorf("integral size (%d) out of limits [1,16]", size)
 			}
 			align := ps.align(size)
 			pos = alignPos(pos, align)
-			if pos+size > len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + size) {
+				ps.errorf("data string too short")
 			}
 			// Read length (support up to 16 bytes)
 			var strLen uint64
 			if ps.littleEnd {
 				b := make([]byte, 16)
-				copy(b, data[pos:pos+size])
+				copy(b, in.data[pos:pos+size])
 				strLen = binary.LittleEndian.Uint64(b)
 			} else {
 				b := make([]byte, 16)
-				copy(b[16-size:], data[pos:pos+size])
+				copy(b[16-size:], in.data[pos:pos+size])
 				strLen = binary.BigEndian.Uint64(b[8:])
 			}
 			pos += size
-			if pos+int(strLen) > len(data) {
-				Errorf(l, "data string too short")
+			if strLen > uint64(math.MaxInt-pos) || !in.has(pos+int(strLen)) {
+				ps.errorf("data string too short")
 			}
-			l.PushString(data[pos : pos+int(strLen)])
+			out.string(in.data[pos : pos+int(strLen)])
 			pos += int(strLen)
-			results++
 		case 'x': // one byte padding
-			if pos >= len(data) {
-				Errorf(l, "data string too short")
+			if !in.has(pos + 1) {
+				ps.errorf("data string too short")
 			}
 			pos++
 		case 'X': // alignment only
 			if ps.eof() {
-				Errorf(l, "invalid next option for option 'X'")
+				ps.errorf("invalid next option for option 'X'")
 			}
 			alignOpt := ps.next()
-			alignSize := getOptionSizeForX(alignOpt, ps, l)
+			alignSize := getOptionSizeForX(alignOpt, ps)
 			align := ps.align(alignSize)
 			pos = alignPos(pos, align)
 		default:
-			Errorf(l, fmt.Sprintf("invalid format option '%c'", opt))
+			ps.errorf("invalid format option '%c'", opt)
 		}
 	}
 
-	// Push final position (1-based)
-	l.PushInteger(pos + 1)
-	return results + 1
+	return pos
 }
 
 func alignPos(pos, align int) int {
@@ -1600,9 +2357,156 @@ func alignPos(pos, align int) int {
 	return pos + (align-(pos%align))%align
 }
 
-func stringPacksize(l *State) int {
+// PackTo writes values to w in the binary format of string.pack, so Go
+// programs can produce data in the same format language as scripts. Values
+// may be Go integers, floats, strings and byte slices; they are converted
+// like the corresponding Lua values, unsigned integers like Lua's unsigned
+// integers. The layout starts from the default "lua" profile rather than
+// the one selected with string.packprofile; the format can change it with
+// the options '<', '>', '=' and '!'.
+func PackTo(w io.Writer, format string, values ...interface{}) error {
+	var buf bytes.Buffer
+	err := runPack("pack", format, func(ps *packState) { ps.pack(&buf, goPackSource(values), 2) })
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// UnpackFrom reads values in the binary format of string.unpack from r. It
+// reads no more than the format describes, so the next record can be read
+// from r afterwards; wrap unbuffered readers in a bufio.Reader when reading
+// 'z' strings, which are read a byte at a time. Integers are returned as
+// int64, floats as float64 and strings as string. The layout starts from the
+// default "lua" profile, as for PackTo. If r ends too early, the error says
+// that the data is too short; other read errors are returned as they are.
+func UnpackFrom(r io.Reader, format string) ([]interface{}, error) {
+	in := &unpackInput{r: r}
+	var out goUnpackSink
+	err := runPack("unpack", format, func(ps *packState) { ps.unpack(in, 0, &out) })
+	if in.err != nil {
+		return out, in.err
+	}
+	return out, err
+}
+
+// A packError is an error raised by pack or unpack run from Go.
+type packError string
+
+func (e packError) Error() string { return string(e) }
+
+// runPack runs f with a pack state for format whose errors are returned.
+func runPack(what, format string, f func(ps *packState)) (err error) {
+	ps := newPackStateWithProfile(format, packProfiles[0], func(arg int, message string) {
+		if arg > 1 { // argument 1 is the format
+			message = fmt.Sprintf("value #%d: %s", arg-1, message)
+		}
+		panic(packError(what + ": " + message))
+	})
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(packError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	f(ps)
+	return nil
+}
+
+// A goPackSource supplies the values of PackTo. Like the arguments of
+// string.pack, they are numbered from 2.
+type goPackSource []interface{}
+
+func (s goPackSource) value(ps *packState, arg int) value {
+	if arg-2 >= len(s) {
+		ps.fail(arg, "no value")
+	}
+	switch v := s[arg-2].(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case uint:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		ps.fail(arg, fmt.Sprintf("unsupported type %T", v))
+		return nil
+	}
+}
+
+func (s goPackSource) toInteger(ps *packState, arg int) (int64, bool) {
+	return toInteger(s.value(ps, arg))
+}
+
+func (s goPackSource) checkInteger(ps *packState, arg int) int64 {
+	n, ok := s.toInteger(ps, arg)
+	if _, isFloat := s.value(ps, arg).(float64); !ok && isFloat {
+		ps.fail(arg, "number has no integer representation")
+	} else if !ok {
+		ps.fail(arg, "number expected")
+	}
+	return n
+}
+
+func (s goPackSource) checkNumber(ps *packState, arg int) float64 {
+	switch v := s.value(ps, arg).(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	ps.fail(arg, "number expected")
+	return 0
+}
+
+func (s goPackSource) checkString(ps *packState, arg int) string {
+	v, ok := s.value(ps, arg).(string)
+	if !ok {
+		ps.fail(arg, "string expected")
+	}
+	return v
+}
+
+// A goUnpackSink collects the results of UnpackFrom.
+type goUnpackSink []interface{}
+
+func (s *goUnpackSink) integer(n int64)   { *s = append(*s, n) }
+func (s *goUnpackSink) number(n float64)  { *s = append(*s, n) }
+func (s *goUnpackSink) string(str string) { *s = append(*s, strings.Clone(str)) }
+
+// packedSize returns the length of the string that string.pack would build
+// for the format at index 1. If arg is zero the format must not contain
+// variable-length options; otherwise the values starting at arg provide the
+// strings for 's' and 'z'.
+func packedSize(l *State, arg int) int {
 	fmtStr := CheckString(l, 1)
-	ps := newPackState(fmtStr)
+	ps := newPackState(l, fmtStr)
 	totalSize := 0
 
 	// Maximum size for pack format result (matches Lua's MAXSIZE = INT_MAX)
@@ -1617,26 +2521,55 @@ func stringPacksize(l *State) int {
 		totalSize += size
 	}
 
+	// value returns the argument index for the next data option
+	var opt byte
+	value := func() int {
+		if arg == 0 {
+			return 0
+		}
+		if strings.IndexByte("bBhHlLTjJiI", opt) >= 0 {
+			if n, ok := l.ToInteger64(arg); ok {
+				ps.setInt(n)
+			}
+		}
+		arg++
+		return arg - 1
+	}
+
 	for !ps.eof() {
-		opt := ps.next()
+		opt = ps.next()
 		switch opt {
 		case ' ':
 			continue
 		case '<', '>', '=':
 			// Endianness doesn't affect size
+		case '#':
+			ps.markLength()
 		case '!':
-			ps.maxAlign = ps.optSize(8)
+			ps.maxAlign = ps.optSize(ps.profile.align)
 		case 'b', 'B':
+			value()
 			addSize(1)
-		case 'h', 'H':
+		case 'h', 'H', 'e':
+			value()
 			align := ps.align(2)
 			totalSize = alignPos(totalSize, align)
 			addSize(2)
-		case 'l', 'L', 'f':
+		case 'f':
+			value()
 			align := ps.align(4)
 			totalSize = alignPos(totalSize, align)
 			addSize(4)
-		case 'j', 'J', 'T', 'd', 'n':
+		case 'l', 'L', 'T':
+			value()
+			size := ps.profile.long
+			if opt == 'T' {
+				size = ps.profile.sizeT
+			}
+			totalSize = alignPos(totalSize, ps.align(size))
+			addSize(size)
+		case 'j', 'J', 'd', 'n':
+			value()
 			align := ps.align(8)
 			totalSize = alignPos(totalSize, align)
 			addSize(8)
@@ -1645,14 +2578,16 @@ func stringPacksize(l *State) int {
 			if size < 1 || size > 16 {
 				Errorf(l, "integral size (%d) out of limits [1,16]", size)
 			}
+			value()
 			align := ps.align(size)
 			totalSize = alignPos(totalSize, align)
 			addSize(size)
 		case 'c':
-			size := ps.getNum(-1)
-			if size < 0 {
-				Errorf(l, "missing size for format option 'c'")
+			if arg == 0 && !ps.eof() && ps.peek() == '#' {
+				Errorf(l, "variable-length format")
 			}
+			size := ps.stringSize()
+			value()
 			addSize(size)
 		case 'x':
 			addSize(1)
@@ -1661,17 +2596,63 @@ func stringPacksize(l *State) int {
 				Errorf(l, "invalid next option for option 'X'")
 			}
 			alignOpt := ps.next()
-			alignSize := getOptionSizeForX(alignOpt, ps, l)
+			alignSize := getOptionSizeForX(alignOpt, ps)
 			align := ps.align(alignSize)
 			totalSize = alignPos(totalSize, align)
-		case 'z', 's':
-			Errorf(l, "variable-length format")
+		case 'z':
+			if arg == 0 {
+				Errorf(l, "variable-length format")
+			}
+			addSize(len(CheckString(l, value())) + 1)
+		case 's':
+			if arg == 0 {
+				Errorf(l, "variable-length format")
+			}
+			size := ps.optSize(ps.profile.sizeT)
+			if size < 1 || size > 16 {
+				Errorf(l, "integral size (%d) out of limits [1,16]", size)
+			}
+			totalSize = alignPos(totalSize, ps.align(size))
+			addSize(size)
+			addSize(len(CheckString(l, value())))
 		default:
 			Errorf(l, fmt.Sprintf("invalid format option '%c'", opt))
 		}
 	}
 
-	l.PushInteger(totalSize)
+	return totalSize
+}
+
+func stringPacksize(l *State) int {
+	l.PushInteger(packedSize(l, 0))
+	return 1
+}
+
+// string.packlen(fmt, v1, v2, ...) returns the length of
+// string.pack(fmt, v1, v2, ...) without building the string. Only the
+// strings for the variable-length options 's' and 'z' are examined.
+func stringPacklen(l *State) int {
+	l.PushInteger(packedSize(l, 2))
+	return 1
+}
+
+// string.packprofile([name]) selects the profile that pack, unpack,
+// packsize and packlen start from and returns the name of the previous one.
+// Without a name it only returns the current profile.
+func stringPackprofile(l *State) int {
+	prev := l.global.packLayout()
+	if !l.IsNoneOrNil(1) {
+		name := CheckString(l, 1)
+		for _, pp := range packProfiles {
+			if pp.name == name {
+				l.global.packProfile = pp
+				l.PushString(prev.name)
+				return 1
+			}
+		}
+		ArgumentError(l, 1, l.PushFString("unknown profile '%s'", name))
+	}
+	l.PushString(prev.name)
 	return 1
 }
 
@@ -1683,7 +2664,7 @@ func stringMatch(l *State) int {
 // gmatchAux is the iterator function for gmatch
 func gmatchAux(l *State) int {
 	s, _ := l.ToString(UpValueIndex(1))
-	p, _ := l.ToString(UpValueIndex(2))
+	cp := l.ToUserData(UpValueIndex(2)).(*compiledPattern)
 	pos, _ := l.ToInteger(UpValueIndex(3))
 	lastMatch, _ := l.ToInteger(UpValueIndex(4)) // Track last successful match end (Lua 5.3.3)
 
@@ -1692,19 +2673,7 @@ func gmatchAux(l *State) int {
 		return 1
 	}
 
-	anchor := len(p) > 0 && p[0] == '^'
-	patStart := 0
-	if anchor {
-		patStart = 1
-	}
-
-	ms := &matchState{
-		l:       l,
-		src:     s,
-		srcEnd:  len(s),
-		pattern: p[patStart:],
-	}
-
+	ms := cp.matchState(l, s)
 	spos := pos // 0-based
 	for spos <= len(s) {
 		ms.captures = ms.captures[:0]
@@ -1722,8 +2691,8 @@ func gmatchAux(l *State) int {
 			return ms.pushCaptures(spos, end)
 		}
 
-		spos++
-		if anchor {
+		spos = ms.nextStart(spos)
+		if cp.anchor {
 			break
 		}
 	}
@@ -1735,12 +2704,18 @@ func gmatchAux(l *State) int {
 // string.gmatch(s, pattern, init)
 func stringGmatch(l *State) int {
 	s := CheckString(l, 1)
-	CheckString(l, 2)
-	init := relativePosition(OptInteger(l, 3, 1), len(s))
-	if init < 1 {
-		init = 1
+	return gmatch(l, s, checkPattern(l, 2))
+}
+
+// gmatch returns the gmatch iterator for the subject s. The optional init
+// argument is at index 3.
+func gmatch(l *State, s string, cp *compiledPattern) int {
+	init := len(s) + 2 // beyond the end: no matches, not even an empty one
+	if i := startPosition(OptInteger64(l, 3, 1), len(s)); i <= int64(len(s))+1 {
+		init = int(i)
 	}
-	l.SetTop(2)
+	l.PushString(s)
+	l.PushUserData(cp)
 	l.PushInteger(init - 1) // Convert 1-based init to 0-based position
 	l.PushInteger(-1)       // lastMatch - initialized to -1 (Lua 5.3.3)
 	l.PushGoClosure(gmatchAux, 4)
@@ -1751,7 +2726,7 @@ func stringGmatch(l *State) int {
 // addReplace adds the replacement value to the buffer.
 // Returns true if the original string was changed. (Function calls and
 // table indexing resulting in nil or false do not change the subject.)
-func addReplace(l *State, ms *matchState, b *bytes.Buffer, sstart, send int) bool {
+func addReplace(l *State, ms *matchState, b gsubWriter, sstart, send int) bool {
 	switch l.TypeOf(3) {
 	case TypeString, TypeNumber:
 		repl, _ := l.ToString(3)
@@ -1789,6 +2764,9 @@ func addReplace(l *State, ms *matchState, b *bytes.Buffer, sstart, send int) boo
 			// not nil and not false
 			if s, ok := l.ToString(-1); ok {
 				b.WriteString(s)
+				if l.global.tags != nil {
+					ms.replacements = append(ms.replacements, s)
+				}
 			} else {
 				Errorf(l, "invalid replacement value (a %s)", l.TypeOf(-1).String())
 			}
@@ -1806,6 +2784,9 @@ func addReplace(l *State, ms *matchState, b *bytes.Buffer, sstart, send int) boo
 			// not nil and not false
 			if s, ok := l.ToString(-1); ok {
 				b.WriteString(s)
+				if l.global.tags != nil {
+					ms.replacements = append(ms.replacements, s)
+				}
 			} else {
 				Errorf(l, "invalid replacement value (a %s)", l.TypeOf(-1).String())
 			}
@@ -1825,30 +2806,50 @@ func addReplace(l *State, ms *matchState, b *bytes.Buffer, sstart, send int) boo
 // string.gsub(s, pattern, repl [, n])
 func stringGsub(l *State) int {
 	s := CheckString(l, 1)
-	p := CheckString(l, 2)
-	// repl is at position 3, type checked in addReplace
-	maxRepl := OptInteger(l, 4, len(s)+1)
+	return gsub(l, s, 1, checkPattern(l, 2))
+}
 
-	anchor := len(p) > 0 && p[0] == '^'
-	patStart := 0
-	if anchor {
-		patStart = 1
+// gsub implements gsub for the subject s at index subject, which is 1 for
+// string.gsub and 2 for the method of compiled patterns. The repl and
+// optional n arguments are at indices 3 and 4 in both.
+func gsub(l *State, s string, subject int, cp *compiledPattern) int {
+	var b bytes.Buffer
+	maxRepl := OptInteger64(l, 4, int64(len(s))+1)
+	if maxRepl > int64(len(s))+1 { // there can't be more matches
+		maxRepl = int64(len(s)) + 1
 	}
-
-	ms := &matchState{
-		l:       l,
-		src:     s,
-		srcEnd:  len(s),
-		pattern: p[patStart:],
+	var n int
+	changed, replacements := replaceMatches(l, s, cp, &b, int(maxRepl), &n)
+	if !changed {
+		l.PushString(s) // no changes: return original string
+	} else {
+		l.PushString(b.String())
+		l.deriveTagsFrom(subject, 3)
+		l.deriveTags(b.String(), replacements...)
 	}
+	l.PushInteger(n)
+	return 2
+}
 
-	var b bytes.Buffer
-	n := 0
-	changed := false
+// A gsubWriter receives the result of a substitution.
+type gsubWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// replaceMatches writes s to b with at most maxRepl matches of cp replaced
+// by the replacement at index 3. It counts the matches in *n as they are
+// made. It returns whether any of them was replaced by something else and,
+// if strings are tagged, the strings that a function or table replaced them
+// with.
+func replaceMatches(l *State, s string, cp *compiledPattern, b gsubWriter, maxRepl int, n *int) (changed bool, replacements []string) {
+	anchor := cp.anchor
+	ms := cp.matchState(l, s)
 	spos := 0
 	lastMatch := -1 // Track where last successful substitution ended (Lua 5.3.3)
 
-	for n < maxRepl {
+	for *n < maxRepl {
 		ms.captures = ms.captures[:0]
 		ms.numCaptures = 0
 		ms.matchDepth = 0
@@ -1857,16 +2858,17 @@ func stringGsub(l *State) int {
 		// Lua 5.3.3: reject match if it ends at same position as last match
 		// This prevents double-substitution at the same position
 		if ok && end != lastMatch {
-			n++
-			if addReplace(l, ms, &b, spos, end) {
+			*n++
+			if addReplace(l, ms, b, spos, end) {
 				changed = true
 			}
 			spos = end
 			lastMatch = end
 		} else if spos < len(s) {
 			// No match (or same-position match): copy one char and advance
-			b.WriteByte(s[spos])
-			spos++
+			next := ms.nextStart(spos)
+			b.WriteString(s[spos:next])
+			spos = next
 		} else {
 			break // End of subject
 		}
@@ -1876,37 +2878,78 @@ func stringGsub(l *State) int {
 		}
 	}
 
-	if !changed {
-		l.PushString(s) // no changes: return original string
-	} else {
-		// Add remainder and push new string
-		if spos <= len(s) {
-			b.WriteString(s[spos:])
+	// Add remainder
+	if spos <= len(s) {
+		b.WriteString(s[spos:])
+	}
+	return changed, ms.replacements
+}
+
+// GsubTo is string.gsub for subjects whose result should not be held in
+// memory: s is written to w as it is scanned, with at most n matches of
+// pattern replaced (all of them if n < 0). The replacement is the value on
+// top of the stack, a string, table or function as for string.gsub, and is
+// popped. GsubTo returns the number of matches. Errors in the pattern or
+// the replacement, and the first error returned by w, end the substitution
+// and are returned; the output written so far stays in w.
+func GsubTo(l *State, w io.Writer, s, pattern string, n int) (int, error) {
+	repl := l.indexToValue(-1)
+	l.Pop(1)
+	if n < 0 {
+		n = len(s) + 1
+	}
+	sink := &gsubSink{l: l, w: w}
+	b := bufio.NewWriter(sink)
+	count := 0
+	l.PushGoFunction(func(l *State) int {
+		l.PushString(s)
+		l.PushString(pattern)
+		l.apiPush(repl)
+		replaceMatches(l, s, checkPattern(l, 2), b, n, &count)
+		b.Flush()
+		return 0
+	})
+	if err := l.ProtectedCall(0, 0, 0); err != nil {
+		l.Pop(1)
+		if sink.err != nil {
+			return count, sink.err
 		}
-		l.PushString(b.String())
+		sink.l = nil // outside of the call, errors of w are only recorded
+		b.Flush()
+		return count, err
 	}
-	l.PushInteger(n)
-	return 2
+	return count, nil
+}
+
+// A gsubSink raises the first error of the writer of GsubTo as a Lua error,
+// so the substitution stops. Without a state, it just records the error.
+type gsubSink struct {
+	l   *State
+	w   io.Writer
+	err error
+}
+
+func (s *gsubSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		s.err = err
+		if s.l != nil {
+			Errorf(s.l, "%s", err.Error())
+		}
+	}
+	return n, err
 }
 
 var stringLibrary = []RegistryFunction{
 	{"byte", func(l *State) int {
 		s := CheckString(l, 1)
-		start := relativePosition(OptInteger(l, 2, 1), len(s))
-		end := relativePosition(OptInteger(l, 3, start), len(s))
-		if start < 1 {
-			start = 1
-		}
-		if end > len(s) {
-			end = len(s)
-		}
-		if start > end {
+		i := OptInteger64(l, 2, 1)
+		start64, end := startPosition(i, len(s)), endPosition(OptInteger64(l, 3, i), len(s))
+		if start64 > int64(end) {
 			return 0
 		}
+		start := int(start64)
 		n := end - start + 1
-		if start+n <= end {
-			Errorf(l, "string slice too long")
-		}
 		CheckStackWithMessage(l, n, "string slice too long")
 		for _, c := range []byte(s[start-1 : end]) {
 			l.PushInteger(int(c))
@@ -1936,13 +2979,23 @@ var stringLibrary = []RegistryFunction{
 	}},
 	{"find", func(l *State) int { return findHelper(l, true) }},
 	{"format", func(l *State) int {
-		l.PushString(formatHelper(l, CheckString(l, 1), l.Top()))
+		n := l.Top()
+		l.PushString(formatHelper(l, CheckString(l, 1), n))
+		if l.global.tags != nil {
+			for i := 1; i <= n; i++ {
+				l.deriveTagsFrom(i)
+			}
+		}
 		return 1
 	}},
 	{"gmatch", stringGmatch},
 	{"gsub", stringGsub},
 	{"len", func(l *State) int { l.PushInteger(len(CheckString(l, 1))); return 1 }},
-	{"lower", func(l *State) int { l.PushString(strings.ToLower(CheckString(l, 1))); return 1 }},
+	{"lower", func(l *State) int {
+		l.PushString(strings.ToLower(CheckString(l, 1)))
+		l.deriveTagsFrom(1)
+		return 1
+	}},
 	{"match", stringMatch},
 	{"rep", func(l *State) int {
 		s, n, sep := CheckString(l, 1), CheckInteger(l, 2), OptString(l, 3, "")
@@ -1962,9 +3015,13 @@ var stringLibrary = []RegistryFunction{
 			}
 			l.PushString(b.String())
 		}
+		l.deriveTagsFrom(1, 3)
 		return 1
 	}},
 	{"pack", stringPack},
+	{"packlen", stringPacklen},
+	{"packprofile", stringPackprofile},
+	{"pattern", stringPattern},
 	{"packsize", stringPacksize},
 	{"reverse", func(l *State) int {
 		s := CheckString(l, 1)
@@ -1973,30 +3030,62 @@ var stringLibrary = []RegistryFunction{
 			b[i], b[j] = b[j], b[i]
 		}
 		l.PushString(string(b))
+		l.deriveTagsFrom(1)
 		return 1
 	}},
 	{"sub", func(l *State) int {
 		s := CheckString(l, 1)
-		start, end := relativePosition(CheckInteger(l, 2), len(s)), relativePosition(OptInteger(l, 3, -1), len(s))
-		if start < 1 {
-			start = 1
-		}
-		if end > len(s) {
-			end = len(s)
-		}
-		if start <= end {
+		start, end := startPosition(CheckInteger64(l, 2), len(s)), endPosition(OptInteger64(l, 3, -1), len(s))
+		if start <= int64(end) {
 			l.PushString(s[start-1 : end])
+			l.deriveTagsFrom(1)
 		} else {
 			l.PushString("")
 		}
 		return 1
 	}},
 	{"unpack", stringUnpack},
-	{"upper", func(l *State) int { l.PushString(strings.ToUpper(CheckString(l, 1))); return 1 }},
+	{"upper", func(l *State) int {
+		l.PushString(strings.ToUpper(CheckString(l, 1)))
+		l.deriveTagsFrom(1)
+		return 1
+	}},
+}
+
+const patternHandle = "PATTERN*"
+
+// string.pattern(p) compiles p into a pattern object that can be passed to
+// find, match, gmatch and gsub instead of a string, or used through its
+// methods. Unlike a string pattern, it is checked for errors up front.
+func stringPattern(l *State) int {
+	cp := compilePattern(CheckString(l, 1))
+	if msg := cp.validate(); msg != "" {
+		Errorf(l, "%s", msg)
+	}
+	l.PushUserData(cp)
+	SetMetaTableNamed(l, patternHandle)
+	return 1
+}
+
+func toPattern(l *State) *compiledPattern {
+	return CheckUserData(l, 1, patternHandle).(*compiledPattern)
+}
+
+var patternMethods = []RegistryFunction{
+	{"find", func(l *State) int { cp := toPattern(l); return find(l, CheckString(l, 2), cp, true) }},
+	{"gmatch", func(l *State) int { cp := toPattern(l); return gmatch(l, CheckString(l, 2), cp) }},
+	{"gsub", func(l *State) int { cp := toPattern(l); return gsub(l, CheckString(l, 2), 2, cp) }},
+	{"match", func(l *State) int { cp := toPattern(l); return find(l, CheckString(l, 2), cp, false) }},
+	{"__tostring", func(l *State) int { l.PushString(toPattern(l).source); return 1 }},
 }
 
 // StringOpen opens the string library. Usually passed to Require.
 func StringOpen(l *State) int {
+	NewMetaTable(l, patternHandle)
+	l.PushValue(-1)
+	l.SetField(-2, "__index")
+	SetFunctions(l, patternMethods, 0)
+	l.Pop(1)
 	NewLibrary(l, stringLibrary)
 	l.CreateTable(0, 1)
 	l.PushString("")
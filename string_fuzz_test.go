@@ -0,0 +1,205 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// patternDriver computes a canonical description of what find, match and
+// gsub do with a subject and a pattern. It runs unchanged in this package
+// and in a reference Lua 5.4, which serves requests read from stdin when
+// the chunk is called with the argument "serve".
+const patternDriver = `
+local function result(ok, ...)
+	if not ok then return "error: " .. tostring((...)) end
+	local t = table.pack(...)
+	for i = 1, t.n do t[i] = type(t[i]) .. ":" .. tostring(t[i]) end
+	return table.concat(t, " ", 1, t.n)
+end
+
+local function canon(s, p, init)
+	return result(pcall(string.find, s, p, init)),
+		result(pcall(string.match, s, p, init)),
+		result(pcall(string.gsub, s, p, "[%0]", 3))
+end
+
+if ... ~= "serve" then return canon end
+io.write(_VERSION, "\n")
+io.flush()
+for header in io.lines() do
+	local ls, lp, init = header:match("^(%d+) (%d+) (%-?%d+)$")
+	-- io.read(0) would wait for more input to check for end of file
+	local s = ls ~= "0" and io.read(tonumber(ls)) or ""
+	local p = lp ~= "0" and io.read(tonumber(lp)) or ""
+	for _, r in ipairs({canon(s, p, tonumber(init))}) do
+		io.write(#r, "\n", r)
+	end
+	io.flush()
+end
+`
+
+// A patternReference is a reference Lua 5.4 interpreter running the
+// pattern driver.
+type patternReference struct {
+	mu  sync.Mutex
+	in  io.Writer
+	out *bufio.Reader
+}
+
+var (
+	referenceOnce sync.Once
+	reference     *patternReference
+)
+
+// patternReferenceFor starts the interpreter named by $LUA_REFERENCE, or
+// lua5.4 or lua from the path, once. It returns nil if there is no Lua 5.4.
+func patternReferenceFor(t testing.TB) *patternReference {
+	referenceOnce.Do(func() {
+		var path string
+		for _, name := range []string{os.Getenv("LUA_REFERENCE"), "lua5.4", "lua"} {
+			if p, err := exec.LookPath(name); name != "" && err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return
+		}
+		script := filepath.Join(t.TempDir(), "pattern-driver.lua")
+		if err := os.WriteFile(script, []byte(patternDriver), 0o644); err != nil {
+			return
+		}
+		cmd := exec.Command(path, script, "serve")
+		in, _ := cmd.StdinPipe()
+		out, _ := cmd.StdoutPipe()
+		if cmd.Start() != nil {
+			return
+		}
+		r := &patternReference{in: in, out: bufio.NewReader(out)}
+		if version, _ := r.out.ReadString('\n'); version != "Lua 5.4\n" {
+			cmd.Process.Kill()
+			return
+		}
+		reference = r
+	})
+	if reference == nil {
+		t.Log("no reference Lua 5.4 found; set LUA_REFERENCE to compare against one")
+	}
+	return reference
+}
+
+func (r *patternReference) canon(s, p string, init int) ([3]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var results [3]string
+	if _, err := fmt.Fprintf(r.in, "%d %d %d\n%s%s", len(s), len(p), init, s, p); err != nil {
+		return results, err
+	}
+	for i := range results {
+		header, err := r.out.ReadString('\n')
+		if err != nil {
+			return results, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(header))
+		if err != nil {
+			return results, err
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(r.out, b); err != nil {
+			return results, err
+		}
+		results[i] = string(b)
+	}
+	return results, nil
+}
+
+// FuzzPatternDifferential runs subject/pattern pairs through find, match and
+// gsub. Without a reference interpreter it checks that the matcher neither
+// crashes nor disagrees with itself; with one it also compares the results
+// and error messages.
+func FuzzPatternDifferential(f *testing.F) {
+	seeds := []struct {
+		s, p string
+		init int
+	}{
+		{"hello world", "(%w+) (%w+)", 1},
+		{"THE (quick) fox", "%f[%a]%a+", 1},
+		{"THE (quick) fox", "%f[%A]", 1},
+		{"[[nested] (parens)]", "%b[]", 1},
+		{"f(a(b)c)d", "%b()", 3},
+		{"aaab", "a-b", 1},
+		{"aaab", "^a*", 2},
+		{"key = value", "(%w+)%s*=%s*(%w+)$", -9},
+		{"abcabc", "(a)(b)(c)%1%2%3", 1},
+		{"x", "()x()", 1},
+		{"", "", 1},
+		{"abc", "", 10},
+		{"a.b", "[%.%-]", 1},
+		{"a]b", "[]]", 1},
+		{"a^b", "[^^]+", 1},
+		{"\x00\xff", "[\x00-\x7f]", 1},
+		{"abc", "[a-", 1},
+		{"abc", "%", 1},
+		{"abc", "(()", 1},
+		{"abc", "%1", 1},
+		{"abc", "%b", 1},
+		{"abc", "%f", 1},
+		{"abc", "a)", 1},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "a*a*a*a*a*a*b", 1},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.s, seed.p, seed.init)
+	}
+	var l *State // with the driver's canon function on top of the stack
+	f.Fuzz(func(t *testing.T, s, p string, init int) {
+		if len(s) > 64 || len(p) > 32 {
+			t.Skip("input too large")
+		}
+		if l == nil {
+			l = NewState()
+			OpenLibraries(l)
+			SetPatternStepLimit(l, 100000)
+			if err := DoString(l, patternDriver); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l.PushValue(-1)
+		l.PushString(s)
+		l.PushString(p)
+		l.PushInteger(init)
+		l.Call(3, 3)
+		var got [3]string
+		for i := range got {
+			got[i], _ = l.ToString(i - 3)
+			if strings.Contains(got[i], "pattern too complex") {
+				l.Pop(3)
+				return // the step limit ends matches the reference may run for ages
+			}
+		}
+		l.Pop(3)
+		// find does a plain search if the pattern has no special characters
+		find, match := got[0], got[1]
+		if strings.ContainsAny(p, "^$*+?.([%-") && strings.HasPrefix(find, "error: ") != strings.HasPrefix(match, "error: ") {
+			t.Errorf("find(%q, %q, %d) = %s, but match = %s", s, p, init, find, match)
+		}
+		if r := patternReferenceFor(t); r != nil {
+			want, err := r.canon(s, p, init)
+			if err != nil {
+				t.Fatalf("reference: %v", err)
+			}
+			for i, name := range []string{"find", "match", "gsub"} {
+				if got[i] != want[i] {
+					t.Errorf("%s(%q, %q, %d) = %s, want %s", name, s, p, init, got[i], want[i])
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,508 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStringPacklen(t *testing.T) {
+	testString(t, `
+		local cases = {
+			{"i4", 1},
+			{"z", "hello"},
+			{"s", "hello"},
+			{"s1", ""},
+			{"!4 b s4", 1, "abc"},
+			{"<i2 z c3 s2 !8 d", 7, "name", "abc", "payload", 1.5},
+			{"!4 b x Xi4 s", 1, "x"},
+		}
+		for _, c in ipairs(cases) do
+			local fmt = c[1]
+			local packed = string.pack(fmt, table.unpack(c, 2))
+			assert(string.packlen(fmt, table.unpack(c, 2)) == #packed, fmt)
+		end
+		assert(string.packlen("i4 d") == string.packsize("i4 d"))
+		assert(not pcall(string.packsize, "z"))
+		assert(not pcall(string.packlen, "z"))
+		assert(not pcall(string.packlen, "s", {}))
+	`)
+}
+
+func TestStringPattern(t *testing.T) {
+	testString(t, `
+		local p = string.pattern("(%w+)=(%w+)")
+		assert(tostring(p) == "(%w+)=(%w+)")
+		assert(select("#", p:find("a=1, b=2")) == 4)
+		local k, v = p:match("x b=2", 3)
+		assert(k == "b" and v == "2")
+		local t = {}
+		for k, v in p:gmatch("a=1, b=2") do t[#t+1] = k .. v end
+		assert(table.concat(t, ",") == "a1,b2")
+		assert(p:gsub("a=1, b=2", "%2=%1") == "1=a, 2=b")
+		assert(string.gsub("a=1", p, "%2") == "1")
+		assert(select(2, ("x=y"):find(p)) == 3)
+
+		local anchored = string.pattern("^[%a_][%w_]*")
+		assert(anchored:match("name1 rest") == "name1")
+		assert(anchored:match(" name") == nil)
+		assert(string.pattern("a.b"):find("a.b", 1, true) == 1)
+
+		for _, bad in ipairs({"[a", "%", "(a", "a)", "%b", "%fa", string.rep("()", 33)}) do
+			assert(not pcall(string.pattern, bad), bad)
+		end
+		-- string patterns still only fail when the bad part is reached
+		assert(string.find("abc", "x[") == nil)
+		assert(not pcall(string.find, "x", "x["))
+
+		-- exercise the cache past its capacity
+		for i = 1, 200 do
+			assert(string.match("key" .. i, "^key(%d+)$") == tostring(i))
+			assert(string.match("v" .. i, "^v" .. i .. "[%d]*$"))
+		end
+	`)
+}
+
+func TestStringPackprofile(t *testing.T) {
+	testString(t, `
+		-- struct { char c; long l; double d; size_t n; }
+		local layout = "b l d T"
+		assert(string.packprofile() == "lua")
+		assert(string.packsize(layout) == 1 + 4 + 8 + 8)
+		assert(string.packprofile("c-amd64") == "lua")
+		assert(string.packsize(layout) == 32)
+		assert(string.packlen("s", "") == 8)
+		assert(string.packprofile("c-i386") == "c-amd64")
+		assert(string.packsize(layout) == 20)
+		assert(#string.pack("s", "abc") == 4 + 3)
+		assert(not pcall(string.pack, "T", 1 << 32))
+		string.packprofile("c-win64")
+		assert(string.packsize(layout) == 24)
+
+		string.packprofile("c-ppc64")
+		local data = string.pack(layout, 7, -2, 1.5, 300)
+		assert(#data == 32 and data:sub(1, 1) == "\7" and data:sub(32, 32) == "\44")
+		local c, l, d, n, next = string.unpack(layout, data)
+		assert(c == 7 and l == -2 and d == 1.5 and n == 300 and next == 33)
+		assert(string.unpack("<l", string.pack("<l", -2)) == -2)
+		assert(string.packsize("!4 l") == 8)
+
+		assert(not pcall(string.packprofile, "c-pdp11"))
+		assert(string.packprofile("lua") == "c-ppc64")
+		assert(string.packsize(layout) == 21)
+	`)
+}
+
+func TestPatternStepLimit(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if prev := SetPatternStepLimit(l, 100000); prev != 0 {
+		t.Fatalf("default limit is %d, want 0", prev)
+	}
+	if err := DoString(l, `
+		assert(string.match(("a"):rep(1000) .. "b", "a*b") == ("a"):rep(1000) .. "b")
+		local s, p = ("a"):rep(10000), ("a*"):rep(50) .. "b"
+		for _, f in ipairs({string.find, string.match, string.gmatch(s, p)}) do
+			local ok, err = pcall(f, s, p)
+			assert(not ok and err:find("pattern too complex"), err)
+		end
+		local ok, err = pcall(string.gsub, s, p, "")
+		assert(not ok and err:find("pattern too complex"), err)
+		assert(select(2, string.gsub(("x"):rep(50000), "x", "y")) == 50000)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnicodePatterns(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		text = "Größe: 12 €, naïve Ελληνικά  日本語"
+		assert(text:match("%a+") == "Gr")
+		assert(text:find("%s") == text:find(" ", 1, true))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if prev := SetUnicodePatterns(l, true); prev {
+		t.Fatal("Unicode patterns enabled by default")
+	}
+	if err := DoString(l, `
+		local function at(s) return (text:find(s, 1, true)) end
+		local words = {}
+		for w in text:gmatch("%a+") do words[#words + 1] = w end
+		assert(table.concat(words, "|") == "Größe|naïve|Ελληνικά|日本語")
+		assert(select(2, text:gsub("%w+", "")) == 5)
+		assert(text:match("%p+", at("€")) == "€,")
+		assert(text:match("%u%l+", at("Ε")) == "Ελληνικά")
+		assert(text:match("%A+", at(":")) == ": 12 €, ")
+		assert(text:match("[^%s,]+", at("€")) == "€")
+		assert(text:match("[α-ω]+") == "λληνικ")
+		assert(text:match("[%€]") == "€")
+		assert(text:match("%f[%a]%a+", at(",")) == "naïve")
+		assert(text:match("%s+%S", at("ά")) == "  日")
+		assert(("\u{2003}x"):match("^%s?x$"))
+		assert(("a\xffb"):match("^%a%A%a$"))
+		assert(("é"):match(".") == "\xC3")
+		assert(("é"):match("%a?$") == "é")
+		assert(("αβα"):gsub("[^α]", "") == "αα")
+		assert(("αβ"):find("[^α]") == 3)
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringFormatMatchesFmt(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	format := func(f string, v interface{}) string {
+		l.Global("string")
+		l.Field(-1, "format")
+		l.PushString(f)
+		switch v := v.(type) {
+		case int64:
+			l.PushInteger64(v)
+		case float64:
+			l.PushNumber(v)
+		}
+		l.Call(2, 1)
+		s, _ := l.ToString(-1)
+		l.Pop(2)
+		return s
+	}
+	ints := []int64{0, 1, -1, 42, -42, 255, 123456789, math.MaxInt64, math.MinInt64}
+	for _, f := range []string{"%d", "%5d", "%-5d", "%05d", "%+d", "% d", "%.3d", "%x", "%X", "%8x", "%-8X", "%08x", "%#x", "%o", "%#o", "%c"} {
+		for _, v := range ints {
+			want := fmt.Sprintf(f, v)
+			switch f[len(f)-1] {
+			case 'x', 'X', 'o':
+				want = fmt.Sprintf(f, uint64(v))
+			case 'c':
+				v &= 0x7f
+				want = string([]byte{byte(v)})
+			}
+			if got := format(f, v); got != want {
+				t.Errorf("string.format(%q, %d) = %q, want %q", f, v, got, want)
+			}
+		}
+	}
+	floats := []float64{0, math.Copysign(0, -1), 1, -1.5, 0.1, 3.14159265358979, 1e-7, 123456789.125, 1e21, -2.5e-300, math.MaxFloat64, math.Inf(1), math.Inf(-1), math.NaN()}
+	for _, f := range []string{"%f", "%.2f", "%10.3f", "%-10.1f", "%010.2f", "%+f", "%e", "%.3E", "%12e", "%g", "%G", "%.14g", "%-12g", "%08g", "%#g"} {
+		for _, v := range floats {
+			if want, got := fmt.Sprintf(f, v), format(f, v); got != want {
+				t.Errorf("string.format(%q, %v) = %q, want %q", f, v, got, want)
+			}
+		}
+	}
+	testString(t, `
+		assert(not pcall(string.format, "%"))
+		assert(not pcall(string.format, "abc%"))
+		assert(not pcall(string.format, "%5", 1))
+		assert(string.format("a%%b%sc", "-") == "a%b-c")
+		assert(string.format("%5u|%-3c|", 7, 65) == "    7|A  |")
+	`)
+}
+
+func BenchmarkStringFormat(b *testing.B) {
+	l := NewState()
+	OpenLibraries(l)
+	LoadString(l, `return function(n)
+		local s
+		for i = 1, n do
+			s = string.format("%d: %s = %.2f (%5d, %x) %g", i, "name", i / 3, i, i, i * 0.5)
+		end
+		return s
+	end`)
+	if err := l.ProtectedCall(0, 1, 0); err != nil {
+		b.Fatal(err)
+	}
+	l.PushInteger(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := l.ProtectedCall(1, 1, 0); err != nil {
+		b.Fatal(err)
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n += len(p); w.n > 8192 {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestGsubTo(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	subject := strings.Repeat("key=value; ", 10000)
+	for _, c := range []struct {
+		repl string
+		n    int
+	}{{`"%2=%1"`, -1}, {`{key = "KEY"}`, -1}, {`function(k) if k == "value" then return false end return k:upper() end`, -1}, {`"<%0>"`, 5}} {
+		if err := DoString(l, "r = "+c.repl); err != nil {
+			t.Fatal(err)
+		}
+		pattern := "(%w+)=(%w+)"
+		if c.repl[0] != '"' {
+			pattern = "%w+"
+		}
+		l.Global("r")
+		var b strings.Builder
+		n, err := GsubTo(l, &b, subject, pattern, c.n)
+		if err != nil {
+			t.Fatalf("%s: %v", c.repl, err)
+		}
+		l.Global("string")
+		l.Field(-1, "gsub")
+		l.PushString(subject)
+		l.PushString(pattern)
+		l.Global("r")
+		if c.n >= 0 {
+			l.PushInteger(c.n)
+		} else {
+			l.PushNil()
+		}
+		l.Call(4, 2)
+		want, _ := l.ToString(-2)
+		wantN, _ := l.ToInteger(-1)
+		l.Pop(3)
+		if b.String() != want || n != wantN {
+			t.Errorf("%s: GsubTo differs from string.gsub (%d vs %d matches)", c.repl, n, wantN)
+		}
+	}
+	top := l.Top()
+	l.PushString("x")
+	if _, err := GsubTo(l, &failingWriter{}, subject, "%w+", -1); err == nil || err.Error() != "disk full" {
+		t.Errorf("got %v, want disk full", err)
+	}
+	l.PushString("x")
+	if _, err := GsubTo(l, io.Discard, subject, "[%w", -1); err == nil || !strings.Contains(err.Error(), "malformed pattern") {
+		t.Errorf("got %v, want malformed pattern error", err)
+	}
+	if err := DoString(l, `r = function(w) if w == "c" then error("bad word") end return w:upper() end`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("r")
+	var partial strings.Builder
+	if n, err := GsubTo(l, &partial, "a b c d", "%w", -1); err == nil || !strings.Contains(err.Error(), "bad word") || n != 3 || partial.String() != "A B " {
+		t.Errorf("got %d matches, %q and %v, want 3, \"A B \" and bad word", n, partial.String(), err)
+	}
+	if l.Top() != top {
+		t.Errorf("GsubTo left %d values on the stack", l.Top()-top)
+	}
+}
+
+func TestStringPackHalfFloat(t *testing.T) {
+	testString(t, `
+		local function roundtrip(x) return (string.unpack("<e", string.pack("<e", x))) end
+		assert(string.packsize("e") == 2 and string.packsize("!b e") == 4)
+		assert(string.pack(">e", 1) == "\x3c\x00" and string.pack("<e", -2) == "\x00\xc0")
+		assert(string.pack(">e", 65504) == "\x7b\xff")
+		for _, x in ipairs({0, 1, -1, 0.5, 1.5, 65504, -65504, 2^-14, 2^-24, 3.140625}) do
+			assert(roundtrip(x) == x, x)
+		end
+		assert(roundtrip(2049) == 2048 and roundtrip(2051) == 2052) -- nearest even
+		assert(roundtrip(1/3) == 0.333251953125)
+		assert(roundtrip(2^-25) == 0 and roundtrip(2^-25 * 1.5) == 2^-24)
+		assert(roundtrip(65520) == math.huge and roundtrip(-1e300) == -math.huge)
+		assert(roundtrip(math.huge) == math.huge and roundtrip(-math.huge) == -math.huge)
+		assert(1 / roundtrip(-0.0) == -math.huge)
+		local nan = roundtrip(0/0)
+		assert(nan ~= nan)
+		assert(string.pack(">e", -(0/0)):byte(1) & 0x7c == 0x7c)
+		for _, fmt in ipairs({"f", "d", "n"}) do
+			assert(string.unpack(fmt, string.pack(fmt, math.huge)) == math.huge)
+			assert(1 / string.unpack(fmt, string.pack(fmt, -0.0)) == -math.huge)
+			local x = string.unpack(fmt, string.pack(fmt, 0/0))
+			assert(x ~= x)
+		end
+		local a, b, pos = string.unpack(">e e", string.pack(">e e", 0.25, -8))
+		assert(a == 0.25 and b == -8 and pos == 5)
+	`)
+}
+
+func TestPackToUnpackFrom(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	const format = "<i4 I2 b d f e s1 z c3 j"
+	values := []interface{}{-7, uint16(65535), int8(-1), 0.25, float32(1.5), 2.0, "len", []byte("zero"), "abc", int64(1) << 40}
+	var b bytes.Buffer
+	if err := PackTo(&b, format, values...); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(l, `return string.pack("`+format+`", -7, 65535, -1, 0.25, 1.5, 2.0, "len", "zero", "abc", 1 << 40)`); err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := l.ToString(-1); b.String() != want {
+		t.Fatalf("PackTo wrote %q, string.pack returned %q", b.String(), want)
+	}
+	// Records are read one at a time from the same reader.
+	b.WriteString(b.String())
+	r := bytes.NewReader(b.Bytes())
+	want := []interface{}{int64(-7), int64(65535), int64(-1), 0.25, 1.5, 2.0, "len", "zero", "abc", int64(1) << 40}
+	for i := 0; i < 2; i++ {
+		got, err := UnpackFrom(r, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("record %d: got %v, want %v", i, got, want)
+		}
+	}
+	if _, err := UnpackFrom(r, "i4"); err == nil || err.Error() != "unpack: data string too short" {
+		t.Errorf("unexpected error at end of data: %v", err)
+	}
+	for _, c := range []struct {
+		format string
+		values []interface{}
+		err    string
+	}{
+		{"b", []interface{}{1.5}, "pack: value #1: number has no integer representation"},
+		{"j", []interface{}{1.5}, "pack: value #1: integer expected"},
+		{"i4 i4", []interface{}{1}, "pack: value #2: no value"},
+		{"z", []interface{}{1}, "pack: value #1: string expected"},
+		{"d", []interface{}{true}, "pack: value #1: unsupported type bool"},
+		{"i17", []interface{}{1}, "pack: integral size (17) out of limits [1,16]"},
+		{"i1", []interface{}{300}, "pack: value #1: integer overflow"},
+	} {
+		if err := PackTo(&b, c.format, c.values...); err == nil || err.Error() != c.err {
+			t.Errorf("PackTo(%q, %v): got error %v, want %q", c.format, c.values, err, c.err)
+		}
+	}
+}
+
+func TestStringPackFloatCorners(t *testing.T) {
+	testString(t, `
+		-- reinterpret bit patterns as doubles and back
+		local function double(bits) return (string.unpack("<d", string.pack("<i8", bits))) end
+		local function bits(fmt, x, endian)
+			local size = string.packsize(fmt)
+			local s = string.pack(endian .. fmt, x)
+			if endian == ">" then s = s:reverse() end
+			return (string.unpack("<I" .. size, s))
+		end
+		local qnan, snan = 0x7ff8000000000000, 0x7ff0000000000001
+		for _, e in ipairs({"<", ">"}) do
+			-- doubles round-trip bit for bit, NaN payloads and signaling NaNs included
+			for _, b in ipairs({qnan | 0x1234, snan, snan | 0x000fedcba9876543, qnan | (1 << 63), 1, (1 << 52) - 1, 1 << 63}) do
+				for _, fmt in ipairs({"d", "n"}) do
+					assert(bits(fmt, double(b), e) == b, string.format("%s%s %x", e, fmt, b))
+				end
+			end
+			-- floats keep the sign, the quiet bit and the high payload bits
+			assert(bits("f", double(qnan), e) == 0x7fc00000)
+			assert(bits("f", double(qnan | (0x12345 << 29)), e) == 0x7fc12345)
+			assert(bits("f", double(qnan | (1 << 63)), e) == 0xffc00000)
+			assert(bits("f", double(0x7ff4000000000000), e) == 0x7fa00000) -- signaling
+			assert(bits("f", double(snan), e) == 0x7f800001) -- still a signaling NaN
+			assert(bits("e", double(snan), e) == 0x7c01 and bits("e", double(qnan | (1 << 63)), e) == 0xfe00)
+			-- and unpacking widens them exactly
+			local f = string.unpack(e .. "f", string.pack(e .. "f", double(0x7ff4000000000000 | (0x55 << 29))))
+			assert(bits("d", f, "<") == 0x7ff4000000000000 | (0x55 << 29))
+			-- negative zero and subnormals
+			for _, fmt in ipairs({"e", "f", "d"}) do
+				local z = string.unpack(e .. fmt, string.pack(e .. fmt, -0.0))
+				assert(z == 0 and 1 / z == -math.huge)
+			end
+			assert(bits("f", -0.0, e) == 0x80000000 and bits("f", 2^-149, e) == 1 and bits("f", -2^-126 / 2, e) == 0x80400000)
+			assert(string.unpack(e .. "f", string.pack(e .. "f", 2^-149)) == 2^-149)
+			assert(string.unpack(e .. "f", string.pack(e .. "f", 2^-151)) == 0) -- rounds to even
+			assert(string.unpack(e .. "f", string.pack(e .. "f", 2^-150 * 3)) == 2^-148)
+			assert(string.unpack(e .. "d", string.pack(e .. "d", 2^-1074)) == 2^-1074)
+			assert(bits("d", double(1), e) == 1 and bits("d", -2^-1074, e) == (1 << 63) | 1)
+		end
+	`)
+}
+
+func TestStringPackRuntimeSizedString(t *testing.T) {
+	testString(t, `
+		-- a length, then a flags byte, then the bytes
+		local msg = string.pack(">#I2 B c#", 5, 0x80, "hello")
+		assert(msg == "\0\5\x80hello")
+		local n, flags, body, pos = string.unpack(">#I2 B c#", msg .. "rest")
+		assert(n == 5 and flags == 0x80 and body == "hello" and pos == 9)
+
+		-- each c# uses the last length field before it
+		local n1, a, n2, b, pos = string.unpack("#B c# #B c#", "\3abc\0")
+		assert(n1 == 3 and a == "abc" and n2 == 0 and b == "" and pos == 6)
+		assert(string.pack("#B c# #B c#", 3, "abc", 0, "") == "\3abc\0")
+		assert(string.pack("#i2 c#", 4, "ab") == string.pack("i2 c4", 4, "ab")) -- padded like c
+		assert(string.packlen("#I2 c#", 3, "abc") == 5)
+
+		local function fails(msg, f, ...)
+			local ok, err = pcall(f, ...)
+			assert(not ok and err:find(msg, 1, true), err)
+		end
+		fails("no length field ('#') before option 'c#'", string.unpack, "B c#", "\3abc")
+		fails("option '#' must precede an integer option", string.pack, "#d c#", 1.5, "x")
+		fails("invalid length (-1) for option 'c#'", string.unpack, "#b c#", "\255")
+		fails("data string too short", string.unpack, "#B c#", "\9abc")
+		fails("string longer than given size", string.pack, "#B c#", 1, "ab")
+		fails("variable-length format", string.packsize, "#B c#")
+	`)
+}
+
+func TestStringPositionBoundaries(t *testing.T) {
+	testString(t, `
+		local min, max = math.mininteger, math.maxinteger
+		local s = "hello"
+		for _, big in ipairs({2^31 // 1, 2^32 // 1, 2^32 + 1 // 1, max}) do
+			assert(s:sub(big) == "" and s:sub(1, big) == "hello" and s:sub(-big) == "hello")
+			assert(s:sub(-big, -big) == "" and s:sub(big, -big) == "")
+			assert(s:byte(big) == nil and select("#", s:byte(1, big)) == 5)
+			assert(s:find("l", big) == nil and s:find("", big) == nil and s:find("h", -big) == 1)
+			assert(s:match(".", -big) == "h")
+			assert(not pcall(string.unpack, "b", s, big))
+			assert(string.unpack("b", s, -big) == 104)
+			assert(not pcall(utf8.len, s, -big) and utf8.len(s, 1, -big) == 0)
+			assert(not pcall(utf8.offset, s, 1, big) and not pcall(utf8.codepoint, s, big))
+		end
+		assert(s:sub(min) == "hello" and s:sub(min, min) == "" and s:sub(max, min) == "")
+		assert(s:byte(min) == nil and s:byte(min, 1) == 104 and s:byte(-2) == 108)
+		assert(s:find("o", min) == 5)
+		local n = 0
+		for _ in s:gmatch("", max) do n = n + 1 end
+		assert(n == 0)
+		for _ in s:gmatch("", 6) do n = n + 1 end
+		assert(n == 1)
+		assert(s:gsub("l", "L", max) == "heLLo" and s:gsub("l", "L", min) == "hello")
+
+		assert(select(2, string.unpack("b", s, 0)) == 2) -- 0 is the first byte, as in Lua 5.4
+		assert(string.unpack("z", "ab\0", -3) == "ab")
+		assert(string.unpack("", s, 6) == 6)
+
+		assert(utf8.offset("aéb", 1, -1) == 4 and utf8.offset("aéb", -1, -1) == 2)
+		assert(utf8.offset("aéb", min) == nil and utf8.offset("aéb", max) == nil)
+		assert(utf8.codepoint("aéb", -1) == 98 and utf8.len("aéb", -1) == 1)
+		assert(not pcall(utf8.len, "aéb", min) and not pcall(utf8.offset, "aéb", 1, min))
+	`)
+}
+
+func TestStringPositionsAreIntegers(t *testing.T) {
+	testString(t, `
+		local function integers(...)
+			for i = 1, select("#", ...) do
+				local v = select(i, ...)
+				assert(math.type(v) == "integer", tostring(v))
+			end
+			return ...
+		end
+		integers(("hello"):find("l+"))
+		assert(select("#", ("hello"):find("l+")) == 2 and select("#", ("hello"):find("(l)(l)")) == 4)
+		integers(("hello"):find("l", 1, true))
+		integers(("hello"):match("()ll()"))
+		for a, b in ("a b"):gmatch("()%a()") do integers(a, b) end
+		integers(select(2, ("hello"):gsub("l", "L")))
+		integers(("hello"):byte(1, -1))
+		integers(utf8.offset("aéb", 3), utf8.len("aéb"), utf8.codepoint("aéb", 1, -1))
+		for p, c in utf8.codes("aé") do integers(p, c) end
+		integers(select(2, string.unpack("i4", string.pack("i4", 1))))
+		integers(#"hello", ("hello"):len(), #{1, 2, 3})
+	`)
+}
@@ -0,0 +1,71 @@
+package lua
+
+import "sync"
+
+// A StringPool shares the storage of identical strings among the chunks
+// loaded by the states that use it. Programs that compile many similar
+// chunks, such as generated templates, otherwise keep a separate copy of
+// every constant string, local variable name and source name per chunk.
+//
+// A pool keeps its strings alive until it is dropped, so it suits a compile
+// session or the lifetime of a set of states rather than a process. It is
+// safe for concurrent use by several states.
+type StringPool struct {
+	mu      sync.Mutex
+	strings map[string]string
+}
+
+// NewStringPool returns an empty pool.
+func NewStringPool() *StringPool {
+	return &StringPool{strings: make(map[string]string)}
+}
+
+// Len returns the number of distinct strings in the pool.
+func (p *StringPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.strings)
+}
+
+// SetStringPool makes l share the strings of the chunks it loads, both
+// source and precompiled, through p. Strings of chunks loaded before are
+// not affected. A nil pool stops the sharing.
+func SetStringPool(l *State, p *StringPool) { l.global.stringPool = p }
+
+func (p *StringPool) intern(s string) string {
+	if t, ok := p.strings[s]; ok {
+		return t
+	}
+	p.strings[s] = s
+	return s
+}
+
+// internPrototype replaces the strings of proto and its nested prototypes by
+// their pooled copies.
+func (p *StringPool) internPrototype(proto *prototype) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.internStrings(proto)
+}
+
+func (p *StringPool) internStrings(proto *prototype) {
+	proto.source = p.intern(proto.source)
+	for i, k := range proto.constants {
+		if s, ok := k.(string); ok {
+			proto.constants[i] = p.intern(s)
+		}
+	}
+	for i := range proto.localVariables {
+		v := &proto.localVariables[i]
+		v.name = p.intern(v.name)
+		if s, ok := v.val.(string); ok {
+			v.val = p.intern(s)
+		}
+	}
+	for i := range proto.upValues {
+		proto.upValues[i].name = p.intern(proto.upValues[i].name)
+	}
+	for i := range proto.prototypes {
+		p.internStrings(&proto.prototypes[i])
+	}
+}
@@ -0,0 +1,61 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestStringPool(t *testing.T) {
+	pool := NewStringPool()
+	chunk := `local greeting = "` + strings.Repeat("hello ", 20) + `" return function(name) return greeting .. name end`
+	constant := func(l *State) *byte {
+		c := l.stack[l.top-1].(*luaClosure)
+		return unsafe.StringData(c.prototype.constants[0].(string))
+	}
+	var data []*byte
+	for i := 0; i < 2; i++ {
+		l := NewState()
+		OpenLibraries(l)
+		SetStringPool(l, pool)
+		if err := LoadString(l, chunk); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, constant(l))
+		if err := l.ProtectedCall(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		l.PushString("world")
+		l.Call(1, 1)
+		if s, _ := l.ToString(-1); s != strings.Repeat("hello ", 20)+"world" {
+			t.Fatalf("unexpected result %q", s)
+		}
+	}
+	if data[0] != data[1] {
+		t.Error("constant strings of identical chunks are not shared")
+	}
+	n := pool.Len()
+	if n == 0 {
+		t.Fatal("empty pool")
+	}
+
+	// Precompiled chunks share the pooled strings too.
+	l := NewState()
+	if err := LoadString(l, chunk); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := l.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	SetStringPool(l, pool)
+	if err := LoadBuffer(l, b.String(), "=dumped", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if constant(l) != data[0] {
+		t.Error("constant strings of a precompiled chunk are not shared")
+	}
+	if pool.Len() != n {
+		t.Errorf("pool grew from %d to %d strings", n, pool.Len())
+	}
+}
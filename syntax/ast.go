@@ -0,0 +1,309 @@
+package syntax
+
+// A Node is a node of the syntax tree. Pos is the position of its first
+// token and End the position just after its last.
+type Node interface {
+	Pos() Pos
+	End() Pos
+}
+
+// A Span is the range of source of a node.
+type Span struct {
+	From, To Pos
+}
+
+// Pos returns the start of the span.
+func (s Span) Pos() Pos { return s.From }
+
+// End returns the position just after the span.
+func (s Span) End() Pos { return s.To }
+
+// A Stmt is a statement.
+type Stmt interface {
+	Node
+	stmt()
+}
+
+// An Expr is an expression.
+type Expr interface {
+	Node
+	expr()
+}
+
+// A Chunk is a parsed chunk: its block, which is the body of the main
+// function, and the comments of the source, which are not part of the tree.
+type Chunk struct {
+	Name     string
+	Block    *Block
+	Comments []Token
+}
+
+// A Block is a list of statements. A return statement can only be the last.
+type Block struct {
+	Span
+	Stmts []Stmt
+}
+
+// Statements.
+type (
+	// LocalStmt declares local variables: local a <const>, b = 1, 2.
+	LocalStmt struct {
+		Span
+		Names   []*Ident
+		Attribs []string // the attribute of each name, "const", "close" or ""
+		Values  []Expr
+	}
+
+	// AssignStmt assigns values to variables: a, t[i] = 1, 2.
+	AssignStmt struct {
+		Span
+		Targets []Expr // *Ident, *IndexExpr or *FieldExpr
+		Values  []Expr
+	}
+
+	// CallStmt is a function call used as a statement.
+	CallStmt struct {
+		Span
+		Call Expr // *CallExpr or *MethodCallExpr
+	}
+
+	DoStmt struct {
+		Span
+		Body *Block
+	}
+
+	WhileStmt struct {
+		Span
+		Cond Expr
+		Body *Block
+	}
+
+	RepeatStmt struct {
+		Span
+		Body *Block
+		Cond Expr
+	}
+
+	// IfStmt has a clause for the if and each elseif, and an else block or
+	// nil.
+	IfStmt struct {
+		Span
+		Clauses []*IfClause
+		Else    *Block
+	}
+
+	// NumericForStmt is for v = start, limit, step do ... end; Step is nil
+	// if it is not given.
+	NumericForStmt struct {
+		Span
+		Var                *Ident
+		Start, Limit, Step Expr
+		Body               *Block
+	}
+
+	// GenericForStmt is for names in exprs do ... end.
+	GenericForStmt struct {
+		Span
+		Names []*Ident
+		Exprs []Expr
+		Body  *Block
+	}
+
+	// FunctionStmt is function a.b.c:m() ... end. Path holds a, b and c;
+	// Method is m or nil.
+	FunctionStmt struct {
+		Span
+		Path   []*Ident
+		Method *Ident
+		Func   *FunctionExpr
+	}
+
+	// LocalFunctionStmt is local function f() ... end.
+	LocalFunctionStmt struct {
+		Span
+		Name *Ident
+		Func *FunctionExpr
+	}
+
+	ReturnStmt struct {
+		Span
+		Values []Expr
+	}
+
+	BreakStmt struct {
+		Span
+	}
+
+	GotoStmt struct {
+		Span
+		Label *Ident
+	}
+
+	// LabelStmt is ::name::.
+	LabelStmt struct {
+		Span
+		Name *Ident
+	}
+
+	// An EmptyStmt is a semicolon.
+	EmptyStmt struct {
+		Span
+	}
+)
+
+// An IfClause is the condition and block of an if or elseif.
+type IfClause struct {
+	Span
+	Cond Expr
+	Body *Block
+}
+
+// Expressions.
+type (
+	// An Ident is a variable, or the name of a local variable, parameter,
+	// field, method or label where it is declared or used.
+	Ident struct {
+		Span
+		Name string
+	}
+
+	NilExpr struct {
+		Span
+	}
+
+	// BoolExpr is true or false.
+	BoolExpr struct {
+		Span
+		Value bool
+	}
+
+	// NumberExpr is a numeral. Value is an int64 or a float64, as Lua would
+	// read Raw.
+	NumberExpr struct {
+		Span
+		Raw   string
+		Value interface{}
+	}
+
+	// StringExpr is a string literal. Raw is the literal with its quotes or
+	// brackets and Value the string it denotes.
+	StringExpr struct {
+		Span
+		Raw   string
+		Value string
+	}
+
+	// VarargExpr is ...
+	VarargExpr struct {
+		Span
+	}
+
+	// FunctionExpr is a function body: its parameters, whether it ends with
+	// ..., and its block. Its span starts at the keyword function, except in
+	// FunctionStmt and LocalFunctionStmt, where it starts at the parameters.
+	FunctionExpr struct {
+		Span
+		Params   []*Ident
+		IsVararg bool
+		Body     *Block
+	}
+
+	// TableExpr is a table constructor.
+	TableExpr struct {
+		Span
+		Fields []*Field
+	}
+
+	// BinaryExpr is Left Op Right, where Op is an operator such as "+" or
+	// "and".
+	BinaryExpr struct {
+		Span
+		Op          string
+		Left, Right Expr
+	}
+
+	// UnaryExpr is Op X, where Op is "-", "not", "#" or "~".
+	UnaryExpr struct {
+		Span
+		Op string
+		X  Expr
+	}
+
+	// ParenExpr is (X), which also truncates X to one value.
+	ParenExpr struct {
+		Span
+		X Expr
+	}
+
+	// IndexExpr is Object[Key].
+	IndexExpr struct {
+		Span
+		Object, Key Expr
+	}
+
+	// FieldExpr is Object.Field.
+	FieldExpr struct {
+		Span
+		Object Expr
+		Field  *Ident
+	}
+
+	// CallExpr is Func(Args). The argument of f"s" and f{...} is the only
+	// element of Args.
+	CallExpr struct {
+		Span
+		Func Expr
+		Args []Expr
+	}
+
+	// MethodCallExpr is Object:Method(Args).
+	MethodCallExpr struct {
+		Span
+		Object Expr
+		Method *Ident
+		Args   []Expr
+	}
+)
+
+// A Field is an entry of a table constructor: a value for the next index
+// when Key and Name are nil, name = value when Name is set and
+// [key] = value when Key is set.
+type Field struct {
+	Span
+	Key   Expr
+	Name  *Ident
+	Value Expr
+}
+
+func (*LocalStmt) stmt()         {}
+func (*AssignStmt) stmt()        {}
+func (*CallStmt) stmt()          {}
+func (*DoStmt) stmt()            {}
+func (*WhileStmt) stmt()         {}
+func (*RepeatStmt) stmt()        {}
+func (*IfStmt) stmt()            {}
+func (*NumericForStmt) stmt()    {}
+func (*GenericForStmt) stmt()    {}
+func (*FunctionStmt) stmt()      {}
+func (*LocalFunctionStmt) stmt() {}
+func (*ReturnStmt) stmt()        {}
+func (*BreakStmt) stmt()         {}
+func (*GotoStmt) stmt()          {}
+func (*LabelStmt) stmt()         {}
+func (*EmptyStmt) stmt()         {}
+
+func (*Ident) expr()          {}
+func (*NilExpr) expr()        {}
+func (*BoolExpr) expr()       {}
+func (*NumberExpr) expr()     {}
+func (*StringExpr) expr()     {}
+func (*VarargExpr) expr()     {}
+func (*FunctionExpr) expr()   {}
+func (*TableExpr) expr()      {}
+func (*BinaryExpr) expr()     {}
+func (*UnaryExpr) expr()      {}
+func (*ParenExpr) expr()      {}
+func (*IndexExpr) expr()      {}
+func (*FieldExpr) expr()      {}
+func (*CallExpr) expr()       {}
+func (*MethodCallExpr) expr() {}
@@ -0,0 +1,172 @@
+package syntax
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseNumber returns the value of a numeral as Lua reads it: an int64 for
+// an integer, or a float64 for a float or a decimal integer that does not
+// fit in 64 bits. Hexadecimal integers wrap around.
+func parseNumber(s string) (interface{}, error) {
+	malformed := fmt.Errorf("malformed number near '%s'", s)
+	if strings.IndexByte(s, '_') >= 0 {
+		return nil, malformed
+	}
+	if len(s) > 1 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		digits := s[2:]
+		if strings.ContainsAny(digits, ".pP") {
+			if !strings.ContainsAny(digits, "pP") {
+				digits += "p0" // Go requires the exponent of hexadecimal floats
+			}
+			f, err := strconv.ParseFloat("0x"+digits, 64)
+			if err != nil && !errors.Is(err, strconv.ErrRange) {
+				return nil, malformed
+			}
+			return f, nil
+		}
+		if digits == "" {
+			return nil, malformed
+		}
+		var i int64
+		for _, c := range []byte(digits) {
+			d := strings.IndexByte("0123456789abcdef", c|0x20)
+			if d < 0 {
+				return nil, malformed
+			}
+			i = i<<4 + int64(d)
+		}
+		return i, nil
+	}
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		} else if !errors.Is(err, strconv.ErrRange) {
+			return nil, malformed
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return nil, malformed
+	}
+	return f, nil
+}
+
+// unquote returns the string that a string literal denotes.
+func unquote(s string) (string, error) {
+	if strings.HasPrefix(s, "[") {
+		level := strings.IndexByte(s[1:], '[') + 2
+		if level < 2 || len(s) < 2*level {
+			return "", fmt.Errorf("malformed long string %q", s)
+		}
+		body := s[level : len(s)-level]
+		for _, nl := range []string{"\r\n", "\n\r", "\n", "\r"} {
+			if strings.HasPrefix(body, nl) {
+				body = body[len(nl):]
+				break
+			}
+		}
+		return strings.NewReplacer("\r\n", "\n", "\n\r", "\n", "\r", "\n").Replace(body), nil
+	}
+	if len(s) < 2 || s[0] != s[len(s)-1] || s[0] != '"' && s[0] != '\'' {
+		return "", fmt.Errorf("malformed string %q", s)
+	}
+	body, b := s[1:len(s)-1], strings.Builder{}
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i++; i >= len(body) {
+			return "", fmt.Errorf("unfinished escape in %q", s)
+		}
+		switch c = body[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(c)
+		case '\n', '\r':
+			if i+1 < len(body) && (body[i+1] == '\n' || body[i+1] == '\r') && body[i+1] != c {
+				i++
+			}
+			b.WriteByte('\n')
+		case 'x':
+			if i+2 >= len(body) {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			x, err := strconv.ParseUint(body[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			b.WriteByte(byte(x))
+			i += 2
+		case 'z':
+			for i+1 < len(body) && strings.IndexByte(" \t\r\n\f\v", body[i+1]) >= 0 {
+				i++
+			}
+		case 'u':
+			end := strings.IndexByte(body[i:], '}')
+			if !strings.HasPrefix(body[i+1:], "{") || end < 0 {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			x, err := strconv.ParseUint(body[i+2:i+end], 16, 32)
+			if err != nil || x >= 1<<31 {
+				return "", fmt.Errorf("UTF-8 value too large in %q", s)
+			}
+			b.WriteString(utf8Escape(uint32(x)))
+			i += end
+		default:
+			if !isDigit(c) {
+				return "", fmt.Errorf("invalid escape in %q", s)
+			}
+			d := 0
+			for n := 0; n < 3 && i < len(body) && isDigit(body[i]); n++ {
+				d = d*10 + int(body[i]-'0')
+				i++
+			}
+			i--
+			if d > 255 {
+				return "", fmt.Errorf("decimal escape too large in %q", s)
+			}
+			b.WriteByte(byte(d))
+		}
+	}
+	return b.String(), nil
+}
+
+// utf8Escape encodes x like Lua's \u{...}, which allows values up to 2^31
+// and surrogates, unlike the encoding of Go.
+func utf8Escape(x uint32) string {
+	if x < 0x80 {
+		return string([]byte{byte(x)})
+	}
+	var buf [6]byte
+	n, mfb := len(buf), uint32(0x3f) // mfb is the largest value that fits in the first byte
+	for {
+		n--
+		buf[n] = byte(0x80 | x&0x3f)
+		x >>= 6
+		mfb >>= 1
+		if x <= mfb {
+			break
+		}
+	}
+	n--
+	buf[n] = byte(^mfb<<1 | x)
+	return string(buf[n:])
+}
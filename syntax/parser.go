@@ -0,0 +1,486 @@
+// Package syntax exposes the front end of go-lua to tools such as linters,
+// highlighters and transpilers.
+//
+// A Scanner splits Lua 5.4 source into tokens, comments included, with the
+// line, column and offset where each starts and ends. Parse builds a syntax
+// tree of the statements and expressions of a chunk, each with its span in
+// the source; Inspect walks it. The tree follows the source as written: it
+// neither resolves names nor folds constants, and parentheses are kept.
+//
+// Parse accepts exactly the chunks that go-lua compiles, since it runs
+// go-lua's compiler first and reports its errors. The scanner and the tree
+// are built apart from the compiler, which reads only line numbers, skips
+// comments and stops at the first error; go-lua's tests check that both
+// read the Lua test suite alike. New fields and node types
+// may be added to the tree, but the existing ones keep their meaning.
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+
+	lua "github.com/speedata/go-lua"
+)
+
+// Parse parses the Lua chunk src and returns its syntax tree. The chunk is
+// first compiled by go-lua's own compiler, so Parse accepts exactly the
+// chunks that lua.Load accepts, and its errors are lua.ParseError values
+// with the messages of lua.Load. name is the chunk name, as in
+// lua.LoadBuffer, e.g. "@file.lua" or "=stdin". A first line starting with
+// '#' is skipped like lua.LoadFile does.
+func Parse(src []byte, name string) (*Chunk, error) {
+	chunk := src
+	if len(chunk) > 0 && chunk[0] == '#' { // keep the line break, so that the line numbers stay
+		if i := bytes.IndexAny(chunk, "\r\n"); i >= 0 {
+			chunk = chunk[i:]
+		} else {
+			chunk = nil
+		}
+	}
+	if errs := lua.CheckSyntax(lua.NewState(), bytes.NewReader(chunk), name, 1); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	p := &parser{}
+	s := NewScanner(src)
+	for {
+		t := s.Next()
+		if t.Kind == Comment {
+			p.comments = append(p.comments, t)
+			continue
+		}
+		p.tokens = append(p.tokens, t)
+		if t.Kind == EOF {
+			break
+		}
+	}
+	return p.parse(name)
+}
+
+// A parser builds the tree from the tokens of a chunk that go-lua has
+// compiled already, so it does not look for errors: a mismatch is a bug.
+type parser struct {
+	tokens   []Token
+	comments []Token
+	i        int
+	last     Token // the last token read
+}
+
+type internalError struct{ err error }
+
+func (p *parser) parse(name string) (c *Chunk, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			ie, ok := e.(internalError)
+			if !ok {
+				panic(e)
+			}
+			c, err = nil, ie.err
+		}
+	}()
+	c = &Chunk{Name: name, Block: p.block(), Comments: p.comments}
+	p.expectKind(EOF)
+	return c, nil
+}
+
+func (p *parser) peek() Token { return p.tokens[p.i] }
+
+func (p *parser) next() Token {
+	t := p.tokens[p.i]
+	if t.Kind != EOF {
+		p.i++
+	}
+	p.last = t
+	return t
+}
+
+// is reports whether the next token is the keyword or symbol text.
+func (p *parser) is(text string) bool {
+	t := p.tokens[p.i]
+	return (t.Kind == Keyword || t.Kind == Symbol) && t.Text == text
+}
+
+// accept reads the keyword or symbol text if it comes next.
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) Token {
+	if !p.is(text) {
+		p.fail(fmt.Sprintf("%q expected", text))
+	}
+	return p.next()
+}
+
+func (p *parser) expectKind(kind Kind) Token {
+	if p.peek().Kind != kind {
+		p.fail(kind.String() + " expected")
+	}
+	return p.next()
+}
+
+func (p *parser) fail(msg string) {
+	t := p.peek()
+	panic(internalError{fmt.Errorf("syntax: internal error at %v near %q: %s", t.Pos, t.Text, msg)})
+}
+
+// span returns the span from from to the end of the last token read.
+func (p *parser) span(from Pos) Span { return Span{From: from, To: p.last.End} }
+
+func (p *parser) name() *Ident {
+	t := p.expectKind(Name)
+	return &Ident{Span: Span{t.Pos, t.End}, Name: t.Text}
+}
+
+func (p *parser) blockFollows() bool {
+	return p.peek().Kind == EOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *parser) block() *Block {
+	b := &Block{Span: Span{p.peek().Pos, p.peek().Pos}}
+	for !p.blockFollows() {
+		if p.is("return") {
+			b.Stmts = append(b.Stmts, p.returnStmt())
+			break
+		}
+		b.Stmts = append(b.Stmts, p.statement())
+	}
+	if n := len(b.Stmts); n > 0 {
+		b.To = b.Stmts[n-1].End()
+	}
+	return b
+}
+
+func (p *parser) returnStmt() Stmt {
+	from := p.next().Pos
+	s := &ReturnStmt{}
+	if !p.blockFollows() && !p.is(";") {
+		s.Values = p.exprList()
+	}
+	p.accept(";")
+	s.Span = p.span(from)
+	return s
+}
+
+func (p *parser) statement() Stmt {
+	from := p.peek().Pos
+	switch {
+	case p.accept(";"):
+		return &EmptyStmt{p.span(from)}
+	case p.accept("if"):
+		s := &IfStmt{}
+		cond := p.expr(0)
+		p.expect("then")
+		s.Clauses = append(s.Clauses, &IfClause{Cond: cond, Body: p.block()})
+		s.Clauses[0].Span = p.span(from)
+		for p.is("elseif") {
+			clauseFrom := p.next().Pos
+			cond := p.expr(0)
+			p.expect("then")
+			s.Clauses = append(s.Clauses, &IfClause{Cond: cond, Body: p.block()})
+			s.Clauses[len(s.Clauses)-1].Span = p.span(clauseFrom)
+		}
+		if p.accept("else") {
+			s.Else = p.block()
+		}
+		p.expect("end")
+		s.Span = p.span(from)
+		return s
+	case p.accept("while"):
+		s := &WhileStmt{Cond: p.expr(0)}
+		p.expect("do")
+		s.Body = p.block()
+		p.expect("end")
+		s.Span = p.span(from)
+		return s
+	case p.accept("do"):
+		s := &DoStmt{Body: p.block()}
+		p.expect("end")
+		s.Span = p.span(from)
+		return s
+	case p.accept("for"):
+		return p.forStmt(from)
+	case p.accept("repeat"):
+		s := &RepeatStmt{Body: p.block()}
+		p.expect("until")
+		s.Cond = p.expr(0)
+		s.Span = p.span(from)
+		return s
+	case p.accept("function"):
+		s := &FunctionStmt{Path: []*Ident{p.name()}}
+		for p.accept(".") {
+			s.Path = append(s.Path, p.name())
+		}
+		if p.accept(":") {
+			s.Method = p.name()
+		}
+		s.Func = p.functionBody(p.peek().Pos)
+		s.Span = p.span(from)
+		return s
+	case p.accept("local"):
+		if p.accept("function") {
+			s := &LocalFunctionStmt{Name: p.name()}
+			s.Func = p.functionBody(p.peek().Pos)
+			s.Span = p.span(from)
+			return s
+		}
+		s := &LocalStmt{}
+		for {
+			s.Names = append(s.Names, p.name())
+			attrib := ""
+			if p.accept("<") {
+				attrib = p.name().Name
+				p.expect(">")
+			}
+			s.Attribs = append(s.Attribs, attrib)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if p.accept("=") {
+			s.Values = p.exprList()
+		}
+		s.Span = p.span(from)
+		return s
+	case p.accept("::"):
+		s := &LabelStmt{Name: p.name()}
+		p.expect("::")
+		s.Span = p.span(from)
+		return s
+	case p.accept("break"):
+		return &BreakStmt{p.span(from)}
+	case p.accept("goto"):
+		s := &GotoStmt{Label: p.name()}
+		s.Span = p.span(from)
+		return s
+	}
+	e := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		s := &AssignStmt{Targets: []Expr{e}}
+		for p.accept(",") {
+			s.Targets = append(s.Targets, p.suffixedExpr())
+		}
+		p.expect("=")
+		s.Values = p.exprList()
+		s.Span = p.span(from)
+		return s
+	}
+	switch e.(type) {
+	case *CallExpr, *MethodCallExpr:
+	default:
+		p.fail("call expected")
+	}
+	return &CallStmt{Span: p.span(from), Call: e}
+}
+
+func (p *parser) forStmt(from Pos) Stmt {
+	first := p.name()
+	if p.accept("=") {
+		s := &NumericForStmt{Var: first, Start: p.expr(0)}
+		p.expect(",")
+		s.Limit = p.expr(0)
+		if p.accept(",") {
+			s.Step = p.expr(0)
+		}
+		p.expect("do")
+		s.Body = p.block()
+		p.expect("end")
+		s.Span = p.span(from)
+		return s
+	}
+	s := &GenericForStmt{Names: []*Ident{first}}
+	for p.accept(",") {
+		s.Names = append(s.Names, p.name())
+	}
+	p.expect("in")
+	s.Exprs = p.exprList()
+	p.expect("do")
+	s.Body = p.block()
+	p.expect("end")
+	s.Span = p.span(from)
+	return s
+}
+
+// functionBody parses the parameters and the block of a function.
+func (p *parser) functionBody(from Pos) *FunctionExpr {
+	f := &FunctionExpr{}
+	p.expect("(")
+	for !p.is(")") {
+		if p.accept("...") {
+			f.IsVararg = true
+			break
+		}
+		f.Params = append(f.Params, p.name())
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	f.Body = p.block()
+	p.expect("end")
+	f.Span = p.span(from)
+	return f
+}
+
+func (p *parser) exprList() []Expr {
+	list := []Expr{p.expr(0)}
+	for p.accept(",") {
+		list = append(list, p.expr(0))
+	}
+	return list
+}
+
+// The priorities of the binary operators, as in lparser.c: an operator
+// binds its left operand with left and its right operand with right.
+var binaryPriority = map[string]struct{ left, right int }{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"|": {4, 4}, "~": {5, 5}, "&": {6, 6}, "<<": {7, 7}, ">>": {7, 7},
+	"..": {9, 8}, "+": {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const unaryPriority = 12
+
+// expr parses an expression whose binary operators bind more tightly than
+// limit.
+func (p *parser) expr(limit int) Expr {
+	var left Expr
+	if t := p.peek(); p.is("not") || p.is("-") || p.is("#") || p.is("~") {
+		p.next()
+		x := p.expr(unaryPriority)
+		left = &UnaryExpr{Span: Span{t.Pos, x.End()}, Op: t.Text, X: x}
+	} else {
+		left = p.simpleExpr()
+	}
+	for {
+		t := p.peek()
+		prio, ok := binaryPriority[t.Text]
+		if !ok || (t.Kind != Symbol && t.Kind != Keyword) || prio.left <= limit {
+			return left
+		}
+		p.next()
+		right := p.expr(prio.right)
+		left = &BinaryExpr{Span: Span{left.Pos(), right.End()}, Op: t.Text, Left: left, Right: right}
+	}
+}
+
+func (p *parser) simpleExpr() Expr {
+	t := p.peek()
+	span := Span{t.Pos, t.End}
+	switch {
+	case t.Kind == Number:
+		p.next()
+		v, err := parseNumber(t.Text)
+		if err != nil {
+			p.fail(err.Error())
+		}
+		return &NumberExpr{Span: span, Raw: t.Text, Value: v}
+	case t.Kind == String:
+		return p.stringExpr()
+	case p.accept("nil"):
+		return &NilExpr{span}
+	case p.accept("true"):
+		return &BoolExpr{span, true}
+	case p.accept("false"):
+		return &BoolExpr{span, false}
+	case p.accept("..."):
+		return &VarargExpr{span}
+	case p.is("{"):
+		return p.table()
+	case p.accept("function"):
+		return p.functionBody(t.Pos)
+	}
+	return p.suffixedExpr()
+}
+
+func (p *parser) stringExpr() *StringExpr {
+	t := p.expectKind(String)
+	v, err := unquote(t.Text)
+	if err != nil {
+		p.fail(err.Error())
+	}
+	return &StringExpr{Span: Span{t.Pos, t.End}, Raw: t.Text, Value: v}
+}
+
+func (p *parser) primaryExpr() Expr {
+	if p.peek().Kind == Name {
+		return p.name()
+	}
+	from := p.expect("(").Pos
+	x := p.expr(0)
+	p.expect(")")
+	return &ParenExpr{Span: p.span(from), X: x}
+}
+
+func (p *parser) suffixedExpr() Expr {
+	e := p.primaryExpr()
+	from := e.Pos()
+	for {
+		switch {
+		case p.accept("."):
+			e = &FieldExpr{Object: e, Field: p.name()}
+			e.(*FieldExpr).Span = p.span(from)
+		case p.accept("["):
+			key := p.expr(0)
+			p.expect("]")
+			e = &IndexExpr{Span: p.span(from), Object: e, Key: key}
+		case p.accept(":"):
+			method := p.name()
+			args := p.args()
+			e = &MethodCallExpr{Span: p.span(from), Object: e, Method: method, Args: args}
+		case p.is("(") || p.is("{") || p.peek().Kind == String:
+			args := p.args()
+			e = &CallExpr{Span: p.span(from), Func: e, Args: args}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) args() []Expr {
+	switch {
+	case p.peek().Kind == String:
+		return []Expr{p.stringExpr()}
+	case p.is("{"):
+		return []Expr{p.table()}
+	}
+	p.expect("(")
+	var args []Expr
+	if !p.is(")") {
+		args = p.exprList()
+	}
+	p.expect(")")
+	return args
+}
+
+func (p *parser) table() *TableExpr {
+	from := p.expect("{").Pos
+	t := &TableExpr{}
+	for !p.is("}") {
+		f := &Field{}
+		fieldFrom := p.peek().Pos
+		switch {
+		case p.accept("["):
+			f.Key = p.expr(0)
+			p.expect("]")
+			p.expect("=")
+		case p.peek().Kind == Name && p.tokens[p.i+1].Text == "=" && p.tokens[p.i+1].Kind == Symbol:
+			f.Name = p.name()
+			p.expect("=")
+		}
+		f.Value = p.expr(0)
+		f.Span = p.span(fieldFrom)
+		t.Fields = append(t.Fields, f)
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	t.Span = p.span(from)
+	return t
+}
@@ -0,0 +1,307 @@
+package syntax
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/speedata/go-lua"
+)
+
+func TestScanner(t *testing.T) {
+	src := "#!/bin/lua\nlocal s = [[a\nb]] --[==[c]==] x.y:z(1.5e3, 'q\\'')\n-- end"
+	want := []struct {
+		kind Kind
+		text string
+		pos  string
+	}{
+		{Comment, "#!/bin/lua", "1:1"},
+		{Keyword, "local", "2:1"},
+		{Name, "s", "2:7"},
+		{Symbol, "=", "2:9"},
+		{String, "[[a\nb]]", "2:11"},
+		{Comment, "--[==[c]==]", "3:5"},
+		{Name, "x", "3:17"},
+		{Symbol, ".", "3:18"},
+		{Name, "y", "3:19"},
+		{Symbol, ":", "3:20"},
+		{Name, "z", "3:21"},
+		{Symbol, "(", "3:22"},
+		{Number, "1.5e3", "3:23"},
+		{Symbol, ",", "3:28"},
+		{String, "'q\\''", "3:30"},
+		{Symbol, ")", "3:35"},
+		{Comment, "-- end", "4:1"},
+		{EOF, "", "4:7"},
+	}
+	s := NewScanner([]byte(src))
+	for _, w := range want {
+		tok := s.Next()
+		if tok.Kind != w.kind || tok.Text != w.text || tok.Pos.String() != w.pos {
+			t.Errorf("got %v %q at %v, want %v %q at %s", tok.Kind, tok.Text, tok.Pos, w.kind, w.text, w.pos)
+		}
+		if src[tok.Pos.Offset:tok.End.Offset] != tok.Text {
+			t.Errorf("%q: offsets %d to %d", tok.Text, tok.Pos.Offset, tok.End.Offset)
+		}
+	}
+}
+
+// TestScannerInvalid checks that the scanner goes on after text that is not
+// a token, as a highlighter needs.
+func TestScannerInvalid(t *testing.T) {
+	var got []string
+	s := NewScanner([]byte("a $ 0x 'open\nb [[never"))
+	for tok := s.Next(); tok.Kind != EOF; tok = s.Next() {
+		got = append(got, fmt.Sprintf("%v %q", tok.Kind, tok.Text))
+	}
+	want := `Name "a"|Invalid "$"|Invalid "0x"|Invalid "'open"|Name "b"|Invalid "[[never"`
+	if strings.Join(got, "|") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, "|"), want)
+	}
+}
+
+// sexpr writes expressions with explicit structure, to check precedence.
+func sexpr(e Expr) string {
+	switch e := e.(type) {
+	case *Ident:
+		return e.Name
+	case *NumberExpr:
+		return e.Raw
+	case *StringExpr:
+		return e.Raw
+	case *NilExpr, *BoolExpr, *VarargExpr:
+		return "lit"
+	case *BinaryExpr:
+		return "(" + sexpr(e.Left) + " " + e.Op + " " + sexpr(e.Right) + ")"
+	case *UnaryExpr:
+		return "(" + e.Op + " " + sexpr(e.X) + ")"
+	case *ParenExpr:
+		return "[" + sexpr(e.X) + "]"
+	case *IndexExpr:
+		return sexpr(e.Object) + "[" + sexpr(e.Key) + "]"
+	case *FieldExpr:
+		return sexpr(e.Object) + "." + e.Field.Name
+	case *CallExpr:
+		return sexpr(e.Func) + "(" + sexprs(e.Args) + ")"
+	case *MethodCallExpr:
+		return sexpr(e.Object) + ":" + e.Method.Name + "(" + sexprs(e.Args) + ")"
+	case *TableExpr:
+		return fmt.Sprintf("{%d}", len(e.Fields))
+	case *FunctionExpr:
+		return "function"
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+func sexprs(list []Expr) string {
+	var s []string
+	for _, e := range list {
+		s = append(s, sexpr(e))
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestExpressions(t *testing.T) {
+	tests := []struct{ in, out string }{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"a or b and c == d", "(a or (b and (c == d)))"},
+		{"-x ^ 2", "(- (x ^ 2))"},
+		{"2 ^ -3 ^ 4", "(2 ^ (- (3 ^ 4)))"},
+		{"a .. b .. c", "(a .. (b .. c))"},
+		{"a - b - c", "((a - b) - c)"},
+		{"not a == b", "((not a) == b)"},
+		{"a | b ~ c & d << e", "(a | (b ~ (c & (d << e))))"},
+		{"#t // 2 % 3", "(((# t) // 2) % 3)"},
+		{"(f())[1].x:m 's' {1}", "[f()][1].x:m('s')({1})"},
+		{"f{1, y = 2, [3] = 4} .. g\"s\"", "(f({3}) .. g(\"s\"))"},
+	}
+	for _, test := range tests {
+		c, err := Parse([]byte("return "+test.in), "=test")
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if got := sexprs(c.Block.Stmts[0].(*ReturnStmt).Values); got != test.out {
+			t.Errorf("%s: got %s, want %s", test.in, got, test.out)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	src := `local a <const>, b = 1
+a.b.c, t[1] = f(), ...
+function a.b:m(x, ...) return x end
+local function g() end
+for i = 1, 10, 2 do break end
+for k, v in pairs(t) do goto continue ::continue:: end
+if x then elseif y then else end
+while x do repeat ; until y end
+do end
+obj:method()`
+	c, err := Parse([]byte(src), "=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, s := range c.Block.Stmts {
+		types = append(types, fmt.Sprintf("%T@%d", s, s.Pos().Line))
+	}
+	want := "*syntax.LocalStmt@1 *syntax.AssignStmt@2 *syntax.FunctionStmt@3 *syntax.LocalFunctionStmt@4 " +
+		"*syntax.NumericForStmt@5 *syntax.GenericForStmt@6 *syntax.IfStmt@7 *syntax.WhileStmt@8 *syntax.DoStmt@9 *syntax.CallStmt@10"
+	if got := strings.Join(types, " "); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	local := c.Block.Stmts[0].(*LocalStmt)
+	if len(local.Names) != 2 || local.Attribs[0] != "const" || local.Attribs[1] != "" || len(local.Values) != 1 {
+		t.Errorf("local: %+v", local)
+	}
+	fn := c.Block.Stmts[2].(*FunctionStmt)
+	if len(fn.Path) != 2 || fn.Method.Name != "m" || len(fn.Func.Params) != 1 || !fn.Func.IsVararg {
+		t.Errorf("function: %+v", fn)
+	}
+	if s := c.Block.Stmts[6].(*IfStmt); len(s.Clauses) != 2 || s.Else == nil {
+		t.Errorf("if: %+v", s)
+	}
+	if s := c.Block.Stmts[4].(*NumericForStmt); s.Step == nil || s.End().Line != 5 || s.End().Column != 30 {
+		t.Errorf("for: %+v", s)
+	}
+}
+
+// TestLiterals compares the values of literals with those go-lua computes.
+func TestLiterals(t *testing.T) {
+	literals := []string{
+		"0", "42", "9223372036854775807", "9223372036854775808", "0xff", "0xffffffffffffffffff",
+		"1.5", ".5", "3.", "1e10", "2E-3", "1e400", "0x1p4", "0x.8", "0xA.8p1",
+		`"a\tb\\\"c"`, `'\65\066\x43\u{44}\u{7FFFFFFF}'`, "'a\\z  \n  b'", "'a\\\nb'",
+		"[[\nx]]", "[==[\r\ny\r\n]]==]", `"\0\255"`,
+	}
+	l := lua.NewState()
+	for _, lit := range literals {
+		c, err := Parse([]byte("return "+lit), "=test")
+		if err != nil {
+			t.Errorf("%s: %v", lit, err)
+			continue
+		}
+		if err := lua.DoString(l, "return "+lit); err != nil {
+			t.Fatal(err)
+		}
+		var want interface{}
+		if l.TypeOf(-1) == lua.TypeNumber {
+			if i, ok := l.ToInteger(-1); ok && l.IsInteger(-1) {
+				want = int64(i)
+			} else {
+				want, _ = l.ToNumber(-1)
+			}
+		} else {
+			want, _ = l.ToString(-1)
+		}
+		l.Pop(1)
+		var got interface{}
+		switch e := c.Block.Stmts[0].(*ReturnStmt).Values[0].(type) {
+		case *NumberExpr:
+			got = e.Value
+		case *StringExpr:
+			got = e.Value
+		}
+		if f, ok := got.(float64); ok && math.IsInf(f, 0) && got == want {
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %#v, want %#v", lit, got, want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	src := "x = 1\nlocal = 2"
+	_, err := Parse([]byte(src), "=test")
+	l := lua.NewState()
+	lua.LoadBuffer(l, src, "=test", "t")
+	want, _ := l.ToString(-1)
+	if e, ok := err.(lua.ParseError); !ok || e.Line != 2 || err.Error() != want {
+		t.Errorf("got %#v, want %s", err, want)
+	}
+}
+
+// TestLuaTests parses the files of the Lua test suite and checks that the
+// spans of the nodes are nested in each other and that names and literals
+// span their text.
+func TestLuaTests(t *testing.T) {
+	files, err := filepath.Glob("../lua-tests/*.lua")
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test files", err)
+	}
+	for _, name := range files {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Parse(src, "@"+name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var stack []Node
+		Inspect(c.Block, func(n Node) bool {
+			if n == nil {
+				stack = stack[:len(stack)-1]
+				return false
+			}
+			if n.Pos().Offset > n.End().Offset {
+				t.Fatalf("%s:%v: %T ends at %v", name, n.Pos(), n, n.End())
+			}
+			if len(stack) > 0 {
+				if parent := stack[len(stack)-1]; n.Pos().Offset < parent.Pos().Offset || n.End().Offset > parent.End().Offset {
+					t.Fatalf("%s:%v: %T is outside of %T at %v", name, n.Pos(), n, parent, parent.Pos())
+				}
+			}
+			text := string(src[n.Pos().Offset:n.End().Offset])
+			switch n := n.(type) {
+			case *Ident:
+				if text != n.Name {
+					t.Fatalf("%s:%v: name %q spans %q", name, n.Pos(), n.Name, text)
+				}
+			case *StringExpr:
+				if text != n.Raw {
+					t.Fatalf("%s:%v: string %q spans %q", name, n.Pos(), n.Raw, text)
+				}
+			}
+			stack = append(stack, n)
+			return true
+		})
+	}
+}
+
+// This example lists the globals that a chunk assigns.
+func ExampleInspect() {
+	src := "local n = 0\nfunction inc() n = n + 1; total = n end"
+	chunk, err := Parse([]byte(src), "=example")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	locals := map[string]bool{}
+	Inspect(chunk.Block, func(n Node) bool {
+		switch n := n.(type) {
+		case *LocalStmt:
+			for _, id := range n.Names {
+				locals[id.Name] = true
+			}
+		case *FunctionStmt:
+			fmt.Printf("%v: %s\n", n.Pos(), n.Path[0].Name)
+		case *AssignStmt:
+			for _, target := range n.Targets {
+				if id, ok := target.(*Ident); ok && !locals[id.Name] {
+					fmt.Printf("%v: %s\n", id.Pos(), id.Name)
+				}
+			}
+		}
+		return true
+	})
+	// Output:
+	// 2:1: inc
+	// 2:27: total
+}
@@ -0,0 +1,240 @@
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Pos is a position in the source. Line and Column start at 1; Column
+// counts bytes. Offset is the byte offset from the start of the source.
+type Pos struct {
+	Line, Column, Offset int
+}
+
+func (p Pos) String() string { return fmt.Sprintf("%d:%d", p.Line, p.Column) }
+
+// A Kind is the kind of a token.
+type Kind int
+
+// The kinds of tokens.
+const (
+	EOF     Kind = iota // the end of the source
+	Invalid             // text that is not a token, such as an unfinished string
+	Comment             // a comment, including its -- and brackets
+	Name                // a name that is not a keyword
+	Keyword             // a reserved word, such as "local"
+	Number              // a numeral
+	String              // a string literal, including its quotes or brackets
+	Symbol              // an operator or punctuation, such as "..." or "("
+)
+
+var kindNames = [...]string{"EOF", "Invalid", "Comment", "Name", "Keyword", "Number", "String", "Symbol"}
+
+func (k Kind) String() string {
+	if k >= 0 && int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// A Token is a piece of the source. Text is the token as it is written;
+// Pos is its first byte and End the position just after its last byte.
+type Token struct {
+	Kind     Kind
+	Text     string
+	Pos, End Pos
+	Err      string // for Invalid tokens, what is wrong
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+// IsKeyword reports whether name is a reserved word of Lua.
+func IsKeyword(name string) bool { return keywords[name] }
+
+// symbols are the operators and punctuation of Lua, longest first.
+var symbols = []string{
+	"...", "..", "==", "~=", "<=", ">=", "//", "::", "<<", ">>",
+	"+", "-", "*", "/", "%", "^", "#", "&", "~", "|", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// A Scanner splits Lua source into tokens. It accepts any input: text that
+// is not a valid token comes back as an Invalid token, so that a
+// highlighter can show the rest of the source.
+type Scanner struct {
+	src []byte
+	pos Pos
+}
+
+// NewScanner returns a scanner for src. A first line starting with '#', as
+// in scripts that start with #!, is returned as a comment, as Lua skips it.
+func NewScanner(src []byte) *Scanner {
+	return &Scanner{src: src, pos: Pos{Line: 1, Column: 1}}
+}
+
+// Next returns the next token. At the end of the source, it returns a
+// token of kind EOF, again and again.
+func (s *Scanner) Next() Token {
+	if s.pos.Offset == 0 && len(s.src) > 0 && s.src[0] == '#' {
+		return s.token(Comment, s.lineEnd(0), "")
+	}
+	s.skipSpace()
+	i := s.pos.Offset
+	if i >= len(s.src) {
+		return Token{Kind: EOF, Pos: s.pos, End: s.pos}
+	}
+	src, c := s.src, s.src[i]
+	switch {
+	case c == '-' && i+1 < len(src) && src[i+1] == '-':
+		if end, ok := s.longBracket(i + 2); ok {
+			return s.token(Comment, end, "")
+		} else if end > 0 {
+			return s.token(Invalid, len(src), "unfinished long comment")
+		}
+		return s.token(Comment, s.lineEnd(i), "")
+	case c == '[' && i+1 < len(src) && (src[i+1] == '[' || src[i+1] == '='):
+		if end, ok := s.longBracket(i); ok {
+			return s.token(String, end, "")
+		} else if end > 0 {
+			return s.token(Invalid, len(src), "unfinished long string")
+		}
+		return s.token(Symbol, i+1, "")
+	case c == '"' || c == '\'':
+		return s.shortString(i, c)
+	case isDigit(c) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+		return s.number(i)
+	case isNameStart(c):
+		j := i
+		for j < len(src) && (isNameStart(src[j]) || isDigit(src[j])) {
+			j++
+		}
+		if keywords[string(src[i:j])] {
+			return s.token(Keyword, j, "")
+		}
+		return s.token(Name, j, "")
+	}
+	for _, sym := range symbols {
+		if strings.HasPrefix(string(src[i:min(i+3, len(src))]), sym) {
+			return s.token(Symbol, i+len(sym), "")
+		}
+	}
+	_, size := utf8.DecodeRune(src[i:])
+	return s.token(Invalid, i+size, fmt.Sprintf("unexpected symbol %q", src[i:i+size]))
+}
+
+// token returns the token from the current position to end and moves past it.
+func (s *Scanner) token(kind Kind, end int, err string) Token {
+	t := Token{Kind: kind, Text: string(s.src[s.pos.Offset:end]), Pos: s.pos, Err: err}
+	s.advance(end)
+	t.End = s.pos
+	return t
+}
+
+// advance moves the position to the offset end, counting lines. \r\n and
+// \n\r count as one line break, like in Lua.
+func (s *Scanner) advance(end int) {
+	p := s.pos
+	for i := p.Offset; i < end; i++ {
+		c := s.src[i]
+		if c != '\n' && c != '\r' {
+			p.Column++
+			continue
+		}
+		if i+1 < end && (s.src[i+1] == '\n' || s.src[i+1] == '\r') && s.src[i+1] != c {
+			i++
+		}
+		p.Line, p.Column = p.Line+1, 1
+	}
+	p.Offset = end
+	s.pos = p
+}
+
+func (s *Scanner) skipSpace() {
+	i := s.pos.Offset
+	for i < len(s.src) && strings.IndexByte(" \t\r\n\f\v", s.src[i]) >= 0 {
+		i++
+	}
+	s.advance(i)
+}
+
+// lineEnd returns the offset of the end of the line that contains i.
+func (s *Scanner) lineEnd(i int) int {
+	for i < len(s.src) && s.src[i] != '\n' && s.src[i] != '\r' {
+		i++
+	}
+	return i
+}
+
+// longBracket returns the end of the long bracket that starts at i, such as
+// [==[ ... ]==]. If there is no opening long bracket at i, it returns 0 and
+// false; if the bracket is not closed, a positive offset and false.
+func (s *Scanner) longBracket(i int) (int, bool) {
+	src := s.src
+	if i >= len(src) || src[i] != '[' {
+		return 0, false
+	}
+	j := i + 1
+	for j < len(src) && src[j] == '=' {
+		j++
+	}
+	if j >= len(src) || src[j] != '[' {
+		return 0, false
+	}
+	closing := "]" + strings.Repeat("=", j-i-1) + "]"
+	end := strings.Index(string(src[j+1:]), closing)
+	if end < 0 {
+		return len(src), false
+	}
+	return j + 1 + end + len(closing), true
+}
+
+func (s *Scanner) shortString(i int, quote byte) Token {
+	src := s.src
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case quote:
+			return s.token(String, j+1, "")
+		case '\n', '\r':
+			return s.token(Invalid, j, "unfinished string")
+		case '\\':
+			if j+1 < len(src) && src[j+1] == 'z' {
+				for j += 2; j < len(src) && strings.IndexByte(" \t\r\n\f\v", src[j]) >= 0; j++ {
+				}
+				j--
+			} else if j+2 < len(src) && (src[j+1] == '\r' && src[j+2] == '\n' || src[j+1] == '\n' && src[j+2] == '\r') {
+				j += 2
+			} else {
+				j++
+			}
+		}
+	}
+	return s.token(Invalid, len(src), "unfinished string")
+}
+
+func (s *Scanner) number(i int) Token {
+	src, j, exponents := s.src, i, "eE"
+	if i+1 < len(src) && src[i] == '0' && (src[i+1] == 'x' || src[i+1] == 'X') {
+		j, exponents = i+2, "pP"
+	}
+	for ; j < len(src); j++ {
+		if strings.IndexByte(exponents, src[j]) >= 0 && j+1 < len(src) && (src[j+1] == '+' || src[j+1] == '-') {
+			j++
+		} else if !isNameStart(src[j]) && !isDigit(src[j]) && src[j] != '.' {
+			break
+		}
+	}
+	t := s.token(Number, j, "")
+	if _, err := parseNumber(t.Text); err != nil {
+		t.Kind, t.Err = Invalid, "malformed number"
+	}
+	return t
+}
+
+func isNameStart(c byte) bool { return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool     { return c >= '0' && c <= '9' }
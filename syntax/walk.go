@@ -0,0 +1,117 @@
+package syntax
+
+// Inspect traverses the tree in depth-first order, like go/ast.Inspect: it
+// calls f(node) and, if f returns true, inspects each child of node, then
+// calls f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	stmts := func(list []Stmt) {
+		for _, s := range list {
+			Inspect(s, f)
+		}
+	}
+	exprs := func(list []Expr) {
+		for _, e := range list {
+			Inspect(e, f)
+		}
+	}
+	idents := func(list []*Ident) {
+		for _, id := range list {
+			Inspect(id, f)
+		}
+	}
+	switch n := node.(type) {
+	case *Block:
+		stmts(n.Stmts)
+	case *LocalStmt:
+		idents(n.Names)
+		exprs(n.Values)
+	case *AssignStmt:
+		exprs(n.Targets)
+		exprs(n.Values)
+	case *CallStmt:
+		Inspect(n.Call, f)
+	case *DoStmt:
+		Inspect(n.Body, f)
+	case *WhileStmt:
+		Inspect(n.Cond, f)
+		Inspect(n.Body, f)
+	case *RepeatStmt:
+		Inspect(n.Body, f)
+		Inspect(n.Cond, f)
+	case *IfStmt:
+		for _, c := range n.Clauses {
+			Inspect(c, f)
+		}
+		if n.Else != nil {
+			Inspect(n.Else, f)
+		}
+	case *IfClause:
+		Inspect(n.Cond, f)
+		Inspect(n.Body, f)
+	case *NumericForStmt:
+		Inspect(n.Var, f)
+		exprs([]Expr{n.Start, n.Limit})
+		if n.Step != nil {
+			Inspect(n.Step, f)
+		}
+		Inspect(n.Body, f)
+	case *GenericForStmt:
+		idents(n.Names)
+		exprs(n.Exprs)
+		Inspect(n.Body, f)
+	case *FunctionStmt:
+		idents(n.Path)
+		if n.Method != nil {
+			Inspect(n.Method, f)
+		}
+		Inspect(n.Func, f)
+	case *LocalFunctionStmt:
+		Inspect(n.Name, f)
+		Inspect(n.Func, f)
+	case *ReturnStmt:
+		exprs(n.Values)
+	case *GotoStmt:
+		Inspect(n.Label, f)
+	case *LabelStmt:
+		Inspect(n.Name, f)
+	case *FunctionExpr:
+		idents(n.Params)
+		Inspect(n.Body, f)
+	case *TableExpr:
+		for _, field := range n.Fields {
+			Inspect(field, f)
+		}
+	case *Field:
+		if n.Key != nil {
+			Inspect(n.Key, f)
+		}
+		if n.Name != nil {
+			Inspect(n.Name, f)
+		}
+		Inspect(n.Value, f)
+	case *BinaryExpr:
+		Inspect(n.Left, f)
+		Inspect(n.Right, f)
+	case *UnaryExpr:
+		Inspect(n.X, f)
+	case *ParenExpr:
+		Inspect(n.X, f)
+	case *IndexExpr:
+		Inspect(n.Object, f)
+		Inspect(n.Key, f)
+	case *FieldExpr:
+		Inspect(n.Object, f)
+		Inspect(n.Field, f)
+	case *CallExpr:
+		Inspect(n.Func, f)
+		exprs(n.Args)
+	case *MethodCallExpr:
+		Inspect(n.Object, f)
+		Inspect(n.Method, f)
+		exprs(n.Args)
+	}
+	f(nil)
+}
@@ -3,6 +3,7 @@ package lua
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -10,6 +11,7 @@ type sortHelper struct {
 	l           *State
 	n           int
 	hasFunction bool
+	t           *table // the table, if it can be accessed raw; see rawTable
 }
 
 func (h sortHelper) Len() int { return h.n }
@@ -18,6 +20,12 @@ func (h sortHelper) Swap(i, j int) {
 	// Convert Go to Lua indices
 	i++
 	j++
+	if t := h.t; t != nil {
+		vi, vj := t.atInt(i), t.atInt(j)
+		t.putAtInt(i, vj)
+		t.putAtInt(j, vi)
+		return
+	}
 	// Get t[i] and t[j] via __index
 	h.l.PushInteger(i)
 	h.l.Table(1) // t[i]
@@ -37,6 +45,18 @@ func (h sortHelper) Less(i, j int) bool {
 	// Convert Go to Lua indices
 	i++
 	j++
+	if t := h.t; t != nil {
+		if !h.hasFunction {
+			return h.l.lessThan(t.atInt(i), t.atInt(j))
+		}
+		h.l.PushValue(2)
+		h.l.apiPush(t.atInt(i))
+		h.l.apiPush(t.atInt(j))
+		h.l.Call(2, 1)
+		b := h.l.ToBoolean(-1)
+		h.l.Pop(1)
+		return b
+	}
 	if h.hasFunction {
 		h.l.PushValue(2)
 		// Get t[i] and t[j] via __index
@@ -59,6 +79,58 @@ func (h sortHelper) Less(i, j int) bool {
 	return b
 }
 
+// rawTable returns the table at index if its elements can be read and
+// written directly, because it has neither an __index nor a __newindex
+// metamethod and is not frozen, and nil otherwise.
+func rawTable(l *State, index int) *table {
+	t := l.indexToValue(index).(*table)
+	if t.frozen {
+		return nil
+	} else if mt := t.metaTable; mt != nil && (l.fastTagMethod(mt, tmIndex) != nil || l.fastTagMethod(mt, tmNewIndex) != nil) {
+		return nil
+	}
+	return t
+}
+
+// moveRaw is table.move for raw tables: it copies the n elements of src at f
+// to dst at t. Ranges in the array parts are copied at once.
+func moveRaw(src *table, f, n int, dst *table, t int) {
+	if f > 0 && t > 0 && f-1 <= len(src.array)-n && t-1 <= len(dst.array)-n {
+		copy(dst.array[t-1:t-1+n], src.array[f-1:f-1+n])
+		return
+	}
+	if src != dst || t > f+n-1 || t <= f {
+		for i := 0; i < n; i++ {
+			dst.putAtInt(t+i, src.atInt(f+i))
+		}
+	} else {
+		for i := n - 1; i >= 0; i-- {
+			dst.putAtInt(t+i, src.atInt(f+i))
+		}
+	}
+}
+
+// concatSize estimates the length of the result of table.concat for a table
+// read without metamethods, so the result is allocated only once.
+func concatSize(t *table, i, last, sepLen int) int {
+	n := 0
+	for ; i <= last && n < maxStringSize; i++ {
+		switch v := t.atInt(i).(type) {
+		case string:
+			n += len(v)
+		case int64, float64:
+			n += 12
+		default:
+			return n // concat fails
+		}
+		if i == last {
+			break
+		}
+		n += sepLen
+	}
+	return n
+}
+
 var tableLibrary = []RegistryFunction{
 	{"concat", func(l *State) int {
 		CheckType(l, 1, TypeTable)
@@ -70,26 +142,48 @@ var tableLibrary = []RegistryFunction{
 		} else {
 			last = CheckInteger(l, 4)
 		}
+		t := l.indexToValue(1).(*table)
+		raw := t.metaTable == nil || l.fastTagMethod(t.metaTable, tmIndex) == nil
 		var b strings.Builder
-		addField := func() {
-			// Get t[i] via __index
-			l.PushInteger(i)
-			l.Table(1)
-			if str, ok := l.ToString(-1); ok {
-				b.WriteString(str)
+		if raw {
+			b.Grow(concatSize(t, i, last, len(sep)))
+		}
+		var num [20]byte
+		var parts []string // the strings, for their tags
+		tagged := l.global.tags != nil
+		for ; i <= last; i++ {
+			var v value
+			if raw { // without __index the elements can be read directly
+				v = t.atInt(i)
 			} else {
+				l.PushInteger(i)
+				l.Table(1)
+				v = l.indexToValue(-1)
+				l.Pop(1)
+			}
+			switch v := v.(type) {
+			case string:
+				b.WriteString(v)
+				if tagged {
+					parts = append(parts, v)
+				}
+			case int64:
+				b.Write(strconv.AppendInt(num[:0], v, 10))
+			case float64:
+				b.WriteString(numberToString(v))
+			default:
+				l.apiPush(v)
 				Errorf(l, fmt.Sprintf("invalid value (%s) at index %d in table for 'concat'", TypeNameOf(l, -1), i))
 			}
-			l.Pop(1)
-		}
-		for ; i < last; i++ {
-			addField()
+			if i == last {
+				break // i+1 might overflow
+			}
 			b.WriteString(sep)
 		}
-		if i == last {
-			addField()
-		}
 		l.PushString(b.String())
+		if tagged {
+			l.deriveTags(b.String(), append(parts, sep)...)
+		}
 		return 1
 	}},
 	{"insert", func(l *State) int {
@@ -97,6 +191,10 @@ var tableLibrary = []RegistryFunction{
 		e := LengthEx(l, 1) + 1 // First empty element.
 		switch l.Top() {
 		case 2:
+			if t := rawTable(l, 1); t != nil {
+				t.putAtInt(e, l.indexToValue(2))
+				return 0
+			}
 			// Insert new element at the end (value is at top)
 			l.PushInteger(e)
 			l.Insert(-2) // key before value
@@ -104,6 +202,14 @@ var tableLibrary = []RegistryFunction{
 		case 3:
 			pos := CheckInteger(l, 2)
 			ArgumentCheck(l, 1 <= pos && pos <= e, 2, "position out of bounds")
+			if t := rawTable(l, 1); t != nil {
+				if pos < e {
+					t.putAtInt(e, t.atInt(e-1))
+					moveRaw(t, pos, e-1-pos, t, pos+1)
+				}
+				t.putAtInt(pos, l.indexToValue(3))
+				return 0
+			}
 			for i := e; i > pos; i-- {
 				// t[i] = t[i-1]
 				l.PushInteger(i - 1)
@@ -153,6 +259,12 @@ var tableLibrary = []RegistryFunction{
 			Errorf(l, "too many results to unpack")
 			panic("unreachable")
 		}
+		if t := rawTable(l, 1); t != nil {
+			for j := 0; j < n; j++ {
+				l.apiPush(t.atInt(i + j))
+			}
+			return n
+		}
 		// Get all elements via __index
 		// Use countdown to avoid integer overflow when i == maxInt
 		for j := 0; j < n; j++ {
@@ -168,6 +280,15 @@ var tableLibrary = []RegistryFunction{
 		if pos != size {
 			ArgumentCheck(l, 1 <= pos && pos <= size+1, 2, "position out of bounds")
 		}
+		if t := rawTable(l, 1); t != nil {
+			l.apiPush(t.atInt(pos))
+			if pos < size {
+				moveRaw(t, pos+1, size-pos, t, pos)
+				pos = size
+			}
+			t.putAtInt(pos, nil)
+			return 1
+		}
 		// Get element to return: push key, get value via __index
 		l.PushInteger(pos)
 		l.Table(1) // get t[pos], push to stack (this is our return value)
@@ -198,7 +319,7 @@ var tableLibrary = []RegistryFunction{
 		// Ensure stack space for sort operations. Swap/Less use up to 5 slots
 		// directly, plus metamethods (__index/__newindex) may use more.
 		l.CheckStack(40)
-		h := sortHelper{l, n, hasFunction}
+		h := sortHelper{l, n, hasFunction, rawTable(l, 1)}
 		sort.Sort(h)
 		// Check result is sorted.
 		if n > 0 && h.Less(n-1, 0) {
@@ -225,6 +346,11 @@ var tableLibrary = []RegistryFunction{
 			ArgumentCheck(l, f > 0 || e < maxInt+f, 3, "too many elements to move")
 			n := e - f + 1 // number of elements to move
 			ArgumentCheck(l, t <= maxInt-n+1, 4, "destination wrap around")
+			if src, dst := rawTable(l, 1), rawTable(l, tt); src != nil && dst != nil {
+				moveRaw(src, f, n, dst, t)
+				l.PushValue(tt)
+				return 1
+			}
 			// Check if tables are the same (not just stack index, but actual identity)
 			sameTable := l.RawEqual(1, tt)
 			// Helper to get value respecting __index
@@ -255,6 +381,33 @@ var tableLibrary = []RegistryFunction{
 		l.PushValue(tt)
 		return 1
 	}},
+	// Extensions, not in the reference manual.
+	{"isarray", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		l.PushBoolean(l.indexToValue(1).(*table).isSequence())
+		return 1
+	}},
+	{"count", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		l.PushInteger(l.indexToValue(1).(*table).count())
+		return 1
+	}},
+	{"freeze", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		l.indexToValue(1).(*table).frozen = true
+		l.SetTop(1)
+		return 1
+	}},
+	{"isfrozen", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		l.PushBoolean(l.indexToValue(1).(*table).frozen)
+		return 1
+	}},
+	{"compact", func(l *State) int {
+		CheckType(l, 1, TypeTable)
+		l.indexToValue(1).(*table).compact()
+		return 0
+	}},
 }
 
 // TableOpen opens the table library. Usually passed to Require.
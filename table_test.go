@@ -0,0 +1,339 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestTableConcat(t *testing.T) {
+	testString(t, `
+		assert(table.concat({1, 2.5, "x", -7, 1e100}, ",") == "1,2.5,x,-7," .. 1e100)
+		assert(table.concat({}, ",") == "")
+		assert(table.concat({"a", "b", "c"}, "", 2) == "bc")
+		assert(table.concat({"a", "b", "c"}, "-", 3, 2) == "")
+		assert(table.concat({[math.maxinteger] = "z"}, "-", math.maxinteger, math.maxinteger) == "z")
+		local t = {"a", "b"}
+		t[4] = "d"
+		local ok, err = pcall(table.concat, t, ",", 1, 4)
+		assert(not ok and err:find("invalid value %(nil%) at index 3 in table for 'concat'"), err)
+		ok, err = pcall(table.concat, {{}})
+		assert(not ok and err:find("invalid value %(table%) at index 1"), err)
+
+		local proxy = setmetatable({}, {__index = function(_, i) return "p" .. i end, __len = function() return 3 end})
+		assert(table.concat(proxy, " ") == "p1 p2 p3")
+		local withBase = setmetatable({"own"}, {__index = {"base", "inherited"}})
+		assert(table.concat(withBase, "+", 1, 2) == "own+inherited")
+		assert(table.concat(setmetatable({"x", "y"}, {}), "") == "xy")
+	`)
+}
+
+func TestTableInsertRemoveMove(t *testing.T) {
+	testString(t, `
+		local function same(t, s) return table.concat(t, ",") == s end
+
+		local t = {}
+		for i = 1, 5 do table.insert(t, i) end
+		table.insert(t, 1, 0)
+		table.insert(t, 4, "x")
+		table.insert(t, #t + 1, 6)
+		assert(same(t, "0,1,2,x,3,4,5,6"))
+		assert(table.remove(t, 4) == "x" and table.remove(t, 1) == 0 and table.remove(t) == 6)
+		assert(same(t, "1,2,3,4,5") and #t == 5)
+		assert(table.remove({}) == nil and table.remove({}, 0) == nil)
+		local e = {}
+		assert(table.remove(e, 1) == nil and next(e) == nil)
+
+		-- Elements in the hash part.
+		local h = {[1] = "a", [2] = "b", [3] = "c"}
+		table.insert(h, 2, "z")
+		assert(same(h, "a,z,b,c"))
+		assert(table.remove(h, 1) == "a" and same(h, "z,b,c") and h[4] == nil)
+
+		-- Overlapping and separate moves.
+		local m = {1, 2, 3, 4, 5}
+		assert(table.move(m, 1, 3, 3) == m and same(m, "1,2,1,2,3"))
+		m = {1, 2, 3, 4, 5}
+		table.move(m, 2, 5, 1)
+		assert(same(m, "2,3,4,5,5"))
+		local d = table.move({1, 2, 3}, 1, 3, 3, {"a", "b"})
+		assert(same(d, "a,b,1,2,3"))
+		d = table.move({1, 2, 3}, 1, 3, -1, {})
+		assert(d[-1] == 1 and d[0] == 2 and d[1] == 3)
+		assert(same(table.move({1, 2}, 1, 0, 1, {9}), "9"))
+
+		-- Metamethods are still honoured.
+		local log = {}
+		local proxy = setmetatable({}, {
+			__index = function(_, k) return rawget(log, k) end,
+			__newindex = function(_, k, v) rawset(log, k, v) end,
+			__len = function() return #log end,
+		})
+		table.insert(proxy, "a")
+		table.insert(proxy, 1, "b")
+		assert(same(log, "b,a") and rawget(proxy, 1) == nil)
+		assert(table.remove(proxy, 1) == "b" and same(log, "a"))
+		table.move({"c", "d"}, 1, 2, 2, proxy)
+		assert(same(log, "a,c,d"))
+
+		-- __newindex is called after a missing __index was looked up.
+		local count = 0
+		local n = setmetatable({}, {__newindex = function(t, k, v) count = count + 1 rawset(t, k, v) end})
+		local _ = n.x
+		n.y = 1
+		table.insert(n, "v")
+		assert(count == 2 and n.y == 1 and n[1] == "v")
+	`)
+}
+
+func TestSortedPairs(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if SetSortedPairs(l, true) {
+		t.Error("sorted pairs enabled by default")
+	}
+	if err := DoString(l, `
+		local t = {"a", "b", z = 1, y = 2, [10] = 3, [-1.5] = 4, [true] = 5, [false] = 6, x = 7}
+		local keys = {}
+		for k in pairs(t) do keys[#keys + 1] = tostring(k) end
+		local s = table.concat(keys, " ")
+		assert(s == "1 2 -1.5 10 x y z false true", s)
+		t.w, t.x, t.y = 8, nil, nil
+		keys = {}
+		for k, v in pairs(t) do
+			keys[#keys + 1] = tostring(k)
+			t[k] = nil -- clearing fields during traversal is allowed
+		end
+		s = table.concat(keys, " ")
+		assert(s == "1 2 -1.5 10 w z false true", s)
+		assert(next(t) == nil)
+	`); err != nil {
+		t.Error(err)
+	}
+	if !SetSortedPairs(l, false) {
+		t.Error("SetSortedPairs did not return the previous setting")
+	}
+}
+
+func TestTableHashPart(t *testing.T) {
+	testString(t, `
+		local t = {}
+		for i = 1, 1000 do t["k" .. i] = i; t[-i] = i; t[i + 0.5] = i end
+		for i = 1, 1000, 2 do t["k" .. i] = nil; t[-i] = nil; t[i + 0.5] = nil end
+		local n = 0
+		for k, v in pairs(t) do
+			n = n + 1
+			assert(v % 2 == 0)
+			t[k] = nil -- clearing fields during traversal is allowed
+		end
+		assert(n == 1500 and next(t) == nil)
+		for i = 1, 100 do t[i * 1.0] = i end -- integral floats are integer keys
+		assert(t[50] == 50 and math.type(next(t)) == "integer")
+		t[-1] = "minus"
+		assert(next(t, -1.0) ~= -1)
+		assert(not pcall(next, t, "missing"))
+
+		-- reused keys are found again after many removals
+		local u = {}
+		for round = 1, 50 do
+			for i = 1, 100 do u["x" .. i] = round end
+			for i = 1, 100 do u["x" .. i] = nil end
+		end
+		u.x1 = 1
+		assert(next(u) == "x1" and next(u, "x1") == nil)
+	`)
+}
+
+func TestTableHashLightUserData(t *testing.T) {
+	type point struct{ x, y int }
+	l := NewState()
+	tbl := newTable()
+	for i := 0; i < 100; i++ {
+		tbl.put(l, point{i, -i}, int64(i))
+		tbl.put(l, &point{i, i}, int64(i))
+	}
+	for i := 0; i < 100; i++ {
+		if v := tbl.at(point{i, -i}); v != int64(i) {
+			t.Errorf("value of point{%d, %d} is %v", i, -i, v)
+		}
+	}
+	if tbl.at(&point{1, 1}) != nil {
+		t.Error("pointer keys compare by address")
+	}
+	if tbl.hash.count != 200 {
+		t.Errorf("hash part has %d entries, want 200", tbl.hash.count)
+	}
+}
+
+func TestTableHashLightUserDataInterfaces(t *testing.T) {
+	type tagged struct {
+		name  interface{}
+		parts [2]interface{}
+	}
+	l := NewState()
+	tbl := newTable()
+	key := func(i int) tagged {
+		return tagged{strings.Repeat("k", i), [2]interface{}{float64(i), -0.0}}
+	}
+	for i := 0; i < 50; i++ {
+		tbl.put(l, key(i), int64(i))
+		tbl.put(l, [2]interface{}{i, "x"}, int64(i))
+	}
+	for i := 0; i < 50; i++ {
+		k := key(i)
+		k.parts[1] = 0.0 // equal to -0
+		if v := tbl.at(k); v != int64(i) {
+			t.Errorf("value of %v is %v", k, v)
+		}
+		if v := tbl.at([2]interface{}{i, "x"}); v != int64(i) {
+			t.Errorf("value of [%d x] is %v", i, v)
+		}
+	}
+
+	for _, k := range []interface{}{[]int{1}, tagged{name: []int{1}}, [1]interface{}{map[int]int{}}} {
+		l.NewTable()
+		l.PushLightUserData(k)
+		l.PushBoolean(true)
+		l.PushGoFunction(func(l *State) int { l.RawSet(1); return 0 })
+		l.Insert(1)
+		if err := l.ProtectedCall(3, 0, 0); err == nil || !strings.Contains(err.Error(), "table index is not hashable") {
+			t.Errorf("%#v as key: got %v", k, err)
+		}
+		l.SetTop(0)
+	}
+}
+
+func TestTableRehashShrinks(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		t = {}
+		for i = 1, 10000 do t[i] = i; t["k" .. i] = i end
+		for i = 1, 10000 do t[i] = nil; t["k" .. i] = nil end
+		-- removed entries are dropped when the hash part fills up again
+		for i = 1, 3000 do t["n" .. i] = i end
+		for i = 1, 10 do t[i * 1000] = i end
+		assert(t.n5 == 5 and t[5000] == 5 and #t == 0)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("t")
+	tbl := l.ToValue(-1).(*table)
+	if len(tbl.array) != 0 || len(tbl.hash.nodes) > 8192 {
+		t.Errorf("table was not shrunk, array size %d, hash size %d", len(tbl.array), len(tbl.hash.nodes))
+	}
+}
+
+func TestCompactTable(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		t = {}
+		for i = 1, 1000 do t[i] = i; t["k" .. i] = i end
+		for i = 11, 1000 do t[i] = nil end
+		for i = 1, 999 do t["k" .. i] = nil end
+		for i = 2000, 1001, -1 do t[i] = i end -- added in reverse, so they go to the hash part
+		for i = 1001, 2000 do t[i] = nil end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("t")
+	tbl := l.ToValue(-1).(*table)
+	CompactTable(l, -1)
+	if len(tbl.array) != 16 || len(tbl.hash.nodes) != 4 {
+		t.Errorf("compacted table has array size %d, hash size %d", len(tbl.array), len(tbl.hash.nodes))
+	}
+	if err := DoString(l, `
+		local n = 0
+		for k, v in pairs(t) do n = n + 1; assert(k == v or k == "k1000" and v == 1000) end
+		assert(n == 11 and #t == 10)
+		t[11] = 11; t.x = "x"
+		assert(#t == 11 and t.x == "x")
+	`); err != nil {
+		t.Error(err)
+	}
+	l.Pop(1)
+	l.PushInteger(1)
+	defer func() {
+		if recover() == nil {
+			t.Error("CompactTable accepted a number")
+		}
+	}()
+	CompactTable(l, -1)
+}
+
+func TestTableStatistics(t *testing.T) {
+	l := NewState()
+	l.CreateTable(10, 5)
+	s := TableStatistics(l, -1)
+	if s.ArrayLength != 10 || s.ArrayUsed != 0 || s.ArrayCapacity != 10 || s.HashSize != 8 || s.HashCount != 0 {
+		t.Errorf("empty table with hints: %+v", s)
+	}
+	for i := 1; i <= 5; i++ {
+		l.PushInteger(i)
+		l.RawSetInt(-2, i)
+	}
+	l.PushString("v")
+	l.SetField(-2, "k")
+	s = TableStatistics(l, -1)
+	if s.ArrayUsed != 5 || s.HashCount != 1 || s.Memory <= 10*int(unsafe.Sizeof(value(nil)))+8*int(unsafe.Sizeof(hashNode{})) {
+		t.Errorf("filled table: %+v", s)
+	}
+	l.NewTable()
+	if s := TableStatistics(l, -1); s.ArrayLength != 0 || s.HashSize != 0 || s.Memory == 0 {
+		t.Errorf("empty table: %+v", s)
+	}
+}
+
+func TestTableIsArrayCount(t *testing.T) {
+	testString(t, `
+		assert(table.isarray({}) and table.count({}) == 0)
+		assert(table.isarray({1, 2, 3}) and table.count({1, 2, 3}) == 3)
+		assert(not table.isarray({1, nil, 3}) and table.count({1, nil, 3}) == 2)
+		assert(not table.isarray({1, 2, x = 1}) and table.count({1, 2, x = 1}) == 3)
+		assert(not table.isarray({[0] = 1}) and not table.isarray({[1.5] = 1}))
+
+		-- built backwards, the keys end up in the hash part
+		local t = {}
+		for i = 100, 1, -1 do t[i] = i end
+		assert(table.isarray(t) and table.count(t) == 100 and #t == 100)
+		t[50] = nil
+		assert(not table.isarray(t) and table.count(t) == 99)
+		local n = #t
+		assert(n == 49 or n == 100) -- any border
+		t[50] = 50; t[101] = 101
+		assert(table.isarray(t) and #t == 101)
+
+		-- trailing nils in the array part do not count
+		local a = {1, 2, 3, 4}
+		a[4] = nil; a[3] = nil
+		assert(table.isarray(a) and #a == 2)
+		a[4] = 4
+		assert(not table.isarray(a))
+
+		-- raw: metamethods are ignored
+		local p = setmetatable({}, {__index = function(_, k) return k end, __len = function() return 10 end})
+		assert(table.isarray(p) and table.count(p) == 0 and #p == 10)
+		assert(not pcall(table.count, 1))
+	`)
+}
+
+func TestTableCompactLibrary(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		cache = {}
+		for i = 1, 5000 do cache[i] = i; cache["k" .. i] = i end
+		for i = 21, 5000 do cache[i] = nil; cache["k" .. i] = nil end
+		for i = 21, 40 do cache[i] = i end
+		table.compact(cache)
+		assert(#cache == 40 and table.count(cache) == 60 and cache.k20 == 20)
+		assert(not pcall(table.compact, "x"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("cache")
+	if s := TableStatistics(l, -1); s.ArrayLength != 64 || s.ArrayCapacity != 64 || s.HashCount != 20 || s.HashSize != 32 {
+		t.Errorf("compacted table: %+v", s)
+	}
+}
@@ -0,0 +1,294 @@
+package lua
+
+import (
+	"hash/maphash"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// A hashNode is a slot of the hash part of a table. A slot with a nil key is
+// free. A slot with a key but a nil value is dead: its entry was removed, but
+// the key stays until the next rehash so that a traversal can continue from
+// it, as Lua allows clearing fields while traversing a table.
+type hashNode struct {
+	key, value value
+	hash       uint64
+}
+
+// A hashPart maps keys to values with open addressing and linear probing.
+// Keys are the internal representation of Lua values; integral float keys
+// are normalized to int64 by the table before they get here. Unlike a Go map
+// with interface{} keys, it hashes strings and numbers without going through
+// the runtime's generic interface hashing, and compares the stored hashes
+// before the keys.
+type hashPart struct {
+	nodes []hashNode // the length is 0 or a power of 2
+	count int        // number of live entries
+	used  int        // number of live and dead entries
+}
+
+var hashSeed = maphash.MakeSeed()
+
+// mixHash is the finalizer of SplitMix64. It spreads the bits of x so that
+// keys that differ in a few bits only, such as consecutive integers or
+// aligned pointers, land in different slots.
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func pointerHash(p unsafe.Pointer) uint64 { return mixHash(uint64(uintptr(p))) }
+
+func hashOf(k value) uint64 {
+	switch k := k.(type) {
+	case string:
+		return maphash.String(hashSeed, k)
+	case int64:
+		return mixHash(uint64(k))
+	case float64:
+		return mixHash(math.Float64bits(k))
+	case bool:
+		if k {
+			return mixHash(1)
+		}
+		return mixHash(2)
+	case *table:
+		return pointerHash(unsafe.Pointer(k))
+	case *luaClosure:
+		return pointerHash(unsafe.Pointer(k))
+	case *goClosure:
+		return pointerHash(unsafe.Pointer(k))
+	case *goFunction:
+		return pointerHash(unsafe.Pointer(k))
+	case *userData:
+		return pointerHash(unsafe.Pointer(k))
+	case *State:
+		return pointerHash(unsafe.Pointer(k))
+	}
+	return reflectHash(reflect.ValueOf(k))
+}
+
+// hashable reports whether k can be a table key. Light userdata that cannot
+// be compared with ==, such as a slice or a struct with a slice in an
+// interface field, cannot.
+func hashable(k value) bool {
+	switch k.(type) {
+	case string, bool, *table, *luaClosure, *goClosure, *goFunction, *userData, *State:
+		return true
+	}
+	return reflect.ValueOf(k).Comparable()
+}
+
+// reflectHash hashes light userdata, which may be any comparable Go value.
+// Values that are equal with == have equal hashes.
+func reflectHash(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.Bool:
+		if v.Bool() {
+			return mixHash(1)
+		}
+		return mixHash(2)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return mixHash(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return mixHash(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); f != 0 { // +0 and -0 are equal
+			return mixHash(math.Float64bits(f))
+		}
+		return 0
+	case reflect.String:
+		return maphash.String(hashSeed, v.String())
+	case reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return mixHash(uint64(v.Pointer()))
+	case reflect.Interface:
+		return reflectHash(v.Elem())
+	case reflect.Array:
+		h := uint64(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			h = mixHash(h ^ reflectHash(v.Index(i)))
+		}
+		return h
+	case reflect.Struct:
+		h := uint64(v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			h = mixHash(h ^ reflectHash(v.Field(i)))
+		}
+		return h
+	}
+	// Complex numbers and the like: equal values still hash alike, but
+	// all of them collide.
+	return uint64(v.Kind())
+}
+
+// find returns the slot of k, which has the hash h, or -1.
+func (p *hashPart) find(k value, h uint64) int {
+	if len(p.nodes) == 0 {
+		return -1
+	}
+	mask := uint64(len(p.nodes) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		n := &p.nodes[i]
+		if n.key == nil {
+			return -1
+		} else if n.hash == h && n.key == k {
+			return int(i)
+		}
+	}
+}
+
+func (p *hashPart) get(k value) value {
+	if p.count == 0 {
+		return nil
+	}
+	if i := p.find(k, hashOf(k)); i >= 0 {
+		return p.nodes[i].value
+	}
+	return nil
+}
+
+func (p *hashPart) getString(s string) value {
+	if p.count == 0 {
+		return nil
+	}
+	h := maphash.String(hashSeed, s)
+	mask := uint64(len(p.nodes) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		n := &p.nodes[i]
+		if n.key == nil {
+			return nil
+		} else if n.hash == h {
+			if k, ok := n.key.(string); ok && k == s {
+				return n.value
+			}
+		}
+	}
+}
+
+func (p *hashPart) getInt(k int64) value {
+	if p.count == 0 {
+		return nil
+	}
+	h := mixHash(uint64(k))
+	mask := uint64(len(p.nodes) - 1)
+	for i := h & mask; ; i = (i + 1) & mask {
+		n := &p.nodes[i]
+		if n.key == nil {
+			return nil
+		} else if n.hash == h {
+			if ki, ok := n.key.(int64); ok && ki == k {
+				return n.value
+			}
+		}
+	}
+}
+
+// replace sets the value of k to v if k has a live entry, and reports
+// whether it did.
+func (p *hashPart) replace(k, v value) bool {
+	if p.count == 0 {
+		return false
+	}
+	if i := p.find(k, hashOf(k)); i >= 0 && p.nodes[i].value != nil {
+		p.nodes[i].value = v
+		return true
+	}
+	return false
+}
+
+// set sets the value of k to v; a nil v removes the entry. It reports
+// whether k had no live entry before and has one now. If the entry is new
+// and there is no room for it, the part is rehashed before the entry is
+// added, leaving room for half as many entries again so that tables whose
+// keys come and go are not rehashed on every insertion.
+func (p *hashPart) set(k, v value) bool {
+	h := hashOf(k)
+	if i := p.find(k, h); i >= 0 {
+		n := &p.nodes[i]
+		added := n.value == nil && v != nil
+		if added {
+			p.count++
+		} else if n.value != nil && v == nil {
+			p.count--
+		}
+		n.value = v
+		return added
+	} else if v == nil {
+		return false
+	}
+	if p.full() {
+		p.resize(p.count + p.count/2 + 1)
+	}
+	p.insert(k, v, h)
+	return true
+}
+
+// full reports whether another key would exceed the maximum load factor.
+func (p *hashPart) full() bool { return (p.used+1)*4 > len(p.nodes)*3 }
+
+// insert adds k, which is not in p, to a free slot. There must be one.
+func (p *hashPart) insert(k, v value, h uint64) {
+	mask := uint64(len(p.nodes) - 1)
+	i := h & mask
+	for p.nodes[i].key != nil {
+		i = (i + 1) & mask
+	}
+	p.nodes[i] = hashNode{key: k, value: v, hash: h}
+	p.count++
+	p.used++
+}
+
+// remove removes the entry in slot i, which must be live.
+func (p *hashPart) remove(i int) {
+	p.nodes[i].value = nil
+	p.count--
+}
+
+// resize rehashes p into a size that holds n live entries, dropping the
+// dead ones.
+func (p *hashPart) resize(n int) {
+	size := 0
+	if n > 0 {
+		size = 4
+		for size*3 < n*4 {
+			size *= 2
+		}
+	}
+	old := p.nodes
+	p.nodes, p.count, p.used = nil, 0, 0
+	if size > 0 {
+		p.nodes = make([]hashNode, size)
+	}
+	for i := range old {
+		if n := &old[i]; n.value != nil {
+			p.insert(n.key, n.value, n.hash)
+		}
+	}
+}
+
+// nextLive returns the first slot at or after i that holds a live entry,
+// or -1.
+func (p *hashPart) nextLive(i int) int {
+	for ; i < len(p.nodes); i++ {
+		if p.nodes[i].value != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// each calls f for every live entry. f may remove entries, but must not add
+// any.
+func (p *hashPart) each(f func(k, v value)) {
+	for i := range p.nodes {
+		if n := &p.nodes[i]; n.value != nil {
+			f(n.key, n.value)
+		}
+	}
+}
@@ -1,21 +1,25 @@
 package lua
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"unsafe"
 )
 
 type table struct {
 	array             []value
-	hash              map[value]value
+	hash              hashPart
 	metaTable         *table
 	flags             byte
-	iterationKeys     []value
+	frozen            bool          // set by table.freeze, see FrozenTable
+	iterationKeys     []value       // sorted keys of the hash part, see nextSorted
 	iterationKeyIndex map[value]int // key -> index in iterationKeys for O(1) lookup
 }
 
-func newTable() *table                     { return &table{hash: make(map[value]value)} }
+func newTable() *table                     { return &table{} }
 func (t *table) invalidateTagMethodCache() { t.flags = 0 }
-func (t *table) atString(k string) value   { return t.hash[k] }
+func (t *table) atString(k string) value   { return t.hash.getString(k) }
 
 func newTableWithSize(arraySize, hashSize int) *table {
 	t := new(table)
@@ -23,38 +27,73 @@ func newTableWithSize(arraySize, hashSize int) *table {
 		t.array = make([]value, arraySize)
 	}
 	if hashSize > 0 {
-		t.hash = make(map[value]value, hashSize)
-	} else {
-		t.hash = make(map[value]value)
+		t.hash.resize(hashSize)
 	}
 	return t
 }
 
+// SetTableDepthLimit sets how deeply nested tables may be for the functions
+// that walk them recursively, such as inspect and Record, and returns the
+// previous limit. Without a limit a deeply nested or cyclic table would
+// exhaust the Go stack, which crashes the program instead of raising an
+// error. Functions that render tables for humans abbreviate the tables
+// beyond the limit; the others raise an error "table nested too deep". A
+// limit of 0 or less restores the default of 1000 levels.
+func SetTableDepthLimit(l *State, depth int) int {
+	prev := l.tableDepthLimit()
+	l.global.tableDepthLimit = max(depth, 0)
+	return prev
+}
+
+// SetSortedPairs sets whether next and pairs visit the keys in the hash part
+// of tables in sorted order and returns the previous setting. By default the
+// order follows Go map iteration and varies between runs, which breaks golden
+// output tests and reproducible generated files. In sorted order numbers
+// come first, then strings and booleans; other keys, such as tables, follow
+// in an order that is stable within a run only. Keys in the array part are
+// always visited first and in order. Sorting costs O(n log n) time at the
+// start of each traversal of a table that was modified since the last one.
+func SetSortedPairs(l *State, sorted bool) bool {
+	prev := l.global.sortedPairs
+	l.global.sortedPairs = sorted
+	return prev
+}
+
+func (l *State) tableDepthLimit() int {
+	if l.global.tableDepthLimit > 0 {
+		return l.global.tableDepthLimit
+	}
+	return maxTableDepth
+}
+
+// checkTableDepth raises an error if a table at nesting level depth lies
+// beyond the limit set with SetTableDepthLimit.
+func (l *State) checkTableDepth(depth int) {
+	if depth > l.tableDepthLimit() {
+		Errorf(l, "table nested too deep (limit is %d)", l.tableDepthLimit())
+	}
+}
+
 func (l *State) fastTagMethod(table *table, event tm) value {
-	if table == nil || table.flags&1<<event != 0 {
+	if table == nil || table.flags&(1<<event) != 0 {
 		return nil
 	}
 	return table.tagMethod(event, l.global.tagMethodNames[event])
 }
 
 func (t *table) extendArray(last int) {
-	t.array = append(t.array, make([]value, last-len(t.array))...)
-	for k, v := range t.hash {
-		var i int
-		switch n := k.(type) {
-		case int64:
-			i = int(n)
-		case float64:
-			if float64(int(n)) != n {
-				continue
-			}
-			i = int(n)
-		default:
-			continue
-		}
-		if 0 < i && i <= len(t.array) {
-			t.array[i-1] = v
-			delete(t.hash, k)
+	if last > cap(t.array) { // the callers size the array part, not append
+		a := make([]value, last)
+		copy(a, t.array)
+		t.array = a
+	} else {
+		t.array = t.array[:last]
+	}
+	for i := range t.hash.nodes {
+		n := &t.hash.nodes[i]
+		if k, ok := n.key.(int64); ok && n.value != nil && 0 < k && k <= int64(len(t.array)) {
+			t.array[k-1] = n.value
+			t.hash.remove(i)
 		}
 	}
 }
@@ -63,11 +102,7 @@ func (t *table) atInt(k int) value {
 	if 0 < k && k <= len(t.array) {
 		return t.array[k-1]
 	}
-	// Try int64 key first (Lua 5.3 style), then float64 for backwards compat
-	if v := t.hash[int64(k)]; v != nil {
-		return v
-	}
-	return t.hash[float64(k)]
+	return t.hash.getInt(int64(k))
 }
 
 func (t *table) maybeResizeArray(key int) bool {
@@ -78,23 +113,9 @@ func (t *table) maybeResizeArray(key int) bool {
 			occupancy++
 		}
 	}
-	for k, v := range t.hash {
-		if v == nil {
-			continue
-		}
-		var i int
-		switch n := k.(type) {
-		case int64:
-			i = int(n)
-		case float64:
-			if float64(int(n)) != n {
-				continue
-			}
-			i = int(n)
-		default:
-			continue
-		}
-		if i <= key {
+	for i := range t.hash.nodes {
+		n := &t.hash.nodes[i]
+		if k, ok := n.key.(int64); ok && n.value != nil && k <= int64(key) {
 			occupancy++
 		}
 	}
@@ -106,27 +127,174 @@ func (t *table) maybeResizeArray(key int) bool {
 }
 
 func (t *table) addOrInsertHash(k, v value) {
-	if _, ok := t.hash[k]; !ok {
+	if v != nil && t.hash.full() && t.hash.get(k) == nil {
+		t.rehash(k)
+		if i, ok := k.(int64); ok && 0 < i && i <= int64(len(t.array)) {
+			t.array[i-1] = v
+			return
+		}
+	}
+	if t.hash.set(k, v) {
 		t.iterationKeys = nil // invalidate iterations when adding an entry
 		t.iterationKeyIndex = nil
 	}
-	t.hash[k] = v
 }
 
+// putAtInt sets the value of the integer key k. A key just past the end of
+// the array part may extend it; other keys that do not fit go to the hash
+// part, which decides on the size of the array part when it has to grow.
 func (t *table) putAtInt(k int, v value) {
 	if 0 < k && k <= len(t.array) {
 		t.array[k-1] = v
-	} else if k > 0 && v != nil && t.maybeResizeArray(k) {
-		t.array[k-1] = v
 	} else if v == nil {
-		// Delete both int64 and float64 keys for backwards compat
-		delete(t.hash, int64(k))
-		delete(t.hash, float64(k))
+		t.hash.set(int64(k), nil)
+	} else if k == len(t.array)+1 && t.maybeResizeArray(k) {
+		t.array[k-1] = v
 	} else {
 		t.addOrInsertHash(int64(k), v)
 	}
 }
 
+// maxArrayBits bounds the size of the array part that rehash considers.
+const maxArrayBits = 30
+
+// rehash resizes both parts of t like PUC-Lua does when the hash part is
+// full: the array part gets the largest power-of-2 size n such that more
+// than half of the slots 1..n are in use, which may shrink it, and the hash
+// part is rebuilt for the remaining entries, dropping removed ones. The key
+// k is about to be added and is counted as well; it may be nil.
+func (t *table) rehash(k value) {
+	var nums [maxArrayBits + 1]int // nums[b] counts the keys in (2^(b-1), 2^b]
+	total := 0
+	countKey := func(i int64) {
+		if 0 < i && i <= 1<<maxArrayBits {
+			nums[ceilLog2(int(i))]++
+			total++
+		}
+	}
+	for i, v := range t.array {
+		if v != nil {
+			countKey(int64(i + 1))
+		}
+	}
+	t.hash.each(func(k, _ value) {
+		if i, ok := k.(int64); ok {
+			countKey(i)
+		}
+	})
+	if i, ok := k.(int64); ok {
+		countKey(i)
+	}
+	size, inUse := 0, 0
+	for b, twoToB := 0, 1; b <= maxArrayBits && twoToB/2 < total; b, twoToB = b+1, twoToB*2 {
+		if inUse += nums[b]; inUse > twoToB/2 {
+			size = twoToB
+		}
+	}
+	t.resizeArray(size)
+	t.hash.resize(t.hash.count + t.hash.count/2 + 1)
+}
+
+// resizeArray sets the size of the array part to n, moving entries between
+// the parts as needed. A smaller array part is copied, so that the memory
+// of the old one can be freed.
+func (t *table) resizeArray(n int) {
+	if n > len(t.array) {
+		t.extendArray(n)
+		return
+	} else if n == len(t.array) {
+		return
+	}
+	for i, v := range t.array[n:] {
+		if v != nil && t.hash.set(int64(n+i+1), v) {
+			t.iterationKeys, t.iterationKeyIndex = nil, nil
+		}
+	}
+	if n == 0 {
+		t.array = nil
+	} else {
+		a := make([]value, n)
+		copy(a, t.array)
+		t.array = a
+	}
+}
+
+// compact shrinks t to the memory its entries need, see CompactTable.
+func (t *table) compact() {
+	if t.frozen { // other goroutines may be reading it
+		return
+	}
+	t.rehash(nil)
+	t.hash.resize(t.hash.count)
+}
+
+// CompactTable shrinks the table at index to the memory its current entries
+// need. Tables release memory on their own only when they grow again, so a
+// table that grew large and then lost most of its entries keeps its memory
+// until then; compacting it frees the memory right away. It also moves
+// integer keys that form a dense sequence into the array part. Compacting a
+// table while traversing it has the same effect as adding a field: the
+// traversal may go wrong. Scripts compact tables with table.compact.
+// Frozen tables are left alone.
+func CompactTable(l *State, index int) {
+	t, ok := l.indexToValue(index).(*table)
+	if !ok {
+		panic(fmt.Sprintf("lua: CompactTable(%d): not a table", index))
+	}
+	t.compact()
+}
+
+// TableStats describes the memory layout of a table, see TableStatistics.
+type TableStats struct {
+	ArrayLength   int // number of slots of the array part
+	ArrayUsed     int // number of non-nil values in the array part
+	ArrayCapacity int // capacity of the slice backing the array part
+	HashSize      int // number of slots of the hash part
+	HashCount     int // number of entries in the hash part
+	HashUsed      int // number of slots taken, including removed entries awaiting a rehash
+	Memory        int // estimated bytes held by the table itself
+}
+
+// ArrayLoad returns the fraction of the array part that holds values.
+func (s TableStats) ArrayLoad() float64 { return loadFactor(s.ArrayUsed, s.ArrayLength) }
+
+// HashLoad returns the load factor of the hash part: the fraction of its
+// slots that are taken. The hash part grows when it exceeds 3/4.
+func (s TableStats) HashLoad() float64 { return loadFactor(s.HashUsed, s.HashSize) }
+
+func loadFactor(used, size int) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(used) / float64(size)
+}
+
+// TableStatistics returns the layout of the table at index, so that hosts
+// can see how the data structures built by scripts use memory and choose
+// size hints for CreateTable; debug.tablestats returns the same to scripts.
+// Memory counts the table and its two parts,
+// but not the contents of strings or other objects referenced from it.
+func TableStatistics(l *State, index int) TableStats {
+	t, ok := l.indexToValue(index).(*table)
+	if !ok {
+		panic(fmt.Sprintf("lua: TableStatistics(%d): not a table", index))
+	}
+	s := TableStats{
+		ArrayLength:   len(t.array),
+		ArrayCapacity: cap(t.array),
+		HashSize:      len(t.hash.nodes),
+		HashCount:     t.hash.count,
+		HashUsed:      t.hash.used,
+	}
+	for _, v := range t.array {
+		if v != nil {
+			s.ArrayUsed++
+		}
+	}
+	s.Memory = int(unsafe.Sizeof(*t)) + s.ArrayCapacity*int(unsafe.Sizeof(value(nil))) + s.HashSize*int(unsafe.Sizeof(hashNode{}))
+	return s
+}
+
 func (t *table) at(k value) value {
 	switch k := k.(type) {
 	case nil:
@@ -136,26 +304,18 @@ func (t *table) at(k value) value {
 		if 0 < i && i <= len(t.array) {
 			return t.array[i-1]
 		}
-		// Try int64 first, then float64 for backwards compat
-		if v := t.hash[k]; v != nil {
-			return v
-		}
-		return t.hash[float64(k)]
+		return t.hash.getInt(k)
 	case float64:
 		if i := int(k); float64(i) == k { // OPT: Inlined copy of atInt.
 			if 0 < i && i <= len(t.array) {
 				return t.array[i-1]
 			}
-			// Try int64 first, then float64 for backwards compat
-			if v := t.hash[int64(i)]; v != nil {
-				return v
-			}
-			return t.hash[k]
+			return t.hash.getInt(int64(i))
 		}
 	case string:
-		return t.hash[k]
+		return t.hash.getString(k)
 	}
-	return t.hash[k]
+	return t.hash.get(k)
 }
 
 func (t *table) put(l *State, k, v value) {
@@ -169,23 +329,14 @@ func (t *table) put(l *State, k, v value) {
 			t.putAtInt(i, v)
 		} else if math.IsNaN(k) {
 			l.runtimeError("table index is NaN")
-		} else if v == nil {
-			delete(t.hash, k)
-		} else {
-			t.addOrInsertHash(k, v)
-		}
-	case string:
-		if v == nil {
-			delete(t.hash, k)
 		} else {
 			t.addOrInsertHash(k, v)
 		}
 	default:
-		if v == nil {
-			delete(t.hash, k)
-		} else {
-			t.addOrInsertHash(k, v)
+		if !hashable(k) {
+			l.runtimeError("table index is not hashable")
 		}
+		t.addOrInsertHash(k, v)
 	}
 }
 
@@ -198,30 +349,18 @@ func (t *table) tryPut(l *State, k, v value) bool {
 		if 0 < i && i <= len(t.array) && t.array[i-1] != nil {
 			t.array[i-1] = v
 			return true
-		} else if t.hash[k] != nil && v != nil {
-			t.hash[k] = v
-			return true
 		}
+		return v != nil && t.hash.replace(k, v)
 	case float64:
 		if i := int(k); float64(i) == k && 0 < i && i <= len(t.array) && t.array[i-1] != nil {
 			t.array[i-1] = v
 			return true
-		} else if math.IsNaN(k) {
+		} else if float64(i) == k || math.IsNaN(k) {
 			return false
-		} else if t.hash[k] != nil && v != nil {
-			t.hash[k] = v
-			return true
-		}
-	case string:
-		if t.hash[k] != nil && v != nil {
-			t.hash[k] = v
-			return true
 		}
+		return v != nil && t.hash.replace(k, v)
 	default:
-		if t.hash[k] != nil && v != nil {
-			t.hash[k] = v
-			return true
-		}
+		return v != nil && t.hash.replace(k, v)
 	}
 	return false
 }
@@ -247,6 +386,11 @@ func (t *table) unboundSearch(j int) int {
 	return i
 }
 
+// length returns a border of t, like the # operator in PUC-Lua: an n >= 0
+// such that t[n] is not nil (or n is 0) and t[n+1] is nil. A sequence has
+// exactly one border, its length. A table with holes has several, and which
+// one is found depends on how the table is split into its array and hash
+// parts, that is, on how it was built; see table.isarray.
 func (t *table) length() int {
 	j := len(t.array)
 	if j > 0 && t.array[j-1] == nil {
@@ -260,12 +404,42 @@ func (t *table) length() int {
 			}
 		}
 		return i
-	} else if t.hash == nil {
+	} else if t.hash.count == 0 {
 		return j
 	}
 	return t.unboundSearch(j)
 }
 
+// count returns the number of entries of t.
+func (t *table) count() int {
+	n := t.hash.count
+	for _, v := range t.array {
+		if v != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// isSequence reports whether the keys of t are exactly 1..n for some n >= 0,
+// so that t has a single border n. As keys are distinct, this holds if all
+// n entries of t have keys in 1..n.
+func (t *table) isSequence() bool {
+	n := t.count()
+	for i := n; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return false
+		}
+	}
+	sequence := true
+	t.hash.each(func(k, _ value) {
+		if i, ok := k.(int64); !ok || i < 1 || i > int64(n) {
+			sequence = false
+		}
+	})
+	return sequence
+}
+
 func arrayIndex(k value) int {
 	switch n := k.(type) {
 	case int64:
@@ -280,16 +454,13 @@ func arrayIndex(k value) int {
 
 func (l *State) next(t *table, key int) bool {
 	i, k := 0, l.stack[key]
-	keyInHash := false
 	if k == nil { // first iteration
 	} else if i = arrayIndex(k); 0 < i && i <= len(t.array) {
 		k = nil
-	} else if _, ok := t.hash[k]; ok {
-		keyInHash = true
-		i = len(t.array)
 	} else {
-		// Key not in hash - might have been deleted during iteration
-		// We'll check iterationKeys below; if not found there, error
+		if f, ok := k.(float64); ok && float64(int64(f)) == f {
+			k = int64(f) // integral float keys are stored as integers
+		}
 		i = len(t.array)
 	}
 	for ; i < len(t.array); i++ {
@@ -299,47 +470,56 @@ func (l *State) next(t *table, key int) bool {
 			return true
 		}
 	}
+	if l.global.sortedPairs {
+		return l.nextSorted(t, k, key)
+	}
+	// Removed entries keep their slot until the next rehash, so a traversal
+	// can continue from a key whose field was cleared.
+	j := 0
+	if k != nil {
+		if j = t.hash.find(k, hashOf(k)) + 1; j == 0 {
+			l.runtimeError("invalid key to 'next'")
+		}
+	}
+	if j = t.hash.nextLive(j); j >= 0 {
+		n := &t.hash.nodes[j]
+		l.stack[key], l.stack[key+1] = n.key, n.value
+		return true
+	}
+	return false // no more elements
+}
+
+// nextSorted continues a traversal of the hash part of t in sorted order,
+// see SetSortedPairs. The keys are sorted once and kept until a key is added
+// to t.
+func (l *State) nextSorted(t *table, k value, key int) bool {
 	if t.iterationKeys == nil {
-		keys := make([]value, len(t.hash))
-		idx := make(map[value]int, len(t.hash))
-		j := 0
-		for hk := range t.hash {
-			keys[j] = hk
+		keys := make([]value, 0, t.hash.count)
+		t.hash.each(func(k, _ value) { keys = append(keys, k) })
+		sort.Slice(keys, func(i, j int) bool { return keyLess(keys[i], keys[j]) })
+		idx := make(map[value]int, len(keys))
+		for j, hk := range keys {
 			idx[hk] = j
-			j++
 		}
-		t.iterationKeys = keys
-		t.iterationKeyIndex = idx
+		t.iterationKeys, t.iterationKeyIndex = keys, idx
 	}
-	// Determine starting position in iterationKeys
 	startPos := 0
 	if k != nil {
-		// Look up current key's position via O(1) index map
-		if pos, ok := t.iterationKeyIndex[k]; ok {
-			startPos = pos + 1
-		} else {
-			// Key not found in index — invalid key
-			if !keyInHash {
+		pos, ok := t.iterationKeyIndex[k]
+		if !ok {
+			if t.hash.get(k) == nil {
 				l.runtimeError("invalid key to 'next'")
 			}
 			return false
 		}
+		startPos = pos + 1
 	}
-	// Find next valid entry starting from startPos
 	for j := startPos; j < len(t.iterationKeys); j++ {
-		hk := t.iterationKeys[j]
-		if hk == nil {
-			continue
-		}
-		// Check if key was deleted from hash
-		if _, present := t.hash[hk]; !present {
-			t.iterationKeys[j] = nil
-			delete(t.iterationKeyIndex, hk)
-			continue
+		if v := t.hash.get(t.iterationKeys[j]); v != nil {
+			l.stack[key] = t.iterationKeys[j]
+			l.stack[key+1] = v
+			return true
 		}
-		l.stack[key] = hk
-		l.stack[key+1] = t.hash[hk]
-		return true
 	}
 	return false // no more elements
 }
@@ -86,16 +86,19 @@ func (events *table) tagMethod(event tm, name string) value {
 	return tm
 }
 
-func (l *State) tagMethodByObject(o value, event tm) value {
-	var mt *table
+// metaTableOf returns the metatable of o, or nil.
+func (l *State) metaTableOf(o value) *table {
 	switch o := o.(type) {
 	case *table:
-		mt = o.metaTable
+		return o.metaTable
 	case *userData:
-		mt = o.metaTable
-	default:
-		mt = l.global.metaTable(o)
+		return o.metaTable
 	}
+	return l.global.metaTable(o)
+}
+
+func (l *State) tagMethodByObject(o value, event tm) value {
+	mt := l.metaTableOf(o)
 	if mt == nil {
 		return nil
 	}
@@ -0,0 +1,159 @@
+package lua
+
+import "sort"
+
+// A stringTags holds the tags of the strings of a state.
+type stringTags struct {
+	tags  map[string][]string // string -> sorted tags
+	check TagCheck
+}
+
+// A TagCheck is called by the functions of the standard libraries that pass
+// a string on to the system, before they pass a tagged string s. sink names
+// the function, e.g. "os.execute", and tags are the tags of s. If it returns
+// an error, the function raises it as a Lua error instead of using s.
+//
+// The sinks are os.execute, io.popen and os.spawn for the command, io.open
+// for the file name and load for the chunk.
+type TagCheck func(sink, s string, tags []string) error
+
+func (l *State) stringTags() *stringTags {
+	if l.global.tags == nil {
+		l.global.tags = &stringTags{tags: make(map[string][]string)}
+	}
+	return l.global.tags
+}
+
+// TagString adds tags to the string at index. It is an experimental aid to
+// taint analysis: a host tags the strings that come from an untrusted
+// source, such as "user-input", and checks with StringTags before it passes
+// a string to a sensitive sink, or has the standard libraries check with
+// SetTagCheck.
+//
+// Lua strings are values without identity, so tags belong to the contents
+// of a string: once a string is tagged, every equal string has the tags,
+// however it was made. This errs on the side of reporting a taint. The
+// strings derived from tagged strings get their tags as well:
+//
+//   - concatenation with .., Concat and table.concat
+//   - string.format, gsub, rep, sub, upper, lower and reverse
+//   - the captures of find, match, gmatch and gsub
+//
+// Other functions do not pass the tags of their arguments on, so a Go
+// function that escapes or validates a string returns an untagged string.
+//
+// The state keeps the tags in a map from the contents of the strings, so
+// every tagged string, including the derived ones, stays in memory as long
+// as the state, even when Lua no longer refers to it. UntagString and
+// ClearStringTags release them; a host that tags the input of many requests
+// should call one of them when it is done with a request. The empty string
+// cannot be tagged. TagString panics if the value is not
+// a string.
+func TagString(l *State, index int, tags ...string) {
+	s, ok := l.indexToValue(index).(string)
+	if !ok {
+		panic("lua: TagString: string expected")
+	}
+	if s != "" && len(tags) > 0 {
+		l.stringTags().add(s, tags)
+	}
+}
+
+// StringTags returns the tags of the string at index, in sorted order, or
+// nil if the value is not a string or has no tags. See TagString.
+func StringTags(l *State, index int) []string {
+	s, ok := l.indexToValue(index).(string)
+	if !ok || l.global.tags == nil {
+		return nil
+	}
+	return append([]string(nil), l.global.tags.tags[s]...)
+}
+
+// UntagString removes the tags of the string at index, and so of all equal
+// strings. The strings derived from it keep their tags. UntagString panics
+// if the value is not a string.
+func UntagString(l *State, index int) {
+	s, ok := l.indexToValue(index).(string)
+	if !ok {
+		panic("lua: UntagString: string expected")
+	}
+	if t := l.global.tags; t != nil {
+		delete(t.tags, s)
+	}
+}
+
+// ClearStringTags removes the tags of all strings.
+func ClearStringTags(l *State) {
+	if t := l.global.tags; t != nil {
+		t.tags = make(map[string][]string)
+	}
+}
+
+// SetTagCheck sets the function that checks the tagged strings passed to
+// the sinks of the standard libraries, and returns the previous one. A nil
+// f checks nothing.
+func SetTagCheck(l *State, f TagCheck) TagCheck {
+	t := l.stringTags()
+	old := t.check
+	t.check = f
+	return old
+}
+
+// add adds tags to s, keeping them sorted and unique.
+func (t *stringTags) add(s string, tags []string) {
+	old := t.tags[s]
+	merged := old
+	for _, tag := range tags {
+		i := sort.SearchStrings(merged, tag)
+		if i < len(merged) && merged[i] == tag {
+			continue
+		}
+		if len(merged) == len(old) { // copy before the first change, others may share old
+			merged = append([]string(nil), old...)
+		}
+		merged = append(merged, "")
+		copy(merged[i+1:], merged[i:])
+		merged[i] = tag
+	}
+	t.tags[s] = merged
+}
+
+// deriveTags gives s the tags of the strings it was made from.
+func (l *State) deriveTags(s string, from ...string) {
+	if t := l.global.tags; t != nil && s != "" {
+		for _, f := range from {
+			if tags := t.tags[f]; tags != nil && f != s {
+				t.add(s, tags)
+			}
+		}
+	}
+}
+
+// deriveTagsFrom gives the string at the top of the stack the tags of the
+// strings at the indexes.
+func (l *State) deriveTagsFrom(indexes ...int) {
+	if l.global.tags == nil {
+		return
+	}
+	s, ok := l.indexToValue(-1).(string)
+	if !ok {
+		return
+	}
+	for _, i := range indexes {
+		if f, ok := l.indexToValue(i).(string); ok {
+			l.deriveTags(s, f)
+		}
+	}
+}
+
+// checkTags calls the TagCheck with s if it is tagged, for the function
+// sink, and raises its error.
+func checkTags(l *State, sink, s string) {
+	if t := l.global.tags; t != nil && t.check != nil {
+		if tags := t.tags[s]; tags != nil {
+			if err := t.check(sink, s, append([]string(nil), tags...)); err != nil {
+				Errorf(l, "%s: %s", sink, err.Error())
+			}
+		}
+	}
+}
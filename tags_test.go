@@ -0,0 +1,100 @@
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStringTags(t *testing.T) {
+	skipWithoutOS(t)
+	l := NewState()
+	OpenLibraries(l)
+	l.PushString("'; drop table users; --")
+	TagString(l, -1, "user-input")
+	TagString(l, -1, "form", "user-input")
+	l.SetGlobal("input")
+	l.PushString("secret")
+	TagString(l, -1, "secret")
+	l.SetGlobal("key")
+	for _, c := range []struct {
+		expr string
+		tags []string
+	}{
+		{`input`, []string{"form", "user-input"}},
+		{`"select " .. input .. " from t"`, []string{"form", "user-input"}},
+		{`input .. key`, []string{"form", "secret", "user-input"}},
+		{`table.concat({"a", input}, ",")`, []string{"form", "user-input"}},
+		{`table.concat({"a", "b"}, key)`, []string{"secret"}},
+		{`string.format("%s=%q", key, 1)`, []string{"secret"}},
+		{`("x"):rep(3, key)`, []string{"secret"}},
+		{`key:upper()`, []string{"secret"}},
+		{`key:sub(2, 4)`, []string{"secret"}},
+		{`key:reverse()`, []string{"secret"}},
+		{`key:match("c(r)e")`, []string{"secret"}},
+		{`select(3, key:find("(cre)"))`, []string{"secret"}},
+		{`key:gmatch("%a%a")()`, []string{"secret"}},
+		{`("a b"):gsub("%a", key)`, []string{"secret"}},
+		{`key:gsub("s", "S")`, []string{"secret"}},
+		{`string.pattern("e"):gsub(key, "E")`, []string{"secret"}},
+		{`string.pattern("%a"):gsub("a b", key)`, []string{"secret"}},
+		{`("a b"):gsub("%a", function() return key end)`, []string{"secret"}},
+		{`("a b"):gsub("%a", {a = key})`, []string{"secret"}},
+		{`"sec" .. "ret"`, []string{"secret"}}, // tags belong to the contents
+		{`"plain" .. "text"`, nil},
+		{`key:len()`, nil},
+		{`string.format("%d", #key)`, nil},
+		{`("a b"):gsub("%a", function() return "x" end)`, nil},
+	} {
+		if err := DoString(l, "return "+c.expr); err != nil {
+			t.Fatal(err)
+		}
+		if got := StringTags(l, 1); !reflect.DeepEqual(got, c.tags) {
+			t.Errorf("%s: tags %v, want %v", c.expr, got, c.tags)
+		}
+		l.SetTop(0)
+	}
+
+	var sinks []string
+	SetTagCheck(l, func(sink, s string, tags []string) error {
+		sinks = append(sinks, sink)
+		for _, tag := range tags {
+			if tag == "user-input" {
+				return errors.New("untrusted " + s)
+			}
+		}
+		return nil
+	})
+	if err := DoString(l, `
+		local ok, e = pcall(load, "return " .. input)
+		assert(not ok and e:find("load: untrusted return '; drop"), e)
+		assert(not pcall(io.open, input))
+		assert(not pcall(os.execute, "echo " .. input))
+		assert(not pcall(io.popen, input))
+		assert(not pcall(os.spawn, {"echo", input}))
+		assert(load("return 1")() == 1)
+		assert(pcall(load, "return '" .. key .. "'"))
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"load", "io.open", "os.execute", "io.popen", "os.spawn", "load"}; !reflect.DeepEqual(sinks, want) {
+		t.Errorf("checked %v, want %v", sinks, want)
+	}
+
+	l.Global("key")
+	UntagString(l, -1)
+	if tags := StringTags(l, -1); tags != nil {
+		t.Errorf("tags %v after UntagString", tags)
+	}
+	l.Global("input")
+	if tags := StringTags(l, -1); len(tags) != 2 {
+		t.Errorf("UntagString removed the tags %v of another string", tags)
+	}
+	l.Pop(2)
+
+	ClearStringTags(l)
+	l.Global("input")
+	if tags := StringTags(l, -1); tags != nil {
+		t.Errorf("tags %v after ClearStringTags", tags)
+	}
+}
@@ -0,0 +1,234 @@
+// Package testutil provides helpers for testing Go bindings of go-lua. It
+// formalizes the patterns used by the tests of the lua package itself:
+// running a script in a fresh state, comparing its results with Go values
+// and confining file access to a temporary directory.
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/speedata/go-lua"
+)
+
+// NewState returns a state with the standard libraries opened. Output
+// written by print, io.write and friends goes to the test log.
+func NewState(t testing.TB) *lua.State {
+	t.Helper()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	w := &logWriter{t: t}
+	t.Cleanup(w.flush)
+	lua.SetStdout(l, w)
+	lua.SetStderr(l, w)
+	return l
+}
+
+// NewSandbox returns a state like NewState whose file access through io,
+// loadfile, dofile and require is confined to a new temporary directory,
+// which is removed when the test ends. The directory initially holds files,
+// which maps slash-separated relative names to their contents. Names in Lua
+// are relative to the directory; absolute names and names leading out of it
+// fail with a permission error. NewSandbox returns the directory as well, so
+// the test can inspect files written by the script.
+func NewSandbox(t testing.TB, files map[string]string) (*lua.State, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := NewState(t)
+	lua.SetFileOpener(l, func(name string, flag int) (lua.File, error) {
+		rel := filepath.Clean(filepath.FromSlash(name))
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		f, err := os.OpenFile(filepath.Join(dir, rel), flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	return l, dir
+}
+
+// Run runs script in l and returns its results converted with ToGo. The
+// stack of l is left as it was.
+func Run(l *lua.State, script string) ([]interface{}, error) {
+	top := l.Top()
+	defer l.SetTop(top)
+	if err := lua.LoadString(l, script); err != nil {
+		return nil, err
+	}
+	if err := l.ProtectedCall(0, lua.MultipleReturns, 0); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, l.Top()-top)
+	for i := top + 1; i <= l.Top(); i++ {
+		results = append(results, ToGo(l, i))
+	}
+	return results, nil
+}
+
+// RequireLuaEqual runs script in l and fails the test immediately unless it
+// succeeds and returns exactly the values want. The results are converted
+// with ToGo; Go integers, floats and slices and maps of them in want may be
+// of any type and are normalized the same way before comparing.
+func RequireLuaEqual(t testing.TB, l *lua.State, script string, want ...interface{}) {
+	t.Helper()
+	got, err := Run(l, script)
+	if err != nil {
+		t.Fatalf("script failed: %v\n%s", err, script)
+	}
+	norm := make([]interface{}, len(want))
+	for i, w := range want {
+		norm[i] = normalize(reflect.ValueOf(w))
+	}
+	if !reflect.DeepEqual(got, norm) {
+		t.Fatalf("script returned %s, want %s\n%s", format(got), format(norm), script)
+	}
+}
+
+// RequireLuaError runs script in l and fails the test immediately unless it
+// raises an error whose message contains substring.
+func RequireLuaError(t testing.TB, l *lua.State, script, substring string) {
+	t.Helper()
+	_, err := Run(l, script)
+	if err == nil {
+		t.Fatalf("script succeeded, want an error containing %q\n%s", substring, script)
+	}
+	if !strings.Contains(err.Error(), substring) {
+		t.Fatalf("script failed with %q, want an error containing %q\n%s", err, substring, script)
+	}
+}
+
+// ToGo converts the value at index to a Go value: nil, bool, int64, float64
+// or string for the corresponding Lua types, []interface{} for tables that
+// are sequences, including the empty table, and map[interface{}]interface{}
+// for other tables. Other values, such as functions, are returned as the
+// string produced by tostring. Tables that contain themselves are not
+// supported.
+func ToGo(l *lua.State, index int) interface{} {
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index)
+	case lua.TypeNumber:
+		if l.IsInteger(index) {
+			i, _ := l.ToInteger64(index)
+			return i
+		}
+		f, _ := l.ToNumber(index)
+		return f
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return s
+	case lua.TypeTable:
+		return tableToGo(l, l.AbsIndex(index))
+	}
+	s, _ := lua.ToStringMeta(l, index)
+	l.Pop(1)
+	return s
+}
+
+func tableToGo(l *lua.State, index int) interface{} {
+	m := make(map[interface{}]interface{})
+	for l.PushNil(); l.Next(index); l.Pop(1) {
+		m[ToGo(l, -2)] = ToGo(l, -1)
+	}
+	s := make([]interface{}, len(m))
+	for i := range s {
+		v, ok := m[int64(i+1)]
+		if !ok {
+			return m
+		}
+		s[i] = v
+	}
+	return s
+}
+
+// normalize converts v to the types returned by ToGo.
+func normalize(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return normalize(v.Elem())
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Slice, reflect.Array:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = normalize(v.Index(i))
+		}
+		return s
+	case reflect.Map:
+		m := make(map[interface{}]interface{}, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			m[normalize(it.Key())] = normalize(it.Value())
+		}
+		return m
+	}
+	return v.Interface()
+}
+
+func format(values []interface{}) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%#v", v)
+	}
+	return "(" + strings.Join(s, ", ") + ")"
+}
+
+// A logWriter writes complete lines to the test log.
+type logWriter struct {
+	t    testing.TB
+	line []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.t.Log(string(w.line[:i]))
+		w.line = w.line[i+1:]
+	}
+}
+
+func (w *logWriter) flush() {
+	if len(w.line) > 0 {
+		w.t.Log(string(w.line))
+		w.line = nil
+	}
+}
@@ -0,0 +1,52 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/speedata/go-lua"
+)
+
+func TestRequireLuaEqual(t *testing.T) {
+	l := NewState(t)
+	RequireLuaEqual(t, l, `return 1, 2.5, "three", true, nil`, 1, 2.5, "three", true, nil)
+	RequireLuaEqual(t, l, `return {10, 20, 30}`, []int{10, 20, 30})
+	RequireLuaEqual(t, l, `return {}`, []int{})
+	RequireLuaEqual(t, l, `return {x = 1, [2] = "y"}`, map[interface{}]interface{}{"x": 1, 2: "y"})
+	RequireLuaEqual(t, l, `return {1, {a = {2, 3}}}`, []interface{}{1, map[string][]uint8{"a": {2, 3}}})
+	RequireLuaEqual(t, l, `print("printed to the test log")`)
+	if l.Top() != 0 {
+		t.Errorf("stack has %d elements left", l.Top())
+	}
+}
+
+func TestRequireLuaError(t *testing.T) {
+	l := NewState(t)
+	RequireLuaError(t, l, `error("boom")`, "boom")
+	RequireLuaError(t, l, `return 1 +`, "unexpected symbol")
+}
+
+func TestNewSandbox(t *testing.T) {
+	if !lua.Features().Has("io") {
+		t.Skip("no io library with lua_noos")
+	}
+	l, dir := NewSandbox(t, map[string]string{
+		"data.txt":    "hello",
+		"lib/mod.lua": "return {answer = 42}",
+	})
+	RequireLuaEqual(t, l, `return io.open("data.txt"):read("a")`, "hello")
+	RequireLuaEqual(t, l, `
+		package.path = "lib/?.lua"
+		return require("mod").answer
+	`, 42)
+	RequireLuaEqual(t, l, `
+		local f = assert(io.open("out.txt", "w"))
+		f:write("written")
+		f:close()
+	`)
+	if b, err := os.ReadFile(filepath.Join(dir, "out.txt")); err != nil || string(b) != "written" {
+		t.Errorf("got %q, %v; want the file written by the script", b, err)
+	}
+	RequireLuaEqual(t, l, `return io.open("../data.txt") == nil, io.open("/etc/passwd") == nil`, true, true)
+}
@@ -0,0 +1,130 @@
+package lua
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// timeoutCheckCount is the number of instructions between checks of the
+// deadline of CallWithTimeout and the context of CallWithContext.
+const timeoutCheckCount = 1000
+
+// CallWithTimeout calls a function in protected mode like ProtectedCall, but
+// aborts it with an error once d has elapsed. It returns TimeoutError in that
+// case; the function and its arguments are removed from the stack and the
+// error message is pushed as for any other error, so l can be used again
+// right away.
+//
+// The deadline is checked from a count hook, which is chained to any hook
+// already installed and is inherited by the coroutines created during the
+// call. Once the deadline has passed, the hook raises the error again before
+// every instruction, so the script cannot catch it with pcall and carry on.
+// A script blocked in a Go function, such as a read from a pipe, is only
+// aborted when that function returns; Go functions can return early by
+// watching CallContext. A call that returns after the deadline fails too, as
+// its results may be cut short.
+func CallWithTimeout(l *State, d time.Duration, argCount, resultCount int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	aborted, err := callInterruptible(l, ctx, "timeout after "+d.String(), argCount, resultCount)
+	if aborted {
+		return TimeoutError
+	}
+	return err
+}
+
+// CallWithContext calls a function in protected mode like ProtectedCall, but
+// aborts it with an error once ctx is done, like CallWithTimeout. It returns
+// ctx.Err() in that case, with the message of that error on the stack.
+// During the call, CallContext returns ctx, so that Go functions called by
+// the script can pass it on to the I/O they do.
+func CallWithContext(l *State, ctx context.Context, argCount, resultCount int) error {
+	aborted, err := callInterruptible(l, ctx, "", argCount, resultCount)
+	if aborted {
+		return ctx.Err()
+	}
+	return err
+}
+
+// CallContext returns the context of the calls of CallWithContext and
+// CallWithTimeout that are running in l, or context.Background() outside of
+// them. Go functions called from Lua can watch it to stop blocking work
+// promptly when the script is aborted. In nested calls, the context is
+// done when the context of any of them is.
+func CallContext(l *State) context.Context {
+	if ctx := l.global.callContext; ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// callInterruptible calls a function in protected mode and aborts it from a
+// count hook once ctx is done, with message or else the error of ctx. It
+// reports whether the call was aborted.
+func callInterruptible(l *State, ctx context.Context, message string, argCount, resultCount int) (bool, error) {
+	var expired, aborted, done int32
+	hook, mask, count, internal := l.hooker, l.hookMask, l.baseHookCount, l.internalHook
+	eventMasks := []byte{MaskCall, MaskReturn, MaskLine, MaskCount, MaskCall}
+	check := func(l *State, ar Debug) {
+		if runtime.GOARCH == "wasm" {
+			// WebAssembly runs goroutines on a single thread without
+			// preemption, so the timers and goroutines that end ctx only run
+			// when the script yields.
+			runtime.Gosched()
+		}
+		if atomic.LoadInt32(&done) == 0 && atomic.LoadInt32(&expired) != 0 {
+			atomic.StoreInt32(&aborted, 1)
+			if l.baseHookCount != 1 {
+				SetDebugHook(l, l.hooker, MaskCount, 1)
+			}
+			if message == "" {
+				message = ctx.Err().Error()
+			}
+			Errorf(l, "%s", message)
+		}
+		if hook != nil && mask&eventMasks[ar.Event] != 0 {
+			hook(l, ar)
+		}
+	}
+	checkCount := timeoutCheckCount
+	if mask&MaskCount != 0 {
+		checkCount = count
+	}
+	outer := l.global.callContext
+	callContext := ctx
+	if outer != nil {
+		var cancel context.CancelFunc
+		callContext, cancel = context.WithCancel(ctx)
+		stop := context.AfterFunc(outer, cancel)
+		defer func() {
+			stop()
+			cancel()
+		}()
+	}
+	SetDebugHook(l, check, mask|MaskCount, checkCount)
+	l.internalHook = internal
+	l.global.callContext = callContext
+	stop := context.AfterFunc(ctx, func() { atomic.StoreInt32(&expired, 1) })
+	defer func() {
+		stop()
+		atomic.StoreInt32(&done, 1)
+		SetDebugHook(l, hook, mask, count)
+		l.internalHook = internal
+		l.global.callContext = outer
+	}()
+	base := l.Top() - argCount - 1
+	err := l.ProtectedCall(argCount, resultCount, 0)
+	if err == nil && ctx.Err() != nil {
+		// A Go function may have returned early because ctx was done, so the
+		// results are not trusted.
+		if message == "" {
+			message = ctx.Err().Error()
+		}
+		l.SetTop(base)
+		l.PushString(message)
+		return true, RuntimeError(message)
+	}
+	return err != nil && atomic.LoadInt32(&aborted) != 0, err
+}
@@ -0,0 +1,151 @@
+package lua
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallWithTimeout(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	for _, script := range []string{
+		`while true do end`,
+		`while true do pcall(function() while true do end end) end`,
+		`local co = coroutine.wrap(function() while true do end end); co()`,
+		`while true do pcall(coroutine.wrap(function() while true do end end)) end`,
+	} {
+		l.PushString("sentinel")
+		if err := LoadString(l, script); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err := CallWithTimeout(l, 20*time.Millisecond, 0, 0); err != TimeoutError {
+			t.Errorf("%s: got %v, want TimeoutError", script, err)
+		} else if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %v to time out", script, elapsed)
+		}
+		if msg, _ := l.ToString(-1); !strings.Contains(msg, "timeout after 20ms") {
+			t.Errorf("%s: error message is %q", script, msg)
+		}
+		if s, _ := l.ToString(-2); l.Top() != 2 || s != "sentinel" {
+			t.Errorf("%s: stack has %d elements, want the sentinel and the message", script, l.Top())
+		}
+		l.SetTop(0)
+		if DebugHook(l) != nil {
+			t.Errorf("%s: hook not removed", script)
+		}
+	}
+
+	// The state is usable after a timeout, and calls that finish in time
+	// return their results.
+	LoadString(l, `local s = 0; for i = 1, 100 do s = s + i end; return s, select('#', pcall(error))`)
+	if err := CallWithTimeout(l, time.Second, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := l.ToInteger(1); s != 5050 || l.Top() != 2 {
+		t.Errorf("got %d with %d results, want 5050 and 2 results", s, l.Top())
+	}
+	l.SetTop(0)
+	LoadString(l, `error("plain")`)
+	if err := CallWithTimeout(l, time.Second, 0, 0); err == nil || err == TimeoutError {
+		t.Errorf("got %v, want the runtime error", err)
+	}
+}
+
+func TestCallWithTimeoutChainsHook(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	calls := 0
+	hook := func(l *State, ar Debug) { calls++ }
+	SetDebugHook(l, hook, MaskCall, 0)
+	LoadString(l, `local function f() end; for i = 1, 10 do f() end`)
+	if err := CallWithTimeout(l, time.Second, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if calls < 10 {
+		t.Errorf("previous hook called %d times, want at least 10", calls)
+	}
+	if DebugHookMask(l) != MaskCall || DebugHook(l) == nil {
+		t.Error("previous hook not restored")
+	}
+}
+
+func TestCallWithContext(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	LoadString(l, `while true do end`)
+	if err := CallWithContext(l, ctx, 0, 0); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if msg, _ := l.ToString(-1); !strings.Contains(msg, "context canceled") {
+		t.Errorf("error message is %q", msg)
+	}
+	if CallContext(l) != context.Background() {
+		t.Error("CallContext is not reset after the call")
+	}
+}
+
+// TestCallContext checks that a Go function blocked in a call that is
+// aborted can see it through CallContext.
+func TestCallContext(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	type key struct{}
+	var seen interface{}
+	l.Register("block", func(l *State) int {
+		seen = CallContext(l).Value(key{})
+		select {
+		case <-CallContext(l).Done():
+		case <-time.After(5 * time.Second):
+		}
+		return 0
+	})
+	l.Register("nested", func(l *State) int {
+		l.Global("block")
+		if err := CallWithContext(l, context.Background(), 0, 0); err != nil {
+			l.Error()
+		}
+		return 0
+	})
+	for _, script := range []string{"block()", "nested()", "pcall(coroutine.wrap(nested))"} {
+		LoadString(l, script)
+		start := time.Now()
+		if err := CallWithTimeout(l, 20*time.Millisecond, 0, 0); err != TimeoutError {
+			t.Errorf("%s: got %v, want TimeoutError", script, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %v to return", script, elapsed)
+		}
+		l.SetTop(0)
+	}
+
+	ctx := context.WithValue(context.Background(), key{}, "v")
+	LoadString(l, "block()")
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := CallWithContext(l, ctx, 0, 0); err != context.DeadlineExceeded || seen != "v" {
+		t.Errorf("got %v and value %v", err, seen)
+	}
+}
+
+func TestCallContextKillsCommands(t *testing.T) {
+	skipWithoutCommands(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sleep")
+	}
+	l := NewState()
+	OpenLibraries(l)
+	LoadString(l, `os.spawn({"sleep", "5"})`)
+	start := time.Now()
+	if err := CallWithTimeout(l, 50*time.Millisecond, 0, 0); err != TimeoutError {
+		t.Errorf("got %v, want TimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v to return", elapsed)
+	}
+}
@@ -0,0 +1,148 @@
+package lua
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TraceOptions select what SetTraceWriter traces.
+type TraceOptions struct {
+	// Functions are the functions to trace, all if empty. An entry matches
+	// the name by which a function is called, as in tracebacks ("f" or
+	// "m.f" for a field), or where it is defined, as chunk and line of the
+	// short source ("test.lua:12", or "test.lua:0" for the main chunk).
+	Functions []string
+	// Registers is the number of registers of each instruction's frame to
+	// show, from the first; 0 shows all of them and a negative value none.
+	Registers int
+}
+
+// A tracer is the state of SetTraceWriter.
+type tracer struct {
+	w         io.Writer
+	functions map[string]bool
+	registers int
+	err       error // the first error writing to w, which stops the trace
+
+	hook     Hook // the hook installed before, which the tracer chains
+	mask     byte
+	count    int
+	internal bool
+	counted  int // instructions since the last count event of hook
+}
+
+// traceValueLength is the length beyond which strings are cut in traces.
+const traceValueLength = 40
+
+// SetTraceWriter writes a line to w for each instruction that l and the
+// coroutines it creates from now on execute in the functions selected by
+// opts, before the instruction runs:
+//
+//	test.lua:3	5	GETTABUP 	2 0 1	; _ENV "print"	| 10 "x" nil
+//
+// The fields are the short source and the line, the pc, the opcode, its
+// operands and their meaning like in ListFunction, and the values of the
+// registers. Tables, functions and the like are shown by their type, not
+// their address, so that the traces of two runs can be compared. A nil w
+// stops the trace. Tracing uses a count hook, chained to any hook already
+// installed like StartProfile does; SetTraceWriter returns the first error
+// writing to the previous writer, which stopped that trace.
+func SetTraceWriter(l *State, w io.Writer, opts TraceOptions) error {
+	var err error
+	if t := l.global.tracer; t != nil {
+		l.global.tracer, err = nil, t.err
+		SetDebugHook(l, t.hook, t.mask, t.count)
+		l.internalHook = t.internal
+	}
+	if w == nil {
+		return err
+	}
+	t := &tracer{
+		w: w, registers: opts.Registers,
+		hook: l.hooker, mask: l.hookMask, count: l.baseHookCount, internal: l.internalHook,
+	}
+	if len(opts.Functions) > 0 {
+		t.functions = make(map[string]bool, len(opts.Functions))
+		for _, f := range opts.Functions {
+			t.functions[f] = true
+		}
+	}
+	SetDebugHook(l, t.trace, t.mask|MaskCount, 1)
+	l.internalHook = t.internal
+	l.global.tracer = t
+	return err
+}
+
+func (t *tracer) trace(l *State, d Debug) {
+	if d.Event == HookCount {
+		if t.err == nil && l.callInfo.isLua() && t.selected(l, l.callInfo) {
+			t.err = t.write(l, l.callInfo)
+		}
+		if t.hook == nil || t.mask&MaskCount == 0 {
+			return
+		} else if t.counted++; t.counted < t.count {
+			return
+		}
+		t.counted = 0
+	}
+	if t.hook != nil && t.mask&hookEventMasks[d.Event] != 0 {
+		t.hook(l, d)
+	}
+}
+
+func (t *tracer) selected(l *State, ci *callInfo) bool {
+	if t.functions == nil {
+		return true
+	}
+	p := l.prototype(ci)
+	if t.functions[chunkID(p.source)+":"+strconv.Itoa(p.lineDefined)] {
+		return true
+	}
+	if !ci.isCallStatus(callStatusTail) && ci.previous.isLua() {
+		name, _ := l.functionName(ci.previous)
+		return name != "" && t.functions[name]
+	}
+	return false
+}
+
+func (t *tracer) write(l *State, ci *callInfo) error {
+	p := l.prototype(ci)
+	pc := int(ci.savedPC)
+	i := p.code[pc]
+	operands, comment := listOperands(p, pc, i)
+	if comment != "" {
+		comment = "\t; " + comment
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d\t%d\t%-9s\t%s%s\t|", chunkID(p.source), getFuncLine(p, pc), pc+1, opNames[i.opCode()], operands, comment)
+	registers := ci.frame
+	if t.registers < 0 {
+		registers = nil
+	} else if t.registers > 0 && t.registers < len(registers) {
+		registers = registers[:t.registers]
+	}
+	for _, v := range registers {
+		b.WriteByte(' ')
+		b.WriteString(traceValue(l, v))
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
+
+// traceValue shows v on a trace line: numbers, strings and booleans as
+// constants, other values by their type.
+func traceValue(l *State, v value) string {
+	switch v := v.(type) {
+	case nil, bool, int64, float64:
+		return constantString(v)
+	case string:
+		if len(v) > traceValueLength {
+			return strconv.Quote(v[:traceValueLength]) + "..."
+		}
+		return strconv.Quote(v)
+	}
+	return l.valueToType(v).String()
+}
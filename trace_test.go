@@ -0,0 +1,95 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTraceWriter(t *testing.T) {
+	const chunk = "local function sq(x)\n  return x * x\nend\nlocal s = sq(3) .. 'a'\nreturn s\n"
+	trace := func(opts TraceOptions) string {
+		l := NewState()
+		OpenLibraries(l)
+		var b bytes.Buffer
+		if err := SetTraceWriter(l, &b, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadBuffer(l, chunk, "=test", "t"); err != nil {
+			t.Fatal(err)
+		}
+		l.Call(0, 1)
+		if s, _ := l.ToString(-1); s != "9a" {
+			t.Errorf("result %q", s)
+		}
+		if err := SetTraceWriter(l, nil, TraceOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if DebugHook(l) != nil {
+			t.Error("the hook was not removed")
+		}
+		return b.String()
+	}
+
+	all := trace(TraceOptions{Registers: 2})
+	for _, want := range []string{
+		"test:3\t2\tCLOSURE  \t0 0\t|",
+		"test:4\t5\tCALL     \t1 2 2\t; 1 in 1 out\t| function function\n",
+		"test:2\t1\tMUL      \t1 0 0\t| 3 ",
+		"test:4\t7\tCONCAT   \t1 2\t| function 9\n",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("trace lacks %q:\n%s", want, all)
+		}
+	}
+	if all != trace(TraceOptions{Registers: 2}) {
+		t.Error("traces of the same run differ")
+	}
+	for _, f := range []string{"sq", "test:1"} {
+		got := trace(TraceOptions{Functions: []string{f}, Registers: -1})
+		if want := "test:2\t1\tMUL      \t1 0 0\t|\ntest:2\t3\tRETURN1  \t1\t|\n"; got != want {
+			t.Errorf("trace of %s = %q, want %q", f, got, want)
+		}
+	}
+	if got := trace(TraceOptions{Functions: []string{"test:0"}}); strings.Contains(got, "test:2") || !strings.Contains(got, "test:5") {
+		t.Errorf("trace of the main chunk:\n%s", got)
+	}
+}
+
+func TestTraceWriterChainsHook(t *testing.T) {
+	run := func(w *failingWriter) (counts, lines int) {
+		l := NewState()
+		OpenLibraries(l)
+		SetDebugHook(l, func(l *State, d Debug) {
+			if d.Event == HookCount {
+				counts++
+			} else {
+				lines++
+			}
+		}, MaskCount|MaskLine, 3)
+		if w != nil {
+			SetTraceWriter(l, w, TraceOptions{})
+		}
+		if err := DoString(l, "local s = 0\nfor i = 1, 1000 do\n  s = s + i\nend\n"); err != nil {
+			t.Fatal(err)
+		}
+		if w != nil {
+			if err := SetTraceWriter(l, nil, TraceOptions{}); err == nil || err.Error() != "disk full" {
+				t.Errorf("SetTraceWriter returned %v", err)
+			}
+			if DebugHookMask(l) != MaskCount|MaskLine || DebugHookCount(l) != 3 {
+				t.Error("the hook was not restored")
+			}
+		}
+		return
+	}
+	counts, lines := run(nil)
+	w := &failingWriter{}
+	tracedCounts, tracedLines := run(w)
+	if tracedCounts != counts || tracedLines != lines {
+		t.Errorf("%d count and %d line events with a trace, %d and %d without", tracedCounts, tracedLines, counts, lines)
+	}
+	if w.n > 8192+200 {
+		t.Errorf("%d bytes written after an error", w.n-8192)
+	}
+}
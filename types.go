@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"math"
 	"reflect"
-	"runtime"
 	"strings"
+	"sync"
 )
 
 type (
@@ -13,6 +13,60 @@ type (
 	float8 int
 )
 
+// Storing an int64 in a value allocates, except for 0..255, which the Go
+// runtime keeps preallocated. Most integers a script computes are small
+// loop counters, indices and sizes, so the VM boxes integer results with
+// intValue, which returns preallocated values for a wider range.
+//
+// A tagged struct or NaN-boxed value type would avoid the allocation for all
+// numbers, but value is an interface{} in every part of the interpreter,
+// and the Go API hands out and accepts the boxed values; such a change would
+// touch all of it. The cache is what remains of that investigation; it
+// makes the loop in BenchmarkFibonnaci about twice as fast.
+const (
+	minCachedInt = -256
+	maxCachedInt = 4095
+)
+
+var cachedInts = func() (c [maxCachedInt - minCachedInt + 1]value) {
+	for i := range c {
+		c[i] = int64(i + minCachedInt)
+	}
+	return
+}()
+
+func intValue(i int64) value {
+	if uint64(i-minCachedInt) <= maxCachedInt-minCachedInt {
+		return cachedInts[i-minCachedInt]
+	}
+	return i
+}
+
+var debugStrings sync.Map // reflect.Type -> func(interface{}) string
+
+// RegisterDebugString registers f to describe userdata whose Go value has
+// the same dynamic type as sample. Internal diagnostics such as crash dumps
+// then show the result of f, for example "Image(1200x800)", instead of the
+// address of the userdata. Registering a nil f removes the function for the
+// type. Registrations apply to all states.
+func RegisterDebugString(sample interface{}, f func(interface{}) string) {
+	t := reflect.TypeOf(sample)
+	if f == nil {
+		debugStrings.Delete(t)
+	} else {
+		debugStrings.Store(t, f)
+	}
+}
+
+// debugString returns the registered description of the userdata value d.
+func debugString(d interface{}) (string, bool) {
+	f, ok := debugStrings.Load(reflect.TypeOf(d))
+	if !ok {
+		return "", false
+	}
+	return f.(func(interface{}) string)(d), true
+}
+
 func debugValue(v value) string {
 	switch v := v.(type) {
 	case *table:
@@ -27,9 +81,7 @@ func debugValue(v value) string {
 			s += entry(x) + ", "
 		}
 		s += "], {"
-		for k, x := range v.hash {
-			s += entry(k) + ": " + entry(x) + ", "
-		}
+		v.hash.each(func(k, x value) { s += entry(k) + ": " + entry(x) + ", " })
 		return s + "}}"
 	case string:
 		return "'" + v + "'"
@@ -42,17 +94,21 @@ func debugValue(v value) string {
 	case *goClosure:
 		return fmt.Sprintf("go closure %#v", v)
 	case *goFunction:
-		pc := reflect.ValueOf(v.Function).Pointer()
-		f := runtime.FuncForPC(pc)
-		file, line := f.FileLine(pc)
-		return fmt.Sprintf("go function %s %s:%d", f.Name(), file, line)
+		name, file, line := goFunctionInfo(goFunctionPC(v.Function))
+		return fmt.Sprintf("go function %s %s:%d", name, file, line)
 	case *userData:
+		if s, ok := debugString(v.data); ok {
+			return "userdata " + s
+		}
 		return fmt.Sprintf("userdata %#v", v)
 	case nil:
 		return "nil"
 	case bool:
 		return fmt.Sprintf("%#v", v)
 	}
+	if s, ok := debugString(v); ok {
+		return "light userdata " + s
+	}
 	return fmt.Sprintf("unknown %#v %s", v, reflect.TypeOf(v).Name())
 }
 
@@ -220,11 +276,6 @@ type upValueDesc struct {
 	kind    byte // Lua 5.4: upvalue kind
 }
 
-type stackLocation struct {
-	state *State
-	index int
-}
-
 // absLineInfo stores absolute line info entries for Lua 5.4 split lineinfo
 type absLineInfo struct {
 	pc, line int
@@ -245,6 +296,14 @@ type prototype struct {
 	isVarArg                     bool
 }
 
+// releaseCaches drops the cached closures of p and its nested prototypes.
+func (p *prototype) releaseCaches() {
+	p.cache = nil
+	for i := range p.prototypes {
+		p.prototypes[i].releaseCaches()
+	}
+}
+
 func (p *prototype) upValueName(index int) string {
 	if s := p.upValues[index].name; s != "" {
 		return s
@@ -311,15 +370,18 @@ func (p *prototype) objectName(reg int, lastPC pc) (name, kind string) {
 			return
 		case opGetField:
 			// Lua 5.4: GETFIELD A B C — key is K[C]
-			name = p.constantName(i.c(), pc)
-			if v, ok := p.localName(i.b()+1, pc); ok && v == "_ENV" {
-				kind = "global"
-			} else {
-				kind = "field"
+			return p.constantName(i.c(), pc), p.fieldKind(i.b(), pc)
+		case opGetTable:
+			// Lua 5.4: GETTABLE key=R[C]. Keys whose constant index doesn't
+			// fit in C, as in functions with more than 255 constants, are
+			// loaded into a register with LOADK or LOADKX.
+			name = "?"
+			if n, k := p.objectName(i.c(), pc); k == "constant" {
+				name = n
 			}
-			return
-		case opGetTable, opGetI:
-			// Lua 5.4: GETTABLE key=R[C], GETI key=integer C
+			return name, p.fieldKind(i.b(), pc)
+		case opGetI:
+			// Lua 5.4: GETI key=integer C
 			kind = "field"
 			name = "?"
 			return
@@ -340,6 +402,16 @@ func (p *prototype) objectName(reg int, lastPC pc) (name, kind string) {
 	return
 }
 
+// fieldKind tells whether indexing the table in register reg at pc reads a
+// global, that is whether the table is _ENV, a local or an upvalue loaded
+// with GETUPVAL.
+func (p *prototype) fieldKind(reg int, pc pc) string {
+	if name, kind := p.objectName(reg, pc); name == "_ENV" && (kind == "local" || kind == "upvalue") {
+		return "global"
+	}
+	return "field"
+}
+
 func (p *prototype) constantName(k int, pc pc) string {
 	// Lua 5.4: k is always a constant index (no RK encoding)
 	if k >= 0 && k < len(p.constants) {
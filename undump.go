@@ -1,15 +1,18 @@
 package lua
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
-	"unsafe"
 )
 
 type loadState struct {
-	in    io.Reader
-	order binary.ByteOrder
+	in          io.Reader
+	order       binary.ByteOrder // of the chunk, which may differ from ours
+	integerSize byte             // of lua_Integer in the chunk, 4 or 8
+	numberSize  byte             // of lua_Number in the chunk, 4 or 8
+	remaining   func() int       // the length of the rest of the input, if known
 }
 
 // Lua 5.4 header: no IntSize/PointerSize fields
@@ -44,11 +47,21 @@ func (state *loadState) read(data interface{}) error {
 }
 
 func (state *loadState) readNumber() (f float64, err error) {
+	if state.numberSize == 4 {
+		var f32 float32
+		err = state.read(&f32)
+		return float64(f32), err
+	}
 	err = state.read(&f)
 	return
 }
 
 func (state *loadState) readInteger() (i int64, err error) {
+	if state.integerSize == 4 {
+		var i32 int32
+		err = state.read(&i32)
+		return int64(i32), err
+	}
 	err = state.read(&i)
 	return
 }
@@ -79,7 +92,7 @@ func (state *loadState) readUnsigned(limit uint64) (uint64, error) {
 }
 
 func (state *loadState) readSize() (int, error) {
-	n, err := state.readUnsigned(^uint64(0))
+	n, err := state.readUnsigned(uint64(maxInt))
 	return int(n), err
 }
 
@@ -88,10 +101,23 @@ func (state *loadState) readInt() (int, error) {
 	return int(n), err
 }
 
+// readCount reads the number of elements of a list whose elements take at
+// least size bytes each, so that a corrupted count is an error instead of
+// a huge allocation when the length of the input is known.
+func (state *loadState) readCount(size int) (int, error) {
+	n, err := state.readInt()
+	if err == nil && state.remaining != nil && n > state.remaining()/size {
+		return 0, errTruncated
+	}
+	return n, err
+}
+
 func (state *loadState) readString() (s string, err error) {
 	size, err := state.readSize()
 	if err != nil || size == 0 {
 		return
+	} else if state.remaining != nil && size-1 > state.remaining() {
+		return "", errTruncated
 	}
 	// size includes conceptual NUL; actual data is size-1 bytes
 	ba := make([]byte, size-1)
@@ -102,7 +128,7 @@ func (state *loadState) readString() (s string, err error) {
 }
 
 func (state *loadState) readCode() (code []instruction, err error) {
-	n, err := state.readInt()
+	n, err := state.readCount(4)
 	if err != nil || n == 0 {
 		return
 	}
@@ -112,7 +138,7 @@ func (state *loadState) readCode() (code []instruction, err error) {
 }
 
 func (state *loadState) readUpValues() (u []upValueDesc, err error) {
-	n, err := state.readInt()
+	n, err := state.readCount(3)
 	if err != nil || n == 0 {
 		return
 	}
@@ -138,7 +164,7 @@ func (state *loadState) readUpValues() (u []upValueDesc, err error) {
 
 func (state *loadState) readLocalVariables() (localVariables []localVariable, err error) {
 	var n int
-	if n, err = state.readInt(); err != nil || n == 0 {
+	if n, err = state.readCount(3); err != nil || n == 0 {
 		return
 	}
 	localVariables = make([]localVariable, n)
@@ -165,7 +191,7 @@ func (state *loadState) readLocalVariables() (localVariables []localVariable, er
 // readDebug54 reads Lua 5.4 debug info (split lineinfo)
 func (state *loadState) readDebug54(p *prototype) error {
 	// Relative line info (int8 per instruction)
-	n, err := state.readInt()
+	n, err := state.readCount(1)
 	if err != nil {
 		return err
 	}
@@ -177,7 +203,7 @@ func (state *loadState) readDebug54(p *prototype) error {
 	}
 
 	// Absolute line info
-	n, err = state.readInt()
+	n, err = state.readCount(2)
 	if err != nil {
 		return err
 	}
@@ -200,7 +226,7 @@ func (state *loadState) readDebug54(p *prototype) error {
 	}
 
 	// Upvalue names
-	n, err = state.readInt()
+	n, err = state.readCount(1)
 	if err != nil {
 		return err
 	}
@@ -224,7 +250,7 @@ const (
 )
 
 func (state *loadState) readConstants() (constants []value, err error) {
-	n, err := state.readInt()
+	n, err := state.readCount(1)
 	if err != nil || n == 0 {
 		return
 	}
@@ -258,7 +284,7 @@ func (state *loadState) readConstants() (constants []value, err error) {
 }
 
 func (state *loadState) readPrototypes(psource string) (prototypes []prototype, err error) {
-	n, err := state.readInt()
+	n, err := state.readCount(1)
 	if err != nil || n == 0 {
 		return
 	}
@@ -287,6 +313,9 @@ func (state *loadState) readFunction(psource string) (p prototype, err error) {
 		} else {
 			p.source = "=?"
 		}
+	} else if state.remaining != nil && sourceSize-1 > state.remaining() {
+		err = errTruncated
+		return
 	} else {
 		ba := make([]byte, sourceSize-1)
 		if err = state.read(ba); err != nil {
@@ -349,28 +378,63 @@ func init() {
 }
 
 func endianness() binary.ByteOrder {
-	if x := 1; *(*byte)(unsafe.Pointer(&x)) == 1 {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
 		return binary.LittleEndian
 	}
 	return binary.BigEndian
 }
 
+// checkHeader reads the header of a chunk. Besides chunks of our own
+// format, it accepts those of other platforms that differ in byte order or
+// use 32-bit integers or floats, like Lua built with LUA_32BITS; their
+// numbers are widened as they are read.
 func (state *loadState) checkHeader() error {
-	h := header54
+	var h struct {
+		Signature               [4]byte
+		Version, Format         byte
+		Data                    [6]byte
+		InstructionSize         byte
+		IntegerSize, NumberSize byte
+	}
 	if err := state.read(&h); err != nil {
 		return err
-	} else if h == header54 {
-		return nil
 	} else if string(h.Signature[:]) != Signature {
 		return errNotPrecompiledChunk
 	} else if h.Version != header54.Version || h.Format != header54.Format {
 		return errVersionMismatch
 	} else if h.Data != header54.Data {
 		return errCorrupted
+	} else if h.InstructionSize != header54.InstructionSize || !validNumberSize(h.IntegerSize) || !validNumberSize(h.NumberSize) {
+		return errIncompatible
+	}
+	testInt := make([]byte, h.IntegerSize)
+	if err := state.read(testInt); err != nil {
+		return err
+	}
+	state.integerSize, state.numberSize = h.IntegerSize, h.NumberSize
+	for _, order := range []binary.ByteOrder{endianness(), swappedEndianness()} {
+		state.order = order
+		if i, _ := (&loadState{in: bytes.NewReader(testInt), order: order, integerSize: h.IntegerSize}).readInteger(); i == header54.TestInt {
+			if n, err := state.readNumber(); err != nil {
+				return err
+			} else if n != header54.TestNum {
+				return errIncompatible
+			}
+			return nil
+		}
 	}
 	return errIncompatible
 }
 
+func validNumberSize(size byte) bool { return size == 4 || size == 8 }
+
+func swappedEndianness() binary.ByteOrder {
+	if endianness() == binary.LittleEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
 func (l *State) undump(in io.Reader, name string) (c *luaClosure, err error) {
 	if len(name) > 0 {
 		if name[0] == '@' || name[0] == '=' {
@@ -379,7 +443,10 @@ func (l *State) undump(in io.Reader, name string) (c *luaClosure, err error) {
 			name = "binary string"
 		}
 	}
-	s := &loadState{in, endianness()}
+	s := &loadState{in: in}
+	if r, ok := in.(interface{ Len() int }); ok {
+		s.remaining = r.Len
+	}
 	var p prototype
 	if err = s.checkHeader(); err != nil {
 		return
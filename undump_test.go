@@ -15,13 +15,94 @@ func TestAllHeaderNoFun(t *testing.T) {
 }
 
 func TestWrongEndian(t *testing.T) {
-	// In Lua 5.3, endianness is checked via TestInt (0x5678)
+	// The byte order is detected via TestInt (0x5678); a TestNum that
+	// doesn't match it is still rejected.
 	h := header54
 	// Swap byte order of TestInt
 	h.TestInt = int64(0x7856000000000000)
 	expectErrorFromUndump(errIncompatible, h, t)
 }
 
+func TestUndumpOppositeEndian(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := LoadString(l, "local t = {...} return t[1] * 2^40 + 0.25, 'str'"); err != nil {
+		t.Fatal(err)
+	}
+	p := l.ToValue(-1).(*luaClosure).prototype
+	var buf bytes.Buffer
+	d := dumpState{l: l, out: &buf, order: swappedEndianness()}
+	d.dumpHeader()
+	d.writeByte(byte(len(p.upValues)))
+	d.dumpFunction(p, "")
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if err := l.Load(&buf, "=swapped", "b"); err != nil {
+		t.Fatal(err)
+	}
+	l.PushInteger(3)
+	l.Call(1, 2)
+	if n, _ := l.ToNumber(-2); n != 3*(1<<40)+0.25 {
+		t.Errorf("got %v, want %v", n, 3*(1<<40)+0.25)
+	}
+	if s, _ := l.ToString(-1); s != "str" {
+		t.Errorf("got %q, want %q", s, "str")
+	}
+}
+
+// TestUndump32Bits loads a chunk as written by Lua built with LUA_32BITS,
+// with 4-byte integers and floats, for "return 70000, -2, 0.5".
+func TestUndump32Bits(t *testing.T) {
+	l := NewState()
+	var buf bytes.Buffer
+	d := dumpState{l: l, out: &buf, order: binary.BigEndian}
+	d.write([]byte(Signature + "\x54\x00\x19\x93\r\n\x1a\n\x04\x04\x04"))
+	d.write(int32(0x5678))
+	d.write(float32(370.5))
+	d.writeByte(1)             // upvalues of the main function
+	d.writeStringValue("=t32") // source
+	d.writeInt(0)              // lineDefined
+	d.writeInt(0)              // lastLineDefined
+	d.writeByte(0)             // parameters
+	d.writeBool(true)          // vararg
+	d.writeByte(3)             // maximum stack size
+	d.writeInt(5)
+	d.write([]instruction{
+		createABCk(opVarArgPrep, 0, 0, 0, 0),
+		createABx(opLoadConstant, 0, 0),
+		createABx(opLoadConstant, 1, 1),
+		createABx(opLoadConstant, 2, 2),
+		createABCk(opReturn, 0, 4, 1, 0),
+	})
+	d.writeInt(3)
+	d.writeByte(dumpVNumInt)
+	d.write(int32(70000))
+	d.writeByte(dumpVNumInt)
+	d.write(int32(-2))
+	d.writeByte(dumpVNumFlt)
+	d.write(float32(0.5))
+	d.writeInt(1) // upvalue _ENV
+	d.writeBool(true)
+	d.writeByte(0)
+	d.writeByte(0)
+	d.writeInt(0) // prototypes
+	d.writeDebug54Stripped(nil)
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if err := l.Load(&buf, "=t32", "b"); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 3)
+	a, _ := l.ToInteger64(-3)
+	b, _ := l.ToInteger64(-2)
+	c, _ := l.ToNumber(-1)
+	if !l.IsInteger(-3) || a != 70000 || b != -2 || c != 0.5 {
+		t.Errorf("got %v, %v, %v, want 70000, -2, 0.5", a, b, c)
+	}
+}
+
 func TestWrongVersion(t *testing.T) {
 	h := header54
 	h.Version++
@@ -101,3 +182,37 @@ func readerOn(data interface{}, t *testing.T) io.Reader {
 	}
 	return buf
 }
+
+// TestDumpLayout checks that Dump writes the layout of luac 5.4: the header
+// with LUAC_DATA, LUAC_INT and LUAC_NUM, the upvalue count of the main
+// function and its fields with variable-length sizes.
+func TestDumpLayout(t *testing.T) {
+	l := NewState()
+	if err := LoadBuffer(l, "return ...", "=chunk", "t"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := l.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := new(bytes.Buffer)
+	want.WriteString("\x1bLua\x54\x00\x19\x93\r\n\x1a\n\x04\x08\x08")
+	binary.Write(want, endianness(), int64(0x5678))
+	binary.Write(want, endianness(), float64(370.5))
+	want.WriteString("\x01")             // upvalues of the main function (_ENV)
+	want.WriteString("\x87=chunk")       // source: size 6+1 with the last-byte flag
+	want.WriteString("\x80\x80\x00\x01") // lineDefined, lastLineDefined, parameters, vararg
+	if got := buf.Bytes(); !bytes.HasPrefix(got, want.Bytes()) {
+		t.Errorf("dump starts with % x, want % x", got[:want.Len()], want.Bytes())
+	}
+
+	// The chunk loads back.
+	if err := l.Load(&buf, "=chunk", "b"); err != nil {
+		t.Fatal(err)
+	}
+	l.PushInteger(7)
+	l.Call(1, 1)
+	if n, _ := l.ToInteger(-1); n != 7 {
+		t.Errorf("loaded chunk returned %d, want 7", n)
+	}
+}
@@ -1,9 +1,10 @@
-//go:build !windows
-// +build !windows
+//go:build !windows && !js && !wasip1 && !lua_noos && !baremetal
+// +build !windows,!js,!wasip1,!lua_noos,!baremetal
 
 package lua
 
 import (
+	"os"
 	"os/exec"
 	"syscall"
 )
@@ -21,3 +22,18 @@ func exitReasonAndCode(exitErr *exec.ExitError) (string, int) {
 	}
 	return "exit", exitErr.ExitCode()
 }
+
+func mapFile(f *os.File) (*mapping, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || !info.Mode().IsRegular() {
+		return readMapping(f)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mapping{data: data, unmap: syscall.Munmap}, nil
+}
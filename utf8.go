@@ -21,64 +21,39 @@ func decodeUTF8(s string, pos int) (rune, int, bool) {
 	return r, size, true
 }
 
-// decodeUTF8Lax decodes a single modified UTF-8 character (1-based pos).
-// Accepts surrogates (U+D800..U+DFFF) and codepoints up to U+7FFFFFFF.
+// utf8Limits are the smallest codepoints that need the given number of
+// continuation bytes; smaller ones are overlong encodings.
+var utf8Limits = [...]uint32{^uint32(0), 0x80, 0x800, 0x10000, 0x200000, 0x4000000}
+
+// decodeUTF8Lax decodes a single modified UTF-8 character (1-based pos) like
+// the lax mode of C Lua: it accepts surrogates (U+D800..U+DFFF) and 5- and
+// 6-byte sequences for codepoints up to U+7FFFFFFF, but not overlong
+// encodings.
 func decodeUTF8Lax(s string, pos int) (rune, int, bool) {
 	if pos < 1 || pos > len(s) {
 		return 0, 0, false
 	}
 	b := s[pos-1:]
-	first := b[0]
-	switch {
-	case first < 0x80:
-		return rune(first), 1, true
-	case first < 0xC0:
-		return 0, 0, false // continuation byte
-	case first < 0xE0:
-		if len(b) < 2 || b[1]&0xC0 != 0x80 {
-			return 0, 0, false
-		}
-		r := rune(first&0x1F)<<6 | rune(b[1]&0x3F)
-		return r, 2, true
-	case first < 0xF0:
-		if len(b) < 3 || b[1]&0xC0 != 0x80 || b[2]&0xC0 != 0x80 {
-			return 0, 0, false
-		}
-		r := rune(first&0x0F)<<12 | rune(b[1]&0x3F)<<6 | rune(b[2]&0x3F)
-		return r, 3, true
-	case first < 0xF8:
-		if len(b) < 4 || b[1]&0xC0 != 0x80 || b[2]&0xC0 != 0x80 || b[3]&0xC0 != 0x80 {
-			return 0, 0, false
-		}
-		r := rune(first&0x07)<<18 | rune(b[1]&0x3F)<<12 | rune(b[2]&0x3F)<<6 | rune(b[3]&0x3F)
-		return r, 4, true
-	case first < 0xFC:
-		if len(b) < 5 || b[1]&0xC0 != 0x80 || b[2]&0xC0 != 0x80 || b[3]&0xC0 != 0x80 || b[4]&0xC0 != 0x80 {
-			return 0, 0, false
-		}
-		r := rune(first&0x03)<<24 | rune(b[1]&0x3F)<<18 | rune(b[2]&0x3F)<<12 | rune(b[3]&0x3F)<<6 | rune(b[4]&0x3F)
-		return r, 5, true
-	case first < 0xFE:
-		if len(b) < 6 || b[1]&0xC0 != 0x80 || b[2]&0xC0 != 0x80 || b[3]&0xC0 != 0x80 || b[4]&0xC0 != 0x80 || b[5]&0xC0 != 0x80 {
+	c := uint32(b[0])
+	if c < 0x80 {
+		return rune(c), 1, true
+	}
+	var res uint32
+	count := 0
+	for ; c&0x40 != 0; c <<= 1 { // each leading 1 bit announces a continuation byte
+		if count++; count >= len(b) || !isContinuationByte(b[count]) {
 			return 0, 0, false
 		}
-		r := rune(first&0x01)<<30 | rune(b[1]&0x3F)<<24 | rune(b[2]&0x3F)<<18 | rune(b[3]&0x3F)<<12 | rune(b[4]&0x3F)<<6 | rune(b[5]&0x3F)
-		return r, 6, true
-	default:
-		return 0, 0, false
+		res = res<<6 | uint32(b[count]&0x3F)
 	}
-}
-
-// utf8PosRelative converts a potentially negative position to a positive one.
-// Negative positions count from the end of the string.
-func utf8PosRelative(pos, len int) int {
-	if pos >= 0 {
-		return pos
+	if count > 5 {
+		return 0, 0, false
 	}
-	if -pos > len {
-		return 0
+	res |= (c & 0x7F) << (count * 5) // the payload bits of the first byte
+	if res > 0x7FFFFFFF || res < utf8Limits[count] {
+		return 0, 0, false
 	}
-	return len + pos + 1
+	return rune(res), count + 1, true
 }
 
 var utf8Library = []RegistryFunction{
@@ -107,7 +82,7 @@ var utf8Library = []RegistryFunction{
 		s := CheckString(l, 1)
 		lax := l.ToBoolean(2)
 		// Check that string starts with a valid UTF-8 byte (not a continuation byte)
-		if !lax && len(s) > 0 && s[0]&0xC0 == 0x80 {
+		if len(s) > 0 && s[0]&0xC0 == 0x80 {
 			ArgumentError(l, 1, "invalid UTF-8 code")
 		}
 		// Capture lax in closure via upvalue
@@ -130,12 +105,11 @@ var utf8Library = []RegistryFunction{
 			// Decode UTF-8 at position n (0-based index)
 			if isLax {
 				r, size, ok := decodeUTF8Lax(str, int(n)+1) // 1-based for decodeUTF8Lax
-				if !ok {
+				if !ok || n+uint64(size) < slen && str[n+uint64(size)]&0xC0 == 0x80 {
 					Errorf(l, "invalid UTF-8 code")
 				}
 				l.PushInteger(int(n) + 1) // 1-based position
 				l.PushInteger(int(r))     // codepoint
-				_ = size
 				return 2
 			}
 			r, size := utf8.DecodeRuneInString(str[n:])
@@ -158,21 +132,22 @@ var utf8Library = []RegistryFunction{
 	// utf8.codepoint(s [, i [, j [, lax]]]) - returns codepoints
 	{"codepoint", func(l *State) int {
 		s := CheckString(l, 1)
-		i := utf8PosRelative(OptInteger(l, 2, 1), len(s))
-		j := utf8PosRelative(OptInteger(l, 3, i), len(s))
+		i64 := relativePosition(OptInteger64(l, 2, 1), len(s))
+		j64 := relativePosition(OptInteger64(l, 3, i64), len(s))
 		lax := l.ToBoolean(4)
 
 		// Empty range check first - if i > j, just return nothing
-		if i > j {
+		if i64 > j64 {
 			return 0
 		}
 		// Only check bounds when we actually have a range to process
-		if i < 1 || i > len(s) {
+		if i64 < 1 || i64 > int64(len(s)) {
 			ArgumentError(l, 2, "out of bounds")
 		}
-		if j > len(s) {
+		if j64 > int64(len(s)) {
 			ArgumentError(l, 3, "out of bounds")
 		}
+		i, j := int(i64), int(j64)
 
 		decode := decodeUTF8
 		if lax {
@@ -196,12 +171,13 @@ var utf8Library = []RegistryFunction{
 	// utf8.len(s [, i [, j [, lax]]]) - returns number of characters
 	{"len", func(l *State) int {
 		s := CheckString(l, 1)
-		i := utf8PosRelative(OptInteger(l, 2, 1), len(s))
-		j := utf8PosRelative(OptInteger(l, 3, -1), len(s))
+		i64 := relativePosition(OptInteger64(l, 2, 1), len(s))
+		j64 := relativePosition(OptInteger64(l, 3, -1), len(s))
 		lax := l.ToBoolean(4)
 
-		ArgumentCheck(l, 1 <= i && i <= len(s)+1, 2, "initial position out of bounds")
-		ArgumentCheck(l, j <= len(s), 3, "final position out of bounds")
+		ArgumentCheck(l, 1 <= i64 && i64 <= int64(len(s))+1, 2, "initial position out of bounds")
+		ArgumentCheck(l, j64 <= int64(len(s)), 3, "final position out of bounds")
+		i, j := int(i64), int(j64)
 		if i > j {
 			l.PushInteger(0)
 			return 1
@@ -215,8 +191,8 @@ var utf8Library = []RegistryFunction{
 		count := 0
 		pos := i
 		for pos <= j {
-			r, size, ok := decode(s, pos)
-			if !ok || (!lax && r == utf8.RuneError) {
+			_, size, ok := decode(s, pos)
+			if !ok {
 				// Return nil and the position of the invalid byte
 				l.PushNil()
 				l.PushInteger(pos)
@@ -230,18 +206,19 @@ var utf8Library = []RegistryFunction{
 	}},
 
 	// utf8.offset(s, n [, i]) - returns byte position of n-th character
-	// Like C Lua, navigates by continuation bytes without decoding.
+	// Like C Lua, navigates by continuation bytes without decoding, so it
+	// needs no lax argument: 5- and 6-byte sequences and surrogates are
+	// skipped like any other character.
 	{"offset", func(l *State) int {
 		s := CheckString(l, 1)
-		n := CheckInteger(l, 2)
-		var posi int
-		if n >= 0 {
-			posi = OptInteger(l, 3, 1)
-		} else {
-			posi = OptInteger(l, 3, len(s)+1)
+		n := CheckInteger64(l, 2)
+		def := int64(1)
+		if n < 0 {
+			def = int64(len(s)) + 1
 		}
-
-		ArgumentCheck(l, 1 <= posi && posi <= len(s)+1, 3, "position out of bounds")
+		posi64 := relativePosition(OptInteger64(l, 3, def), len(s))
+		ArgumentCheck(l, 1 <= posi64 && posi64 <= int64(len(s))+1, 3, "position out of bounds")
+		posi := int(posi64)
 
 		if n == 0 {
 			// Find beginning of current byte sequence
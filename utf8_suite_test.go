@@ -6,6 +6,7 @@ import (
 )
 
 func TestUtf8Suite(t *testing.T) {
+	skipWithoutOS(t)
 	l := NewState()
 	OpenLibraries(l)
 	for _, s := range []string{"_port", "_no32", "_noformatA", "_noweakref", "_noGC", "_noBuffering", "_noStringDump", "_nocoroutine", "_soft"} {
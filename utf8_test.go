@@ -0,0 +1,38 @@
+package lua
+
+import "testing"
+
+func TestUTF8Lax(t *testing.T) {
+	testString(t, `
+		local function invalid(f, ...)
+			local ok, err = pcall(f, ...)
+			return not ok and err:find("invalid UTF%-8 code") ~= nil
+		end
+
+		-- Surrogates and codepoints beyond U+10FFFF need lax.
+		for _, s in ipairs({"\u{D800}", "\u{DFFF}", "\u{110000}", "\u{3FFFFFF}", "\u{7FFFFFFF}"}) do
+			assert(utf8.len(s) == nil)
+			assert(utf8.len(s, 1, -1, true) == 1)
+			assert(invalid(utf8.codepoint, s))
+			assert(utf8.char(utf8.codepoint(s, 1, 1, true)) == s)
+			assert(invalid(function() for _ in utf8.codes(s) do end end))
+			for p, c in utf8.codes(s, true) do assert(p == 1 and utf8.char(c) == s) end
+		end
+		assert(utf8.codepoint("\u{7FFFFFFF}", 1, 1, true) == 0x7FFFFFFF)
+		assert(utf8.len("a\u{D800}b\u{4000000}c", 1, -1, true) == 5)
+		assert(utf8.offset("a\u{7FFFFFFF}b", 3) == 8)
+
+		-- Overlong encodings, stray bytes and truncated sequences are invalid
+		-- even in lax mode.
+		for _, s in ipairs({"\xC0\x80", "\xE0\x80\x80", "\xF8\x80\x80\x80\x80", "\xFE\x80\x80\x80\x80\x80\x80", "\xFF", "\x80", "\xE4\xB8"}) do
+			assert(utf8.len(s, 1, -1, true) == nil)
+			assert(invalid(utf8.codepoint, s, 1, 1, true))
+			assert(invalid(function() for _ in utf8.codes(s, true) do end end))
+		end
+		assert(invalid(function() for _ in utf8.codes("a\u{D800}\x80", true) do end end))
+
+		-- U+FFFD is an ordinary character.
+		assert(utf8.len("\u{FFFD}") == 1)
+		assert(utf8.codepoint("\u{FFFD}") == 0xFFFD)
+	`)
+}
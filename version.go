@@ -0,0 +1,94 @@
+package lua
+
+import "sort"
+
+// Implementation is the name of this implementation of Lua.
+const Implementation = "go-lua"
+
+// OptionalLibraries are the libraries that come with go-lua besides the
+// standard ones, sorted by name. OpenLibraries does not open them; pass them
+// as preloaded libraries to make all of them available through require:
+//
+//	lua.OpenLibraries(l, lua.OptionalLibraries...)
+var OptionalLibraries = sortedLibraries(append([]RegistryFunction{
+	{"class", ClassOpen},
+	{"hash", HashOpen},
+	{"inspect", InspectOpen},
+	{"json", JSONOpen},
+	{"lpeg", LPegOpen},
+	{"msgpack", MsgPackOpen},
+	{"regex", RegexOpen},
+}, osOptionalLibraries...))
+
+// sortedLibraries sorts libs by name, so that the libraries that only some
+// builds have do not end up at the end.
+func sortedLibraries(libs []RegistryFunction) []RegistryFunction {
+	sort.Slice(libs, func(i, j int) bool { return libs[i].Name < libs[j].Name })
+	return libs
+}
+
+// standardLibraries are the libraries that OpenLibraries opens, in order.
+var standardLibraries = append(append([]RegistryFunction{
+	{"_G", BaseOpen},
+	{"package", PackageOpen},
+	{"coroutine", CoroutineOpen},
+	{"table", TableOpen},
+}, osLibraries...), []RegistryFunction{
+	{"string", StringOpen},
+	{"bit32", Bit32Open},
+	{"math", MathOpen},
+	{"debug", DebugOpen},
+	{"utf8", UTF8Open},
+}...)
+
+// A VersionInfo describes the Lua version that go-lua implements and the
+// features that it was built with, so that hosts can check for a feature
+// instead of guessing from the version number.
+type VersionInfo struct {
+	Implementation string // Implementation
+	Version        string // VersionString, the value of _VERSION
+	Number         int    // VersionNumber
+
+	// Compat lists the features of earlier Lua versions that are kept:
+	//
+	//	"bitlib"  the bit32 library of Lua 5.2
+	//	"mathlib" math.pow, math.atan2, math.cosh, math.sinh, math.tanh,
+	//	          math.frexp and math.ldexp of Lua 5.2
+	//	"lt_le"   __le falls back to "not __lt" with swapped operands
+	//	"readfmt" io.read accepts formats with a leading '*'
+	Compat []string
+
+	Libraries         []string // the libraries that OpenLibraries opens
+	OptionalLibraries []string // the names of OptionalLibraries
+}
+
+// Features returns the version and features of go-lua.
+func Features() VersionInfo {
+	names := func(libs []RegistryFunction) []string {
+		s := make([]string, len(libs))
+		for i, lib := range libs {
+			s[i] = lib.Name
+		}
+		return s
+	}
+	return VersionInfo{
+		Implementation:    Implementation,
+		Version:           VersionString,
+		Number:            VersionNumber,
+		Compat:            []string{"bitlib", "mathlib", "lt_le", "readfmt"},
+		Libraries:         names(standardLibraries),
+		OptionalLibraries: names(OptionalLibraries),
+	}
+}
+
+// Has reports whether v lists the compatibility feature or library name.
+func (v VersionInfo) Has(name string) bool {
+	for _, list := range [][]string{v.Compat, v.Libraries, v.OptionalLibraries} {
+		for _, s := range list {
+			if s == name {
+				return true
+			}
+		}
+	}
+	return false
+}
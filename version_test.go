@@ -0,0 +1,52 @@
+package lua
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	v := Features()
+	if v.Implementation != "go-lua" || v.Version != "Lua 5.4" || v.Number != 504 {
+		t.Errorf("unexpected version: %+v", v)
+	}
+	if !v.Has("lpeg") || !v.Has("utf8") || !v.Has("mathlib") || v.Has("jit") {
+		t.Errorf("Has is wrong for %+v", v)
+	}
+
+	l := NewState()
+	OpenLibraries(l, OptionalLibraries...)
+	l.Global("_VERSION")
+	if s, _ := l.ToString(-1); s != v.Version {
+		t.Errorf("_VERSION is %q, want %q", s, v.Version)
+	}
+	l.Pop(1)
+	var libs []string
+	for _, name := range v.Libraries {
+		if name != "_G" {
+			libs = append(libs, name)
+		}
+	}
+	for _, name := range append(libs, v.OptionalLibraries...) {
+		l.PushString(name)
+		l.SetGlobal("name")
+		if err := DoString(l, "assert(type(require(name)) == 'table', name)"); err != nil {
+			t.Error(err)
+		}
+	}
+	if !sort.StringsAreSorted(v.OptionalLibraries) {
+		t.Errorf("optional libraries are not sorted: %v", v.OptionalLibraries)
+	}
+	if !reflect.DeepEqual(v.Compat, []string{"bitlib", "mathlib", "lt_le", "readfmt"}) {
+		t.Errorf("compat features changed: %v", v.Compat)
+	}
+	testString(t, `
+		assert(bit32.band(6, 3) == 2)
+		assert(math.pow(2, 3) == 8 and math.atan2(1, 1) > 0 and math.cosh(0) == 1 and math.sinh(0) == 0)
+		assert(math.tanh(0) == 0 and math.frexp(8) == 0.5 and math.ldexp(0.5, 4) == 8)
+		local mt = {__lt = function(a, b) return a.v < b.v end}
+		local a, b = setmetatable({v = 1}, mt), setmetatable({v = 2}, mt)
+		assert(a <= b and not (b <= a))
+	`)
+}
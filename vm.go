@@ -185,7 +185,9 @@ func (l *State) setTableAt(t value, key value, val value) {
 	for loop := 0; loop < maxTagLoop; loop++ {
 		var tm value
 		if table, ok := t.(*table); ok {
-			if table.tryPut(l, key, val) {
+			if table.frozen {
+				l.runtimeError("attempt to modify a frozen table")
+			} else if table.tryPut(l, key, val) {
 				// previous non-nil value ==> metamethod irrelevant
 				table.invalidateTagMethodCache()
 				return
@@ -213,10 +215,10 @@ func (l *State) objectLength(v value) value {
 	switch v := v.(type) {
 	case *table:
 		if tm = l.fastTagMethod(v.metaTable, tmLen); tm == nil {
-			return float64(v.length())
+			return intValue(int64(v.length()))
 		}
 	case string:
-		return float64(len(v))
+		return intValue(int64(len(v)))
 	default:
 		if tm = l.tagMethodByObject(v, tmLen); tm == nil {
 			l.typeError(v, "get length of")
@@ -542,7 +544,9 @@ func (l *State) concat(total int) {
 			for i, j := 0, len(ss)-1; i < j; i, j = i+1, j-1 {
 				ss[i], ss[j] = ss[j], ss[i]
 			}
-			put(len(ss), strings.Join(ss, ""))
+			r := strings.Join(ss, "")
+			l.deriveTags(r, ss...)
+			put(len(ss), r)
 		}
 		total -= n - 1 // created 1 new string from `n` strings
 		l.top -= n - 1 // popped `n` strings and pushed 1
@@ -589,6 +593,7 @@ func (l *State) traceExecution() {
 	// Matches C Lua where trap=0 during VARARGPREP; hooks start after it.
 	if callInfo.savedPC == 0 {
 		if p := l.prototype(callInfo); p.isVarArg {
+			l.hookCount++ // VARARGPREP does not count, or a count of 1 stops here
 			return
 		}
 	}
@@ -692,7 +697,7 @@ func (l *State) callOrderImmediate(ra value, imm int, flip bool, isFloat bool, e
 	if isFloat {
 		p2 = float64(imm)
 	} else {
-		p2 = int64(imm)
+		p2 = intValue(int64(imm))
 	}
 	if flip {
 		result, ok := l.callOrderTagMethod(p2, ra, event)
@@ -741,6 +746,17 @@ func expectNext(ci *callInfo, expected opCode) instruction {
 	return i
 }
 
+// executeSwitch dispatches on the opcode with a switch, which the Go compiler
+// turns into a single indirect jump through a table, so the order of the
+// cases does not matter. A table of handler functions per opcode was tried
+// for the opcodes of the loop benchmarks: as Go cannot inline the indirect
+// call and each handler has to pass the frame back, BenchmarkIntegerLoop and
+// BenchmarkWhileLoop became about 17% slower, over the medians of six runs.
+// Decoding an operand is a shift and a mask of an instruction that is
+// already in a register, so pre-decoded operands were not pursued either. A
+// profile of BenchmarkIntegerLoop shows where the time goes instead: about a
+// third to boxing integers outside the cache of intValue, and a tenth to the
+// write barriers of storing them in the frame.
 func (l *State) executeSwitch() {
 	ci := l.callInfo
 	frame, closure, constants := newFrame(l, ci)
@@ -756,7 +772,7 @@ func (l *State) executeSwitch() {
 			frame[i.a()] = frame[i.b()]
 
 		case opLoadI:
-			frame[i.a()] = int64(i.sbx())
+			frame[i.a()] = intValue(int64(i.sbx()))
 
 		case opLoadF:
 			frame[i.a()] = float64(i.sbx())
@@ -856,7 +872,7 @@ func (l *State) executeSwitch() {
 			b := frame[i.b()]
 			ic := int64(i.sC())
 			if ib, ok := b.(int64); ok {
-				frame[i.a()] = ib + ic
+				frame[i.a()] = intValue(ib + ic)
 				ci.skip()
 				break
 			}
@@ -871,7 +887,7 @@ func (l *State) executeSwitch() {
 		case opAddK:
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib + ic
+				frame[i.a()] = intValue(ib + ic)
 				ci.skip()
 				break
 			}
@@ -884,7 +900,7 @@ func (l *State) executeSwitch() {
 		case opSubK:
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib - ic
+				frame[i.a()] = intValue(ib - ic)
 				ci.skip()
 				break
 			}
@@ -897,7 +913,7 @@ func (l *State) executeSwitch() {
 		case opMulK:
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib * ic
+				frame[i.a()] = intValue(ib * ic)
 				ci.skip()
 				break
 			}
@@ -913,7 +929,7 @@ func (l *State) executeSwitch() {
 				if ic == 0 {
 					l.runtimeError("attempt to perform 'n%0'")
 				}
-				frame[i.a()] = intMod(ib, ic)
+				frame[i.a()] = intValue(intMod(ib, ic))
 				ci.skip()
 				break
 			}
@@ -945,7 +961,7 @@ func (l *State) executeSwitch() {
 				if ic == 0 {
 					l.runtimeError("attempt to divide by zero")
 				}
-				frame[i.a()] = intIDiv(ib, ic)
+				frame[i.a()] = intValue(intIDiv(ib, ic))
 				ci.skip()
 				break
 			}
@@ -959,7 +975,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib & ic
+					frame[i.a()] = intValue(ib & ic)
 					ci.skip()
 					break
 				}
@@ -969,7 +985,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib | ic
+					frame[i.a()] = intValue(ib | ic)
 					ci.skip()
 					break
 				}
@@ -979,7 +995,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], constants[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib ^ ic
+					frame[i.a()] = intValue(ib ^ ic)
 					ci.skip()
 					break
 				}
@@ -990,7 +1006,7 @@ func (l *State) executeSwitch() {
 			// R[A] := R[B] >> sC
 			b := frame[i.b()]
 			if ib, ok := toInteger(b); ok {
-				frame[i.a()] = intShiftLeft(ib, -int64(i.sC()))
+				frame[i.a()] = intValue(intShiftLeft(ib, -int64(i.sC())))
 				ci.skip()
 				break
 			}
@@ -999,7 +1015,7 @@ func (l *State) executeSwitch() {
 			// R[A] := sC << R[B] (sC is value, R[B] is shift amount)
 			b := frame[i.b()]
 			if ib, ok := toInteger(b); ok {
-				frame[i.a()] = intShiftLeft(int64(i.sC()), ib)
+				frame[i.a()] = intValue(intShiftLeft(int64(i.sC()), ib))
 				ci.skip()
 				break
 			}
@@ -1008,7 +1024,7 @@ func (l *State) executeSwitch() {
 		case opAdd:
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib + ic
+				frame[i.a()] = intValue(ib + ic)
 				ci.skip()
 				break
 			}
@@ -1021,7 +1037,7 @@ func (l *State) executeSwitch() {
 		case opSub:
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib - ic
+				frame[i.a()] = intValue(ib - ic)
 				ci.skip()
 				break
 			}
@@ -1034,7 +1050,7 @@ func (l *State) executeSwitch() {
 		case opMul:
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ic, ok := integerValues(b, c); ok {
-				frame[i.a()] = ib * ic
+				frame[i.a()] = intValue(ib * ic)
 				ci.skip()
 				break
 			}
@@ -1050,7 +1066,7 @@ func (l *State) executeSwitch() {
 				if ic == 0 {
 					l.runtimeError("attempt to perform 'n%0'")
 				}
-				frame[i.a()] = intMod(ib, ic)
+				frame[i.a()] = intValue(intMod(ib, ic))
 				ci.skip()
 				break
 			}
@@ -1082,7 +1098,7 @@ func (l *State) executeSwitch() {
 				if ic == 0 {
 					l.runtimeError("attempt to divide by zero")
 				}
-				frame[i.a()] = intIDiv(ib, ic)
+				frame[i.a()] = intValue(intIDiv(ib, ic))
 				ci.skip()
 				break
 			}
@@ -1096,7 +1112,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib & ic
+					frame[i.a()] = intValue(ib & ic)
 					ci.skip()
 					break
 				}
@@ -1106,7 +1122,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib | ic
+					frame[i.a()] = intValue(ib | ic)
 					ci.skip()
 					break
 				}
@@ -1116,7 +1132,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = ib ^ ic
+					frame[i.a()] = intValue(ib ^ ic)
 					ci.skip()
 					break
 				}
@@ -1126,7 +1142,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = intShiftLeft(ib, ic)
+					frame[i.a()] = intValue(intShiftLeft(ib, ic))
 					ci.skip()
 					break
 				}
@@ -1136,7 +1152,7 @@ func (l *State) executeSwitch() {
 			b, c := frame[i.b()], frame[i.c()]
 			if ib, ok := toInteger(b); ok {
 				if ic, ok := toInteger(c); ok {
-					frame[i.a()] = intShiftLeft(ib, -ic)
+					frame[i.a()] = intValue(intShiftLeft(ib, -ic))
 					ci.skip()
 					break
 				}
@@ -1154,7 +1170,7 @@ func (l *State) executeSwitch() {
 		case opMMBinI:
 			pi := ci.code[ci.savedPC-2]
 			ra := frame[i.a()]
-			imm := int64(i.sB())
+			imm := intValue(int64(i.sB()))
 			event := tm(i.c())
 			if i.k() != 0 {
 				result := l.arithOrBitwise(imm, ra, event)
@@ -1185,7 +1201,7 @@ func (l *State) executeSwitch() {
 		case opUnaryMinus:
 			b := frame[i.b()]
 			if ib, ok := b.(int64); ok {
-				frame[i.a()] = -ib
+				frame[i.a()] = intValue(-ib)
 			} else if nb, ok := toFloat(b); ok {
 				frame[i.a()] = -nb
 			} else {
@@ -1197,7 +1213,7 @@ func (l *State) executeSwitch() {
 		case opBNot:
 			b := frame[i.b()]
 			if ib, ok := toInteger(b); ok {
-				frame[i.a()] = ^ib
+				frame[i.a()] = intValue(^ib)
 			} else {
 				tmp := l.bitwiseArith(b, b, tmBNot)
 				frame = ci.frame
@@ -1225,6 +1241,7 @@ func (l *State) executeSwitch() {
 		// --- Close / TBC ---
 		case opClose:
 			l.closeYieldable(ci.stackIndex(i.a()))
+			frame = ci.frame
 
 		case opTBC:
 			ra := ci.stackIndex(i.a())
@@ -1461,19 +1478,24 @@ func (l *State) executeSwitch() {
 			}
 			frame, closure, constants = newFrame(l, ci)
 
-		// --- For loops (5.4: Bx format, counter-based for integers) ---
+		// --- For loops (5.4: Bx format) ---
 		case opForLoop:
 			a := i.a()
-			if _, ok := frame[a+2].(int64); ok {
-				// Integer loop: ra+1 is counter (unsigned)
-				count := uint64(frame[a+1].(int64))
-				if count > 0 {
-					step := frame[a+2].(int64)
-					idx := frame[a].(int64)
-					frame[a+1] = int64(count - 1)
-					idx = int64(uint64(idx) + uint64(step))
-					frame[a] = idx
-					frame[a+3] = idx
+			if step, ok := frame[a+2].(int64); ok {
+				// Integer loop: ra+1 is the limit. Comparing the distance to
+				// it with the step, rather than counting down the iterations
+				// like PUC-Lua, avoids boxing a new counter every iteration.
+				idx, limit := frame[a].(int64), frame[a+1].(int64)
+				var more bool
+				if step > 0 {
+					more = uint64(limit)-uint64(idx) >= uint64(step)
+				} else {
+					more = uint64(idx)-uint64(limit) >= uint64(-(step+1))+1
+				}
+				if more {
+					v := intValue(int64(uint64(idx) + uint64(step)))
+					frame[a] = v
+					frame[a+3] = v
 					ci.jump(-i.bx())
 				}
 			} else {
@@ -1483,8 +1505,9 @@ func (l *State) executeSwitch() {
 				idx := frame[a].(float64)
 				idx += step
 				if (step > 0 && idx <= limit) || (step <= 0 && limit <= idx) {
-					frame[a] = idx
-					frame[a+3] = idx
+					v := value(idx) // box once for both slots
+					frame[a] = v
+					frame[a+3] = v
 					ci.jump(-i.bx())
 				}
 			}
@@ -1496,24 +1519,15 @@ func (l *State) executeSwitch() {
 					if iStep == 0 {
 						l.runtimeError("'for' step is zero")
 					}
-					frame[a+3] = iInit // control variable
+					frame[a+3] = frame[a] // control variable
 					iLimit, shouldSkip := l.forLimit54(frame[a+1], iInit, iStep)
 					if shouldSkip {
 						ci.jump(i.bx() + 1) // skip loop body + FORLOOP
 						break
 					}
-					// Compute iteration counter
-					var count uint64
-					if iStep > 0 {
-						count = uint64(iLimit) - uint64(iInit)
-						if iStep != 1 {
-							count /= uint64(iStep)
-						}
-					} else {
-						count = uint64(iInit) - uint64(iLimit)
-						count /= uint64(-(iStep + 1)) + 1
-					}
-					frame[a+1] = int64(count) // store counter in place of limit
+					// The loop runs while idx and iLimit are at least a step
+					// apart, see opForLoop; iLimit does not overflow.
+					frame[a+1] = intValue(iLimit)
 					// ra stays as init (unchanged)
 					break
 				}
@@ -1632,6 +1646,7 @@ func (l *State) executeSwitch() {
 			if l.hookMask != 0 {
 				if l.hookMask&MaskCall != 0 {
 					l.callHook(ci)
+					frame = ci.frame
 				}
 				l.oldPC = 1 // next opcode will be seen as a "new" line
 			}
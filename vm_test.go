@@ -2,6 +2,8 @@ package lua
 
 import (
 	"fmt"
+	"math"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -10,6 +12,23 @@ import (
 
 func testString(t *testing.T, s string) { testStringHelper(t, s, false) }
 
+// skipWithoutOS skips a test that uses the io or os library or reads
+// files, which builds with the lua_noos tag leave out.
+func skipWithoutOS(t *testing.T) {
+	if len(osLibraries) == 0 {
+		t.Skip("no io and os libraries with lua_noos")
+	}
+}
+
+// skipWithoutCommands skips a test that runs commands, which WebAssembly
+// and builds with the lua_noos tag cannot.
+func skipWithoutCommands(t *testing.T) {
+	skipWithoutOS(t)
+	if runtime.GOOS == "js" || runtime.GOOS == "wasip1" {
+		t.Skip("no commands in WebAssembly")
+	}
+}
+
 // Commented out to avoid a warning relating to the method not being used. Left
 // here since it's useful for debugging.
 // func traceString(t *testing.T, s string) { testStringHelper(t, s, true) }
@@ -30,12 +49,7 @@ func testStringHelper(t *testing.T, s string, trace bool) {
 	OpenLibraries(l)
 	LoadString(l, s)
 	if trace {
-		SetDebugHook(l, func(state *State, ar Debug) {
-			ci := state.callInfo
-			p := state.prototype(ci)
-			println(stack(state.stack[ci.base():state.top]))
-			println(ci.code[ci.savedPC].String(), p.source, p.lineInfo[ci.savedPC])
-		}, MaskCount, 1)
+		SetTraceWriter(l, os.Stderr, TraceOptions{})
 	}
 	l.Call(0, 0)
 }
@@ -52,13 +66,27 @@ func TestProtectedCall(t *testing.T) {
 	l.Call(0, 0)
 }
 
+func TestCountHookSkipsVarArgPrep(t *testing.T) {
+	l := NewState()
+	count := 0
+	SetDebugHook(l, func(l *State, ar Debug) { count++ }, MaskCount, 1)
+	LoadString(l, "local a = 1 local b = 2 local c = 3")
+	l.Call(0, 0)
+	// As in C Lua, the VARARGPREP of the chunk is not counted: the hook
+	// sees three LOADIs and the RETURN.
+	if count != 4 {
+		t.Errorf("count hook called %d times, want 4", count)
+	}
+}
+
 func TestLua(t *testing.T) {
+	skipWithoutOS(t)
 	tests := []struct {
 		name    string
 		nonPort bool
 	}{
 		// {name: "attrib"},     // Requires debug.getinfo, weak references
-		// {name: "big"},         // EXTRAARG handling issue with large (>2^18 element) tables
+		// {name: "big"},         // yields at the top level; see TestBig
 		{name: "bitwise"},
 		{name: "calls"},
 		{name: "closure"},
@@ -82,7 +110,7 @@ func TestLua(t *testing.T) {
 		{name: "tpack"}, // Lua 5.4: string.pack/unpack tests
 		{name: "utf8"},  // Lua 5.4: utf8 library tests
 		{name: "vararg"},
-		// {name: "verybig"},     // Very slow/memory intensive
+		{name: "verybig"}, // only the RK part with _soft; see TestVeryBig
 	}
 	for _, v := range tests {
 		if v.nonPort && runtime.GOOS == "windows" {
@@ -104,12 +132,7 @@ func TestLua(t *testing.T) {
 			l.PushBoolean(false)
 			l.SetGlobal("_port")
 		}
-		// l.SetDebugHook(func(state *State, ar Debug) {
-		// 	ci := state.callInfo.(*luaCallInfo)
-		// 	p := state.prototype(ci)
-		// 	println(stack(state.stack[ci.base():state.top]))
-		// 	println(ci.code[ci.savedPC].String(), p.source, p.lineInfo[ci.savedPC])
-		// }, MaskCount, 1)
+		// SetTraceWriter(l, os.Stderr, TraceOptions{})
 		l.Global("debug")
 		l.Field(-1, "traceback")
 		traceback := l.Top()
@@ -124,6 +147,46 @@ func TestLua(t *testing.T) {
 	}
 }
 
+// TestBig runs big.lua the way all.lua does, in a coroutine and without
+// _soft, so that it compiles a table constructor with more than 2^18
+// elements and more constants than fit in an instruction.
+func TestBig(t *testing.T) {
+	skipWithoutOS(t)
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		local f = coroutine.wrap(assert(loadfile("lua-tests/big.lua")))
+		assert(f() == "b")
+		assert(f() == "a")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVeryBig runs all of verybig.lua, which compiles a chunk of more than
+// 64k lines, and checks that functions beyond the register limit fail to
+// compile instead of producing broken code.
+func TestVeryBig(t *testing.T) {
+	skipWithoutOS(t)
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+		assert(dofile("lua-tests/verybig.lua") == 10)
+
+		local f, err = load("a = f(x" .. string.rep(",x", 260) .. ")")
+		assert(not f and err:find("too many registers", 1, true), err)
+
+		-- method calls and stores whose constant doesn't fit in an instruction
+		local src = {"local b = {"}
+		for i = 1, 300 do src[#src + 1] = "a" .. i .. " = " .. i .. ".5," end
+		src[#src + 1] = "}; function b:m(x, y) return x + y end; b.z = 'zz'; return b:m(10, 12), b.z"
+		local s, z = assert(load(table.concat(src)))()
+		assert(s == 22 and z == "zz")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func benchmarkSort(b *testing.B, program string) {
 	l := NewState()
 	OpenLibraries(l)
@@ -147,6 +210,146 @@ func BenchmarkSort2(b *testing.B) {
 	benchmarkSort(b, "i = 0; table.sort(a, function(x,y) i=i+1; return y<x end)")
 }
 
+func BenchmarkConcat(b *testing.B) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `a = {} for i = 1, 100000 do a[i] = i % 3 == 0 and i or "x" .. i end`); err != nil {
+		b.Fatal(err)
+	}
+	LoadString(l, `return table.concat(a, ", ")`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.PushValue(-1)
+		if err := l.ProtectedCall(0, 1, 0); err != nil {
+			b.Fatal(err)
+		}
+		l.Pop(1)
+	}
+}
+
+func BenchmarkInsertRemove(b *testing.B) {
+	l := NewState()
+	OpenLibraries(l)
+	LoadString(l, `
+		local a = {}
+		for i = 1, 1000 do table.insert(a, i) end
+		for i = 1, 100 do table.insert(a, 1, i) end
+		for i = 1, 100 do table.remove(a, 1) end
+		table.move(a, 1, #a, 2)
+		while #a > 0 do table.remove(a) end`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.PushValue(-1)
+		if err := l.ProtectedCall(0, 0, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkChunk measures running program, which is compiled once.
+func benchmarkChunk(b *testing.B, program string) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := LoadString(l, program); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.PushValue(-1)
+		if err := l.ProtectedCall(0, 0, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	benchmarkChunk(b, `
+		local t, s = {1, 2, 3, 4, 5, 6, 7, 8}, 0
+		for i = 1, 1000 do
+			local a, b, c = table.unpack(t)
+			s = s + a + b + c + #tostring(i)
+		end`)
+}
+
+func BenchmarkTableFields(b *testing.B) {
+	benchmarkChunk(b, `
+		local p = {x = 1, y = 2, z = 3, name = "point", visible = true}
+		for i = 1, 1000 do
+			p.x = p.x + p.y * p.z
+			p.visible = not p.visible
+			if p.name ~= "point" then error("name") end
+		end`)
+}
+
+func BenchmarkTableStringKeys(b *testing.B) {
+	benchmarkChunk(b, `
+		local t, keys = {}, {}
+		for i = 1, 1000 do keys[i] = "key" .. i end
+		for i = 1, 1000 do t[keys[i]] = i end
+		local s = 0
+		for i = 1, 1000 do s = s + t[keys[i]] end
+		for k, v in pairs(t) do s = s + v end
+		for i = 1, 1000, 2 do t[keys[i]] = nil end`)
+}
+
+func BenchmarkTableSparseKeys(b *testing.B) {
+	benchmarkChunk(b, `
+		local t = {}
+		for i = 1, 1000 do t[i * 7919] = i; t[-i] = i; t[i + 0.5] = i end
+		local s = 0
+		for i = 1, 1000 do s = s + t[i * 7919] + t[-i] + t[i + 0.5] end
+		for k in pairs(t) do t[k] = nil end`)
+}
+
+func BenchmarkIntegerLoop(b *testing.B) {
+	benchmarkChunk(b, `
+		local s = 0
+		for i = 1, 10000 do
+			if i % 3 == 0 then s = s + i * 2 else s = s - 1 end
+		end`)
+}
+
+func BenchmarkFloatLoop(b *testing.B) {
+	benchmarkChunk(b, `
+		local x, y = 0.0, 1.5
+		for i = 1, 10000 do
+			x = x * 0.5 + y / 3
+			if x > 100.0 then x = 0.0 end
+		end`)
+}
+
+func BenchmarkWhileLoop(b *testing.B) {
+	benchmarkChunk(b, `
+		local i, n = 0, 0
+		while i < 10000 do
+			i = i + 1
+			if i <= 5000 and i ~= 17 then n = n + 1 end
+		end`)
+}
+
+func BenchmarkCalls(b *testing.B) {
+	benchmarkChunk(b, `
+		local function add(a, b) return a + b end
+		local s = 0
+		for i = 1, 1000 do s = add(s, i) end`)
+}
+
+func BenchmarkClosures(b *testing.B) {
+	benchmarkChunk(b, `
+		local s = 0
+		for i = 1, 1000 do
+			local x = i
+			local f = function() x = x + 1 return x end
+			s = s + f()
+		end`)
+}
+
+func BenchmarkProtectedCalls(b *testing.B) {
+	benchmarkChunk(b, `
+		local function f(a) return a end
+		for i = 1, 1000 do pcall(f, i) end`)
+}
+
 func BenchmarkFibonnaci(b *testing.B) {
 	l := NewState()
 	s := `return function(n)
@@ -1302,3 +1505,70 @@ func TestCoroutineBasicGoAPI(t *testing.T) {
 		t.Fatalf("expected (10, 20), got (%d, %d)", v1, v2)
 	}
 }
+
+func TestIntValue(t *testing.T) {
+	for _, i := range []int64{minCachedInt - 1, minCachedInt, -1, 0, 255, 256, maxCachedInt, maxCachedInt + 1, math.MinInt64, math.MaxInt64} {
+		if v, ok := intValue(i).(int64); !ok || v != i {
+			t.Errorf("intValue(%d) = %v", i, intValue(i))
+		}
+	}
+	testString(t, `
+		local s = 0
+		for i = -300, 5000 do s = s + i end
+		assert(s == (5000 * 5001 - 300 * 301) // 2)
+		for i = math.maxinteger - 2, math.maxinteger do s = i end
+		assert(s == math.maxinteger)
+		assert(4095 + 1 == 4096 and -256 - 1 == -257 and 64 * 64 == 4096)
+	`)
+}
+
+func TestIntegerForLoopBounds(t *testing.T) {
+	testString(t, `
+		local function count(a, b, c)
+			local n, last = 0, nil
+			for i = a, b, c do n = n + 1; last = i end
+			return n, last
+		end
+		local max, min = math.maxinteger, math.mininteger
+		assert(select(1, count(1, 10, 3)) == 4 and select(2, count(1, 10, 3)) == 10)
+		assert(count(10, 1, -3) == 4 and select(2, count(10, 1, -3)) == 1)
+		assert(count(max - 2, max, 1) == 3 and select(2, count(max - 2, max, 1)) == max)
+		assert(count(min + 2, min, -1) == 3 and select(2, count(min + 2, min, -1)) == min)
+		assert(count(min, max, max) == 3 and count(max, min, min) == 2)
+		assert(count(0, max, max) == 2 and count(1, 0, 1) == 0 and count(0, 1, -1) == 0)
+		assert(count(1, 3.7, 1) == 3 and count(3, 1.5, -1) == 2)
+	`)
+}
+
+// TestHotPathAllocations pins down that the VM runs common code without
+// allocating, as long as the numbers stay in the range that intValue caches.
+// The escape analysis report of the hot paths is in benchmarks/escape.txt;
+// see the Makefile.
+func TestHotPathAllocations(t *testing.T) {
+	tests := []struct{ name, code string }{
+		{"integer loop", "local s = 0 for i = 1, 100 do s = s + i % 7 end"},
+		{"while loop", "local i = 0 while i < 100 do i = i + 1 end"},
+		{"calls", "local function add(a, b) return a + b end local s = 0 for i = 1, 50 do s = add(i, 1) end"},
+		{"pcall", "local f = function() end for i = 1, 50 do pcall(f) end"},
+		{"table access", "T = T or {1, 2, 3, x = 4} local t = T for i = 1, 50 do t[i % 3 + 1] = t.x + t[1] end"},
+		{"comparisons", "local n = 0 for i = 1, 100 do if i < 50 and i ~= 7 or i >= 90 then n = n + 1 end end"},
+	}
+	l := NewState()
+	OpenLibraries(l)
+	for _, tt := range tests {
+		if err := LoadString(l, tt.code); err != nil {
+			t.Fatal(err)
+		}
+		run := func() {
+			l.PushValue(-1)
+			if err := l.ProtectedCall(0, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		run() // let the stack grow
+		if n := testing.AllocsPerRun(10, run); n != 0 {
+			t.Errorf("%s: %v allocations per run", tt.name, n)
+		}
+		l.Pop(1)
+	}
+}